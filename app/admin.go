@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Admin toggles let learners change how the pod looks to Kubernetes
+// without killing the process.
+
+// healthOverride forces the liveness probe to fail for a while
+type healthOverride struct {
+	mu      sync.Mutex
+	failing bool
+	until   time.Time // zero: fail until explicitly recovered
+}
+
+var liveness = &healthOverride{}
+
+// Failing reports whether /health should fail right now, clearing an
+// expired override (the auto-recover timer)
+func (h *healthOverride) Failing() (bool, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failing && !h.until.IsZero() && time.Now().After(h.until) {
+		h.failing = false
+		slog.Info("liveness failure window ended, /health recovered")
+	}
+	return h.failing, h.until
+}
+
+// HealthOverrideStatus is returned by the /admin/health endpoints
+type HealthOverrideStatus struct {
+	Failing    bool       `json:"failing"`
+	RecoversAt *time.Time `json:"recovers_at,omitempty"`
+}
+
+func (h *healthOverride) status() HealthOverrideStatus {
+	failing, until := h.Failing()
+	status := HealthOverrideStatus{Failing: failing}
+	if failing && !until.IsZero() {
+		status.RecoversAt = &until
+	}
+	return status
+}
+
+// healthFailHandler makes /health return 500, e.g.
+// curl -X POST 'localhost:8080/admin/health/fail?duration=2m'
+// Without duration it fails until /admin/health/recover is called. With
+// the default probe settings kubelet restarts the container after ~30s.
+func healthFailHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	var until time.Time
+	if v := r.URL.Query().Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeProblem(w, r, http.StatusBadRequest, "duration must be a positive Go duration like 90s or 2m")
+			return
+		}
+		until = time.Now().Add(d)
+	}
+
+	liveness.mu.Lock()
+	liveness.failing = true
+	liveness.until = until
+	liveness.mu.Unlock()
+	slog.Warn("liveness failure injected", "until", until)
+
+	writeJSON(w, http.StatusOK, liveness.status())
+}
+
+// healthRecoverHandler ends an injected liveness failure
+func healthRecoverHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	liveness.mu.Lock()
+	liveness.failing = false
+	liveness.until = time.Time{}
+	liveness.mu.Unlock()
+	slog.Info("liveness failure cleared")
+
+	writeJSON(w, http.StatusOK, liveness.status())
+}
+
+// readinessOverride takes the pod out of Service endpoints on request. The
+// process keeps running and serving, it just stops receiving new traffic
+// through the Service - the same thing kubectl drain relies on, minus the
+// eviction:
+//
+//	curl -X POST localhost:9090/admin/ready/disable
+//	kubectl get endpointslices -l kubernetes.io/service-name=go-app -w
+type readinessOverride struct {
+	mu       sync.Mutex
+	disabled bool
+	changed  time.Time // zero until first toggled
+}
+
+var readyOverride = &readinessOverride{}
+
+// ReadyToggle is the admin toggle's state, reported by /ready and the
+// /admin/ready endpoints
+type ReadyToggle struct {
+	Enabled   bool       `json:"enabled"`
+	ChangedAt *time.Time `json:"changed_at,omitempty"`
+}
+
+func (o *readinessOverride) Disabled() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.disabled
+}
+
+func (o *readinessOverride) status() ReadyToggle {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	toggle := ReadyToggle{Enabled: !o.disabled}
+	if !o.changed.IsZero() {
+		changed := o.changed
+		toggle.ChangedAt = &changed
+	}
+	return toggle
+}
+
+func (o *readinessOverride) set(disabled bool) {
+	o.mu.Lock()
+	o.disabled, o.changed = disabled, time.Now()
+	o.mu.Unlock()
+}
+
+// readyDisableHandler makes /ready fail until /admin/ready/enable
+func readyDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	readyOverride.set(true)
+	slog.Warn("readiness disabled by admin, leaving Service endpoints")
+	podEvents.Record("Warning", "ReadinessDisabled", "/admin/ready/disable: /ready fails, the pod leaves Service endpoints")
+	writeJSON(w, http.StatusOK, readyOverride.status())
+}
+
+// readyEnableHandler lets /ready pass again
+func readyEnableHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	readyOverride.set(false)
+	slog.Info("readiness re-enabled by admin")
+	podEvents.Record("Normal", "ReadinessEnabled", "/admin/ready/enable: /ready passes again")
+	writeJSON(w, http.StatusOK, readyOverride.status())
+}
+
+// requireMethod writes a 405 and returns false unless r uses method
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeProblem(w, r, http.StatusMethodNotAllowed, "use "+method)
+	return false
+}
+
+// movedToAdminHandler answers admin paths requested on the app port with a
+// pointer to the admin listener, rather than the home page
+func movedToAdminHandler(adminPort string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusNotFound, "served on the admin port :"+adminPort+" (ADMIN_PORT)")
+	}
+}
+
+// serveAdmin listens on addr for the admin endpoints until the process
+// exits. Fatal if the port can't be opened.
+func serveAdmin(addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		if err := listenAndServe(srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("admin server failed", "addr", addr, "error", err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// /api/session makes session affinity visible. The first request gets a
+// cookie naming the pod that served it; every later one reports whether
+// it landed on the same pod as the request before, and moves the cookie
+// to the pod that answered:
+//
+//	curl -s -c /tmp/jar -b /tmp/jar localhost:30080/api/session   # a few times
+//
+// With the Service's default sessionAffinity: None, consecutive requests
+// (on new connections, as curl makes) spread across pods and most are
+// misses. sessionAffinity: ClientIP pins a client IP to one pod, and the
+// Ingress's cookie affinity (k8s/advanced/ingress.yaml) pins a browser:
+// every request after the first is a hit. kubectl port-forward always
+// hits, since it tunnels to a single pod.
+//
+// Hits and misses are counted per pod (session_affinity_requests_total),
+// so sum them across pods for the cluster's hit rate. ?reset=true starts
+// a new session.
+
+const affinityCookie = "go_app_session_pod"
+
+var affinityRequests = newCounterVec("session_affinity_requests_total",
+	"/api/session requests by result: new session, hit (same pod as the last request) or miss.", "result")
+
+// affinityTotals are this pod's counts, for the response
+var affinityTotals struct{ sessions, hits, misses atomic.Int64 }
+
+// SessionAffinity is returned by /api/session
+type SessionAffinity struct {
+	SessionID   string    `json:"session_id"`
+	Pod         string    `json:"pod"`                    // the pod that served this request
+	PreviousPod string    `json:"previous_pod,omitempty"` // the pod that served the one before
+	IssuedBy    string    `json:"issued_by"`              // the pod that started the session
+	NewSession  bool      `json:"new_session"`
+	SamePod     bool      `json:"same_pod"`
+	Requests    int       `json:"requests"` // in this session, this one included
+	Started     time.Time `json:"started"`
+	Client      string    `json:"client"`
+	PodTotals   struct {
+		Sessions int64 `json:"sessions"`
+		Hits     int64 `json:"hits"`
+		Misses   int64 `json:"misses"`
+	} `json:"pod_totals"`
+}
+
+// affinityState is what the cookie carries: id|issued-by|last-pod|requests|started
+type affinityState struct {
+	id, issuedBy, lastPod string
+	requests              int
+	started               time.Time
+}
+
+func parseAffinityCookie(r *http.Request) (affinityState, bool) {
+	c, err := r.Cookie(affinityCookie)
+	if err != nil {
+		return affinityState{}, false
+	}
+	parts := strings.Split(c.Value, "|")
+	if len(parts) != 5 {
+		return affinityState{}, false
+	}
+	n, err := strconv.Atoi(parts[3])
+	started, err2 := strconv.ParseInt(parts[4], 10, 64)
+	if err != nil || err2 != nil || parts[0] == "" {
+		return affinityState{}, false
+	}
+	return affinityState{id: parts[0], issuedBy: parts[1], lastPod: parts[2], requests: n, started: time.Unix(started, 0).UTC()}, true
+}
+
+func (s affinityState) cookieValue() string {
+	return strings.Join([]string{s.id, s.issuedBy, s.lastPod, strconv.Itoa(s.requests), strconv.FormatInt(s.started.Unix(), 10)}, "|")
+}
+
+func sessionAffinityHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	hostname, _ := os.Hostname()
+	state, ok := parseAffinityCookie(r)
+	if r.URL.Query().Get("reset") == "true" {
+		ok = false
+	}
+	resp := SessionAffinity{Pod: hostname, Client: r.RemoteAddr}
+	if !ok {
+		state = affinityState{id: randomToken()[:16], issuedBy: hostname, started: time.Now().UTC().Truncate(time.Second)}
+		resp.NewSession = true
+		affinityRequests.Inc("new")
+		affinityTotals.sessions.Add(1)
+	} else {
+		resp.PreviousPod = state.lastPod
+		resp.SamePod = state.lastPod == hostname
+		if resp.SamePod {
+			affinityRequests.Inc("hit")
+			affinityTotals.hits.Add(1)
+		} else {
+			affinityRequests.Inc("miss")
+			affinityTotals.misses.Add(1)
+		}
+	}
+	state.lastPod = hostname
+	state.requests++
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     affinityCookie,
+		Value:    state.cookieValue(),
+		Path:     "/api/session",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	resp.SessionID, resp.IssuedBy, resp.Requests, resp.Started = state.id, state.issuedBy, state.requests, state.started
+	resp.PodTotals.Sessions = affinityTotals.sessions.Load()
+	resp.PodTotals.Hits = affinityTotals.hits.Load()
+	resp.PodTotals.Misses = affinityTotals.misses.Load()
+	w.Header().Set("Cache-Control", "no-store") // a cached answer would hide the pod
+	writeJSON(w, http.StatusOK, resp)
+}
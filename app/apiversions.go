@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/version"
+)
+
+// Two versions of the info API, for canary and blue/green practice. v1 is
+// /api/info under a versioned path; v2 regroups the same data. Run the old
+// and new Deployments side by side with APP_VERSION=1.x and 2.x and the
+// split is visible in curl output and on the homepage, whose accent color
+// follows the major version (see theme.go):
+//
+//	for i in $(seq 20); do curl -s go-app/api/info | jq -r .version; done | sort | uniq -c
+
+// InfoV2 is returned by /api/v2/info
+type InfoV2 struct {
+	APIVersion string       `json:"api_version"`
+	App        InfoV2App    `json:"app"`
+	Pod        InfoV2Pod    `json:"pod"`
+	Message    string       `json:"message,omitempty"`
+	Visits     *VisitCounts `json:"visits,omitempty"`
+	ServedAt   time.Time    `json:"served_at"`
+}
+
+// InfoV2App identifies the build
+type InfoV2App struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Major     int    `json:"major"`
+	GitCommit string `json:"git_commit,omitempty"`
+	Color     string `json:"color"`
+	Track     string `json:"track"`
+}
+
+// InfoV2Pod is where the request was served
+type InfoV2Pod struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Node      string `json:"node,omitempty"`
+	Zone      string `json:"zone,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Color     string `json:"color"` // hashed from the name, see podColor
+}
+
+// majorVersion is the leading number of a version like "v2.1.0", or 1
+func majorVersion(version string) int {
+	head, _, _ := strings.Cut(strings.TrimPrefix(version, "v"), ".")
+	major, err := strconv.Atoi(head)
+	if err != nil || major < 1 {
+		return 1
+	}
+	return major
+}
+
+func apiInfoV2Handler(appName, appVersion string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pod := readPodInfo()
+		if pod.Name == "" {
+			pod.Name, _ = os.Hostname()
+		}
+		writeJSON(w, http.StatusOK, InfoV2{
+			APIVersion: "v2",
+			App: InfoV2App{
+				Name:      appName,
+				Version:   appVersion,
+				Major:     majorVersion(appVersion),
+				GitCommit: version.Short(buildInfo().GitCommit),
+				Color:     currentTheme().Color,
+				Track:     deploymentTrack(),
+			},
+			Pod: InfoV2Pod{
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+				IP:        pod.IP,
+				Node:      pod.Node,
+				Zone:      topology().Zone,
+				Region:    topology().Region,
+				Color:     currentPodColor(),
+			},
+			Message:  appMessage(),
+			Visits:   currentVisits(r.Context()),
+			ServedAt: time.Now(),
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/middleware"
+)
+
+// An audit trail for the calls that change the pod: every /chaos trigger
+// and every /admin call that isn't a read. Each is one JSON line on its own
+// stream, apart from the application and access logs, so it can be kept
+// and shipped on its own terms, and the last few hundred are in memory:
+//
+//	AUDIT_LOG=stderr              stdout, stderr, or a file (rotated like ACCESS_LOG_FILE)
+//	curl localhost:9090/admin/audit?limit=20
+//
+// who is the basic-auth user (ADMIN_PASSWORD), the JWT subject or the
+// client certificate's CN, and "anonymous" otherwise - which is the point
+// to make: without auth in front of the admin surface the trail can only
+// say which IP did it. Requests rejected by auth are recorded too, with the
+// user they claimed to be and result "denied".
+
+// keptAuditEntries bounds the entries /admin/audit can return
+const keptAuditEntries = 500
+
+// AuditEntry is one recorded action
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Who        string    `json:"who"`
+	AuthMethod string    `json:"auth_method"` // basic, jwt, mtls or none
+	Remote     string    `json:"remote"`
+	Method     string    `json:"method"`
+	Action     string    `json:"action"` // the route
+	Query      string    `json:"query,omitempty"`
+	Status     int       `json:"status"`
+	Result     string    `json:"result"` // ok, denied or failed
+	DurationMS float64   `json:"duration_ms"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Pod        string    `json:"pod"`
+}
+
+// AuditResponse is returned by /admin/audit
+type AuditResponse struct {
+	Destination string       `json:"destination"`
+	Total       int64        `json:"total"`
+	Entries     []AuditEntry `json:"entries"` // newest first
+}
+
+var (
+	auditLogger      = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	auditDestination = "stderr"
+
+	auditMu      sync.Mutex
+	auditEntries []AuditEntry
+	auditTotal   int64
+
+	auditEvents = newCounterVec("audit_events_total", "Audited admin and chaos actions, by result (ok, denied, failed).", "result")
+)
+
+// setupAuditLog points the audit trail at stdout, stderr or a file. Its
+// level is fixed: LOG_LEVEL=error must not silence it.
+func setupAuditLog(dest string) error {
+	out := os.Stderr
+	switch dest {
+	case "stderr":
+	case "stdout":
+		out = os.Stdout
+	default:
+		f, err := openRotatingFile(dest, getEnvInt("AUDIT_LOG_MAX_BYTES", 10<<20))
+		if err != nil {
+			return err
+		}
+		auditLogger, auditDestination = slog.New(slog.NewJSONHandler(f, nil)), dest
+		return nil
+	}
+	auditLogger, auditDestination = slog.New(slog.NewJSONHandler(out, nil)), dest
+	return nil
+}
+
+// audited reports whether r changes something: any /chaos trigger, and
+// /admin calls other than reads
+func audited(pattern string, r *http.Request) bool {
+	switch {
+	case strings.HasPrefix(pattern, "/chaos/"):
+		return true
+	case !strings.HasPrefix(pattern, "/admin/"):
+		return false
+	case pattern == "/admin/drain" && r.URL.Query().Get("start") == "true":
+		return true
+	}
+	return r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+}
+
+// auditActions records audited requests once they're answered. It sits
+// inside JWT auth, to know the subject, and outside basic auth, to see
+// what it turns away.
+func auditActions(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if pattern != "/chaos" && !strings.HasPrefix(pattern, "/chaos/") && !strings.HasPrefix(pattern, "/admin/") {
+		return next
+	}
+	hostname, _ := os.Hostname()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !audited(pattern, r) {
+			next(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &middleware.Recorder{ResponseWriter: w}
+		entry := AuditEntry{Method: r.Method, Action: pattern, Query: r.URL.RawQuery, Remote: r.RemoteAddr,
+			RequestID: requestIDFromContext(r.Context()), Pod: hostname}
+		entry.Who, entry.AuthMethod = auditActor(r)
+		if pattern == "/chaos/crash" && r.Method == http.MethodPost && adminAllowed(r) {
+			// Recorded first: on success the process is gone
+			entry.Status = http.StatusOK
+			recordAudit(entry, start)
+			next(w, r)
+			return
+		}
+		defer func() {
+			if v := recover(); v != nil { // /chaos/panic, recorded as the 500 it becomes
+				entry.Status = http.StatusInternalServerError
+				recordAudit(entry, start)
+				panic(v)
+			}
+			entry.Status = cmp.Or(rec.Status, http.StatusOK)
+			recordAudit(entry, start)
+		}()
+		next(rec, r)
+	}
+}
+
+// auditActor names who made r and how they proved it
+func auditActor(r *http.Request) (who, method string) {
+	if t := jwtFromContext(r.Context()); t != nil {
+		return t.Claims.Subject, "jwt"
+	}
+	if cn := clientCommonName(r); cn != "" {
+		return cn, "mtls"
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return user, "basic"
+	}
+	return "anonymous", "none"
+}
+
+func recordAudit(e AuditEntry, start time.Time) {
+	e.Time = start.UTC()
+	e.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+	switch {
+	case e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden:
+		e.Result = "denied"
+	case e.Status >= 400:
+		e.Result = "failed"
+	default:
+		e.Result = "ok"
+	}
+	auditEvents.Inc(e.Result)
+	auditLogger.Info("audit", "who", e.Who, "auth_method", e.AuthMethod, "remote", e.Remote, "method", e.Method,
+		"action", e.Action, "query", e.Query, "status", e.Status, "result", e.Result,
+		"duration_ms", e.DurationMS, "request_id", e.RequestID, "pod", e.Pod)
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditTotal++
+	auditEntries = append(auditEntries, e)
+	if len(auditEntries) > keptAuditEntries {
+		auditEntries = auditEntries[len(auditEntries)-keptAuditEntries:]
+	}
+}
+
+// auditHandler serves GET /admin/audit?limit=&who=&result=
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	limit := int64(100)
+	if r.URL.Query().Get("limit") != "" {
+		var ok bool
+		if limit, ok = queryInt(w, r, "limit", 1, keptAuditEntries); !ok {
+			return
+		}
+	}
+	who, result := r.URL.Query().Get("who"), r.URL.Query().Get("result")
+
+	auditMu.Lock()
+	resp := AuditResponse{Destination: auditDestination, Total: auditTotal, Entries: []AuditEntry{}}
+	for i := len(auditEntries) - 1; i >= 0 && int64(len(resp.Entries)) < limit; i-- {
+		e := auditEntries[i]
+		if (who == "" || e.Who == who) && (result == "" || e.Result == result) {
+			resp.Entries = append(resp.Entries, e)
+		}
+	}
+	auditMu.Unlock()
+	writeJSON(w, http.StatusOK, resp)
+}
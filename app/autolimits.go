@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+)
+
+// The Go runtime sizes itself to the machine, not the container. A pod
+// limited to 1 CPU on a 32-core node ran 32 Ps and got throttled (Go 1.25
+// fixed GOMAXPROCS, not the memory side), and the GC ignored memory.max
+// until the kernel OOM-killed the pod. At startup we read the container's
+// limits and set both:
+//
+//	GOMAXPROCS = ceil(CPU limit), at least 1
+//	GOMEMLIMIT = memory limit * GOMEMLIMIT_RATIO (0.9), leaving room for
+//	             stacks, buffers and whatever the GC can't free in time
+//
+// Limits come from cgroup files, else from the Downward API env
+// (CPU_LIMIT in millicores, MEMORY_LIMIT in bytes). GOMAXPROCS and
+// GOMEMLIMIT in the env always win, and AUTO_LIMITS=false turns this off.
+// The decision is logged and shown at /debug/runtime.
+
+// runtimeTuning records how GOMAXPROCS and GOMEMLIMIT were chosen
+type runtimeTuning struct {
+	GOMAXPROCS tuningDecision `json:"gomaxprocs"`
+	GOMEMLIMIT tuningDecision `json:"gomemlimit"`
+}
+
+// tuningDecision is one setting: its value and where it came from
+type tuningDecision struct {
+	Value  int64  `json:"value"`  // 0 for GOMEMLIMIT means unlimited
+	Source string `json:"source"` // env, cgroup, downward_api or default
+	Limit  string `json:"limit,omitempty"`
+}
+
+// runtimeTuned is the decision made at startup, for /debug/runtime
+var runtimeTuned *runtimeTuning
+
+// applyContainerLimits sets GOMAXPROCS and GOMEMLIMIT from the container's
+// limits, unless the env sets them, and logs what it did
+func applyContainerLimits() {
+	if !getEnvBool("AUTO_LIMITS", true) {
+		slog.Info("automatic runtime limits disabled", "gomaxprocs", runtime.GOMAXPROCS(0))
+		return
+	}
+	limits, err := readCgroupLimits(cgroupRoot)
+	if err != nil {
+		slog.Warn("cannot read cgroup limits", "error", err)
+	}
+	t := &runtimeTuning{
+		GOMAXPROCS: tuningDecision{Value: int64(runtime.GOMAXPROCS(0)), Source: "default"},
+		GOMEMLIMIT: tuningDecision{Source: "default"},
+	}
+
+	cores, cpuSource := limits.CPUCores, "cgroup"
+	if cores == 0 {
+		if milli, err := strconv.ParseInt(getEnv("CPU_LIMIT", ""), 10, 64); err == nil && milli > 0 {
+			cores, cpuSource = float64(milli)/1000, "downward_api"
+		}
+	}
+	switch {
+	case os.Getenv("GOMAXPROCS") != "":
+		t.GOMAXPROCS.Source = "env"
+	case cores > 0:
+		procs := min(max(int(math.Ceil(cores)), 1), runtime.NumCPU())
+		runtime.GOMAXPROCS(procs)
+		t.GOMAXPROCS = tuningDecision{Value: int64(procs), Source: cpuSource, Limit: strconv.FormatFloat(cores, 'f', -1, 64) + " cores"}
+	}
+
+	memory, memSource := limits.MemoryBytes, "cgroup"
+	if memory == 0 {
+		if b, err := strconv.ParseInt(getEnv("MEMORY_LIMIT", ""), 10, 64); err == nil && b > 0 {
+			memory, memSource = b, "downward_api"
+		}
+	}
+	switch {
+	case os.Getenv("GOMEMLIMIT") != "":
+		t.GOMEMLIMIT.Source = "env"
+		if v := debug.SetMemoryLimit(-1); v != math.MaxInt64 {
+			t.GOMEMLIMIT.Value = v
+		}
+	case memory > 0:
+		ratio := getEnvFloat("GOMEMLIMIT_RATIO", 0.9)
+		if ratio <= 0 || ratio > 1 {
+			slog.Warn("GOMEMLIMIT_RATIO must be in (0, 1], using 0.9", "value", ratio)
+			ratio = 0.9
+		}
+		limit := int64(float64(memory) * ratio)
+		debug.SetMemoryLimit(limit)
+		t.GOMEMLIMIT = tuningDecision{Value: limit, Source: memSource, Limit: strconv.FormatInt(memory, 10) + " bytes"}
+	}
+
+	runtimeTuned = t
+	slog.Info("runtime sized to container limits",
+		"gomaxprocs", t.GOMAXPROCS.Value, "gomaxprocs_source", t.GOMAXPROCS.Source,
+		"gomemlimit_bytes", t.GOMEMLIMIT.Value, "gomemlimit_source", t.GOMEMLIMIT.Source,
+		"num_cpu", runtime.NumCPU())
+}
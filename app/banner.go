@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"runtime"
+)
+
+// startupBanner summarizes the effective runtime configuration in a single
+// log event, so "why does this pod behave differently?" starts with one line
+type startupBanner struct {
+	App        string
+	Version    string
+	Port       string
+	GoVersion  string
+	GOMAXPROCS int
+	NumCPU     int
+	Limits     cgroupLimits
+	Features   map[string]bool
+}
+
+// newStartupBanner collects runtime and cgroup details for the banner
+func newStartupBanner(app, version, port string, features map[string]bool) startupBanner {
+	limits, err := readCgroupLimits(cgroupRoot)
+	if err != nil {
+		slog.Warn("could not read cgroup limits", "error", err)
+	}
+	return startupBanner{
+		App:        app,
+		Version:    version,
+		Port:       port,
+		GoVersion:  runtime.Version(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		NumCPU:     runtime.NumCPU(),
+		Limits:     limits,
+		Features:   features,
+	}
+}
+
+// logStartupBanner logs the banner and warns about GOMAXPROCS/CPU quota
+// mismatches. The Go runtime sizes GOMAXPROCS from the node's CPU count, not
+// the container's limit, so a 100m pod on a 16-core node runs 16 Ps and
+// spends most of each CFS period throttled.
+func logStartupBanner(b startupBanner) {
+	slog.Info("startup config",
+		"app", b.App,
+		"version", b.Version,
+		"port", b.Port,
+		"go_version", b.GoVersion,
+		"gomaxprocs", b.GOMAXPROCS,
+		"num_cpu", b.NumCPU,
+		"cgroup_limits", b.Limits,
+		"features", b.Features,
+	)
+
+	if b.Limits.CPUCores > 0 && float64(b.GOMAXPROCS) > math.Ceil(b.Limits.CPUCores) {
+		slog.Warn("GOMAXPROCS exceeds the CPU limit, expect throttling; set GOMAXPROCS or use go.uber.org/automaxprocs",
+			"gomaxprocs", b.GOMAXPROCS, "cpu_limit_cores", b.Limits.CPUCores)
+	}
+}
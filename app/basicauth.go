@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP basic auth for the dangerous endpoints, /admin/*, /chaos* and the
+// CPU and memory burners under /api/load/: on as soon as ADMIN_PASSWORD is
+// set, as an env var or a file in SECRETS_DIR (k8s/advanced/secret.yaml):
+//
+//	ADMIN_USER=admin         the default
+//	ADMIN_PASSWORD=...
+//
+//	curl -u admin:$ADMIN_PASSWORD -X POST localhost:9090/admin/ready/disable
+//	curl -u admin:$ADMIN_PASSWORD -X POST 'localhost:8080/chaos/latency?ms=500'
+//	curl -u admin:$ADMIN_PASSWORD -X POST 'localhost:8080/api/load/cpu?duration=30s'
+//
+// The credentials are read on every request, so a rotated Secret file
+// takes effect without a restart; if the file vanishes, requests are
+// refused rather than let through. Probes and /metrics stay open: the
+// kubelet and Prometheus would need the password too. A preStop httpGet
+// on /admin/drain can send it with httpHeaders (Authorization: Basic ...).
+
+// adminAuthRequired is set in main when ADMIN_PASSWORD is configured
+var adminAuthRequired bool
+
+var basicAuthResults = newCounterVec("http_basic_auth_results_total",
+	"Basic auth outcomes for /admin, /chaos and /api/load requests.", "result")
+
+// Wrong passwords are throttled per client whether or not rate limiting
+// is on, since /admin/* is exempt from it for the kubelet's preStop hook:
+// a client gets ADMIN_AUTH_FAILURES wrong guesses a minute (10), then a
+// 429 with Retry-After until the bucket refills, right password or not.
+// Only wrong credentials spend the bucket; a request without any, as a
+// browser sends before prompting, doesn't.
+
+// authThrottle keeps a bucket of wrong guesses per client
+type authThrottle struct {
+	mu      sync.Mutex
+	perMin  float64
+	clients map[string]*tokenBucket
+}
+
+// adminFailures is set in main along with adminAuthRequired
+var adminFailures *authThrottle
+
+func newAuthThrottle(perMinute int) *authThrottle {
+	return &authThrottle{perMin: float64(max(perMinute, 1)), clients: map[string]*tokenBucket{}}
+}
+
+// blocked reports how long client must wait, 0 when it may try
+func (t *authThrottle) blocked(client string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, found := t.clients[client]
+	if !found {
+		return 0
+	}
+	_, wait := b.ready(time.Now())
+	return wait
+}
+
+// failed spends one of client's guesses, forgetting the clients that have
+// refilled so the map doesn't keep every IP that ever guessed
+func (t *authThrottle) failed(client string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for key, b := range t.clients {
+		if b.full(now) {
+			delete(t.clients, key)
+		}
+	}
+	b, found := t.clients[client]
+	if !found {
+		b = newTokenBucket(t.perMin/60, t.perMin, now)
+		t.clients[client] = b
+	}
+	b.take(now)
+}
+
+// authClient keys the throttle like the rate limiter does, by IP
+func authClient(r *http.Request) string {
+	if limiter != nil {
+		return limiter.clientKey(r)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// adminCredentials returns the current user and password; ok is false
+// when no password is configured
+func adminCredentials() (user, password string, ok bool) {
+	password, ok = readSecret("ADMIN_PASSWORD")
+	if !ok || password == "" {
+		return "", "", false
+	}
+	if user, _ = readSecret("ADMIN_USER"); user == "" {
+		user = "admin"
+	}
+	return user, password, true
+}
+
+// credentialsMatch compares in constant time; hashing first hides the
+// lengths too
+func credentialsMatch(got, want string) bool {
+	g, w := sha256.Sum256([]byte(got)), sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(g[:], w[:]) == 1
+}
+
+// protectedPattern reports whether a route needs admin credentials. The
+// /api/load/ burners are in the set too: anyone reaching the Service could
+// otherwise pin the pod's CPU or memory, JWT or not.
+func protectedPattern(pattern string) bool {
+	return strings.HasPrefix(pattern, "/admin/") || pattern == "/chaos" || strings.HasPrefix(pattern, "/chaos/") ||
+		strings.HasPrefix(pattern, "/api/load/")
+}
+
+// requireBasicAuth guards /admin/*, /chaos* and /api/load/* when
+// ADMIN_PASSWORD is set
+func requireBasicAuth(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if !protectedPattern(pattern) {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthRequired {
+			next(w, r)
+			return
+		}
+		client := authClient(r)
+		if wait := adminFailures.blocked(client); wait > 0 {
+			basicAuthResults.Inc("throttled")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeProblem(w, r, http.StatusTooManyRequests, "too many failed admin logins; retry later")
+			return
+		}
+		if result, msg := checkAdminAuth(r); result != "ok" {
+			if result == "invalid" {
+				adminFailures.failed(client)
+			}
+			basicAuthResults.Inc(result)
+			slog.Warn("admin auth failed", "result", result, "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+			writeProblem(w, r, http.StatusUnauthorized, msg)
+			return
+		}
+		basicAuthResults.Inc("ok")
+		next(w, r)
+	}
+}
+
+// checkAdminAuth checks r's credentials, returning ok or why not
+func checkAdminAuth(r *http.Request) (result, msg string) {
+	wantUser, wantPassword, ok := adminCredentials()
+	if !ok {
+		return "unconfigured", "ADMIN_PASSWORD is no longer available; refusing admin requests"
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "missing", "basic auth credentials are required"
+	}
+	// both halves are always compared, so timing doesn't reveal which was wrong
+	userOK, passwordOK := credentialsMatch(user, wantUser), credentialsMatch(password, wantPassword)
+	if !userOK || !passwordOK {
+		return "invalid", "invalid credentials"
+	}
+	return "ok", ""
+}
+
+// adminAllowed reports whether requireBasicAuth will let r through
+func adminAllowed(r *http.Request) bool {
+	if !adminAuthRequired {
+		return true
+	}
+	result, _ := checkAdminAuth(r)
+	return result == "ok"
+}
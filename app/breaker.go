@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// circuitBreaker stops calling a dependency that keeps failing, so a dead
+// downstream costs a fast error instead of a full timeout per request and
+// gets time to recover. Classic three states:
+//
+//	closed    calls flow; consecutive failures are counted
+//	open      calls fail immediately until the cooldown has passed
+//	half-open one trial call; success closes the breaker, failure reopens it
+//
+// Trip holds a breaker open, no trials, until Reset closes it again, so a
+// failure-isolation demo doesn't need a broken downstream:
+//
+//	curl localhost:30080/api/breakers
+//	curl -X POST localhost:9090/admin/breakers/go-app-service/trip
+//	curl 'localhost:30080/api/call?url=http://go-app-service/api/info'   # 503, nothing sent
+//	curl -X POST localhost:9090/admin/breakers/go-app-service/reset
+type circuitBreaker struct {
+	name      string
+	threshold int           // consecutive failures that open the breaker
+	cooldown  time.Duration // how long to stay open before a trial
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool // a half-open trial call is in flight
+	forced   bool // tripped by hand: open until Reset
+}
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// errBreakerOpen is returned by Allow while the breaker rejects calls
+var errBreakerOpen = errors.New("circuit breaker open")
+
+var (
+	breakerState = newGaugeVec("circuit_breaker_state",
+		"Circuit breaker state: 0 closed, 1 half-open, 2 open.", "name")
+	breakerTransitions = newCounterVec("circuit_breaker_transitions_total",
+		"Circuit breaker state changes by breaker and new state.", "name", "state")
+)
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	breakerState.Set(0, name)
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown, state: breakerClosed}
+}
+
+// Allow reports whether a call may proceed right now
+func (b *circuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.forced || time.Since(b.openedAt) < b.cooldown {
+			return errBreakerOpen
+		}
+		b.setState(breakerHalfOpen)
+		b.trial = true
+		return nil
+	case breakerHalfOpen:
+		if b.trial {
+			return errBreakerOpen // only one trial at a time
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+// Record reports the outcome of an allowed call
+func (b *circuitBreaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if success {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// Trip opens the breaker and keeps it open until Reset
+func (b *circuitBreaker) Trip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.forced, b.openedAt = true, time.Now()
+	b.setState(breakerOpen)
+}
+
+// Reset closes the breaker and forgets its failures
+func (b *circuitBreaker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.forced, b.failures, b.trial = false, 0, false
+	b.setState(breakerClosed)
+}
+
+func (b *circuitBreaker) setState(state string) {
+	if state == b.state {
+		return
+	}
+	slog.Warn("circuit breaker state changed", "breaker", b.name, "from", b.state, "to", state, "failures", b.failures, "forced", b.forced)
+	b.state = state
+	breakerState.Set(map[string]float64{breakerClosed: 0, breakerHalfOpen: 1, breakerOpen: 2}[state], b.name)
+	breakerTransitions.Inc(b.name, state)
+}
+
+// BreakerStatus is the JSON view of a breaker
+type BreakerStatus struct {
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	Failures  int        `json:"consecutive_failures"`
+	Threshold int        `json:"threshold"`
+	Forced    bool       `json:"forced,omitempty"`   // tripped by hand, open until reset
+	RetryAt   *time.Time `json:"retry_at,omitempty"` // when an open breaker allows a trial
+}
+
+func (b *circuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BreakerStatus{Name: b.name, State: b.state, Failures: b.failures, Threshold: b.threshold, Forced: b.forced}
+	if b.state == breakerOpen && !b.forced {
+		retryAt := b.openedAt.Add(b.cooldown)
+		status.RetryAt = &retryAt
+	}
+	return status
+}
+
+// breakerSet keeps one breaker per dependency, created on first use
+type breakerSet struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newBreakerSet(threshold int, cooldown time.Duration) *breakerSet {
+	return &breakerSet{threshold: threshold, cooldown: cooldown, breakers: map[string]*circuitBreaker{}}
+}
+
+// Get returns the breaker for name
+func (s *breakerSet) Get(name string) *circuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[name]
+	if !ok {
+		b = newCircuitBreaker(name, s.threshold, s.cooldown)
+		s.breakers[name] = b
+	}
+	return b
+}
+
+// Lookup returns the breaker for name, nil if there is none yet
+func (s *breakerSet) Lookup(name string) *circuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.breakers[name]
+}
+
+// Statuses snapshots every breaker, by name
+func (s *breakerSet) Statuses() []BreakerStatus {
+	s.mu.Lock()
+	names := sortedKeys(s.breakers)
+	breakers := make([]*circuitBreaker, len(names))
+	for i, name := range names {
+		breakers[i] = s.breakers[name]
+	}
+	s.mu.Unlock()
+	statuses := []BreakerStatus{}
+	for _, b := range breakers {
+		statuses = append(statuses, b.Status())
+	}
+	return statuses
+}
+
+// BreakersResponse is returned by /api/breakers
+type BreakersResponse struct {
+	Threshold int             `json:"threshold"` // BREAKER_FAILURES
+	Cooldown  string          `json:"cooldown"`  // BREAKER_COOLDOWN
+	Breakers  []BreakerStatus `json:"breakers"`  // one per host /api/call has called or tripped
+}
+
+// breakersHandler serves /api/breakers
+func breakersHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, BreakersResponse{
+		Threshold: callBreakers.threshold,
+		Cooldown:  callBreakers.cooldown.String(),
+		Breakers:  callBreakers.Statuses(),
+	})
+}
+
+// breakerControlHandler serves POST /admin/breakers/{name}/trip and
+// /reset. Tripping a host /api/call hasn't called yet creates its breaker.
+func breakerControlHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/breakers/")
+	i := strings.LastIndex(rest, "/")
+	name, action := rest[:max(i, 0)], rest[i+1:]
+	if name == "" || (action != "trip" && action != "reset") {
+		writeProblem(w, r, http.StatusNotFound, "use POST /admin/breakers/{name}/trip or /admin/breakers/{name}/reset")
+		return
+	}
+	b := callBreakers.Lookup(name)
+	switch {
+	case action == "trip":
+		b = callBreakers.Get(name)
+		b.Trip()
+	case b == nil:
+		writeProblem(w, r, http.StatusNotFound, "no breaker "+name+"; see /api/breakers")
+		return
+	default:
+		b.Reset()
+	}
+	writeJSON(w, http.StatusOK, b.Status())
+}
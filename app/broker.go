@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Optional messaging, for event-driven and KEDA demos. BROKER_URL picks the
+// driver:
+//
+//	nats://nats:4222                   NATS core (user:pass@ or token@ for auth)
+//	kafka://kafka-0:9092,kafka-1:9092  Kafka via segmentio/kafka-go (user:pass@ for SASL/PLAIN)
+//	memory://                          in-process, for trying it without a broker
+//
+// Every pod subscribes to BROKER_SUBJECT (go-demo.events) and keeps the last
+// messages it received for /api/messages; POST /api/publish sends one, the
+// body as text or, as application/json, {"message": "...", "subject": "..."}.
+// With BROKER_QUEUE_GROUP set, pods share the subscription and the broker
+// hands each message to just one of them - a work queue instead of a
+// broadcast. On Kafka the queue group is the consumer group.
+//
+// Like the Redis client the NATS driver speaks the wire protocol directly,
+// as NATS's is a few text commands; Kafka's binary protocol, with its
+// consumer group rebalancing, is left to kafka-go.
+
+// broker is a publish/subscribe connection
+type broker interface {
+	Publish(ctx context.Context, subject string, data []byte) error
+	Subscribe(subject, queue string, handle func(subject string, data []byte)) error
+	Connected() bool
+	Close()
+}
+
+// BrokerMessage is the envelope published by /api/publish
+type BrokerMessage struct {
+	ID      string    `json:"id"`
+	From    string    `json:"from"` // the publishing pod
+	SentAt  time.Time `json:"sent_at"`
+	Message string    `json:"message"`
+}
+
+// ReceivedMessage is one message this pod's subscriber got
+type ReceivedMessage struct {
+	Subject    string    `json:"subject"`
+	ReceivedAt time.Time `json:"received_at"`
+	BrokerMessage
+	Raw string `json:"raw,omitempty"` // payloads that weren't an envelope
+}
+
+// MessagesResponse is returned by /api/messages
+type MessagesResponse struct {
+	Broker     string            `json:"broker"` // URL without credentials
+	Connected  bool              `json:"connected"`
+	Subject    string            `json:"subject"`
+	QueueGroup string            `json:"queue_group,omitempty"`
+	Pod        string            `json:"pod"`
+	Received   int64             `json:"received_total"`
+	Messages   []ReceivedMessage `json:"messages"` // newest first
+}
+
+// keptMessages bounds the received messages held in memory
+const keptMessages = 100
+
+var (
+	msgBroker   broker
+	brokerURL   string // redacted, for display
+	brokerSubj  string
+	brokerQueue string
+
+	receivedMu  sync.Mutex
+	received    []ReceivedMessage
+	receivedCnt atomic.Int64
+
+	brokerPublished = newCounterVec("broker_messages_published_total",
+		"Messages published by /api/publish, by result.", "result")
+	brokerReceived = newCounterVec("broker_messages_received_total",
+		"Messages received by this pod's subscriber.")
+)
+
+func init() {
+	newGaugeFunc("broker_connected", "1 while connected to BROKER_URL.", func() float64 {
+		return boolFloat(msgBroker != nil && msgBroker.Connected())
+	})
+}
+
+// newBroker connects to rawURL; the NATS and Kafka drivers keep retrying
+// in the background, so a broker that's down at startup isn't fatal
+func newBroker(rawURL string) (broker, error) {
+	u, hosts, err := parseBrokerURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "memory":
+		return newMemoryBroker(), nil
+	case "nats":
+		return newNATSBroker(u), nil
+	case "kafka":
+		return newKafkaBroker(u, hosts)
+	}
+	return nil, fmt.Errorf("unsupported BROKER_URL scheme %q: want nats://, kafka:// or memory://", u.Scheme)
+}
+
+// setupBroker connects and subscribes; called from serve when BROKER_URL is set
+func setupBroker(rawURL, subject, queue string) error {
+	b, err := newBroker(rawURL)
+	if err != nil {
+		return err
+	}
+	if err := b.Subscribe(subject, queue, recordMessage); err != nil {
+		b.Close()
+		return err
+	}
+	msgBroker, brokerURL, brokerSubj, brokerQueue = b, redactURL(rawURL), subject, queue
+	return nil
+}
+
+// parseBrokerURL parses rawURL, which may list several hosts separated by
+// commas (kafka://kafka-0:9092,kafka-1:9092). url.Parse rejects those, so
+// u has the first host only and hosts has them all.
+func parseBrokerURL(rawURL string) (u *url.URL, hosts []string, err error) {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		u, err = url.Parse(rawURL) // no hosts to split; let url.Parse judge it
+		return u, nil, err
+	}
+	authority, tail := rest, ""
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		authority, tail = rest[:i], rest[i:]
+	}
+	userinfo, hostList := "", authority
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		userinfo, hostList = authority[:i+1], authority[i+1:]
+	}
+	hosts = strings.Split(hostList, ",")
+	u, err = url.Parse(scheme + "://" + userinfo + hosts[0] + tail)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, hosts, nil
+}
+
+// redactURL drops credentials from a URL for logs and responses
+func redactURL(rawURL string) string {
+	u, hosts, err := parseBrokerURL(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	u.User = url.User("redacted")
+	u.Host = strings.Join(hosts, ",")
+	return u.String()
+}
+
+func recordMessage(subject string, data []byte) {
+	msg := ReceivedMessage{Subject: subject, ReceivedAt: time.Now()}
+	if err := json.Unmarshal(data, &msg.BrokerMessage); err != nil || msg.ID == "" {
+		msg.BrokerMessage, msg.Raw = BrokerMessage{}, string(data)
+	}
+	brokerReceived.Inc()
+	receivedCnt.Add(1)
+	receivedMu.Lock()
+	received = append(received, msg)
+	if len(received) > keptMessages {
+		received = received[len(received)-keptMessages:]
+	}
+	receivedMu.Unlock()
+	slog.Debug("message received", "subject", subject, "id", msg.ID, "from", msg.From)
+}
+
+// publishHandler publishes ?message= or the request body, e.g.
+// curl -X POST localhost:8080/api/publish -d 'hello'
+func publishHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	if msgBroker == nil {
+		writeProblem(w, r, http.StatusServiceUnavailable, "messaging is disabled; set BROKER_URL (nats://host:4222, kafka://host:9092 or memory://)")
+		return
+	}
+	var req struct {
+		Message string `json:"message" validate:"required,max=65536"`
+		Subject string `json:"subject" validate:"subject"`
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := decodeBody(w, r, 80<<10, &req); err != nil {
+			writeBodyProblem(w, r, err)
+			return
+		}
+	} else if req.Message = r.URL.Query().Get("message"); req.Message == "" {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "cannot read body: "+err.Error())
+			return
+		}
+		req.Message = string(body)
+	}
+	if v := r.URL.Query().Get("subject"); v != "" {
+		req.Subject = v
+	}
+	req.Subject = cmp.Or(req.Subject, brokerSubj)
+	if err := validate(&req); err != nil {
+		writeBodyProblem(w, r, err)
+		return
+	}
+	text, subject := req.Message, req.Subject
+
+	hostname, _ := os.Hostname()
+	var id [8]byte
+	rand.Read(id[:])
+	msg := BrokerMessage{ID: hex.EncodeToString(id[:]), From: hostname, SentAt: time.Now(), Message: text}
+	data, _ := json.Marshal(msg)
+	if err := msgBroker.Publish(r.Context(), subject, data); err != nil {
+		brokerPublished.Inc("error")
+		writeProblem(w, r, http.StatusServiceUnavailable, "publish failed: "+err.Error())
+		return
+	}
+	brokerPublished.Inc("ok")
+	writeJSON(w, http.StatusAccepted, map[string]any{"subject": subject, "bytes": len(data), "message": msg})
+}
+
+func validSubject(s string) bool {
+	if s == "" || strings.ContainsAny(s, " \t\r\n*>") {
+		return false
+	}
+	for _, token := range strings.Split(s, ".") {
+		if token == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// messagesHandler lists what this pod's subscriber received
+func messagesHandler(w http.ResponseWriter, r *http.Request) {
+	if msgBroker == nil {
+		writeProblem(w, r, http.StatusServiceUnavailable, "messaging is disabled; set BROKER_URL (nats://host:4222, kafka://host:9092 or memory://)")
+		return
+	}
+	hostname, _ := os.Hostname()
+	resp := MessagesResponse{
+		Broker:     brokerURL,
+		Connected:  msgBroker.Connected(),
+		Subject:    brokerSubj,
+		QueueGroup: brokerQueue,
+		Pod:        hostname,
+		Received:   receivedCnt.Load(),
+		Messages:   []ReceivedMessage{},
+	}
+	receivedMu.Lock()
+	for i := len(received) - 1; i >= 0; i-- {
+		resp.Messages = append(resp.Messages, received[i])
+	}
+	receivedMu.Unlock()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// memoryBroker delivers within the process; queue groups pick one
+// subscriber round-robin, like NATS
+type memoryBroker struct {
+	mu   sync.Mutex
+	subs []memorySub
+	next map[string]int
+}
+
+type memorySub struct {
+	subject, queue string
+	handle         func(string, []byte)
+}
+
+func newMemoryBroker() *memoryBroker { return &memoryBroker{next: map[string]int{}} }
+
+func (b *memoryBroker) Publish(ctx context.Context, subject string, data []byte) error {
+	b.mu.Lock()
+	var targets []func(string, []byte)
+	groups := map[string][]func(string, []byte){}
+	for _, s := range b.subs {
+		if s.subject != subject {
+			continue
+		}
+		if s.queue == "" {
+			targets = append(targets, s.handle)
+		} else {
+			groups[s.queue] = append(groups[s.queue], s.handle)
+		}
+	}
+	for queue, members := range groups {
+		targets = append(targets, members[b.next[queue]%len(members)])
+		b.next[queue]++
+	}
+	b.mu.Unlock()
+	for _, handle := range targets {
+		go handle(subject, append([]byte(nil), data...))
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(subject, queue string, handle func(string, []byte)) error {
+	b.mu.Lock()
+	b.subs = append(b.subs, memorySub{subject, queue, handle})
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memoryBroker) Connected() bool { return true }
+func (b *memoryBroker) Close()          {}
+
+// natsBroker is one NATS connection with a reader goroutine. It redials
+// with backoff and re-sends its subscriptions after every reconnect.
+type natsBroker struct {
+	addr     string
+	connect  string // the CONNECT line, with credentials
+	mu       sync.Mutex
+	conn     net.Conn
+	w        *bufio.Writer
+	subs     []natsSub
+	closed   bool
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+type natsSub struct {
+	subject, queue string
+	handle         func(string, []byte)
+}
+
+func newNATSBroker(u *url.URL) *natsBroker {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	opts := map[string]any{"verbose": false, "pedantic": false, "lang": "go", "name": getEnv("APP_NAME", "go-demo-app"),
+		"version": buildInfo().Version, "protocol": 1}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			opts["user"], opts["pass"] = u.User.Username(), pass
+		} else {
+			opts["auth_token"] = u.User.Username()
+		}
+	}
+	line, _ := json.Marshal(opts)
+	b := &natsBroker{addr: addr, connect: "CONNECT " + string(line) + "\r\n", stop: make(chan struct{})}
+	go b.run()
+	return b
+}
+
+// run keeps a connection up until Close
+func (b *natsBroker) run() {
+	for attempt := 0; ; attempt++ {
+		conn, r, err := b.dial()
+		if err == nil {
+			attempt = 0
+			slog.Info("broker connected", "addr", b.addr)
+			err = b.read(conn, r)
+		}
+		b.mu.Lock()
+		if b.conn == conn && conn != nil {
+			b.conn, b.w = nil, nil
+		}
+		closed := b.closed
+		b.mu.Unlock()
+		if closed {
+			return
+		}
+		wait := backoff(min(attempt, 5), 500*time.Millisecond, 15*time.Second)
+		slog.Warn("broker connection lost, reconnecting", "addr", b.addr, "error", err, "retry_in", wait.Round(time.Millisecond).String())
+		select {
+		case <-time.After(wait):
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// dial connects, handshakes and re-subscribes
+func (b *natsBroker) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, 5*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	info, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return nil, nil, fmt.Errorf("not a NATS server: %q", strings.TrimSpace(info))
+	}
+	// PING after CONNECT: the PONG (or -ERR) says whether we were accepted
+	io.WriteString(conn, b.connect+"PING\r\n")
+	reply, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if reply = strings.TrimSpace(reply); reply != "PONG" {
+		conn.Close()
+		return nil, nil, fmt.Errorf("connect rejected: %s", reply)
+	}
+	conn.SetDeadline(time.Time{})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn, b.w = conn, bufio.NewWriter(conn)
+	for i, s := range b.subs {
+		b.writeSub(i+1, s)
+	}
+	if err := b.w.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, r, nil
+}
+
+func (b *natsBroker) writeSub(sid int, s natsSub) {
+	if s.queue != "" {
+		fmt.Fprintf(b.w, "SUB %s %s %d\r\n", s.subject, s.queue, sid)
+	} else {
+		fmt.Fprintf(b.w, "SUB %s %d\r\n", s.subject, sid)
+	}
+}
+
+// read handles server traffic until the connection fails
+func (b *natsBroker) read(conn net.Conn, r *bufio.Reader) error {
+	defer conn.Close()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(args)
+			if len(fields) < 3 {
+				return fmt.Errorf("bad MSG line %q", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				return fmt.Errorf("bad MSG line %q", line)
+			}
+			payload := make([]byte, size+2) // with the trailing \r\n
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+			sid, _ := strconv.Atoi(fields[1])
+			b.mu.Lock()
+			var handle func(string, []byte)
+			if sid >= 1 && sid <= len(b.subs) {
+				handle = b.subs[sid-1].handle
+			}
+			b.mu.Unlock()
+			if handle != nil {
+				handle(fields[0], payload[:size])
+			}
+		case "PING":
+			b.mu.Lock()
+			if b.w != nil {
+				b.w.WriteString("PONG\r\n")
+				b.w.Flush()
+			}
+			b.mu.Unlock()
+		case "PONG", "+OK", "INFO":
+		case "-ERR":
+			slog.Warn("broker error", "addr", b.addr, "error", args)
+		}
+	}
+}
+
+func (b *natsBroker) Publish(ctx context.Context, subject string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return errors.New("not connected to " + b.addr)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		b.conn.SetWriteDeadline(deadline)
+		defer b.conn.SetWriteDeadline(time.Time{})
+	}
+	fmt.Fprintf(b.w, "PUB %s %d\r\n", subject, len(data))
+	b.w.Write(data)
+	b.w.WriteString("\r\n")
+	return b.w.Flush()
+}
+
+func (b *natsBroker) Subscribe(subject, queue string, handle func(string, []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, natsSub{subject, queue, handle})
+	if b.conn != nil {
+		b.writeSub(len(b.subs), b.subs[len(b.subs)-1])
+		return b.w.Flush()
+	}
+	return nil // sent once connected
+}
+
+func (b *natsBroker) Connected() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn != nil
+}
+
+func (b *natsBroker) Close() {
+	b.stopOnce.Do(func() {
+		b.mu.Lock()
+		b.closed = true
+		if b.conn != nil {
+			b.w.Flush()
+			b.conn.Close()
+		}
+		b.mu.Unlock()
+		close(b.stop)
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/cache"
+)
+
+// In-memory caches, one per use, each an LRU from the cache package bounded
+// in entries and optionally in age. Every pod keeps its own, so through a
+// Service the hit rate falls as replicas are added, and a cache that fills
+// up is memory the container's limit has to allow for:
+//
+//	COMPUTE_CACHE_SIZE=256 COMPUTE_CACHE_MEMORY_TTL=0    /api/compute/*
+//	GUESTBOOK_CACHE_SIZE=64 GUESTBOOK_CACHE_TTL=5s       GET /api/guestbook
+//	curl -X POST 'localhost:9090/admin/cache/flush?cache=compute'
+//
+// cache_requests_total, cache_evictions_total{reason} and cache_entries
+// are labelled by cache. Evictions are counted by reason: size (the least
+// recently used entry made room), expired (found past its TTL) or flush.
+
+var (
+	cacheRequests = newCounterVec("cache_requests_total",
+		"In-memory cache lookups, by cache and result (hit, miss).", "cache", "result")
+	cacheEvictions = newCounterVec("cache_evictions_total",
+		"Entries dropped from in-memory caches, by cache and reason (size, expired, flush).", "cache", "reason")
+	cacheEntries = newGaugeVec("cache_entries",
+		"Entries held in each in-memory cache.", "cache")
+)
+
+// cacheMetrics is the caches' observer
+type cacheMetrics struct{}
+
+func init() { cache.SetObserver(cacheMetrics{}) }
+
+func (cacheMetrics) Lookup(name string, hit bool) {
+	cacheRequests.Inc(name, map[bool]string{true: "hit", false: "miss"}[hit])
+}
+
+func (cacheMetrics) Evicted(name, reason string, n int) {
+	cacheEvictions.Add(float64(n), name, reason)
+}
+
+func (cacheMetrics) Entries(name string, n int) {
+	cacheEntries.Set(float64(n), name)
+}
+
+// CacheFlushResponse is returned by /admin/cache/flush
+type CacheFlushResponse struct {
+	Flushed map[string]int `json:"flushed"` // entries dropped, by cache
+	Caches  []cache.Stats  `json:"caches"`
+}
+
+// cacheFlushHandler empties one cache (?cache=) or all of them (POST)
+func cacheFlushHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	all := cache.All()
+	flush := all
+	if only := r.URL.Query().Get("cache"); only != "" {
+		c, ok := cache.Lookup(only)
+		if !ok {
+			names := make([]string, len(all))
+			for i, c := range all {
+				names[i] = c.Name()
+			}
+			writeProblem(w, r, http.StatusNotFound, "no cache "+only+"; caches are "+strings.Join(names, ", "))
+			return
+		}
+		flush = []cache.Cache{c}
+	}
+	resp := CacheFlushResponse{Flushed: map[string]int{}, Caches: []cache.Stats{}}
+	for _, c := range flush {
+		resp.Flushed[c.Name()] = c.Flush()
+	}
+	for _, c := range all { // all of them, flushed or not
+		resp.Caches = append(resp.Caches, c.Stats())
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
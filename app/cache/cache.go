@@ -0,0 +1,231 @@
+// Package cache holds the app's in-memory caches: maps bounded in entries
+// and optionally in age, which evict the least recently used entry to
+// make room. Every cache is registered under its name, so they can be
+// listed and flushed together; an Observer, set by the app, turns lookups
+// and evictions into metrics.
+package cache
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats describes one cache
+type Stats struct {
+	Name      string `json:"name"`
+	Entries   int    `json:"entries"`
+	Size      int    `json:"size"`
+	TTL       string `json:"ttl,omitempty"`
+	Hits      int64  `json:"hits"`
+	Misses    int64  `json:"misses"`
+	Evictions int64  `json:"evictions"`
+}
+
+// Cache is the part of an LRU that doesn't depend on its value type
+type Cache interface {
+	Name() string
+	Flush() int
+	Stats() Stats
+}
+
+// Observer is told about every lookup and eviction, and the entries left.
+// Evictions are by reason: size (the least recently used entry made room),
+// expired (found past its TTL) or flush.
+type Observer interface {
+	Lookup(cache string, hit bool)
+	Evicted(cache, reason string, n int)
+	Entries(cache string, n int)
+}
+
+var (
+	mu     sync.Mutex
+	caches = map[string]Cache{}
+
+	// observer holds an observerBox, read on every lookup
+	observer atomic.Value
+)
+
+type observerBox struct{ Observer }
+
+func init() { observer.Store(observerBox{nopObserver{}}) }
+
+type nopObserver struct{}
+
+func (nopObserver) Lookup(string, bool)         {}
+func (nopObserver) Evicted(string, string, int) {}
+func (nopObserver) Entries(string, int)         {}
+
+// SetObserver sets who hears about every cache's lookups and evictions,
+// those created before the call included
+func SetObserver(o Observer) { observer.Store(observerBox{o}) }
+
+func observed() Observer { return observer.Load().(observerBox).Observer }
+
+// LRU is a size-bounded map that evicts the least recently used entry,
+// and drops entries older than its TTL when that is set
+type LRU[V any] struct {
+	name string
+	size int
+	ttl  time.Duration
+
+	mu                      sync.Mutex
+	order                   *list.List // front is most recent
+	entries                 map[string]*list.Element
+	hits, misses, evictions int64
+}
+
+type entry[V any] struct {
+	key     string
+	value   V
+	expires time.Time // zero without a TTL
+}
+
+// New registers a cache of size entries (0 disables it) under name,
+// replacing any cache registered under it before
+func New[V any](name string, size int, ttl time.Duration) *LRU[V] {
+	c := &LRU[V]{name: name, size: size, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+	mu.Lock()
+	caches[name] = c
+	mu.Unlock()
+	observed().Entries(name, 0)
+	return c
+}
+
+func (c *LRU[V]) Name() string { return c.name }
+
+// Size is the most entries the cache keeps
+func (c *LRU[V]) Size() int { return c.size }
+
+// TTL is how long an entry is kept, 0 for as long as there is room
+func (c *LRU[V]) TTL() time.Duration { return c.ttl }
+
+func (c *LRU[V]) Enabled() bool { return c.size > 0 }
+
+func (c *LRU[V]) Get(key string) (V, bool) {
+	var zero V
+	if c.size <= 0 {
+		return zero, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok && c.expired(e.Value.(*entry[V])) {
+		c.remove(e, "expired")
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		observed().Lookup(c.name, false)
+		return zero, false
+	}
+	c.hits++
+	observed().Lookup(c.name, true)
+	c.order.MoveToFront(e)
+	return e.Value.(*entry[V]).value, true
+}
+
+func (c *LRU[V]) Add(key string, value V) {
+	if c.size <= 0 {
+		return
+	}
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = time.Now().Add(c.ttl)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		ent := e.Value.(*entry[V])
+		ent.value, ent.expires = value, expires
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&entry[V]{key: key, value: value, expires: expires})
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back(), "size")
+	}
+	observed().Entries(c.name, c.order.Len())
+}
+
+// Flush drops every entry and returns how many there were
+func (c *LRU[V]) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.order.Len()
+	c.order.Init()
+	clear(c.entries)
+	c.evictions += int64(n)
+	observed().Evicted(c.name, "flush", n)
+	observed().Entries(c.name, 0)
+	return n
+}
+
+func (c *LRU[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *LRU[V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := Stats{Name: c.name, Entries: c.order.Len(), Size: c.size, Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+	if c.ttl > 0 {
+		s.TTL = c.ttl.String()
+	}
+	return s
+}
+
+// expired and remove are called with c.mu held
+func (c *LRU[V]) expired(e *entry[V]) bool {
+	return !e.expires.IsZero() && time.Now().After(e.expires)
+}
+
+func (c *LRU[V]) remove(e *list.Element, reason string) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*entry[V]).key)
+	c.evictions++
+	observed().Evicted(c.name, reason, 1)
+	observed().Entries(c.name, c.order.Len())
+}
+
+// Lookup returns the cache registered under name
+func Lookup(name string) (Cache, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	c, ok := caches[name]
+	return c, ok
+}
+
+// All returns every registered cache, sorted by name
+func All() []Cache {
+	mu.Lock()
+	all := make([]Cache, 0, len(caches))
+	for _, c := range caches {
+		all = append(all, c)
+	}
+	mu.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].Name() < all[j].Name() })
+	return all
+}
+
+// FlushAll empties every cache, returning the entries dropped
+func FlushAll() int {
+	n := 0
+	for _, c := range All() {
+		n += c.Flush()
+	}
+	return n
+}
+
+// Entries counts the entries across every cache
+func Entries() int {
+	n := 0
+	for _, c := range All() {
+		n += c.Stats().Entries
+	}
+	return n
+}
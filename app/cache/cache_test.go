@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// recorder counts what an Observer hears
+type recorder struct {
+	hits, misses int
+	evicted      map[string]int
+}
+
+func (r *recorder) Lookup(_ string, hit bool) {
+	if hit {
+		r.hits++
+	} else {
+		r.misses++
+	}
+}
+
+func (r *recorder) Evicted(_, reason string, n int) { r.evicted[reason] += n }
+func (r *recorder) Entries(string, int)             {}
+
+func observe(t *testing.T) *recorder {
+	t.Helper()
+	r := &recorder{evicted: map[string]int{}}
+	SetObserver(r)
+	t.Cleanup(func() { SetObserver(nopObserver{}) })
+	return r
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	r := observe(t)
+	c := New[int]("test-size", 2, 0)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Get("a") // b is now the least recently used
+	c.Add("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b should have been evicted to make room for c")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s should still be cached", key)
+		}
+	}
+	if r.evicted["size"] != 1 || r.hits != 3 || r.misses != 1 {
+		t.Errorf("observer heard %d size evictions, %d hits, %d misses; want 1, 3, 1", r.evicted["size"], r.hits, r.misses)
+	}
+}
+
+func TestLRUExpiresAfterTTL(t *testing.T) {
+	r := observe(t)
+	c := New[string]("test-ttl", 4, 10*time.Millisecond)
+	c.Add("k", "v")
+	if v, ok := c.Get("k"); !ok || v != "v" {
+		t.Fatalf("Get = %q, %v; want v, true", v, ok)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.Get("k"); ok {
+		t.Error("entry outlived its TTL")
+	}
+	if c.Len() != 0 || r.evicted["expired"] != 1 {
+		t.Errorf("Len = %d, expired evictions = %d; want 0, 1", c.Len(), r.evicted["expired"])
+	}
+}
+
+func TestDisabledCacheKeepsNothing(t *testing.T) {
+	c := New[int]("test-off", 0, 0)
+	c.Add("a", 1)
+	if _, ok := c.Get("a"); ok || c.Enabled() {
+		t.Error("a cache of size 0 should keep nothing")
+	}
+}
+
+func TestFlushAll(t *testing.T) {
+	r := observe(t)
+	a, b := New[int]("test-flush-a", 4, 0), New[int]("test-flush-b", 4, 0)
+	a.Add("1", 1)
+	a.Add("2", 2)
+	b.Add("1", 1)
+
+	if got, ok := Lookup("test-flush-a"); !ok || got.Stats().Entries != 2 {
+		t.Fatalf("Lookup(test-flush-a) = %v, %v; want the cache with 2 entries", got, ok)
+	}
+	before := Entries()
+	if n := FlushAll(); n != before || n < 3 {
+		t.Errorf("FlushAll dropped %d entries; want %d, at least 3", n, before)
+	}
+	if a.Len()+b.Len() != 0 || r.evicted["flush"] < 3 {
+		t.Errorf("after FlushAll: %d entries left, %d flush evictions", a.Len()+b.Len(), r.evicted["flush"])
+	}
+	if s := a.Stats(); s.Evictions != 2 || s.Size != 4 {
+		t.Errorf("Stats = %+v; want 2 evictions of a size 4 cache", s)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// /api/call makes an outbound request the way a well-behaved service
+// should: a per-attempt timeout, retries with exponential backoff and
+// jitter under a retry budget (retry.go), and a circuit breaker per
+// downstream host. Run two copies of the
+// app and point one at the other to demo service discovery, NetworkPolicy
+// and failure isolation:
+//
+//	curl 'localhost:8080/api/call?url=http://other-app/api/info'
+//	kubectl exec deploy/other-app -- wget -qO- --post-data= 'localhost:8080/chaos/error-rate?percent=100'
+//
+// After a few failures the breaker opens and calls fail in microseconds.
+
+// Limits for per-request overrides
+const (
+	maxCallRetries = 10
+	maxCallBody    = 64 << 10
+)
+
+// callBreakers holds one breaker per downstream host; serve replaces it
+// with BREAKER_FAILURES and BREAKER_COOLDOWN applied
+var callBreakers = newBreakerSet(5, 30*time.Second)
+
+// CallAttempt is one try at the downstream request
+type CallAttempt struct {
+	Attempt   int     `json:"attempt"`
+	Status    int     `json:"status,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+	BackoffMS float64 `json:"backoff_ms,omitempty"` // sleep before the next attempt
+}
+
+// CallResponse is returned by /api/call
+type CallResponse struct {
+	URL       string          `json:"url"`
+	Status    int             `json:"status,omitempty"`
+	LatencyMS float64         `json:"latency_ms"`
+	Attempts  []CallAttempt   `json:"attempts"`
+	Mode      string          `json:"mode"`                 // backoff or naive (RETRY_MODE, ?mode=)
+	StoppedBy string          `json:"stopped_by,omitempty"` // what ended the retries early
+	Breaker   BreakerStatus   `json:"breaker"`
+	Body      json.RawMessage `json:"body,omitempty"` // downstream JSON, or a JSON string
+	Error     string          `json:"error,omitempty"`
+}
+
+// retryable reports whether a response status is worth another attempt
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// backoff is full-jitter exponential backoff: random in [0, base*2^attempt)
+func backoff(attempt int, base, limit time.Duration) time.Duration {
+	ceiling := min(base<<attempt, limit)
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func callHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	target := q.Get("url")
+	if target == "" {
+		target = getEnv("DOWNSTREAM_URL", "")
+	}
+	u, err := url.Parse(target)
+	if target == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeProblem(w, r, http.StatusBadRequest, "url must be an http(s) URL (or set DOWNSTREAM_URL)")
+		return
+	}
+	timeout := getEnvDuration("CALL_TIMEOUT", 2*time.Second)
+	if v := q.Get("timeout"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 || timeout > time.Minute {
+			writeProblem(w, r, http.StatusBadRequest, "timeout must be a Go duration up to 1m")
+			return
+		}
+	}
+	policy, ok := retryPolicyFromQuery(w, r, retryPolicyFromEnv())
+	if !ok {
+		return
+	}
+
+	if degraded.skip(w, "call") {
+		shedDegraded(w, r, "outbound calls are off")
+		return
+	}
+
+	breaker := callBreakers.Get(u.Host)
+	resp := CallResponse{URL: target, Mode: policy.Mode}
+	start := time.Now()
+	var body []byte
+	attempts, stopped := policy.do(r.Context(), "call", breaker, func(ctx context.Context) (status int, err error) {
+		status, body, err = callOnce(ctx, target, timeout)
+		return status, err
+	})
+	resp.Attempts = attempts
+	if n := len(attempts); n > 0 {
+		resp.Status, resp.Error = attempts[n-1].Status, attempts[n-1].Error
+	}
+	if stopped != nil {
+		resp.StoppedBy = stopped.Error()
+		if resp.Error == "" && len(attempts) == 0 {
+			resp.Error = stopped.Error()
+		}
+	}
+	resp.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	resp.Breaker = breaker.Status()
+	if len(body) > 0 {
+		if json.Valid(body) {
+			resp.Body = body
+		} else {
+			resp.Body, _ = json.Marshal(string(body))
+		}
+	}
+
+	code := http.StatusOK
+	switch {
+	case len(resp.Attempts) == 0:
+		code = http.StatusServiceUnavailable // breaker open, nothing was sent
+	case resp.Error != "" || retryable(resp.Status):
+		code = http.StatusBadGateway
+		if resp.Error == "" {
+			resp.Error = fmt.Sprintf("downstream returned %d", resp.Status)
+		}
+	}
+	writeJSON(w, code, resp)
+}
+
+// callOnce performs a single GET with its own timeout
+func callOnce(ctx context.Context, target string, timeout time.Duration) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	res, err := outboundClient.Do(req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 0, nil, fmt.Errorf("timeout after %s", timeout)
+	} else if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxCallBody))
+	return res.StatusCode, body, err
+}
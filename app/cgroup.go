@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the container's cgroup v2 hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupLimits are the resource limits the container runtime applied to us.
+// Zero means unlimited (or not detectable, e.g. outside a container).
+type cgroupLimits struct {
+	CPUCores    float64 `json:"cpu_cores,omitempty"`
+	MemoryBytes int64   `json:"memory_bytes,omitempty"`
+}
+
+// cgroupV1 reports whether root holds a cgroup v1 hierarchy (one
+// directory per controller) rather than the unified v2 one
+func cgroupV1(root string) bool {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(root, "memory", "memory.limit_in_bytes"))
+	return err == nil
+}
+
+// readCgroupLimits reads cgroup v2 cpu.max and memory.max under root, or
+// their v1 equivalents. Missing files are not an error: they simply mean
+// no limit was found.
+func readCgroupLimits(root string) (cgroupLimits, error) {
+	var limits cgroupLimits
+	if cgroupV1(root) {
+		return readCgroupV1Limits(root)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		cores, err := parseCPUMax(string(data))
+		if err != nil {
+			return limits, err
+		}
+		limits.CPUCores = cores
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, "memory.max")); err == nil {
+		bytes, err := parseMemoryMax(string(data))
+		if err != nil {
+			return limits, err
+		}
+		limits.MemoryBytes = bytes
+	}
+
+	return limits, nil
+}
+
+// parseCPUMax parses cgroup v2 cpu.max ("$QUOTA $PERIOD" or "max $PERIOD")
+// into a number of CPU cores. A 100m limit in the pod spec shows up as
+// "10000 100000", i.e. 0.1 cores.
+func parseCPUMax(content string) (float64, error) {
+	fields := strings.Fields(content)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, fmt.Errorf("cpu.max: unexpected format %q", content)
+	}
+	if fields[0] == "max" {
+		return 0, nil
+	}
+
+	quota, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cpu.max: bad quota: %w", err)
+	}
+	period := int64(100000) // kernel default when the period is omitted
+	if len(fields) == 2 {
+		if period, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return 0, fmt.Errorf("cpu.max: bad period: %w", err)
+		}
+	}
+	if quota <= 0 || period <= 0 {
+		return 0, fmt.Errorf("cpu.max: invalid quota/period %q", content)
+	}
+	return float64(quota) / float64(period), nil
+}
+
+// parseMemoryMax parses cgroup v2 memory.max ("max" or a byte count). A
+// limit of 0 is rejected rather than returned: 0 already means unlimited
+// in cgroupLimits, and no process could start under a real 0-byte limit.
+func parseMemoryMax(content string) (int64, error) {
+	value := strings.TrimSpace(content)
+	if value == "max" {
+		return 0, nil
+	}
+	bytes, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("memory.max: %w", err)
+	}
+	if bytes <= 0 {
+		return 0, fmt.Errorf("memory.max: invalid limit %q", value)
+	}
+	return bytes, nil
+}
+
+// v1Unlimited is above any real memory.limit_in_bytes: v1 reports "no
+// limit" as the largest page-aligned int64
+const v1Unlimited = 1 << 62
+
+// readCgroupV1Limits reads cpu.cfs_quota_us, cpu.cfs_period_us and
+// memory.limit_in_bytes from the v1 controller directories
+func readCgroupV1Limits(root string) (cgroupLimits, error) {
+	var limits cgroupLimits
+	quota, errQ := readCgroupInt(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+	period, errP := readCgroupInt(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	if errQ == nil && errP == nil && quota > 0 && period > 0 {
+		limits.CPUCores = float64(quota) / float64(period)
+	}
+	if bytes, err := readCgroupInt(filepath.Join(root, "memory", "memory.limit_in_bytes")); err == nil && bytes < v1Unlimited {
+		limits.MemoryBytes = bytes
+	}
+	return limits, nil
+}
+
+// readCgroupInt reads a file holding a single integer
+func readCgroupInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readCgroupStat reads a flat keyed file like cpu.stat or memory.stat
+func readCgroupStat(path string) (map[string]int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	stats := map[string]int64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, value, ok := strings.Cut(line, " "); ok {
+			if n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+				stats[key] = n
+			}
+		}
+	}
+	return stats, nil
+}
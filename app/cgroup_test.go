@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestParseCPUMax(t *testing.T) {
+	tests := []struct {
+		content string
+		want    float64
+		wantErr bool
+	}{
+		{"max 100000\n", 0, false}, // no limit
+		{"10000 100000\n", 0.1, false},
+		{"250000 100000", 2.5, false},
+		{"50000", 0.5, false}, // period omitted: the kernel's 100000
+		{"max", 0, false},
+		{"", 0, true},
+		{"garbage", 0, true},
+		{"10000 garbage", 0, true},
+		{"10000 100000 7", 0, true},
+		{"0 100000", 0, true},
+		{"-1 100000", 0, true},
+		{"10000 0", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCPUMax(tt.content)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCPUMax(%q) error = %v, want error %v", tt.content, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseCPUMax(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestParseMemoryMax(t *testing.T) {
+	tests := []struct {
+		content string
+		want    int64
+		wantErr bool
+	}{
+		{"max\n", 0, false}, // no limit
+		{"536870912\n", 512 << 20, false},
+		{"0", 0, true}, // 0 would read as unlimited
+		{"-1", 0, true},
+		{"", 0, true},
+		{"512Mi", 0, true},
+		{"garbage", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMemoryMax(tt.content)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMemoryMax(%q) error = %v, want error %v", tt.content, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseMemoryMax(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
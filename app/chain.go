@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// /api/chain passes one request along a chain of pods, each calling the
+// next with one hop fewer, and returns who served every hop and how long
+// it took. The chain goes to CHAIN_NEXT_URL, another app's Service, or by
+// default back through our own:
+//
+//	curl -s 'localhost:30080/api/chain?hops=4' | jq '.chain[] | {hop, pod, latency_ms}'
+//
+// Every hop carries the same traceparent and X-Request-ID (tracingTransport),
+// so with OTEL_EXPORTER_OTLP_ENDPOINT set the whole chain is one trace,
+// nested a level per hop; trace_id in each hop shows the propagation even
+// without a collector. Each hop opens a new connection, so kube-proxy
+// picks a pod per hop and the same pod can appear twice. Through a mesh,
+// the hop latencies include the sidecars.
+//
+// A hop that fails ends the chain: the hops before it report the error
+// and the response is a 502. Each hop retries the next under the retry
+// policy (retry.go), so a failure at the end is retried at every level.
+
+// maxChainHops bounds ?hops=, and with it the nesting of requests
+const maxChainHops = 10
+
+// ChainHop is one pod's part of the chain
+type ChainHop struct {
+	Hop       int     `json:"hop"` // 1 for the pod that was asked first
+	Pod       string  `json:"pod"`
+	ServedBy  string  `json:"served_by"` // node and zone
+	Version   string  `json:"version"`
+	TraceID   string  `json:"trace_id,omitempty"`
+	LatencyMS float64 `json:"latency_ms"` // this hop and every one after it
+	Next      string  `json:"next,omitempty"`
+	Attempts  int     `json:"attempts,omitempty"` // calls to the next hop, retries included
+	Error     string  `json:"error,omitempty"`
+	Degraded  bool    `json:"degraded,omitempty"` // ended the chain early, see /api/degraded
+}
+
+// ChainResponse is returned by /api/chain
+type ChainResponse struct {
+	Hops      int        `json:"hops"`
+	RequestID string     `json:"request_id,omitempty"`
+	Chain     []ChainHop `json:"chain"`
+}
+
+// chainClient opens a new connection per hop, so each one is balanced
+var chainClient = &http.Client{
+	Transport: tracingTransport{base: &http.Transport{Proxy: http.ProxyFromEnvironment, DisableKeepAlives: true}},
+	Timeout:   30 * time.Second,
+}
+
+// chainNextURL is where the next hop goes, with ?hops= to be filled in
+func chainNextURL() string {
+	return getEnv("CHAIN_NEXT_URL", "http://go-app-service") + "/api/chain"
+}
+
+func chainHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	hops, hop := int64(3), int64(1)
+	var ok bool
+	if r.URL.Query().Get("hops") != "" {
+		if hops, ok = queryInt(w, r, "hops", 1, maxChainHops); !ok {
+			return
+		}
+	}
+	if r.URL.Query().Get("hop") != "" {
+		if hop, ok = queryInt(w, r, "hop", 1, maxChainHops); !ok {
+			return
+		}
+	}
+	start := time.Now()
+	hostname, _ := os.Hostname()
+	self := ChainHop{
+		Hop:      int(hop),
+		Pod:      hostname,
+		ServedBy: servedBy(),
+		Version:  buildInfo().Version,
+		TraceID:  traceIDFromContext(r.Context()),
+	}
+	resp := ChainResponse{Hops: int(hops), RequestID: requestIDFromContext(r.Context())}
+
+	policy, ok := retryPolicyFromQuery(w, r, retryPolicyFromEnv())
+	if !ok {
+		return
+	}
+
+	code := http.StatusOK
+	var rest []ChainHop
+	if hops > 1 && degraded.skip(w, "chain") {
+		self.Degraded = true
+	} else if hops > 1 {
+		self.Next = chainNextURL()
+		var err error
+		attempts, stopped := policy.do(r.Context(), "chain", nil, func(ctx context.Context) (int, error) {
+			var next ChainResponse
+			var status int
+			next, status, err = callNextHop(ctx, self.Next, policy, hops-1, hop+1)
+			rest = next.Chain
+			return status, err
+		})
+		self.Attempts = len(attempts)
+		if err != nil || stopped != nil {
+			self.Error, code = errors.Join(err, stopped).Error(), http.StatusBadGateway
+		}
+	}
+	self.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	resp.Chain = append([]ChainHop{self}, rest...)
+	writeJSON(w, code, resp)
+}
+
+// callNextHop asks target for the rest of the chain, passing the retry
+// policy on. A failed hop still returns the hops after it that did answer.
+func callNextHop(ctx context.Context, target string, policy retryPolicy, hops, hop int64) (ChainResponse, int, error) {
+	var next ChainResponse
+	u := target + "?" + url.Values{
+		"hops":    {strconv.FormatInt(hops, 10)},
+		"hop":     {strconv.FormatInt(hop, 10)},
+		"mode":    {policy.Mode},
+		"retries": {strconv.Itoa(policy.Retries)},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return next, 0, err
+	}
+	res, err := chainClient.Do(req)
+	if err != nil {
+		return next, 0, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return next, res.StatusCode, err
+	}
+	if json.Unmarshal(body, &next) != nil || len(next.Chain) == 0 {
+		return ChainResponse{}, res.StatusCode, fmt.Errorf("hop %d: %s from %s", hop, res.Status, target)
+	}
+	if res.StatusCode != http.StatusOK {
+		return next, res.StatusCode, fmt.Errorf("hop %d failed", hop+int64(len(next.Chain))-1)
+	}
+	return next, res.StatusCode, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/chaos"
+)
+
+// Chaos engineering endpoints. Each one makes the pod misbehave in a way
+// Kubernetes reacts to visibly:
+//
+//	/chaos/crash?code=1        exit the process        -> restarts, CrashLoopBackOff
+//	/chaos/panic               panic in a handler      -> a 500, the pod survives
+//	/chaos/latency?ms=5000     slow every response     -> probe timeouts, readiness flaps
+//	/chaos/error-rate?percent= fail a share of requests -> liveness restarts, 5xx alerts
+//	/chaos/memory-leak?mb=     retain memory forever   -> OOMKilled
+//	/chaos/cpu?seconds=        burn every core         -> throttling, HPA scale-up
+//	/chaos/goroutines?count=   leak blocked goroutines -> go_goroutines climbs, pprof shows where
+//
+// Each one takes a POST, so a link prefetch or a crawler can't set it off;
+// GET /chaos shows the current state. Latency and error-rate are reset by
+// setting them to 0:
+//
+//	curl -X POST 'localhost:8080/chaos/latency?ms=0'
+
+//
+// Faults can also be requested per call on any /api/ endpoint, which
+// leaves other clients alone:
+//
+//	curl 'localhost:8080/api/info?delay=500ms&status=503'
+//	curl -H 'X-Inject-Delay: 2s' -H 'X-Inject-Status: 500' localhost:8080/api/info
+//
+// Delays are capped at INJECT_MAX_DELAY (30s); INJECT_ENABLED=false turns
+// this off.
+
+// chaosState is the currently injected misbehavior
+var chaosState = &chaos.State{}
+
+func init() {
+	newGaugeFunc("chaos_leaked_goroutines", "Goroutines leaked on purpose by /chaos/goroutines.",
+		func() float64 { return float64(chaosState.Status().Goroutines) })
+}
+
+// registerChaosRoutes adds the /chaos endpoints
+func registerChaosRoutes(routes *routeRegistry) {
+	routes.HandleFunc("/chaos", "Current chaos state", chaosStatusHandler, http.MethodGet)
+	routes.HandleFunc("/chaos/crash", "Exit the process (?code=1)", recordChaosEvent(chaosCrashHandler), http.MethodPost)
+	routes.HandleFunc("/chaos/panic", "Panic in the handler; recovered as a 500, the pod keeps running", recordChaosEvent(chaosPanicHandler), http.MethodPost)
+	routes.HandleFunc("/chaos/latency", "Delay every response (?ms=)", recordChaosEvent(chaosLatencyHandler), http.MethodPost)
+	routes.HandleFunc("/chaos/error-rate", "Fail a share of requests with 500 (?percent=)", recordChaosEvent(chaosErrorRateHandler), http.MethodPost)
+	routes.HandleFunc("/chaos/memory-leak", "Allocate and never free memory (?mb=)", recordChaosEvent(chaosMemoryLeakHandler), http.MethodPost)
+	routes.HandleFunc("/chaos/cpu", "Burn all CPUs (?seconds=)", recordChaosEvent(chaosCPUHandler), http.MethodPost)
+	routes.HandleFunc("/chaos/goroutines", "Leak goroutines blocked on a channel (?count=10000&block=true)", recordChaosEvent(chaosGoroutinesHandler), http.MethodPost)
+	routes.HandleFunc("/chaos/goroutines/release", "Release the leaked goroutines", recordChaosEvent(chaosReleaseGoroutinesHandler), http.MethodPost)
+}
+
+// injectChaos applies the configured latency and error rate to handler.
+// The /chaos endpoints themselves and /admin/reset are exempt so chaos can
+// always be undone.
+func injectChaos(pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	if pattern == "/chaos" || strings.HasPrefix(pattern, "/chaos/") || pattern == "/admin/reset" {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d := chaosState.Latency(); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if chaosState.Fail() {
+			writeProblem(w, r, http.StatusInternalServerError, "chaos: injected failure")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Request-level injection settings, set in main
+var (
+	injectEnabled  = true
+	injectMaxDelay = 30 * time.Second
+)
+
+var injectedFaults = newCounterVec("injected_faults_total",
+	"Faults injected on request via ?delay=/?status= or X-Inject-* headers.", "type")
+
+// injectFromRequest applies the delay and status a caller asked for on
+// /api/ routes. The query parameter wins over the header.
+func injectFromRequest(pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	if !strings.HasPrefix(pattern, "/api/") {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !injectEnabled {
+			handler(w, r)
+			return
+		}
+		if v := injectParam(r, "delay", "X-Inject-Delay"); v != "" {
+			delay, err := time.ParseDuration(v)
+			if err != nil || delay < 0 {
+				writeProblem(w, r, http.StatusBadRequest, "delay must be a Go duration like 500ms")
+				return
+			}
+			delay = min(delay, injectMaxDelay)
+			w.Header().Set("X-Injected-Delay", delay.String())
+			injectedFaults.Inc("delay")
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if v := injectParam(r, "status", "X-Inject-Status"); v != "" {
+			code, err := strconv.Atoi(v)
+			if err != nil || code < 400 || code > 599 {
+				writeProblem(w, r, http.StatusBadRequest, "status must be an HTTP status between 400 and 599")
+				return
+			}
+			injectedFaults.Inc("status")
+			writeProblem(w, r, code, "injected status "+v)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func injectParam(r *http.Request, query, header string) string {
+	if v := r.URL.Query().Get(query); v != "" {
+		return v
+	}
+	return r.Header.Get(header)
+}
+
+func chaosStatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeChaosStatus(w)
+}
+
+// chaosPanicHandler panics, unlike /chaos/crash which exits: the recovery
+// middleware answers 500 and the process carries on
+func chaosPanicHandler(w http.ResponseWriter, r *http.Request) {
+	panic("chaos: panic requested")
+}
+
+func chaosCrashHandler(w http.ResponseWriter, r *http.Request) {
+	code, err := strconv.Atoi(r.URL.Query().Get("code"))
+	if err != nil {
+		code = 1
+	}
+	slog.Warn("chaos: crashing on request", "exit_code", code, "remote", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"crashing": true, "exit_code": code})
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	// Give the response a moment to reach the client before dying
+	remote := r.RemoteAddr
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		terminate(code, "ChaosCrash", "/chaos/crash requested by "+remote, nil)
+	}()
+}
+
+func chaosLatencyHandler(w http.ResponseWriter, r *http.Request) {
+	ms, ok := queryInt(w, r, "ms", 0, 60_000)
+	if !ok {
+		return
+	}
+	chaosState.SetLatency(ms)
+	slog.Warn("chaos: latency set", "latency_ms", ms)
+	writeChaosStatus(w)
+}
+
+func chaosErrorRateHandler(w http.ResponseWriter, r *http.Request) {
+	pct, ok := queryInt(w, r, "percent", 0, 100)
+	if !ok {
+		return
+	}
+	chaosState.SetErrorRate(pct)
+	slog.Warn("chaos: error rate set", "error_percent", pct)
+	writeChaosStatus(w)
+}
+
+func chaosMemoryLeakHandler(w http.ResponseWriter, r *http.Request) {
+	mb, ok := queryInt(w, r, "mb", 1, 4096)
+	if !ok {
+		return
+	}
+	chaosState.LeakMemory(mb)
+	slog.Warn("chaos: leaked memory", "mb", mb)
+	writeChaosStatus(w)
+}
+
+func chaosCPUHandler(w http.ResponseWriter, r *http.Request) {
+	seconds, ok := queryInt(w, r, "seconds", 1, 600)
+	if !ok {
+		return
+	}
+	workers := chaosState.BurnCPU(time.Duration(seconds) * time.Second)
+	slog.Warn("chaos: burning CPU", "seconds", seconds, "workers", workers)
+	writeChaosStatus(w)
+}
+
+// chaosGoroutinesHandler leaks goroutines blocked on a channel, or with
+// block=false waking every second. Find them with go_goroutines in
+// /metrics, then /debug/pprof/goroutine?debug=1, where they all sit in
+// chaos.leakedGoroutine.
+func chaosGoroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	count, ok := queryInt(w, r, "count", 1, 100_000)
+	if !ok {
+		return
+	}
+	block := r.URL.Query().Get("block") != "false"
+	if err := chaosState.LeakGoroutines(count, block); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "at most "+strconv.Itoa(chaos.MaxGoroutines)+" leaked goroutines; release some first")
+		return
+	}
+	slog.Warn("chaos: leaked goroutines", "count", count, "block", block, "total", chaosState.Status().Goroutines)
+	writeChaosStatus(w)
+}
+
+func chaosReleaseGoroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	released := chaosState.ReleaseGoroutines()
+	slog.Info("chaos: released leaked goroutines", "count", released)
+	writeChaosStatus(w)
+}
+
+func writeChaosStatus(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, chaosState.Status())
+}
+
+// queryInt parses an integer query parameter within [min, max], writing a
+// 400 response and returning false when it is missing or out of range
+func queryInt(w http.ResponseWriter, r *http.Request, name string, min, max int64) (int64, bool) {
+	value, err := strconv.ParseInt(r.URL.Query().Get(name), 10, 64)
+	if err != nil || value < min || value > max {
+		writeProblem(w, r, http.StatusBadRequest,
+			name+" must be an integer between "+strconv.FormatInt(min, 10)+" and "+strconv.FormatInt(max, 10))
+		return 0, false
+	}
+	return value, true
+}
@@ -0,0 +1,195 @@
+// Package chaos is the misbehavior the app injects on demand: latency and
+// errors on every request, memory and goroutines that are never freed,
+// and CPU burned on every core. Each kind is something Kubernetes reacts
+// to visibly (probe timeouts, OOMKills, throttling). The app exposes it
+// under /chaos and applies the latency and error rate in its middleware.
+package chaos
+
+import (
+	"errors"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxGoroutines caps the leaked goroutines, at roughly 2-8 KiB of stack
+// each
+const MaxGoroutines = 1_000_000
+
+// ErrTooManyGoroutines is returned when a leak would go past MaxGoroutines
+var ErrTooManyGoroutines = errors.New("too many leaked goroutines; release some first")
+
+// Status is the misbehavior in place
+type Status struct {
+	LatencyMS    int64 `json:"latency_ms"`
+	ErrorPercent int64 `json:"error_percent"`
+	LeakedMB     int   `json:"leaked_mb"`
+	CPUBurners   int64 `json:"cpu_burners"`
+	Goroutines   int64 `json:"leaked_goroutines"`
+}
+
+// Active counts the faults in place: latency, error rate, leaked memory,
+// CPU burners and leaked goroutines
+func (s Status) Active() int {
+	n := 0
+	for _, v := range []int64{s.LatencyMS, s.ErrorPercent, int64(s.LeakedMB), s.CPUBurners, s.Goroutines} {
+		if v > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// State is the currently injected misbehavior; the zero value has none
+type State struct {
+	latencyMS  atomic.Int64
+	errorRate  atomic.Int64 // percent of requests to fail
+	cpuBurners atomic.Int64
+	goroutines atomic.Int64
+
+	mu       sync.Mutex
+	leaked   [][]byte
+	leakGate chan struct{} // closed to release the leaked goroutines
+}
+
+// Status returns what is injected now
+func (s *State) Status() Status {
+	s.mu.Lock()
+	leaked := len(s.leaked)
+	s.mu.Unlock()
+	return Status{
+		LatencyMS:    s.latencyMS.Load(),
+		ErrorPercent: s.errorRate.Load(),
+		LeakedMB:     leaked,
+		CPUBurners:   s.cpuBurners.Load(),
+		Goroutines:   s.goroutines.Load(),
+	}
+}
+
+// SetLatency delays every request by ms milliseconds, 0 for none
+func (s *State) SetLatency(ms int64) { s.latencyMS.Store(ms) }
+
+// Latency is the delay to add to a request
+func (s *State) Latency() time.Duration {
+	return time.Duration(s.latencyMS.Load()) * time.Millisecond
+}
+
+// SetErrorRate fails percent of requests, 0 for none
+func (s *State) SetErrorRate(percent int64) { s.errorRate.Store(percent) }
+
+// Fail picks whether this request is one of the failed share
+func (s *State) Fail() bool {
+	pct := s.errorRate.Load()
+	return pct > 0 && rand.Int63n(100) < pct
+}
+
+// LeakMemory allocates mb MiB that are never freed until Reset. Every
+// page is touched so the memory is actually resident, not just reserved.
+func (s *State) LeakMemory(mb int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := int64(0); i < mb; i++ {
+		block := make([]byte, 1<<20)
+		for j := 0; j < len(block); j += 4096 {
+			block[j] = 1
+		}
+		s.leaked = append(s.leaked, block)
+	}
+}
+
+// BurnCPU keeps every core busy for d, returning how many burners it
+// started; they can't be stopped early
+func (s *State) BurnCPU(d time.Duration) int {
+	deadline := time.Now().Add(d)
+	workers := runtime.GOMAXPROCS(0)
+	for i := 0; i < workers; i++ {
+		s.cpuBurners.Add(1)
+		go func() {
+			defer s.cpuBurners.Add(-1)
+			for time.Now().Before(deadline) {
+				for j := 0; j < 1_000_000; j++ {
+				}
+			}
+		}()
+	}
+	return workers
+}
+
+// LeakGoroutines leaks count goroutines the way real code does: waiting
+// on a channel nobody will ever send on. With block false they wake every
+// second instead, like a forgotten ticker loop, and cost CPU as well. In
+// a goroutine profile they all sit in leakedGoroutine.
+func (s *State) LeakGoroutines(count int64, block bool) error {
+	if s.goroutines.Load()+count > MaxGoroutines {
+		return ErrTooManyGoroutines
+	}
+	s.mu.Lock()
+	if s.leakGate == nil {
+		s.leakGate = make(chan struct{})
+	}
+	gate := s.leakGate
+	s.mu.Unlock()
+	for range count {
+		s.goroutines.Add(1)
+		go leakedGoroutine(&s.goroutines, gate, block)
+	}
+	return nil
+}
+
+// leakedGoroutine waits for gate to close; its name is what pprof shows
+func leakedGoroutine(running *atomic.Int64, gate <-chan struct{}, block bool) {
+	defer running.Add(-1)
+	if block {
+		<-gate
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-gate:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReleaseGoroutines lets the leaked goroutines exit, returning how many
+// there were. They exit as the scheduler gets to them, so it waits up to a
+// second for that.
+func (s *State) ReleaseGoroutines() int64 {
+	s.release()
+	released := s.goroutines.Load()
+	for deadline := time.Now().Add(time.Second); s.goroutines.Load() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return released
+}
+
+func (s *State) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leakGate != nil {
+		close(s.leakGate)
+		s.leakGate = nil
+	}
+}
+
+// Reset undoes what can be undone, returning how many faults it cleared:
+// latency and error rate go to 0, leaked memory is dropped for the GC and
+// leaked goroutines are released. CPU burners run until their time is up.
+func (s *State) Reset() int {
+	cleared := s.Status().Active()
+	s.latencyMS.Store(0)
+	s.errorRate.Store(0)
+	s.mu.Lock()
+	s.leaked = nil
+	s.mu.Unlock()
+	s.release()
+	if s.cpuBurners.Load() > 0 {
+		cleared-- // still burning
+	}
+	return cleared
+}
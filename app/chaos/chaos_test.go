@@ -0,0 +1,58 @@
+package chaos
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReset(t *testing.T) {
+	var s State
+	s.SetLatency(250)
+	s.SetErrorRate(100)
+	s.LeakMemory(2)
+	if err := s.LeakGoroutines(10, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Status(); got != (Status{LatencyMS: 250, ErrorPercent: 100, LeakedMB: 2, Goroutines: 10}) {
+		t.Errorf("status = %+v", got)
+	}
+	if s.Latency() != 250*time.Millisecond || !s.Fail() {
+		t.Errorf("latency %v, fail %v: want 250ms and every request failed", s.Latency(), s.Fail())
+	}
+
+	if n := s.Reset(); n != 4 {
+		t.Errorf("Reset cleared %d faults, want 4", n)
+	}
+	for deadline := time.Now().Add(time.Second); s.Status().Goroutines > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := s.Status(); got.Active() != 0 {
+		t.Errorf("status after Reset = %+v, want nothing injected", got)
+	}
+	if s.Fail() {
+		t.Error("a request failed after Reset")
+	}
+}
+
+func TestLeakGoroutines(t *testing.T) {
+	var s State
+	for _, block := range []bool{true, false} {
+		if err := s.LeakGoroutines(5, block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.LeakGoroutines(MaxGoroutines, true); !errors.Is(err, ErrTooManyGoroutines) {
+		t.Errorf("leaking past the cap: %v, want ErrTooManyGoroutines", err)
+	}
+	if n := s.ReleaseGoroutines(); n != 10 {
+		t.Errorf("released %d, want 10", n)
+	}
+	if n := s.Status().Goroutines; n != 0 {
+		t.Errorf("%d goroutines still running after release", n)
+	}
+	// A new leak after a release gets a new gate
+	if err := s.LeakGoroutines(1, true); err != nil || s.ReleaseGoroutines() != 1 {
+		t.Error("leak after release didn't leak and release again")
+	}
+}
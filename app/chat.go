@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// /ws/chat is a chat room over WebSockets. Each client's connection stays
+// on the pod that accepted it, so with two replicas behind a Service half
+// the room is on each - and without shared infrastructure each half only
+// hears itself. With REDIS_ADDR set every pod publishes what its clients
+// say to a Redis channel and delivers what it hears there to its own
+// clients, which makes them one room:
+//
+//	websocat 'ws://localhost:30080/ws/chat?name=alice'
+//	websocat 'ws://localhost:30080/ws/chat?name=bob'     # maybe another pod
+//
+// Every message says which pod its sender is connected to. The first
+// message a client gets says whether the room is shared ("relay": "redis")
+// or this pod's alone ("local"). CHAT_CHANNEL (go-demo.chat) is the Redis
+// channel.
+
+// maxChatMessage bounds one message from a client
+const maxChatMessage = 4096
+
+// ChatMessage is one frame on /ws/chat
+type ChatMessage struct {
+	Type   string    `json:"type"` // message, join, leave or welcome
+	ID     string    `json:"id"`
+	From   string    `json:"from"`
+	Pod    string    `json:"pod"` // the pod the sender is connected to
+	Text   string    `json:"text,omitempty"`
+	SentAt time.Time `json:"sent_at"`
+	Relay  string    `json:"relay,omitempty"`  // welcome only: redis or local
+	Online int64     `json:"online,omitempty"` // welcome only: clients on this pod
+}
+
+var (
+	chatMessages = newCounterVec("chat_messages_total",
+		"Chat messages, by direction: published by this pod's clients, delivered to them, or dropped for a slow client.", "direction")
+	chatRelayUp atomic.Bool
+)
+
+func init() {
+	newGaugeFunc("chat_relay_connected", "1 while the Redis subscription relaying /ws/chat is up.", func() float64 {
+		return boolFloat(chatRelayUp.Load())
+	})
+}
+
+// chatRoom delivers messages to this pod's clients, and through Redis (when
+// set) to every other pod's
+type chatRoom struct {
+	redis   *redisClient
+	channel string
+
+	mu      sync.Mutex
+	clients map[*chatClient]struct{}
+}
+
+// chatClient is one connection's outbox; a client that falls this many
+// messages behind loses them rather than holding up the room
+type chatClient struct {
+	send chan []byte
+}
+
+var chat = &chatRoom{clients: map[*chatClient]struct{}{}}
+
+// startChatRelay subscribes the room to CHAT_CHANNEL; called from main when
+// REDIS_ADDR is set
+func startChatRelay(ctx context.Context, redis *redisClient) {
+	chat.redis, chat.channel = redis, getEnv("CHAT_CHANNEL", "go-demo.chat")
+	go redis.Subscribe(ctx, chat.channel, chat.deliver, func(up bool) {
+		if up != chatRelayUp.Swap(up) {
+			slog.Info("chat relay", "connected", up, "channel", chat.channel)
+		}
+	})
+}
+
+func (room *chatRoom) relay() string {
+	if room.redis != nil {
+		return "redis"
+	}
+	return "local"
+}
+
+// publish sends msg to the whole room; through Redis it comes back to this
+// pod too, the same way it reaches the others
+func (room *chatRoom) publish(ctx context.Context, msg ChatMessage) {
+	data, _ := json.Marshal(msg)
+	chatMessages.Inc("published")
+	if room.redis != nil {
+		_, err := room.redis.Do(ctx, "PUBLISH", room.channel, string(data))
+		if err == nil {
+			return
+		}
+		slog.Warn("chat publish failed, delivering on this pod only", "error", err)
+	}
+	room.deliver(data)
+}
+
+func (room *chatRoom) deliver(data []byte) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	for c := range room.clients {
+		select {
+		case c.send <- data:
+			chatMessages.Inc("delivered")
+		default:
+			chatMessages.Inc("dropped")
+		}
+	}
+}
+
+func (room *chatRoom) join(c *chatClient) int64 {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	room.clients[c] = struct{}{}
+	return int64(len(room.clients))
+}
+
+func (room *chatRoom) leave(c *chatClient) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	delete(room.clients, c)
+}
+
+func chatHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" || len(name) > 32 || !utf8.ValidString(name) {
+		name = "guest-" + randomChatID()[:4]
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	activeStreams.Add(1)
+	defer activeStreams.Done()
+	closeCode := uint16(wsNormalClosure)
+	defer func() { ws.Close(closeCode) }()
+	wsConnections.Add(1, "/ws/chat")
+	defer wsConnections.Add(-1, "/ws/chat")
+
+	hostname, _ := os.Hostname()
+	ctx := context.WithoutCancel(r.Context())
+	client := &chatClient{send: make(chan []byte, 32)}
+	online := chat.join(client)
+	defer chat.leave(client)
+	slog.Info("websocket connected", "path", "/ws/chat", "remote", r.RemoteAddr, "name", name)
+
+	welcome, _ := json.Marshal(ChatMessage{Type: "welcome", ID: randomChatID(), From: name, Pod: hostname,
+		SentAt: time.Now().UTC(), Relay: chat.relay(), Online: online})
+	if ws.WriteText(welcome) != nil {
+		return
+	}
+	announce := func(kind, text string) {
+		chat.publish(ctx, ChatMessage{Type: kind, ID: randomChatID(), From: name, Pod: hostname, Text: text, SentAt: time.Now().UTC()})
+	}
+	announce("join", "")
+	defer announce("leave", "")
+
+	incoming := make(chan string)
+	clientGone := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			msg, err := ws.readMessage(maxChatMessage)
+			if err != nil {
+				clientGone <- err
+				return
+			}
+			if text := strings.TrimSpace(string(msg)); text != "" && utf8.ValidString(text) {
+				select {
+				case incoming <- text:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		select {
+		case text := <-incoming:
+			announce("message", text)
+		case data := <-client.send:
+			if ws.WriteText(data) != nil {
+				return
+			}
+		case err := <-clientGone:
+			slog.Info("websocket disconnected", "path", "/ws/chat", "remote", r.RemoteAddr, "name", name, "reason", err.Error())
+			return
+		case <-streamsClosing:
+			closeCode = wsGoingAway
+			return
+		}
+	}
+}
+
+func randomChatID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
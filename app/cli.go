@@ -0,0 +1,193 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The binary is a small toolkit. With no subcommand it runs APP_MODE,
+// serve by default, so images and manifests running plain ./app keep
+// working and a Job can pick a mode with one env var:
+//
+//	app serve                                   the servers (default)
+//	app task -work=30s                          a simulated batch job
+//	app init -dir=/shared                       prepare a shared volume, then exit
+//	app sidecar-logs -file=/var/log/app/x.log   ship a log file to stdout as JSON
+//	app healthcheck [-url url] [-unix path]     exec probe / Docker HEALTHCHECK
+//	app loadgen -rps 50 -duration 30s <url>     HTTP load with latency stats
+//	app webhook -addr=:8443                     validating/mutating admission webhook
+//	app operator                                reconcile Greeting custom resources
+//	app proxy -upstream http://go-app-service   caching reverse proxy
+//	app version [-json]                         build metadata
+//
+// Servers are configured by env vars, which serve's flags and the config
+// file can also set (see settings.go); flags drive the other modes.
+
+// command is one subcommand; run returns the exit code
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"serve", "Run the app, admin and gRPC servers (default)", runServe},
+	{"task", "Simulate a batch job with progress logs and a chosen exit code, for Jobs and CronJobs", runTask},
+	{"init", "Write config and a marker file into a shared volume, for init containers", runInit},
+	{"sidecar-logs", "Follow a log file in a shared volume and re-emit it as JSON with pod metadata", runSidecarLogs},
+	{"healthcheck", "GET a URL, exit 0 on 2xx: for exec probes in images without curl", runHealthcheck},
+	{"loadgen", "Send HTTP load and report status codes, latencies and pods", runLoadgen},
+	{"webhook", "Serve admission webhooks: require resource limits, add a label", runWebhook},
+	{"operator", "Reconcile Greeting custom resources into status, serve them at /api/greetings", runOperator},
+	{"proxy", "Caching reverse proxy in front of an upstream, with hit/miss headers and metrics", runProxy},
+	{"version", "Print build metadata", runVersion},
+}
+
+func main() {
+	args := os.Args[1:]
+	name := getEnv("APP_MODE", "serve")
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(args))
+		}
+	}
+	if name != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	}
+	usage(os.Stderr)
+	if name != "help" {
+		os.Exit(2)
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-13s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun '%s <command> -h' for a command's flags.\n", os.Args[0])
+}
+
+// newFlagSet returns a flag set that prints its usage line and exits 2 on
+// bad flags, like the go tool's subcommands
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n\nFlags:\n", os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runServe(args []string) int {
+	fs := newFlagSet("serve", "")
+	applyFlags := addSettingFlags(fs)
+	fs.Parse(args)
+	applyFlags()
+	loadSettingsFile(getEnv("CONFIG_FILE", defaultConfigFile))
+	return serve()
+}
+
+// runHealthcheck is a dependency-free probe: distroless and scratch images
+// have no curl or wget for an exec probe or HEALTHCHECK to call
+func runHealthcheck(args []string) int {
+	fs := newFlagSet("healthcheck", "[url]")
+	target := fs.String("url", "", "URL to check, same as the argument (default /health on the admin port)")
+	timeout := fs.Duration("timeout", 2*time.Second, "give up after this long")
+	insecure := fs.Bool("insecure", false, "skip TLS verification (self-signed localhost certs)")
+	unixPath := fs.String("unix", "", "connect to this Unix socket (UDS_PATH) instead of the URL's host")
+	quiet := fs.Bool("q", false, "print nothing, only set the exit code")
+	fs.Parse(args)
+
+	defaultURL := defaultHealthURL()
+	if *unixPath != "" {
+		defaultURL = "http://localhost/api/version" // the app port's routes; /health may be on the admin port
+	}
+	url := cmp.Or(*target, fs.Arg(0), defaultURL)
+	client := &http.Client{Timeout: *timeout}
+	transport := &http.Transport{}
+	if *insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if *unixPath != "" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", *unixPath)
+		}
+	}
+	client.Transport = transport
+	start := time.Now()
+	res, err := client.Get(url)
+	if err != nil {
+		if !*quiet {
+			fmt.Fprintln(os.Stderr, "unhealthy:", err)
+		}
+		return 1
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "unhealthy: %s returned %d in %s\n", url, res.StatusCode, elapsed)
+		}
+		return 1
+	}
+	if !*quiet {
+		fmt.Printf("healthy: %s returned %d in %s\n", url, res.StatusCode, elapsed)
+	}
+	return 0
+}
+
+// defaultHealthURL is /health on the admin port, or on PORT when the
+// admin endpoints share it, read from the same env as serve
+func defaultHealthURL() string {
+	port := getEnv("PORT", "8080")
+	scheme := "http"
+	if adminPort := getEnv("ADMIN_PORT", "9090"); adminPort != "0" && adminPort != port {
+		port = adminPort
+	} else if getEnv("TLS_CERT_FILE", "") != "" {
+		scheme = "https"
+	}
+	return scheme + "://127.0.0.1:" + port + "/health"
+}
+
+func runVersion(args []string) int {
+	fs := newFlagSet("version", "")
+	asJSON := fs.Bool("json", false, "print JSON, like /api/version")
+	fs.Parse(args)
+
+	v := buildInfo()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return 0
+	}
+	fmt.Printf("version:    %s\n", v.Version)
+	if v.GitCommit != "" {
+		dirty := ""
+		if v.GitDirty {
+			dirty = " (dirty)"
+		}
+		fmt.Printf("commit:     %s%s\n", v.GitCommit, dirty)
+	}
+	if v.BuildDate != "" {
+		fmt.Printf("built:      %s\n", v.BuildDate)
+	}
+	fmt.Printf("go:         %s %s\n", v.GoVersion, v.Platform)
+	return 0
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The container's idea of the time, and how far it is off:
+//
+//	curl -s localhost:30080/api/time | jq '{utc, local, timezone}'
+//	curl -s 'localhost:30080/api/time?ntp=pool.ntp.org' | jq .ntp
+//	kubectl set env deploy/go-app -n go-demo TZ=Europe/Berlin   # then ask again
+//
+// A container has the node's clock (there is no clock namespace to give
+// it its own) but its image's timezone database. This image is alpine
+// without tzdata, so TZ=Europe/Berlin can't be found and Go falls back to
+// UTC without a word: timezone.error says so. Mount the node's
+// /usr/share/zoneinfo, add tzdata to the image, or build with
+// -tags timetzdata to fix it; better still, keep servers on UTC and
+// convert at the edges, so logs from every pod line up.
+//
+// Uptime is measured twice: on the monotonic clock, which only moves
+// forward, and on the wall clock, which NTP may step. They differ when
+// the wall clock was set since the start, and the difference is why
+// durations should never come from subtracting timestamps.
+//
+// The drift check is one SNTP query (UDP 123) to ?ntp= or NTP_SERVER; a
+// NetworkPolicy without egress to it makes it time out. Pods that disagree
+// by more than NTP_MAX_DRIFT (1s) put certificates, JWT expiry and the
+// order of log lines across pods at risk.
+
+// ClockZone is the container's local timezone
+type ClockZone struct {
+	Name          string `json:"name"` // as Go resolved it: "Local" when from /etc/localtime
+	Abbreviation  string `json:"abbreviation"`
+	OffsetSeconds int    `json:"offset_seconds"`
+	TZ            string `json:"tz,omitempty"`    // the TZ variable
+	LocalTime     bool   `json:"etc_localtime"`   // whether /etc/localtime exists
+	Error         string `json:"error,omitempty"` // why TZ couldn't be loaded
+}
+
+// ClockNTP is the drift against an NTP server
+type ClockNTP struct {
+	Server         string     `json:"server"`
+	ServerTime     *time.Time `json:"server_time,omitempty"`
+	OffsetMS       float64    `json:"offset_ms"` // server minus us: positive when our clock is behind
+	RoundTripMS    float64    `json:"round_trip_ms"`
+	Stratum        int        `json:"stratum,omitempty"`
+	MaxDriftMS     float64    `json:"max_drift_ms"`
+	WithinMaxDrift bool       `json:"within_max_drift"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// TimeResponse is returned by /api/time
+type TimeResponse struct {
+	UTC               time.Time `json:"utc"`
+	Local             string    `json:"local"` // RFC 3339 in the local zone
+	Unix              int64     `json:"unix"`
+	Timezone          ClockZone `json:"timezone"`
+	StartedAt         time.Time `json:"started_at"`
+	UptimeSeconds     float64   `json:"uptime_seconds"`      // monotonic clock
+	WallUptimeSeconds float64   `json:"wall_uptime_seconds"` // wall clock, stepped by NTP
+	WallClockStepMS   float64   `json:"wall_clock_step_ms"`  // wall minus monotonic
+	NTP               *ClockNTP `json:"ntp,omitempty"`
+	Pod               string    `json:"pod"`
+}
+
+var clockDrift = newGaugeVec("clock_drift_seconds", "Offset of an NTP server's clock from ours at the last /api/time check, by server.", "server")
+
+// ntpEpochOffset is the seconds from 1900, NTP's epoch, to 1970
+const ntpEpochOffset = 2208988800
+
+// sntpQuery asks server for the time once, over SNTP (RFC 4330)
+func sntpQuery(ctx context.Context, server string, maxDrift time.Duration) ClockNTP {
+	result := ClockNTP{Server: server, MaxDriftMS: float64(maxDrift.Milliseconds())}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // leap 0, version 4, mode 3 (client)
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	received := time.Now()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if n < 48 || resp[0]&0x07 != 4 {
+		result.Error = "not an NTP server reply"
+		return result
+	}
+	if resp[1] == 0 {
+		result.Error = fmt.Sprintf("server sent kiss code %q", resp[12:16])
+		return result
+	}
+	receivedAt, transmitAt := ntpTime(resp[32:40]), ntpTime(resp[40:48])
+	// The server's clock was offset by the mean of what each leg shows,
+	// and the round trip is the elapsed time less the server's own
+	offset := (receivedAt.Sub(sent) + transmitAt.Sub(received)) / 2
+	rtt := received.Sub(sent) - transmitAt.Sub(receivedAt)
+	serverTime := transmitAt.UTC()
+	result.ServerTime = &serverTime
+	result.OffsetMS = roundTo(float64(offset.Microseconds())/1000, 3)
+	result.RoundTripMS = roundTo(float64(rtt.Microseconds())/1000, 3)
+	result.Stratum = int(resp[1])
+	result.WithinMaxDrift = offset.Abs() <= maxDrift
+	clockDrift.Set(offset.Seconds(), result.Server)
+	return result
+}
+
+// ntpTime decodes a 64-bit NTP timestamp: seconds since 1900 and a fraction
+func ntpTime(b []byte) time.Time {
+	secs, frac := binary.BigEndian.Uint32(b[:4]), binary.BigEndian.Uint32(b[4:])
+	nanos := (int64(frac) * int64(time.Second)) >> 32
+	return time.Unix(int64(secs)-ntpEpochOffset, nanos)
+}
+
+// localZone describes time.Local and what it was resolved from
+func localZone(now time.Time) ClockZone {
+	abbr, offset := now.In(time.Local).Zone()
+	z := ClockZone{Name: time.Local.String(), Abbreviation: abbr, OffsetSeconds: offset, TZ: os.Getenv("TZ")}
+	if _, err := os.Stat("/etc/localtime"); err == nil {
+		z.LocalTime = true
+	}
+	if z.TZ != "" {
+		if _, err := time.LoadLocation(z.TZ); err != nil {
+			z.Error = err.Error() + ": no tzdata in the image, using UTC"
+		}
+	}
+	return z
+}
+
+func timeHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	now := time.Now()
+	hostname, _ := os.Hostname()
+	monotonic := now.Sub(startTime)
+	wall := now.Round(0).Sub(startTime.Round(0)) // Round(0) drops the monotonic reading
+	resp := TimeResponse{
+		UTC:               now.UTC(),
+		Local:             now.Format(time.RFC3339Nano),
+		Unix:              now.Unix(),
+		Timezone:          localZone(now),
+		StartedAt:         startTime.UTC(),
+		UptimeSeconds:     roundTo(monotonic.Seconds(), 3),
+		WallUptimeSeconds: roundTo(wall.Seconds(), 3),
+		WallClockStepMS:   roundTo(float64((wall-monotonic).Microseconds())/1000, 3),
+		Pod:               hostname,
+	}
+	if server := cmp.Or(r.URL.Query().Get("ntp"), getEnv("NTP_SERVER", "")); server != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		ntp := sntpQuery(ctx, server, getEnvDuration("NTP_MAX_DRIFT", time.Second))
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && ntp.Error != "" {
+			ntp.Error = "no answer in 2s (UDP 123 blocked by a NetworkPolicy or firewall?): " + ntp.Error
+		}
+		resp.NTP = &ntp
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cluster view over a headless Service. With PEER_SERVICE set, every
+// replica resolves it every CLUSTER_GOSSIP_INTERVAL (10s), asks each
+// address for /api/info and /api/stats, and keeps what it heard, so any
+// pod can answer /api/cluster for all of them without a round of requests:
+//
+//	curl -s localhost:30080/api/cluster | jq '.members[] | {name, version, requests_total, state}'
+//
+// Behind a Deployment the DNS names are made from pod IPs
+// (10-244-0-5.go-app-headless...) and change on every restart; behind a
+// StatefulSet whose serviceName is the headless Service they are the
+// stable go-app-cluster-0.go-app-cluster... and survive a reschedule
+// (k8s/advanced/cluster-statefulset.yaml). Only ready pods are in DNS, so
+// a pod failing its readiness probe drops to "gone" and is forgotten a
+// minute later; one in DNS that doesn't answer is "unreachable", with its
+// last known stats.
+//
+// Each round also fetches /api/config/version, for the config skew report
+// (configskew.go).
+//
+// Unlike /api/dashboard, which asks every pod when it is asked, the view
+// can be up to an interval old: last_seen says how old.
+
+// ClusterMember is one replica as last heard from
+type ClusterMember struct {
+	Name          string         `json:"name"` // pod name from /api/info
+	DNSName       string         `json:"dns_name,omitempty"`
+	IP            string         `json:"ip"`
+	Self          bool           `json:"self"`
+	State         string         `json:"state"` // alive, unreachable or gone
+	Version       string         `json:"version,omitempty"`
+	Node          string         `json:"node,omitempty"`
+	Zone          string         `json:"zone,omitempty"`
+	Ordinal       *int           `json:"ordinal,omitempty"`
+	Role          string         `json:"role,omitempty"`
+	Ready         bool           `json:"ready"`
+	UptimeSeconds float64        `json:"uptime_seconds"`
+	RequestsTotal int64          `json:"requests_total"`
+	Config        *ConfigVersion `json:"config,omitempty"` // nil from a pod without /api/config/version
+	LastSeen      *time.Time     `json:"last_seen,omitempty"`
+	Error         string         `json:"error,omitempty"`
+}
+
+// ClusterResponse is returned by /api/cluster
+type ClusterResponse struct {
+	Service   string          `json:"service"`
+	ServedBy  string          `json:"served_by"`
+	Interval  string          `json:"interval"`
+	LastRound time.Time       `json:"last_round"`
+	Error     string          `json:"error,omitempty"` // the last DNS lookup's, if it failed
+	Members   []ClusterMember `json:"members"`
+	Totals    struct {
+		Members  int            `json:"members"`
+		Alive    int            `json:"alive"`
+		Requests int64          `json:"requests"` // across alive and unreachable members
+		Versions map[string]int `json:"versions"`
+	} `json:"totals"`
+}
+
+// clusterGossip polls the headless Service's pods
+type clusterGossip struct {
+	service  string
+	port     string
+	interval time.Duration
+	client   *http.Client
+
+	mu        sync.Mutex
+	members   map[string]*ClusterMember // by IP
+	lastRound time.Time
+	lastErr   string
+}
+
+// cluster is set in main when PEER_SERVICE is set
+var cluster *clusterGossip
+
+var (
+	clusterFetches = newCounterVec("cluster_gossip_fetches_total",
+		"Peer /api/info and /api/stats fetches for the cluster view, by result (ok, error).", "result")
+	clusterMembers = newGaugeVec("cluster_members", "Replicas in the cluster view, by state.", "state")
+)
+
+// newClusterGossipFromEnv returns nil unless PEER_SERVICE is set; the
+// default /api/peers falls back to isn't enough to turn it on
+func newClusterGossipFromEnv(port string) *clusterGossip {
+	service := getEnv("PEER_SERVICE", "")
+	if service == "" {
+		return nil
+	}
+	g := &clusterGossip{
+		service:  service,
+		port:     port,
+		interval: getEnvDuration("CLUSTER_GOSSIP_INTERVAL", 10*time.Second),
+		client:   &http.Client{Transport: tracingTransport{base: http.DefaultTransport}, Timeout: 2 * time.Second},
+		members:  map[string]*ClusterMember{},
+	}
+	newGaugeFunc("cluster_view_age_seconds", "Seconds since the cluster view was last refreshed.", func() float64 {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.lastRound.IsZero() {
+			return 0
+		}
+		return time.Since(g.lastRound).Seconds()
+	})
+	return g
+}
+
+// run refreshes the view every interval until ctx is done
+func (g *clusterGossip) run(ctx context.Context) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		g.round(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// round resolves the Service and asks every address it returns
+func (g *clusterGossip) round(ctx context.Context) {
+	lookupCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	peers, err := lookupPeerDNS(lookupCtx, g.service)
+	cancel()
+
+	heard := make([]ClusterMember, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			heard[i] = g.fetch(ctx, peer)
+		}()
+	}
+	wg.Wait()
+	defer func() { recordConfigSkew(g.view()) }()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	g.lastRound, g.lastErr = now, ""
+	if err != nil {
+		// Keep the last view rather than report everyone gone over a DNS blip
+		g.lastErr = err.Error()
+		slog.Warn("cluster view: DNS lookup failed", "service", g.service, "error", err)
+		return
+	}
+	inDNS := map[string]bool{}
+	for _, m := range heard {
+		inDNS[m.IP] = true
+		if prev, ok := g.members[m.IP]; ok && m.State == "unreachable" {
+			// Keep what it said last time
+			prev.State, prev.Error, prev.DNSName = m.State, m.Error, m.DNSName
+			continue
+		}
+		g.members[m.IP] = &m
+	}
+	counts := map[string]int{}
+	for ip, m := range g.members {
+		if !inDNS[ip] {
+			if m.LastSeen == nil || now.Sub(*m.LastSeen) > time.Minute {
+				delete(g.members, ip)
+				continue
+			}
+			m.State, m.Error = "gone", "no longer in "+g.service+" (not ready, or deleted)"
+		}
+		counts[m.State]++
+	}
+	for _, state := range []string{"alive", "unreachable", "gone"} {
+		clusterMembers.Set(float64(counts[state]), state)
+	}
+}
+
+// fetch asks one address for /api/info and /api/stats
+func (g *clusterGossip) fetch(ctx context.Context, peer Peer) ClusterMember {
+	m := ClusterMember{DNSName: peer.Name, IP: peer.IP, Self: peer.Self, State: "unreachable"}
+	base := "http://" + net.JoinHostPort(peer.IP, g.port)
+	var info AppInfo
+	var stats PodSnapshot
+	err := g.getJSON(ctx, base+"/api/info", &info)
+	if err == nil {
+		err = g.getJSON(ctx, base+"/api/stats", &stats)
+	}
+	if err != nil {
+		clusterFetches.Inc("error")
+		m.Error = err.Error()
+		return m
+	}
+	clusterFetches.Inc("ok")
+	var config ConfigVersion
+	if g.getJSON(ctx, base+"/api/config/version", &config) == nil {
+		m.Config = &config
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	m.Name, m.Version, m.Node, m.Zone = info.Hostname, info.Version, info.Node, info.Zone
+	m.Self = m.Self || info.Hostname == hostname
+	m.Ordinal, m.Role = info.Ordinal, info.Role
+	m.Ready, m.UptimeSeconds, m.RequestsTotal = stats.Ready, stats.UptimeSeconds, stats.RequestsTotal
+	m.State, m.LastSeen = "alive", &now
+	return m
+}
+
+func (g *clusterGossip) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// view is the members sorted by name, this pod always among them
+func (g *clusterGossip) view() ClusterResponse {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	hostname, _ := os.Hostname()
+	resp := ClusterResponse{
+		Service:   g.service,
+		ServedBy:  hostname,
+		Interval:  g.interval.String(),
+		LastRound: g.lastRound,
+		Error:     g.lastErr,
+		Members:   []ClusterMember{},
+	}
+	self := false
+	for _, m := range g.members {
+		if m.Self {
+			self = true
+		}
+		resp.Members = append(resp.Members, *m)
+	}
+	if !self {
+		// Not ready, so not in DNS (or not in a cluster at all)
+		snap, pod, now := podSnapshot(), readPodInfo(), time.Now()
+		m := ClusterMember{
+			Name: hostname, IP: pod.IP, Self: true, State: "alive", Version: snap.Version, Node: pod.Node,
+			Zone: topology().Zone, Ready: snap.Ready, UptimeSeconds: snap.UptimeSeconds,
+			RequestsTotal: snap.RequestsTotal, LastSeen: &now,
+		}
+		config := currentConfigVersion()
+		m.Config = &config
+		if o, ok := statefulSetOrdinal(); ok {
+			m.Ordinal, m.Role = &o.ordinal, o.role()
+		}
+		resp.Members = append(resp.Members, m)
+	}
+	sort.Slice(resp.Members, func(i, j int) bool {
+		a, b := resp.Members[i], resp.Members[j]
+		return a.Name < b.Name || a.Name == b.Name && a.IP < b.IP
+	})
+	resp.Totals.Members = len(resp.Members)
+	resp.Totals.Versions = map[string]int{}
+	for _, m := range resp.Members {
+		if m.State == "alive" {
+			resp.Totals.Alive++
+		}
+		if m.State != "gone" {
+			resp.Totals.Requests += m.RequestsTotal
+		}
+		if m.Version != "" {
+			resp.Totals.Versions[m.Version]++
+		}
+	}
+	return resp
+}
+
+func clusterHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	if cluster == nil {
+		writeProblem(w, r, http.StatusNotFound, "the cluster view is off; set PEER_SERVICE to a headless Service")
+		return
+	}
+	writeJSON(w, http.StatusOK, cluster.view())
+}
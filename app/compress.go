@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Response compression, negotiated per request from Accept-Encoding:
+//
+//	COMPRESSION=false                   leave it to the Ingress (on by default)
+//	COMPRESSION_MIN_SIZE=1024           smaller bodies go out as they are
+//	COMPRESSION_TYPES=text/html,...     media types worth compressing; text/* works
+//
+//	curl -s -o /dev/null -w '%{size_download}\n' localhost:8080/api/routes
+//	curl -s -o /dev/null -w '%{size_download}\n' -H 'Accept-Encoding: gzip' localhost:8080/api/routes
+//
+// Bodies are held back until COMPRESSION_MIN_SIZE bytes are written (or the
+// handler flushes or finishes), because below a packet or so the gzip
+// header costs more than it saves. Streams (/events, WebSockets) and
+// already-encoded or partial (206) responses pass through untouched.
+//
+// With an Ingress in front, the two layers don't double-compress: nginx's
+// use-gzip skips responses that already carry Content-Encoding. Compressing
+// here costs this pod's CPU (see /api/resources) and saves bandwidth on
+// every hop, Service and node included; compressing at the Ingress
+// centralizes the CPU but only shrinks the last hop to the client.
+// Compressed responses get Vary: Accept-Encoding, and strong ETags become
+// weak, since the bytes differ per encoding - which is what nginx does too.
+
+// compressionConfig is set in main unless COMPRESSION=false
+type compressionConfig struct {
+	minSize int
+	types   []string // media types; entries ending in / match a prefix
+}
+
+var compression *compressionConfig
+
+const defaultCompressionTypes = "text/html,text/css,text/plain,text/javascript,application/javascript,application/json,application/xml,image/svg+xml"
+
+var (
+	compressedResponses = newCounterVec("http_compressed_responses_total",
+		"Responses compressed, by encoding.", "encoding")
+	compressionSkipped = newCounterVec("http_compression_skipped_total",
+		"Responses sent uncompressed, by reason.", "reason")
+	compressionBytesIn = newCounterVec("http_compression_uncompressed_bytes_total",
+		"Body bytes handlers wrote to compressed responses.", "encoding")
+	compressionBytesSaved = newCounterVec("http_compression_saved_bytes_total",
+		"Bytes compression kept off the wire.", "encoding")
+)
+
+// newCompressionFromEnv returns nil when compression is off
+func newCompressionFromEnv() *compressionConfig {
+	if !getEnvBool("COMPRESSION", true) {
+		return nil
+	}
+	c := &compressionConfig{minSize: int(max(getEnvInt("COMPRESSION_MIN_SIZE", 1024), 0))}
+	for _, t := range strings.Split(getEnv("COMPRESSION_TYPES", defaultCompressionTypes), ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			c.types = append(c.types, strings.TrimSuffix(t, "*"))
+		}
+	}
+	return c
+}
+
+// compressible reports whether contentType is one of the configured types
+func (c *compressionConfig) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" { // SSE must reach the client event by event
+		return false
+	}
+	for _, t := range c.types {
+		if mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks gzip or deflate by Accept-Encoding q-value,
+// gzip on a tie, or "" when the client accepts neither
+func negotiateEncoding(acceptEncoding string) string {
+	weights, wildcard := map[string]float64{}, 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if name == "*" {
+			wildcard = q
+		} else if name != "" {
+			weights[name] = q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range []string{"gzip", "deflate"} {
+		q, ok := weights[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// encoder is what gzip.Writer and zlib.Writer have in common
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// HTTP's "deflate" is the zlib format, not raw deflate
+var encoderPools = map[string]*sync.Pool{
+	"gzip":    {New: func() any { return gzip.NewWriter(io.Discard) }},
+	"deflate": {New: func() any { return zlib.NewWriter(io.Discard) }},
+}
+
+// countingWriter counts the compressed bytes on their way out
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// compressWriter buffers the start of a body to decide, then either
+// compresses the rest or passes it through
+type compressWriter struct {
+	http.ResponseWriter
+	cfg      *compressionConfig
+	encoding string // negotiated; "" when the client accepts neither
+	status   int
+	buf      []byte
+	decided  bool
+	enc      encoder // nil when passing through
+	out      *countingWriter
+	in       int64
+	hijacked bool
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.decided {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		c.ResponseWriter.WriteHeader(code) // 103 Early Hints and friends go straight out
+		return
+	}
+	if c.status == 0 {
+		c.status = code
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !c.decided {
+		c.buf = append(c.buf, b...)
+		if len(c.buf) >= c.cfg.minSize {
+			if err := c.decide(false); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if c.enc != nil {
+		c.in += int64(len(b))
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// skipReason says why the response can't be compressed, or ""
+func (c *compressWriter) skipReason(final bool) string {
+	h := c.Header()
+	switch {
+	case c.status == http.StatusNoContent || c.status == http.StatusNotModified || c.status == http.StatusPartialContent:
+		return "status"
+	case h.Get("Content-Encoding") != "":
+		return "already_encoded"
+	case !c.cfg.compressible(h.Get("Content-Type")):
+		return "content_type"
+	case final && len(c.buf) < c.cfg.minSize:
+		return "too_small"
+	case c.encoding == "":
+		return "not_accepted"
+	}
+	return ""
+}
+
+// decide sends the headers and the buffered start of the body; final is
+// set when the handler has finished, so the buffer is the whole body
+func (c *compressWriter) decide(final bool) error {
+	c.decided = true
+	h := c.Header()
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if h.Get("Content-Type") == "" && len(c.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(c.buf)) // as net/http would, but before choosing
+	}
+	reason := c.skipReason(final)
+	if reason == "" || reason == "not_accepted" {
+		h.Add("Vary", "Accept-Encoding") // caches must not serve gzip to clients that didn't ask
+	}
+	if reason != "" {
+		compressionSkipped.Inc(reason)
+		c.ResponseWriter.WriteHeader(c.status)
+		_, err := c.ResponseWriter.Write(c.buf)
+		c.buf = nil
+		return err
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", c.encoding)
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	c.out = &countingWriter{w: c.ResponseWriter}
+	c.enc = encoderPools[c.encoding].Get().(encoder)
+	c.enc.Reset(c.out)
+	c.in = int64(len(c.buf))
+	_, err := c.enc.Write(c.buf)
+	c.buf = nil
+	return err
+}
+
+// Flush sends what is buffered, compressed so far, for streaming handlers
+func (c *compressWriter) Flush() {
+	if c.hijacked {
+		return
+	}
+	if !c.decided {
+		c.decide(false)
+	}
+	if c.enc != nil {
+		c.enc.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Hijack hands the connection over (WebSockets); nothing was written yet
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(c.ResponseWriter).Hijack()
+	if err == nil {
+		c.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (c *compressWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+// finish writes out a body still buffered, or the gzip trailer
+func (c *compressWriter) finish() {
+	if c.hijacked {
+		return
+	}
+	if !c.decided {
+		c.decide(true)
+	}
+	if c.enc == nil {
+		return
+	}
+	c.enc.Close()
+	encoderPools[c.encoding].Put(c.enc)
+	compressedResponses.Inc(c.encoding)
+	compressionBytesIn.Add(float64(c.in), c.encoding)
+	compressionBytesSaved.Add(float64(max(c.in-c.out.n, 0)), c.encoding)
+}
+
+// compress negotiates the encoding and compresses the body when it pays
+func compress(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if compression == nil || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, cfg: compression, encoding: negotiateEncoding(r.Header.Get("Accept-Encoding"))}
+		next(cw, r)
+		cw.finish()
+	}
+}
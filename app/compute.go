@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/cache"
+)
+
+// CPU work with a known answer, for HPA demos that need more than a busy
+// loop and for a lesson in caching. Each result is looked up in a per-pod
+// LRU, then in Redis (when REDIS_ADDR is set), and only computed when
+// neither has it:
+//
+//	curl -s localhost:30080/api/compute/fib/90000 | jq '{cache, compute_ms}'
+//	curl -s 'localhost:30080/api/compute/primes?upTo=5000000' | jq '{count, cache}'
+//
+//	COMPUTE_CACHE_SIZE=256      entries in each pod's LRU, 0 for none
+//	COMPUTE_CACHE_MEMORY_TTL=0  how long the LRU keeps a result, 0 until evicted
+//	COMPUTE_CACHE_TTL=10m       how long Redis keeps a result, 0 for no Redis tier
+//
+// ?cache=none skips both tiers, which is how to make the endpoint a steady
+// CPU load. Through a Service the memory tier's hit rate drops as replicas
+// are added - each one warms its own - while the Redis tier's doesn't;
+// compute_cache_hit_ratio{tier} shows both.
+
+// Limits keep one request to a few seconds of CPU and tens of MB
+const (
+	maxFibN       = 200000
+	maxPrimesUpTo = 20000000
+)
+
+// ComputeResponse is returned by /api/compute/*
+type ComputeResponse struct {
+	Function  string  `json:"function"`
+	Input     int64   `json:"input"`
+	Result    any     `json:"result"`
+	Cache     string  `json:"cache"`           // memory, redis, miss or bypass; hot or peer with groupcache
+	Owner     string  `json:"owner,omitempty"` // the groupcache owner pod
+	ComputeMS float64 `json:"compute_ms"`
+	Pod       string  `json:"pod"`
+}
+
+// FibResult is fib(n), as a decimal string since it outgrows any integer
+type FibResult struct {
+	Digits int    `json:"digits"`
+	Value  string `json:"value"`
+}
+
+// PrimesResult counts the primes up to a limit
+type PrimesResult struct {
+	Count   int   `json:"count"`
+	Largest int   `json:"largest,omitempty"`
+	Last    []int `json:"last"` // the ten largest
+}
+
+var (
+	computeLRU       = cache.New[json.RawMessage]("compute", 256, 0) // COMPUTE_CACHE_SIZE and COMPUTE_CACHE_MEMORY_TTL, set in serve
+	computeRedisTTL  = 10 * time.Minute                              // COMPUTE_CACHE_TTL, set in serve
+	computeLookups   = newCounterVec("compute_cache_requests_total", "Compute cache lookups, by tier (memory, redis) and result (hit, miss, error).", "tier", "result")
+	computeHitRatio  = newGaugeVec("compute_cache_hit_ratio", "Share of compute cache lookups that hit, by tier, since the pod started.", "tier")
+	computeDurations = newHistogramVec("compute_duration_seconds", "Time spent computing results the caches didn't have, by function.",
+		[]float64{0.001, 0.01, 0.05, 0.1, 0.5, 1, 2, 5}, "function")
+	computeTierStats = map[string]*cacheTierStats{"memory": {}, "redis": {}}
+)
+
+type cacheTierStats struct{ hits, lookups atomic.Int64 }
+
+func recordComputeLookup(tier, result string) {
+	computeLookups.Inc(tier, result)
+	s := computeTierStats[tier]
+	if result == "hit" {
+		s.hits.Add(1)
+	}
+	n := s.lookups.Add(1)
+	computeHitRatio.Set(float64(s.hits.Load())/float64(n), tier)
+}
+
+func init() {
+	newGaugeFunc("compute_cache_entries", "Results held in this pod's compute LRU.", func() float64 { return float64(computeLRU.Len()) })
+}
+
+// computeFibHandler serves /api/compute/fib/{n}
+func computeFibHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	n, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/compute/fib/"), 10, 64)
+	if err != nil || n < 0 || n > maxFibN {
+		writeProblem(w, r, http.StatusBadRequest, "n must be an integer between 0 and "+strconv.Itoa(maxFibN)+", as in /api/compute/fib/90")
+		return
+	}
+	serveComputed(w, r, "fib", n, func(ctx context.Context) (any, error) { return fibonacci(ctx, n) })
+}
+
+// computePrimesHandler serves /api/compute/primes?upTo=
+func computePrimesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	upTo, ok := queryInt(w, r, "upTo", 2, maxPrimesUpTo)
+	if !ok {
+		return
+	}
+	serveComputed(w, r, "primes", upTo, func(ctx context.Context) (any, error) { return sievePrimes(ctx, int(upTo)) })
+}
+
+// serveComputed answers from the first tier that has the result, computing
+// and storing it when none does. With GROUPCACHE the key's owner pod does
+// that, see groupcache.go.
+func serveComputed(w http.ResponseWriter, r *http.Request, function string, input int64, compute func(context.Context) (any, error)) {
+	hostname, _ := os.Hostname()
+	resp := ComputeResponse{Function: function, Input: input, Pod: hostname}
+	key := function + ":" + strconv.FormatInt(input, 10)
+
+	if r.URL.Query().Get("cache") == "none" {
+		if degraded.skip(w, "compute") {
+			shedDegraded(w, r, "only cached results are served, ?cache=none is off")
+			return
+		}
+		start := time.Now()
+		result, err := compute(r.Context())
+		if err != nil {
+			writeProblem(w, r, http.StatusServiceUnavailable, "computation cancelled: "+err.Error())
+			return
+		}
+		elapsed := time.Since(start)
+		computeDurations.Observe(elapsed.Seconds(), function)
+		resp.Result, resp.Cache, resp.ComputeMS = result, "bypass", float64(elapsed.Microseconds())/1000
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	var res computedResult
+	var err error
+	if degraded.Active() {
+		// this pod's tiers only: no peer fetch, no computing
+		if cached, ok := computeLookup(r.Context(), "compute:"+key); ok {
+			resp.Result, resp.Cache = cached.data, cached.tier
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		if degraded.skip(w, "compute") {
+			shedDegraded(w, r, key+" isn't cached and won't be computed")
+			return
+		}
+	}
+	if g := groupcache; g != nil {
+		res, resp.Owner, err = g.Get(r.Context(), key)
+	} else {
+		res, err = computeLocal(r.Context(), function, key, compute)
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusServiceUnavailable, "computation cancelled: "+err.Error())
+		return
+	}
+	resp.Result, resp.Cache, resp.ComputeMS = res.data, res.tier, res.ms
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// computedResult is a result as JSON, with where it came from
+type computedResult struct {
+	data json.RawMessage
+	tier string  // memory, redis or miss; hot or peer through groupcache
+	ms   float64 // computing it, when it wasn't cached
+}
+
+// computeLocal answers key (fib:90) from this pod's LRU or Redis, else
+// computes and stores it in both
+func computeLocal(ctx context.Context, function, key string, compute func(context.Context) (any, error)) (computedResult, error) {
+	key = "compute:" + key
+	if cached, ok := computeLookup(ctx, key); ok {
+		return computedResult{data: cached.data, tier: cached.tier}, nil
+	}
+	start := time.Now()
+	result, err := compute(ctx)
+	if err != nil {
+		return computedResult{}, err
+	}
+	elapsed := time.Since(start)
+	computeDurations.Observe(elapsed.Seconds(), function)
+	return computedResult{data: computeStore(ctx, key, result), tier: "miss", ms: float64(elapsed.Microseconds()) / 1000}, nil
+}
+
+// computeFunctions check an input and return its computation, for peers
+// asking through groupcache
+var computeFunctions = map[string]func(input int64) (compute func(context.Context) (any, error), problem string){
+	"fib": func(n int64) (func(context.Context) (any, error), string) {
+		if n < 0 || n > maxFibN {
+			return nil, "n must be between 0 and " + strconv.Itoa(maxFibN)
+		}
+		return func(ctx context.Context) (any, error) { return fibonacci(ctx, n) }, ""
+	},
+	"primes": func(upTo int64) (func(context.Context) (any, error), string) {
+		if upTo < 2 || upTo > maxPrimesUpTo {
+			return nil, "upTo must be between 2 and " + strconv.Itoa(maxPrimesUpTo)
+		}
+		return func(ctx context.Context) (any, error) { return sievePrimes(ctx, int(upTo)) }, ""
+	},
+}
+
+type cachedResult struct {
+	tier string
+	data json.RawMessage
+}
+
+// computeLookup checks the LRU, then Redis, copying a Redis hit into the
+// LRU so the next one is local
+func computeLookup(ctx context.Context, key string) (cachedResult, bool) {
+	if computeLRU.Enabled() {
+		if data, ok := computeLRU.Get(key); ok {
+			recordComputeLookup("memory", "hit")
+			return cachedResult{"memory", data}, true
+		}
+		recordComputeLookup("memory", "miss")
+	}
+	if visitsRedis == nil || computeRedisTTL <= 0 {
+		return cachedResult{}, false
+	}
+	reply, err := visitsRedis.Do(ctx, "GET", key)
+	if err != nil {
+		recordComputeLookup("redis", "error")
+		slog.Warn("compute cache unavailable", "error", err)
+		return cachedResult{}, false
+	}
+	stored, ok := reply.(string)
+	if !ok {
+		recordComputeLookup("redis", "miss")
+		return cachedResult{}, false
+	}
+	recordComputeLookup("redis", "hit")
+	computeLRU.Add(key, json.RawMessage(stored))
+	return cachedResult{"redis", json.RawMessage(stored)}, true
+}
+
+// computeStore keeps result in both tiers and returns it as JSON
+func computeStore(ctx context.Context, key string, result any) json.RawMessage {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil
+	}
+	computeLRU.Add(key, data)
+	if visitsRedis != nil && computeRedisTTL > 0 {
+		if _, err := visitsRedis.Do(ctx, "SET", key, string(data), "PX", strconv.FormatInt(computeRedisTTL.Milliseconds(), 10)); err != nil {
+			slog.Warn("compute cache store failed", "error", err)
+		}
+	}
+	return data
+}
+
+// fibonacci adds its way up to fib(n); the numbers grow by a bit every
+// step or two, so the cost is quadratic in n
+func fibonacci(ctx context.Context, n int64) (FibResult, error) {
+	a, b := big.NewInt(0), big.NewInt(1)
+	for i := int64(0); i < n; i++ {
+		if i%1024 == 0 && ctx.Err() != nil {
+			return FibResult{}, ctx.Err()
+		}
+		a.Add(a, b)
+		a, b = b, a
+	}
+	value := a.String()
+	return FibResult{Digits: len(value), Value: value}, nil
+}
+
+// sievePrimes is the sieve of Eratosthenes: a byte per number, so upTo
+// is also the memory it takes
+func sievePrimes(ctx context.Context, upTo int) (PrimesResult, error) {
+	composite := make([]bool, upTo+1)
+	for i := 2; i*i <= upTo; i++ {
+		if i%64 == 0 && ctx.Err() != nil {
+			return PrimesResult{}, ctx.Err()
+		}
+		if composite[i] {
+			continue
+		}
+		for j := i * i; j <= upTo; j += i {
+			composite[j] = true
+		}
+	}
+	res := PrimesResult{Last: []int{}}
+	for i := 2; i <= upTo; i++ {
+		if !composite[i] {
+			res.Count++
+			res.Largest = i
+		}
+	}
+	for i := upTo; i >= 2 && len(res.Last) < 10; i-- {
+		if !composite[i] {
+			res.Last = append(res.Last, i)
+		}
+	}
+	return res, nil
+}
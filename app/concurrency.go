@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Per-route concurrency limits, off unless CONCURRENCY_LIMITS names routes:
+//
+//	CONCURRENCY_LIMITS=/api/compute/primes=2:4,/api/load/cpu=1   pattern=limit[:queue]
+//	CONCURRENCY_QUEUE_TIMEOUT=2s                                 longest wait for a slot
+//	hey -c 20 -n 200 'localhost:8080/api/compute/primes?upTo=5000000&cache=none'
+//
+// A route runs at most limit requests at once; up to queue more (limit by
+// default) wait for a slot, and the rest, or those that wait too long, are
+// shed with a 503 and Retry-After. Where the rate limiter caps requests
+// per second, this caps work in progress, which is what runs a pod out of
+// CPU or memory: shedding early keeps latency flat for the requests that
+// are let in, and http_concurrency_queue_depth is a custom metric an HPA
+// can scale on before anything is shed. Patterns are the registered ones,
+// as /api/routes lists them.
+
+// routeLimit is one route's semaphore and bounded wait queue
+type routeLimit struct {
+	pattern string
+	slots   chan struct{}
+	queued  chan struct{} // a place in the queue, so waiting is bounded too
+	timeout time.Duration
+}
+
+// concurrencyLimits is set in main, by route pattern
+var concurrencyLimits map[string]*routeLimit
+
+var (
+	concurrencyInFlight = newGaugeVec("http_concurrency_in_flight",
+		"Requests holding a slot of a route's concurrency limit.", "route")
+	concurrencyQueueDepth = newGaugeVec("http_concurrency_queue_depth",
+		"Requests waiting for a slot of a route's concurrency limit.", "route")
+	concurrencyShed = newCounterVec("http_concurrency_shed_total",
+		"Requests answered 503 by a route's concurrency limit, by reason (queue_full, timeout).", "route", "reason")
+)
+
+// parseConcurrencyLimits reads pattern=limit[:queue],...
+func parseConcurrencyLimits(spec string, timeout time.Duration) (map[string]*routeLimit, error) {
+	limits := map[string]*routeLimit{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, sizes, ok := strings.Cut(item, "=")
+		limitStr, queueStr, hasQueue := strings.Cut(sizes, ":")
+		limit, err := strconv.Atoi(limitStr)
+		if !ok || !strings.HasPrefix(pattern, "/") || err != nil || limit < 1 {
+			return nil, fmt.Errorf("%q: want /route=limit[:queue] with a limit of at least 1", item)
+		}
+		queue := limit
+		if hasQueue {
+			if queue, err = strconv.Atoi(queueStr); err != nil || queue < 0 {
+				return nil, fmt.Errorf("%q: queue must be 0 or more", item)
+			}
+		}
+		limits[pattern] = &routeLimit{pattern: pattern, slots: make(chan struct{}, limit), queued: make(chan struct{}, queue), timeout: timeout}
+		concurrencyInFlight.Set(0, pattern)
+		concurrencyQueueDepth.Set(0, pattern)
+	}
+	return limits, nil
+}
+
+// acquire takes a slot, queueing for one if the route is busy. It returns
+// the reason when the request is shed instead.
+func (l *routeLimit) acquire(ctx context.Context) (release func(), shed string) {
+	release = func() {
+		<-l.slots
+		concurrencyInFlight.Add(-1, l.pattern)
+	}
+	select {
+	case l.slots <- struct{}{}:
+		concurrencyInFlight.Add(1, l.pattern)
+		return release, ""
+	default:
+	}
+	select {
+	case l.queued <- struct{}{}:
+	default:
+		return nil, "queue_full"
+	}
+	concurrencyQueueDepth.Add(1, l.pattern)
+	defer func() {
+		<-l.queued
+		concurrencyQueueDepth.Add(-1, l.pattern)
+	}()
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		concurrencyInFlight.Add(1, l.pattern)
+		return release, ""
+	case <-timer.C:
+		return nil, "timeout"
+	case <-ctx.Done():
+		return nil, "timeout" // the client or the request deadline gave up first
+	}
+}
+
+// limitConcurrency sheds requests beyond the route's limit and queue
+func limitConcurrency(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := concurrencyLimits[pattern]
+		if l == nil {
+			next(w, r)
+			return
+		}
+		release, shed := l.acquire(r.Context())
+		if shed != "" {
+			concurrencyShed.Inc(pattern, shed)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(l.timeout.Seconds())))))
+			writeProblem(w, r, http.StatusServiceUnavailable,
+				fmt.Sprintf("%s is at its concurrency limit of %d (%s)", pattern, cap(l.slots), shed))
+			return
+		}
+		defer release()
+		next(w, r)
+	}
+}
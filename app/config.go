@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/config"
+)
+
+// Runtime configuration that can change without a restart: the YAML file
+// CONFIG_FILE names, usually a ConfigMap mounted as a volume, layered
+// under env vars by app/config, which watches the file with fsnotify and
+// swaps the config atomically when it changes. CONFIG_CONFIGMAP reads the
+// ConfigMap through the API instead (configsource.go). /api/config shows
+// the effective values and where each came from.
+
+// defaultConfigFile is where the ConfigMap is mounted unless CONFIG_FILE says
+const defaultConfigFile = "/etc/config/config.yaml"
+
+var (
+	configReloads = newCounterVec("config_reloads_total",
+		"Config file reloads by result.", "result")
+
+	// appConfigs holds the config; cors.go and selfload.go register keys
+	// of their own
+	appConfigs = config.NewStore(config.Hooks{
+		Source:   settingSource,
+		Reloaded: logConfigReload,
+		Changed:  applyConfig,
+	},
+		config.Key{Name: "message", Env: "APP_MESSAGE", Default: "Hello from Kubernetes!"},
+		config.Key{Name: "log_level", Env: "LOG_LEVEL", Default: "info"},
+	)
+)
+
+// appConfig returns the current config snapshot
+func appConfig() *config.Config {
+	return appConfigs.Current()
+}
+
+func logConfigReload(c *config.Config, err error) {
+	if err != nil {
+		configReloads.Inc("error")
+		slog.Error("config reload failed, keeping previous config", "file", c.File, "error", err)
+		return
+	}
+	configReloads.Inc("success")
+	slog.Info("config reloaded", "file", c.File, "checksum", c.Checksum)
+}
+
+// watchConfigFile reloads path on every change, polling every interval
+// where fsnotify can't watch its directory
+func watchConfigFile(path string, interval time.Duration) {
+	ctx := context.Background()
+	if err := appConfigs.Watch(ctx, path); err != nil {
+		slog.Info("config file not watchable, polling it", "file", path, "interval", interval.String(), "reason", err)
+		config.Poll(ctx, path, interval, func(data []byte) { appConfigs.Reload(path, data) })
+	}
+}
+
+// applyConfig pushes changed settings into the parts of the app that cache them
+func applyConfig(old, updated *config.Config) {
+	if value := updated.Get("log_level"); value != old.Get("log_level") {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			slog.Warn("ignoring invalid log_level from config", "value", value)
+		} else if level != logLevel.Level() {
+			logLevel.Set(level)
+			slog.Warn("log level changed by config", "to", level.String())
+		}
+	}
+}
+
+// configHandler shows the effective config and where each value came from
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := appConfig()
+	writeJSONConditional(w, r, etagOf(cfg), cfg)
+}
@@ -0,0 +1,304 @@
+// Package config is the runtime configuration that changes without a
+// restart. Values come from a YAML file, usually a ConfigMap mounted as a
+// volume, with env vars taking precedence. The file is watched with
+// fsnotify and the config swapped atomically when its content changes, so
+// `kubectl apply` on the ConfigMap shows up within about a minute (the
+// kubelet sync period) and no pod restarts are needed.
+//
+// Two gotchas worth demoing: ConfigMaps mounted with subPath never update,
+// and env vars read from a ConfigMap (envFrom) only change on restart.
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// Key is a setting the app knows about and uses itself
+type Key struct {
+	Name    string // key in the YAML file
+	Env     string // env var that overrides the file
+	Default string
+}
+
+// Config is one immutable snapshot of the effective configuration
+type Config struct {
+	Values   map[string]string `json:"values"`
+	Sources  map[string]string `json:"sources"` // default, file, configmap, env or flag
+	File     string            `json:"file"`
+	Checksum string            `json:"checksum,omitempty"` // of the file content
+	LoadedAt time.Time         `json:"loaded_at"`
+	Error    string            `json:"error,omitempty"` // last reload failure, old values kept
+}
+
+// Get returns a config value, or "" when unset
+func (c *Config) Get(key string) string {
+	return c.Values[key]
+}
+
+// Hooks connect a Store to the rest of the app; any of them may be nil
+type Hooks struct {
+	// Source names the layer an env override came from; "env" when nil
+	Source func(env string) string
+	// Reloaded is told about every reload: the config now current, and
+	// err when the file was rejected and c is the previous one
+	Reloaded func(c *Config, err error)
+	// Changed runs after a reload installs a new config
+	Changed func(old, updated *Config)
+}
+
+// Store holds the current Config of a set of keys
+type Store struct {
+	hooks   Hooks
+	mu      sync.Mutex // guards keys
+	keys    []Key
+	current atomic.Pointer[Config]
+}
+
+// NewStore returns a store of keys with nothing loaded yet
+func NewStore(hooks Hooks, keys ...Key) *Store {
+	return &Store{hooks: hooks, keys: keys}
+}
+
+// Register adds keys, for parts of the app that bring their own settings
+func (s *Store) Register(keys ...Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, keys...)
+}
+
+// Keys lists the registered keys
+func (s *Store) Keys() []Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Key(nil), s.keys...)
+}
+
+// Current returns the current snapshot, defaults and env when nothing
+// was loaded
+func (s *Store) Current() *Config {
+	if c := s.current.Load(); c != nil {
+		return c
+	}
+	return s.Build("", nil, "")
+}
+
+// Load reads path (missing is fine) and installs the resulting config
+func (s *Store) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		s.current.Store(s.Build(path, nil, ""))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	values, err := Parse(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	s.current.Store(s.Build(path, values, Checksum(data)))
+	return nil
+}
+
+// Build layers defaults, file values and env overrides. A path starting
+// with configmap: was read through the API rather than a volume.
+func (s *Store) Build(path string, file map[string]string, sum string) *Config {
+	c := &Config{
+		Values:   map[string]string{},
+		Sources:  map[string]string{},
+		File:     path,
+		Checksum: sum,
+		LoadedAt: time.Now(),
+	}
+	keys := s.Keys()
+	for _, k := range keys {
+		c.Values[k.Name], c.Sources[k.Name] = k.Default, "default"
+	}
+	layer := "file"
+	if strings.HasPrefix(path, "configmap:") {
+		layer = "configmap"
+	}
+	for k, v := range file {
+		c.Values[k], c.Sources[k] = v, layer
+	}
+	for _, k := range keys {
+		if v := os.Getenv(k.Env); v != "" {
+			c.Values[k.Name], c.Sources[k.Name] = v, "env"
+			if s.hooks.Source != nil {
+				c.Sources[k.Name] = s.hooks.Source(k.Env)
+			}
+		}
+	}
+	return c
+}
+
+// Reload installs data read from path when its content changed,
+// reporting whether it did. A broken file is reported to Hooks.Reloaded
+// and the previous config stays active.
+func (s *Store) Reload(path string, data []byte) bool {
+	old := s.Current()
+	sum := Checksum(data)
+	if sum == old.Checksum {
+		return false
+	}
+
+	values, err := Parse(data)
+	if err != nil {
+		failed := *old
+		failed.Checksum = sum // don't retry until the file changes again
+		failed.Error = err.Error()
+		s.current.Store(&failed)
+		if s.hooks.Reloaded != nil {
+			s.hooks.Reloaded(&failed, err)
+		}
+		return false
+	}
+	updated := s.Build(path, values, sum)
+	s.current.Store(updated)
+	if s.hooks.Reloaded != nil {
+		s.hooks.Reloaded(updated, nil)
+	}
+	if s.hooks.Changed != nil {
+		s.hooks.Changed(old, updated)
+	}
+	return true
+}
+
+// Watch reloads path whenever it changes, until ctx is done; see the
+// package function
+func (s *Store) Watch(ctx context.Context, path string) error {
+	return Watch(ctx, path, func(data []byte) { s.Reload(path, data) })
+}
+
+// settle is how long Watch waits for a burst of events to end: an editor
+// or `echo >` truncates the file before writing it, and the empty file in
+// between is not a config to install
+const settle = 100 * time.Millisecond
+
+// Watch calls reload with path's content, nil once it's gone, after every
+// change fsnotify reports in its directory, until ctx is done. The kubelet
+// updates a ConfigMap volume by swapping its ..data symlink and never
+// writes the file itself, so the directory is what's watched; reload sees
+// every change there and should skip content it already has (Checksum).
+// The error is for a watch that can't start, like a directory that
+// doesn't exist; Poll is the fallback.
+func Watch(ctx context.Context, path string, reload func(data []byte)) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+	quiet := time.NewTimer(settle)
+	defer quiet.Stop()
+	quiet.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			quiet.Reset(settle)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				quiet.Reset(settle) // some events were lost
+			}
+		case <-quiet.C:
+			read(path, reload)
+		}
+	}
+}
+
+// Poll calls reload with path's content every interval until ctx is done
+func Poll(ctx context.Context, path string, interval time.Duration, reload func(data []byte)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			read(path, reload)
+		}
+	}
+}
+
+// read passes path's content to reload, nil when it doesn't exist, and
+// skips errors that aren't worth a reload, like permissions mid-swap
+func read(path string, reload func(data []byte)) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	reload(data)
+}
+
+// Checksum identifies file content, "" for no file
+func Checksum(data []byte) string {
+	if data == nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Parse reads a YAML mapping of scalars, flattening nested maps to dotted
+// keys (server: {port: 80} becomes server.port). Scalars keep their text
+// as written, so 1.10 stays 1.10; null values are left out. Lists are
+// rejected rather than flattened into something no setting reads.
+func Parse(data []byte) (map[string]string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	if len(doc.Content) == 0 {
+		return values, nil // empty, or only comments
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected key: value pairs", root.Line)
+	}
+	return values, flatten(root, "", values)
+}
+
+func flatten(m *yaml.Node, prefix string, values map[string]string) error {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		key, value := prefix+m.Content[i].Value, m.Content[i+1]
+		for value.Kind == yaml.AliasNode {
+			value = value.Alias
+		}
+		switch {
+		case value.Kind == yaml.MappingNode:
+			if err := flatten(value, key+".", values); err != nil {
+				return err
+			}
+		case value.Kind == yaml.SequenceNode:
+			return fmt.Errorf("line %d: %s: lists are not supported", value.Line, key)
+		case value.Tag == "!!null":
+		default:
+			values[key] = value.Value
+		}
+	}
+	return nil
+}
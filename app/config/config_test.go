@@ -0,0 +1,165 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	values, err := Parse([]byte(`
+# comments and blank lines are fine
+message: "Hello: world"   # quoted, colon kept
+log_level: debug
+version: 1.10
+server:
+  port: 9000
+  tls:
+    enabled: true
+banner: |
+  two
+  lines
+base: &base hello
+copy: *base
+unset:
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"message":            "Hello: world",
+		"log_level":          "debug",
+		"version":            "1.10",
+		"server.port":        "9000",
+		"server.tls.enabled": "true",
+		"banner":             "two\nlines\n",
+		"base":               "hello",
+		"copy":               "hello",
+	}
+	if len(values) != len(want) {
+		t.Errorf("got %d values %v, want %d", len(values), values, len(want))
+	}
+	for k, v := range want {
+		if values[k] != v {
+			t.Errorf("%s = %q, want %q", k, values[k], v)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := map[string]string{
+		"a list":          "hosts:\n  - a\n  - b\n",
+		"not a mapping":   "just a string\n",
+		"broken indent":   "a: 1\n  b: 2\n",
+		"unclosed quote":  "a: \"open\n",
+		"tab indentation": "a:\n\tb: 1\n",
+	}
+	for name, content := range tests {
+		if values, err := Parse([]byte(content)); err == nil {
+			t.Errorf("%s: parsed as %v, want an error", name, values)
+		}
+	}
+	if values, err := Parse(nil); err != nil || len(values) != 0 {
+		t.Errorf("empty file: %v, %v; want no values", values, err)
+	}
+}
+
+func TestStoreLayersAndReload(t *testing.T) {
+	t.Setenv("TEST_LEVEL", "warn")
+	var changes, failures int
+	s := NewStore(Hooks{
+		Reloaded: func(c *Config, err error) {
+			if err != nil {
+				failures++
+			}
+		},
+		Changed: func(old, updated *Config) { changes++ },
+	}, Key{Name: "message", Env: "TEST_MESSAGE", Default: "hi"}, Key{Name: "log_level", Env: "TEST_LEVEL", Default: "info"})
+
+	if !s.Reload("config.yaml", []byte("message: from file\nlog_level: debug\n")) {
+		t.Fatal("first reload not installed")
+	}
+	c := s.Current()
+	if c.Get("message") != "from file" || c.Sources["message"] != "file" {
+		t.Errorf("message = %q from %s, want the file's", c.Get("message"), c.Sources["message"])
+	}
+	if c.Get("log_level") != "warn" || c.Sources["log_level"] != "env" {
+		t.Errorf("log_level = %q from %s, want the env override", c.Get("log_level"), c.Sources["log_level"])
+	}
+
+	if s.Reload("config.yaml", []byte("message: from file\nlog_level: debug\n")) {
+		t.Error("the same content was installed twice")
+	}
+	if s.Reload("config.yaml", []byte("message: [broken")) {
+		t.Error("a broken file was installed")
+	}
+	if c := s.Current(); c.Get("message") != "from file" || c.Error == "" {
+		t.Errorf("after a broken file: message %q, error %q; want the old value and the error", c.Get("message"), c.Error)
+	}
+	if s.Reload("config.yaml", nil); s.Current().Get("message") != "hi" {
+		t.Errorf("after the file went away: message %q, want the default", s.Current().Get("message"))
+	}
+	if changes != 2 || failures != 1 {
+		t.Errorf("%d changes and %d failures, want 2 and 1", changes, failures)
+	}
+}
+
+// TestWatchFollowsASymlinkSwap updates the file the way the kubelet
+// updates a ConfigMap volume: a new ..data directory, swapped in by a
+// rename over the ..data symlink
+func TestWatchFollowsASymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+	writeVersion := func(name, content string) {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "config.yaml"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		tmp := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(name, tmp); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion("..v1", "message: one\n")
+	if err := os.Symlink("..data/config.yaml", filepath.Join(dir, "config.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "config.yaml")
+	s := NewStore(Hooks{}, Key{Name: "message", Env: "TEST_MESSAGE", Default: "hi"})
+	if err := s.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watching := make(chan error, 1)
+	go func() { watching <- s.Watch(ctx, path) }()
+	time.Sleep(100 * time.Millisecond) // for the watch to start
+
+	writeVersion("..v2", "message: two\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Current().Get("message") != "two" {
+		if time.Now().After(deadline) {
+			t.Fatalf("message = %q after the swap, want two", s.Current().Get("message"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-watching; err != nil {
+		t.Errorf("Watch() = %v", err)
+	}
+}
+
+func TestWatchNeedsTheDirectory(t *testing.T) {
+	err := Watch(context.Background(), "/does/not/exist/config.yaml", func([]byte) {})
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("Watch() = %v, want an error for the missing directory", err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// Config skew across replicas. A ConfigMap edit doesn't reach every pod
+// at once: each kubelet notices on its own sync (up to a minute apart),
+// env changes only land as the rollout replaces pods, and a pod can keep
+// old data for good if its reload fails. Each pod says which versions it
+// runs at /api/config/version; the cluster view fetches that from every
+// peer on each gossip round, and /api/cluster/config-skew compares them:
+//
+//	kubectl edit configmap app-config -n go-demo
+//	watch -n1 "curl -s localhost:8080/api/cluster/config-skew | jq '.artifacts[] | {name, in_sync, stale}'"
+//
+// Three things are compared: the config file (config), the flags file
+// (flags) and the effective values with env overrides applied
+// (effective), which differ mid-rollout while the file doesn't. The
+// newest version of each is the one that appeared last, going by when
+// its first pod loaded it, and a pod on any other is stale;
+// behind_seconds says how long the newest has been around. A peer too old
+// to answer /api/config/version is listed as unknown. Needs the cluster
+// view (PEER_SERVICE, see cluster.go), and is as old as its last round.
+
+// ConfigVersion is returned by /api/config/version
+type ConfigVersion struct {
+	Pod             string    `json:"pod"`
+	ConfigChecksum  string    `json:"config_checksum"` // of the file, "" with none
+	ConfigLoadedAt  time.Time `json:"config_loaded_at"`
+	ValuesDigest    string    `json:"values_digest"` // of the effective values, env included
+	FlagsChecksum   string    `json:"flags_checksum"`
+	FlagsLoadedAt   time.Time `json:"flags_loaded_at"`
+	ResourceVersion string    `json:"resource_version,omitempty"` // with CONFIG_CONFIGMAP
+}
+
+var configSkewStale = newGaugeVec("config_skew_stale_pods",
+	"Replicas in the cluster view not on the newest version, by artifact (config, flags, effective).", "artifact")
+
+// currentConfigVersion describes what this pod runs
+func currentConfigVersion() ConfigVersion {
+	hostname, _ := os.Hostname()
+	c, f := appConfig(), featureFlags()
+	configSource.mu.Lock()
+	rv := configSource.ResourceVersion
+	configSource.mu.Unlock()
+	return ConfigVersion{Pod: hostname, ConfigChecksum: c.Checksum, ConfigLoadedAt: c.LoadedAt,
+		ValuesDigest: valuesDigest(c.Values), FlagsChecksum: f.Checksum, FlagsLoadedAt: f.LoadedAt, ResourceVersion: rv}
+}
+
+// valuesDigest hashes the values in key order
+func valuesDigest(values map[string]string) string {
+	h := sha256.New()
+	for _, k := range sortedKeys(values) {
+		h.Write([]byte(k + "=" + values[k] + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func configVersionHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, currentConfigVersion())
+}
+
+// ConfigSkewVersion is one version of an artifact and who runs it
+type ConfigSkewVersion struct {
+	Version     string    `json:"version"` // "" when there is no file
+	Newest      bool      `json:"newest"`
+	FirstLoaded time.Time `json:"first_loaded"` // by any of its pods
+	Pods        []string  `json:"pods"`
+}
+
+// ConfigSkewPod is a pod not on the newest version
+type ConfigSkewPod struct {
+	Name          string  `json:"name"`
+	Version       string  `json:"version"`
+	BehindSeconds float64 `json:"behind_seconds"` // since the newest first appeared
+}
+
+// ConfigSkewArtifact compares one of config, flags and effective
+type ConfigSkewArtifact struct {
+	Name     string              `json:"name"`
+	InSync   bool                `json:"in_sync"`
+	Newest   string              `json:"newest"`
+	Versions []ConfigSkewVersion `json:"versions"`
+	Stale    []ConfigSkewPod     `json:"stale"`
+}
+
+// ConfigSkewResponse is returned by /api/cluster/config-skew
+type ConfigSkewResponse struct {
+	ServedBy  string               `json:"served_by"`
+	LastRound time.Time            `json:"last_round"` // of the cluster view
+	InSync    bool                 `json:"in_sync"`
+	Members   int                  `json:"members"` // compared: alive, answering /api/config/version
+	Unknown   []string             `json:"unknown"` // alive, but no /api/config/version
+	Artifacts []ConfigSkewArtifact `json:"artifacts"`
+}
+
+// configSkew compares the alive members of view
+func configSkew(view ClusterResponse) ConfigSkewResponse {
+	resp := ConfigSkewResponse{ServedBy: view.ServedBy, LastRound: view.LastRound, InSync: true, Unknown: []string{}}
+	var versions []ConfigVersion
+	for _, m := range view.Members {
+		switch {
+		case m.State != "alive":
+		case m.Config == nil:
+			resp.Unknown = append(resp.Unknown, m.Name)
+		default:
+			versions = append(versions, *m.Config)
+		}
+	}
+	resp.Members = len(versions)
+	now := time.Now()
+	for _, a := range []struct {
+		name string
+		of   func(ConfigVersion) (string, time.Time)
+	}{
+		{"config", func(v ConfigVersion) (string, time.Time) { return v.ConfigChecksum, v.ConfigLoadedAt }},
+		{"flags", func(v ConfigVersion) (string, time.Time) { return v.FlagsChecksum, v.FlagsLoadedAt }},
+		{"effective", func(v ConfigVersion) (string, time.Time) { return v.ValuesDigest, v.ConfigLoadedAt }},
+	} {
+		artifact := compareVersions(a.name, versions, a.of, now)
+		if !artifact.InSync {
+			resp.InSync = false
+		}
+		resp.Artifacts = append(resp.Artifacts, artifact)
+	}
+	return resp
+}
+
+// compareVersions groups pods by one artifact's version; the newest is
+// the one whose first pod loaded it last
+func compareVersions(name string, pods []ConfigVersion, of func(ConfigVersion) (string, time.Time), now time.Time) ConfigSkewArtifact {
+	artifact := ConfigSkewArtifact{Name: name, InSync: true, Versions: []ConfigSkewVersion{}, Stale: []ConfigSkewPod{}}
+	byVersion := map[string]*ConfigSkewVersion{}
+	for _, p := range pods {
+		version, loaded := of(p)
+		v, ok := byVersion[version]
+		if !ok {
+			v = &ConfigSkewVersion{Version: version, FirstLoaded: loaded}
+			byVersion[version] = v
+		}
+		if loaded.Before(v.FirstLoaded) {
+			v.FirstLoaded = loaded
+		}
+		v.Pods = append(v.Pods, p.Pod)
+	}
+	var newest *ConfigSkewVersion
+	for _, v := range byVersion {
+		if newest == nil || v.FirstLoaded.After(newest.FirstLoaded) {
+			newest = v
+		}
+	}
+	if newest == nil {
+		return artifact
+	}
+	newest.Newest, artifact.Newest = true, newest.Version
+	for _, v := range byVersion {
+		sort.Strings(v.Pods)
+		artifact.Versions = append(artifact.Versions, *v)
+		if v == newest {
+			continue
+		}
+		artifact.InSync = false
+		for _, pod := range v.Pods {
+			artifact.Stale = append(artifact.Stale, ConfigSkewPod{Name: pod, Version: v.Version,
+				BehindSeconds: now.Sub(newest.FirstLoaded).Seconds()})
+		}
+	}
+	sort.Slice(artifact.Versions, func(i, j int) bool {
+		return artifact.Versions[i].FirstLoaded.After(artifact.Versions[j].FirstLoaded)
+	})
+	sort.Slice(artifact.Stale, func(i, j int) bool { return artifact.Stale[i].Name < artifact.Stale[j].Name })
+	return artifact
+}
+
+// recordConfigSkew updates config_skew_stale_pods after a gossip round
+func recordConfigSkew(view ClusterResponse) {
+	for _, a := range configSkew(view).Artifacts {
+		configSkewStale.Set(float64(len(a.Stale)), a.Name)
+	}
+}
+
+func configSkewHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	if cluster == nil {
+		writeProblem(w, r, http.StatusNotFound, "config skew needs the cluster view; set PEER_SERVICE to a headless Service")
+		return
+	}
+	writeJSON(w, http.StatusOK, configSkew(cluster.view()))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A mounted ConfigMap reaches the pod through the kubelet: it notices the
+// change on its next sync (up to a minute), swaps the volume's ..data
+// symlink, and the app's fsnotify watch picks it up at once. With
+// CONFIG_CONFIGMAP set the app skips the volume and watches the ConfigMap
+// through the API server instead, the way informers and controllers do,
+// so an edit applies within a second:
+//
+//	kubectl edit configmap app-config -n go-demo
+//	curl localhost:8080/api/config/source   # resource_version and observed_at move at once
+//
+// The watch starts from a GET (the resourceVersion to watch from), then
+// streams ADDED/MODIFIED/DELETED events. The server ends watches every few
+// minutes and forgets old versions, answering 410 Gone; both are normal,
+// and the answer is to watch again or list again. It needs get, list and
+// watch on the ConfigMap (k8s/advanced/rbac.yaml). CONFIG_CONFIGMAP_KEY
+// picks the key holding the YAML, config.yaml by default. Env overrides
+// still win over both sources.
+
+// ConfigSource is returned by /api/config/source
+type ConfigSource struct {
+	Mode            string     `json:"mode"` // file (volume mount, watched) or api-watch
+	File            string     `json:"file,omitempty"`
+	PollInterval    string     `json:"poll_interval,omitempty"` // when the directory can't be watched
+	ConfigMap       string     `json:"configmap,omitempty"`     // namespace/name
+	Key             string     `json:"key,omitempty"`
+	ResourceVersion string     `json:"resource_version,omitempty"` // last observed
+	LastEvent       string     `json:"last_event,omitempty"`       // ADDED, MODIFIED, DELETED, BOOKMARK
+	ObservedAt      *time.Time `json:"observed_at,omitempty"`
+	Updates         int        `json:"updates"`
+	WatchRestarts   int        `json:"watch_restarts,omitempty"`
+	Relists         int        `json:"relists,omitempty"` // after 410 Gone
+	Checksum        string     `json:"checksum,omitempty"`
+	LoadedAt        time.Time  `json:"loaded_at"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// kubeConfigMap is the subset of a v1 ConfigMap the app reads
+type kubeConfigMap struct {
+	Metadata kubeObjectMeta    `json:"metadata"`
+	Data     map[string]string `json:"data"`
+}
+
+var configSource = struct {
+	mu sync.Mutex
+	ConfigSource
+}{ConfigSource: ConfigSource{Mode: "file"}}
+
+// errWatchExpired means the watch's resourceVersion is too old to resume
+var errWatchExpired = errors.New("watch expired (410 Gone)")
+
+// configMapWatcher keeps the app config in sync with one ConfigMap key
+type configMapWatcher struct {
+	kube *kubeClient
+	name string
+	key  string
+}
+
+// origin is what /api/config shows as the config's file
+func (cw *configMapWatcher) origin() string {
+	return "configmap:" + cw.kube.namespace + "/" + cw.name + "/" + cw.key
+}
+
+// observe records a ConfigMap version and applies its key
+func (cw *configMapWatcher) observe(event string, cm kubeConfigMap) {
+	now := time.Now()
+	configSource.mu.Lock()
+	configSource.ResourceVersion, configSource.LastEvent, configSource.ObservedAt = cm.Metadata.ResourceVersion, event, &now
+	configSource.Error = ""
+	configSource.mu.Unlock()
+	if event == "BOOKMARK" {
+		return
+	}
+	data, ok := cm.Data[cw.key]
+	if !ok || event == "DELETED" {
+		cw.fail("ConfigMap " + event + " or has no key " + cw.key + ", keeping the last config")
+		return
+	}
+	if appConfigs.Reload(cw.origin(), []byte(data)) {
+		configSource.mu.Lock()
+		configSource.Updates++
+		configSource.mu.Unlock()
+		slog.Info("config updated from the API", "configmap", cw.name, "resource_version", cm.Metadata.ResourceVersion, "event", event)
+	}
+}
+
+func (cw *configMapWatcher) fail(msg string) {
+	configSource.mu.Lock()
+	configSource.Error = msg
+	configSource.mu.Unlock()
+}
+
+// get reads the ConfigMap and returns the resourceVersion to watch from
+func (cw *configMapWatcher) get(ctx context.Context) (string, error) {
+	var cm kubeConfigMap
+	if err := cw.kube.Do(ctx, http.MethodGet, "/api/v1/namespaces/"+cw.kube.namespace+"/configmaps/"+cw.name, nil, &cm); err != nil {
+		return "", err
+	}
+	cw.observe("ADDED", cm)
+	return cm.Metadata.ResourceVersion, nil
+}
+
+// watch streams changes after resourceVersion until the server ends the
+// watch, returning the last version seen
+func (cw *configMapWatcher) watch(ctx context.Context, resourceVersion string) (string, error) {
+	q := url.Values{
+		"watch":               {"true"},
+		"fieldSelector":       {"metadata.name=" + cw.name},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {"300"},
+	}
+	path := "/api/v1/namespaces/" + cw.kube.namespace + "/configmaps?" + q.Encode()
+	err := cw.kube.Watch(ctx, path, func(e kubeWatchEvent) error {
+		if e.Type == "ERROR" {
+			var status kubeAPIError
+			json.Unmarshal(e.Object, &status)
+			if status.Code == http.StatusGone {
+				return errWatchExpired
+			}
+			return &status
+		}
+		var cm kubeConfigMap
+		if err := json.Unmarshal(e.Object, &cm); err != nil {
+			return err
+		}
+		cw.observe(e.Type, cm)
+		resourceVersion = cm.Metadata.ResourceVersion
+		return nil
+	})
+	return resourceVersion, err
+}
+
+// Run gets and watches until ctx is done, backing off on errors
+func (cw *configMapWatcher) Run(ctx context.Context) {
+	backoff := time.Second
+	resourceVersion := ""
+	for ctx.Err() == nil {
+		var err error
+		if resourceVersion == "" {
+			resourceVersion, err = cw.get(ctx)
+		} else {
+			resourceVersion, err = cw.watch(ctx, resourceVersion)
+			configSource.mu.Lock()
+			configSource.WatchRestarts++
+			if errors.Is(err, errWatchExpired) {
+				configSource.Relists++
+			}
+			configSource.mu.Unlock()
+			if errors.Is(err, errWatchExpired) {
+				slog.Info("configmap watch expired, listing again", "configmap", cw.name)
+				resourceVersion, err = "", nil
+			}
+		}
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		cw.fail(err.Error())
+		if isKubeStatus(err, http.StatusForbidden) {
+			slog.Warn("no RBAC permission to watch the ConfigMap (see k8s/advanced/rbac.yaml)", "configmap", cw.name, "error", err)
+		} else {
+			slog.Warn("configmap watch failed, retrying", "configmap", cw.name, "error", err, "backoff", backoff.String())
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// watchConfigMap switches the config source to the named ConfigMap and
+// watches it until ctx is done
+func watchConfigMap(ctx context.Context, kube *kubeClient, name, key string) {
+	cw := &configMapWatcher{kube: kube, name: name, key: key}
+	configSource.mu.Lock()
+	configSource.ConfigSource = ConfigSource{Mode: "api-watch", ConfigMap: kube.namespace + "/" + name, Key: key}
+	configSource.mu.Unlock()
+	cw.Run(ctx)
+}
+
+// configSourceHandler serves GET /api/config/source. pollInterval is the
+// file mode's CONFIG_RELOAD_INTERVAL, for when fsnotify can't watch it.
+func configSourceHandler(pollInterval time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+		configSource.mu.Lock()
+		resp := configSource.ConfigSource
+		configSource.mu.Unlock()
+		c := appConfig()
+		resp.Checksum, resp.LoadedAt = c.Checksum, c.LoadedAt
+		if resp.Mode == "file" {
+			resp.File, resp.PollInterval = c.File, pollInterval.String()
+			resp.Error = c.Error
+		} else if resp.Error == "" {
+			resp.Error = c.Error
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// /api/connect is netcat for pods without one: a TCP dial, optionally
+// followed by a TLS handshake, from this pod to anywhere:
+//
+//	curl 'localhost:8080/api/connect?host=go-app-service&port=80'
+//	curl 'localhost:8080/api/connect?host=postgres.other-ns&port=5432&timeout=1s'
+//	curl 'localhost:8080/api/connect?host=kubernetes.default&port=443&tls=true&insecure=true'
+//
+// How a dial fails says where to look. "refused" means the packet arrived
+// and nothing listens on the port (wrong targetPort, pod not ready). A
+// "timeout" means the packet vanished, which is what a NetworkPolicy drop
+// looks like. "dns" means the name never resolved.
+
+// ConnectResponse is returned by /api/connect
+type ConnectResponse struct {
+	Host        string      `json:"host"`
+	Port        int         `json:"port"`
+	Success     bool        `json:"success"`
+	ResolvedIPs []string    `json:"resolved_ips"`
+	DNSMS       float64     `json:"dns_ms"`
+	Remote      string      `json:"remote_addr,omitempty"` // the IP the dial reached
+	Local       string      `json:"local_addr,omitempty"`
+	ConnectMS   float64     `json:"connect_ms"`
+	TLS         *ConnectTLS `json:"tls,omitempty"`
+	Failure     string      `json:"failure,omitempty"` // dns, refused, timeout, unreachable, tls or error
+	Error       string      `json:"error,omitempty"`
+	Pod         string      `json:"pod"`
+}
+
+// ConnectTLS describes the handshake after the TCP dial
+type ConnectTLS struct {
+	HandshakeMS float64       `json:"handshake_ms"`
+	Version     string        `json:"version,omitempty"`
+	CipherSuite string        `json:"cipher_suite,omitempty"`
+	ServerName  string        `json:"server_name"`
+	ALPN        string        `json:"alpn,omitempty"`
+	Verified    bool          `json:"verified"`
+	PeerCerts   []*ClientCert `json:"peer_certificates,omitempty"`
+}
+
+// dialFailure names the usual reasons a dial fails
+func dialFailure(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	}
+	return "error"
+}
+
+// connectHandler serves /api/connect?host=&port=&timeout=&tls=
+func connectHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	q := r.URL.Query()
+	host := strings.TrimSpace(q.Get("host"))
+	if host == "" || len(host) > 253 || strings.ContainsAny(host, " /") {
+		writeProblem(w, r, http.StatusBadRequest, "host must be a name or IP, like go-app-service or 10.96.0.1")
+		return
+	}
+	host = strings.Trim(host, "[]") // accept [::1] as well as ::1
+	port, ok := queryInt(w, r, "port", 1, 65535)
+	if !ok {
+		return
+	}
+	timeout := 2 * time.Second
+	if v := q.Get("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 || timeout > 30*time.Second {
+			writeProblem(w, r, http.StatusBadRequest, "timeout must be a Go duration up to 30s")
+			return
+		}
+	}
+	useTLS := q.Get("tls") == "true" || q.Get("insecure") == "true" || q.Get("servername") != ""
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	hostname, _ := os.Hostname()
+	resp := ConnectResponse{Host: host, Port: int(port), ResolvedIPs: []string{}, Pod: hostname}
+	fail := func(kind string, err error) {
+		resp.Failure, resp.Error = kind, err.Error()
+		writeJSON(w, http.StatusOK, resp)
+	}
+
+	// Resolve separately, so DNS time and the addresses tried are visible
+	start := time.Now()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	resp.DNSMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		fail(dialFailure(err), err)
+		return
+	}
+	for _, ip := range ips {
+		resp.ResolvedIPs = append(resp.ResolvedIPs, ip.String())
+	}
+
+	var dialer net.Dialer
+	start = time.Now()
+	var conn net.Conn
+	for _, ip := range ips {
+		if conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))); err == nil {
+			break
+		}
+	}
+	resp.ConnectMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		fail(dialFailure(err), err)
+		return
+	}
+	defer conn.Close()
+	resp.Remote, resp.Local = conn.RemoteAddr().String(), conn.LocalAddr().String()
+
+	if useTLS {
+		insecure := q.Get("insecure") == "true"
+		serverName := q.Get("servername")
+		if serverName == "" {
+			serverName = host
+		}
+		resp.TLS = &ConnectTLS{ServerName: serverName, Verified: !insecure}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure, NextProtos: []string{"h2", "http/1.1"}})
+		start = time.Now()
+		err := tlsConn.HandshakeContext(ctx)
+		resp.TLS.HandshakeMS = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			resp.TLS.Verified = false
+			fail("tls", err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		resp.TLS.Version = tls.VersionName(state.Version)
+		resp.TLS.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+		resp.TLS.ALPN = state.NegotiatedProtocol
+		for _, cert := range state.PeerCertificates {
+			resp.TLS.PeerCerts = append(resp.TLS.PeerCerts, describeCert(cert))
+		}
+	}
+	resp.Success = true
+	writeJSON(w, http.StatusOK, resp)
+}
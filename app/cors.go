@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/config"
+)
+
+// CORS lets a frontend served from another origin (its own Deployment and
+// Ingress host) call this API from the browser. It is off until origins
+// are allowed, and, like every config key, reloads from the ConfigMap:
+//
+//	cors:
+//	  allowed_origins: https://frontend.example.com,https://*.preview.example.com
+//	  allowed_methods: GET,POST,DELETE
+//	  allowed_headers: Content-Type,Authorization
+//	  exposed_headers: X-Request-ID,X-Served-By
+//	  allow_credentials: true
+//	  max_age: 10m
+//
+// or the CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS, ... env vars. "*"
+// allows any origin, but never with credentials: the origin is echoed back
+// instead, which is what browsers require for cookies.
+//
+//	curl -i -X OPTIONS localhost:8080/api/info -H 'Origin: https://frontend.example.com' \
+//	  -H 'Access-Control-Request-Method: POST'
+//
+// A preflight from an origin, method or header the policy doesn't allow
+// gets a 403 saying which, instead of the bare missing header a browser
+// reports as a CORS error. Browsers cache a successful preflight for
+// max_age; Chrome caps it at 2h.
+
+var corsConfigKeys = []config.Key{
+	{Name: "cors.allowed_origins", Env: "CORS_ALLOWED_ORIGINS", Default: ""},
+	{Name: "cors.allowed_methods", Env: "CORS_ALLOWED_METHODS", Default: "GET,POST,PUT,PATCH,DELETE"},
+	{Name: "cors.allowed_headers", Env: "CORS_ALLOWED_HEADERS", Default: "Content-Type,Authorization,X-Request-ID"},
+	{Name: "cors.exposed_headers", Env: "CORS_EXPOSED_HEADERS", Default: "X-Request-ID,X-Served-By"},
+	{Name: "cors.allow_credentials", Env: "CORS_ALLOW_CREDENTIALS", Default: "false"},
+	{Name: "cors.max_age", Env: "CORS_MAX_AGE", Default: "10m"},
+}
+
+func init() {
+	appConfigs.Register(corsConfigKeys...)
+}
+
+var corsRequests = newCounterVec("http_cors_requests_total",
+	"Cross-origin requests by kind (preflight, simple) and result.", "kind", "result")
+
+// corsPolicy is parsed from one config snapshot
+type corsPolicy struct {
+	config         *config.Config // the snapshot it was parsed from
+	origins        []string
+	methods        []string
+	headers        []string // lower case; "*" allows any
+	exposed        string
+	credentials    bool
+	maxAgeSeconds  string
+	allowAnyOrigin bool
+}
+
+var currentCORS atomic.Pointer[corsPolicy]
+
+// corsPolicyFor returns the policy for the current config, parsing it
+// again only after a reload
+func corsPolicyFor(c *config.Config) *corsPolicy {
+	if p := currentCORS.Load(); p != nil && p.config == c {
+		return p
+	}
+	p := &corsPolicy{
+		config:      c,
+		origins:     splitList(c.Get("cors.allowed_origins")),
+		methods:     splitList(strings.ToUpper(c.Get("cors.allowed_methods"))),
+		headers:     splitList(strings.ToLower(c.Get("cors.allowed_headers"))),
+		exposed:     strings.Join(splitList(c.Get("cors.exposed_headers")), ", "),
+		credentials: c.Get("cors.allow_credentials") == "true",
+	}
+	for _, o := range p.origins {
+		p.allowAnyOrigin = p.allowAnyOrigin || o == "*"
+	}
+	if d, err := time.ParseDuration(c.Get("cors.max_age")); err == nil && d > 0 {
+		p.maxAgeSeconds = strconv.Itoa(int(d.Seconds()))
+	}
+	currentCORS.Store(p)
+	return p
+}
+
+// allowsOrigin matches exact origins, "*", and one-level wildcards like
+// https://*.example.com
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	for _, o := range p.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(o, "*."); ok && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, "."+suffix) {
+			sub := strings.TrimSuffix(strings.TrimPrefix(origin, prefix), "."+suffix)
+			if sub != "" && !strings.ContainsAny(sub, "./:") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *corsPolicy) allowsMethod(method string) bool {
+	for _, m := range p.methods {
+		if m == method || m == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// disallowedHeader returns the first requested header not allowed, or ""
+func (p *corsPolicy) disallowedHeader(requested string) string {
+	for _, h := range splitList(strings.ToLower(requested)) {
+		allowed := false
+		for _, a := range p.headers {
+			allowed = allowed || a == h || a == "*"
+		}
+		if !allowed {
+			return h
+		}
+	}
+	return ""
+}
+
+// allowOrigin sets the headers every allowed cross-origin response carries
+func (p *corsPolicy) allowOrigin(h http.Header, origin string) {
+	if p.allowAnyOrigin && !p.credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// cors answers preflights and adds the CORS headers to allowed
+// cross-origin requests; same-origin requests pass straight through
+func cors(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		p := corsPolicyFor(appConfig())
+		if origin == "" || len(p.origins) == 0 {
+			next(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight {
+			if p.allowsOrigin(origin) {
+				corsRequests.Inc("simple", "allowed")
+				p.allowOrigin(h, origin)
+				if p.exposed != "" {
+					h.Set("Access-Control-Expose-Headers", p.exposed)
+				}
+			} else {
+				corsRequests.Inc("simple", "rejected") // served, but the browser hides the response
+			}
+			next(w, r)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		method := r.Header.Get("Access-Control-Request-Method")
+		reason := ""
+		switch {
+		case !p.allowsOrigin(origin):
+			reason = "origin " + origin + " is not in cors.allowed_origins"
+		case !p.allowsMethod(method):
+			reason = "method " + method + " is not in cors.allowed_methods"
+		default:
+			if header := p.disallowedHeader(r.Header.Get("Access-Control-Request-Headers")); header != "" {
+				reason = "header " + header + " is not in cors.allowed_headers"
+			}
+		}
+		if reason != "" {
+			corsRequests.Inc("preflight", "rejected")
+			writeProblem(w, r, http.StatusForbidden, "CORS preflight rejected: "+reason)
+			return
+		}
+
+		corsRequests.Inc("preflight", "allowed")
+		p.allowOrigin(h, origin)
+		h.Set("Access-Control-Allow-Methods", method)
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			h.Set("Access-Control-Allow-Headers", requested)
+		}
+		if p.maxAgeSeconds != "" {
+			h.Set("Access-Control-Max-Age", p.maxAgeSeconds)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// CounterResponse is returned by /api/counter
+type CounterResponse struct {
+	Shared   int64  `json:"shared"`
+	Pod      int64  `json:"pod"`
+	Hostname string `json:"hostname"`
+	Tenant   string `json:"tenant,omitempty"` // TENANT_MODE: both counts are this tenant's
+}
+
+// podCounter lives in this process only. Every replica has its own copy, so
+// refreshing through the Service shows it jumping around as different pods
+// answer, and it resets to zero whenever the pod restarts. With TENANT_MODE
+// each tenant has its own, as it has its own Redis key.
+var podCounter tenantCounter
+
+// counterKey is the Redis key holding the counter shared by all replicas
+const counterKey = "go-demo:counter"
+
+// counterHandler increments both the shared (Redis) and per-pod counters.
+// Unlike podCounter, the Redis value is the same no matter which replica
+// serves the request and survives pod restarts: state lives outside the pod.
+func counterHandler(redis *redisClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hostname, _ := os.Hostname()
+
+		shared, err := redis.Incr(r.Context(), tenantScoped(r.Context(), counterKey))
+		if err != nil {
+			slog.Error("shared counter unavailable", "error", err)
+			writeProblem(w, r, http.StatusServiceUnavailable, "shared counter unavailable")
+			return
+		}
+
+		resp := CounterResponse{
+			Shared:   shared,
+			Pod:      podCounter.get(r.Context()).Add(1),
+			Hostname: hostname,
+			Tenant:   tenantFromContext(r.Context()),
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// Visit counting for the home page. Same idea as /api/counter, but shown
+// where people actually look: the total across all replicas lives in Redis,
+// the per-pod count in this process.
+
+// visitsKey is the Redis key holding the total visits across replicas
+const visitsKey = "go-demo:visits"
+
+// VisitCounts is shown on the home page and in /api/info
+type VisitCounts struct {
+	Total int64 `json:"total"` // all replicas, from Redis
+	Pod   int64 `json:"pod"`   // this replica only, in memory
+}
+
+var (
+	// visitsRedis is nil unless REDIS_ADDR is set
+	visitsRedis *redisClient
+	podVisits   tenantCounter
+)
+
+// recordVisit counts a home page view. Without Redis it returns nil; when
+// Redis is down only the per-pod count is reported and the page still renders.
+func recordVisit(ctx context.Context) *VisitCounts {
+	if visitsRedis == nil {
+		return nil
+	}
+	counts := &VisitCounts{Pod: podVisits.get(ctx).Add(1)}
+	total, err := visitsRedis.Incr(ctx, tenantScoped(ctx, visitsKey))
+	if err != nil {
+		slog.Warn("visit counter unavailable", "error", err)
+		return counts
+	}
+	counts.Total = total
+	return counts
+}
+
+// currentVisits reads the counts without incrementing them
+func currentVisits(ctx context.Context) *VisitCounts {
+	if visitsRedis == nil {
+		return nil
+	}
+	counts := &VisitCounts{Pod: podVisits.get(ctx).Load()}
+	total, err := visitsRedis.GetInt(ctx, tenantScoped(ctx, visitsKey))
+	if err != nil {
+		slog.Warn("visit counter unavailable", "error", err)
+		return counts
+	}
+	counts.Total = total
+	return counts
+}
+
+// visitsLabel is the home page row for the visit counts
+func visitsLabel(counts *VisitCounts) string {
+	if counts == nil {
+		return "set REDIS_ADDR to count visits"
+	}
+	return fmt.Sprintf("%d total / %d on this pod", counts.Total, counts.Pod)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeRedis answers INCR, GET and PING over RESP from an in-memory map
+type fakeRedis struct {
+	addr string
+
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{addr: ln.Addr().String(), values: map[string]int64{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		req, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		args, _ := req.([]interface{})
+		if len(args) == 0 {
+			fmt.Fprint(conn, "-ERR expected a command array\r\n")
+			continue
+		}
+		f.mu.Lock()
+		switch cmd, _ := args[0].(string); cmd {
+		case "PING":
+			fmt.Fprint(conn, "+PONG\r\n")
+		case "INCR":
+			key, _ := args[1].(string)
+			f.values[key]++
+			fmt.Fprintf(conn, ":%d\r\n", f.values[key])
+		case "GET":
+			key, _ := args[1].(string)
+			if n, ok := f.values[key]; ok {
+				s := strconv.FormatInt(n, 10)
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(s), s)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", cmd)
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *fakeRedis) get(key string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.values[key]
+}
+
+func TestCounterHandlerIncrements(t *testing.T) {
+	fake := startFakeRedis(t)
+	handler := counterHandler(newRedisClient(fake.addr))
+	podBefore := podCounter.get(t.Context()).Load()
+
+	for want := int64(1); want <= 3; want++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/counter", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d: %s", want, rec.Code, rec.Body)
+		}
+		var resp CounterResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Shared != want {
+			t.Errorf("request %d: shared = %d, want %d", want, resp.Shared, want)
+		}
+		if resp.Pod != podBefore+want {
+			t.Errorf("request %d: pod = %d, want %d", want, resp.Pod, podBefore+want)
+		}
+	}
+	if n := fake.get(counterKey); n != 3 {
+		t.Errorf("%s in Redis = %d, want 3", counterKey, n)
+	}
+}
+
+func TestCounterHandlerRedisUnreachable(t *testing.T) {
+	// A port that was just free and now has nothing listening
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	podBefore := podCounter.get(t.Context()).Load()
+	rec := httptest.NewRecorder()
+	counterHandler(newRedisClient(addr))(rec, httptest.NewRequest(http.MethodGet, "/api/counter", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", ct)
+	}
+	if n := podCounter.get(t.Context()).Load(); n != podBefore {
+		t.Errorf("pod counter moved from %d to %d on a failed request", podBefore, n)
+	}
+}
+
+func TestRedisClientGetIntAndPing(t *testing.T) {
+	fake := startFakeRedis(t)
+	c := newRedisClient(fake.addr)
+	ctx := t.Context()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if n, err := c.GetInt(ctx, "missing"); err != nil || n != 0 {
+		t.Errorf("GetInt(missing) = %d, %v; want 0, nil", n, err)
+	}
+	for range 2 {
+		if _, err := c.Incr(ctx, "k"); err != nil {
+			t.Fatalf("Incr: %v", err)
+		}
+	}
+	if n, err := c.GetInt(ctx, "k"); err != nil || n != 2 {
+		t.Errorf("GetInt(k) = %d, %v; want 2, nil", n, err)
+	}
+	if _, err := c.Do(ctx, "FLUSHALL"); err == nil {
+		t.Error("an error reply came back as success")
+	}
+}
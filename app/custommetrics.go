@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HPA on custom metrics: Prometheus scrapes /metrics, prometheus-adapter
+// serves the series through the custom.metrics.k8s.io API, and the HPA
+// scales on the per-pod average. The demo gauges here are set by hand
+// from the admin port, so the scale-up can be driven without real load:
+//
+//	curl -X POST 'localhost:9090/admin/metrics/custom?name=queue_depth&value=50'
+//	curl -X POST 'localhost:9090/admin/metrics/custom?name=active_sessions&value=200&for=5m'
+//	kubectl get --raw /apis/custom.metrics.k8s.io/v1beta1/namespaces/go-demo/pods/*/demo_queue_depth
+//	kubectl get hpa go-app-custom -n go-demo -w
+//
+// Each pod reports its own value, and the HPA averages them: set it on one
+// pod and the average moves less than on all. ?for= resets the value
+// later, to watch the scale-down stabilization window at work.
+// job_queue_depth from /api/jobs is a real metric the same rule serves.
+// See k8s/advanced/hpa-custom-metrics.yaml.
+
+// customMetric is one settable demo gauge
+type customMetric struct {
+	mu      sync.Mutex
+	value   float64
+	resetAt time.Time // zero when the value doesn't expire
+	timer   *time.Timer
+}
+
+// customMetrics are the settable gauges, exported as demo_<name>
+var customMetrics = map[string]*customMetric{
+	"queue_depth":     {},
+	"active_sessions": {},
+}
+
+func init() {
+	newGaugeFunc("demo_queue_depth", "Demo queue depth, set through /admin/metrics/custom for HPA custom metrics.",
+		customMetrics["queue_depth"].get)
+	newGaugeFunc("demo_active_sessions", "Demo active sessions, set through /admin/metrics/custom for HPA custom metrics.",
+		customMetrics["active_sessions"].get)
+}
+
+func (m *customMetric) get() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.value
+}
+
+// set changes the value, back to 0 after d when d > 0
+func (m *customMetric) set(value float64, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.value = value
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer, m.resetAt = nil, time.Time{}
+	}
+	if d > 0 {
+		var t *time.Timer
+		t = time.AfterFunc(d, func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if m.timer == t { // not replaced by a later set
+				m.value, m.timer, m.resetAt = 0, nil, time.Time{}
+			}
+		})
+		m.timer, m.resetAt = t, time.Now().Add(d)
+	}
+}
+
+// CustomMetricValue is one gauge in /admin/metrics/custom
+type CustomMetricValue struct {
+	Name    string     `json:"name"`
+	Metric  string     `json:"metric"` // the Prometheus series
+	Value   float64    `json:"value"`
+	ResetAt *time.Time `json:"reset_at,omitempty"`
+}
+
+func customMetricValues() []CustomMetricValue {
+	values := make([]CustomMetricValue, 0, len(customMetrics))
+	for name, m := range customMetrics {
+		m.mu.Lock()
+		v := CustomMetricValue{Name: name, Metric: "demo_" + name, Value: m.value}
+		if !m.resetAt.IsZero() {
+			at := m.resetAt
+			v.ResetAt = &at
+		}
+		m.mu.Unlock()
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+	return values
+}
+
+// customMetricsHandler serves /admin/metrics/custom: GET lists the values,
+// POST ?name=&value=&for= sets one, DELETE ?name= resets it to 0
+func customMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, customMetricValues())
+	case http.MethodPost, http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		m, ok := customMetrics[name]
+		if !ok {
+			writeProblem(w, r, http.StatusBadRequest, "name must be queue_depth or active_sessions")
+			return
+		}
+		if r.Method == http.MethodDelete {
+			m.set(0, 0)
+			writeJSON(w, http.StatusOK, customMetricValues())
+			return
+		}
+		value, err := strconv.ParseFloat(r.URL.Query().Get("value"), 64)
+		if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+			writeProblem(w, r, http.StatusBadRequest, "value must be a non-negative number")
+			return
+		}
+		var d time.Duration
+		if v := r.URL.Query().Get("for"); v != "" {
+			if d, err = time.ParseDuration(v); err != nil || d <= 0 || d > time.Hour {
+				writeProblem(w, r, http.StatusBadRequest, "for must be a Go duration up to 1h")
+				return
+			}
+		}
+		m.set(value, d)
+		slog.Info("custom metric set", "metric", "demo_"+name, "value", value, "for", d.String())
+		writeJSON(w, http.StatusOK, customMetricValues())
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeProblem(w, r, http.StatusMethodNotAllowed, "use GET, POST or DELETE")
+	}
+}
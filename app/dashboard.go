@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// /dashboard is one screen to project during scaling and rollout demos:
+// every replica with its version, readiness and request rate. The page
+// polls /api/dashboard, and the pod that answers fans out to its peers'
+// /api/stats by pod IP, so the numbers don't depend on which pod the
+// Service picked. Peers come from /api/peers' discovery (the API with
+// RBAC, else the headless Service); pod-to-pod calls use plain HTTP, so
+// with TLS enabled only this pod's own stats appear.
+
+// PodSnapshot is one pod's counters, returned by /api/stats
+type PodSnapshot struct {
+	Pod            string  `json:"pod"`
+	Version        string  `json:"version"`
+	Color          string  `json:"color"`
+	Ready          bool    `json:"ready"`
+	UptimeSeconds  float64 `json:"uptime_seconds"`
+	RequestsTotal  int64   `json:"requests_total"` // includes the dashboard's own polling
+	InFlight       int64   `json:"in_flight"`
+	Goroutines     int     `json:"goroutines"`
+	HeapAllocBytes uint64  `json:"heap_alloc_bytes"`
+}
+
+// DashboardPod is a peer with its stats, or why they're missing
+type DashboardPod struct {
+	Peer
+	Stats *PodSnapshot `json:"stats,omitempty"`
+	Error string       `json:"error,omitempty"`
+}
+
+// DashboardResponse is returned by /api/dashboard
+type DashboardResponse struct {
+	Source      string         `json:"source"` // how peers were found: kubernetes-api, dns or self
+	ServedBy    string         `json:"served_by"`
+	Pods        []DashboardPod `json:"pods"`
+	Error       string         `json:"error,omitempty"`
+	GeneratedAt time.Time      `json:"generated_at"`
+}
+
+func podSnapshot() PodSnapshot {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	hostname, _ := os.Hostname()
+	return PodSnapshot{
+		Pod:            hostname,
+		Version:        buildInfo().Version,
+		Color:          currentTheme().Color,
+		Ready:          ready.Load() && !readyOverride.Disabled(),
+		UptimeSeconds:  time.Since(startTime).Round(time.Second).Seconds(),
+		RequestsTotal:  requestsServed.Load(),
+		InFlight:       inFlight.Load(),
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAllocBytes: mem.HeapAlloc,
+	}
+}
+
+func podStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, podSnapshot())
+}
+
+// dashboardAPIHandler gathers every peer's /api/stats on port
+func dashboardAPIHandler(port string) http.HandlerFunc {
+	client := &http.Client{Transport: tracingTransport{base: http.DefaultTransport}, Timeout: 2 * time.Second}
+	return func(w http.ResponseWriter, r *http.Request) {
+		self := podSnapshot()
+		resp := DashboardResponse{ServedBy: self.Pod, GeneratedAt: time.Now()}
+
+		peers, err := discoverPeers(r.Context())
+		resp.Source, resp.Error = peers.Source, peers.Error
+		if err != nil {
+			// Outside a cluster: just this pod
+			resp.Source, resp.Error = "self", err.Error()
+			peers.Peers = []Peer{{Name: self.Pod, IP: getEnv("POD_IP", ""), Ready: self.Ready, Self: true}}
+		}
+
+		resp.Pods = make([]DashboardPod, len(peers.Peers))
+		var wg sync.WaitGroup
+		for i, peer := range peers.Peers {
+			resp.Pods[i].Peer = peer
+			if peer.Self {
+				resp.Pods[i].Stats = &self
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				stats, err := fetchPodStats(r.Context(), client, peer.IP, port)
+				resp.Pods[i].Stats = stats
+				if err != nil {
+					resp.Pods[i].Error = err.Error()
+				}
+			}()
+		}
+		wg.Wait()
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func fetchPodStats(ctx context.Context, client *http.Client, ip, port string) (*PodSnapshot, error) {
+	if ip == "" {
+		return nil, fmt.Errorf("no pod IP yet")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+net.JoinHostPort(ip, port)+"/api/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("/api/stats returned %d", res.StatusCode)
+	}
+	var stats PodSnapshot
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// DashboardPage is the data for templates/dashboard.html
+type DashboardPage struct {
+	AppName    string
+	ThemeStyle template.CSS
+	User       string // signed-in user with OIDC login, else ""
+}
+
+// registerDashboardRoutes adds /dashboard and its API, behind an OIDC
+// login when one is configured
+func registerDashboardRoutes(routes *routeRegistry, pages *template.Template, appName, port string) {
+	routes.Handle(Route{Path: "/dashboard", Methods: []string{http.MethodGet}, Auth: []string{authLogin},
+		Description: "Live cluster dashboard: every replica's version, readiness and request rate"}, dashboardHandler(pages, appName))
+	routes.Handle(Route{Path: "/api/dashboard", Methods: []string{http.MethodGet}, Auth: []string{authLogin},
+		Description: "Peers with their /api/stats, for /dashboard"}, dashboardAPIHandler(port))
+}
+
+func dashboardHandler(pages *template.Template, appName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := DashboardPage{AppName: appName, ThemeStyle: themeStyle()}
+		if s := sessionFromContext(r.Context()); s != nil {
+			page.User = s.User()
+		}
+		renderPage(w, r, pages, "dashboard.html", page)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rtmetrics "runtime/metrics"
+	"time"
+)
+
+// Diagnostics for performance lessons, on the admin listener only:
+//
+//	kubectl port-forward deploy/go-app 9090
+//	curl localhost:9090/debug/runtime
+//	go tool pprof http://localhost:9090/debug/pprof/profile?seconds=30   # needs ENABLE_PPROF=true
+//
+// pprof is opt-in: profiles are cheap but not free, and goroutine dumps and
+// the command line can leak more than you'd like from a public port.
+
+// RuntimeStats is returned by /debug/runtime
+type RuntimeStats struct {
+	GoVersion     string         `json:"go_version"`
+	Goroutines    int            `json:"goroutines"`
+	GOMAXPROCS    int            `json:"gomaxprocs"`
+	NumCPU        int            `json:"num_cpu"`
+	GOMEMLIMIT    int64          `json:"gomemlimit_bytes,omitempty"` // omitted when unlimited
+	GOGC          int            `json:"gogc"`
+	CgroupLimits  cgroupLimits   `json:"cgroup_limits"`
+	Tuning        *runtimeTuning `json:"tuning,omitempty"` // how GOMAXPROCS and GOMEMLIMIT were chosen
+	UptimeSeconds float64        `json:"uptime_seconds"`
+	Memory        RuntimeMemory  `json:"memory"`
+	GC            RuntimeGC      `json:"gc"`
+}
+
+// RuntimeMemory is a subset of runtime.MemStats
+type RuntimeMemory struct {
+	HeapAllocBytes   uint64 `json:"heap_alloc_bytes"`
+	HeapInuseBytes   uint64 `json:"heap_inuse_bytes"`
+	HeapObjects      uint64 `json:"heap_objects"`
+	StackInuseBytes  uint64 `json:"stack_inuse_bytes"`
+	SysBytes         uint64 `json:"sys_bytes"`
+	TotalAllocBytes  uint64 `json:"total_alloc_bytes"`
+	NextGCHeapTarget uint64 `json:"next_gc_bytes"`
+}
+
+// RuntimeGC summarizes garbage collection so far
+type RuntimeGC struct {
+	Cycles        uint32     `json:"cycles"`
+	Forced        uint32     `json:"forced"`
+	LastGC        *time.Time `json:"last_gc,omitempty"`
+	PauseTotalMS  float64    `json:"pause_total_ms"`
+	LastPauseMS   float64    `json:"last_pause_ms"`
+	CPUFraction   float64    `json:"cpu_fraction"` // share of CPU time spent in GC since start
+	RecentPauseMS []float64  `json:"recent_pauses_ms,omitempty"`
+}
+
+func runtimeHandler(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	limits, _ := readCgroupLimits(cgroupRoot)
+
+	stats := RuntimeStats{
+		GoVersion:     runtime.Version(),
+		Goroutines:    runtime.NumGoroutine(),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		NumCPU:        runtime.NumCPU(),
+		CgroupLimits:  limits,
+		Tuning:        runtimeTuned,
+		UptimeSeconds: time.Since(startTime).Seconds(),
+		Memory: RuntimeMemory{
+			HeapAllocBytes:   mem.HeapAlloc,
+			HeapInuseBytes:   mem.HeapInuse,
+			HeapObjects:      mem.HeapObjects,
+			StackInuseBytes:  mem.StackInuse,
+			SysBytes:         mem.Sys,
+			TotalAllocBytes:  mem.TotalAlloc,
+			NextGCHeapTarget: mem.NextGC,
+		},
+		GC: RuntimeGC{
+			Cycles:       mem.NumGC,
+			Forced:       mem.NumForcedGC,
+			PauseTotalMS: float64(mem.PauseTotalNs) / 1e6,
+			CPUFraction:  mem.GCCPUFraction,
+		},
+	}
+	// The effective GOGC and GOMEMLIMIT, whether set by env or at runtime
+	settings := []rtmetrics.Sample{{Name: "/gc/gogc:percent"}, {Name: "/gc/gomemlimit:bytes"}}
+	rtmetrics.Read(settings)
+	stats.GOGC = int(settings[0].Value.Uint64())
+	if limit := settings[1].Value.Uint64(); limit != math.MaxInt64 {
+		stats.GOMEMLIMIT = int64(limit)
+	}
+
+	if mem.NumGC > 0 {
+		last := time.Unix(0, int64(mem.LastGC))
+		stats.GC.LastGC = &last
+		stats.GC.LastPauseMS = float64(mem.PauseNs[(mem.NumGC+255)%256]) / 1e6
+		// PauseNs is a ring buffer of the last 256 pauses; show up to 10
+		for i := uint32(0); i < min(mem.NumGC, 10); i++ {
+			stats.GC.RecentPauseMS = append(stats.GC.RecentPauseMS, float64(mem.PauseNs[(mem.NumGC-i+255)%256])/1e6)
+		}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// registerPprofRoutes adds the net/http/pprof handlers. pprof.Index serves
+// the named profiles (heap, goroutine, allocs, block, mutex, ...) under
+// /debug/pprof/ itself.
+func registerPprofRoutes(routes *routeRegistry) {
+	routes.HandleFunc("/debug/pprof/", "pprof index and named profiles (heap, goroutine, ...)", pprof.Index, http.MethodGet)
+	routes.HandleFunc("/debug/pprof/cmdline", "pprof: process command line", pprof.Cmdline, http.MethodGet)
+	routes.HandleFunc("/debug/pprof/profile", "pprof: CPU profile (?seconds=30)", pprof.Profile, http.MethodGet)
+	routes.HandleFunc("/debug/pprof/symbol", "pprof: symbol lookup", pprof.Symbol, http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/debug/pprof/trace", "pprof: execution trace (?seconds=5)", pprof.Trace, http.MethodGet)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/middleware"
+)
+
+// "Capture what's happening right now" without a redeploy. A capture
+// window turns the log level up to debug, keeps every log line and the
+// request and response bodies of every request for its duration, then
+// puts the level back and offers the lot as one download:
+//
+//	curl -X POST 'localhost:9090/admin/debug-capture?duration=30s'
+//	curl localhost:9090/admin/debug-capture                       # progress
+//	curl -o capture.tar.gz localhost:9090/admin/debug-capture/download
+//
+// The bundle holds capture.json (the window and counts), logs.jsonl and
+// requests.jsonl. Bodies are cut at ?body_bytes= (DEBUG_CAPTURE_BODY_BYTES,
+// 4 KiB), the window at DEBUG_CAPTURE_MAX_DURATION, and credentials in
+// headers are never kept. DELETE ends a window early. One capture runs at
+// a time, per pod: with several replicas, run it on each through
+// kubectl port-forward, or pin the traffic to one pod first.
+
+const (
+	maxCapturedRequests = 2000
+	maxCapturedLogLines = 20000
+)
+
+// capturedHeadersRedacted are masked in the bundle, whatever their value
+var capturedHeadersRedacted = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization", "X-Api-Key"}
+
+// CapturedRequest is one request seen during a capture window
+type CapturedRequest struct {
+	Time              time.Time   `json:"time"`
+	RequestID         string      `json:"request_id,omitempty"`
+	Method            string      `json:"method"`
+	URL               string      `json:"url"`
+	Route             string      `json:"route"`
+	Remote            string      `json:"remote"`
+	RequestHeaders    http.Header `json:"request_headers"`
+	RequestBody       string      `json:"request_body,omitempty"`
+	RequestTruncated  bool        `json:"request_truncated,omitempty"`
+	Status            int         `json:"status"`
+	ResponseHeaders   http.Header `json:"response_headers"`
+	ResponseBody      string      `json:"response_body,omitempty"`
+	ResponseTruncated bool        `json:"response_truncated,omitempty"`
+	DurationMS        float64     `json:"duration_ms"`
+}
+
+// DebugCaptureStatus is returned by /admin/debug-capture and stored in the
+// bundle as capture.json
+type DebugCaptureStatus struct {
+	Active          bool       `json:"active"`
+	Pod             string     `json:"pod,omitempty"`
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	EndsAt          *time.Time `json:"ends_at,omitempty"`
+	EndedAt         *time.Time `json:"ended_at,omitempty"`
+	Duration        string     `json:"duration,omitempty"`
+	Level           string     `json:"level,omitempty"`          // while capturing
+	PreviousLevel   string     `json:"previous_level,omitempty"` // restored afterwards
+	BodyBytes       int        `json:"body_bytes,omitempty"`
+	Requests        int        `json:"requests"`
+	DroppedRequests int        `json:"dropped_requests,omitempty"`
+	LogLines        int        `json:"log_lines"`
+	DroppedLogLines int        `json:"dropped_log_lines,omitempty"`
+	Download        string     `json:"download,omitempty"`
+}
+
+// debugCapture is the current or last capture window
+type debugCapture struct {
+	started, ends, ended time.Time
+	level, previous      slog.Level
+	bodyBytes            int
+	timer                *time.Timer
+
+	requests        []CapturedRequest
+	droppedRequests int
+	logs            bytes.Buffer
+	logLines        int
+	droppedLogLines int
+}
+
+var capture struct {
+	mu      sync.Mutex
+	current *debugCapture // nil before the first window
+	active  bool
+}
+
+// captureLogs tees log output into the active window; setupLogging and
+// setupAccessLog write through it
+type captureLogs struct{ w io.Writer }
+
+func (c captureLogs) Write(p []byte) (int, error) {
+	capture.mu.Lock()
+	if dc := capture.current; capture.active {
+		if dc.logLines < maxCapturedLogLines {
+			dc.logs.Write(p)
+			dc.logLines++
+		} else {
+			dc.droppedLogLines++
+		}
+	}
+	capture.mu.Unlock()
+	return c.w.Write(p)
+}
+
+// captureTraffic records bodies while a window is open. It sits inside
+// compression, so it keeps what the handler wrote rather than gzip.
+func captureTraffic(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if strings.HasPrefix(pattern, "/admin/debug-capture") || isProbeOrMetrics(pattern) {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		capture.mu.Lock()
+		active, limit := capture.active, 0
+		if active {
+			limit = capture.current.bodyBytes
+		}
+		capture.mu.Unlock()
+		if !active {
+			next(w, r)
+			return
+		}
+
+		start := time.Now()
+		entry := CapturedRequest{Time: start.UTC(), RequestID: requestIDFromContext(r.Context()), Method: r.Method,
+			URL: r.URL.RequestURI(), Route: pattern, Remote: r.RemoteAddr, RequestHeaders: redactedHeaders(r.Header)}
+		reqBody := &cappedBuffer{limit: limit}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+		rec := &captureRecorder{Recorder: middleware.Recorder{ResponseWriter: w}, body: cappedBuffer{limit: limit}}
+		defer func() {
+			entry.Status = cmp.Or(rec.Status, http.StatusOK)
+			v := recover()
+			if v != nil { // answered with a 500 further out
+				entry.Status = http.StatusInternalServerError
+			}
+			entry.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+			entry.ResponseHeaders = redactedHeaders(w.Header())
+			entry.RequestBody, entry.RequestTruncated = reqBody.String(), reqBody.truncated
+			entry.ResponseBody, entry.ResponseTruncated = rec.body.String(), rec.body.truncated
+			recordCapturedRequest(entry)
+			if v != nil {
+				panic(v)
+			}
+		}()
+		next(rec, r)
+	}
+}
+
+// isProbeOrMetrics reports the kubelet's and Prometheus' routes, which
+// would fill a capture with the same few lines
+func isProbeOrMetrics(pattern string) bool {
+	switch pattern {
+	case "/health", "/ready", "/startup", "/metrics":
+		return true
+	}
+	return false
+}
+
+func recordCapturedRequest(entry CapturedRequest) {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	dc := capture.current
+	if !capture.active {
+		return // the window closed while the request ran
+	}
+	if len(dc.requests) >= maxCapturedRequests {
+		dc.droppedRequests++
+		return
+	}
+	dc.requests = append(dc.requests, entry)
+}
+
+func redactedHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range capturedHeadersRedacted {
+		if _, ok := out[name]; ok {
+			out[name] = []string{"[redacted]"}
+		}
+	}
+	return out
+}
+
+// cappedBuffer keeps the first limit bytes written to it
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		b.truncated = true
+		b.Buffer.Write(p[:max(room, 0)])
+	} else {
+		b.Buffer.Write(p)
+	}
+	return len(p), nil
+}
+
+// captureRecorder keeps the start of the response body as it is written
+type captureRecorder struct {
+	middleware.Recorder
+	body cappedBuffer
+}
+
+func (c *captureRecorder) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.Recorder.Write(b)
+}
+
+func (c *captureRecorder) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+// debugCaptureHandler starts (POST), reports (GET) or ends (DELETE) a
+// capture window
+func debugCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		startDebugCapture(w, r)
+		return
+	case http.MethodDelete:
+		if !stopDebugCapture("stopped") {
+			writeProblem(w, r, http.StatusConflict, "no capture is running")
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeProblem(w, r, http.StatusMethodNotAllowed, "use GET, POST or DELETE")
+		return
+	}
+	writeJSON(w, http.StatusOK, debugCaptureStatus())
+}
+
+func startDebugCapture(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	maxDuration := getEnvDuration("DEBUG_CAPTURE_MAX_DURATION", 5*time.Minute)
+	d := 30 * time.Second
+	if v := q.Get("duration"); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil || d <= 0 {
+			writeProblem(w, r, http.StatusBadRequest, "duration must be a positive Go duration like 30s or 2m")
+			return
+		}
+	}
+	if d > maxDuration {
+		writeProblem(w, r, http.StatusBadRequest, "duration is over DEBUG_CAPTURE_MAX_DURATION ("+maxDuration.String()+")")
+		return
+	}
+	bodyBytes := int(getEnvInt("DEBUG_CAPTURE_BODY_BYTES", 4096))
+	if v := q.Get("body_bytes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 1<<20 {
+			writeProblem(w, r, http.StatusBadRequest, "body_bytes must be between 0 and 1048576")
+			return
+		}
+		bodyBytes = n
+	}
+	level := slog.LevelDebug
+	if v := q.Get("level"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "level must be one of debug, info, warn, error")
+			return
+		}
+	}
+
+	capture.mu.Lock()
+	if capture.active {
+		capture.mu.Unlock()
+		writeProblem(w, r, http.StatusConflict, "a capture is already running; DELETE it or wait for it to end")
+		return
+	}
+	now := time.Now()
+	dc := &debugCapture{started: now, ends: now.Add(d), level: level, previous: logLevel.Level(), bodyBytes: bodyBytes}
+	dc.timer = time.AfterFunc(d, func() { stopDebugCapture("finished") })
+	capture.current, capture.active = dc, true
+	capture.mu.Unlock()
+
+	logLevel.Set(level)
+	slog.Warn("debug capture started", "duration", d.String(), "level", level.String(), "previous_level", dc.previous.String(),
+		"body_bytes", bodyBytes)
+	writeJSON(w, http.StatusAccepted, debugCaptureStatus())
+}
+
+// stopDebugCapture closes the window and puts the log level back, unless
+// someone changed it in the meantime; false when none was open
+func stopDebugCapture(how string) bool {
+	capture.mu.Lock()
+	dc := capture.current
+	if !capture.active {
+		capture.mu.Unlock()
+		return false
+	}
+	capture.active = false
+	dc.ended = time.Now()
+	dc.timer.Stop()
+	requests, lines := len(dc.requests), dc.logLines
+	capture.mu.Unlock()
+
+	if logLevel.Level() == dc.level {
+		logLevel.Set(dc.previous)
+	}
+	slog.Warn("debug capture "+how, "requests", requests, "log_lines", lines, "log_level", logLevel.Level().String())
+	return true
+}
+
+func debugCaptureStatus() DebugCaptureStatus {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	dc := capture.current
+	if dc == nil {
+		return DebugCaptureStatus{}
+	}
+	hostname, _ := os.Hostname()
+	started, ends := dc.started.UTC(), dc.ends.UTC()
+	s := DebugCaptureStatus{Active: capture.active, Pod: hostname, StartedAt: &started, EndsAt: &ends,
+		Duration: dc.ends.Sub(dc.started).String(), Level: dc.level.String(), PreviousLevel: dc.previous.String(),
+		BodyBytes: dc.bodyBytes, Requests: len(dc.requests), DroppedRequests: dc.droppedRequests,
+		LogLines: dc.logLines, DroppedLogLines: dc.droppedLogLines, Download: "/admin/debug-capture/download"}
+	if !dc.ended.IsZero() {
+		ended := dc.ended.UTC()
+		s.EndedAt = &ended
+	}
+	return s
+}
+
+// debugCaptureDownloadHandler serves the last window as a .tar.gz; a
+// running one is bundled as far as it got
+func debugCaptureDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	status := debugCaptureStatus()
+	if status.StartedAt == nil {
+		writeProblem(w, r, http.StatusNotFound, "no capture yet; POST /admin/debug-capture?duration=30s first")
+		return
+	}
+	capture.mu.Lock()
+	logs := bytes.Clone(capture.current.logs.Bytes())
+	var requests bytes.Buffer
+	enc := json.NewEncoder(&requests)
+	for _, entry := range capture.current.requests {
+		enc.Encode(entry)
+	}
+	capture.mu.Unlock()
+	meta, _ := json.MarshalIndent(status, "", "  ")
+
+	name := "debug-capture-" + status.Pod + "-" + status.StartedAt.Format("20060102T150405Z")
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.tar.gz"`)
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{"capture.json", meta}, {"logs.jsonl", logs}, {"requests.jsonl", requests.Bytes()}} {
+		tw.WriteHeader(&tar.Header{Name: name + "/" + f.name, Mode: 0o644, Size: int64(len(f.data)), ModTime: *status.StartedAt})
+		tw.Write(f.data)
+	}
+	tw.Close()
+	gz.Close()
+}
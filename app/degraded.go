@@ -0,0 +1,265 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Degraded mode trades features for the error budget: while it is on, the
+// app stops making the calls that cost it most and answers what it can
+// from what it already has. With DEGRADE_AUTO the SLO burn rates (slo.go)
+// switch it:
+//
+//	DEGRADE_AUTO=true
+//	DEGRADE_BURN_RATE=14.4          on when a route's 1h and 5m burn both pass it
+//	DEGRADE_RECOVER_BURN_RATE=1     off once every route's 5m burn is below it
+//	DEGRADE_HOLD=2m                 shortest time in either state
+//	curl -X POST 'localhost:8080/chaos/error-rate?percent=50'
+//	curl -s localhost:8080/api/degraded | jq '{active, reason, trigger}'
+//
+// POST /admin/degraded?mode=on|off|auto forces it either way, or hands it
+// back to the burn rates. While degraded:
+//
+//	/api/compute/*   cache hits only; misses and ?cache=none are shed
+//	/api/call        shed, sparing the downstream and its breaker
+//	/api/fanout      shed
+//	/api/chain       this hop only, without calling the next
+//	/api/info        no Redis visit counts
+//
+// Shed requests get a 503 with Retry-After and X-Degraded, like a
+// concurrency limit's, but aren't counted against the SLOs: the mode would
+// otherwise keep itself on. degraded_skips_total{feature} counts them.
+// The same 1h-and-5m rule as the page alert means a short spike doesn't
+// flip it, and the hold stops it flapping at the edge.
+
+// degradedHeader marks a response that degraded mode shortened or shed
+const degradedHeader = "X-Degraded"
+
+// degradedFeatures are what degraded mode skips
+var degradedFeatures = []string{"compute", "call", "fanout", "chain", "visits"}
+
+// DegradedTransition is one switch on or off
+type DegradedTransition struct {
+	At       time.Time `json:"at"`
+	Active   bool      `json:"active"`
+	Reason   string    `json:"reason"`
+	BurnRate float64   `json:"burn_rate,omitempty"`
+}
+
+// DegradedStatus is returned by /api/degraded
+type DegradedStatus struct {
+	Active       bool                 `json:"active"`
+	Mode         string               `json:"mode"` // auto, on or off
+	Auto         bool                 `json:"auto"` // DEGRADE_AUTO
+	Since        *time.Time           `json:"since,omitempty"`
+	Reason       string               `json:"reason,omitempty"`
+	Trigger      string               `json:"trigger,omitempty"` // the route whose burn switched it on
+	BurnRate     float64              `json:"burn_rate"`         // the worst route's 5m burn at the last check
+	WorstRoute   string               `json:"worst_route,omitempty"`
+	Threshold    float64              `json:"threshold"`
+	RecoverBelow float64              `json:"recover_below"`
+	Hold         string               `json:"hold"`
+	CheckedAt    *time.Time           `json:"checked_at,omitempty"`
+	Features     []string             `json:"features"`
+	Skipped      map[string]int64     `json:"skipped"` // since the pod started
+	Transitions  []DegradedTransition `json:"transitions"`
+}
+
+// degradedMode switches the app in and out of degraded mode
+type degradedMode struct {
+	auto               bool
+	threshold, recover float64
+	hold               time.Duration
+
+	mu          sync.Mutex
+	mode        string // auto, on or off
+	active      bool
+	since       time.Time
+	holdUntil   time.Time // no automatic switch before then
+	reason      string
+	trigger     string
+	burn        float64
+	worst       string
+	checked     time.Time
+	skipped     map[string]int64
+	transitions []DegradedTransition
+}
+
+// degradedHistoryLen bounds the transitions kept
+const degradedHistoryLen = 20
+
+var (
+	degraded = &degradedMode{threshold: sloPageBurnRate, recover: 1, hold: 2 * time.Minute, mode: "auto", skipped: map[string]int64{}}
+
+	degradedSkips = newCounterVec("degraded_skips_total",
+		"Work skipped or requests shed while in degraded mode, by feature.", "feature")
+)
+
+func init() {
+	newGaugeFunc("degraded_mode", "1 while the app is in degraded mode.", func() float64 {
+		if degraded.Active() {
+			return 1
+		}
+		return 0
+	})
+}
+
+// configure reads the DEGRADE_* settings
+func (d *degradedMode) configure() {
+	d.auto = getEnvBool("DEGRADE_AUTO", false)
+	d.threshold = getEnvFloat("DEGRADE_BURN_RATE", d.threshold)
+	d.recover = getEnvFloat("DEGRADE_RECOVER_BURN_RATE", d.recover)
+	d.hold = getEnvDuration("DEGRADE_HOLD", d.hold)
+}
+
+// Active reports whether degraded mode is on
+func (d *degradedMode) Active() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.active
+}
+
+// watch checks the burn rates every interval, for DEGRADE_AUTO
+func (d *degradedMode) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		d.check()
+	}
+}
+
+// check compares the worst route's burn with the thresholds
+func (d *degradedMode) check() {
+	var worst string
+	var burn, long float64
+	for _, rs := range slos.report() {
+		for _, sli := range []SLIReport{rs.Availability, rs.Latency} {
+			if sli.BurnRates["5m"] > burn {
+				worst, burn, long = rs.Route, sli.BurnRates["5m"], sli.BurnRates["1h"]
+			}
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.burn, d.worst, d.checked = burn, worst, time.Now()
+	if d.mode != "auto" || time.Now().Before(d.holdUntil) {
+		return
+	}
+	switch {
+	case !d.active && burn > d.threshold && long > d.threshold:
+		d.switchTo(true, worst+" is burning its error budget "+strconv.FormatFloat(burn, 'f', 1, 64)+"x too fast", worst)
+	case d.active && burn < d.recover:
+		d.switchTo(false, "every route's 5m burn is below "+strconv.FormatFloat(d.recover, 'f', -1, 64), "")
+	}
+}
+
+// switchTo records a transition; d.mu must be held
+func (d *degradedMode) switchTo(active bool, reason, trigger string) {
+	if active == d.active {
+		d.reason = reason
+		return
+	}
+	d.active, d.since, d.reason, d.trigger = active, time.Now(), reason, trigger
+	d.holdUntil = d.since.Add(d.hold)
+	d.transitions = append(d.transitions, DegradedTransition{At: d.since, Active: active, Reason: reason, BurnRate: d.burn})
+	if len(d.transitions) > degradedHistoryLen {
+		d.transitions = d.transitions[len(d.transitions)-degradedHistoryLen:]
+	}
+	if active {
+		slog.Warn("degraded mode on", "reason", reason, "burn_rate", d.burn)
+		podEvents.Record("Warning", "DegradedModeOn", reason)
+	} else {
+		slog.Info("degraded mode off", "reason", reason, "burn_rate", d.burn)
+		podEvents.Record("Normal", "DegradedModeOff", reason)
+	}
+}
+
+// setMode forces the mode on or off, or back to the burn rates
+func (d *degradedMode) setMode(mode string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.mode = mode
+	switch mode {
+	case "on":
+		d.switchTo(true, "forced on by /admin/degraded", "")
+	case "off":
+		d.switchTo(false, "forced off by /admin/degraded", "")
+	default:
+		if !d.auto {
+			d.switchTo(false, "back to auto, but DEGRADE_AUTO is off", "")
+			return
+		}
+		// let the next check decide, without waiting out the hold
+		d.holdUntil = time.Time{}
+	}
+}
+
+// skip counts a skipped feature and reports whether degraded mode is on.
+// w, when there is one, gets X-Degraded.
+func (d *degradedMode) skip(w http.ResponseWriter, feature string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.active {
+		return false
+	}
+	d.skipped[feature]++
+	degradedSkips.Inc(feature)
+	if w != nil {
+		w.Header().Set(degradedHeader, feature)
+	}
+	return true
+}
+
+// Status returns a copy of the mode's state
+func (d *degradedMode) Status() DegradedStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := DegradedStatus{Active: d.active, Mode: d.mode, Auto: d.auto, Reason: d.reason, Trigger: d.trigger,
+		BurnRate: d.burn, WorstRoute: d.worst, Threshold: d.threshold, RecoverBelow: d.recover, Hold: d.hold.String(),
+		Features: degradedFeatures, Skipped: map[string]int64{}, Transitions: append([]DegradedTransition{}, d.transitions...)}
+	if !d.since.IsZero() {
+		since := d.since
+		s.Since = &since
+	}
+	if !d.checked.IsZero() {
+		checked := d.checked
+		s.CheckedAt = &checked
+	}
+	for _, f := range degradedFeatures {
+		s.Skipped[f] = d.skipped[f]
+	}
+	return s
+}
+
+// shedDegraded answers a request degraded mode won't serve
+func shedDegraded(w http.ResponseWriter, r *http.Request, what string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(max(degraded.hold, time.Second).Seconds())))
+	writeProblem(w, r, http.StatusServiceUnavailable, "degraded mode: "+what+"; see /api/degraded")
+}
+
+// degradedHandler serves /api/degraded
+func degradedHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, degraded.Status())
+}
+
+// degradedAdminHandler serves POST /admin/degraded?mode=on|off|auto
+func degradedAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode != "on" && mode != "off" && mode != "auto" {
+		writeProblem(w, r, http.StatusBadRequest, "mode must be on, off or auto")
+		return
+	}
+	degraded.setMode(mode)
+	if mode == "auto" && degraded.auto {
+		degraded.check()
+	}
+	writeJSON(w, http.StatusOK, degraded.Status())
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /api/dns looks a name up the way this pod's own clients would, with the
+// pod's resolver and /etc/resolv.conf:
+//
+//	curl 'localhost:8080/api/dns?name=go-app-service'
+//	curl 'localhost:8080/api/dns?name=go-app-service.go-demo.svc.cluster.local.'
+//	curl 'localhost:8080/api/dns?name=_http._tcp.go-app-service.go-demo.svc.cluster.local&type=SRV'
+//
+// The answer includes the search list the resolver walks for short names:
+// with the cluster default of ndots:5, "go-app-service" is tried as
+// go-app-service.go-demo.svc.cluster.local first, which is why short names
+// work inside a namespace and why a trailing dot skips the search entirely.
+
+// resolvConfPath is read for the resolver settings
+const resolvConfPath = "/etc/resolv.conf"
+
+// dnsTypes are the record types /api/dns knows, in the order they're tried
+var dnsTypes = []string{"A", "AAAA", "CNAME", "SRV"}
+
+// DNSResponse is returned by /api/dns
+type DNSResponse struct {
+	Name       string         `json:"name"`
+	Found      bool           `json:"found"` // any lookup returned answers
+	Lookups    []DNSLookup    `json:"lookups"`
+	Resolver   ResolverConfig `json:"resolver"`
+	Candidates []string       `json:"search_candidates"` // names tried, in order
+	Pod        string         `json:"pod"`
+}
+
+// DNSLookup is one record type's answers
+type DNSLookup struct {
+	Type      string   `json:"type"`
+	Answers   []string `json:"answers"`
+	Error     string   `json:"error,omitempty"`
+	NotFound  bool     `json:"not_found,omitempty"` // NXDOMAIN or no records of this type
+	LatencyMS float64  `json:"latency_ms"`
+}
+
+// ResolverConfig is the parsed /etc/resolv.conf
+type ResolverConfig struct {
+	Nameservers []string `json:"nameservers"`
+	Search      []string `json:"search"`
+	Options     []string `json:"options"`
+	Ndots       int      `json:"ndots"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// readResolvConf parses the nameserver, search and options lines
+func readResolvConf(path string) ResolverConfig {
+	cfg := ResolverConfig{Nameservers: []string{}, Search: []string{}, Options: []string{}, Ndots: 1}
+	f, err := os.Open(path)
+	if err != nil {
+		cfg.Error = err.Error()
+		return cfg
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			cfg.Nameservers = append(cfg.Nameservers, fields[1])
+		case "search", "domain": // the last one wins, as in the libc resolver
+			cfg.Search = fields[1:]
+		case "options":
+			cfg.Options = append(cfg.Options, fields[1:]...)
+			for _, opt := range fields[1:] {
+				if v, ok := strings.CutPrefix(opt, "ndots:"); ok {
+					if n, err := strconv.Atoi(v); err == nil {
+						cfg.Ndots = min(n, 15)
+					}
+				}
+			}
+		}
+	}
+	return cfg
+}
+
+// searchCandidates lists the names the resolver tries for name: a name
+// with at least ndots dots is tried as-is first, otherwise last
+func searchCandidates(name string, cfg ResolverConfig) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+	var candidates []string
+	for _, domain := range cfg.Search {
+		candidates = append(candidates, name+"."+strings.TrimSuffix(domain, ".")+".")
+	}
+	if strings.Count(name, ".") >= cfg.Ndots {
+		return append([]string{name + "."}, candidates...)
+	}
+	return append(candidates, name+".")
+}
+
+// lookupDNS runs one record type's lookup
+func lookupDNS(ctx context.Context, recordType, name string) DNSLookup {
+	l := DNSLookup{Type: recordType, Answers: []string{}}
+	start := time.Now()
+	var err error
+	switch recordType {
+	case "A", "AAAA":
+		network := "ip4"
+		if recordType == "AAAA" {
+			network = "ip6"
+		}
+		var ips []net.IP
+		ips, err = net.DefaultResolver.LookupIP(ctx, network, name)
+		for _, ip := range ips {
+			l.Answers = append(l.Answers, ip.String())
+		}
+	case "CNAME":
+		var cname string
+		cname, err = net.DefaultResolver.LookupCNAME(ctx, name)
+		if err == nil && cname != "" && !strings.EqualFold(strings.TrimSuffix(cname, "."), strings.TrimSuffix(name, ".")) {
+			l.Answers = append(l.Answers, cname)
+		}
+	case "SRV":
+		var srvs []*net.SRV
+		_, srvs, err = net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		for _, srv := range srvs {
+			l.Answers = append(l.Answers, srv.Target+":"+strconv.Itoa(int(srv.Port))+
+				" priority="+strconv.Itoa(int(srv.Priority))+" weight="+strconv.Itoa(int(srv.Weight)))
+		}
+	}
+	l.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		var dnsErr *net.DNSError
+		l.NotFound = errors.As(err, &dnsErr) && dnsErr.IsNotFound
+		l.Error = err.Error()
+	}
+	return l
+}
+
+// dnsHandler serves /api/dns?name=&type=&timeout=
+func dnsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	q := r.URL.Query()
+	name := strings.TrimSpace(q.Get("name"))
+	if name == "" || len(name) > 253 || strings.ContainsAny(name, " /:") {
+		writeProblem(w, r, http.StatusBadRequest, "name must be a DNS name, like go-app-service or go-app-service.go-demo.svc.cluster.local")
+		return
+	}
+	types := dnsTypes
+	if v := strings.ToUpper(q.Get("type")); v != "" && v != "ALL" {
+		types = nil
+		for _, t := range strings.Split(v, ",") {
+			known := false
+			for _, k := range dnsTypes {
+				known = known || k == t
+			}
+			if !known {
+				writeProblem(w, r, http.StatusBadRequest, "type must be A, AAAA, CNAME, SRV or a comma-separated list")
+				return
+			}
+			types = append(types, t)
+		}
+	}
+	timeout := 5 * time.Second
+	if v := q.Get("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 || timeout > 30*time.Second {
+			writeProblem(w, r, http.StatusBadRequest, "timeout must be a Go duration up to 30s")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	cfg := readResolvConf(resolvConfPath)
+	hostname, _ := os.Hostname()
+	resp := DNSResponse{Name: name, Resolver: cfg, Candidates: searchCandidates(name, cfg), Pod: hostname}
+	for _, t := range types {
+		l := lookupDNS(ctx, t, name)
+		resp.Found = resp.Found || len(l.Answers) > 0
+		resp.Lookups = append(resp.Lookups, l)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
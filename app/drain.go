@@ -0,0 +1,261 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// POST /admin/drain is the standard drain as a hook target: fail
+// readiness, keep serving while the endpoint removal spreads, then wait for
+// in-flight requests to finish. It returns when the pod is drained, which
+// is what a preStop hook wants - SIGTERM only comes after the hook returns:
+//
+//	lifecycle:
+//	  preStop:
+//	    httpGet:
+//	      path: /admin/drain?start=true&settle=5s&timeout=20s
+//	      port: admin
+//
+//	curl -X POST 'localhost:9090/admin/drain?settle=5s'   # the same by hand
+//
+// settle is the time to keep accepting requests after readiness fails
+// (kube-proxy and Ingress controllers see the change a few seconds late);
+// timeout bounds the wait for in-flight requests. Both must fit in
+// terminationGracePeriodSeconds with the shutdown after. httpGet hooks can
+// only GET, hence start=true; a plain GET reports the drain's progress from
+// another terminal. Draining can't be undone: the pod is on its way out.
+//
+// Jobs of at least LONG_TASK_THRESHOLD (30s) also hold the drain: once the
+// requests are done it keeps waiting, in phase waiting_tasks, until those
+// jobs finish or DRAIN_TASK_DEADLINE (2m, ?deadline=) after the drain
+// started, then ends as deadline_passed. Paired with a PodDisruptionBudget,
+// kubectl drain shows both halves of a voluntary disruption: the eviction
+// API refusing pods the budget can't spare, and a pod that is allowed to go
+// holding its node until the work it started is done:
+//
+//	curl -X POST 'localhost:8080/api/jobs?duration=90s'
+//	kubectl drain <node> --ignore-daemonsets
+//	curl localhost:8080/api/drain/status    # the tasks the drain waits for
+//
+// terminationGracePeriodSeconds has to cover the deadline, or the kubelet
+// kills the pod with its jobs first.
+
+// DrainProgress is one sample of in-flight requests during a drain
+type DrainProgress struct {
+	ElapsedMS int64 `json:"elapsed_ms"`
+	InFlight  int64 `json:"in_flight"`
+	LongTasks int   `json:"long_tasks"`
+}
+
+// DrainStatus is returned by /admin/drain
+type DrainStatus struct {
+	Draining  bool            `json:"draining"`
+	Phase     string          `json:"phase"` // idle, settling, waiting, waiting_tasks, drained, timed_out or deadline_passed
+	StartedAt *time.Time      `json:"started_at,omitempty"`
+	InFlight  int64           `json:"in_flight"`
+	LongTasks int             `json:"long_tasks"`
+	Settle    string          `json:"settle,omitempty"`
+	Timeout   string          `json:"timeout,omitempty"`
+	Deadline  *time.Time      `json:"deadline,omitempty"` // when the drain stops waiting for long tasks
+	Progress  []DrainProgress `json:"progress,omitempty"`
+}
+
+// DrainTasksStatus is returned by /api/drain/status
+type DrainTasksStatus struct {
+	Pod       string     `json:"pod"`
+	Draining  bool       `json:"draining"`
+	Phase     string     `json:"phase"`
+	Blocking  bool       `json:"blocking"` // the drain is held by long tasks alone
+	Threshold string     `json:"long_task_threshold"`
+	Deadline  *time.Time `json:"deadline,omitempty"`
+	LongTasks []Job      `json:"long_tasks"`
+}
+
+// drainState is the drain started by /admin/drain, if any
+type drainState struct {
+	srv atomic.Pointer[http.Server] // the app server, to stop keep-alives
+
+	// Set at startup: which jobs count as long tasks, and how long a drain
+	// waits for them by default
+	longTask     time.Duration
+	taskDeadline time.Duration
+
+	mu     sync.Mutex
+	status DrainStatus
+	done   chan struct{}
+}
+
+var drainer = &drainState{status: DrainStatus{Phase: "idle"}, longTask: 30 * time.Second, taskDeadline: 2 * time.Minute}
+
+// Draining reports whether a drain has started, for /ready
+func (d *drainState) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status.Draining
+}
+
+func (d *drainState) snapshot() DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := d.status
+	s.Progress = append([]DrainProgress(nil), d.status.Progress...)
+	if s.Phase == "idle" {
+		s.InFlight = inFlight.Load()
+		s.LongTasks = len(d.longTasks())
+	}
+	return s
+}
+
+// longTasks returns the running jobs a drain waits for
+func (d *drainState) longTasks() []Job {
+	if jobs == nil {
+		return []Job{}
+	}
+	return jobs.LongRunning(d.longTask)
+}
+
+// start begins a drain, or returns false when one is already running
+func (d *drainState) start(settle, timeout, deadline time.Duration, self int64) bool {
+	d.mu.Lock()
+	if d.status.Draining {
+		d.mu.Unlock()
+		return false
+	}
+	now := time.Now()
+	hardDeadline := now.Add(deadline)
+	d.status = DrainStatus{Draining: true, Phase: "settling", StartedAt: &now, InFlight: inFlight.Load() - self,
+		LongTasks: len(d.longTasks()), Settle: settle.String(), Timeout: timeout.String(), Deadline: &hardDeadline}
+	d.done = make(chan struct{})
+	d.mu.Unlock()
+
+	ready.Store(false)
+	slog.Warn("draining: readiness failing, still serving while endpoints update", "settle", settle.String(), "timeout", timeout.String(),
+		"deadline", deadline.String())
+	podEvents.Record("Normal", "DrainStarted", "readiness failing; settle "+settle.String()+", then waiting up to "+timeout.String()+
+		" for in-flight requests and "+deadline.String()+" for long tasks")
+	go d.run(now, settle, timeout, hardDeadline, self)
+	return true
+}
+
+func (d *drainState) run(start time.Time, settle, timeout time.Duration, hardDeadline time.Time, self int64) {
+	defer close(d.done)
+	time.Sleep(settle)
+	if srv := d.srv.Load(); srv != nil {
+		srv.SetKeepAlivesEnabled(false) // clients reconnect, to another pod
+	}
+	d.mu.Lock()
+	d.status.Phase = "waiting"
+	d.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		active := max(inFlight.Load()-self, 0)
+		tasks := len(d.longTasks())
+		d.mu.Lock()
+		d.status.InFlight, d.status.LongTasks = active, tasks
+		if n := len(d.status.Progress); n == 0 || d.status.Progress[n-1].InFlight != active || d.status.Progress[n-1].LongTasks != tasks {
+			d.status.Progress = append(d.status.Progress, DrainProgress{ElapsedMS: time.Since(start).Milliseconds(), InFlight: active, LongTasks: tasks})
+		}
+		now := time.Now()
+		switch {
+		case active == 0 && tasks == 0:
+			d.status.Phase = "drained"
+		case active > 0 && now.After(deadline):
+			d.status.Phase = "timed_out"
+		case now.After(hardDeadline):
+			d.status.Phase = "deadline_passed"
+		case active == 0 && d.status.Phase != "waiting_tasks":
+			d.status.Phase = "waiting_tasks"
+			slog.Info("drain waiting for long tasks", "long_tasks", tasks, "deadline", hardDeadline.Format(time.RFC3339))
+		}
+		phase := d.status.Phase
+		d.mu.Unlock()
+		if phase != "waiting" && phase != "waiting_tasks" {
+			slog.Info("drain finished", "phase", phase, "in_flight", active, "long_tasks", tasks, "after", time.Since(start).Round(time.Millisecond).String())
+			if phase == "deadline_passed" {
+				podEvents.Record("Warning", "DrainDeadline", strconv.Itoa(tasks)+" long tasks still running at the drain deadline")
+			}
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// drainHandler serves /admin/drain. sharedPort is true when admin routes
+// are on the app port, where the drain request itself is in flight.
+func drainHandler(sharedPort bool) http.HandlerFunc {
+	var self int64
+	if sharedPort {
+		self = 1
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := r.Method == http.MethodPost || (r.Method == http.MethodGet && r.URL.Query().Get("start") == "true")
+		switch {
+		case r.Method == http.MethodGet && !start:
+			writeJSON(w, http.StatusOK, drainer.snapshot())
+		case start:
+			settle, timeout, deadline := 5*time.Second, 20*time.Second, drainer.taskDeadline
+			for name, d := range map[string]*time.Duration{"settle": &settle, "timeout": &timeout} {
+				if v := r.URL.Query().Get(name); v != "" {
+					parsed, err := time.ParseDuration(v)
+					if err != nil || parsed < 0 || parsed > 5*time.Minute {
+						writeProblem(w, r, http.StatusBadRequest, name+" must be a Go duration up to 5m")
+						return
+					}
+					*d = parsed
+				}
+			}
+			if v := r.URL.Query().Get("deadline"); v != "" {
+				parsed, err := time.ParseDuration(v)
+				if err != nil || parsed < 0 || parsed > time.Hour {
+					writeProblem(w, r, http.StatusBadRequest, "deadline must be a Go duration up to 1h")
+					return
+				}
+				deadline = parsed
+			}
+			if !drainer.start(settle, timeout, deadline, self) {
+				slog.Info("drain already in progress, waiting for it")
+			}
+			// Hold the hook until the drain ends, however it was started
+			drainer.mu.Lock()
+			done := drainer.done
+			drainer.mu.Unlock()
+			select {
+			case <-done:
+			case <-r.Context().Done():
+				return
+			}
+			writeJSON(w, http.StatusOK, drainer.snapshot())
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeProblem(w, r, http.StatusMethodNotAllowed, "use GET or POST")
+		}
+	}
+}
+
+// drainStatusHandler serves /api/drain/status: the long tasks a drain waits
+// for, on the app port so it can be watched from outside the pod
+func drainStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	hostname, _ := os.Hostname()
+	s := drainer.snapshot()
+	tasks := drainer.longTasks()
+	writeJSON(w, http.StatusOK, DrainTasksStatus{
+		Pod:       hostname,
+		Draining:  s.Draining,
+		Phase:     s.Phase,
+		Blocking:  s.Phase == "waiting_tasks",
+		Threshold: drainer.longTask.String(),
+		Deadline:  s.Deadline,
+		LongTasks: tasks,
+	})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// IPv4, IPv6 and dual-stack listening, for dual-stack cluster lessons:
+//
+//	LISTEN_ADDR=0.0.0.0,::            one IPv4 and one IPv6-only socket on PORT
+//	LISTEN_ADDR=[fd00::12]:8080       one address only
+//	READY_CHECK_DUAL_STACK=true       not ready unless both families work
+//	curl -s -6 'http://[::1]:8080/api/echo' | jq '.client.family, .server'
+//
+// By default the app listens on ":8080", one IPv6 socket that also takes
+// IPv4 connections as IPv4-mapped addresses (::ffff:10.244.0.5); Go prints
+// those as plain IPv4, which hides that the socket is IPv6. /api/echo says
+// so in server.dual_stack_socket. An explicit IPv4 address gets an IPv4
+// socket and an explicit IPv6 one an IPv6-only socket, so LISTEN_ADDR=::
+// alone refuses IPv4 - what a single-stack listener does to half the
+// clients of a dual-stack Service (ipFamilyPolicy: RequireDualStack).
+//
+// The readiness check wants an address of each family on the pod's
+// interfaces and a connection of each family to the app port: a pod in a
+// single-stack cluster, or listening on one family, stays out of the
+// Service.
+
+// listenAddr is one LISTEN_ADDR entry
+type listenAddr struct {
+	network string // tcp4, tcp6, or tcp for both on one socket
+	addr    string
+}
+
+// parseListenAddrs reads LISTEN_ADDR, entries host, [v6host], or either
+// with a port (PORT otherwise). Empty, it is ":"+port.
+func parseListenAddrs(spec, port string) ([]listenAddr, error) {
+	var addrs []listenAddr
+	for _, item := range splitList(spec) {
+		host, p, err := net.SplitHostPort(item)
+		if err != nil {
+			host, p = strings.Trim(item, "[]"), port
+		}
+		network := "tcp"
+		if host != "" {
+			ip := net.ParseIP(host)
+			switch {
+			case ip == nil:
+				return nil, fmt.Errorf("%q: want an IP address, not a name, so the family is clear", item)
+			case ip.To4() != nil:
+				network = "tcp4"
+			default:
+				network = "tcp6"
+			}
+		}
+		addrs = append(addrs, listenAddr{network: network, addr: net.JoinHostPort(host, p)})
+	}
+	if len(addrs) == 0 {
+		addrs = []listenAddr{{network: "tcp", addr: ":" + port}}
+	}
+	return addrs, nil
+}
+
+// listenAddrStrings are addrs for logging, with the network when it's
+// one family
+func listenAddrStrings(addrs []listenAddr) []string {
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.addr
+		if a.network != "tcp" {
+			out[i] = a.network + " " + a.addr
+		}
+	}
+	return out
+}
+
+// families are the IP families a listenAddr accepts
+func (l listenAddr) families() []string {
+	switch l.network {
+	case "tcp4":
+		return []string{"IPv4"}
+	case "tcp6":
+		return []string{"IPv6"}
+	}
+	return []string{"IPv4", "IPv6"}
+}
+
+// dialTarget is where to connect to reach l over family, "" if it can't
+func (l listenAddr) dialTarget(family string) string {
+	if !slices.Contains(l.families(), family) {
+		return ""
+	}
+	host, port, _ := net.SplitHostPort(l.addr)
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+		if family == "IPv6" {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// ipFamily names ip's family; IPv4-mapped IPv6 addresses are IPv4
+func ipFamily(ip net.IP) string {
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// multiListener accepts from several listeners as one, so a single
+// http.Server serves every LISTEN_ADDR
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	errs      chan error
+	closeOnce sync.Once
+}
+
+func newMultiListener(listeners []net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+	m := &multiListener{listeners: listeners, conns: make(chan net.Conn), done: make(chan struct{}), errs: make(chan error)}
+	for _, ln := range listeners {
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					select {
+					case m.errs <- err: // http.Server retries a temporary one
+					case <-m.done:
+					}
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					continue
+				}
+				select {
+				case m.conns <- conn:
+				case <-m.done:
+					conn.Close()
+					return
+				}
+			}
+		}()
+	}
+	return m
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var errs []error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, ln := range m.listeners {
+			errs = append(errs, ln.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Addr is the first listener's
+func (m *multiListener) Addr() net.Addr { return m.listeners[0].Addr() }
+
+// EchoServer is the socket a request came in on
+type EchoServer struct {
+	LocalAddr       string `json:"local_addr"`
+	Family          string `json:"family"`            // of the connection: IPv4, IPv6 or unix
+	DualStackSocket bool   `json:"dual_stack_socket"` // an IPv6 socket carrying IPv4
+}
+
+// echoServer describes r's connection from this end
+func echoServer(r *http.Request) *EchoServer {
+	var local *net.TCPAddr
+	switch addr := r.Context().Value(http.LocalAddrContextKey).(type) {
+	case *net.TCPAddr:
+		local = addr
+	case *net.UnixAddr:
+		return &EchoServer{LocalAddr: addr.Name, Family: "unix"}
+	default:
+		return nil
+	}
+	return &EchoServer{
+		LocalAddr: local.String(),
+		Family:    ipFamily(local.IP),
+		// an IPv4 socket's addresses have 4 bytes, an IPv6 socket's 16
+		DualStackSocket: len(local.IP) == net.IPv6len && local.IP.To4() != nil,
+	}
+}
+
+// remoteFamily is the family of r's client address
+func remoteFamily(r *http.Request) string {
+	if unixPeer(r) != nil {
+		return "unix"
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return ipFamily(net.ParseIP(host))
+}
+
+// dualStackCheck passes when the pod has both families and the app
+// answers on both
+type dualStackCheck struct{ addrs []listenAddr }
+
+func (c dualStackCheck) Name() string { return "dual-stack" }
+
+func (c dualStackCheck) Check(ctx context.Context) error {
+	have := map[string]bool{}
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range ifaddrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.IsGlobalUnicast() {
+			have[ipFamily(n.IP)] = true
+		}
+	}
+	var problems []string
+	for _, family := range []string{"IPv4", "IPv6"} {
+		if !have[family] {
+			problems = append(problems, "no "+family+" address on the pod")
+		}
+		target := ""
+		for _, l := range c.addrs {
+			if target = l.dialTarget(family); target != "" {
+				break
+			}
+		}
+		if target == "" {
+			problems = append(problems, "not listening on "+family)
+			continue
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", target)
+		if err != nil {
+			problems = append(problems, family+" "+target+": "+dialFailure(err))
+			continue
+		}
+		conn.Close()
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"unicode/utf8"
+)
+
+// /api/echo mirrors the request back as the pod received it, after every
+// proxy on the way had its say. Useful to check what an Ingress rewrite
+// left of the path, which X-Forwarded-* headers arrive, or what a mesh
+// sidecar injected:
+//
+//	curl -s http://go-app.local/app/api/echo?x=1 -d 'hello' | jq
+//
+// Any method is accepted. Bodies are cut at maxEchoBody.
+
+const maxEchoBody = 64 << 10
+
+// EchoResponse is returned by /api/echo
+type EchoResponse struct {
+	Method        string              `json:"method"`
+	URL           string              `json:"url"` // as reconstructed from Host and X-Forwarded-Proto
+	Proto         string              `json:"proto"`
+	Protocol      string              `json:"protocol"` // h3, h2, h2c or http/1.1
+	Host          string              `json:"host"`
+	Path          string              `json:"path"`
+	RawQuery      string              `json:"raw_query,omitempty"`
+	Query         map[string][]string `json:"query,omitempty"`
+	Headers       map[string][]string `json:"headers"`
+	ContentLength int64               `json:"content_length"`
+	Body          string              `json:"body,omitempty"`
+	BodyEncoding  string              `json:"body_encoding,omitempty"` // "base64" for non-UTF-8 bodies
+	BodyTruncated bool                `json:"body_truncated,omitempty"`
+	Client        EchoClient          `json:"client"`
+	Server        *EchoServer         `json:"server,omitempty"`
+	TLS           *EchoTLS            `json:"tls,omitempty"`
+	ServedBy      string              `json:"served_by"`
+}
+
+// EchoClient is who sent the request, directly and according to proxies
+type EchoClient struct {
+	RemoteAddr     string    `json:"remote_addr"`         // the last hop: Ingress controller, kube-proxy SNAT or the client
+	Family         string    `json:"family"`              // of remote_addr: IPv4 or IPv6, or unix
+	UnixPeer       *UnixPeer `json:"unix_peer,omitempty"` // the process on a UDS_PATH connection
+	ForwardedFor   string    `json:"forwarded_for,omitempty"`
+	RealIP         string    `json:"real_ip,omitempty"`
+	ForwardedProto string    `json:"forwarded_proto,omitempty"`
+	ForwardedHost  string    `json:"forwarded_host,omitempty"`
+}
+
+// EchoTLS describes the TLS connection, when the pod terminates TLS itself
+type EchoTLS struct {
+	Version     string        `json:"version"`
+	CipherSuite string        `json:"cipher_suite"`
+	ServerName  string        `json:"server_name,omitempty"` // SNI
+	ALPN        string        `json:"alpn,omitempty"`
+	ClientCerts []*ClientCert `json:"client_certificates,omitempty"`
+}
+
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEchoBody+1))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "reading body: "+err.Error())
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	resp := EchoResponse{
+		Method:        r.Method,
+		URL:           scheme + "://" + r.Host + r.RequestURI,
+		Proto:         r.Proto,
+		Protocol:      requestProtocol(r),
+		Host:          r.Host,
+		Path:          r.URL.Path,
+		RawQuery:      r.URL.RawQuery,
+		Query:         r.URL.Query(),
+		Headers:       r.Header,
+		ContentLength: r.ContentLength,
+		Client: EchoClient{
+			RemoteAddr:     r.RemoteAddr,
+			Family:         remoteFamily(r),
+			UnixPeer:       unixPeer(r),
+			ForwardedFor:   r.Header.Get("X-Forwarded-For"),
+			RealIP:         r.Header.Get("X-Real-IP"),
+			ForwardedProto: r.Header.Get("X-Forwarded-Proto"),
+			ForwardedHost:  r.Header.Get("X-Forwarded-Host"),
+		},
+		Server:   echoServer(r),
+		ServedBy: servedBy(),
+	}
+	if len(resp.Query) == 0 {
+		resp.Query = nil
+	}
+	if len(body) > maxEchoBody {
+		body, resp.BodyTruncated = body[:maxEchoBody], true
+	}
+	if utf8.Valid(body) {
+		resp.Body = string(body)
+	} else {
+		resp.Body, resp.BodyEncoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	if r.TLS != nil {
+		resp.TLS = &EchoTLS{
+			Version:     tls.VersionName(r.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+			ServerName:  r.TLS.ServerName,
+			ALPN:        r.TLS.NegotiatedProtocol,
+		}
+		for _, cert := range r.TLS.PeerCertificates {
+			resp.TLS.ClientCerts = append(resp.TLS.ClientCerts, describeCert(cert))
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// Conditional GETs. /api/info, /api/config and /static/ send an ETag, and
+// a request whose If-None-Match still matches gets a bodiless 304:
+//
+//	curl -si localhost:30080/api/config | grep -i etag
+//	curl -si -H 'If-None-Match: "<that value>"' localhost:30080/api/config   # 304
+//
+//	API_CACHE_CONTROL=no-cache                 any cache may keep it, but must revalidate
+//	STATIC_CACHE_CONTROL=public, max-age=3600  assets are reused without asking for an hour
+//
+// /api/info's ETag is weak (W/): it leaves out the timestamp, so two answers
+// from one pod match while nothing else changed. It does cover the
+// hostname, so through a Service a revalidation that lands on another pod
+// gets a 200 with that pod's answer - a CDN or Ingress cache in front sees
+// one URL with as many versions as there are replicas. /api/config only
+// changes when its ConfigMap does, which makes it the one to watch a cache
+// pick up a reload. Compression turns strong ETags weak (compress.go);
+// If-None-Match compares them weakly, so a gzip and a plain copy both match.
+
+// apiCacheControl is what ETagged API responses send; API_CACHE_CONTROL,
+// set in serve
+var apiCacheControl = "no-cache"
+
+// etagOf is a strong ETag for v's JSON
+func etagOf(v any) string {
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// etagMatches is the weak comparison If-None-Match uses (RFC 9110 13.1.2)
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONConditional writes v with etag, or a 304 when the client's
+// copy is still current. Other formats get the format's name in the ETag,
+// as the bytes differ.
+func writeJSONConditional(w http.ResponseWriter, r *http.Request, etag string, v any) {
+	_, hasProto := v.(protoMarshaler)
+	if format := negotiateFormat(r, hasProto); format.name != formatJSON.name {
+		etag = strings.TrimSuffix(etag, `"`) + "-" + format.name + `"`
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", apiCacheControl)
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Add("Vary", "Accept")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeNegotiated(w, r, http.StatusOK, v)
+}
+
+// staticETags hashes every embedded asset once: they can't change while
+// the binary runs, and embed.FS has no modification times for
+// Last-Modified
+func staticETags(assets fs.FS) map[string]string {
+	tags := map[string]string{}
+	fs.WalkDir(assets, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(assets, path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		tags[path] = `"` + hex.EncodeToString(sum[:12]) + `"`
+		return nil
+	})
+	return tags
+}
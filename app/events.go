@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// /events is a Server-Sent Events feed with one event per request this pod
+// serves, for watching traffic spread across replicas during scaling and
+// rollouts without tailing logs. The first event, named "hello", says which
+// pod the stream is attached to. SSE is plain HTTP, so curl works:
+//
+//	curl -N localhost:30080/events
+//
+// In a browser: new EventSource("/events").onmessage = e => console.log(e.data)
+
+// RequestEvent is one served request
+type RequestEvent struct {
+	ID           uint64    `json:"id"` // increasing per pod; /api/requests pages with ?before=
+	Time         time.Time `json:"time"`
+	Pod          string    `json:"pod"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Status       int       `json:"status"`
+	Client       string    `json:"client"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"` // set by Ingress controllers and proxies
+	LatencyMS    float64   `json:"latency_ms"`
+	RequestID    string    `json:"request_id,omitempty"`
+}
+
+// eventSubscriberBuffer is how many events a slow subscriber may fall
+// behind before new ones are dropped for it; the request path never waits
+const eventSubscriberBuffer = 64
+
+// defaultRequestHistory is how many past requests are kept unless
+// REQUEST_HISTORY_SIZE says otherwise
+const defaultRequestHistory = 1000
+
+// eventHub fans request events out to every connected /events client, and
+// keeps the last historySize for /api/requests and /graphql
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan RequestEvent]struct{}
+	historySize int            // set in main before serving
+	history     []RequestEvent // ring of historySize, next at historyNext
+	historyNext int
+	lastID      uint64
+}
+
+// requestEvents is fed by instrument for every routed request
+var requestEvents = &eventHub{subscribers: map[chan RequestEvent]struct{}{}, historySize: defaultRequestHistory}
+
+var eventsDropped = newCounterVec("sse_events_dropped_total",
+	"Request events not delivered to a slow subscriber (/events, the request log).")
+
+// Subscribe registers a new subscriber; call the returned func to leave
+func (h *eventHub) Subscribe() (<-chan RequestEvent, func()) {
+	return h.subscribe(eventSubscriberBuffer)
+}
+
+// subscribe is Subscribe with room for buffer events
+func (h *eventHub) subscribe(buffer int) (<-chan RequestEvent, func()) {
+	ch := make(chan RequestEvent, buffer)
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers, ch)
+		h.mu.Unlock()
+	}
+}
+
+// Publish delivers ev to every subscriber that has room for it
+func (h *eventHub) Publish(ev RequestEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	ev.ID = h.lastID
+	if len(h.history) < h.historySize {
+		h.history = append(h.history, ev)
+	} else {
+		h.history[h.historyNext] = ev
+	}
+	h.historyNext = (h.historyNext + 1) % h.historySize
+	for ch := range h.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			eventsDropped.Inc()
+		}
+	}
+}
+
+// Recent returns up to n past events, newest first
+func (h *eventHub) Recent(n int) []RequestEvent {
+	if n <= 0 {
+		return nil
+	}
+	events := make([]RequestEvent, 0, min(n, h.historySize))
+	h.each(func(ev RequestEvent) bool {
+		events = append(events, ev)
+		return len(events) < n
+	})
+	return events
+}
+
+// each calls fn with past events, newest first, until it returns false
+func (h *eventHub) each(fn func(RequestEvent) bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := 1; i <= len(h.history); i++ {
+		if !fn(h.history[(h.historyNext-i+len(h.history))%len(h.history)]) {
+			return
+		}
+	}
+}
+
+// Clear forgets the past events, returning how many there were. IDs carry
+// on from the last one, so a ?before= cursor stays valid.
+func (h *eventHub) Clear() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := len(h.history)
+	h.history, h.historyNext = nil, 0
+	return n
+}
+
+// Buffered returns how many past events are kept
+func (h *eventHub) Buffered() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.history)
+}
+
+// Len returns the number of subscribers
+func (h *eventHub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+func init() {
+	newGaugeFunc("sse_subscribers", "Clients connected to /events.",
+		func() float64 { return float64(requestEvents.Len()) })
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	rc := http.NewResponseController(w)
+	// The server's WriteTimeout would cut the stream off
+	rc.SetWriteDeadline(time.Time{})
+
+	events, unsubscribe := requestEvents.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx: don't buffer the stream
+	w.WriteHeader(http.StatusOK)
+	hostname, _ := os.Hostname()
+	fmt.Fprintf(w, "retry: 2000\nevent: hello\ndata: {\"pod\":%q}\n\n", hostname)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	slog.Info("sse subscriber connected", "path", "/events", "remote", r.RemoteAddr)
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev := <-events:
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		case <-heartbeat.C:
+			// A comment line keeps idle proxies from closing the connection
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		case <-streamsClosing:
+			// EventSource reconnects after "retry", through the Service
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An A/B experiment: every caller is put in one variant, always the same,
+// by hashing who they are, so any pod gives the same answer without
+// sharing state. Callers are known by a header or, failing that, a cookie
+// handed out on their first request:
+//
+//	EXPERIMENT_NAME=checkout-button EXPERIMENT_VARIANTS=control:50,treatment:50
+//	curl -H 'X-User-ID: alice' localhost:30080/api/experiment           # an exposure
+//	curl -X POST -H 'X-User-ID: alice' localhost:30080/api/experiment/convert
+//	curl localhost:30080/api/experiment/results
+//
+// Each GET counts an exposure and each POST /convert a conversion, in
+// experiment_exposures_total and experiment_conversions_total - the
+// per-variant metrics a Flagger or Argo Rollouts analysis would query -
+// and, with REDIS_ADDR, in Redis, so /results covers every replica rather
+// than the pod that answered. The results compare each variant's
+// conversion rate with the first one's (a two-proportion z-test); the
+// weights move the split between variants, not between Deployments, which
+// is what makes this different from a canary.
+
+// experimentCookie carries the unit ID for callers without the header
+const experimentCookie = "go_app_experiment_unit"
+
+// experimentVariant is one arm and its share of units, in percent
+type experimentVariant struct {
+	name   string
+	weight float64
+}
+
+// experiment is the one running experiment
+type experiment struct {
+	name       string
+	unitHeader string
+	variants   []experimentVariant
+	redis      *redisClient // nil counts per pod
+
+	mu          sync.Mutex
+	exposures   map[string]int64
+	conversions map[string]int64
+}
+
+// ExperimentAssignment is returned by /api/experiment and /convert
+type ExperimentAssignment struct {
+	Experiment string  `json:"experiment"`
+	Variant    string  `json:"variant"`
+	Unit       string  `json:"unit"`
+	UnitSource string  `json:"unit_source"` // header, cookie or new
+	Bucket     float64 `json:"bucket"`      // 0-100, where the unit hashed to
+	Pod        string  `json:"pod"`
+	Converted  bool    `json:"converted,omitempty"`
+}
+
+// VariantResult is one variant's counts in /api/experiment/results
+type VariantResult struct {
+	Name           string   `json:"name"`
+	Weight         float64  `json:"weight_percent"`
+	Exposures      int64    `json:"exposures"`
+	Conversions    int64    `json:"conversions"`
+	ConversionRate float64  `json:"conversion_rate"`
+	Lift           *float64 `json:"lift_percent,omitempty"` // against the control
+	ZScore         *float64 `json:"z_score,omitempty"`
+	PValue         *float64 `json:"p_value,omitempty"`
+}
+
+// ExperimentResults is returned by /api/experiment/results
+type ExperimentResults struct {
+	Experiment string          `json:"experiment"`
+	Scope      string          `json:"scope"` // cluster (Redis) or pod
+	Pod        string          `json:"pod"`
+	Control    string          `json:"control"`
+	Variants   []VariantResult `json:"variants"`
+	Error      string          `json:"error,omitempty"`
+	At         time.Time       `json:"at"`
+}
+
+var (
+	experimentExposures = newCounterVec("experiment_exposures_total",
+		"Units shown an experiment variant (GET /api/experiment).", "experiment", "variant")
+	experimentConversions = newCounterVec("experiment_conversions_total",
+		"Conversions recorded for an experiment variant (POST /api/experiment/convert).", "experiment", "variant")
+)
+
+// currentExperiment is set in main
+var currentExperiment *experiment
+
+// newExperimentFromEnv parses EXPERIMENT_VARIANTS, "name:weight,..."
+func newExperimentFromEnv() (*experiment, error) {
+	e := &experiment{
+		name:        getEnv("EXPERIMENT_NAME", "checkout-button"),
+		unitHeader:  getEnv("EXPERIMENT_UNIT_HEADER", "X-User-ID"),
+		exposures:   map[string]int64{},
+		conversions: map[string]int64{},
+	}
+	if !validTenant.MatchString(e.name) {
+		return nil, fmt.Errorf("EXPERIMENT_NAME %q must be a DNS label", e.name)
+	}
+	var total float64
+	for _, spec := range strings.Split(getEnv("EXPERIMENT_VARIANTS", "control:50,treatment:50"), ",") {
+		name, weight, _ := strings.Cut(strings.TrimSpace(spec), ":")
+		w, err := strconv.ParseFloat(weight, 64)
+		if name == "" || err != nil || w < 0 {
+			return nil, fmt.Errorf("EXPERIMENT_VARIANTS entry %q must look like name:weight", spec)
+		}
+		e.variants = append(e.variants, experimentVariant{name: name, weight: w})
+		total += w
+	}
+	if len(e.variants) < 2 || total <= 0 {
+		return nil, fmt.Errorf("EXPERIMENT_VARIANTS needs two or more variants with weights adding up to more than 0")
+	}
+	for i := range e.variants {
+		e.variants[i].weight *= 100 / total
+		experimentExposures.Add(0, e.name, e.variants[i].name)
+		experimentConversions.Add(0, e.name, e.variants[i].name)
+	}
+	return e, nil
+}
+
+// bucket hashes unit into [0, 100): the same unit always lands in the same
+// place, and a new experiment name reshuffles everyone
+func (e *experiment) bucket(unit string) float64 {
+	sum := sha256.Sum256([]byte(e.name + ":" + unit))
+	return float64(binary.BigEndian.Uint64(sum[:8])%1_000_000) / 10_000
+}
+
+func (e *experiment) assign(bucket float64) string {
+	var upTo float64
+	for _, v := range e.variants {
+		upTo += v.weight
+		if bucket < upTo {
+			return v.name
+		}
+	}
+	return e.variants[len(e.variants)-1].name
+}
+
+// unit identifies the caller: the unit header, the cookie, or a new ID
+// sent back as the cookie
+func (e *experiment) unit(w http.ResponseWriter, r *http.Request) (unit, source string) {
+	if id := strings.TrimSpace(r.Header.Get(e.unitHeader)); id != "" && len(id) <= 128 {
+		return id, "header"
+	}
+	if c, err := r.Cookie(experimentCookie); err == nil && c.Value != "" && len(c.Value) <= 128 {
+		return c.Value, "cookie"
+	}
+	id := randomToken()[:16]
+	http.SetCookie(w, &http.Cookie{
+		Name:     experimentCookie,
+		Value:    id,
+		Path:     "/api/experiment",
+		MaxAge:   int((30 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id, "new"
+}
+
+// count adds one exposure or conversion, in Redis when set and always in
+// this pod's own tally and metrics
+func (e *experiment) count(ctx context.Context, kind, variant string) {
+	e.mu.Lock()
+	if kind == "exposures" {
+		e.exposures[variant]++
+		experimentExposures.Inc(e.name, variant)
+	} else {
+		e.conversions[variant]++
+		experimentConversions.Inc(e.name, variant)
+	}
+	e.mu.Unlock()
+	if e.redis != nil {
+		if _, err := e.redis.Incr(ctx, e.redisKey(kind, variant)); err != nil {
+			slog.Warn("experiment counter unavailable", "experiment", e.name, "error", err)
+		}
+	}
+}
+
+func (e *experiment) redisKey(kind, variant string) string {
+	return "go-demo:experiment:" + e.name + ":" + variant + ":" + kind
+}
+
+// experimentHandler serves GET /api/experiment (kind "exposures") and
+// POST /api/experiment/convert ("conversions")
+func experimentHandler(kind string) http.HandlerFunc {
+	method := http.MethodGet
+	if kind == "conversions" {
+		method = http.MethodPost
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, method) {
+			return
+		}
+		e := currentExperiment
+		hostname, _ := os.Hostname()
+		resp := ExperimentAssignment{Experiment: e.name, Pod: hostname, Converted: kind == "conversions"}
+		resp.Unit, resp.UnitSource = e.unit(w, r)
+		resp.Bucket = e.bucket(resp.Unit)
+		resp.Variant = e.assign(resp.Bucket)
+		e.count(r.Context(), kind, resp.Variant)
+
+		w.Header().Set("X-Experiment-Variant", resp.Variant)
+		w.Header().Set("Cache-Control", "private, no-store") // the answer depends on who asks
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// experimentResultsHandler serves GET /api/experiment/results
+func experimentResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	e := currentExperiment
+	hostname, _ := os.Hostname()
+	resp := ExperimentResults{Experiment: e.name, Scope: "pod", Pod: hostname, Control: e.variants[0].name, At: time.Now().UTC()}
+	resp.Variants = make([]VariantResult, len(e.variants))
+	for i, v := range e.variants {
+		resp.Variants[i] = VariantResult{Name: v.name, Weight: math.Round(v.weight*100) / 100}
+	}
+	if e.redis != nil {
+		resp.Scope = "cluster"
+		for i := range resp.Variants {
+			v := &resp.Variants[i]
+			var err, err2 error
+			v.Exposures, err = e.redis.GetInt(r.Context(), e.redisKey("exposures", v.Name))
+			v.Conversions, err2 = e.redis.GetInt(r.Context(), e.redisKey("conversions", v.Name))
+			if err = cmp.Or(err, err2); err != nil {
+				// This pod's counts are better than none
+				slog.Warn("experiment results unavailable from redis", "experiment", e.name, "error", err)
+				resp.Scope, resp.Error = "pod", "redis: "+err.Error()
+				break
+			}
+		}
+	}
+	if resp.Scope == "pod" {
+		e.mu.Lock()
+		for i := range resp.Variants {
+			resp.Variants[i].Exposures = e.exposures[resp.Variants[i].Name]
+			resp.Variants[i].Conversions = e.conversions[resp.Variants[i].Name]
+		}
+		e.mu.Unlock()
+	}
+	for i := range resp.Variants {
+		if v := &resp.Variants[i]; v.Exposures > 0 {
+			v.ConversionRate = float64(v.Conversions) / float64(v.Exposures)
+		}
+	}
+	for i := 1; i < len(resp.Variants); i++ {
+		compareVariant(&resp.Variants[i], resp.Variants[0])
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// compareVariant fills in v's lift over the control and a two-proportion
+// z-test; left empty until both have exposures to compare
+func compareVariant(v *VariantResult, control VariantResult) {
+	if v.Exposures == 0 || control.Exposures == 0 {
+		return
+	}
+	if control.ConversionRate > 0 {
+		lift := math.Round((v.ConversionRate/control.ConversionRate-1)*10000) / 100
+		v.Lift = &lift
+	}
+	pooled := float64(v.Conversions+control.Conversions) / float64(v.Exposures+control.Exposures)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/float64(v.Exposures) + 1/float64(control.Exposures)))
+	if se == 0 {
+		return
+	}
+	z := (v.ConversionRate - control.ConversionRate) / se
+	p := math.Erfc(math.Abs(z) / math.Sqrt2) // two-sided
+	z, p = math.Round(z*1000)/1000, math.Round(p*10000)/10000
+	v.ZScore, v.PValue = &z, &p
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// /api/fanout calls the app's own Service N times and counts which pods
+// answered, a quantitative view of Service load balancing:
+//
+//	curl 'localhost:8080/api/fanout?requests=50'
+//
+// kube-proxy balances connections, not requests. By default every call
+// uses a new connection so the spread is visible; with ?keepalive=true
+// all calls reuse one connection and land on the same pod, which is why
+// long-lived HTTP/2 or gRPC clients need client-side load balancing.
+
+// defaultFanoutURL is the Service from k8s/service.yaml
+const defaultFanoutURL = "http://go-app-service/api/info"
+
+// FanoutResponse is returned by /api/fanout
+type FanoutResponse struct {
+	Target      string         `json:"target"`
+	Requests    int            `json:"requests"`
+	Concurrency int            `json:"concurrency"`
+	KeepAlive   bool           `json:"keepalive"`
+	Pods        map[string]int `json:"pods"` // hostname -> responses
+	Errors      int            `json:"errors"`
+	LastError   string         `json:"last_error,omitempty"`
+	DurationMS  float64        `json:"duration_ms"`
+	Spread      []FanoutShare  `json:"spread"`
+}
+
+// FanoutShare is one pod's share of the responses
+type FanoutShare struct {
+	Pod     string  `json:"pod"`
+	Color   string  `json:"color,omitempty"` // the pod's pod_color
+	Count   int     `json:"count"`
+	Percent float64 `json:"percent"`
+}
+
+func fanoutHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	requests, concurrency := int64(20), int64(4)
+	var ok bool
+	if q.Get("requests") != "" {
+		if requests, ok = queryInt(w, r, "requests", 1, 1000); !ok {
+			return
+		}
+	}
+	if q.Get("concurrency") != "" {
+		if concurrency, ok = queryInt(w, r, "concurrency", 1, 50); !ok {
+			return
+		}
+	}
+	keepAlive := q.Get("keepalive") == "true"
+	target := getEnv("FANOUT_URL", defaultFanoutURL)
+	if degraded.skip(w, "fanout") {
+		shedDegraded(w, r, "fan-out calls are off")
+		return
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = !keepAlive
+	if keepAlive {
+		transport.MaxConnsPerHost = 1
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: tracingTransport{base: transport}, Timeout: 5 * time.Second}
+
+	resp := FanoutResponse{
+		Target:      target,
+		Requests:    int(requests),
+		Concurrency: int(concurrency),
+		KeepAlive:   keepAlive,
+		Pods:        map[string]int{},
+	}
+	colors := map[string]string{}
+	var mu sync.Mutex
+	jobs := make(chan struct{})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := int64(0); i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				info, err := fanoutCall(r, client, target)
+				mu.Lock()
+				if err != nil {
+					resp.Errors++
+					resp.LastError = err.Error()
+				} else {
+					resp.Pods[info.Hostname]++
+					colors[info.Hostname] = info.PodColor
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := int64(0); i < requests && r.Context().Err() == nil; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	resp.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+
+	for pod, count := range resp.Pods {
+		resp.Spread = append(resp.Spread, FanoutShare{
+			Pod:     pod,
+			Color:   colors[pod],
+			Count:   count,
+			Percent: float64(count) * 100 / float64(requests),
+		})
+	}
+	sort.Slice(resp.Spread, func(i, j int) bool { return resp.Spread[i].Count > resp.Spread[j].Count })
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// fanoutCall fetches target's AppInfo
+func fanoutCall(r *http.Request, client *http.Client, target string) (AppInfo, error) {
+	var info AppInfo
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target, nil)
+	if err != nil {
+		return info, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return info, err
+	}
+	defer res.Body.Close()
+	err = json.NewDecoder(res.Body).Decode(&info)
+	return info, err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// File storage under DATA_DIR for PersistentVolume demos. Mount a PVC at
+// /data and files survive pod restarts and rescheduling; mount an emptyDir
+// (or nothing) and they vanish with the pod.
+//
+//	curl -X PUT --data-binary @notes.txt localhost:8080/api/files/notes.txt
+//	curl localhost:8080/api/files            # list + disk usage
+//	curl localhost:8080/api/files/notes.txt  # download
+//	curl -X DELETE localhost:8080/api/files/notes.txt
+
+// maxFileSize caps uploads so a demo can't fill the volume in one request
+const maxFileSize = 10 << 20
+
+// validFileName allows one path segment, so requests can't escape DATA_DIR
+var validFileName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,127}$`)
+
+// StoredFile describes one file in the data directory
+type StoredFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// DiskUsage is the usage of the filesystem holding DATA_DIR
+type DiskUsage struct {
+	TotalBytes uint64 `json:"total_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	UsedBytes  uint64 `json:"used_bytes"`
+	FilesBytes int64  `json:"files_bytes"` // used by the files listed here
+}
+
+// FilesResponse is returned by the /api/files endpoints
+type FilesResponse struct {
+	Dir string `json:"dir"`
+	// Mounted is true when DATA_DIR is a separate filesystem from the
+	// container root, i.e. a volume is mounted there
+	Mounted bool         `json:"mounted"`
+	File    *StoredFile  `json:"file,omitempty"`
+	Files   []StoredFile `json:"files,omitempty"`
+	Disk    *DiskUsage   `json:"disk,omitempty"`
+}
+
+func dataDir() string {
+	return getEnv("DATA_DIR", "/data")
+}
+
+// filesHandler serves GET /api/files and GET/PUT/DELETE /api/files/{name}
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	dir := dataDir()
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/files"), "/")
+	if name == "" {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+		files, err := listStoredFiles(dir)
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "cannot read data directory: "+err.Error())
+			return
+		}
+		resp := filesResponse(dir, files)
+		resp.Files = files
+		if resp.Files == nil {
+			resp.Files = []StoredFile{}
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	if !validFileName.MatchString(name) {
+		writeProblem(w, r, http.StatusBadRequest, "file name must be one path segment of letters, digits, '.', '_' or '-'")
+		return
+	}
+	path := filepath.Join(dir, name)
+
+	switch r.Method {
+	case http.MethodGet:
+		f, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			writeProblem(w, r, http.StatusNotFound, "no such file")
+			return
+		} else if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			writeProblem(w, r, http.StatusNotFound, "no such file")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, name, info.ModTime(), f)
+
+	case http.MethodPut:
+		file, err := writeStoredFile(dir, name, http.MaxBytesReader(w, r.Body, maxFileSize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, "file larger than 10MiB")
+			return
+		} else if err != nil {
+			slog.Error("file write failed", "file", name, "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, "write failed: "+err.Error())
+			return
+		}
+		slog.Info("file stored", "file", name, "size", file.Size, "dir", dir)
+		files, _ := listStoredFiles(dir)
+		resp := filesResponse(dir, files)
+		resp.File = &file
+		writeJSON(w, http.StatusCreated, resp)
+
+	case http.MethodDelete:
+		err := os.Remove(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			writeProblem(w, r, http.StatusNotFound, "no such file")
+			return
+		} else if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		slog.Info("file deleted", "file", name, "dir", dir)
+		files, _ := listStoredFiles(dir)
+		writeJSON(w, http.StatusOK, filesResponse(dir, files))
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeProblem(w, r, http.StatusMethodNotAllowed, "use GET, PUT or DELETE")
+	}
+}
+
+// writeStoredFile writes to a temp file and renames it into place, so a
+// crash mid-upload never leaves a truncated file behind
+func writeStoredFile(dir, name string, body io.Reader) (StoredFile, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return StoredFile{}, err
+	}
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return StoredFile{}, err
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return StoredFile{}, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return StoredFile{}, err
+	}
+	return StoredFile{Name: name, Size: size, Modified: time.Now().UTC()}, nil
+}
+
+// listStoredFiles lists regular files, skipping in-progress uploads
+func listStoredFiles(dir string) ([]StoredFile, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var files []StoredFile
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, StoredFile{Name: e.Name(), Size: info.Size(), Modified: info.ModTime().UTC()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func filesResponse(dir string, files []StoredFile) FilesResponse {
+	resp := FilesResponse{Dir: dir, Mounted: isMountPoint(dir)}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err == nil {
+		bsize := uint64(st.Bsize)
+		resp.Disk = &DiskUsage{
+			TotalBytes: uint64(st.Blocks) * bsize,
+			FreeBytes:  uint64(st.Bavail) * bsize,
+			UsedBytes:  (uint64(st.Blocks) - uint64(st.Bfree)) * bsize,
+		}
+		for _, f := range files {
+			resp.Disk.FilesBytes += f.Size
+		}
+	}
+	return resp
+}
+
+// isMountPoint reports whether dir lives on a different device than /
+func isMountPoint(dir string) bool {
+	dirInfo, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	rootInfo, err := os.Stat("/")
+	if err != nil {
+		return false
+	}
+	a, ok1 := dirInfo.Sys().(*syscall.Stat_t)
+	b, ok2 := rootInfo.Sys().(*syscall.Stat_t)
+	return ok1 && ok2 && a.Dev != b.Dev
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/config"
+	"github.com/michael-jaquier/kubernetes-learning/app/flags"
+)
+
+// Feature flags from FLAGS_FILE (/etc/config/flags.yaml by default), see
+// app/flags. /api/flags lists them, feature_flag_enabled exports the
+// boolean ones, and a change is logged as it lands.
+
+var (
+	flagReloads = newCounterVec("feature_flag_reloads_total",
+		"Feature flag file reloads by result.", "result")
+	flagEnabledGauge = newGaugeVec("feature_flag_enabled",
+		"Boolean feature flags, 1 when on.", "flag")
+
+	featureFlagStore = flags.NewStore(flags.Hooks{
+		Source:    settingSource,
+		Reloaded:  logFlagReload,
+		Installed: flagsInstalled,
+	},
+		flags.Def{Name: "new_homepage", Default: "false", Bool: true, Description: "Card layout for the homepage info"},
+		flags.Def{Name: "v2_message", Default: "", Description: "Replaces the message in /api/info and on the homepage when set"},
+	)
+)
+
+// featureFlags returns the current flags
+func featureFlags() *flags.Set {
+	return featureFlagStore.Current()
+}
+
+// flagEnabled reports whether a boolean flag is on
+func flagEnabled(name string) bool {
+	return featureFlagStore.Enabled(name)
+}
+
+// flagString returns a string flag, or "" when unset
+func flagString(name string) string {
+	return featureFlagStore.String(name)
+}
+
+// flagsInstalled exports the boolean flags and logs what changed
+func flagsInstalled(old, updated *flags.Set) {
+	for name, flag := range updated.Flags {
+		if flag.Type == "bool" {
+			flagEnabledGauge.Set(boolFloat(flag.Value == "true"), name)
+		}
+		if old != nil && old.Flags[name].Value != flag.Value {
+			slog.Info("feature flag changed", "flag", name, "from", old.Flags[name].Value, "to", flag.Value, "source", flag.Source)
+		}
+	}
+}
+
+func logFlagReload(s *flags.Set, err error) {
+	if err != nil {
+		flagReloads.Inc("error")
+		slog.Error("feature flag reload failed, keeping previous flags", "file", s.File, "error", err)
+		return
+	}
+	flagReloads.Inc("success")
+	slog.Info("feature flags reloaded", "file", s.File, "checksum", s.Checksum)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// watchFlagsFile reloads path on every change, polling every interval
+// where fsnotify can't watch its directory
+func watchFlagsFile(path string, interval time.Duration) {
+	ctx := context.Background()
+	if err := featureFlagStore.Watch(ctx, path); err != nil {
+		slog.Info("flags file not watchable, polling it", "file", path, "interval", interval.String(), "reason", err)
+		config.Poll(ctx, path, interval, func(data []byte) { featureFlagStore.Reload(path, data) })
+	}
+}
+
+// appMessage is the greeting: the v2_message flag when set, else the
+// configured message
+func appMessage() string {
+	if msg := flagString("v2_message"); msg != "" {
+		return msg
+	}
+	return appConfig().Get("message")
+}
+
+// homepageClass is the body class for the new_homepage flag
+func homepageClass() string {
+	if flagEnabled("new_homepage") {
+		return "layout-new"
+	}
+	return ""
+}
+
+func flagsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, featureFlags())
+}
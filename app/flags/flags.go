@@ -0,0 +1,183 @@
+// Package flags holds feature flags, for rolling out behavior with a
+// ConfigMap instead of a new image. Flags live in a YAML file of their
+// own, mounted next to config.yaml, and reload the way app/config does,
+// so flipping one is a `kubectl apply` away:
+//
+//	flags.yaml: |
+//	  new_homepage: true
+//	  v2_message: "Now with flags!"
+//
+// FLAG_<NAME> env vars (FLAG_NEW_HOMEPAGE=true) override the file, and
+// like all env vars only change on restart. Compare the two rollouts.
+package flags
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/config"
+)
+
+// Def is a flag the app checks
+type Def struct {
+	Name        string
+	Default     string
+	Bool        bool
+	Description string
+}
+
+// Flag is one flag's effective value
+type Flag struct {
+	Value       string `json:"value"`
+	Type        string `json:"type"`   // bool or string
+	Source      string `json:"source"` // default, file or env
+	Description string `json:"description,omitempty"`
+}
+
+// Set is one immutable snapshot of all flags
+type Set struct {
+	Flags    map[string]Flag `json:"flags"`
+	File     string          `json:"file"`
+	Checksum string          `json:"checksum,omitempty"`
+	LoadedAt time.Time       `json:"loaded_at"`
+	Error    string          `json:"error,omitempty"` // last reload failure, old values kept
+}
+
+// Hooks connect a Store to the rest of the app; any of them may be nil
+type Hooks struct {
+	// Source names the layer a FLAG_* override came from; "env" when nil
+	Source func(env string) string
+	// Reloaded is told about every reload: the set now current, and err
+	// when the file was rejected and s is the previous one
+	Reloaded func(s *Set, err error)
+	// Installed runs whenever a set becomes current, old nil the first time
+	Installed func(old, updated *Set)
+}
+
+// Store holds the current Set of the defined flags
+type Store struct {
+	defs    []Def
+	hooks   Hooks
+	current atomic.Pointer[Set]
+}
+
+// NewStore returns a store of defs with nothing loaded yet
+func NewStore(hooks Hooks, defs ...Def) *Store {
+	return &Store{defs: defs, hooks: hooks}
+}
+
+// Current returns the current flags, defaults and env when nothing was
+// loaded
+func (s *Store) Current() *Set {
+	if f := s.current.Load(); f != nil {
+		return f
+	}
+	return s.Build("", nil, "")
+}
+
+// Enabled reports whether a boolean flag is on
+func (s *Store) Enabled(name string) bool {
+	return s.Current().Flags[name].Value == "true"
+}
+
+// String returns a string flag, or "" when unset
+func (s *Store) String(name string) string {
+	return s.Current().Flags[name].Value
+}
+
+// Build layers defaults, file values and FLAG_* env overrides. Flags in
+// the file the app doesn't define are kept, typed by their value.
+func (s *Store) Build(path string, file map[string]string, sum string) *Set {
+	f := &Set{Flags: map[string]Flag{}, File: path, Checksum: sum, LoadedAt: time.Now()}
+	for name, value := range file {
+		f.Flags[name] = Flag{Value: value, Type: guessType(value), Source: "file"}
+	}
+	for _, def := range s.defs {
+		flag, ok := f.Flags[def.Name]
+		if !ok {
+			flag = Flag{Value: def.Default, Source: "default"}
+		}
+		env := "FLAG_" + strings.ToUpper(def.Name)
+		if v := os.Getenv(env); v != "" {
+			flag.Value, flag.Source = v, "env"
+			if s.hooks.Source != nil {
+				flag.Source = s.hooks.Source(env)
+			}
+		}
+		flag.Type, flag.Description = "string", def.Description
+		if def.Bool {
+			flag.Type, flag.Value = "bool", strings.ToLower(flag.Value)
+		}
+		f.Flags[def.Name] = flag
+	}
+	return f
+}
+
+// guessType is the type of a flag the app doesn't define
+func guessType(value string) string {
+	if value == "true" || value == "false" {
+		return "bool"
+	}
+	return "string"
+}
+
+func (s *Store) install(f *Set) {
+	old := s.current.Swap(f)
+	if s.hooks.Installed != nil {
+		s.hooks.Installed(old, f)
+	}
+}
+
+// Load reads path (missing is fine) and installs the flags
+func (s *Store) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		s.install(s.Build(path, nil, ""))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	values, err := config.Parse(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	s.install(s.Build(path, values, config.Checksum(data)))
+	return nil
+}
+
+// Reload installs data read from path when its content changed,
+// reporting whether it did. A broken file keeps the previous flags.
+func (s *Store) Reload(path string, data []byte) bool {
+	old := s.Current()
+	sum := config.Checksum(data)
+	if sum == old.Checksum {
+		return false
+	}
+	values, err := config.Parse(data)
+	if err != nil {
+		failed := *old
+		failed.Checksum, failed.Error = sum, err.Error() // don't retry until the file changes again
+		s.current.Store(&failed)
+		if s.hooks.Reloaded != nil {
+			s.hooks.Reloaded(&failed, err)
+		}
+		return false
+	}
+	updated := s.Build(path, values, sum)
+	s.install(updated)
+	if s.hooks.Reloaded != nil {
+		s.hooks.Reloaded(updated, nil)
+	}
+	return true
+}
+
+// Watch reloads path whenever it changes, until ctx is done; the error
+// is for a watch that can't start (see config.Watch)
+func (s *Store) Watch(ctx context.Context, path string) error {
+	return config.Watch(ctx, path, func(data []byte) { s.Reload(path, data) })
+}
@@ -0,0 +1,46 @@
+package flags
+
+import "testing"
+
+func TestStoreLayersAndReload(t *testing.T) {
+	t.Setenv("FLAG_V2_MESSAGE", "from env")
+	var installs, failures int
+	s := NewStore(Hooks{
+		Reloaded: func(_ *Set, err error) {
+			if err != nil {
+				failures++
+			}
+		},
+		Installed: func(old, updated *Set) { installs++ },
+	},
+		Def{Name: "new_homepage", Default: "false", Bool: true},
+		Def{Name: "v2_message"},
+	)
+
+	if s.Enabled("new_homepage") || s.String("v2_message") != "from env" {
+		t.Errorf("before a load: new_homepage %v, v2_message %q; want the default and the env", s.Enabled("new_homepage"), s.String("v2_message"))
+	}
+	if !s.Reload("flags.yaml", []byte("new_homepage: TRUE\nv2_message: from file\nbeta: true\n")) {
+		t.Fatal("reload not installed")
+	}
+	f := s.Current()
+	if !s.Enabled("new_homepage") || f.Flags["new_homepage"].Source != "file" {
+		t.Errorf("new_homepage = %+v, want on from the file", f.Flags["new_homepage"])
+	}
+	if flag := f.Flags["v2_message"]; flag.Value != "from env" || flag.Source != "env" {
+		t.Errorf("v2_message = %+v, want the env override", flag)
+	}
+	if flag := f.Flags["beta"]; flag.Type != "bool" || flag.Source != "file" {
+		t.Errorf("undefined flag beta = %+v, want a bool from the file", flag)
+	}
+
+	if s.Reload("flags.yaml", []byte("new_homepage: [")) {
+		t.Error("a broken file was installed")
+	}
+	if !s.Enabled("new_homepage") || s.Current().Error == "" {
+		t.Error("a broken file didn't keep the previous flags with the error")
+	}
+	if installs != 1 || failures != 1 {
+		t.Errorf("%d installs and %d failures, want 1 and 1", installs, failures)
+	}
+}
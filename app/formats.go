@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Every JSON endpoint can also answer in YAML or XML, picked by Accept or,
+// for a quick look, ?format= (json, yaml, xml, msgpack or protobuf):
+//
+//	curl -s 'localhost:30080/api/config?format=yaml' | yq .values
+//	curl -s -H 'Accept: application/yaml' localhost:30080/api/peers
+//	curl -s -H 'Accept: application/xml' localhost:30080/api/info
+//
+// The fields are the JSON ones, names and order included: the response is
+// encoded as JSON first and converted, so omitempty and custom marshalers
+// behave the same in every format. XML has no arrays, so a list is its
+// elements repeated as <item>, and a key that isn't a valid element name
+// becomes <entry key="...">. Errors stay application/problem+json, and a
+// browser, whose Accept starts with text/html, keeps getting JSON.
+
+var (
+	formatYAML = responseFormat{name: "yaml", contentType: "application/yaml", aliases: []string{"application/x-yaml", "text/yaml", "text/x-yaml"}}
+	formatXML  = responseFormat{name: "xml", contentType: "application/xml", aliases: []string{"text/xml"}}
+
+	// responseFormats are the formats negotiateFormat chooses from, JSON
+	// first so that it wins ties
+	responseFormats = []responseFormat{formatJSON, formatYAML, formatXML, formatMsgpack, formatProtobuf}
+)
+
+// formatWriter carries the request to writeJSON, which has only the writer
+type formatWriter struct {
+	http.ResponseWriter
+	r *http.Request
+}
+
+func (f *formatWriter) Flush() {
+	if fl, ok := f.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+func (f *formatWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(f.ResponseWriter).Hijack()
+}
+
+func (f *formatWriter) Unwrap() http.ResponseWriter { return f.ResponseWriter }
+
+// negotiateFormats lets writeJSON answer in another format when the
+// request asks for one. Requests that don't are left alone.
+func negotiateFormats(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if negotiateFormat(r, true).name != formatJSON.name {
+			w = &formatWriter{ResponseWriter: w, r: r}
+		}
+		next(w, r)
+	}
+}
+
+// orderedObject is a JSON object with its keys in the order they came
+type orderedObject struct {
+	keys   []string
+	values []any
+}
+
+// decodeOrdered turns v's JSON into nested orderedObject, []any,
+// json.Number, string, bool and nil
+func decodeOrdered(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return decodeOrderedValue(dec)
+}
+
+func decodeOrderedValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := &orderedObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.keys = append(obj.keys, key.(string))
+			obj.values = append(obj.values, value)
+		}
+		_, err := dec.Token() // }
+		return obj, err
+	case json.Delim('['):
+		list := []any{}
+		for dec.More() {
+			value, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err := dec.Token() // ]
+		return list, err
+	}
+	return tok, nil
+}
+
+// marshalYAML encodes v as a YAML document
+func marshalYAML(v any) ([]byte, error) {
+	tree, err := decodeOrdered(v)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	switch t := tree.(type) {
+	case *orderedObject:
+		if len(t.keys) == 0 {
+			b.WriteString("{}\n")
+		}
+		appendYAMLObject(&b, t, "", false)
+	case []any:
+		if len(t) == 0 {
+			b.WriteString("[]\n")
+		}
+		appendYAMLList(&b, t, "")
+	default:
+		b.WriteString(yamlValue(t) + "\n")
+	}
+	return b.Bytes(), nil
+}
+
+// appendYAMLObject writes obj's keys at indent; inline means the first
+// one follows a list item's "- " on the same line
+func appendYAMLObject(b *bytes.Buffer, obj *orderedObject, indent string, inline bool) {
+	for i, key := range obj.keys {
+		if i > 0 || !inline {
+			b.WriteString(indent)
+		}
+		b.WriteString(yamlString(key) + ":")
+		switch t := obj.values[i].(type) {
+		case *orderedObject:
+			if len(t.keys) == 0 {
+				b.WriteString(" {}\n")
+				continue
+			}
+			b.WriteString("\n")
+			appendYAMLObject(b, t, indent+"  ", false)
+		case []any:
+			if len(t) == 0 {
+				b.WriteString(" []\n")
+				continue
+			}
+			b.WriteString("\n")
+			appendYAMLList(b, t, indent) // kubectl's style: a list sits at its key's indent
+		default:
+			b.WriteString(" " + yamlValue(t) + "\n")
+		}
+	}
+}
+
+func appendYAMLList(b *bytes.Buffer, list []any, indent string) {
+	for _, item := range list {
+		b.WriteString(indent + "-")
+		switch t := item.(type) {
+		case *orderedObject:
+			if len(t.keys) == 0 {
+				b.WriteString(" {}\n")
+				continue
+			}
+			b.WriteString(" ")
+			appendYAMLObject(b, t, indent+"  ", true)
+		case []any:
+			if len(t) == 0 {
+				b.WriteString(" []\n")
+				continue
+			}
+			b.WriteString("\n")
+			appendYAMLList(b, t, indent+"  ")
+		default:
+			b.WriteString(" " + yamlValue(t) + "\n")
+		}
+	}
+}
+
+// yamlValue is a scalar: null, true, 42, or a string quoted if it must be
+func yamlValue(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(t)
+	case json.Number:
+		return t.String()
+	case string:
+		return yamlString(t)
+	}
+	return "null"
+}
+
+// yamlString leaves s plain when YAML reads it back as the same string,
+// and double-quotes it otherwise: a JSON string is a valid YAML one
+func yamlString(s string) string {
+	plain := s != "" && strings.TrimSpace(s) == s &&
+		!strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`") &&
+		!strings.ContainsAny(s, "\n\r\t") &&
+		!strings.Contains(s, ": ") && !strings.Contains(s, " #") && !strings.HasSuffix(s, ":")
+	switch strings.ToLower(s) {
+	case "null", "~", "true", "false", "yes", "no", "on", "off", "y", "n", ".inf", "-.inf", ".nan":
+		plain = false
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		plain = false // "1.10" is a version, not a number
+	} else if _, err := strconv.ParseInt(s, 0, 64); err == nil {
+		plain = false // 0x1f, 0o17
+	}
+	if plain {
+		return s
+	}
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// validXMLName is a conservative element name: no colons, no leading "xml"
+var validXMLName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// marshalXML encodes v inside a <response> element
+func marshalXML(v any) ([]byte, error) {
+	tree, err := decodeOrdered(v)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	appendXMLElement(&b, "response", tree, "")
+	return b.Bytes(), nil
+}
+
+func appendXMLElement(b *bytes.Buffer, name string, v any, indent string) {
+	open, tag := "<"+name+">", name
+	if !validXMLName.MatchString(name) || strings.HasPrefix(strings.ToLower(name), "xml") {
+		var key bytes.Buffer
+		xml.EscapeText(&key, []byte(name))
+		open, tag = `<entry key="`+strings.ReplaceAll(key.String(), `"`, "&quot;")+`">`, "entry"
+	}
+	switch t := v.(type) {
+	case *orderedObject:
+		b.WriteString(indent + open + "\n")
+		for i, key := range t.keys {
+			appendXMLElement(b, key, t.values[i], indent+"  ")
+		}
+		b.WriteString(indent + "</" + tag + ">\n")
+	case []any:
+		b.WriteString(indent + open + "\n")
+		for _, item := range t {
+			appendXMLElement(b, "item", item, indent+"  ")
+		}
+		b.WriteString(indent + "</" + tag + ">\n")
+	case nil:
+		b.WriteString(indent + strings.TrimSuffix(open, ">") + "/>\n")
+	default:
+		b.WriteString(indent + open)
+		text := yamlValue(t)
+		if s, ok := t.(string); ok {
+			text = s
+		}
+		xml.EscapeText(b, []byte(text))
+		b.WriteString("</" + tag + ">\n")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Every place the app writes, so the container can run with
+// readOnlyRootFilesystem: true and a volume mounted at each path it uses:
+//
+//	DATA_DIR=/data           /api/files, /api/upload, REQUEST_LOG's requests.db
+//	TEMP_DIR=/tmp            temp files (multipart spill-over), set as TMPDIR
+//	RAFT_STATE_DIR           the Raft log, vote and snapshots (KV_RAFT)
+//	ACCESS_LOG_FILE, AUDIT_LOG=<file>, TERMINATION_LOG
+//	curl localhost:8080/api/fs-audit
+//
+// Uploads are already written to a temp file inside DATA_DIR and renamed,
+// so nothing else goes through /tmp unless a library asks os.TempDir. A
+// path the app uses but cannot write is logged at startup; a read-only
+// root with nothing mounted there is the usual cause.
+
+// FSAuditPath is one path the app may write to
+type FSAuditPath struct {
+	Path    string `json:"path"`
+	Purpose string `json:"purpose"`
+	Setting string `json:"setting"`
+	Used    bool   `json:"used"` // false when the feature is off
+	Exists  bool   `json:"exists"`
+	// Writable is probed by creating (and removing) a file in a
+	// directory, or opening a file for append
+	Writable bool   `json:"writable"`
+	Mounted  bool   `json:"mounted"` // on a volume rather than the root filesystem
+	Error    string `json:"error,omitempty"`
+}
+
+// FSAuditResponse is returned by /api/fs-audit
+type FSAuditResponse struct {
+	RootReadOnly bool          `json:"root_read_only"`
+	Paths        []FSAuditPath `json:"paths"`
+	// Problems lists the used paths that cannot be written
+	Problems []string `json:"problems"`
+}
+
+// tempDir is where temp files go; setupTempDir points TMPDIR at it
+func tempDir() string {
+	return getEnv("TEMP_DIR", cmp.Or(os.Getenv("TMPDIR"), "/tmp"))
+}
+
+// setupTempDir makes os.TempDir, and so the standard library's temp
+// files, follow TEMP_DIR
+func setupTempDir() {
+	os.Setenv("TMPDIR", tempDir())
+}
+
+// writablePaths lists what the app writes with the current settings
+func writablePaths() []FSAuditPath {
+	termination, custom := terminationLogPath()
+	// The default file is only written when the kubelet has created it
+	_, err := os.Stat(termination)
+	paths := []FSAuditPath{
+		{Path: dataDir(), Purpose: "files, uploads and the request log", Setting: "DATA_DIR", Used: true},
+		{Path: tempDir(), Purpose: "temp files", Setting: "TEMP_DIR", Used: true},
+		{Path: termination, Purpose: "termination message", Setting: "TERMINATION_LOG", Used: custom || err == nil},
+	}
+	if reqLog != nil {
+		// SQLite writes the database and, beside it, its -wal and -shm
+		// files: the file is probed here, the directory as DATA_DIR
+		paths = append(paths, FSAuditPath{Path: reqLog.path, Purpose: "persistent request log (SQLite)", Setting: "REQUEST_LOG", Used: true})
+	}
+	if dir := getEnv("RAFT_STATE_DIR", ""); dir != "" && getEnvBool("KV_RAFT", false) {
+		paths = append(paths, FSAuditPath{Path: dir, Purpose: "Raft log, vote and snapshots", Setting: "RAFT_STATE_DIR", Used: true})
+	}
+	if path := getEnv("ACCESS_LOG_FILE", ""); path != "" {
+		paths = append(paths, FSAuditPath{Path: path, Purpose: "access log", Setting: "ACCESS_LOG_FILE", Used: true})
+	}
+	if dest := getEnv("AUDIT_LOG", "stderr"); dest != "stderr" && dest != "stdout" {
+		paths = append(paths, FSAuditPath{Path: dest, Purpose: "audit log", Setting: "AUDIT_LOG", Used: true})
+	}
+	for i := range paths {
+		if paths[i].Used {
+			probeWritable(&paths[i])
+		}
+	}
+	return paths
+}
+
+// probeWritable fills in p's Exists, Writable and Mounted
+func probeWritable(p *FSAuditPath) {
+	dir := p.Path
+	info, err := os.Stat(p.Path)
+	switch {
+	case os.IsNotExist(err):
+		// The app creates it on first write: probe the nearest parent
+		for dir = filepath.Dir(dir); dir != "/" && !isDir(dir); dir = filepath.Dir(dir) {
+		}
+	case err != nil:
+		p.Error = err.Error()
+		return
+	default:
+		p.Exists = true
+	}
+	if !p.Exists || info.IsDir() {
+		p.Mounted = isMountPoint(dir)
+		f, err := os.CreateTemp(dir, ".fs-audit-*")
+		if err != nil {
+			p.Error = err.Error()
+			return
+		}
+		f.Close()
+		os.Remove(f.Name())
+	} else {
+		p.Mounted = isMountPoint(filepath.Dir(p.Path))
+		f, err := os.OpenFile(p.Path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			p.Error = err.Error()
+			return
+		}
+		f.Close()
+	}
+	p.Writable = true
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// rootReadOnly reports whether / is mounted read-only
+func rootReadOnly() bool {
+	var st syscall.Statfs_t
+	return syscall.Statfs("/", &st) == nil && st.Flags&0x1 != 0 // ST_RDONLY
+}
+
+func fsAuditProblems(paths []FSAuditPath) []string {
+	problems := []string{}
+	for _, p := range paths {
+		if p.Used && !p.Writable {
+			problems = append(problems, p.Setting+" "+p.Path+": "+cmp.Or(p.Error, "not writable"))
+		}
+	}
+	return problems
+}
+
+// logFSAudit warns at startup about every used path that can't be written
+func logFSAudit() {
+	for _, problem := range fsAuditProblems(writablePaths()) {
+		slog.Warn("path not writable", "problem", problem, "root_read_only", rootReadOnly())
+	}
+}
+
+// fsAuditHandler serves /api/fs-audit
+func fsAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	paths := writablePaths()
+	writeJSON(w, http.StatusOK, FSAuditResponse{RootReadOnly: rootReadOnly(), Paths: paths, Problems: fsAuditProblems(paths)})
+}
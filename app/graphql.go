@@ -0,0 +1,773 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /graphql serves the data behind /api/info, /api/peers, /events and
+// /api/resources through one schema. The client picks the fields, and one
+// query can ask for all four:
+//
+//	curl localhost:8080/graphql -d '{"query":"{ info { pod_name version } requests(last: 5) { method path status } }"}'
+//	curl -G localhost:8080/graphql --data-urlencode 'query={ peers { source peers { name ip ready } } }'
+//
+// The schema is generated from the REST response types, so field names are
+// their json names and the two APIs can't disagree. Introspection works,
+// which is what GraphiQL's docs and completion run on. GraphiQL is served
+// at GET /graphql in a browser with GRAPHIQL=true, the default when
+// APP_ENV=development; it loads from a CDN, GRAPHIQL_CDN_URL overrides it.
+//
+// For Ingress, every query is one POST to one path: path-based routing,
+// caching and per-route metrics all see only /graphql. The
+// graphql_root_fields_total counter shows what the queries asked for.
+
+// gqlMaxDepth bounds selection nesting; introspection's TypeRef fragment
+// is the deepest legitimate query, at about 12
+const gqlMaxDepth = 20
+
+// gqlMaxFields bounds the fields one query resolves, every list item's
+// counted: aliases and fragment spreads can't multiply a short document
+// into a huge response. GraphiQL's introspection query resolves about 800.
+const gqlMaxFields = 10000
+
+// gqlMaxRootFields bounds the root fields one query resolves; each is a
+// real call, like a DNS lookup for peers or a CPU sample for resources
+const gqlMaxRootFields = 10
+
+// maxGraphQLBody limits POST bodies
+const maxGraphQLBody = 1 << 20
+
+var graphqlRootFields = newCounterVec("graphql_root_fields_total",
+	"Top-level fields resolved by /graphql queries.", "field")
+
+// gqlArgument is an argument of a root field
+type gqlArgument struct {
+	name, typ   string // typ is a GraphQL type, like Int or String!
+	def         any    // nil without a default
+	description string
+}
+
+// gqlRootField is a field of the Query type
+type gqlRootField struct {
+	name, description string
+	args              []gqlArgument
+	typ               reflect.Type
+	resolve           func(r *http.Request, args map[string]any) (any, error)
+}
+
+// graphQLRootFields are the queries; each returns a REST response type
+func graphQLRootFields(appName, appVersion string) []gqlRootField {
+	return []gqlRootField{
+		{
+			name: "info", description: "Application and pod info, as /api/info",
+			typ: reflect.TypeOf(AppInfo{}),
+			resolve: func(r *http.Request, _ map[string]any) (any, error) {
+				return newAppInfo(r, appName, appVersion), nil
+			},
+		},
+		{
+			name: "peers", description: "Sibling pods, as /api/peers",
+			typ: reflect.TypeOf(PeersResponse{}),
+			resolve: func(r *http.Request, _ map[string]any) (any, error) {
+				return discoverPeers(r.Context())
+			},
+		},
+		{
+			name: "requests", description: "Requests this pod served, newest first, as streamed by /events",
+			args: []gqlArgument{{name: "last", typ: "Int", def: float64(20), description: "How many, up to REQUEST_HISTORY_SIZE (1000 by default)"}},
+			typ:  reflect.TypeOf([]RequestEvent{}),
+			resolve: func(r *http.Request, args map[string]any) (any, error) {
+				last, ok := args["last"].(float64)
+				if !ok || last < 1 || last > float64(requestEvents.historySize) || last != float64(int(last)) {
+					return nil, fmt.Errorf("last must be an integer from 1 to %d", requestEvents.historySize)
+				}
+				return requestEvents.Recent(int(last)), nil
+			},
+		},
+		{
+			name: "resources", description: "CPU and memory usage from cgroups, as /api/resources",
+			args: []gqlArgument{{name: "window", typ: "String", def: "1s", description: "CPU sampling window, a Go duration from 100ms to 30s"}},
+			typ:  reflect.TypeOf(ResourcesResponse{}),
+			resolve: func(r *http.Request, args map[string]any) (any, error) {
+				s, _ := args["window"].(string)
+				window, err := time.ParseDuration(s)
+				if err != nil || window < 100*time.Millisecond || window > 30*time.Second {
+					return nil, errors.New("window must be a Go duration between 100ms and 30s")
+				}
+				return sampleResources(r.Context(), window)
+			},
+		},
+	}
+}
+
+// Introspection types, resolved by the same reflection as the data. Nil
+// slices come out as null, which the spec wants for fields that don't
+// apply to a kind (fields of a SCALAR).
+
+type introSchema struct {
+	Description      *string          `json:"description"`
+	QueryType        *introType       `json:"queryType"`
+	MutationType     *introType       `json:"mutationType"`
+	SubscriptionType *introType       `json:"subscriptionType"`
+	Types            []*introType     `json:"types"`
+	Directives       []introDirective `json:"directives"`
+}
+
+type introType struct {
+	Kind           string            `json:"kind"`
+	Name           *string           `json:"name"`
+	Description    *string           `json:"description"`
+	SpecifiedByURL *string           `json:"specifiedByURL"`
+	Fields         []introField      `json:"fields"`
+	Interfaces     []*introType      `json:"interfaces"`
+	PossibleTypes  []*introType      `json:"possibleTypes"`
+	EnumValues     []introEnumValue  `json:"enumValues"`
+	InputFields    []introInputValue `json:"inputFields"`
+	OfType         *introType        `json:"ofType"`
+	IsOneOf        *bool             `json:"isOneOf"`
+}
+
+type introField struct {
+	Name              string            `json:"name"`
+	Description       *string           `json:"description"`
+	Args              []introInputValue `json:"args"`
+	Type              *introType        `json:"type"`
+	IsDeprecated      bool              `json:"isDeprecated"`
+	DeprecationReason *string           `json:"deprecationReason"`
+}
+
+type introInputValue struct {
+	Name              string     `json:"name"`
+	Description       *string    `json:"description"`
+	Type              *introType `json:"type"`
+	DefaultValue      *string    `json:"defaultValue"`
+	IsDeprecated      bool       `json:"isDeprecated"`
+	DeprecationReason *string    `json:"deprecationReason"`
+}
+
+type introEnumValue struct {
+	Name              string  `json:"name"`
+	Description       *string `json:"description"`
+	IsDeprecated      bool    `json:"isDeprecated"`
+	DeprecationReason *string `json:"deprecationReason"`
+}
+
+type introDirective struct {
+	Name         string            `json:"name"`
+	Description  *string           `json:"description"`
+	Locations    []string          `json:"locations"`
+	Args         []introInputValue `json:"args"`
+	IsRepeatable bool              `json:"isRepeatable"`
+}
+
+// introTypeNames are the __typename of the introspection types
+var introTypeNames = map[reflect.Type]string{
+	reflect.TypeOf(introSchema{}):     "__Schema",
+	reflect.TypeOf(introType{}):       "__Type",
+	reflect.TypeOf(introField{}):      "__Field",
+	reflect.TypeOf(introInputValue{}): "__InputValue",
+	reflect.TypeOf(introEnumValue{}):  "__EnumValue",
+	reflect.TypeOf(introDirective{}):  "__Directive",
+}
+
+func optString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// gqlStructField is a struct field as a GraphQL field
+type gqlStructField struct {
+	name  string
+	index []int
+	typ   reflect.Type
+}
+
+var gqlFieldCache sync.Map // reflect.Type -> []gqlStructField
+
+// gqlFields lists t's fields by json name, embedded structs flattened as
+// encoding/json does
+func gqlFields(t reflect.Type) []gqlStructField {
+	if cached, ok := gqlFieldCache.Load(t); ok {
+		return cached.([]gqlStructField)
+	}
+	var fields []gqlStructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			for _, inner := range gqlFields(ft) {
+				inner.index = append([]int{i}, inner.index...)
+				fields = append(fields, inner)
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, gqlStructField{name: name, index: []int{i}, typ: f.Type})
+	}
+	gqlFieldCache.Store(t, fields)
+	return fields
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// isGQLObject reports whether t resolves with a selection set
+func isGQLObject(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != timeType && t.Name() != ""
+}
+
+// gqlTypeName is the GraphQL name of struct type t
+func gqlTypeName(t reflect.Type) string {
+	if name, ok := introTypeNames[t]; ok {
+		return name
+	}
+	return t.Name()
+}
+
+// gqlSchema is the executable schema and its introspection
+type gqlSchema struct {
+	root  []gqlRootField
+	intro *introSchema
+	types map[string]*introType
+}
+
+func newGraphQLSchema(appName, appVersion string) *gqlSchema {
+	s := &gqlSchema{root: graphQLRootFields(appName, appVersion), types: map[string]*introType{}}
+	s.intro = &introSchema{Description: optString(appName + " pod data, generated from the REST response types")}
+	for _, name := range []string{"String", "Int", "Float", "Boolean"} {
+		s.named("SCALAR", name, "")
+	}
+	s.named("SCALAR", "JSON", "Free-form JSON: maps and untyped values")
+
+	query := s.named("OBJECT", "Query", "")
+	for _, f := range s.root {
+		field := introField{Name: f.name, Description: optString(f.description), Args: []introInputValue{}, Type: s.typeRef(f.typ)}
+		for _, a := range f.args {
+			arg := introInputValue{Name: a.name, Description: optString(a.description), Type: s.argType(a.typ)}
+			if a.def != nil {
+				literal, _ := json.Marshal(a.def) // scalars print the same in JSON and GraphQL
+				arg.DefaultValue = optString(string(literal))
+			}
+			field.Args = append(field.Args, arg)
+		}
+		query.Fields = append(query.Fields, field)
+	}
+	s.intro.QueryType = query
+
+	ifArg := []introInputValue{{Name: "if", Type: &introType{Kind: "NON_NULL", OfType: s.types["Boolean"]}}}
+	locations := []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"}
+	s.intro.Directives = []introDirective{
+		{Name: "skip", Description: optString("Skips this field or fragment when if is true"), Locations: locations, Args: ifArg},
+		{Name: "include", Description: optString("Includes this field or fragment only when if is true"), Locations: locations, Args: ifArg},
+	}
+	return s
+}
+
+// named registers a named type, or returns the one already registered
+func (s *gqlSchema) named(kind, name, description string) *introType {
+	if t, ok := s.types[name]; ok {
+		return t
+	}
+	t := &introType{Kind: kind, Name: optString(name), Description: optString(description)}
+	if kind == "OBJECT" {
+		t.Interfaces = []*introType{}
+	}
+	s.types[name] = t
+	s.intro.Types = append(s.intro.Types, t)
+	return t
+}
+
+// typeRef maps a Go type to a GraphQL type, registering structs as objects.
+// GraphQL's Int is 32-bit, so 64-bit counters are Floats.
+func (s *gqlSchema) typeRef(t reflect.Type) *introType {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return s.types["String"]
+	case isGQLObject(t):
+		if existing, ok := s.types[t.Name()]; ok {
+			return existing
+		}
+		obj := s.named("OBJECT", t.Name(), "")
+		for _, f := range gqlFields(t) {
+			obj.Fields = append(obj.Fields, introField{Name: f.name, Args: []introInputValue{}, Type: s.typeRef(f.typ)})
+		}
+		return obj
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return s.types["Boolean"]
+	case reflect.String:
+		return s.types["String"]
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return s.types["Int"]
+	case reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return s.types["Float"]
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() != reflect.Uint8 {
+			return &introType{Kind: "LIST", OfType: s.typeRef(t.Elem())}
+		}
+	}
+	return s.types["JSON"]
+}
+
+// argType maps an argument type like String! to its introspection type
+func (s *gqlSchema) argType(typ string) *introType {
+	if name, ok := strings.CutSuffix(typ, "!"); ok {
+		return &introType{Kind: "NON_NULL", OfType: s.argType(name)}
+	}
+	return s.types[typ]
+}
+
+// gqlObject is a response object, keeping the query's field order
+type gqlObject struct {
+	keys   []string
+	values []any
+}
+
+func (o *gqlObject) set(key string, value any) {
+	o.keys, o.values = append(o.keys, key), append(o.values, value)
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(o.values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type gqlError struct {
+	Message   string        `json:"message"`
+	Locations []gqlLocation `json:"locations,omitempty"`
+	Path      []any         `json:"path,omitempty"`
+}
+
+// gqlResponse is the body of every /graphql response; Data is absent when
+// the request failed before execution
+type gqlResponse struct {
+	Data   *gqlObject `json:"data,omitempty"`
+	Errors []gqlError `json:"errors,omitempty"`
+}
+
+// gqlExecutor runs one operation
+type gqlExecutor struct {
+	r      *http.Request
+	schema *gqlSchema
+	doc    *gqlDocument
+	vars   map[string]any
+	errors []gqlError
+	fields int // resolved so far, against gqlMaxFields
+	roots  int // root fields resolved, against gqlMaxRootFields
+}
+
+// fail records a field error; the field's value becomes null
+func (e *gqlExecutor) fail(err error, sel *gqlSelection, path []any) {
+	e.errors = append(e.errors, gqlError{
+		Message:   err.Error(),
+		Locations: []gqlLocation{{sel.line, sel.col}},
+		Path:      append([]any(nil), path...),
+	})
+}
+
+// budget counts one field, and reports false once the query is over
+// gqlMaxFields; the first field over it gets the error
+func (e *gqlExecutor) budget(sel *gqlSelection, path []any) bool {
+	e.fields++
+	if e.fields == gqlMaxFields+1 {
+		e.fail(fmt.Errorf("query resolves more than %d fields", gqlMaxFields), sel, path)
+	}
+	return e.fields <= gqlMaxFields
+}
+
+// included applies @skip and @include
+func (e *gqlExecutor) included(dirs []gqlDirective) (bool, error) {
+	for _, d := range dirs {
+		if d.name != "skip" && d.name != "include" {
+			return false, fmt.Errorf("unknown directive @%s", d.name)
+		}
+		cond, ok := d.args["if"]
+		if !ok {
+			return false, fmt.Errorf("@%s needs an if argument", d.name)
+		}
+		v, _ := cond.resolve(e.vars).(bool)
+		if v == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// fieldGroup is the selections for one response key, merged
+type fieldGroup struct {
+	key  string
+	sels []*gqlSelection
+}
+
+// collectFields expands fragments into the fields selected on typeName
+func (e *gqlExecutor) collectFields(typeName string, sels []*gqlSelection, visited map[string]bool, groups *[]fieldGroup) {
+	for _, sel := range sels {
+		ok, err := e.included(sel.directives)
+		if err != nil {
+			e.fail(err, sel, nil)
+		}
+		if !ok {
+			continue
+		}
+		switch {
+		case sel.spread != "":
+			f, found := e.doc.fragments[sel.spread]
+			if !found {
+				e.fail(fmt.Errorf("unknown fragment %q", sel.spread), sel, nil)
+				continue
+			}
+			if visited[f.name] || f.typeCond != typeName {
+				continue
+			}
+			visited[f.name] = true
+			e.collectFields(typeName, f.selections, visited, groups)
+		case sel.inline:
+			if sel.typeCond == "" || sel.typeCond == typeName {
+				e.collectFields(typeName, sel.selections, visited, groups)
+			}
+		default:
+			key := sel.responseKey()
+			i := 0
+			for i < len(*groups) && (*groups)[i].key != key {
+				i++
+			}
+			if i == len(*groups) {
+				*groups = append(*groups, fieldGroup{key: key})
+			}
+			(*groups)[i].sels = append((*groups)[i].sels, sel)
+		}
+	}
+}
+
+// subSelections merges the selection sets of a field group
+func subSelections(g fieldGroup) []*gqlSelection {
+	var sels []*gqlSelection
+	for _, sel := range g.sels {
+		sels = append(sels, sel.selections...)
+	}
+	return sels
+}
+
+func (e *gqlExecutor) executeQuery(sels []*gqlSelection) *gqlObject {
+	var groups []fieldGroup
+	e.collectFields("Query", sels, map[string]bool{}, &groups)
+	data := &gqlObject{}
+	for _, g := range groups {
+		sel, path := g.sels[0], []any{g.key}
+		if !e.budget(sel, path) {
+			data.set(g.key, nil)
+			continue
+		}
+		var value any
+		var err error
+		switch sel.name {
+		case "__typename":
+			value = "Query"
+		case "__schema":
+			value, err = e.complete(reflect.ValueOf(e.schema.intro), subSelections(g), path, 1)
+		case "__type":
+			name, _ := sel.args["name"].resolve(e.vars).(string)
+			value, err = e.complete(reflect.ValueOf(e.schema.types[name]), subSelections(g), path, 1)
+		default:
+			value, err = e.resolveRoot(sel, subSelections(g), path)
+		}
+		if err != nil {
+			e.fail(err, sel, path)
+			value = nil
+		}
+		data.set(g.key, value)
+	}
+	return data
+}
+
+func (e *gqlExecutor) resolveRoot(sel *gqlSelection, sels []*gqlSelection, path []any) (any, error) {
+	var field *gqlRootField
+	for i := range e.schema.root {
+		if e.schema.root[i].name == sel.name {
+			field = &e.schema.root[i]
+		}
+	}
+	if field == nil {
+		return nil, fmt.Errorf("cannot query field %q on type \"Query\"", sel.name)
+	}
+	if e.roots++; e.roots > gqlMaxRootFields {
+		return nil, fmt.Errorf("query resolves more than %d root fields", gqlMaxRootFields)
+	}
+	args := map[string]any{}
+	for _, a := range field.args {
+		args[a.name] = a.def
+		if v, ok := sel.args[a.name]; ok {
+			args[a.name] = v.resolve(e.vars)
+		}
+	}
+	for name := range sel.args {
+		if _, ok := args[name]; !ok {
+			return nil, fmt.Errorf("unknown argument %q on field \"Query.%s\"", name, sel.name)
+		}
+	}
+	graphqlRootFields.Inc(field.name)
+	result, err := field.resolve(e.r, args)
+	if err != nil {
+		return nil, err
+	}
+	return e.complete(reflect.ValueOf(result), sels, path, 1)
+}
+
+// complete shapes v by the selection set: objects keep only the selected
+// fields, lists complete each item, scalars marshal as encoding/json does
+func (e *gqlExecutor) complete(v reflect.Value, sels []*gqlSelection, path []any, depth int) (any, error) {
+	if depth > gqlMaxDepth {
+		return nil, fmt.Errorf("query is nested more than %d levels deep", gqlMaxDepth)
+	}
+	for v.IsValid() && (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil, nil
+	}
+	t := v.Type()
+	switch {
+	case isGQLObject(t):
+		if len(sels) == 0 {
+			return nil, fmt.Errorf("field of type %q must have a selection of subfields", gqlTypeName(t))
+		}
+		return e.executeObject(v, sels, path, depth), nil
+	case (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && t.Elem().Kind() != reflect.Uint8:
+		if t.Kind() == reflect.Slice && v.IsNil() {
+			return nil, nil
+		}
+		items := make([]any, v.Len())
+		for i := range items {
+			item, err := e.complete(v.Index(i), sels, append(path, i), depth)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	if len(sels) > 0 {
+		return nil, errors.New("field of a scalar type has no subfields to select")
+	}
+	return v.Interface(), nil
+}
+
+func (e *gqlExecutor) executeObject(v reflect.Value, sels []*gqlSelection, path []any, depth int) *gqlObject {
+	typeName := gqlTypeName(v.Type())
+	var groups []fieldGroup
+	e.collectFields(typeName, sels, map[string]bool{}, &groups)
+	obj := &gqlObject{}
+	for _, g := range groups {
+		sel, fieldPath := g.sels[0], append(append([]any(nil), path...), g.key)
+		if !e.budget(sel, fieldPath) {
+			obj.set(g.key, nil)
+			continue
+		}
+		if sel.name == "__typename" {
+			obj.set(g.key, typeName)
+			continue
+		}
+		value, err := e.resolveField(v, typeName, sel, subSelections(g), fieldPath, depth)
+		if err != nil {
+			e.fail(err, sel, fieldPath)
+			value = nil
+		}
+		obj.set(g.key, value)
+	}
+	return obj
+}
+
+func (e *gqlExecutor) resolveField(v reflect.Value, typeName string, sel *gqlSelection, sels []*gqlSelection, path []any, depth int) (any, error) {
+	// introspection fields take includeDeprecated, which changes nothing here
+	if len(sel.args) > 0 && !strings.HasPrefix(typeName, "__") {
+		return nil, fmt.Errorf("field \"%s.%s\" takes no arguments", typeName, sel.name)
+	}
+	for _, f := range gqlFields(v.Type()) {
+		if f.name != sel.name {
+			continue
+		}
+		fv, err := v.FieldByIndexErr(f.index)
+		if err != nil { // through a nil embedded pointer
+			return nil, nil
+		}
+		return e.complete(fv, sels, path, depth+1)
+	}
+	return nil, fmt.Errorf("cannot query field %q on type %q", sel.name, typeName)
+}
+
+// graphQLRequest is the GraphQL-over-HTTP request, from a JSON body or
+// the query string
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables"`
+	OperationName string         `json:"operationName"`
+}
+
+// execute runs req, returning the HTTP status: 400 when the document
+// can't run at all, else 200 with any field errors in the body
+func (s *gqlSchema) execute(r *http.Request, req graphQLRequest) (gqlResponse, int) {
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		gerr := gqlError{Message: err.Error()}
+		var syntax *gqlSyntaxError
+		if errors.As(err, &syntax) {
+			gerr.Locations = []gqlLocation{{syntax.line, syntax.col}}
+		}
+		return gqlResponse{Errors: []gqlError{gerr}}, http.StatusBadRequest
+	}
+	var op *gqlOperation
+	for _, candidate := range doc.operations {
+		if candidate.name == req.OperationName || req.OperationName == "" && len(doc.operations) == 1 {
+			op = candidate
+		}
+	}
+	switch {
+	case op == nil && req.OperationName == "":
+		return graphQLFailure("operationName is required for a document with several operations"), http.StatusBadRequest
+	case op == nil:
+		return graphQLFailure(fmt.Sprintf("no operation named %q", req.OperationName)), http.StatusBadRequest
+	case op.kind != "query":
+		return graphQLFailure("only queries are supported: this schema has no " + op.kind + " type"), http.StatusBadRequest
+	}
+
+	vars := map[string]any{}
+	for _, d := range op.vars {
+		if v, ok := req.Variables[d.name]; ok {
+			vars[d.name] = v
+		} else if d.def != nil {
+			vars[d.name] = d.def.resolve(nil)
+		}
+	}
+	e := &gqlExecutor{r: r, schema: s, doc: doc, vars: vars}
+	data := e.executeQuery(op.selections)
+	return gqlResponse{Data: data, Errors: e.errors}, http.StatusOK
+}
+
+func graphQLFailure(msg string) gqlResponse {
+	return gqlResponse{Errors: []gqlError{{Message: msg}}}
+}
+
+// graphiQLDefaultQuery is the first query GraphiQL shows
+const graphiQLDefaultQuery = `# Ctrl-Enter runs the query; Ctrl-Space completes fields.
+{
+  info {
+    pod_name
+    version
+    node
+  }
+  requests(last: 5) {
+    time
+    method
+    path
+    status
+    latency_ms
+  }
+}
+`
+
+// GraphiQLPage is the data for templates/graphiql.html
+type GraphiQLPage struct {
+	AppName      string
+	CDN          string
+	DefaultQuery string
+}
+
+// graphQLHandler serves /graphql: GET ?query=&variables=&operationName=,
+// or POST a JSON body (application/graphql bodies are the bare query)
+func graphQLHandler(pages *template.Template, appName, appVersion string) http.HandlerFunc {
+	schema := newGraphQLSchema(appName, appVersion)
+	graphiql := getEnvBool("GRAPHIQL", strings.HasPrefix(getEnv("APP_ENV", ""), "dev"))
+	cdn := strings.TrimRight(getEnv("GRAPHIQL_CDN_URL", "https://unpkg.com"), "/")
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req graphQLRequest
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			if q.Get("query") == "" && graphiql && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				renderPage(w, r, pages, "graphiql.html", GraphiQLPage{AppName: appName, CDN: cdn, DefaultQuery: graphiQLDefaultQuery})
+				return
+			}
+			req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+			if v := q.Get("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+					writeJSON(w, http.StatusBadRequest, graphQLFailure("variables must be a JSON object: "+err.Error()))
+					return
+				}
+			}
+		case http.MethodPost:
+			body := http.MaxBytesReader(w, r.Body, maxGraphQLBody)
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/graphql" {
+				query, err := io.ReadAll(body)
+				if err != nil {
+					writeJSON(w, http.StatusBadRequest, graphQLFailure("reading body: "+err.Error()))
+					return
+				}
+				req.Query = string(query)
+			} else if err := json.NewDecoder(body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, graphQLFailure(`body must be JSON like {"query": "{ info { version } }"}: `+err.Error()))
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSON(w, http.StatusMethodNotAllowed, graphQLFailure("use GET or POST"))
+			return
+		}
+		if strings.TrimSpace(req.Query) == "" {
+			writeJSON(w, http.StatusBadRequest, graphQLFailure("query is required"))
+			return
+		}
+		resp, status := schema.execute(r, req)
+		writeJSON(w, status, resp)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// gqlTestNode nests as deep as a test needs
+type gqlTestNode struct {
+	Name     string         `json:"name"`
+	Child    *gqlTestNode   `json:"child"`
+	Children []*gqlTestNode `json:"children"`
+}
+
+// testGraphQLSchema has one root field, nodes, returning roots
+func testGraphQLSchema(roots []*gqlTestNode) *gqlSchema {
+	return &gqlSchema{root: []gqlRootField{{
+		name: "nodes",
+		typ:  reflect.TypeOf(roots),
+		resolve: func(*http.Request, map[string]any) (any, error) {
+			return roots, nil
+		},
+	}}}
+}
+
+func runGraphQL(t *testing.T, s *gqlSchema, query string) gqlResponse {
+	t.Helper()
+	resp, status := s.execute(httptest.NewRequest(http.MethodPost, "/graphql", nil), graphQLRequest{Query: query})
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, errors %v", status, resp.Errors)
+	}
+	return resp
+}
+
+func hasGraphQLError(resp gqlResponse, msg string) bool {
+	for _, e := range resp.Errors {
+		if strings.Contains(e.Message, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGraphQLDepthLimit(t *testing.T) {
+	root := &gqlTestNode{Name: "0"}
+	for n, i := root, 1; i < 2*gqlMaxDepth; i++ {
+		n.Child = &gqlTestNode{Name: "deeper"}
+		n = n.Child
+	}
+	s := testGraphQLSchema([]*gqlTestNode{root})
+	// levels fields, each selected inside the one before
+	nested := func(levels int) string {
+		return "{ nodes " + strings.Repeat("{ child ", levels-2) + "{ name }" + strings.Repeat(" }", levels-2) + " }"
+	}
+
+	if resp := runGraphQL(t, s, nested(gqlMaxDepth)); len(resp.Errors) != 0 {
+		t.Errorf("%d levels: errors %v, want none", gqlMaxDepth, resp.Errors)
+	}
+	if resp := runGraphQL(t, s, nested(gqlMaxDepth+1)); !hasGraphQLError(resp, "nested more than") {
+		t.Errorf("%d levels: errors %v, want the depth limit", gqlMaxDepth+1, resp.Errors)
+	}
+	// Fragments don't get around it, nor recurse forever
+	cyclic := "{ nodes { ...F } } fragment F on gqlTestNode { name child { ...F } }"
+	if resp := runGraphQL(t, s, cyclic); !hasGraphQLError(resp, "nested more than") {
+		t.Errorf("self-referencing fragment: errors %v, want the depth limit", resp.Errors)
+	}
+}
+
+func TestGraphQLFieldLimit(t *testing.T) {
+	// 200 nodes of 200 children: a short query asks for 40,000 names
+	roots := make([]*gqlTestNode, 200)
+	for i := range roots {
+		roots[i] = &gqlTestNode{Name: "root", Children: make([]*gqlTestNode, 200)}
+		for j := range roots[i].Children {
+			roots[i].Children[j] = &gqlTestNode{Name: "leaf"}
+		}
+	}
+	s := testGraphQLSchema(roots)
+
+	resp := runGraphQL(t, s, "{ nodes { children { name } } }")
+	if !hasGraphQLError(resp, fmt.Sprintf("more than %d fields", gqlMaxFields)) {
+		t.Fatalf("errors %v, want the field limit", resp.Errors)
+	}
+	if n := len(resp.Errors); n != 1 {
+		t.Errorf("got %d errors, want the limit reported once", n)
+	}
+	if resp := runGraphQL(t, s, "{ nodes { name } }"); len(resp.Errors) != 0 {
+		t.Errorf("400 fields: errors %v, want none", resp.Errors)
+	}
+
+	// Aliases multiply the root field instead
+	var aliased strings.Builder
+	aliased.WriteString("{")
+	for i := range gqlMaxRootFields + 1 {
+		aliased.WriteString(" a" + strings.Repeat("x", i) + ": nodes { name }")
+	}
+	aliased.WriteString(" }")
+	if resp := runGraphQL(t, s, aliased.String()); !hasGraphQLError(resp, "root fields") {
+		t.Errorf("%d aliased root fields: errors %v, want the root field limit", gqlMaxRootFields+1, resp.Errors)
+	}
+}
+
+// graphiQLIntrospection is the query GraphiQL sends to load the schema
+const graphiQLIntrospection = `
+query IntrospectionQuery {
+  __schema {
+    queryType { name } mutationType { name } subscriptionType { name }
+    types { ...FullType }
+    directives { name description locations args { ...InputValue } }
+  }
+}
+fragment FullType on __Type {
+  kind name description
+  fields(includeDeprecated: true) { name description args { ...InputValue } type { ...TypeRef } isDeprecated deprecationReason }
+  inputFields { ...InputValue }
+  interfaces { ...TypeRef }
+  enumValues(includeDeprecated: true) { name description isDeprecated deprecationReason }
+  possibleTypes { ...TypeRef }
+}
+fragment InputValue on __InputValue { name description type { ...TypeRef } defaultValue }
+fragment TypeRef on __Type {
+  kind name
+  ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name } } } } } } }
+}`
+
+func TestGraphQLIntrospectionFitsTheLimits(t *testing.T) {
+	resp := runGraphQL(t, newGraphQLSchema("test", "1.0.0"), graphiQLIntrospection)
+	if len(resp.Errors) != 0 {
+		t.Fatalf("errors %v, want GraphiQL's introspection to run", resp.Errors)
+	}
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A small GraphQL parser, enough for /graphql: queries with aliases,
+// arguments, variables, fragments, inline fragments and @skip/@include.
+// Type definitions (SDL) are not parsed; the schema comes from Go types.
+// See graphql.go.
+
+// gqlDocument is a parsed request document
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind       string // query, mutation or subscription
+	name       string
+	vars       []gqlVarDef
+	selections []*gqlSelection
+}
+
+type gqlVarDef struct {
+	name string
+	def  *gqlValue // nil without a default
+}
+
+type gqlFragment struct {
+	name       string
+	typeCond   string
+	selections []*gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread (spread set) or an inline
+// fragment (inline set)
+type gqlSelection struct {
+	alias, name string
+	args        map[string]*gqlValue
+	directives  []gqlDirective
+	selections  []*gqlSelection
+	spread      string
+	inline      bool
+	typeCond    string
+	line, col   int
+}
+
+func (s *gqlSelection) responseKey() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]*gqlValue
+}
+
+// gqlValue is a literal or $variable in a document
+type gqlValue struct {
+	kind   string // variable, int, float, string, boolean, null, enum, list, object
+	raw    string
+	list   []*gqlValue
+	fields map[string]*gqlValue
+}
+
+// resolve turns v into a Go value, like encoding/json would decode it
+func (v *gqlValue) resolve(vars map[string]any) any {
+	switch v.kind {
+	case "variable":
+		return vars[v.raw]
+	case "int":
+		n, _ := strconv.ParseInt(v.raw, 10, 64)
+		return float64(n)
+	case "float":
+		f, _ := strconv.ParseFloat(v.raw, 64)
+		return f
+	case "boolean":
+		return v.raw == "true"
+	case "null":
+		return nil
+	case "list":
+		list := make([]any, len(v.list))
+		for i, item := range v.list {
+			list[i] = item.resolve(vars)
+		}
+		return list
+	case "object":
+		obj := map[string]any{}
+		for k, item := range v.fields {
+			obj[k] = item.resolve(vars)
+		}
+		return obj
+	}
+	return v.raw // string, enum
+}
+
+type gqlToken struct {
+	kind      string // name, int, float, string, punct, eof
+	val       string
+	line, col int
+}
+
+// gqlSyntaxError carries the position for the response's locations
+type gqlSyntaxError struct {
+	msg       string
+	line, col int
+}
+
+func (e *gqlSyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %d:%d: %s", e.line, e.col, e.msg)
+}
+
+// lexGraphQL splits src into tokens, dropping whitespace, commas and comments
+func lexGraphQL(src string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	line, lineStart := 1, 0
+	for i := 0; i < len(src); {
+		c := src[i]
+		col := i - lineStart + 1
+		switch {
+		case c == '\n':
+			i++
+			line, lineStart = line+1, i
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "\uFEFF"): // byte order mark
+			i += len("\uFEFF")
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{"punct", "...", line, col})
+			i += 3
+		case strings.ContainsRune("!$&():=@[]{}|", rune(c)):
+			tokens = append(tokens, gqlToken{"punct", string(c), line, col})
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, gqlToken{"name", src[i:j], line, col})
+			i = j
+		case c == '-' || c >= '0' && c <= '9':
+			j, kind := i+1, "int"
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || strings.IndexByte(".eE+-", src[j]) >= 0) {
+				if strings.IndexByte(".eE", src[j]) >= 0 {
+					kind = "float"
+				}
+				j++
+			}
+			if _, err := strconv.ParseFloat(src[i:j], 64); err != nil {
+				return nil, &gqlSyntaxError{"invalid number " + strconv.Quote(src[i:j]), line, col}
+			}
+			tokens = append(tokens, gqlToken{kind, src[i:j], line, col})
+			i = j
+		case strings.HasPrefix(src[i:], `"""`):
+			end := strings.Index(src[i+3:], `"""`)
+			if end < 0 {
+				return nil, &gqlSyntaxError{"unterminated block string", line, col}
+			}
+			block := src[i+3 : i+3+end]
+			tokens = append(tokens, gqlToken{"string", strings.TrimSpace(block), line, col})
+			if nl := strings.LastIndexByte(block, '\n'); nl >= 0 {
+				line, lineStart = line+strings.Count(block, "\n"), i+3+nl+1
+			}
+			i += end + 6
+		case c == '"':
+			s, n, err := lexGraphQLString(src[i:])
+			if err != nil {
+				return nil, &gqlSyntaxError{err.Error(), line, col}
+			}
+			tokens = append(tokens, gqlToken{"string", s, line, col})
+			i += n
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, &gqlSyntaxError{"unexpected character " + strconv.QuoteRune(r), line, col}
+		}
+	}
+	return append(tokens, gqlToken{kind: "eof", line: line, col: len(src) - lineStart + 1}), nil
+}
+
+// lexGraphQLString reads a quoted string, returning it and its length in src
+func lexGraphQLString(src string) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		switch c := src[i]; c {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\n':
+			return "", 0, fmt.Errorf("unterminated string")
+		case '\\':
+			if i+1 >= len(src) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			i++
+			switch e := src[i]; e {
+			case '"', '\\', '/':
+				b.WriteByte(e)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if i+4 >= len(src) {
+					return "", 0, fmt.Errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(src[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid unicode escape")
+				}
+				b.WriteRune(rune(r))
+				i += 4
+			default:
+				return "", 0, fmt.Errorf("invalid escape \\%c", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// gqlMaxNesting bounds how deep selection sets, list and object values
+// and list types nest in a document, so a body of a million "{" can't
+// recurse the parser that deep; execution has its own gqlMaxDepth
+const gqlMaxNesting = 64
+
+// gqlParser is a recursive-descent parser over the tokens
+type gqlParser struct {
+	tokens []gqlToken
+	pos    int
+	depth  int // nesting, against gqlMaxNesting
+}
+
+// parseGraphQL parses an executable document
+func parseGraphQL(src string) (*gqlDocument, error) {
+	tokens, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	doc := &gqlDocument{fragments: map[string]*gqlFragment{}}
+	for p.peek().kind != "eof" {
+		t := p.peek()
+		switch {
+		case t.kind == "punct" && t.val == "{":
+			sels, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: sels})
+		case t.kind == "name" && (t.val == "query" || t.val == "mutation" || t.val == "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case t.kind == "name" && t.val == "fragment":
+			f, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := doc.fragments[f.name]; dup {
+				return nil, &gqlSyntaxError{"duplicate fragment " + f.name, t.line, t.col}
+			}
+			doc.fragments[f.name] = f
+		default:
+			return nil, p.unexpected(t)
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, &gqlSyntaxError{"document has no operation", 1, 1}
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) peek() gqlToken { return p.tokens[p.pos] }
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+// nest enters one level of nesting at t; call the returned func to leave it
+func (p *gqlParser) nest(t gqlToken) (func(), error) {
+	if p.depth++; p.depth > gqlMaxNesting {
+		return nil, &gqlSyntaxError{fmt.Sprintf("nested more than %d levels deep", gqlMaxNesting), t.line, t.col}
+	}
+	return func() { p.depth-- }, nil
+}
+
+func (p *gqlParser) unexpected(t gqlToken) error {
+	if t.kind == "eof" {
+		return &gqlSyntaxError{"unexpected end of document", t.line, t.col}
+	}
+	return &gqlSyntaxError{"unexpected " + strconv.Quote(t.val), t.line, t.col}
+}
+
+// isPunct reports whether the next token is punctuator s
+func (p *gqlParser) isPunct(s string) bool {
+	t := p.peek()
+	return t.kind == "punct" && t.val == s
+}
+
+func (p *gqlParser) expect(s string) error {
+	if !p.isPunct(s) {
+		return p.unexpected(p.peek())
+	}
+	p.next()
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	t := p.next()
+	if t.kind != "name" {
+		return "", p.unexpected(t)
+	}
+	return t.val, nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.next().val}
+	if p.peek().kind == "name" {
+		op.name = p.next().val
+	}
+	if p.isPunct("(") {
+		p.next()
+		for !p.isPunct(")") {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if err := p.typeRef(); err != nil {
+				return nil, err
+			}
+			def := gqlVarDef{name: name}
+			if p.isPunct("=") {
+				p.next()
+				if def.def, err = p.value(true); err != nil {
+					return nil, err
+				}
+			}
+			op.vars = append(op.vars, def)
+		}
+		p.next()
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+// typeRef skips a variable's type, like [String!]!; coercion is left to
+// the resolvers
+func (p *gqlParser) typeRef() error {
+	if p.isPunct("[") {
+		leave, err := p.nest(p.next())
+		if err != nil {
+			return err
+		}
+		defer leave()
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.isPunct("!") {
+		p.next()
+	}
+	return nil
+}
+
+func (p *gqlParser) fragment() (*gqlFragment, error) {
+	p.next() // fragment
+	f := &gqlFragment{}
+	var err error
+	if f.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if on, err := p.name(); err != nil || on != "on" {
+		return nil, &gqlSyntaxError{"expected \"on\" after fragment " + f.name, p.peek().line, p.peek().col}
+	}
+	if f.typeCond, err = p.name(); err != nil {
+		return nil, err
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	f.selections, err = p.selectionSet()
+	return f, err
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	leave, err := p.nest(p.peek())
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []*gqlSelection
+	for !p.isPunct("}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	p.next()
+	if len(sels) == 0 {
+		t := p.tokens[p.pos-1]
+		return nil, &gqlSyntaxError{"empty selection set", t.line, t.col}
+	}
+	return sels, nil
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	t := p.peek()
+	sel := &gqlSelection{line: t.line, col: t.col}
+	var err error
+	if p.isPunct("...") {
+		p.next()
+		if n := p.peek(); n.kind == "name" && n.val != "on" {
+			sel.spread = p.next().val
+			sel.directives, err = p.directives()
+			return sel, err
+		}
+		sel.inline = true
+		if p.peek().kind == "name" { // on Type
+			p.next()
+			if sel.typeCond, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if sel.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		sel.selections, err = p.selectionSet()
+		return sel, err
+	}
+
+	if sel.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.isPunct(":") {
+		p.next()
+		sel.alias = sel.name
+		if sel.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("(") {
+		if sel.args, err = p.arguments(false); err != nil {
+			return nil, err
+		}
+	}
+	if sel.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.isPunct("{") {
+		sel.selections, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+func (p *gqlParser) arguments(constant bool) (map[string]*gqlValue, error) {
+	p.next() // (
+	args := map[string]*gqlValue{}
+	for !p.isPunct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(constant); err != nil {
+			return nil, err
+		}
+	}
+	p.next()
+	return args, nil
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var dirs []gqlDirective
+	for p.isPunct("@") {
+		p.next()
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		d := gqlDirective{name: name}
+		if p.isPunct("(") {
+			if d.args, err = p.arguments(false); err != nil {
+				return nil, err
+			}
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+// value parses a literal; constant disallows variables, as in defaults
+func (p *gqlParser) value(constant bool) (*gqlValue, error) {
+	t := p.next()
+	if t.kind == "punct" && (t.val == "[" || t.val == "{") {
+		leave, err := p.nest(t)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+	}
+	switch {
+	case t.kind == "punct" && t.val == "$" && !constant:
+		name, err := p.name()
+		return &gqlValue{kind: "variable", raw: name}, err
+	case t.kind == "int" || t.kind == "float" || t.kind == "string":
+		return &gqlValue{kind: t.kind, raw: t.val}, nil
+	case t.kind == "name":
+		switch t.val {
+		case "true", "false":
+			return &gqlValue{kind: "boolean", raw: t.val}, nil
+		case "null":
+			return &gqlValue{kind: "null"}, nil
+		}
+		return &gqlValue{kind: "enum", raw: t.val}, nil
+	case t.kind == "punct" && t.val == "[":
+		v := &gqlValue{kind: "list"}
+		for !p.isPunct("]") {
+			item, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			v.list = append(v.list, item)
+		}
+		p.next()
+		return v, nil
+	case t.kind == "punct" && t.val == "{":
+		v := &gqlValue{kind: "object", fields: map[string]*gqlValue{}}
+		for !p.isPunct("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if v.fields[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+		return v, nil
+	}
+	return nil, p.unexpected(t)
+}
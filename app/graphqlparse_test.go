@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	doc, err := parseGraphQL(`
+		query Recent($n: Int = 5, $tags: [String!]!) @cached {
+			first: requests(last: $n) { method ...Where }
+			info { ... on AppInfo @include(if: true) { version } }
+		}
+		fragment Where on RequestEvent { path status }
+		# a comment, and commas, are ignored,,,
+		{ __typename }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.operations) != 2 || doc.fragments["Where"] == nil {
+		t.Fatalf("got %d operations and fragments %v, want 2 and Where", len(doc.operations), doc.fragments)
+	}
+	op := doc.operations[0]
+	if op.name != "Recent" || len(op.vars) != 2 || op.vars[0].def.resolve(nil) != float64(5) {
+		t.Errorf("operation = %q with vars %+v, want Recent with $n = 5 and $tags", op.name, op.vars)
+	}
+	first := op.selections[0]
+	if first.responseKey() != "first" || first.name != "requests" || first.args["last"].kind != "variable" {
+		t.Errorf("first selection = %+v, want first: requests(last: $n)", first)
+	}
+	if spread := first.selections[1]; spread.spread != "Where" {
+		t.Errorf("spread = %+v, want ...Where", spread)
+	}
+	if inline := op.selections[1].selections[0]; !inline.inline || inline.typeCond != "AppInfo" || len(inline.directives) != 1 {
+		t.Errorf("inline fragment = %+v, want ... on AppInfo @include", inline)
+	}
+}
+
+func TestParseGraphQLValues(t *testing.T) {
+	doc, err := parseGraphQL(`{ f(a: -1.5e2, b: "tab\there é", c: """ block """, d: [1, [2]], e: {x: null, y: ENUM}, g: false) }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := doc.operations[0].selections[0].args
+	tests := map[string]any{"a": -150.0, "b": "tab\there é", "c": "block", "e": map[string]any{"x": nil, "y": "ENUM"}, "g": false}
+	for name, want := range tests {
+		got := args[name].resolve(nil)
+		if gm, ok := got.(map[string]any); ok {
+			wm := want.(map[string]any)
+			if len(gm) != len(wm) || gm["x"] != wm["x"] || gm["y"] != wm["y"] {
+				t.Errorf("%s = %v, want %v", name, got, want)
+			}
+		} else if got != want {
+			t.Errorf("%s = %#v, want %#v", name, got, want)
+		}
+	}
+	if d, ok := args["d"].resolve(nil).([]any); !ok || len(d) != 2 {
+		t.Errorf("d = %v, want [1 [2]]", args["d"].resolve(nil))
+	}
+}
+
+func TestParseGraphQLRejectsMalformed(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"empty", "", "document has no operation"},
+		{"only a comment", "# nothing", "document has no operation"},
+		{"unclosed selection", "{ info { version }", "unexpected end of document"},
+		{"empty selection", "{ info { } }", "empty selection set"},
+		{"stray close", "{ info } }", `unexpected "}"`},
+		{"bad character", "{ info ^ }", "unexpected character"},
+		{"unterminated string", `{ f(a: "abc) }`, "unterminated string"},
+		{"newline in string", "{ f(a: \"a\nb\") }", "unterminated string"},
+		{"bad escape", `{ f(a: "\q") }`, "invalid escape"},
+		{"bad unicode escape", `{ f(a: "\u12") }`, "invalid unicode escape"},
+		{"unterminated block string", `{ f(a: """abc) }`, "unterminated block string"},
+		{"bad number", "{ f(a: 1-2) }", "invalid number"},
+		{"argument without value", "{ f(a:) }", `unexpected ")"`},
+		{"variable in a default", "query($a: Int = $b) { f }", `unexpected "$"`},
+		{"variable without $", "query(a: Int) { f }", `unexpected "a"`},
+		{"unclosed list type", "query($a: [Int) { f }", `unexpected ")"`},
+		{"fragment without on", "fragment F User { id } { f }", `expected "on"`},
+		{"duplicate fragment", "fragment F on Q { a } fragment F on Q { b } { f }", "duplicate fragment F"},
+		{"schema definition", "type Query { f: Int }", `unexpected "type"`},
+		{"alias without field", "{ a: }", `unexpected "}"`},
+		{"deep selections", strings.Repeat("{ a ", gqlMaxNesting+1) + strings.Repeat("}", gqlMaxNesting+1), "nested more than"},
+		{"deep list value", "{ f(a: " + strings.Repeat("[", 100000) + ") }", "nested more than"},
+		{"deep object value", "{ f(a: " + strings.Repeat("{a: ", 100000) + ") }", "nested more than"},
+		{"deep list type", "query($a: " + strings.Repeat("[", 100000) + ") { f }", "nested more than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGraphQL(tt.src)
+			if err == nil {
+				t.Fatalf("parseGraphQL(%.40q) succeeded, want an error containing %q", tt.src, tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want it to contain %q", err, tt.want)
+			}
+			var syntax *gqlSyntaxError
+			if !errors.As(err, &syntax) || syntax.line < 1 || syntax.col < 1 {
+				t.Errorf("error %v has no position", err)
+			}
+		})
+	}
+}
+
+func TestParseGraphQLPositions(t *testing.T) {
+	_, err := parseGraphQL("{\n  info {\n    version ^\n  }\n}")
+	var syntax *gqlSyntaxError
+	if !errors.As(err, &syntax) || syntax.line != 3 || syntax.col != 13 {
+		t.Errorf("error = %v, want one at 3:13", err)
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"hash/crc32"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gc "github.com/golang/groupcache"
+	"github.com/golang/groupcache/consistenthash"
+)
+
+// groupcache (github.com/golang/groupcache) shared by the replicas. Each
+// fib or primes result has one owner, picked by consistent hashing over
+// the ready pods: the owner computes it (once, however many callers ask at
+// the same time) and keeps it in its main cache; any other pod asks the
+// owner and sometimes keeps a copy in its hot cache. Adding a replica
+// moves about 1/n of the keys, where a plain hash mod n would move nearly
+// all of them:
+//
+//	GROUPCACHE=true GROUPCACHE_REPLICAS=50 GROUPCACHE_REFRESH=10s
+//	curl -s localhost:30080/api/compute/fib/90000 | jq '{cache, owner, pod}'
+//	curl -s 'localhost:30080/api/cache/peers?key=fib:90000' | jq
+//
+// The peer list comes from /api/peers' discovery: the pod lister with
+// RBAC, else the headless Service in PEER_SERVICE. Peers talk groupcache's
+// protocol on GROUPCACHE_PORT (7001), not the app port, and only to the
+// pods on the ring: anyone else gets a 403. A pod that can't reach a key's
+// owner computes the result itself, so a lost peer costs CPU, not errors.
+// Every pod refreshes its own view, so for a few seconds after a scale
+// event two pods can disagree on an owner and both compute a key.
+// GROUPCACHE_BYTES (64MiB) bounds the main and hot caches together.
+
+// defaultGroupcacheReplicas is how many points each pod gets on the hash ring;
+// more points spread the keys more evenly
+const defaultGroupcacheReplicas = 50
+
+// CachePeer is one pod on the hash ring
+type CachePeer struct {
+	Name    string  `json:"name,omitempty"`
+	Addr    string  `json:"addr"`
+	Self    bool    `json:"self"`
+	Share   float64 `json:"share"`   // of the hash ring, so of the keys
+	Fetches int64   `json:"fetches"` // keys this pod asked it for
+	Errors  int64   `json:"errors"`
+}
+
+// CachePeersResponse is returned by /api/cache/peers
+type CachePeersResponse struct {
+	Enabled     bool        `json:"enabled"`
+	Source      string      `json:"source,omitempty"` // kubernetes-api or dns
+	Replicas    int         `json:"replicas,omitempty"`
+	RefreshedAt *time.Time  `json:"refreshed_at,omitempty"`
+	Error       string      `json:"error,omitempty"` // the last refresh's
+	Key         string      `json:"key,omitempty"`
+	Owner       string      `json:"owner,omitempty"` // of ?key=
+	Peers       []CachePeer `json:"peers"`
+	Local       struct {
+		OwnedLoads   int64 `json:"owned_loads"`   // keys computed here as the owner
+		Deduplicated int64 `json:"deduplicated"`  // callers that waited for a load already running
+		PeerRequests int64 `json:"peer_requests"` // keys served to other pods
+		HotHits      int64 `json:"hot_hits"`      // others' keys answered from the hot cache
+	} `json:"local"`
+}
+
+// groupCache is this pod's groupcache: the group, the pool of peers and
+// the peer server, plus the ring mirrored to tell who owns what
+type groupCache struct {
+	port     string
+	replicas int
+	refresh  time.Duration
+	group    *gc.Group
+	pool     *gc.HTTPPool
+	srv      *http.Server
+
+	mu          sync.Mutex
+	self        string                // this pod's address on the ring
+	ring        *consistenthash.Map   // the pool's ring, by address
+	peers       map[string]*CachePeer // by address
+	source      string
+	refreshedAt time.Time
+	lastErr     string
+}
+
+// groupcache is set in main when GROUPCACHE is true
+var groupcache *groupCache
+
+var (
+	groupcacheFetches = newCounterVec("groupcache_peer_fetches_total",
+		"Keys fetched from their owner pod, by result (ok, error).", "result")
+	groupcacheRefused = newCounterVec("groupcache_peer_refused_total",
+		"Requests to GROUPCACHE_PORT from pods not on the ring.", "reason")
+)
+
+// newGroupCacheFromEnv returns nil unless GROUPCACHE=true
+func newGroupCacheFromEnv() *groupCache {
+	if !getEnvBool("GROUPCACHE", false) {
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	g := &groupCache{
+		port:     getEnv("GROUPCACHE_PORT", "7001"),
+		replicas: int(max(getEnvInt("GROUPCACHE_REPLICAS", defaultGroupcacheReplicas), 1)),
+		refresh:  getEnvDuration("GROUPCACHE_REFRESH", 10*time.Second),
+		peers:    map[string]*CachePeer{},
+	}
+	g.self = net.JoinHostPort(cmp.Or(getEnv("POD_IP", ""), hostname), g.port)
+	g.ring = consistenthash.New(g.replicas, nil)
+	g.pool = gc.NewHTTPPoolOpts(peerURL(g.self), &gc.HTTPPoolOptions{Replicas: g.replicas})
+	g.pool.Transport = func(ctx context.Context) http.RoundTripper {
+		return cachePeerTransport{g: g, ctx: ctx, base: tracingTransport{base: http.DefaultTransport}}
+	}
+	g.group = gc.NewGroup("compute", getEnvInt("GROUPCACHE_BYTES", 64<<20), gc.GetterFunc(g.load))
+	newGaugeFunc("groupcache_peers", "Pods on this pod's groupcache hash ring.", func() float64 {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return float64(len(g.peers))
+	})
+	return g
+}
+
+func peerURL(addr string) string { return "http://" + addr }
+
+// serve answers the other pods on GROUPCACHE_PORT
+func (g *groupCache) serve() {
+	g.srv = &http.Server{Addr: ":" + g.port, Handler: g.onlyPeers(g.pool), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := listenAndServe(g.srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("groupcache server failed", "addr", g.srv.Addr, "error", err)
+		}
+	}()
+}
+
+// Close stops the peer server
+func (g *groupCache) Close() {
+	if g.srv != nil {
+		g.srv.Close()
+	}
+}
+
+// onlyPeers refuses requests from IPs not on the ring
+func (g *groupCache) onlyPeers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		member := false
+		g.mu.Lock()
+		for addr := range g.peers {
+			if host, _, _ := net.SplitHostPort(addr); host == ip {
+				member = true
+			}
+		}
+		g.mu.Unlock()
+		if !member {
+			groupcacheRefused.Inc("not_peer")
+			http.Error(w, "not a groupcache peer", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// run refreshes the ring every refresh interval until ctx is done
+func (g *groupCache) run(ctx context.Context) {
+	for {
+		g.refreshPeers(ctx)
+		select {
+		case <-time.After(g.refresh):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshPeers rebuilds the ring from the ready pods; a failed discovery
+// keeps the last ring
+func (g *groupCache) refreshPeers(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	resp, err := discoverPeers(ctx)
+	if err != nil {
+		g.mu.Lock()
+		g.lastErr = err.Error()
+		g.mu.Unlock()
+		slog.Warn("groupcache peer discovery failed, keeping the last ring", "error", err)
+		return
+	}
+	hostname, _ := os.Hostname()
+	members := map[string]Peer{}
+	for _, p := range resp.Peers {
+		if !p.Ready || p.IP == "" || p.Self {
+			continue
+		}
+		members[net.JoinHostPort(p.IP, g.port)] = p
+	}
+	// under the address the pool knows as itself, ready or not: it still
+	// owns keys it is asked for
+	members[g.self] = Peer{Name: hostname, Self: true}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	changed := len(members) != len(g.peers)
+	peers := map[string]*CachePeer{}
+	addrs, urls := make([]string, 0, len(members)), make([]string, 0, len(members))
+	for addr, p := range members {
+		if old := g.peers[addr]; old != nil {
+			peers[addr] = old
+		} else {
+			changed = true
+			peers[addr] = &CachePeer{Addr: addr}
+		}
+		peers[addr].Name, peers[addr].Self = cmp.Or(p.Name, addr), addr == g.self
+		addrs, urls = append(addrs, addr), append(urls, peerURL(addr))
+	}
+	g.pool.Set(urls...)
+	g.ring = consistenthash.New(g.replicas, nil)
+	g.ring.Add(urls...)
+	g.peers, g.source, g.refreshedAt, g.lastErr = peers, resp.Source, time.Now(), ""
+	g.shares(addrs)
+	if changed {
+		slog.Info("groupcache ring changed", "peers", len(peers), "source", resp.Source)
+	}
+}
+
+// shares sets each peer's slice of the ring, placing the points the way
+// consistenthash does; called with g.mu held
+func (g *groupCache) shares(addrs []string) {
+	owners := map[uint32]string{}
+	var points []uint32
+	for _, addr := range addrs {
+		g.peers[addr].Share = 0
+		for i := 0; i < g.replicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peerURL(addr)))
+			points = append(points, point)
+			owners[point] = addr
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+	for i, point := range points {
+		prev := points[(i+len(points)-1)%len(points)]
+		span := point - prev // wraps around for the first point
+		if len(points) == 1 {
+			span = ^uint32(0)
+		}
+		g.peers[owners[point]].Share += float64(span) / (1 << 32)
+	}
+}
+
+// owner is the address that owns key and whether that is this pod
+func (g *groupCache) owner(key string) (string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ring.IsEmpty() {
+		return g.self, true
+	}
+	addr := strings.TrimPrefix(g.ring.Get(key), "http://")
+	return addr, addr == g.self
+}
+
+// computeTrace records, for one Get, where the result came from
+type computeTrace struct {
+	mu   sync.Mutex
+	tier string
+	ms   float64
+}
+
+type computeTraceKey struct{}
+
+func (t *computeTrace) set(tier string, ms float64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.tier, t.ms = tier, ms
+	t.mu.Unlock()
+}
+
+func traceFrom(ctx context.Context) *computeTrace {
+	t, _ := ctx.Value(computeTraceKey{}).(*computeTrace)
+	return t
+}
+
+// Get returns key's result and its owner's name. The tier is the owner's
+// (memory, redis or miss) when this pod computed it, peer when the owner
+// sent it, and memory or hot for groupcache's main and hot caches; a
+// caller that waited on another's load reports it the same way.
+func (g *groupCache) Get(ctx context.Context, key string) (computedResult, string, error) {
+	trace := &computeTrace{}
+	var data []byte
+	if err := g.group.Get(context.WithValue(ctx, computeTraceKey{}, trace), key, gc.AllocatingByteSliceSink(&data)); err != nil {
+		return computedResult{}, g.ownerName(key), err
+	}
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	res := computedResult{data: data, tier: trace.tier, ms: trace.ms}
+	if res.tier == "" {
+		res.tier = "hot"
+		if _, mine := g.owner(key); mine {
+			res.tier = "memory"
+		}
+	}
+	return res, g.ownerName(key), nil
+}
+
+// load computes key here, for this pod or a peer that found it the owner.
+// Peers send any key they like, so it is checked like a query.
+func (g *groupCache) load(ctx context.Context, key string, dest gc.Sink) error {
+	function, raw, _ := strings.Cut(key, ":")
+	input, err := strconv.ParseInt(raw, 10, 64)
+	check := computeFunctions[function]
+	if err != nil || check == nil {
+		return errors.New("key must be fib:{n} or primes:{upTo}")
+	}
+	compute, problem := check(input)
+	if problem != "" {
+		return errors.New(problem)
+	}
+	res, err := computeLocal(ctx, function, key, compute)
+	if err != nil {
+		return err
+	}
+	traceFrom(ctx).set(res.tier, res.ms)
+	return dest.SetBytes(res.data)
+}
+
+// cachePeerTransport counts fetches from each owner and marks the Get as
+// served by a peer
+type cachePeerTransport struct {
+	g    *groupCache
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t cachePeerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	failed := err != nil || res.StatusCode != http.StatusOK
+	t.g.mu.Lock()
+	if p := t.g.peers[req.URL.Host]; p != nil {
+		p.Fetches++
+		if failed {
+			p.Errors++
+		}
+	}
+	t.g.mu.Unlock()
+	if failed {
+		groupcacheFetches.Inc("error")
+		slog.Warn("groupcache owner unreachable, computing here", "owner", req.URL.Host, "error", err)
+		return res, err
+	}
+	groupcacheFetches.Inc("ok")
+	traceFrom(t.ctx).set("peer", 0)
+	return res, nil
+}
+
+// cachePeersHandler serves GET /api/cache/peers (?key= to find its owner)
+func cachePeersHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	resp := CachePeersResponse{Peers: []CachePeer{}}
+	g := groupcache
+	if g == nil {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	if key := r.URL.Query().Get("key"); key != "" {
+		resp.Key, resp.Owner = key, g.ownerName(key)
+	}
+	stats := &g.group.Stats
+	resp.Local.OwnedLoads, resp.Local.PeerRequests = stats.LocalLoads.Get(), stats.ServerRequests.Get()
+	resp.Local.Deduplicated = stats.Loads.Get() - stats.LoadsDeduped.Get()
+	resp.Local.HotHits = g.group.CacheStats(gc.HotCache).Hits
+	g.mu.Lock()
+	resp.Enabled, resp.Source, resp.Replicas, resp.Error = true, g.source, g.replicas, g.lastErr
+	if !g.refreshedAt.IsZero() {
+		at := g.refreshedAt.UTC()
+		resp.RefreshedAt = &at
+	}
+	for _, p := range g.peers {
+		resp.Peers = append(resp.Peers, *p)
+	}
+	g.mu.Unlock()
+	sort.Slice(resp.Peers, func(i, j int) bool { return resp.Peers[i].Name < resp.Peers[j].Name })
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// ownerName is the pod name owning key, for responses
+func (g *groupCache) ownerName(key string) string {
+	addr, _ := g.owner(key)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if p := g.peers[addr]; p != nil {
+		return p.Name
+	}
+	return addr
+}
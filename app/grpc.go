@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A gRPC server on its own port (GRPC_PORT, default 50051) for the gRPC
+// lessons: named ports, gRPC Services and native gRPC probes
+// (livenessProbe.grpc). gRPC is protobuf messages over HTTP/2, so this is
+// a plain net/http handler speaking cleartext HTTP/2 (h2c, which is what
+// kubelet probes use) with hand-encoded protobuf. It serves:
+//
+//	demo.v1.Info/GetInfo              app and pod info
+//	demo.v1.Echo/Echo                 returns the message and pod name
+//	grpc.health.v1.Health/Check|Watch standard health protocol
+//	grpc.reflection.v1(alpha)         so grpcurl works without .proto files
+//
+// Try it with: grpcurl -plaintext localhost:50051 list
+
+// gRPC status codes used here
+const (
+	grpcOK               = 0
+	grpcInvalidArgument  = 3
+	grpcDeadlineExceeded = 4
+	grpcNotFound         = 5
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+)
+
+// grpcError is an error with a gRPC status code
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string { return fmt.Sprintf("grpc status %d: %s", e.code, e.message) }
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// grpcStream carries the messages of one call in both directions
+type grpcStream struct {
+	ctx context.Context
+	r   io.Reader
+	w   http.ResponseWriter
+}
+
+// Recv reads the next length-prefixed message, io.EOF when the client is done
+func (s *grpcStream) Recv() ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(s.r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, grpcErrorf(grpcInternal, "truncated message")
+		}
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > 4<<20 {
+		return nil, grpcErrorf(grpcInvalidArgument, "message larger than 4MiB")
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(s.r, msg); err != nil {
+		return nil, grpcErrorf(grpcInternal, "truncated message")
+	}
+	return msg, nil
+}
+
+// Send writes one message and flushes it to the client
+func (s *grpcStream) Send(msg protoMessage) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	if _, err := s.w.Write(append(frame, msg...)); err != nil {
+		return err
+	}
+	http.NewResponseController(s.w).Flush()
+	return nil
+}
+
+// grpcUnary handles a request/response method
+type grpcUnary func(ctx context.Context, req protoFields) (protoMessage, error)
+
+// grpcServer routes /package.Service/Method paths to implementations
+type grpcServer struct {
+	unary     map[string]grpcUnary
+	streaming map[string]func(*grpcStream) error
+}
+
+var grpcHandled = newCounterVec("grpc_server_handled_total",
+	"gRPC calls completed, by method and status code.", "method", "code")
+
+func newGRPCServer() *grpcServer {
+	g := &grpcServer{
+		unary: map[string]grpcUnary{
+			"/demo.v1.Info/GetInfo":        grpcGetInfo,
+			"/demo.v1.Echo/Echo":           grpcEcho,
+			"/grpc.health.v1.Health/Check": grpcHealthCheck,
+		},
+		streaming: map[string]func(*grpcStream) error{
+			"/grpc.health.v1.Health/Watch":                                   grpcHealthWatch,
+			"/grpc.reflection.v1.ServerReflection/ServerReflectionInfo":      grpcReflection,
+			"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo": grpcReflection,
+		},
+	}
+	return g
+}
+
+func (g *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "this port speaks gRPC (HTTP/2, application/grpc)")
+		return
+	}
+	ctx := r.Context()
+	if timeout, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx, span := startSpan(contextWithRemoteParent(ctx, r.Header), "grpc "+r.URL.Path, spanKindServer)
+	defer span.End()
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	stream := &grpcStream{ctx: ctx, r: r.Body, w: w}
+
+	var err error
+	if handler, ok := g.unary[r.URL.Path]; ok {
+		err = serveUnary(stream, handler)
+	} else if handler, ok := g.streaming[r.URL.Path]; ok {
+		err = handler(stream)
+	} else {
+		err = grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+	}
+
+	code, message := grpcOK, ""
+	var gerr *grpcError
+	switch {
+	case err == nil:
+	case errors.As(err, &gerr):
+		code, message = gerr.code, gerr.message
+	case errors.Is(err, context.DeadlineExceeded):
+		code, message = grpcDeadlineExceeded, "deadline exceeded"
+	default:
+		code, message = grpcInternal, err.Error()
+	}
+	if code != grpcOK {
+		span.SetError(errors.New(message))
+	}
+	span.SetAttr("rpc.grpc.status_code", strconv.Itoa(code))
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", message)
+	}
+	grpcHandled.Inc(r.URL.Path, strconv.Itoa(code))
+	slog.Debug("grpc call", "method", r.URL.Path, "code", code, "trace_id", traceIDFromContext(ctx))
+}
+
+func serveUnary(stream *grpcStream, handler grpcUnary) error {
+	msg, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return grpcErrorf(grpcInvalidArgument, "missing request message")
+	} else if err != nil {
+		return err
+	}
+	req, err := decodeProto(msg)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	resp, err := handler(stream.ctx, req)
+	if err != nil {
+		return err
+	}
+	return stream.Send(resp)
+}
+
+// parseGRPCTimeout decodes the grpc-timeout header, e.g. "500m" or "2S"
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	unit := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}[v[len(v)-1]]
+	return time.Duration(n) * unit, unit != 0
+}
+
+// demo.v1.Info/GetInfo returns the same data as /api/info
+func grpcGetInfo(ctx context.Context, req protoFields) (protoMessage, error) {
+	hostname, _ := os.Hostname()
+	return protoMessage(nil).
+		String(1, getEnv("APP_NAME", "go-demo-app")).
+		String(2, buildInfo().Version).
+		String(3, hostname).
+		String(4, time.Now().Format(time.RFC3339)).
+		String(5, appMessage()).
+		String(6, podEnv().Node).
+		String(7, topology().Zone), nil
+}
+
+// demo.v1.Echo/Echo returns the message along with the pod that answered
+func grpcEcho(ctx context.Context, req protoFields) (protoMessage, error) {
+	hostname, _ := os.Hostname()
+	return protoMessage(nil).String(1, req.String(1)).String(2, hostname), nil
+}
+
+// Health serving status values (grpc.health.v1.HealthCheckResponse.ServingStatus)
+const (
+	healthServing        = 1
+	healthNotServing     = 2
+	healthServiceUnknown = 3
+)
+
+// healthStatus maps a health service name to a status. "" is the liveness
+// view, like /health; "readiness" mirrors /ready for readiness probes:
+//
+//	livenessProbe:  {grpc: {port: 50051}}
+//	readinessProbe: {grpc: {port: 50051, service: readiness}}
+func healthStatus(ctx context.Context, service string) (int, bool) {
+	switch service {
+	case "", "demo.v1.Info", "demo.v1.Echo":
+		if failing, _ := liveness.Failing(); failing {
+			return healthNotServing, true
+		}
+		return healthServing, true
+	case "readiness":
+		if !ready.Load() || readyOverride.Disabled() {
+			return healthNotServing, true
+		}
+		if _, ok := readinessChecks.Run(ctx); !ok {
+			return healthNotServing, true
+		}
+		return healthServing, true
+	}
+	return healthServiceUnknown, false
+}
+
+func grpcHealthCheck(ctx context.Context, req protoFields) (protoMessage, error) {
+	status, known := healthStatus(ctx, req.String(1))
+	if !known {
+		return nil, grpcErrorf(grpcNotFound, "unknown service %q", req.String(1))
+	}
+	return protoMessage(nil).Varint(1, uint64(status)), nil
+}
+
+// grpcHealthWatch streams the status of a service whenever it changes
+func grpcHealthWatch(stream *grpcStream) error {
+	msg, err := stream.Recv()
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "missing request message")
+	}
+	req, err := decodeProto(msg)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	last := -1
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		status, _ := healthStatus(stream.ctx, req.String(1))
+		if status != last {
+			if err := stream.Send(protoMessage(nil).Varint(1, uint64(status))); err != nil {
+				return err
+			}
+			last = status
+		}
+		select {
+		case <-stream.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// serveGRPC listens on addr with cleartext HTTP/2 and serves until the
+// process exits. Fatal if the port can't be opened.
+func serveGRPC(addr string) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: newGRPCServer()}
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true) // only to explain the 415
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	go func() {
+		if err := listenAndServe(srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("gRPC server failed", "addr", addr, "error", err)
+		}
+	}()
+	return srv
+}
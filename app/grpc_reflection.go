@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// gRPC server reflection lets tools like grpcurl and Postman discover the
+// services and message types at runtime. The answers are serialized
+// FileDescriptorProtos, normally generated by protoc; with no code
+// generation here they are built by hand from the equivalent of:
+//
+//	syntax = "proto3";
+//	package demo.v1;
+//	message InfoRequest {}
+//	message InfoResponse { string name = 1; string version = 2; string hostname = 3;
+//	  string timestamp = 4; string message = 5; string node = 6; string zone = 7; }
+//	message EchoRequest { string message = 1; }
+//	message EchoResponse { string message = 1; string hostname = 2; }
+//	service Info { rpc GetInfo(InfoRequest) returns (InfoResponse); }
+//	service Echo { rpc Echo(EchoRequest) returns (EchoResponse); }
+//
+// plus the standard grpc/health/v1/health.proto.
+
+// Field types and labels from descriptor.proto
+const (
+	descTypeString = 9
+	descTypeEnum   = 14
+	descOptional   = 1
+)
+
+type descField struct {
+	name     string
+	number   int
+	typ      int
+	typeName string // for messages and enums, fully qualified with a leading dot
+}
+
+type descMessage struct {
+	name   string
+	fields []descField
+	enums  []descEnum
+}
+
+type descEnum struct {
+	name   string
+	values []string // value i has number i
+}
+
+type descMethod struct {
+	name, input, output string
+	serverStreaming     bool
+}
+
+type descService struct {
+	name    string
+	methods []descMethod
+}
+
+type descFile struct {
+	name     string
+	pkg      string
+	messages []descMessage
+	services []descService
+}
+
+// encode serializes the file as a google.protobuf.FileDescriptorProto
+func (f descFile) encode() []byte {
+	m := protoMessage(nil).String(1, f.name).String(2, f.pkg)
+	for _, msg := range f.messages {
+		d := protoMessage(nil).String(1, msg.name)
+		for _, fl := range msg.fields {
+			d = d.Bytes(2, protoMessage(nil).
+				String(1, fl.name).
+				Varint(3, uint64(fl.number)).
+				Varint(4, descOptional).
+				Varint(5, uint64(fl.typ)).
+				String(6, fl.typeName).
+				String(10, fl.name))
+		}
+		for _, e := range msg.enums {
+			d = d.Bytes(4, e.encode())
+		}
+		m = m.Bytes(4, d)
+	}
+	for _, svc := range f.services {
+		s := protoMessage(nil).String(1, svc.name)
+		for _, method := range svc.methods {
+			s = s.Bytes(2, protoMessage(nil).
+				String(1, method.name).
+				String(2, method.input).
+				String(3, method.output).
+				Bool(6, method.serverStreaming))
+		}
+		m = m.Bytes(6, s)
+	}
+	return m.String(12, "proto3")
+}
+
+func (e descEnum) encode() protoMessage {
+	m := protoMessage(nil).String(1, e.name)
+	for i, v := range e.values {
+		m = m.Bytes(2, protoMessage(nil).String(1, v).Varint(2, uint64(i)))
+	}
+	return m
+}
+
+func stringFields(names ...string) []descField {
+	fields := make([]descField, len(names))
+	for i, name := range names {
+		fields[i] = descField{name: name, number: i + 1, typ: descTypeString}
+	}
+	return fields
+}
+
+var demoProto = descFile{
+	name: "demo/v1/demo.proto",
+	pkg:  "demo.v1",
+	messages: []descMessage{
+		{name: "InfoRequest"},
+		{name: "InfoResponse", fields: stringFields("name", "version", "hostname", "timestamp", "message", "node", "zone")},
+		{name: "EchoRequest", fields: stringFields("message")},
+		{name: "EchoResponse", fields: stringFields("message", "hostname")},
+	},
+	services: []descService{
+		{name: "Info", methods: []descMethod{{name: "GetInfo", input: ".demo.v1.InfoRequest", output: ".demo.v1.InfoResponse"}}},
+		{name: "Echo", methods: []descMethod{{name: "Echo", input: ".demo.v1.EchoRequest", output: ".demo.v1.EchoResponse"}}},
+	},
+}
+
+var healthProto = descFile{
+	name: "grpc/health/v1/health.proto",
+	pkg:  "grpc.health.v1",
+	messages: []descMessage{
+		{name: "HealthCheckRequest", fields: stringFields("service")},
+		{
+			name: "HealthCheckResponse",
+			fields: []descField{{name: "status", number: 1, typ: descTypeEnum,
+				typeName: ".grpc.health.v1.HealthCheckResponse.ServingStatus"}},
+			enums: []descEnum{{name: "ServingStatus", values: []string{"UNKNOWN", "SERVING", "NOT_SERVING", "SERVICE_UNKNOWN"}}},
+		},
+	},
+	services: []descService{{name: "Health", methods: []descMethod{
+		{name: "Check", input: ".grpc.health.v1.HealthCheckRequest", output: ".grpc.health.v1.HealthCheckResponse"},
+		{name: "Watch", input: ".grpc.health.v1.HealthCheckRequest", output: ".grpc.health.v1.HealthCheckResponse", serverStreaming: true},
+	}}},
+}
+
+var reflectionFiles = []descFile{demoProto, healthProto}
+
+// fileForSymbol finds the file defining a fully qualified symbol such as
+// demo.v1.Echo, demo.v1.Echo.Echo or grpc.health.v1.HealthCheckRequest
+func fileForSymbol(symbol string) (descFile, bool) {
+	for _, f := range reflectionFiles {
+		if strings.HasPrefix(symbol, f.pkg+".") {
+			return f, true
+		}
+	}
+	return descFile{}, false
+}
+
+// grpcReflection answers ServerReflectionRequests until the client hangs up
+func grpcReflection(stream *grpcStream) error {
+	for {
+		raw, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		req, err := decodeProto(raw)
+		if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%v", err)
+		}
+
+		resp := protoMessage(nil).String(1, req.String(1)).Bytes(2, raw)
+		switch {
+		case req.Has(7): // list_services
+			var list protoMessage
+			for _, f := range reflectionFiles {
+				for _, svc := range f.services {
+					list = list.Bytes(1, protoMessage(nil).String(1, f.pkg+"."+svc.name))
+				}
+			}
+			resp = resp.Bytes(6, list)
+		case req.Has(3) || req.Has(4): // file_by_filename, file_containing_symbol
+			var file descFile
+			found := false
+			if req.Has(3) {
+				for _, f := range reflectionFiles {
+					if f.name == req.String(3) {
+						file, found = f, true
+					}
+				}
+			} else {
+				file, found = fileForSymbol(req.String(4))
+			}
+			if found {
+				resp = resp.Bytes(4, protoMessage(nil).Bytes(1, file.encode()))
+			} else {
+				resp = resp.Bytes(7, protoMessage(nil).Varint(1, grpcNotFound).String(2, "not found"))
+			}
+		default: // extensions: none defined
+			resp = resp.Bytes(7, protoMessage(nil).Varint(1, grpcUnimplemented).String(2, "not supported"))
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/store"
+)
+
+// guestbookHandler lists (GET ?limit=) or adds (POST {"name","message"})
+// entries; in a StatefulSet only ordinal 0 adds them. With TENANT_MODE each
+// tenant sees only its own; without it, everyone's.
+func guestbookHandler(guestbook *store.Guestbook) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			limit := 50
+			if r.URL.Query().Get("limit") != "" {
+				n, ok := queryInt(w, r, "limit", 1, 200)
+				if !ok {
+					return
+				}
+				limit = int(n)
+			}
+			entries, cached, err := guestbook.List(r.Context(), tenantFromContext(r.Context()), limit)
+			if err != nil {
+				slog.Error("guestbook list failed", "error", err)
+				writeProblem(w, r, http.StatusServiceUnavailable, "guestbook unavailable")
+				return
+			}
+			w.Header().Set("X-Cache", "miss")
+			if cached {
+				w.Header().Set("X-Cache", "hit")
+			}
+			writeJSON(w, http.StatusOK, entries)
+
+		case http.MethodPost:
+			if o, ok := statefulSetOrdinal(); ok && o.role() != "writer" {
+				// A read replica: writes go to ordinal 0
+				sendProblem(w, r, Problem{
+					Status:     http.StatusConflict,
+					Detail:     fmt.Sprintf("read-only replica (ordinal %d); send writes to %s", o.ordinal, o.writer()),
+					Extensions: map[string]any{"role": o.role(), "writer": o.writer()},
+				})
+				return
+			}
+			var body struct {
+				Name    string `json:"name" validate:"required,max=100"`
+				Message string `json:"message" validate:"required,max=1000"`
+			}
+			if err := decodeJSON(w, r, 16<<10, &body); err != nil {
+				writeBodyProblem(w, r, err)
+				return
+			}
+			hostname, _ := os.Hostname()
+			entry, err := guestbook.Add(r.Context(), cmp.Or(tenantFromContext(r.Context()), defaultTenant), body.Name, body.Message, hostname)
+			if err != nil {
+				slog.Error("guestbook insert failed", "error", err)
+				writeProblem(w, r, http.StatusServiceUnavailable, "guestbook unavailable")
+				return
+			}
+			writeJSON(w, http.StatusCreated, entry)
+
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeProblem(w, r, http.StatusMethodNotAllowed, "use GET or POST")
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// An experimental HTTP/3 listener. HTTP/3 runs over QUIC, which is UDP, so
+// it takes the certificate of the HTTPS port (TLS_CERT_FILE, TLS_KEY_FILE)
+// and a UDP port of its own, HTTP3_PORT; the same handlers answer on both:
+//
+//	kubectl set env deploy/go-app -n go-demo HTTP3_PORT=8080   # TLS set up as in certificate.yaml
+//	kubectl apply -f k8s/advanced/http3.yaml
+//	# from a pod whose curl lists HTTP3 in curl -V:
+//	curl -k --http3-only https://go-app-h3:8080/api/echo | jq .protocol   # "h3"
+//	curl -k -sI https://go-app-h3:8080/ | grep -i alt-svc                  # h3=":8080"
+//
+// Clients don't start with HTTP/3: they learn of it from the Alt-Svc
+// header on an HTTPS response over TCP, then try QUIC on that port and
+// stay on TCP if no UDP gets through. So the Service needs a UDP port next
+// to the TCP one, kube-proxy balances the two independently (the TCP and
+// QUIC connections of one client can land on different pods), and a
+// LoadBalancer that only opens TCP quietly keeps everyone on HTTP/2.
+// HTTP3_PUBLIC_PORT is the port Alt-Svc announces when clients come in
+// through a different one, a NodePort say.
+
+// http3Server serves HTTP/3 on a UDP socket until Close
+type http3Server struct {
+	*http3.Server
+	conn net.PacketConn
+}
+
+// serveHTTP3 listens on the UDP address addr and serves handler over
+// HTTP/3 with tlsConfig, announcing publicPort in Alt-Svc
+func serveHTTP3(addr string, publicPort int, handler http.Handler, tlsConfig *tls.Config) *http3Server {
+	conn, err := listenPacket("udp", addr)
+	if err != nil {
+		fatal("HTTP/3 server failed to start", "addr", addr, "error", err)
+	}
+	s := &http3Server{
+		Server: &http3.Server{Handler: handler, TLSConfig: tlsConfig, Port: publicPort},
+		conn:   conn,
+	}
+	go func() {
+		if err := s.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP/3 server stopped", "error", err)
+		}
+	}()
+	return s
+}
+
+// Close stops the server and releases its socket, which http3.Server
+// leaves open when given one
+func (s *http3Server) Close() error {
+	err := s.Server.Close()
+	s.conn.Close()
+	return err
+}
+
+// advertiseHTTP3 adds the Alt-Svc header pointing at s to responses sent
+// over TCP, so clients that speak HTTP/3 switch to it
+func advertiseHTTP3(s *http3Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			s.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// http3PublicPort is the port announced in Alt-Svc: HTTP3_PUBLIC_PORT, or
+// the UDP port itself
+func http3PublicPort(port string) (int, error) {
+	return strconv.Atoi(getEnv("HTTP3_PUBLIC_PORT", port))
+}
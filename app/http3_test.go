@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3ServesAndIsAdvertised(t *testing.T) {
+	ca := newTestCA(t)
+	cfg := serverTLSConfig(t, ca, "optional")
+	handler := apiInfoHandler("go-app", "test")
+	h3 := serveHTTP3("127.0.0.1:0", 0, handler, cfg)
+	t.Cleanup(func() { h3.Close() })
+
+	// Over QUIC the request reports h3
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool}}
+	t.Cleanup(func() { transport.Close() })
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	resp, err := client.Get("https://" + h3.conn.LocalAddr().String() + "/api/info")
+	if err != nil {
+		t.Fatalf("HTTP/3 request: %v", err)
+	}
+	defer resp.Body.Close()
+	var info AppInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 3 || info.Protocol != "h3" {
+		t.Errorf("proto %s, protocol %q; want HTTP/3 and h3", resp.Proto, info.Protocol)
+	}
+
+	// Over TCP the response points at the UDP port
+	ts := httptest.NewUnstartedServer(advertiseHTTP3(h3, handler))
+	ts.Listener = tls.NewListener(ts.Listener, cfg)
+	ts.Start()
+	t.Cleanup(ts.Close)
+	resp, err = mtlsClient(t, ca, nil, nil).Get("https://" + ts.Listener.Addr().String() + "/api/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	_, port, _ := net.SplitHostPort(h3.conn.LocalAddr().String())
+	if got, want := resp.Header.Get("Alt-Svc"), `h3=":`+port+`"; ma=2592000`; got != want {
+		t.Errorf("Alt-Svc = %q, want %q", got, want)
+	}
+}
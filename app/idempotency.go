@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Idempotency-Key on POST /api/guestbook and /api/jobs. A client that
+// retries a POST (after a timeout, a reset connection, a 502 from the
+// Ingress) can't know whether the first one was applied; sending the same
+// key makes the retry safe. The first request with a key runs, and its
+// response is kept for IDEMPOTENCY_TTL (24h); a repeat gets that response
+// again, with Idempotent-Replayed: true, instead of a second entry or job:
+//
+//	curl -i -X POST -H 'Idempotency-Key: order-42' 'localhost:30080/api/jobs?duration=2s'   # twice
+//
+// A repeat while the first is still running gets 409, and the same key
+// with a different body 422 (draft-ietf-httpapi-idempotency-key-header).
+// Server errors (5xx) aren't kept, so retrying one runs it again.
+//
+// Keys are kept in memory, so a retry that a Service or Ingress sends to
+// another replica isn't recognized - with REDIS_ADDR set they are kept in
+// Redis and shared by every pod, which is what makes the pattern work with
+// more than one replica.
+
+// idempotencyRecord is what's kept under a key
+type idempotencyRecord struct {
+	Fingerprint string            `json:"fingerprint"` // method, path and body
+	Done        bool              `json:"done"`
+	Status      int               `json:"status,omitempty"`
+	Header      map[string]string `json:"header,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	Pod         string            `json:"pod"`
+}
+
+// idempotencyStore claims keys and keeps responses
+type idempotencyStore interface {
+	// Reserve claims key with rec, or returns what is already stored there
+	Reserve(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) (*idempotencyRecord, error)
+	Save(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) error
+	Release(ctx context.Context, key string) error
+}
+
+// idempotencyKeys is in memory unless main finds REDIS_ADDR
+var idempotencyKeys idempotencyStore = newMemoryIdempotencyStore()
+
+// idempotencyTTL is how long a key is remembered; IDEMPOTENCY_TTL, set in serve
+var idempotencyTTL = 24 * time.Hour
+
+// maxIdempotentBody bounds the request bodies hashed and responses kept
+const maxIdempotentBody = 1 << 20
+
+var idempotencyResults = newCounterVec("idempotency_requests_total",
+	"POSTs with an Idempotency-Key, by route and result (new, replayed, in_progress, mismatch, error).", "handler", "result")
+
+// idempotent makes POSTs to next with an Idempotency-Key run at most once
+// per key
+func idempotent(route string, next http.HandlerFunc) http.HandlerFunc {
+	hostname, _ := os.Hostname()
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeProblem(w, r, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+		if err != nil || len(body) > maxIdempotentBody {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, "request body too large for an idempotent request")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256([]byte(r.Method + " " + r.URL.RequestURI() + "\n" + string(body)))
+		fingerprint := hex.EncodeToString(sum[:])
+		storeKey := "idempotency:" + route + ":" + key
+
+		existing, err := idempotencyKeys.Reserve(r.Context(), storeKey, idempotencyRecord{Fingerprint: fingerprint, Pod: hostname}, idempotencyTTL)
+		switch {
+		case err != nil:
+			idempotencyResults.Inc(route, "error")
+			slog.Error("idempotency store unavailable", "error", err)
+			writeProblem(w, r, http.StatusServiceUnavailable, "cannot check the Idempotency-Key right now; retry with the same key")
+			return
+		case existing != nil && existing.Fingerprint != fingerprint:
+			idempotencyResults.Inc(route, "mismatch")
+			writeProblem(w, r, http.StatusUnprocessableEntity, "this Idempotency-Key was used for a different request")
+			return
+		case existing != nil && !existing.Done:
+			idempotencyResults.Inc(route, "in_progress")
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, r, http.StatusConflict, "a request with this Idempotency-Key is still in progress on "+existing.Pod)
+			return
+		case existing != nil:
+			idempotencyResults.Inc(route, "replayed")
+			for k, v := range existing.Header {
+				w.Header().Set(k, v)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.Header().Set("X-Idempotent-Original-Pod", existing.Pod)
+			w.WriteHeader(existing.Status)
+			w.Write(existing.Body)
+			return
+		}
+		idempotencyResults.Inc(route, "new")
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			// Detached from the request: a cancelled client still
+			// leaves a key to replay or release
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 2*time.Second)
+			defer cancel()
+			if !completed || rec.status >= 500 || rec.overflow {
+				if err := idempotencyKeys.Release(ctx, storeKey); err != nil {
+					slog.Warn("idempotency key release failed", "key", key, "error", err)
+				}
+				return
+			}
+			saved := idempotencyRecord{Fingerprint: fingerprint, Done: true, Status: rec.status, Pod: hostname, Body: rec.body.Bytes(),
+				Header: map[string]string{}}
+			for _, h := range []string{"Content-Type", "Location"} {
+				if v := w.Header().Get(h); v != "" {
+					saved.Header[h] = v
+				}
+			}
+			if err := idempotencyKeys.Save(ctx, storeKey, saved, idempotencyTTL); err != nil {
+				slog.Warn("idempotency key save failed", "key", key, "error", err)
+			}
+		}()
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		completed = true
+	}
+}
+
+// idempotencyRecorder keeps a copy of the response it passes on
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool // too big to keep
+}
+
+func (rec *idempotencyRecorder) WriteHeader(code int) {
+	if rec.status == 0 && code >= 200 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.body.Len()+len(b) > maxIdempotentBody {
+		rec.overflow = true
+	} else if !rec.overflow {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter { return rec.ResponseWriter }
+
+// memoryIdempotencyStore keeps keys in this pod only
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	records   map[string]memoryIdempotencyEntry
+	lastSweep time.Time
+}
+
+type memoryIdempotencyEntry struct {
+	rec     idempotencyRecord
+	expires time.Time
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{records: map[string]memoryIdempotencyEntry{}}
+}
+
+func (s *memoryIdempotencyStore) Reserve(_ context.Context, key string, rec idempotencyRecord, ttl time.Duration) (*idempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, e := range s.records {
+			if now.After(e.expires) {
+				delete(s.records, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	if e, ok := s.records[key]; ok && now.Before(e.expires) {
+		return &e.rec, nil
+	}
+	s.records[key] = memoryIdempotencyEntry{rec: rec, expires: now.Add(ttl)}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Save(_ context.Context, key string, rec idempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = memoryIdempotencyEntry{rec: rec, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// redisIdempotencyStore shares keys between replicas: SET NX claims a key
+// atomically, so two pods given the same retry can't both run it
+type redisIdempotencyStore struct {
+	client *redisClient
+}
+
+func (s redisIdempotencyStore) Reserve(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) (*idempotencyRecord, error) {
+	data, _ := json.Marshal(rec)
+	reply, err := s.client.Do(ctx, "SET", key, string(data), "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return nil, err
+	}
+	if reply == "OK" {
+		return nil, nil
+	}
+	reply, err = s.client.Do(ctx, "GET", key)
+	if err != nil {
+		return nil, err
+	}
+	stored, ok := reply.(string)
+	if !ok {
+		return nil, errors.New("idempotency key vanished; retry")
+	}
+	var existing idempotencyRecord
+	if err := json.Unmarshal([]byte(stored), &existing); err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+func (s redisIdempotencyStore) Save(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) error {
+	data, _ := json.Marshal(rec)
+	_, err := s.client.Do(ctx, "SET", key, string(data), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (s redisIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := s.client.Do(ctx, "DEL", key)
+	return err
+}
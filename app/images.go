@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// POST /api/images/resize decodes an uploaded JPEG, PNG or GIF, scales it
+// and returns the result: real CPU and memory per request, proportional to
+// the pixels, where /api/load/* only spins or allocates.
+//
+//	curl -s -o thumb.jpg -D - --data-binary @photo.jpg 'localhost:30080/api/images/resize?width=320'
+//	curl -s -o thumb.png -F image=@photo.png 'localhost:30080/api/images/resize?width=200&height=200&format=png'
+//
+// With only one of width and height the other keeps the aspect ratio. The
+// timings come back in X-Decode-Time, X-Resize-Time, X-Encode-Time and
+// X-Queue-Time. IMAGE_CONCURRENCY images (GOMAXPROCS by default) are
+// processed at once and the rest wait for a slot, for up to
+// IMAGE_QUEUE_TIMEOUT (5s) before a 503: a CPU limit shows up as queue
+// time and image_resize_waiting, which is the signal to scale on, before
+// it shows up as throttling. A decoded image is 4 bytes per pixel, so
+// IMAGE_CONCURRENCY times the largest expected image is what the memory
+// limit has to hold.
+
+// Limits keep a decompression bomb from OOMing the pod
+const (
+	maxImageUpload    = 20 << 20
+	maxImagePixels    = 40_000_000
+	maxImageDimension = 8192
+)
+
+var (
+	imageSlots        = make(chan struct{}, 1) // IMAGE_CONCURRENCY, GOMAXPROCS by default, set in serve
+	imageQueueTimeout = 5 * time.Second        // IMAGE_QUEUE_TIMEOUT, set in serve
+
+	imageResizes   = newCounterVec("image_resize_requests_total", "Image resize requests, by result (ok, rejected, invalid, error).", "result")
+	imageInFlight  = newGaugeVec("image_resize_in_flight", "Images being processed now, at most IMAGE_CONCURRENCY.")
+	imageWaiting   = newGaugeVec("image_resize_waiting", "Resize requests waiting for a processing slot.")
+	imageDurations = newHistogramVec("image_resize_duration_seconds", "Time per resize, by stage (queue, decode, resize, encode).",
+		[]float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 5}, "stage")
+)
+
+func init() {
+	imageInFlight.Set(0)
+	imageWaiting.Set(0)
+}
+
+func imageResizeHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	q := r.URL.Query()
+	var width, height int64
+	var ok bool
+	if q.Get("width") != "" {
+		if width, ok = queryInt(w, r, "width", 1, maxImageDimension); !ok {
+			return
+		}
+	}
+	if q.Get("height") != "" {
+		if height, ok = queryInt(w, r, "height", 1, maxImageDimension); !ok {
+			return
+		}
+	}
+	if width == 0 && height == 0 {
+		imageResizes.Inc("invalid")
+		writeProblem(w, r, http.StatusBadRequest, "give width, height or both")
+		return
+	}
+	quality := int64(jpeg.DefaultQuality)
+	if q.Get("quality") != "" {
+		if quality, ok = queryInt(w, r, "quality", 1, 100); !ok {
+			return
+		}
+	}
+
+	data, err := readImageUpload(w, r)
+	if err != nil {
+		imageResizes.Inc("invalid")
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, "image larger than 20MiB")
+			return
+		}
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		imageResizes.Inc("invalid")
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "not a JPEG, PNG or GIF image: "+err.Error())
+		return
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		imageResizes.Inc("invalid")
+		writeProblem(w, r, http.StatusRequestEntityTooLarge,
+			"image is "+strconv.Itoa(cfg.Width)+"x"+strconv.Itoa(cfg.Height)+", more than "+strconv.Itoa(maxImagePixels)+" pixels")
+		return
+	}
+	if q.Get("format") != "" {
+		format = q.Get("format")
+	}
+	if format != "jpeg" && format != "png" && format != "gif" {
+		imageResizes.Inc("invalid")
+		writeProblem(w, r, http.StatusBadRequest, "format must be jpeg, png or gif")
+		return
+	}
+	if width == 0 {
+		width = max(int64(cfg.Width)*height/int64(cfg.Height), 1)
+	}
+	if height == 0 {
+		height = max(int64(cfg.Height)*width/int64(cfg.Width), 1)
+	}
+
+	queued := time.Now()
+	release, err := acquireImageSlot(r.Context())
+	if err != nil {
+		imageResizes.Inc("rejected")
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, r, http.StatusServiceUnavailable, "all "+strconv.Itoa(cap(imageSlots))+" image slots busy for "+imageQueueTimeout.String())
+		return
+	}
+	defer release()
+	queueTime := time.Since(queued)
+	imageDurations.Observe(queueTime.Seconds(), "queue")
+
+	start := time.Now()
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		imageResizes.Inc("invalid")
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "cannot decode image: "+err.Error())
+		return
+	}
+	decodeTime := time.Since(start)
+	imageDurations.Observe(decodeTime.Seconds(), "decode")
+
+	start = time.Now()
+	dst, err := resizeBilinear(r.Context(), src, int(width), int(height))
+	if err != nil {
+		imageResizes.Inc("error")
+		writeProblem(w, r, http.StatusServiceUnavailable, "resize cancelled: "+err.Error())
+		return
+	}
+	resizeTime := time.Since(start)
+	imageDurations.Observe(resizeTime.Seconds(), "resize")
+
+	start = time.Now()
+	var out bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: int(quality)})
+	case "png":
+		err = png.Encode(&out, dst)
+	case "gif":
+		err = gif.Encode(&out, dst, nil)
+	}
+	if err != nil {
+		imageResizes.Inc("error")
+		slog.Error("image encode failed", "format", format, "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "encode failed: "+err.Error())
+		return
+	}
+	encodeTime := time.Since(start)
+	imageDurations.Observe(encodeTime.Seconds(), "encode")
+	imageResizes.Inc("ok")
+
+	h := w.Header()
+	h.Set("Content-Type", "image/"+format)
+	h.Set("Content-Length", strconv.Itoa(out.Len()))
+	h.Set("X-Original-Size", strconv.Itoa(cfg.Width)+"x"+strconv.Itoa(cfg.Height))
+	h.Set("X-Resized-Size", strconv.FormatInt(width, 10)+"x"+strconv.FormatInt(height, 10))
+	h.Set("X-Queue-Time", queueTime.String())
+	h.Set("X-Decode-Time", decodeTime.String())
+	h.Set("X-Resize-Time", resizeTime.String())
+	h.Set("X-Encode-Time", encodeTime.String())
+	h.Set("X-Processing-Time", (decodeTime + resizeTime + encodeTime).String())
+	w.WriteHeader(http.StatusOK)
+	w.Write(out.Bytes())
+}
+
+// readImageUpload takes the image from a multipart "image" field or, for
+// any other content type, the raw body
+func readImageUpload(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body := http.MaxBytesReader(w, r.Body, maxImageUpload)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return io.ReadAll(body)
+	}
+	r.Body = body
+	if err := r.ParseMultipartForm(maxImageUpload); err != nil {
+		return nil, err
+	}
+	defer r.MultipartForm.RemoveAll()
+	f, _, err := r.FormFile("image")
+	if err != nil {
+		return nil, errors.New("multipart upload needs an image field")
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// acquireImageSlot waits up to IMAGE_QUEUE_TIMEOUT for a processing slot
+func acquireImageSlot(ctx context.Context) (func(), error) {
+	release := func() {
+		<-imageSlots
+		imageInFlight.Add(-1)
+	}
+	select {
+	case imageSlots <- struct{}{}:
+		imageInFlight.Add(1)
+		return release, nil
+	default:
+	}
+	imageWaiting.Add(1)
+	defer imageWaiting.Add(-1)
+	ctx, cancel := context.WithTimeout(ctx, imageQueueTimeout)
+	defer cancel()
+	select {
+	case imageSlots <- struct{}{}:
+		imageInFlight.Add(1)
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resizeBilinear scales src to width x height, each output pixel a blend
+// of the four source pixels around it. The standard library has no
+// scaler (golang.org/x/image/draw does), so it works on RGBA directly.
+// Shrinking by more than half skips source pixels, so thumbnails of fine
+// detail alias; the work per output pixel stays the same either way.
+func resizeBilinear(ctx context.Context, src image.Image, width, height int) (*image.RGBA, error) {
+	b := src.Bounds()
+	in, ok := src.(*image.RGBA)
+	if !ok {
+		in = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(in, in.Bounds(), src, b.Min, draw.Src)
+	}
+	sw, sh := in.Bounds().Dx(), in.Bounds().Dy()
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	xScale := float64(sw) / float64(width)
+	yScale := float64(sh) / float64(height)
+	for y := 0; y < height; y++ {
+		if y%64 == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		fy := max((float64(y)+0.5)*yScale-0.5, 0)
+		y0 := int(fy)
+		y1 := min(y0+1, sh-1)
+		dy := fy - float64(y0)
+		for x := 0; x < width; x++ {
+			fx := max((float64(x)+0.5)*xScale-0.5, 0)
+			x0 := int(fx)
+			x1 := min(x0+1, sw-1)
+			dx := fx - float64(x0)
+			p00, p01 := in.PixOffset(x0+in.Rect.Min.X, y0+in.Rect.Min.Y), in.PixOffset(x1+in.Rect.Min.X, y0+in.Rect.Min.Y)
+			p10, p11 := in.PixOffset(x0+in.Rect.Min.X, y1+in.Rect.Min.Y), in.PixOffset(x1+in.Rect.Min.X, y1+in.Rect.Min.Y)
+			o := out.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				top := float64(in.Pix[p00+c])*(1-dx) + float64(in.Pix[p01+c])*dx
+				bottom := float64(in.Pix[p10+c])*(1-dx) + float64(in.Pix[p11+c])*dx
+				out.Pix[o+c] = uint8(top*(1-dy) + bottom*dy + 0.5)
+			}
+		}
+	}
+	return out, nil
+}
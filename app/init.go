@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// init mode prepares a shared volume and exits, for the init container
+// lesson: init containers run to completion, in order, before the app
+// container starts, and a failing one holds the pod in Init:Error.
+//
+//	app init -dir=/shared -work=5s
+//
+// It writes config.yaml, which the app container can read with
+// CONFIG_FILE=/shared/config.yaml, and then the marker file - last, so
+// the marker means everything else is in place. With
+// READY_CHECK_FILE=/shared/.initialized the app stays unready until the
+// marker exists, which also covers a volume prepared some other way.
+// INIT_DIR, INIT_WORK and INIT_FAIL set the flags' defaults. See
+// k8s/advanced/init-container.yaml.
+
+// initMarker is the file written when init mode has finished
+const initMarker = ".initialized"
+
+func runInit(args []string) int {
+	fs := newFlagSet("init", "")
+	dir := fs.String("dir", getEnv("INIT_DIR", "/shared"), "directory to prepare, usually an emptyDir shared with the app container")
+	work := fs.Duration("work", getEnvDuration("INIT_WORK", 3*time.Second), "simulated preparation time")
+	fail := fs.Bool("fail", getEnvBool("INIT_FAIL", false), "exit 1 instead of writing the marker, to see Init:Error and retries")
+	fs.Parse(args)
+
+	setupLogging(getEnv("LOG_LEVEL", "info"))
+	slog.Info("init started", "dir", *dir, "work", work.String())
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		slog.Error("init failed", "error", err)
+		return 1
+	}
+	time.Sleep(*work)
+	if *fail {
+		slog.Error("init failed", "error", "INIT_FAIL is set", "dir", *dir)
+		return 1
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now().UTC().Format(time.RFC3339)
+	config := fmt.Sprintf("# Generated by %s init at %s\nmessage: %s\ninit:\n  pod: %s\n  prepared_at: %s\n  version: %s\n",
+		os.Args[0], now, strconv.Quote("Prepared by init container on "+hostname), hostname, now, buildInfo().Version)
+	if err := writeFileAtomic(filepath.Join(*dir, "config.yaml"), []byte(config)); err != nil {
+		slog.Error("init failed", "error", err)
+		return 1
+	}
+	if err := writeFileAtomic(filepath.Join(*dir, initMarker), []byte(now+"\n")); err != nil {
+		slog.Error("init failed", "error", err)
+		return 1
+	}
+	slog.Info("init completed", "dir", *dir, "files", []string{"config.yaml", initMarker})
+	return 0
+}
+
+// writeFileAtomic writes via a temp file and rename, so a reader never
+// sees half a file
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
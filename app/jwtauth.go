@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Optional JWT bearer authentication for /api/*, off unless a key source
+// is configured:
+//
+//	JWT_HMAC_SECRET=...  (or JWT_HMAC_SECRET_FILE)    HS256/384/512, a shared secret
+//	JWT_JWKS_URL=https://issuer/.well-known/jwks.json  RS*, PS* and ES256/384, public keys
+//	JWT_ISSUER=... JWT_AUDIENCE=...                    checked when set
+//	JWT_REQUIRED_SCOPE=api:read                         every request needs it (403 without)
+//	JWT_WRITE_SCOPE=api:write                           POST, PUT, PATCH and DELETE also need it
+//
+//	curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/whoami   # the validated claims
+//
+// A missing or invalid token is a 401, a valid token without the scope a
+// 403; both carry a WWW-Authenticate header (RFC 6750) and a JSON body
+// with a machine-readable code. The algorithms follow the key source, so
+// an RS256 deployment can't be fooled by a token "signed" with HS256 and
+// the public key, and alg "none" is never accepted.
+//
+// Kubernetes is itself an issuer: projected service account tokens verify
+// against the API server's keys, so pods can call each other with their
+// own identity and no extra IdP:
+//
+//	JWT_JWKS_URL=https://kubernetes.default.svc/openid/v1/jwks
+//	JWT_ISSUER=https://kubernetes.default.svc.cluster.local
+//	JWT_AUDIENCE=go-app    # callers mount a serviceAccountToken volume with this audience
+//
+// That JWKS is fetched with this pod's own token; any authenticated
+// identity may read it by default. Compare with validating at the Ingress
+// (oauth2-proxy and auth-url): the app then only sees headers it has to
+// trust, but never a token it could check itself.
+
+// jwtVerifier checks signatures and standard claims
+type jwtVerifier struct {
+	hmacSecret    []byte
+	jwks          *jwksCache // nil with a shared secret
+	issuer        string
+	audience      string
+	requiredScope string
+	writeScope    string
+	leeway        time.Duration
+}
+
+// jwtAuth is set in main when JWT authentication is configured
+var jwtAuth *jwtVerifier
+
+var authResults = newCounterVec("http_auth_results_total",
+	"JWT authentication outcomes for /api/ requests.", "result")
+
+// newJWTVerifierFromEnv returns nil when no key source is configured
+func newJWTVerifierFromEnv() (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		issuer:        getEnv("JWT_ISSUER", ""),
+		audience:      getEnv("JWT_AUDIENCE", ""),
+		requiredScope: getEnv("JWT_REQUIRED_SCOPE", ""),
+		writeScope:    getEnv("JWT_WRITE_SCOPE", ""),
+		leeway:        getEnvDuration("JWT_LEEWAY", 30*time.Second),
+	}
+	secret := getEnv("JWT_HMAC_SECRET", "")
+	if path := getEnv("JWT_HMAC_SECRET_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+	jwksURL := getEnv("JWT_JWKS_URL", "")
+	switch {
+	case secret != "" && jwksURL != "":
+		return nil, errors.New("set JWT_HMAC_SECRET or JWT_JWKS_URL, not both")
+	case secret != "":
+		if len(secret) < 32 {
+			return nil, errors.New("JWT_HMAC_SECRET must be at least 32 bytes")
+		}
+		v.hmacSecret = []byte(secret)
+	case jwksURL != "":
+		u, err := url.Parse(jwksURL)
+		if err != nil || u.Scheme != "https" && u.Scheme != "http" {
+			return nil, fmt.Errorf("JWT_JWKS_URL %q is not an http(s) URL", jwksURL)
+		}
+		v.jwks = &jwksCache{url: u, refresh: getEnvDuration("JWT_JWKS_REFRESH", 10*time.Minute)}
+	default:
+		return nil, nil
+	}
+	return v, nil
+}
+
+// keySource describes where verification keys come from, for logs
+func (v *jwtVerifier) keySource() string {
+	if v.jwks != nil {
+		return v.jwks.url.String()
+	}
+	return "hmac secret"
+}
+
+// jwtHeader is the JOSE header
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are the standard claims checked here; the token's full claims
+// are kept alongside for handlers
+type jwtClaims struct {
+	Issuer    string  `json:"iss"`
+	Subject   string  `json:"sub"`
+	Audience  jwtAud  `json:"aud"`
+	ExpiresAt float64 `json:"exp"`
+	NotBefore float64 `json:"nbf"`
+	IssuedAt  float64 `json:"iat"`
+	Scope     string  `json:"scope"` // space-separated, OAuth 2.0 style
+	Scp       jwtAud  `json:"scp"`   // a list, Azure AD and Okta style
+}
+
+// verifiedToken is a token that passed every check
+type verifiedToken struct {
+	Alg    string
+	Kid    string
+	Claims jwtClaims
+	Raw    map[string]any
+}
+
+func (t *verifiedToken) hasScope(scope string) bool {
+	return slices.Contains(strings.Fields(t.Claims.Scope), scope) || slices.Contains(t.Claims.Scp, scope)
+}
+
+// Verify checks the signature, then exp, nbf, iss and aud
+func (v *jwtVerifier) Verify(ctx context.Context, token string) (*verifiedToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT (want header.payload.signature)")
+	}
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("signature is not base64url")
+	}
+	if err := v.verifySignature(ctx, header, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	t := &verifiedToken{Alg: header.Alg, Kid: header.Kid}
+	if err := decodeJWTSegment(parts[1], &t.Claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	decodeJWTSegment(parts[1], &t.Raw)
+	now := time.Now()
+	switch {
+	case t.Claims.ExpiresAt == 0:
+		return nil, errors.New("token has no exp claim")
+	case now.After(time.Unix(int64(t.Claims.ExpiresAt), 0).Add(v.leeway)):
+		return nil, fmt.Errorf("token expired at %s", unixTime(t.Claims.ExpiresAt).Format(time.RFC3339))
+	case t.Claims.NotBefore != 0 && now.Add(v.leeway).Before(time.Unix(int64(t.Claims.NotBefore), 0)):
+		return nil, fmt.Errorf("token not valid before %s", unixTime(t.Claims.NotBefore).Format(time.RFC3339))
+	case v.issuer != "" && t.Claims.Issuer != v.issuer:
+		return nil, fmt.Errorf("issuer %q is not %q", t.Claims.Issuer, v.issuer)
+	case v.audience != "" && !slices.Contains(t.Claims.Audience, v.audience):
+		return nil, fmt.Errorf("audience %v does not include %q", []string(t.Claims.Audience), v.audience)
+	}
+	return t, nil
+}
+
+func decodeJWTSegment(segment string, out any) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return errors.New("not base64url")
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return errors.New("not a JSON object")
+	}
+	return nil
+}
+
+// jwtHashes maps the digest size in an alg name to its hash
+var (
+	jwtHashes  = map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	hmacHashes = map[crypto.Hash]func() hash.Hash{crypto.SHA256: sha256.New, crypto.SHA384: sha512.New384, crypto.SHA512: sha512.New}
+)
+
+func (v *jwtVerifier) verifySignature(ctx context.Context, header jwtHeader, signed string, sig []byte) error {
+	if len(header.Alg) != 5 {
+		return fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+	family, hashAlg := header.Alg[:2], jwtHashes[header.Alg[2:]]
+	if hashAlg == 0 {
+		return fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+
+	if v.hmacSecret != nil {
+		if family != "HS" {
+			return fmt.Errorf("alg %s not accepted: this server verifies HS256/384/512 with a shared secret", header.Alg)
+		}
+		mac := hmac.New(hmacHashes[hashAlg], v.hmacSecret)
+		mac.Write([]byte(signed))
+		if subtle.ConstantTimeCompare(mac.Sum(nil), sig) != 1 {
+			return errors.New("signature does not match")
+		}
+		return nil
+	}
+
+	if family == "HS" {
+		return fmt.Errorf("alg %s not accepted: this server verifies public-key signatures from JWT_JWKS_URL", header.Alg)
+	}
+	key, err := v.jwks.key(ctx, header.Kid)
+	if err != nil {
+		return err
+	}
+	h := hashAlg.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch family {
+		case "RS":
+			if rsa.VerifyPKCS1v15(pub, hashAlg, digest, sig) != nil {
+				err = errors.New("signature does not match")
+			}
+		case "PS":
+			if rsa.VerifyPSS(pub, hashAlg, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) != nil {
+				err = errors.New("signature does not match")
+			}
+		default:
+			err = fmt.Errorf("alg %s does not match RSA key %q", header.Alg, header.Kid)
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		switch {
+		case family != "ES":
+			err = fmt.Errorf("alg %s does not match EC key %q", header.Alg, header.Kid)
+		case len(sig) != 2*size:
+			err = errors.New("ECDSA signature has the wrong length")
+		case !ecdsa.Verify(pub, digest, new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])):
+			err = errors.New("signature does not match")
+		}
+	default:
+		err = fmt.Errorf("unsupported key type for %q", header.Kid)
+	}
+	return err
+}
+
+// jwksCache holds the issuer's public keys, refetched every refresh and
+// when a token names a kid it hasn't seen, which is how key rotation
+// reaches the app
+type jwksCache struct {
+	url     *url.URL
+	refresh time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// jwksMinInterval stops tokens with made-up kids from hammering the issuer
+const jwksMinInterval = 30 * time.Second
+
+func (c *jwksCache) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lookup := func() crypto.PublicKey {
+		if kid == "" && len(c.keys) == 1 {
+			for _, k := range c.keys {
+				return k
+			}
+		}
+		return c.keys[kid]
+	}
+	stale := time.Since(c.fetchedAt) > c.refresh
+	if k := lookup(); k != nil && !stale {
+		return k, nil
+	}
+	if stale || time.Since(c.fetchedAt) > jwksMinInterval {
+		if err := c.fetch(ctx); err != nil {
+			if k := lookup(); k != nil {
+				slog.Warn("JWKS refresh failed, using cached keys", "url", c.url.String(), "error", err)
+				return k, nil
+			}
+			return nil, fmt.Errorf("fetching JWKS: %w", err)
+		}
+	}
+	if k := lookup(); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("no key %q in JWKS", kid)
+}
+
+// jwk is one JSON Web Key; only public RSA and EC keys are used
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (c *jwksCache) fetch(ctx context.Context) error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if c.url.Host == "kubernetes.default.svc" || strings.HasPrefix(c.url.Host, "kubernetes.default.svc.") {
+		// The API server's keys, fetched with in-cluster credentials
+		kube, err := inClusterKube()
+		if err != nil {
+			return err
+		}
+		if err := kube.Do(ctx, http.MethodGet, c.url.RequestURI(), nil, &set); err != nil {
+			return err
+		}
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned %s", c.url, resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+			return fmt.Errorf("decoding JWKS: %w", err)
+		}
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		} else {
+			slog.Warn("skipping JWKS key", "kid", k.Kid, "error", err)
+		}
+	}
+	c.keys, c.fetchedAt = keys, time.Now()
+	slog.Info("JWKS fetched", "url", c.url.String(), "keys", len(keys))
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := func(s string) *big.Int {
+		data, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(data)
+	}
+	switch k.Kty {
+	case "RSA":
+		n, e := b64(k.N), b64(k.E)
+		if n.Sign() == 0 || !e.IsInt64() || e.Int64() < 3 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: b64(k.X), Y: b64(k.Y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported kty %q", k.Kty)
+}
+
+// writeAuthError is a problem with the machine-readable code
+// (missing_token, invalid_token or insufficient_scope) and the scope a 403
+// lacks
+func writeAuthError(w http.ResponseWriter, r *http.Request, status int, code, msg, scope string) {
+	challenge := `Bearer realm="api"`
+	if code != "missing_token" { // RFC 6750: no error attribute when no credentials were sent
+		challenge += fmt.Sprintf(`, error=%q, error_description=%q`, code, msg)
+	}
+	ext := map[string]any{"code": code}
+	if scope != "" {
+		challenge += fmt.Sprintf(`, scope=%q`, scope)
+		ext["required_scope"] = scope
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	authResults.Inc(code)
+	sendProblem(w, r, Problem{Status: status, Detail: msg, Extensions: ext})
+}
+
+type jwtKey struct{}
+
+// jwtFromContext returns the request's validated token, or nil
+func jwtFromContext(ctx context.Context) *verifiedToken {
+	t, _ := ctx.Value(jwtKey{}).(*verifiedToken)
+	return t
+}
+
+// authenticate requires a valid bearer token on /api/ routes when
+// JWT authentication is configured
+func authenticate(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if !strings.HasPrefix(pattern, "/api/") {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if jwtAuth == nil {
+			next(w, r)
+			return
+		}
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+			writeAuthError(w, r, http.StatusUnauthorized, "missing_token", "Authorization: Bearer <token> is required", "")
+			return
+		}
+		t, err := jwtAuth.Verify(r.Context(), strings.TrimSpace(token))
+		if err != nil {
+			writeAuthError(w, r, http.StatusUnauthorized, "invalid_token", err.Error(), "")
+			return
+		}
+		missing := ""
+		if s := jwtAuth.requiredScope; s != "" && !t.hasScope(s) {
+			missing = s
+		} else if s := jwtAuth.writeScope; s != "" && !t.hasScope(s) && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			missing = s
+		}
+		if missing != "" {
+			writeAuthError(w, r, http.StatusForbidden, "insufficient_scope", "token lacks scope "+missing, missing)
+			return
+		}
+		authResults.Inc("ok")
+		next(w, r.WithContext(context.WithValue(r.Context(), jwtKey{}, t)))
+	}
+}
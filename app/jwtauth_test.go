@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHMACSecret = "0123456789abcdef0123456789abcdef"
+
+// signJWT builds header.payload.signature, signing with key: a []byte
+// secret for HS256, an *rsa.PrivateKey for RS256, nil for no signature
+func signJWT(t *testing.T, alg string, claims map[string]any, key any) string {
+	t.Helper()
+	segment := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": alg, "typ": "JWT", "kid": "test"}) + "." + segment(claims)
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// testClaims are valid claims for audience go-app, with overrides
+func testClaims(overrides map[string]any) map[string]any {
+	claims := map[string]any{
+		"sub": "alice",
+		"aud": "go-app",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	for k, v := range overrides {
+		claims[k] = v
+	}
+	return claims
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// What an attacker signs HS256 with when the server holds an RSA key
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hmacVerifier := &jwtVerifier{hmacSecret: []byte(testHMACSecret), audience: "go-app"}
+	rsaVerifier := &jwtVerifier{
+		audience: "go-app",
+		jwks: &jwksCache{
+			refresh:   time.Hour,
+			keys:      map[string]crypto.PublicKey{"test": &rsaKey.PublicKey},
+			fetchedAt: time.Now(),
+		},
+	}
+	past, future := time.Now().Add(-time.Hour).Unix(), time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name     string
+		verifier *jwtVerifier
+		token    string
+		wantErr  string // "" for a valid token
+	}{
+		{"HS256 valid", hmacVerifier, signJWT(t, "HS256", testClaims(nil), []byte(testHMACSecret)), ""},
+		{"RS256 valid", rsaVerifier, signJWT(t, "RS256", testClaims(nil), rsaKey), ""},
+		{"alg none", hmacVerifier, signJWT(t, "none", testClaims(nil), nil), "unsupported alg"},
+		{"alg none, RSA server", rsaVerifier, signJWT(t, "none", testClaims(nil), nil), "unsupported alg"},
+		{"HS256 signed with the RSA public key", rsaVerifier, signJWT(t, "HS256", testClaims(nil), publicDER), "not accepted"},
+		{"RS256 to an HMAC server", hmacVerifier, signJWT(t, "RS256", testClaims(nil), rsaKey), "not accepted"},
+		{"expired", hmacVerifier, signJWT(t, "HS256", testClaims(map[string]any{"exp": past}), []byte(testHMACSecret)), "expired"},
+		{"expired within leeway", &jwtVerifier{hmacSecret: []byte(testHMACSecret), leeway: 2 * time.Hour},
+			signJWT(t, "HS256", testClaims(map[string]any{"exp": past}), []byte(testHMACSecret)), ""},
+		{"no exp", hmacVerifier, signJWT(t, "HS256", testClaims(map[string]any{"exp": nil}), []byte(testHMACSecret)), "no exp"},
+		{"not yet valid", hmacVerifier, signJWT(t, "HS256", testClaims(map[string]any{"nbf": future}), []byte(testHMACSecret)), "not valid before"},
+		{"wrong audience", hmacVerifier, signJWT(t, "HS256", testClaims(map[string]any{"aud": "other-app"}), []byte(testHMACSecret)), "audience"},
+		{"audience in a list", hmacVerifier, signJWT(t, "HS256", testClaims(map[string]any{"aud": []string{"other-app", "go-app"}}), []byte(testHMACSecret)), ""},
+		{"wrong issuer", &jwtVerifier{hmacSecret: []byte(testHMACSecret), issuer: "https://issuer"},
+			signJWT(t, "HS256", testClaims(map[string]any{"iss": "https://evil"}), []byte(testHMACSecret)), "issuer"},
+		{"HS256 wrong secret", hmacVerifier, signJWT(t, "HS256", testClaims(nil), []byte("another secret of at least 32 bytes")), "signature does not match"},
+		{"RS256 wrong key", rsaVerifier, signJWT(t, "RS256", testClaims(nil), otherKey), "signature does not match"},
+		{"claims changed after signing", hmacVerifier, func() string {
+			parts := strings.Split(signJWT(t, "HS256", testClaims(nil), []byte(testHMACSecret)), ".")
+			admin := strings.Split(signJWT(t, "HS256", testClaims(map[string]any{"sub": "admin"}), nil), ".")
+			return parts[0] + "." + admin[1] + "." + parts[2]
+		}(), "signature does not match"},
+		{"not a JWT", hmacVerifier, "abc.def", "not a JWT"},
+		{"signature not base64url", hmacVerifier, signJWT(t, "HS256", testClaims(nil), nil) + "!", "not base64url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.verifier.Verify(context.Background(), tt.token)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Verify() error = %v, want a valid token", err)
+			case tt.wantErr == "" && token.Claims.Subject != "alice":
+				t.Errorf("subject = %q, want alice", token.Claims.Subject)
+			case tt.wantErr != "" && err == nil:
+				t.Fatalf("Verify() accepted the token, want an error containing %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("Verify() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
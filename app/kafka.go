@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// kafkaBroker publishes and consumes with segmentio/kafka-go. Subjects are
+// topics, created on first publish when the cluster allows it.
+//
+// Kafka has no broadcast subscription: every consumer reads as part of a
+// consumer group, and a group shares the topic's partitions among its
+// members. A queue group is that, named; without one each pod joins a
+// group of its own (go-demo-<pod>), so every pod gets every message. Those
+// per-pod groups start at the newest offset and outlive the pod on the
+// brokers, until Kafka expires them (offsets.retention.minutes).
+type kafkaBroker struct {
+	brokers []string
+	dialer  *kafka.Dialer
+	writer  *kafka.Writer
+
+	connected atomic.Bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// newKafkaBroker connects to hosts, the bootstrap servers listed in the
+// URL (kafka://kafka-0:9092,kafka-1:9092), port 9092 by default. A
+// user:pass@ in u authenticates with SASL/PLAIN; there is no TLS.
+func newKafkaBroker(u *url.URL, hosts []string) (*kafkaBroker, error) {
+	var brokers []string
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "9092")
+		}
+		brokers = append(brokers, host)
+	}
+	if len(brokers) == 0 {
+		return nil, errors.New("kafka:// needs at least one broker, like kafka://kafka:9092")
+	}
+
+	dialer := &kafka.Dialer{Timeout: 5 * time.Second, ClientID: getEnv("APP_NAME", "go-demo-app")}
+	transport := &kafka.Transport{DialTimeout: 5 * time.Second, ClientID: dialer.ClientID}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		mechanism := plain.Mechanism{Username: u.User.Username(), Password: pass}
+		dialer.SASLMechanism, transport.SASL = mechanism, mechanism
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &kafkaBroker{
+		brokers: brokers,
+		dialer:  dialer,
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Balancer:               &kafka.LeastBytes{},
+			RequiredAcks:           kafka.RequireOne,
+			BatchTimeout:           10 * time.Millisecond, // the default second would delay every /api/publish
+			AllowAutoTopicCreation: true,
+			Transport:              transport,
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	b.wg.Add(1)
+	go b.watch()
+	return b, nil
+}
+
+// watch checks every 10 seconds that a broker answers, for Connected:
+// kafka-go dials per request and has no connection state to report
+func (b *kafkaBroker) watch() {
+	defer b.wg.Done()
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+	for {
+		b.probe()
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (b *kafkaBroker) probe() {
+	for _, addr := range b.brokers {
+		conn, err := b.dialer.DialContext(b.ctx, "tcp", addr)
+		if err != nil {
+			continue
+		}
+		_, err = conn.ApiVersions()
+		conn.Close()
+		if err == nil {
+			if !b.connected.Swap(true) {
+				slog.Info("broker connected", "addr", addr)
+			}
+			return
+		}
+	}
+	if b.connected.Swap(false) {
+		slog.Warn("broker connection lost", "brokers", strings.Join(b.brokers, ","))
+	}
+}
+
+func (b *kafkaBroker) Publish(ctx context.Context, subject string, data []byte) error {
+	err := b.writer.WriteMessages(ctx, kafka.Message{Topic: subject, Value: data})
+	if err != nil && ctx.Err() == nil {
+		b.connected.Store(false) // until the next probe says otherwise
+	}
+	return err
+}
+
+// Subscribe consumes subject in the background until Close, committing
+// each message's offset once handled
+func (b *kafkaBroker) Subscribe(subject, queue string, handle func(string, []byte)) error {
+	group := queue
+	if group == "" {
+		hostname, _ := os.Hostname()
+		group = "go-demo-" + hostname
+	}
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     b.brokers,
+		GroupID:     group,
+		Topic:       subject,
+		Dialer:      b.dialer,
+		StartOffset: kafka.LastOffset, // a new group skips the topic's history
+		MaxWait:     time.Second,
+	})
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer r.Close()
+		for attempt := 0; ; {
+			m, err := r.FetchMessage(b.ctx)
+			if err == nil {
+				handle(m.Topic, m.Value)
+				err = r.CommitMessages(b.ctx, m)
+			}
+			if b.ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				wait := backoff(min(attempt, 5), 500*time.Millisecond, 15*time.Second)
+				attempt++
+				slog.Warn("broker read failed, retrying", "topic", subject, "group", group, "error", err, "retry_in", wait.Round(time.Millisecond).String())
+				select {
+				case <-time.After(wait):
+				case <-b.ctx.Done():
+					return
+				}
+				continue
+			}
+			attempt = 0
+		}
+	}()
+	return nil
+}
+
+func (b *kafkaBroker) Connected() bool { return b.connected.Load() }
+
+func (b *kafkaBroker) Close() {
+	b.closeOnce.Do(func() {
+		b.cancel()
+		b.wg.Wait()
+		b.writer.Close()
+	})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kubeClient talks to the Kubernetes API server from inside a pod, using
+// the service account credentials the kubelet mounts into every container.
+// It is a thin JSON-over-HTTPS wrapper, kept for the lessons that show
+// "the Kubernetes API" is just REST: every call here can be reproduced
+// with curl and the same token. Leader election (leader.go) uses client-go
+// instead, as the state machine there is the point rather than the wire.
+type kubeClient struct {
+	host      string // https://host:port
+	namespace string // the pod's own namespace
+	tokenFile string
+	http      *http.Client
+}
+
+// kubeObjectMeta is the subset of ObjectMeta the app reads or writes
+type kubeObjectMeta struct {
+	Name              string            `json:"name,omitempty"`
+	Namespace         string            `json:"namespace,omitempty"`
+	UID               string            `json:"uid,omitempty"`
+	ResourceVersion   string            `json:"resourceVersion,omitempty"`
+	Generation        int64             `json:"generation,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	CreationTimestamp string            `json:"creationTimestamp,omitempty"`
+}
+
+// kubeAPIError is a non-2xx answer from the API server (a metav1.Status)
+type kubeAPIError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *kubeAPIError) Error() string {
+	return fmt.Sprintf("kubernetes API %d %s: %s", e.Code, e.Reason, e.Message)
+}
+
+// isKubeStatus reports whether err is an API error with the given HTTP code,
+// e.g. http.StatusNotFound or http.StatusConflict
+func isKubeStatus(err error, code int) bool {
+	var apiErr *kubeAPIError
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// errNotInCluster is returned when there is no API server to talk to
+var errNotInCluster = errors.New("not running in a Kubernetes cluster (KUBERNETES_SERVICE_HOST unset)")
+
+var (
+	kubeOnce   sync.Once
+	kubeShared *kubeClient
+	kubeErr    error
+)
+
+// inClusterKube returns the process-wide API client, created on first use
+func inClusterKube() (*kubeClient, error) {
+	kubeOnce.Do(func() { kubeShared, kubeErr = newInClusterKubeClient() })
+	return kubeShared, kubeErr
+}
+
+// newInClusterKubeClient builds a client from the pod's service account
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := getEnv("KUBERNETES_SERVICE_HOST", ""), getEnv("KUBERNETES_SERVICE_PORT", "")
+	if host == "" {
+		return nil, errNotInCluster
+	}
+	if port == "" {
+		port = "443"
+	}
+	pool, err := loadCertPool(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("service account CA: %w", err)
+	}
+	namespace := getEnv("POD_NAMESPACE", "")
+	if data, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil && namespace == "" {
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return &kubeClient{
+		host:      "https://" + net.JoinHostPort(host, port),
+		namespace: namespace,
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		http: &http.Client{
+			Transport: tracingTransport{base: transport},
+			Timeout:   10 * time.Second,
+		},
+	}, nil
+}
+
+// Do sends a request to path (e.g. /api/v1/namespaces/x/pods), encoding
+// body as JSON when non-nil and decoding the response into out when non-nil
+func (c *kubeClient) Do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := c.newRequest(ctx, method, path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return readKubeAPIError(resp)
+	}
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// newRequest builds an authenticated request to path
+func (c *kubeClient) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.host+path, body)
+	if err != nil {
+		return nil, err
+	}
+	// Bound service account tokens are rotated by the kubelet, so read the
+	// file every time rather than caching it at startup
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// readKubeAPIError turns a non-2xx response into a *kubeAPIError
+func readKubeAPIError(resp *http.Response) error {
+	apiErr := &kubeAPIError{Code: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+	apiErr.Code = resp.StatusCode
+	return apiErr
+}
+
+// kubeWatchEvent is one line of a ?watch=true stream. Object is an ERROR's
+// metav1.Status, or the changed object for ADDED, MODIFIED, DELETED and
+// BOOKMARK.
+type kubeWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Watch streams the watch at path (which must carry watch=true), calling
+// fn for each event until the server ends the watch, ctx is done or fn
+// returns an error. Watches outlive the client's request timeout, so the
+// server-side timeoutSeconds in path is what bounds them.
+func (c *kubeClient) Watch(ctx context.Context, path string, fn func(kubeWatchEvent) error) error {
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: c.http.Transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return readKubeAPIError(resp)
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event kubeWatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
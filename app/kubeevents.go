@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kubernetes Events attached to our own pod tell the app's side of the
+// story next to the kubelet's, in the same places learners already look:
+//
+//	kubectl describe pod <pod>      # Events: at the bottom
+//	kubectl get events -n go-demo --field-selector involvedObject.name=<pod> -w
+//
+// We emit them for startup complete, readiness toggled through
+// /admin/ready, a drain started and every /chaos call. It needs a Role
+// rule to create events (k8s/advanced/rbac.yaml); without one the first
+// failure is logged and the recorder turns itself off. KUBE_EVENTS=false
+// disables it. Events are posted in the background so a slow API server
+// never holds up a request, and terminate flushes them before exiting.
+
+// podEventBacklog is how many events may wait to be posted
+const podEventBacklog = 32
+
+// kubeEvent is the subset of a core/v1 Event the app creates
+type kubeEvent struct {
+	APIVersion     string         `json:"apiVersion"`
+	Kind           string         `json:"kind"`
+	Metadata       kubeObjectMeta `json:"metadata"`
+	InvolvedObject struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Name       string `json:"name"`
+		Namespace  string `json:"namespace"`
+		UID        string `json:"uid,omitempty"`
+	} `json:"involvedObject"`
+	Type   string `json:"type"` // Normal or Warning
+	Reason string `json:"reason"`
+	// Message is what kubectl describe shows
+	Message string `json:"message"`
+	Source  struct {
+		Component string `json:"component"`
+		Host      string `json:"host,omitempty"`
+	} `json:"source"`
+	ReportingComponent string    `json:"reportingComponent"`
+	ReportingInstance  string    `json:"reportingInstance"`
+	FirstTimestamp     time.Time `json:"firstTimestamp"`
+	LastTimestamp      time.Time `json:"lastTimestamp"`
+	Count              int       `json:"count"`
+}
+
+// podEventRecorder posts Events about this pod
+type podEventRecorder struct {
+	once    sync.Once
+	kube    *kubeClient
+	pod     string
+	uid     string
+	app     string // APP_NAME, the reporting component
+	events  chan kubeEvent
+	pending sync.WaitGroup
+	mu      sync.Mutex
+	off     bool
+}
+
+var podEvents = &podEventRecorder{}
+
+// start connects on first use; it leaves the recorder off outside a
+// cluster or when KUBE_EVENTS=false
+func (p *podEventRecorder) start() {
+	p.once.Do(func() {
+		kube, err := inClusterKube()
+		if err != nil || !getEnvBool("KUBE_EVENTS", true) {
+			p.off = true
+			return
+		}
+		p.kube = kube
+		p.pod = getEnv("POD_NAME", "")
+		if p.pod == "" {
+			p.pod, _ = os.Hostname()
+		}
+		p.uid = getEnv("POD_UID", "")
+		p.app = getEnv("APP_NAME", "go-demo-app")
+		p.events = make(chan kubeEvent, podEventBacklog)
+		go p.run()
+	})
+}
+
+// Record queues an Event of type Normal or Warning; it never blocks
+func (p *podEventRecorder) Record(eventType, reason, message string) {
+	p.start()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.off {
+		return
+	}
+	now := time.Now().UTC()
+	e := kubeEvent{APIVersion: "v1", Kind: "Event", Type: eventType, Reason: reason, Message: message,
+		ReportingComponent: p.app, ReportingInstance: p.pod, FirstTimestamp: now, LastTimestamp: now, Count: 1}
+	e.Metadata = kubeObjectMeta{Name: p.pod + "." + strconv.FormatInt(now.UnixNano(), 16), Namespace: p.kube.namespace}
+	e.Source.Component, e.Source.Host = p.app, getEnv("NODE_NAME", "")
+	p.pending.Add(1)
+	select {
+	case p.events <- e:
+	default:
+		p.pending.Done()
+		slog.Debug("kubernetes event dropped, backlog full", "reason", reason)
+	}
+}
+
+func (p *podEventRecorder) run() {
+	for e := range p.events {
+		p.post(e)
+		p.pending.Done()
+	}
+}
+
+func (p *podEventRecorder) post(e kubeEvent) {
+	p.mu.Lock()
+	off := p.off
+	p.mu.Unlock()
+	if off {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if p.uid == "" {
+		// kubectl describe matches events on the pod's UID, which only
+		// the API knows unless POD_UID comes from the Downward API
+		var pod kubePod
+		if err := p.kube.Do(ctx, http.MethodGet, "/api/v1/namespaces/"+p.kube.namespace+"/pods/"+p.pod, nil, &pod); err == nil {
+			p.uid = pod.Metadata.UID
+		}
+	}
+	e.InvolvedObject.APIVersion, e.InvolvedObject.Kind = "v1", "Pod"
+	e.InvolvedObject.Name, e.InvolvedObject.Namespace, e.InvolvedObject.UID = p.pod, p.kube.namespace, p.uid
+
+	err := p.kube.Do(ctx, http.MethodPost, "/api/v1/namespaces/"+p.kube.namespace+"/events", e, nil)
+	if err == nil {
+		slog.Debug("kubernetes event posted", "reason", e.Reason)
+		return
+	}
+	if isKubeStatus(err, http.StatusForbidden) || isKubeStatus(err, http.StatusUnauthorized) {
+		p.mu.Lock()
+		p.off = true
+		p.mu.Unlock()
+		slog.Warn("cannot create Kubernetes events, turning them off (see k8s/advanced/rbac.yaml)", "error", err)
+		return
+	}
+	slog.Warn("kubernetes event not posted", "reason", e.Reason, "error", err)
+}
+
+// Flush waits up to timeout for queued events, before the process exits
+func (p *podEventRecorder) Flush(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		p.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// recordChaosEvent wraps a /chaos handler to emit a Warning event per call
+func recordChaosEvent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Path
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		podEvents.Record("Warning", "ChaosTriggered", r.Method+" "+target+" from "+r.RemoteAddr)
+		handler(w, r)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// The key-value store that raft.go replicates. Every member applies the
+// same committed log, so any pod answers a read from its own copy - a
+// follower's can be a heartbeat behind. Writes go to the leader, which a
+// follower forwards them to, and answer once a quorum has them:
+//
+//	curl -X PUT --data blue localhost:8080/api/kv/color   # 200 once committed
+//	curl localhost:8080/api/kv/color                       # from whichever pod answers
+//	curl localhost:8080/api/kv/                            # every key
+//	curl -X DELETE localhost:8080/api/kv/color
+//
+// KV_WRITE_TIMEOUT (5s) bounds the wait for a quorum. Past it the write
+// answers 503, and may still commit later if the leader gets through: the
+// client can't tell, as with any replicated store.
+
+// maxKVValue bounds a PUT body
+const maxKVValue = 64 << 10
+
+// KVEntry is one key and the log index that last wrote it
+type KVEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Index uint64 `json:"index"`
+}
+
+// KVResponse is returned by /api/kv/{key}
+type KVResponse struct {
+	KVEntry
+	Op          string `json:"op,omitempty"` // put or delete, for writes
+	ServedBy    string `json:"served_by"`
+	Leader      string `json:"leader,omitempty"`
+	State       string `json:"state"`
+	CommitIndex uint64 `json:"commit_index"`
+	ForwardedBy string `json:"forwarded_by,omitempty"` // the follower that passed the write on
+}
+
+// KVListResponse is returned by GET /api/kv/
+type KVListResponse struct {
+	ServedBy    string    `json:"served_by"`
+	Leader      string    `json:"leader,omitempty"`
+	State       string    `json:"state"`
+	CommitIndex uint64    `json:"commit_index"`
+	Keys        []KVEntry `json:"keys"`
+}
+
+// kvCommand is one write, as it travels in the Raft log
+type kvCommand struct {
+	Op    string `json:"op"` // put or delete
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// kvState is the replicated state machine, hashicorp/raft's FSM
+type kvState struct {
+	mu   sync.RWMutex
+	data map[string]KVEntry
+}
+
+var (
+	kvStore = &kvState{data: map[string]KVEntry{}}
+
+	kvWrites = newCounterVec("kv_writes_total",
+		"Writes to the Raft kv store handled on this pod, by result (committed, forwarded, no_leader, timeout).", "result")
+)
+
+// Apply runs one committed entry; raft calls it in log order
+func (s *kvState) Apply(l *raft.Log) any {
+	var c kvCommand
+	if err := json.Unmarshal(l.Data, &c); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch c.Op {
+	case "put":
+		s.data[c.Key] = KVEntry{Key: c.Key, Value: c.Value, Index: l.Index}
+	case "delete":
+		delete(s.data, c.Key)
+	}
+	return nil
+}
+
+// Snapshot copies the data for the library to persist, which it does
+// while Apply goes on
+func (s *kvState) Snapshot() (raft.FSMSnapshot, error) {
+	return kvSnapshot(s.list()), nil
+}
+
+// Restore replaces the data with a snapshot's, on a restart or when the
+// leader sends one to a member too far behind
+func (s *kvState) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var entries []KVEntry
+	if err := json.NewDecoder(rc).Decode(&entries); err != nil {
+		return err
+	}
+	data := make(map[string]KVEntry, len(entries))
+	for _, e := range entries {
+		data[e.Key] = e
+	}
+	s.mu.Lock()
+	s.data = data
+	s.mu.Unlock()
+	return nil
+}
+
+// kvSnapshot is the store at one index, written as a JSON array
+type kvSnapshot []KVEntry
+
+func (k kvSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(k); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (k kvSnapshot) Release() {}
+
+func (s *kvState) get(key string) (KVEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.data[key]
+	return e, ok
+}
+
+func (s *kvState) list() []KVEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := make([]KVEntry, 0, len(s.data))
+	for _, e := range s.data {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// kvForwardClient passes writes on to the leader, traced like any call
+var kvForwardClient = &http.Client{Transport: tracingTransport{base: http.DefaultTransport}}
+
+// kvHandler serves GET, PUT and DELETE /api/kv/{key}, and GET /api/kv/
+func kvHandler(w http.ResponseWriter, r *http.Request) {
+	n := kvRaft
+	if n == nil {
+		writeProblem(w, r, http.StatusNotFound, "the kv store is off on this pod (KV_RAFT=true)")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/api/kv/")
+	status := n.Status()
+	hostname, _ := os.Hostname()
+
+	switch r.Method {
+	case http.MethodGet:
+		if key == "" {
+			writeJSON(w, http.StatusOK, KVListResponse{ServedBy: hostname, Leader: status.Leader, State: status.State,
+				CommitIndex: status.CommitIndex, Keys: kvStore.list()})
+			return
+		}
+		e, ok := kvStore.get(key)
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, "no such key: "+key)
+			return
+		}
+		writeJSON(w, http.StatusOK, KVResponse{KVEntry: e, ServedBy: hostname, Leader: status.Leader,
+			State: status.State, CommitIndex: status.CommitIndex})
+	case http.MethodPut, http.MethodDelete:
+		if key == "" {
+			writeProblem(w, r, http.StatusBadRequest, "name a key: /api/kv/{key}")
+			return
+		}
+		entry := kvCommand{Op: "delete", Key: key}
+		var body []byte
+		if r.Method == http.MethodPut {
+			var err error
+			if body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxKVValue)); err != nil {
+				writeProblem(w, r, http.StatusRequestEntityTooLarge, "values are limited to 64KiB")
+				return
+			}
+			entry.Op, entry.Value = "put", string(body)
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), getEnvDuration("KV_WRITE_TIMEOUT", 5*time.Second))
+		defer cancel()
+		cmd, _ := json.Marshal(entry)
+		index, err := n.Propose(ctx, cmd)
+		switch {
+		case errors.Is(err, errNotLeader):
+			kvForward(w, r, n, body)
+		case err != nil:
+			kvWrites.Inc("timeout")
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, r, http.StatusServiceUnavailable, "write not committed: "+err.Error())
+		default:
+			kvWrites.Inc("committed")
+			status = n.Status()
+			writeJSON(w, http.StatusOK, KVResponse{KVEntry: KVEntry{Key: key, Value: entry.Value, Index: index}, Op: entry.Op,
+				ServedBy: hostname, Leader: status.Leader, State: status.State, CommitIndex: status.CommitIndex,
+				ForwardedBy: r.Header.Get("X-Raft-Forwarded-By")})
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeProblem(w, r, http.StatusMethodNotAllowed, "use GET, PUT or DELETE")
+	}
+}
+
+// kvForward sends a write a follower got to the leader, once: a request
+// already forwarded isn't passed on again while the leadership settles
+func kvForward(w http.ResponseWriter, r *http.Request, n *raftNode, body []byte) {
+	leader, addr := n.Leader()
+	if addr == "" || r.Header.Get("X-Raft-Forwarded-By") != "" {
+		kvWrites.Inc("no_leader")
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, r, http.StatusServiceUnavailable, "no leader to take the write, an election may be under way")
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, "http://"+addr+r.URL.Path, bytes.NewReader(body))
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	req.Header.Set("X-Raft-Forwarded-By", n.id)
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := kvForwardClient.Do(req)
+	if err != nil {
+		kvWrites.Inc("no_leader")
+		writeProblem(w, r, http.StatusBadGateway, "leader "+leader+" unreachable: "+err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	kvWrites.Inc("forwarded")
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.Header().Set("X-Raft-Leader", leader)
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		w.Header().Set("Retry-After", v)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
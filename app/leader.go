@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	coordinationv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+// Leader election on a coordination.k8s.io/v1 Lease with client-go's
+// leaderelection package, the same code kube-controller-manager and most
+// operators run. Every replica tries to hold the Lease; the holder renews
+// it every few seconds, and when it stops (crash, kubectl delete pod,
+// network partition) another replica takes over once the lease expires.
+// Watch it happen with:
+//
+//	kubectl get lease go-app-leader -n go-demo -w
+//
+// The service account needs get/create/update on leases
+// (see k8s/advanced/rbac.yaml).
+
+// Timings are client-go's recommended defaults; shards.go uses them too
+const (
+	leaseDuration = 15 * time.Second // how long a lease is valid without renewal
+	renewDeadline = 10 * time.Second // leader gives up if it can't renew for this long
+	leaseRetry    = 2 * time.Second  // how often everyone tries to acquire/renew
+)
+
+// leaderElector competes for one Lease on behalf of this pod
+type leaderElector struct {
+	name      string
+	namespace string
+	identity  string
+	lock      resourcelock.Interface
+	done      chan struct{} // closed when Run returns
+
+	mu          sync.Mutex
+	leader      string
+	isLeader    bool
+	renewedAt   time.Time
+	transitions int
+	lastError   string
+}
+
+// LeaderStatus is returned by /api/leader
+type LeaderStatus struct {
+	Enabled     bool       `json:"enabled"`
+	Lease       string     `json:"lease,omitempty"`
+	Identity    string     `json:"identity,omitempty"`
+	Leader      string     `json:"leader,omitempty"`
+	IsLeader    bool       `json:"is_leader"`
+	RenewedAt   *time.Time `json:"renewed_at,omitempty"`
+	Transitions int        `json:"transitions"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// elector is nil unless ENABLE_LEADER_ELECTION is set
+var elector *leaderElector
+
+func init() {
+	newGaugeFunc("leader_election_is_leader", "1 while this pod holds the leader Lease.", func() float64 {
+		if elector != nil && elector.Status().IsLeader {
+			return 1
+		}
+		return 0
+	})
+}
+
+func newLeaderElector(kube *kubeClient, name string) (*leaderElector, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper { return tracingTransport{base: rt} }
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	klog.SetSlogLogger(slog.Default()) // client-go logs through klog
+	identity, _ := os.Hostname()
+	return newLeaseElector(client.CoordinationV1(), kube.namespace, name, identity), nil
+}
+
+// newLeaseElector competes for namespace/name as identity
+func newLeaseElector(leases coordinationv1.LeasesGetter, namespace, name, identity string) *leaderElector {
+	le := &leaderElector{name: name, namespace: namespace, identity: identity, done: make(chan struct{})}
+	le.lock = observedLease{le: le, Interface: &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Client:     leases,
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}}
+	return le
+}
+
+// Run stands for election until ctx ends, then gives the lease up if it
+// holds it. client-go's elector returns when it loses the lease; it
+// stands again right away.
+func (le *leaderElector) Run(ctx context.Context) {
+	defer close(le.done)
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            le.lock,
+		Name:            le.name,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     leaseRetry,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) { le.setLeading(true) },
+			OnStoppedLeading: func() { le.setLeading(false) },
+			OnNewLeader:      le.newLeader,
+		},
+	})
+	if err != nil {
+		slog.Error("leader election not started", "lease", le.name, "error", err)
+		le.mu.Lock()
+		le.lastError = err.Error()
+		le.mu.Unlock()
+		return
+	}
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+}
+
+func (le *leaderElector) setLeading(leading bool) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.isLeader = leading
+	if leading {
+		slog.Info("became leader", "lease", le.name, "identity", le.identity)
+	} else {
+		slog.Warn("lost leadership", "lease", le.name)
+	}
+}
+
+func (le *leaderElector) newLeader(identity string) {
+	if identity != le.identity {
+		slog.Info("new leader observed", "lease", le.name, "leader", identity)
+	}
+}
+
+// observedLease records what the elector reads and writes, for Status:
+// client-go keeps the holder's renewals and the transitions to itself
+type observedLease struct {
+	resourcelock.Interface
+	le *leaderElector
+}
+
+func (o observedLease) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	record, raw, err := o.Interface.Get(ctx)
+	o.le.observe(record, err)
+	return record, raw, err
+}
+
+func (o observedLease) Create(ctx context.Context, record resourcelock.LeaderElectionRecord) error {
+	err := o.Interface.Create(ctx, record)
+	o.le.observe(&record, err)
+	return err
+}
+
+func (o observedLease) Update(ctx context.Context, record resourcelock.LeaderElectionRecord) error {
+	err := o.Interface.Update(ctx, record)
+	o.le.observe(&record, err)
+	return err
+}
+
+// observe records a Lease read or written, or the error doing so. A Lease
+// that doesn't exist yet is no error: the elector creates it.
+func (le *leaderElector) observe(record *resourcelock.LeaderElectionRecord, err error) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			le.lastError = err.Error()
+		}
+		return
+	}
+	le.lastError = ""
+	le.leader = record.HolderIdentity
+	le.transitions = record.LeaderTransitions
+	if record.HolderIdentity == le.identity {
+		le.renewedAt = record.RenewTime.Time
+	}
+}
+
+// Release waits for Run, whose context was cancelled, to give up the lease
+// so another replica can take over right away instead of waiting for it to
+// expire
+func (le *leaderElector) Release(ctx context.Context) {
+	select {
+	case <-le.done:
+		slog.Info("left the election", "lease", le.name)
+	case <-ctx.Done():
+		slog.Warn("lease release timed out", "lease", le.name)
+	}
+}
+
+// Status reports the current view of the election
+func (le *leaderElector) Status() LeaderStatus {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	status := LeaderStatus{
+		Enabled:     true,
+		Lease:       le.namespace + "/" + le.name,
+		Identity:    le.identity,
+		Leader:      le.leader,
+		IsLeader:    le.isLeader,
+		Transitions: le.transitions,
+		Error:       le.lastError,
+	}
+	if le.isLeader {
+		renewed := le.renewedAt
+		status.RenewedAt = &renewed
+	}
+	return status
+}
+
+// leaderHandler shows who currently leads
+func leaderHandler(w http.ResponseWriter, r *http.Request) {
+	if elector == nil {
+		writeJSON(w, http.StatusOK, LeaderStatus{Enabled: false})
+		return
+	}
+	writeJSON(w, http.StatusOK, elector.Status())
+}
+
+// leaderLabel is the home page row for the current leader, "" when
+// leader election is off
+func leaderLabel() string {
+	if elector == nil {
+		return ""
+	}
+	status := elector.Status()
+	value := status.Leader
+	if value == "" {
+		value = "none yet"
+	}
+	if status.IsLeader {
+		value += " (this pod)"
+	}
+	return value
+}
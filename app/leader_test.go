@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// waitFor polls cond for up to twice the lease duration
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * leaseDuration); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestLeaderElectionHandsOverOnRelease(t *testing.T) {
+	leases := fake.NewClientset().CoordinationV1()
+	first := newLeaseElector(leases, "go-demo", "go-app-leader", "pod-a")
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	defer stopFirst()
+	go first.Run(firstCtx)
+	waitFor(t, "pod-a to lead", func() bool { return first.Status().IsLeader })
+
+	second := newLeaseElector(leases, "go-demo", "go-app-leader", "pod-b")
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	defer stopSecond()
+	go second.Run(secondCtx)
+	waitFor(t, "pod-b to see pod-a", func() bool { return second.Status().Leader == "pod-a" })
+	if s := second.Status(); s.IsLeader || s.RenewedAt != nil {
+		t.Errorf("pod-b status %+v while pod-a leads", s)
+	}
+
+	// Released on shutdown, the lease goes to pod-b well before it expires
+	released := time.Now()
+	stopFirst()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	first.Release(ctx)
+	if first.Status().IsLeader {
+		t.Error("pod-a still leads after Release")
+	}
+	waitFor(t, "pod-b to lead", func() bool { return second.Status().IsLeader })
+	if took := time.Since(released); took >= leaseDuration {
+		t.Errorf("handover took %v, as long as waiting for the lease to expire", took)
+	}
+	if s := second.Status(); s.Leader != "pod-b" || s.Transitions != 1 || s.RenewedAt == nil {
+		t.Errorf("pod-b status %+v, want it leading after one transition", s)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load generation endpoints for HorizontalPodAutoscaler demos. Unlike the
+// chaos endpoints these are well-behaved: bounded, cancellable, and they
+// report what they are doing. Starting load takes a POST, like the chaos
+// triggers, so a link unfurler or prefetcher following a URL can't.
+
+// Limits keep a typo from pinning a node for hours
+const (
+	maxLoadDuration = 10 * time.Minute
+	maxLoadWorkers  = 64
+	maxLoadMemoryMB = 4096
+)
+
+var (
+	// cpuLoadWorkers is the number of goroutines currently burning CPU
+	cpuLoadWorkers atomic.Int64
+	// memoryHeldBytes is the memory currently retained by /api/load/memory
+	memoryHeldBytes atomic.Int64
+)
+
+func init() {
+	newGaugeFunc("load_cpu_active_workers", "Goroutines currently generating CPU load.",
+		func() float64 { return float64(cpuLoadWorkers.Load()) })
+	newGaugeFunc("load_memory_held_bytes", "Bytes currently retained by the memory load endpoint.",
+		func() float64 { return float64(memoryHeldBytes.Load()) })
+}
+
+// CPULoadProgress is streamed once per second while load runs
+type CPULoadProgress struct {
+	Elapsed    string `json:"elapsed"`
+	Remaining  string `json:"remaining"`
+	Workers    int    `json:"workers"`
+	Iterations int64  `json:"iterations"`
+	Done       bool   `json:"done"`
+	Cancelled  bool   `json:"cancelled,omitempty"`
+}
+
+// cpuLoadHandler burns CPU on N goroutines, e.g.
+// POST /api/load/cpu?duration=30s&workers=4, streaming NDJSON progress
+// lines. Closing the connection (Ctrl+C on curl) stops the load immediately.
+func cpuLoadHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if r.URL.Query().Get("duration") == "" {
+		duration, err = 30*time.Second, nil
+	}
+	if err != nil || duration <= 0 || duration > maxLoadDuration {
+		writeProblem(w, r, http.StatusBadRequest, "duration must be a Go duration between 0 and "+maxLoadDuration.String())
+		return
+	}
+	workers := 1
+	if v := r.URL.Query().Get("workers"); v != "" {
+		workers, err = strconv.Atoi(v)
+		if err != nil || workers < 1 || workers > maxLoadWorkers {
+			writeProblem(w, r, http.StatusBadRequest, "workers must be between 1 and "+strconv.Itoa(maxLoadWorkers))
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), duration)
+	defer cancel()
+
+	slog.Info("cpu load started", "duration", duration.String(), "workers", workers)
+	var iterations atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		cpuLoadWorkers.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cpuLoadWorkers.Add(-1)
+			burnCPU(ctx, &iterations)
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	start := time.Now()
+	progress := func(done bool) CPULoadProgress {
+		elapsed := time.Since(start).Round(time.Second)
+		remaining := max((duration - elapsed).Round(time.Second), 0)
+		return CPULoadProgress{
+			Elapsed:    elapsed.String(),
+			Remaining:  remaining.String(),
+			Workers:    workers,
+			Iterations: iterations.Load(),
+			Done:       done,
+		}
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			enc.Encode(progress(false))
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-ctx.Done():
+			wg.Wait()
+			final := progress(true)
+			final.Cancelled = r.Context().Err() != nil
+			enc.Encode(final)
+			slog.Info("cpu load finished", "iterations", final.Iterations, "cancelled", final.Cancelled)
+			return
+		}
+	}
+}
+
+// burnCPU spins until ctx is done, counting work done in chunks
+func burnCPU(ctx context.Context, iterations *atomic.Int64) {
+	x := 0.0
+	for ctx.Err() == nil {
+		for i := 0; i < 100_000; i++ {
+			x += float64(i) * 1.0000001
+		}
+		iterations.Add(1)
+	}
+	_ = x
+}
+
+// MemoryStats reports process memory as the kernel and the Go runtime see it
+type MemoryStats struct {
+	RSSBytes       int64  `json:"rss_bytes"`
+	HeapAllocBytes uint64 `json:"heap_alloc_bytes"`
+	HeapSysBytes   uint64 `json:"heap_sys_bytes"`
+	SysBytes       uint64 `json:"sys_bytes"`
+	HeldBytes      int64  `json:"held_bytes"`
+	NumGC          uint32 `json:"num_gc"`
+}
+
+// MemoryLoadResponse is returned by /api/load/memory
+type MemoryLoadResponse struct {
+	AllocatedMB int         `json:"allocated_mb,omitempty"`
+	Hold        string      `json:"hold,omitempty"`
+	Memory      MemoryStats `json:"memory"`
+}
+
+// memoryLoadHandler allocates and retains memory, e.g.
+// POST /api/load/memory?mb=256&hold=60s, then frees it once the hold expires.
+// Ask for more than the container's memory limit and the kernel OOM-kills
+// the process: the pod shows "OOMKilled" and restarts. A GET only
+// reports current memory usage.
+func memoryLoadHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("mb") == "" && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusOK, MemoryLoadResponse{Memory: readMemoryStats()})
+		return
+	}
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	mb, err := strconv.Atoi(q.Get("mb"))
+	if err != nil || mb < 1 || mb > maxLoadMemoryMB {
+		writeProblem(w, r, http.StatusBadRequest, "mb must be between 1 and "+strconv.Itoa(maxLoadMemoryMB))
+		return
+	}
+	hold := 60 * time.Second
+	if q.Get("hold") != "" {
+		hold, err = time.ParseDuration(q.Get("hold"))
+		if err != nil || hold <= 0 || hold > maxLoadDuration {
+			writeProblem(w, r, http.StatusBadRequest, "hold must be a Go duration between 0 and "+maxLoadDuration.String())
+			return
+		}
+	}
+
+	blocks := make([][]byte, mb)
+	for i := range blocks {
+		blocks[i] = make([]byte, 1<<20)
+		// Write to every page so it counts towards RSS (and the cgroup limit)
+		for j := 0; j < len(blocks[i]); j += 4096 {
+			blocks[i][j] = 1
+		}
+	}
+	size := int64(mb) << 20
+	memoryHeldBytes.Add(size)
+	slog.Info("memory load allocated", "mb", mb, "hold", hold.String())
+
+	go func() {
+		time.Sleep(hold)
+		runtime.KeepAlive(blocks)
+		blocks = nil
+		memoryHeldBytes.Add(-size)
+		// Return the pages to the OS so RSS visibly drops in kubectl top
+		debug.FreeOSMemory()
+		slog.Info("memory load released", "mb", mb)
+	}()
+
+	writeJSON(w, http.StatusOK, MemoryLoadResponse{
+		AllocatedMB: mb,
+		Hold:        hold.String(),
+		Memory:      readMemoryStats(),
+	})
+}
+
+// readMemoryStats combines Go runtime stats with the RSS from /proc
+func readMemoryStats() MemoryStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return MemoryStats{
+		RSSBytes:       readRSS(),
+		HeapAllocBytes: m.HeapAlloc,
+		HeapSysBytes:   m.HeapSys,
+		SysBytes:       m.Sys,
+		HeldBytes:      memoryHeldBytes.Load(),
+		NumGC:          m.NumGC,
+	}
+}
+
+// readRSS returns the resident set size from /proc/self/status (Linux only)
+func readRSS() int64 {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kb, _ := strconv.ParseInt(fields[1], 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
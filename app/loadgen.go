@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// loadgen drives traffic for HPA, rate limit and rollout demos from a pod
+// or a laptop, without installing hey or k6:
+//
+//	kubectl run loadgen --rm -it --image=localhost:5001/go-app -- ./app loadgen -rps 100 -duration 1m http://go-app-service/api/info
+//
+// Or from a running pod, with no extra pod at all:
+//
+//	curl -X POST 'localhost:9090/admin/loadgen?url=http://go-app-service/api/info&rps=100&duration=5m'
+//	curl localhost:9090/admin/loadgen         # progress, then the summary
+//	curl -X DELETE localhost:9090/admin/loadgen
+//
+// It counts responses per pod (X-Served-By) and per track
+// (X-Deployment-Track), so it also shows how a Service spreads load - how
+// keep-alive pins a client to one pod, how close a canary split comes to
+// its weight.
+// Ctrl+C, or DELETE, stops early and still reports the summary.
+// SELF_LOAD_SCHEDULE starts admin runs on a timetable (selfload.go).
+
+// loadgenConfig is one run's shape, from CLI flags or admin query params
+type loadgenConfig struct {
+	URL         string        `json:"url"`
+	Method      string        `json:"method"`
+	RPS         float64       `json:"rps"` // 0 is as fast as possible
+	Duration    time.Duration `json:"-"`
+	Concurrency int           `json:"concurrency"`
+	Timeout     time.Duration `json:"-"`
+	KeepAlive   bool          `json:"keepalive"`
+}
+
+// loadgenMaxDuration bounds admin-triggered runs, which nobody is watching
+// with a finger on Ctrl+C
+const loadgenMaxDuration = 30 * time.Minute
+
+// loadgenResult is the summary; printed as text, or JSON with -json
+type loadgenResult struct {
+	URL        string             `json:"url"`
+	Duration   float64            `json:"duration_seconds"`
+	Requests   int                `json:"requests"`
+	Errors     int                `json:"errors"`
+	RPS        float64            `json:"rps"`
+	Statuses   map[int]int        `json:"statuses"`
+	ErrorKinds map[string]int     `json:"error_kinds,omitempty"`
+	Pods       map[string]int     `json:"pods,omitempty"`
+	Tracks     map[string]int     `json:"tracks,omitempty"`
+	LatencyMS  map[string]float64 `json:"latency_ms"`
+
+	mu        sync.Mutex
+	start     time.Time
+	latencies []time.Duration
+}
+
+var loadgenRequests = newCounterVec("loadgen_requests_total",
+	"Requests sent by /admin/loadgen, by status code or error.", "code")
+
+func newLoadgenResult(target string) *loadgenResult {
+	return &loadgenResult{URL: target, Statuses: map[int]int{}, ErrorKinds: map[string]int{}, Pods: map[string]int{}, Tracks: map[string]int{}, start: time.Now()}
+}
+
+// generateLoad sends requests until ctx ends or cfg.Duration passes,
+// recording into result as it goes so a run can be watched live
+func generateLoad(ctx context.Context, cfg loadgenConfig, result *loadgenResult, onResponse func(code string)) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = !cfg.KeepAlive
+	transport.MaxIdleConnsPerHost = cfg.Concurrency
+	client := &http.Client{Transport: transport, Timeout: cfg.Timeout}
+
+	// With a target rate, workers take a ticket per request
+	var tickets <-chan time.Time
+	if cfg.RPS > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.RPS))
+		defer ticker.Stop()
+		tickets = ticker.C
+	}
+
+	var wg sync.WaitGroup
+	for range cfg.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if tickets != nil {
+					select {
+					case <-tickets:
+					case <-ctx.Done():
+						return
+					}
+				} else if ctx.Err() != nil {
+					return
+				}
+				status, served, latency, err := loadgenRequest(ctx, client, cfg.Method, cfg.URL)
+				if ctx.Err() != nil {
+					return // cut off by the deadline, not a real failure
+				}
+				code := result.record(status, served, latency, err)
+				if onResponse != nil {
+					onResponse(code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func runLoadgen(args []string) int {
+	fs := newFlagSet("loadgen", "<url>")
+	cfg := loadgenConfig{}
+	fs.Float64Var(&cfg.RPS, "rps", 10, "target requests per second across all workers, 0 for as fast as possible")
+	fs.DurationVar(&cfg.Duration, "duration", 10*time.Second, "how long to run")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 4, "parallel workers")
+	fs.StringVar(&cfg.Method, "method", http.MethodGet, "HTTP method")
+	fs.DurationVar(&cfg.Timeout, "timeout", 5*time.Second, "per-request timeout")
+	fs.BoolVar(&cfg.KeepAlive, "keepalive", true, "reuse connections (false spreads load across pods, like new clients)")
+	asJSON := fs.Bool("json", false, "print the summary as JSON")
+	fs.Parse(args)
+
+	cfg.URL = fs.Arg(0)
+	if cfg.URL == "" || cfg.Concurrency < 1 || cfg.Duration <= 0 || cfg.RPS < 0 {
+		fs.Usage()
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Fprintf(os.Stderr, "loadgen: %s %s for %s, %d workers, rps %s\n", cfg.Method, cfg.URL, cfg.Duration, cfg.Concurrency, rateLabel(cfg.RPS))
+	result := newLoadgenResult(cfg.URL)
+	generateLoad(ctx, cfg, result, nil)
+	summary := result.summary()
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(summary)
+	} else {
+		summary.print(os.Stdout)
+	}
+	if summary.Requests == 0 || summary.Errors == summary.Requests {
+		return 1
+	}
+	return 0
+}
+
+func rateLabel(rps float64) string {
+	if rps == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%g/s", rps)
+}
+
+// responder is who answered one request: X-Served-By and X-Deployment-Track
+type responder struct{ pod, track string }
+
+// loadgenRequest sends one request and drains the body, so the latency
+// covers the whole response
+func loadgenRequest(ctx context.Context, client *http.Client, method, target string) (int, responder, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return 0, responder{}, 0, err
+	}
+	req.Header.Set("User-Agent", "go-demo-app-loadgen")
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, responder{}, 0, err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res.StatusCode, responder{res.Header.Get("X-Served-By"), res.Header.Get("X-Deployment-Track")}, time.Since(start), nil
+}
+
+// errorKind shortens an error to something worth counting, e.g.
+// "connection refused" rather than every address that refused
+func errorKind(err error) string {
+	msg := err.Error()
+	for _, kind := range []string{"connection refused", "connection reset", "Client.Timeout", "no such host", "EOF"} {
+		if strings.Contains(msg, kind) {
+			return kind
+		}
+	}
+	return msg
+}
+
+// record counts one response, returning its status code or "error"
+func (r *loadgenResult) record(status int, served responder, latency time.Duration, err error) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Requests++
+	if err != nil {
+		r.Errors++
+		r.ErrorKinds[errorKind(err)]++
+		return "error"
+	}
+	r.Statuses[status]++
+	r.latencies = append(r.latencies, latency)
+	if served.pod != "" {
+		r.Pods[served.pod]++
+	}
+	if served.track != "" {
+		r.Tracks[served.track]++
+	}
+	return strconv.Itoa(status)
+}
+
+// summary is a copy of the counts so far, with rate and percentiles
+func (r *loadgenResult) summary() *loadgenResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	elapsed := time.Since(r.start)
+	s := &loadgenResult{
+		URL:        r.URL,
+		Duration:   elapsed.Round(time.Millisecond).Seconds(),
+		Requests:   r.Requests,
+		Errors:     r.Errors,
+		RPS:        float64(r.Requests) / max(elapsed.Seconds(), 1e-3),
+		Statuses:   copyCounts(r.Statuses),
+		ErrorKinds: copyCounts(r.ErrorKinds),
+		Pods:       copyCounts(r.Pods),
+		Tracks:     copyCounts(r.Tracks),
+		LatencyMS:  map[string]float64{},
+	}
+	if len(r.latencies) == 0 {
+		return s
+	}
+	latencies := append([]time.Duration(nil), r.latencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	for _, p := range []struct {
+		name string
+		q    float64
+	}{{"p50", 0.50}, {"p90", 0.90}, {"p99", 0.99}, {"max", 1}} {
+		i := min(int(p.q*float64(len(latencies))), len(latencies)-1)
+		s.LatencyMS[p.name] = float64(latencies[i].Microseconds()) / 1000
+	}
+	return s
+}
+
+func copyCounts[K comparable](counts map[K]int) map[K]int {
+	out := make(map[K]int, len(counts))
+	for k, v := range counts {
+		out[k] = v
+	}
+	return out
+}
+
+func (r *loadgenResult) print(w io.Writer) {
+	fmt.Fprintf(w, "Requests:  %d in %.1fs (%.1f/s)\n", r.Requests, r.Duration, r.RPS)
+	fmt.Fprintf(w, "Statuses:  %s\n", formatCounts(r.Statuses))
+	if r.Errors > 0 {
+		fmt.Fprintf(w, "Errors:    %d (%s)\n", r.Errors, formatCounts(r.ErrorKinds))
+	}
+	if len(r.LatencyMS) > 0 {
+		fmt.Fprintf(w, "Latency:   p50 %.1fms  p90 %.1fms  p99 %.1fms  max %.1fms\n",
+			r.LatencyMS["p50"], r.LatencyMS["p90"], r.LatencyMS["p99"], r.LatencyMS["max"])
+	}
+	if len(r.Pods) > 0 {
+		fmt.Fprintf(w, "Pods:      %s\n", formatCounts(r.Pods))
+	}
+	if len(r.Tracks) > 0 {
+		fmt.Fprintf(w, "Tracks:    %s\n", formatTrackShares(r.Tracks))
+	}
+}
+
+// formatCounts renders a tally largest first, e.g. "200: 95, 503: 5"
+func formatCounts[K comparable](counts map[K]int) string {
+	keys := make([]K, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return counts[keys[i]] > counts[keys[j]] })
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%v: %d", k, counts[k])
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatTrackShares is formatCounts with each track's share of the total,
+// e.g. "stable: 2700 (90.0%), canary: 300 (10.0%)"
+func formatTrackShares(counts map[string]int) string {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	parts := strings.Split(formatCounts(counts), ", ")
+	for i, part := range parts {
+		track, _, _ := strings.Cut(part, ": ")
+		parts[i] = fmt.Sprintf("%s (%.1f%%)", part, float64(counts[track])*100/float64(max(total, 1)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// LoadgenStatus is returned by /admin/loadgen: the running or last run
+type LoadgenStatus struct {
+	Running    bool           `json:"running"`
+	Source     string         `json:"source,omitempty"` // admin, or schedule for SELF_LOAD_SCHEDULE
+	Config     *loadgenConfig `json:"config,omitempty"`
+	Duration   string         `json:"duration,omitempty"`
+	StartedAt  *time.Time     `json:"started_at,omitempty"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Result     *loadgenResult `json:"result,omitempty"`
+}
+
+// loadgenRun is the admin-triggered run; one at a time per pod
+var loadgenRun struct {
+	mu       sync.Mutex
+	cfg      *loadgenConfig
+	result   *loadgenResult
+	cancel   context.CancelFunc
+	started  time.Time
+	finished time.Time
+	source   string
+	final    *loadgenResult // summary once finished
+}
+
+func loadgenStatus() LoadgenStatus {
+	loadgenRun.mu.Lock()
+	defer loadgenRun.mu.Unlock()
+	if loadgenRun.cfg == nil {
+		return LoadgenStatus{}
+	}
+	s := LoadgenStatus{
+		Running:   loadgenRun.cancel != nil,
+		Source:    loadgenRun.source,
+		Config:    loadgenRun.cfg,
+		Duration:  loadgenRun.cfg.Duration.String(),
+		StartedAt: &loadgenRun.started,
+		Result:    loadgenRun.final,
+	}
+	if s.Running {
+		s.Result = loadgenRun.result.summary()
+	} else {
+		s.FinishedAt = &loadgenRun.finished
+	}
+	return s
+}
+
+// errLoadgenRunning is startLoadgenRun's answer while a run is in progress
+var errLoadgenRunning = errors.New("a run is in progress; DELETE /admin/loadgen to stop it")
+
+// startLoadgenRun starts cfg in the background as the pod's one run;
+// source says who asked, admin or schedule (selfload.go)
+func startLoadgenRun(cfg loadgenConfig, source string) error {
+	loadgenRun.mu.Lock()
+	if loadgenRun.cancel != nil {
+		loadgenRun.mu.Unlock()
+		return errLoadgenRunning
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := newLoadgenResult(cfg.URL)
+	loadgenRun.cfg, loadgenRun.result, loadgenRun.cancel, loadgenRun.final = &cfg, result, cancel, nil
+	loadgenRun.started, loadgenRun.source = result.start, source
+	loadgenRun.mu.Unlock()
+
+	slog.Info("loadgen started", "url", cfg.URL, "rps", cfg.RPS, "duration", cfg.Duration.String(), "concurrency", cfg.Concurrency, "source", source)
+	go func() {
+		generateLoad(ctx, cfg, result, func(code string) { loadgenRequests.Inc(code) })
+		summary := result.summary()
+		loadgenRun.mu.Lock()
+		loadgenRun.cancel()
+		loadgenRun.cancel, loadgenRun.final, loadgenRun.finished = nil, summary, time.Now()
+		loadgenRun.mu.Unlock()
+		slog.Info("loadgen finished", "url", cfg.URL, "requests", summary.Requests, "errors", summary.Errors,
+			"rps", fmt.Sprintf("%.1f", summary.RPS), "p99_ms", summary.LatencyMS["p99"], "source", source)
+	}()
+	return nil
+}
+
+// stopLoadgenRun cancels the run in progress, if any
+func stopLoadgenRun() {
+	loadgenRun.mu.Lock()
+	defer loadgenRun.mu.Unlock()
+	if loadgenRun.cancel != nil {
+		loadgenRun.cancel()
+		slog.Info("loadgen stopped early", "url", loadgenRun.cfg.URL)
+	}
+}
+
+// loadgenHandler reports (GET), starts (POST) or stops (DELETE) a run
+func loadgenHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, loadgenStatus())
+	case http.MethodPost:
+		cfg, err := loadgenConfigFromQuery(r.URL.Query())
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := startLoadgenRun(cfg, "admin"); err != nil {
+			writeProblem(w, r, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, loadgenStatus())
+	case http.MethodDelete:
+		stopLoadgenRun()
+		writeJSON(w, http.StatusOK, loadgenStatus())
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeProblem(w, r, http.StatusMethodNotAllowed, "use GET, POST or DELETE")
+	}
+}
+
+// loadgenConfigFromQuery reads url (required), rps, duration, concurrency,
+// method and keepalive, with the CLI's defaults
+func loadgenConfigFromQuery(q url.Values) (loadgenConfig, error) {
+	cfg := loadgenConfig{URL: q.Get("url"), Method: http.MethodGet, RPS: 10, Duration: time.Minute,
+		Concurrency: 4, Timeout: 5 * time.Second, KeepAlive: true}
+	if u, err := url.Parse(cfg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return cfg, fmt.Errorf("url must be an absolute http(s) URL, e.g. http://go-app-service/api/info")
+	}
+	if v := q.Get("method"); v != "" {
+		cfg.Method = strings.ToUpper(v)
+	}
+	if v := q.Get("rps"); v != "" {
+		rps, err := strconv.ParseFloat(v, 64)
+		if err != nil || rps < 0 {
+			return cfg, fmt.Errorf("rps must be a number >= 0 (0 for as fast as possible)")
+		}
+		cfg.RPS = rps
+	}
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > loadgenMaxDuration {
+			return cfg, fmt.Errorf("duration must be a Go duration up to %s, like 90s or 5m", loadgenMaxDuration)
+		}
+		cfg.Duration = d
+	}
+	if v := q.Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 256 {
+			return cfg, fmt.Errorf("concurrency must be an integer between 1 and 256")
+		}
+		cfg.Concurrency = n
+	}
+	if v := q.Get("keepalive"); v != "" {
+		keepAlive, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("keepalive must be true or false")
+		}
+		cfg.KeepAlive = keepAlive
+	}
+	return cfg, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// logLevel is the minimum level emitted; it can be changed at runtime
+var logLevel = new(slog.LevelVar)
+
+// accessLogger writes the per-request lines: the default logger, or
+// ACCESS_LOG_FILE's when set
+var accessLogger = slog.Default()
+
+// setupLogging installs a JSON slog handler on stdout with the pod hostname
+// and DEPLOYMENT_TRACK on every line, ready for Fluent Bit / Loki to pick up. The standard log
+// package is routed through it as well.
+func setupLogging(level string) {
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		logLevel.Set(slog.LevelInfo)
+	}
+	hostname, _ := os.Hostname()
+	handler := slog.NewJSONHandler(captureLogs{os.Stdout}, &slog.HandlerOptions{Level: logLevel})
+	slog.SetDefault(slog.New(handler).With("pod", hostname, "track", deploymentTrack()))
+	accessLogger = slog.Default()
+}
+
+// setupAccessLog sends access logs to path instead of stdout, the classic
+// pattern of an app that logs to a file and a sidecar that ships it (see
+// sidecar.go). The file is rotated at maxBytes, keeping one path.1.
+func setupAccessLog(path string, maxBytes int64) error {
+	f, err := openRotatingFile(path, maxBytes)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	accessLogger = slog.New(slog.NewJSONHandler(captureLogs{f}, &slog.HandlerOptions{Level: logLevel})).With("pod", hostname, "track", deploymentTrack())
+	return nil
+}
+
+// rotatingFile is an append-only file that renames itself to path.1 and
+// starts over past maxBytes, like logrotate's copy-less rotation. A tailer
+// sees the rename as a new file at path.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxBytes int64) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file, rf.size = f, info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxBytes > 0 && rf.size+int64(len(p)) > rf.maxBytes {
+		rf.file.Close()
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return 0, fmt.Errorf("rotating %s: %w", rf.path, err)
+		}
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// fatal logs at error level and exits, replacing log.Fatalf; the message
+// also goes to the termination log, for kubectl describe pod
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	terminate(1, "Fatal", msg, slogDetails(args))
+}
+
+// logLevelHandler reports (GET) or changes (POST) the log level, e.g.
+// curl -X POST 'localhost:8080/admin/loglevel?level=debug'
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		level := r.URL.Query().Get("level")
+		if level == "" {
+			var body struct {
+				Level string `json:"level"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			level = body.Level
+		}
+		previous := logLevel.Level()
+		if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "level must be one of debug, info, warn, error")
+			return
+		}
+		slog.Warn("log level changed", "from", previous.String(), "to", logLevel.Level().String())
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeProblem(w, r, http.StatusMethodNotAllowed, "use GET or POST")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"level": strings.ToLower(logLevel.Level().String()),
+	})
+}
@@ -1,21 +1,47 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
+	"html/template"
+	"log/slog"
 	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/cache"
+	"github.com/michael-jaquier/kubernetes-learning/app/config"
+	"github.com/michael-jaquier/kubernetes-learning/app/store"
+	"github.com/michael-jaquier/kubernetes-learning/app/version"
 )
 
 // AppInfo holds application metadata
 type AppInfo struct {
-	Name      string    `json:"name"`
-	Version   string    `json:"version"`
-	Hostname  string    `json:"hostname"`
-	Timestamp time.Time `json:"timestamp"`
-	Message   string    `json:"message"`
+	Name       string       `json:"name"`
+	Version    string       `json:"version"`
+	Hostname   string       `json:"hostname"`
+	Timestamp  time.Time    `json:"timestamp"`
+	Message    string       `json:"message"`
+	ClientCN   string       `json:"client_cn,omitempty"`
+	Zone       string       `json:"zone,omitempty"`   // topology.kubernetes.io/zone of the node
+	Region     string       `json:"region,omitempty"` // topology.kubernetes.io/region of the node
+	Namespace  string       `json:"namespace,omitempty"`
+	PodName    string       `json:"pod_name,omitempty"`
+	PodIP      string       `json:"pod_ip,omitempty"`
+	Node       string       `json:"node,omitempty"`
+	Visits     *VisitCounts `json:"visits,omitempty"`
+	Protocol   string       `json:"protocol"`             // h3, h2, h2c or http/1.1, as this request arrived
+	Ordinal    *int         `json:"ordinal,omitempty"`    // StatefulSet pod index, from the pod name
+	Role       string       `json:"role,omitempty"`       // writer (ordinal 0) or reader
+	Color      string       `json:"color"`                // APP_COLOR, or the version's default
+	PodColor   string       `json:"pod_color"`            // hashed from the hostname, stable per pod
+	Track      string       `json:"track"`                // DEPLOYMENT_TRACK: stable or canary
+	Generation int          `json:"generation,omitempty"` // HOT_RELOAD process generation, 1 before any reload
 }
 
 // HealthStatus represents health check response
@@ -25,167 +51,831 @@ type HealthStatus struct {
 	Checked time.Time `json:"checked"`
 }
 
+// ReadyStatus represents readiness check response
+type ReadyStatus struct {
+	Status string        `json:"status"`
+	Reason string        `json:"reason,omitempty"`
+	Toggle ReadyToggle   `json:"admin_toggle"` // /admin/ready/disable and /enable
+	Checks []checkResult `json:"checks,omitempty"`
+}
+
 var startTime = time.Now()
 
-func main() {
+// serve runs the servers until SIGTERM and returns the exit code; the
+// default subcommand
+func serve() int {
+	setupLogging(getEnv("LOG_LEVEL", "info"))
+	applyContainerLimits() // before anything sizes itself by GOMAXPROCS
+	scheduleCrash()
+	watchSignals()
+	setupTempDir()
+
 	// Configuration
 	port := getEnv("PORT", "8080")
 	appName := getEnv("APP_NAME", "go-demo-app")
-	appVersion := getEnv("APP_VERSION", "1.0.0")
+	appVersion := buildInfo().Version // ldflags, else APP_VERSION
+
+	// Tracing export, when an OTLP collector is configured
+	if endpoint := getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""); endpoint != "" {
+		tracer = newOTLPExporter(endpoint, getEnv("OTEL_SERVICE_NAME", appName))
+		slog.Info("tracing enabled", "otlp_endpoint", endpoint)
+	}
+
+	// Access logs to a shared volume for a log-shipping sidecar
+	if path := getEnv("ACCESS_LOG_FILE", ""); path != "" {
+		if err := setupAccessLog(path, getEnvInt("ACCESS_LOG_MAX_BYTES", 10<<20)); err != nil {
+			fatal("cannot open access log file", "file", path, "error", err)
+		}
+		slog.Info("access logs written to file", "file", path)
+	}
+
+	// Admin and chaos calls, on a stream of their own
+	if dest := getEnv("AUDIT_LOG", "stderr"); dest != "stderr" {
+		if err := setupAuditLog(dest); err != nil {
+			fatal("cannot open audit log", "destination", dest, "error", err)
+		}
+		slog.Info("audit log written to", "destination", dest)
+	}
+
+	// Runtime config from a mounted ConfigMap, reloaded when it changes, or
+	// watched through the API server when CONFIG_CONFIGMAP names one
+	configFile := getEnv("CONFIG_FILE", defaultConfigFile)
+	if err := appConfigs.Load(configFile); err != nil {
+		failedSetting("CONFIG_FILE", err)
+	}
+	applyConfig(&config.Config{}, appConfig())
+	configPoll := getEnvDuration("CONFIG_RELOAD_INTERVAL", 5*time.Second)
+	if name := getEnv("CONFIG_CONFIGMAP", ""); name != "" {
+		kube, err := inClusterKube()
+		if err != nil {
+			fatal("CONFIG_CONFIGMAP needs the Kubernetes API", "error", err)
+		}
+		go watchConfigMap(context.Background(), kube, name, getEnv("CONFIG_CONFIGMAP_KEY", "config.yaml"))
+		slog.Info("config watched through the API", "configmap", kube.namespace+"/"+name)
+	} else {
+		go watchConfigFile(configFile, configPoll)
+	}
+
+	// Feature flags from a mounted file, reloaded the same way
+	flagsFile := getEnv("FLAGS_FILE", "/etc/config/flags.yaml")
+	if err := featureFlagStore.Load(flagsFile); err != nil {
+		failedSetting("FLAGS_FILE", err)
+	}
+	go watchFlagsFile(flagsFile, configPoll)
+
+	currentTheme() // resolve now so a bad APP_COLOR is reported at startup
+
+	// Dependency checks for the readiness probe
+	registerReadinessChecksFromEnv()
+
+	// Active health checks of UPSTREAMS for /status/upstreams
+	upstreams, err := newUpstreamProberFromEnv()
+	if err != nil {
+		failedSetting("UPSTREAMS", err)
+		upstreams = &upstreamProber{}
+	}
+	if len(upstreams.upstreams) > 0 {
+		go upstreams.Run(context.Background())
+		if getEnvBool("UPSTREAM_READY", false) {
+			readinessChecks.Register(upstreamsCheck{prober: upstreams})
+		}
+		slog.Info("upstream health checks enabled", "upstreams", len(upstreams.upstreams), "interval", upstreams.interval.String())
+	}
+
+	// Scheduled load on our own Service; idle until self_load.schedule is set
+	go runSelfLoadSchedule(context.Background())
+
+	// How many past requests /api/requests and /graphql can look back on
+	requestEvents.historySize = int(max(getEnvInt("REQUEST_HISTORY_SIZE", defaultRequestHistory), 1))
+
+	// Limits the handlers keep in package variables, which hold the
+	// defaults until here: read at init they would miss -set and CONFIG_FILE
+	requestTimeout = getEnvDuration("REQUEST_TIMEOUT", requestTimeout)
+	uploadMaxBytes = getEnvInt("UPLOAD_MAX_BYTES", uploadMaxBytes)
+	idempotencyTTL = getEnvDuration("IDEMPOTENCY_TTL", idempotencyTTL)
+	apiCacheControl = getEnv("API_CACHE_CONTROL", apiCacheControl)
+	tcpEchoIdleTimeout = getEnvDuration("TCP_IDLE_TIMEOUT", tcpEchoIdleTimeout)
+	imageSlots = make(chan struct{}, max(int(getEnvInt("IMAGE_CONCURRENCY", int64(runtime.GOMAXPROCS(0)))), 1))
+	imageQueueTimeout = getEnvDuration("IMAGE_QUEUE_TIMEOUT", imageQueueTimeout)
+	computeLRU = cache.New[json.RawMessage]("compute", int(getEnvInt("COMPUTE_CACHE_SIZE", int64(computeLRU.Size()))),
+		getEnvDuration("COMPUTE_CACHE_MEMORY_TTL", computeLRU.TTL()))
+	computeRedisTTL = getEnvDuration("COMPUTE_CACHE_TTL", computeRedisTTL)
+	callBreakers = newBreakerSet(int(getEnvInt("BREAKER_FAILURES", int64(callBreakers.threshold))),
+		getEnvDuration("BREAKER_COOLDOWN", callBreakers.cooldown))
+	recentTraces.size = int(getEnvInt("TRACE_BUFFER", int64(recentTraces.size)))
+	retryBudget = newRetryBudgetFromEnv()
+
+	// Optional persistent request log under DATA_DIR
+	if l, err := newRequestLogFromEnv(); err != nil {
+		fatal("cannot open the request log", "error", err)
+	} else if reqLog = l; reqLog != nil {
+		entries, size := reqLog.stats()
+		slog.Info("request log enabled", "file", reqLog.path, "entries", entries, "bytes", size,
+			"retention", reqLog.retention.String(), "mounted", isMountPoint(dataDir()))
+		go reqLog.run()
+	}
+
+	// Optional restart history under DATA_DIR, from this start on
+	if l, err := newRestartLogFromEnv(appVersion); err != nil {
+		fatal("cannot open the restart history", "error", err)
+	} else if restartHistory = l; restartHistory != nil {
+		snap := restartHistory.Snapshot()
+		slog.Info("restart history enabled", "file", restartHistory.path, "restarts", snap.Restarts,
+			"pod_restarts", snap.PodRestarts, "mounted", snap.Mounted)
+		go restartHistory.run()
+	}
+	logFSAudit() // warn about paths a read-only root leaves unwritable
+
+	// Optional cluster view over the headless Service in PEER_SERVICE
+	if cluster = newClusterGossipFromEnv(port); cluster != nil {
+		slog.Info("cluster view enabled", "service", cluster.service, "interval", cluster.interval.String())
+		go cluster.run(context.Background())
+	}
+
+	// NetworkPolicy checks on a timer, for /api/netpol/test to return
+	if interval := getEnvDuration("NETPOL_INTERVAL", 0); interval > 0 {
+		slog.Info("netpol checks enabled", "file", netpolTargetsFile(), "interval", interval.String())
+		go runNetpolTimer(interval)
+	}
+
+	// Optional groupcache compute cache shared by the replicas, with its own peer port
+	if groupcache = newGroupCacheFromEnv(); groupcache != nil {
+		groupcache.serve()
+		slog.Info("groupcache enabled", "addr", groupcache.srv.Addr, "self", groupcache.self, "replicas", groupcache.replicas, "refresh", groupcache.refresh.String())
+		go groupcache.run(context.Background())
+	}
+
+	// Optional self-registration with a Consul-style registry
+	if s, err := newServiceRegistrationFromEnv(appName, port); err != nil {
+		failedSetting("registry", err)
+	} else if registration = s; registration != nil {
+		slog.Info("service registration enabled", "registry", registration.base.Host, "service", registration.service,
+			"ttl", registration.ttl.String())
+		go registration.run()
+	}
+
+	// Optional tenant partitioning, applied by the standard middleware
+	if t, err := newTenantResolverFromEnv(); err != nil {
+		failedSetting("tenants", err)
+	} else if tenants = t; tenants != nil {
+		slog.Info("tenant mode enabled", "mode", tenants.mode, "source", tenants.source())
+	}
+
+	// Optional traffic mirroring to a shadow, applied by the standard middleware
+	if m, err := newTrafficMirrorFromEnv(); err != nil {
+		failedSetting("mirror", err)
+	} else if mirror = m; mirror != nil {
+		slog.Info("traffic mirroring enabled", "target", mirror.target.String(), "percent", mirror.percent)
+	}
+
+	// Per-route SLOs, counted by the standard middleware
+	if t, err := newSLOTrackerFromEnv(); err != nil {
+		failedSetting("SLOs", err)
+	} else {
+		slos = t
+		metrics.register(slos)
+	}
+
+	// Degraded mode, switched by those burn rates with DEGRADE_AUTO
+	degraded.configure()
+	if degraded.auto {
+		go degraded.watch(10 * time.Second)
+		slog.Info("automatic degraded mode enabled", "burn_rate", degraded.threshold, "recover_below", degraded.recover, "hold", degraded.hold.String())
+	}
+
+	// The A/B experiment behind /api/experiment
+	if e, err := newExperimentFromEnv(); err != nil {
+		failedSetting("experiment", err)
+	} else {
+		currentExperiment = e
+	}
+
+	// Optional rate limiting, applied by the standard middleware
+	if limiter = newRateLimiterFromEnv(); limiter != nil {
+		go limiter.sweepEvery(time.Minute)
+		slog.Info("rate limiting enabled", "rps", getEnv("RATE_LIMIT_RPS", ""), "client_rps", getEnv("RATE_LIMIT_CLIENT_RPS", ""),
+			"tenant_rps", getEnv("RATE_LIMIT_TENANT_RPS", ""), "trust_forwarded", limiter.trustForwarded)
+	}
+
+	// Optional per-route concurrency limits, applied the same way
+	if spec := getEnv("CONCURRENCY_LIMITS", ""); spec != "" {
+		limits, err := parseConcurrencyLimits(spec, getEnvDuration("CONCURRENCY_QUEUE_TIMEOUT", 2*time.Second))
+		if err != nil {
+			failedSetting("CONCURRENCY_LIMITS", err)
+		} else {
+			concurrencyLimits = limits
+			slog.Info("concurrency limits enabled", "routes", sortedKeys(limits))
+		}
+	}
+
+	// Optional JWT authentication on /api/, applied by the standard middleware
+	if verifier, err := newJWTVerifierFromEnv(); err != nil {
+		failedSetting("JWT", err)
+	} else if jwtAuth = verifier; jwtAuth != nil {
+		slog.Info("JWT authentication enabled", "keys", jwtAuth.keySource(),
+			"issuer", jwtAuth.issuer, "audience", jwtAuth.audience)
+	}
+
+	// Optional basic auth on /admin/* and /chaos*, applied by the standard middleware
+	if user, _, ok := adminCredentials(); ok {
+		adminAuthRequired = true
+		adminFailures = newAuthThrottle(int(getEnvInt("ADMIN_AUTH_FAILURES", 10)))
+		slog.Info("admin basic auth enabled", "user", user, "failures_per_minute", adminFailures.perMin)
+	}
+
+	// Optional OIDC login for /dashboard
+	if provider, err := newOIDCFromEnv(); err != nil {
+		failedSetting("OIDC", err)
+	} else if oidcAuth = provider; oidcAuth != nil {
+		slog.Info("OIDC login enabled", "issuer", oidcAuth.issuer, "client_id", oidcAuth.clientID)
+		if oidcAuth.randomKey {
+			slog.Warn("OIDC_SESSION_SECRET not set; sessions are signed with a per-pod key and end on restart")
+		}
+	}
+
+	// Response compression, applied by the standard middleware
+	if compression = newCompressionFromEnv(); compression != nil {
+		slog.Info("response compression enabled", "min_size", compression.minSize, "types", compression.types)
+	}
+
+	// Per-request fault injection (?delay=, ?status=) on /api/ routes
+	injectEnabled = getEnvBool("INJECT_ENABLED", true)
+	injectMaxDelay = getEnvDuration("INJECT_MAX_DELAY", injectMaxDelay)
+
+	// In-memory job queue, drained after the HTTP servers on shutdown
+	jobs = newJobQueue(int(getEnvInt("JOB_WORKERS", 2)), int(getEnvInt("JOB_QUEUE_SIZE", 100)))
+	// Long jobs hold /admin/drain until they finish or DRAIN_TASK_DEADLINE passes
+	drainer.longTask = getEnvDuration("LONG_TASK_THRESHOLD", drainer.longTask)
+	drainer.taskDeadline = getEnvDuration("DRAIN_TASK_DEADLINE", drainer.taskDeadline)
+
+	// Messaging, when a broker is configured
+	if rawURL := getEnv("BROKER_URL", ""); rawURL != "" {
+		if err := setupBroker(rawURL, getEnv("BROKER_SUBJECT", "go-demo.events"), getEnv("BROKER_QUEUE_GROUP", "")); err != nil {
+			failedSetting("BROKER_URL", err)
+		} else {
+			slog.Info("messaging enabled", "broker", brokerURL, "subject", brokerSubj, "queue_group", brokerQueue)
+		}
+	}
+
+	// Page templates; a broken one fails startup rather than every request
+	pages, err := parseTemplates()
+	if err != nil {
+		fatal("invalid page templates", "error", err)
+	}
 
 	// Routes
-	http.HandleFunc("/", homeHandler(appName, appVersion))
-	http.HandleFunc("/health", healthHandler)
-	http.HandleFunc("/ready", readyHandler)
-	http.HandleFunc("/api/info", apiInfoHandler(appName, appVersion))
+	mux := http.NewServeMux()
+	routes := newRouteRegistry(mux, standardMiddleware...)
+	routes.HandleFunc("/", "HTML home page", homeHandler(pages, appName), http.MethodGet)
+	routes.HandleFunc("/api/info", "Application and pod info (Accept: application/msgpack or application/x-protobuf for binary)", apiInfoHandler(appName, appVersion), http.MethodGet)
+	routes.HandleFunc("/api/v1/info", "Application and pod info, v1 schema (same as /api/info)", apiInfoHandler(appName, appVersion), http.MethodGet)
+	routes.HandleFunc("/api/v2/info", "Application and pod info, v2 schema grouped into app and pod", apiInfoV2Handler(appName, appVersion), http.MethodGet)
+	routes.HandleFunc("/api/config", "Effective config (ConfigMap file + env)", configHandler, http.MethodGet)
+	routes.HandleFunc("/api/config/effective", "Every startup setting read, its value and layer: flag > env > file > default", effectiveConfigHandler, http.MethodGet)
+	routes.HandleFunc("/api/config/version", "Checksums and load times of this pod's config and flags, for peers to compare", configVersionHandler, http.MethodGet)
+	routes.HandleFunc("/api/config/source", "Where config comes from: watched file or API watch, with the last resourceVersion", configSourceHandler(configPoll), http.MethodGet)
+	routes.HandleFunc("/api/flags", "Feature flags (FLAGS_FILE + FLAG_* env), hot-reloaded", flagsHandler, http.MethodGet)
+	routes.HandleFunc("/api/secrets", "Mounted and env Secrets, values redacted", secretsHandler, http.MethodGet)
+	routes.HandleFunc("/api/secrets/lease", "Vault dynamic credential leases and their renewals", secretsLeaseHandler, http.MethodGet)
+	routes.HandleFunc("/api/security", "UID/GID, groups, seccomp, no_new_privs and capabilities from /proc, to check a securityContext", securityHandler, http.MethodGet)
+	routes.HandleFunc("/api/fs-audit", "Paths the app writes to and whether each is writable (readOnlyRootFilesystem)", fsAuditHandler, http.MethodGet)
+	routes.HandleFunc("/api/files", "Files in DATA_DIR with disk usage (PVC demo)", filesHandler, http.MethodGet)
+	routes.HandleFunc("/api/files/", "Get, PUT or DELETE a file in DATA_DIR", filesHandler, http.MethodGet, http.MethodPut, http.MethodDelete)
+	routes.HandleFunc("/api/upload", "Stream multipart uploads into DATA_DIR with SHA-256 checksums (POST; UPLOAD_MAX_BYTES)", uploadHandler, http.MethodPost)
+	routes.HandleFunc("/api/peers", "Sibling pods from the API (RBAC) or headless Service DNS", peersHandler, http.MethodGet)
+	routes.HandleFunc("/api/cluster", "Every replica's version, uptime and requests, gossiped over PEER_SERVICE", clusterHandler, http.MethodGet)
+	routes.HandleFunc("/api/cluster/config-skew", "Replicas still on an older config, flags or env, compared over the cluster view", configSkewHandler, http.MethodGet)
+	routes.HandleFunc("/api/fanout", "Call our own Service N times and tally pods (?requests=20)", fanoutHandler, http.MethodGet)
+	routes.HandleFunc("/api/call", "Outbound call with retries and a circuit breaker (?url=)", callHandler, http.MethodGet)
+	routes.HandleFunc("/api/breakers", "Circuit breakers of /api/call, one per downstream host: state, failures, retry time", breakersHandler, http.MethodGet)
+	routes.HandleFunc("/api/chain", "Pass a request along N pods via CHAIN_NEXT_URL and time each hop (?hops=3)", chainHandler, http.MethodGet)
+	routes.HandleFunc("/ws/stats", "WebSocket streaming live pod stats every second", statsHandler, http.MethodGet)
+	routes.HandleFunc("/ws/chat", "WebSocket chat room, shared by every replica through Redis pub/sub (?name=)", chatHandler, http.MethodGet)
+	routes.HandleFunc("/events", "Server-Sent Events feed of every request this pod serves", eventsHandler, http.MethodGet)
+	routes.HandleFunc("/api/session", "Session affinity check: a cookie names the last pod, each request says whether it landed there again (?reset=true)", sessionAffinityHandler, http.MethodGet)
+	routes.HandleFunc("/api/requests", "Recent requests this pod served, newest first (?limit=&code=5xx&path=&exclude=&before=)", requestsHandler, http.MethodGet)
+	routes.HandleFunc("/api/restarts", "Starts and exits of this container kept in DATA_DIR: restart count, exit reasons and uptimes (RESTART_HISTORY=true)", restartsHandler, http.MethodGet)
+	routes.HandleFunc("/api/requests/log", "The persistent request log in DATA_DIR, newest first (REQUEST_LOG=true; ?since=1h&code=&path=&before=&limit=)", requestLogHandler, http.MethodGet)
+	routes.HandleFunc("/api/whoami", "The verified client certificate (mTLS) or mesh identity", whoamiHandler, http.MethodGet)
+	routes.HandleFunc("/api/version", "Build metadata: version, git commit, build date", versionHandler, http.MethodGet)
+	routes.HandleFunc("/api/provenance", "The binary's SHA-256, Go build info and dependencies, and its signature and SBOM references", provenanceHandler, http.MethodGet)
+	routes.HandleFunc("/api/time", "Wall clock, timezone and monotonic uptime, with drift against an NTP server (?ntp=pool.ntp.org or NTP_SERVER)", timeHandler, http.MethodGet)
+	routes.HandleFunc("/api/echo", "Echo the request: method, URL, headers, query, body, client IP and TLS", echoHandler, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	routes.HandleFunc("/api/download", "Stream ?mb= megabytes of random data, to measure throughput with curl (DOWNLOAD_MAX_MB)", downloadHandler, http.MethodGet)
+	routes.HandleFunc("/api/upload-sink", "Read and discard the POST or PUT body, reporting throughput (UPLOAD_SINK_MAX_MB)", uploadSinkHandler, http.MethodPost, http.MethodPut)
+	routes.HandleFunc("/api/stream-echo", "Stream the POSTed body back in flushed chunks, to see what buffers (?chunk=1024&chunk_delay=200ms)", streamEchoHandler, http.MethodPost)
+	routes.HandleFunc("/api/echo/", "Echo any subpath, to see what an Ingress rewrite forwards", echoHandler, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	registerDashboardRoutes(routes, pages, appName, port)
+	routes.HandleFunc("/trace/", "Waterfall of a recent request's spans and middleware stages, kept in memory (/trace/{request-id}; HTML, or JSON with ?format=json)", traceHandler(pages, appName), http.MethodGet)
+	routes.HandleFunc("/status/upstreams", "Status page: state and rolling success rate of each UPSTREAMS target (HTML, or JSON with ?format=json)", upstreamsHandler(upstreams, pages, appName), http.MethodGet)
+	if oidcAuth != nil {
+		registerOIDCRoutes(routes, oidcAuth)
+	}
+	routes.HandleFunc("/api/stats", "This pod's request counters, version and readiness", podStatsHandler, http.MethodGet)
+	routes.HandleFunc("/api/tenants", "Tenants this pod has served (TENANT_MODE)", tenantsHandler, http.MethodGet)
+	routes.HandleFunc("/api/experiment", "This caller's A/B experiment variant (counts an exposure)", experimentHandler("exposures"), http.MethodGet)
+	routes.HandleFunc("/api/experiment/convert", "Record a conversion for this caller's variant (POST)", experimentHandler("conversions"), http.MethodPost)
+	routes.HandleFunc("/api/experiment/results", "Exposures and conversions per variant, against the control", experimentResultsHandler, http.MethodGet)
+	routes.HandleFunc("/api/slo", "Per-route SLIs, error budgets and burn rates (?route=)", sloHandler, http.MethodGet)
+	routes.HandleFunc("/api/degraded", "Degraded mode: whether it is on, why, and the work it has skipped", degradedHandler, http.MethodGet)
+	routes.HandleFunc("/api/track", "This pod's DEPLOYMENT_TRACK and what it has served", trackHandler, http.MethodGet)
+	routes.HandleFunc("/api/registration", "This pod's registration with the REGISTRY_URL service registry", registrationHandler, http.MethodGet)
+	routes.HandleFunc("/api/mirror", "How the MIRROR_URL shadow's answers compare", mirrorHandler, http.MethodGet)
+	routes.HandleFunc("/api/jobs", "Work queue: POST to enqueue (?type=cpu&duration=10s&count=5), GET for depth", idempotent("/api/jobs", jobsHandler), http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/api/jobs/", "One queued job's status", jobsHandler, http.MethodGet)
+	routes.HandleFunc("/api/drain/status", "Drain phase and the long jobs (LONG_TASK_THRESHOLD) holding it until they finish or DRAIN_TASK_DEADLINE", drainStatusHandler, http.MethodGet)
+	routes.HandleFunc("/api/publish", "Publish a message to BROKER_SUBJECT (POST ?message=, a text body or JSON {message, subject})", publishHandler, http.MethodPost)
+	routes.HandleFunc("/api/messages", "Messages this pod's broker subscriber received", messagesHandler, http.MethodGet)
+	routes.HandleFunc("/api/dns", "DNS lookups (A, AAAA, CNAME, SRV) with the pod resolver (?name=)", dnsHandler, http.MethodGet)
+	routes.HandleFunc("/api/connect", "TCP (and TLS) dial from this pod, for NetworkPolicy lessons (?host=&port=)", connectHandler, http.MethodGet)
+	routes.HandleFunc("/api/netpol/test", "Dial every target in NETPOL_TARGETS_FILE and compare with allow/deny (?run=true skips the NETPOL_INTERVAL cache)", netpolTestHandler, http.MethodGet)
+	routes.HandleFunc("/api/resources", "CPU usage and throttling, memory working set vs limit, from cgroups (?window=1s)", resourcesHandler, http.MethodGet)
+	routes.HandleFunc("/api/signals", "Signals this process received, with timestamps", signalsHandler(getEnvDuration("TERMINATION_GRACE_PERIOD", defaultGracePeriod)), http.MethodGet)
+	routes.HandleFunc("/api/signals/prestop", "Record a preStop hook call (?sleep=5s holds it)", preStopHandler, http.MethodGet)
+	routes.HandleFunc("/api/rbac/can-i", "Ask the API server what this pod's service account may do (?verb=&resource=)", canIHandler, http.MethodGet)
+	routes.HandleFunc("/api/serviceaccount", "Decoded claims and age of the projected service account token", serviceAccountHandler, http.MethodGet)
+	routes.HandleFunc("/api/startup", "WAIT_FOR dependency checks at startup: each target's attempts, errors and backoff", startupWaitHandler, http.MethodGet)
+	routes.HandleFunc("/api/pod", "Downward API pod metadata and resources", podHandler, http.MethodGet)
+	routes.HandleFunc("/api/routes", "Registered routes with their methods and auth (?method=POST&auth=admin|bearer|login|none)", routesHandler(routes), http.MethodGet)
+	routes.HandleFunc("/openapi.json", "OpenAPI 3 spec of the JSON API, generated from this route list", openAPIHandler(routes, appName), http.MethodGet)
+	routes.HandleFunc("/docs", "Swagger UI over /openapi.json", docsHandler(pages, appName), http.MethodGet)
+	routes.HandleFunc("/graphql", "GraphQL over info, peers, recent requests and resources (GET ?query= or POST; GraphiQL with GRAPHIQL=true)", graphQLHandler(pages, appName, appVersion), http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/static/", "Embedded CSS/JS assets", staticHandler(), http.MethodGet)
+	routes.HandleFunc("/api/wait", "Hold the request open, for proxy and LB idle timeouts (?seconds=120&keepalive=10s)", waitHandler, http.MethodGet)
+	routes.HandleFunc("/api/load/cpu", "Burn CPU for HPA demos (POST ?duration=30s&workers=4)", cpuLoadHandler, http.MethodPost)
+	routes.HandleFunc("/api/load/memory", "Allocate and hold memory (POST ?mb=256&hold=60s; GET reports usage)", memoryLoadHandler, http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/api/compute/fib/", "Fibonacci number n, cached in an LRU and Redis (/api/compute/fib/90000; ?cache=none)", computeFibHandler, http.MethodGet)
+	routes.HandleFunc("/api/compute/primes", "Count primes with a sieve, cached like fib (?upTo=5000000&cache=none)", computePrimesHandler, http.MethodGet)
+	routes.HandleFunc("/api/cache/peers", "groupcache hash ring: each pod's share of the keys and fetches (?key=fib:90000 for its owner)", cachePeersHandler, http.MethodGet)
+	routes.HandleFunc("/api/images/resize", "Resize a POSTed JPEG, PNG or GIF, IMAGE_CONCURRENCY at a time (?width=320&height=&format=png)", imageResizeHandler, http.MethodPost)
+	registerChaosRoutes(routes)
+
+	// Probes, metrics and admin toggles get their own listener, so users
+	// only reach the app port and a NetworkPolicy can guard the rest.
+	// ADMIN_PORT=0 (or the app port) serves them on the app port instead.
+	adminPort := getEnv("ADMIN_PORT", "9090")
+	serverCfg := serverConfigFromEnv()
+	adminMux, admin := mux, routes
+	if adminPort != "0" && adminPort != port {
+		adminMux = http.NewServeMux()
+		admin = newRouteRegistry(adminMux, standardMiddleware...)
+		admin.HandleFunc("/admin/routes", "Admin routes with their methods and auth, like /api/routes", routesHandler(admin), http.MethodGet)
+	}
+	admin.HandleFunc("/health", "Liveness probe", healthHandler, http.MethodGet)
+	admin.HandleFunc("/ready", "Readiness probe", readyHandler, http.MethodGet)
+	admin.HandleFunc("/startup", "Startup probe: 503 until WAIT_FOR, STARTUP_DELAY and warm-up are done", startupHandler, http.MethodGet)
+	admin.HandleFunc("/metrics", "Prometheus metrics", metricsHandler, http.MethodGet)
+	admin.HandleFunc("/admin/audit", "Recent admin and chaos actions: who, what, when, result (?limit=&who=&result=denied)", auditHandler, http.MethodGet)
+	admin.HandleFunc("/admin/loglevel", "Get (GET) or set (POST ?level=) the log level", logLevelHandler, http.MethodGet, http.MethodPost)
+	admin.HandleFunc("/admin/reset", "Clear counters, guestbook, request history, traces, caches and chaos: GET to preview (a page in a browser), POST ?confirm=yes&targets=", resetHandler(pages, appName), http.MethodGet, http.MethodPost)
+	admin.HandleFunc("/admin/cache/flush", "Empty the in-memory caches (POST; ?cache=compute or guestbook, default all)", cacheFlushHandler, http.MethodPost)
+	admin.HandleFunc("/admin/debug-capture", "Debug logs and request/response bodies for a while: POST ?duration=30s&body_bytes=, GET status, DELETE to stop", debugCaptureHandler, http.MethodGet, http.MethodPost, http.MethodDelete)
+	admin.HandleFunc("/admin/debug-capture/download", "The last debug capture as a .tar.gz of logs and requests", debugCaptureDownloadHandler, http.MethodGet)
+	admin.HandleFunc("/admin/health/fail", "Make /health fail (POST ?duration=2m)", healthFailHandler, http.MethodPost)
+	admin.HandleFunc("/admin/health/recover", "Make /health pass again (POST)", healthRecoverHandler, http.MethodPost)
+	admin.HandleFunc("/admin/ready/disable", "Make /ready fail, taking the pod out of Service endpoints (POST)", readyDisableHandler, http.MethodPost)
+	admin.HandleFunc("/admin/ready/enable", "Make /ready pass again (POST)", readyEnableHandler, http.MethodPost)
+	admin.HandleFunc("/admin/drain", "Fail readiness and wait for in-flight requests, for preStop hooks (POST, or GET ?start=true; ?settle=&timeout=&deadline=)", drainHandler(admin == routes), http.MethodGet, http.MethodPost)
+	admin.HandleFunc("/admin/metrics/custom", "Demo gauges for HPA custom metrics: GET, POST ?name=&value=&for=, DELETE ?name=", customMetricsHandler, http.MethodGet, http.MethodPost, http.MethodDelete)
+	admin.HandleFunc("/admin/breakers/", "Hold a circuit breaker open (POST /admin/breakers/{name}/trip) or close it (.../reset)", breakerControlHandler, http.MethodPost)
+	admin.HandleFunc("/admin/degraded", "Force degraded mode on or off, or back to the SLO burn rates (POST ?mode=on|off|auto)", degradedAdminHandler, http.MethodPost)
+	admin.HandleFunc("/admin/self-load", "Scheduled load on our own Service (SELF_LOAD_SCHEDULE): GET the schedule and next run, POST to run now, DELETE to stop", selfLoadHandler, http.MethodGet, http.MethodPost, http.MethodDelete)
+	admin.HandleFunc("/admin/loadgen", "Generate load: POST ?url=&rps=&duration=, GET for progress, DELETE to stop", loadgenHandler, http.MethodGet, http.MethodPost, http.MethodDelete)
+	admin.HandleFunc("/debug/connections", "Open app-port connections with their state, age and request count", connectionsHandler(serverCfg), http.MethodGet)
+	admin.HandleFunc("/debug/runtime", "Goroutines, GC stats, GOMAXPROCS and GOMEMLIMIT", runtimeHandler, http.MethodGet)
+	if getEnvBool("ENABLE_PPROF", false) {
+		if admin == routes {
+			slog.Warn("ENABLE_PPROF ignored: pprof is only served on a separate ADMIN_PORT")
+		} else {
+			registerPprofRoutes(admin)
+		}
+	}
+	if admin != routes {
+		for _, route := range admin.Routes() {
+			mux.HandleFunc(route.Path, movedToAdminHandler(adminPort))
+		}
+	}
+
+	// Optional dynamic database credentials from Vault, needed before the
+	// first connection
+	if v, err := newVaultClientFromEnv(); err != nil {
+		failedSetting("vault", err)
+	} else if vault = v; vault != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := vault.login(ctx); err != nil {
+			fatal("vault login failed", "addr", vault.addr.Host, "auth", vault.auth, "error", err)
+		}
+		for name, env := range map[string]string{"postgres": "VAULT_DB_CREDS_PATH", "redis": "VAULT_REDIS_CREDS_PATH"} {
+			if path := getEnv(env, ""); path != "" {
+				if _, err := vault.lease(ctx, name, path); err != nil {
+					fatal("cannot get database credentials from vault", "secret", name, "error", err)
+				}
+			}
+		}
+		cancel()
+		if l := vault.find("redis"); l != nil {
+			redisCredentials = l
+		}
+		go vault.run(context.Background())
+		slog.Info("vault credentials enabled", "addr", vault.addr.Host, "auth", vault.auth, "leases", len(vault.leases))
+	}
+
+	// Optional shared counter, only when Redis is configured
+	if redisAddr := getEnv("REDIS_ADDR", ""); redisAddr != "" {
+		visitsRedis = newRedisClient(redisAddr)
+		routes.HandleFunc("/api/counter", "Counter shared by all replicas via Redis", counterHandler(visitsRedis), http.MethodGet, http.MethodPost)
+		idempotencyKeys = redisIdempotencyStore{client: visitsRedis} // one Idempotency-Key for every replica
+		startChatRelay(context.Background(), visitsRedis)
+		if currentExperiment != nil {
+			currentExperiment.redis = visitsRedis // results across replicas
+		}
+		slog.Info("shared counter enabled", "path", "/api/counter", "redis", redisAddr)
+	}
+
+	// Optional guestbook, only when PostgreSQL is configured
+	db, dbEnabled, err := newPostgresFromEnv()
+	if err != nil {
+		failedSetting("database", err)
+	}
+	if dbEnabled {
+		if l := vault.find("postgres"); l != nil {
+			db.Credentials = l.credentials
+		}
+		guestbook := store.NewGuestbook(db, int(getEnvInt("GUESTBOOK_CACHE_SIZE", 64)), getEnvDuration("GUESTBOOK_CACHE_TTL", 5*time.Second))
+		readinessChecks.Register(guestbook)
+		go guestbook.MigrateWithRetry()
+		resetTargets.Register("guestbook", "Every guestbook entry in PostgreSQL, for all tenants", guestbook.Count, guestbook.Reset)
+		routes.HandleFunc("/api/guestbook", "Guestbook stored in PostgreSQL (GET, POST)", idempotent("/api/guestbook", guestbookHandler(guestbook)), http.MethodGet, http.MethodPost)
+		slog.Info("guestbook enabled", "path", "/api/guestbook", "postgres", db.Addr, "database", db.Database)
+	}
+
+	// Optional object storage, only when an S3 endpoint is configured
+	objectStore, s3Enabled, err := newS3ClientFromEnv()
+	if err != nil {
+		failedSetting("object storage", err)
+	}
+	if s3Enabled {
+		readinessChecks.Register(objectStore)
+		if getEnvBool("S3_CREATE_BUCKET", false) {
+			go objectStore.ensureBucketWithRetry()
+		}
+		routes.HandleFunc("/api/objects", "Objects in the S3 bucket (GET lists, ?prefix=)", objectsHandler(objectStore), http.MethodGet)
+		routes.HandleFunc("/api/objects/", "One object in the S3 bucket (GET, PUT, DELETE)", objectsHandler(objectStore), http.MethodGet, http.MethodPut, http.MethodDelete)
+		slog.Info("object storage enabled", "path", "/api/objects", "endpoint", objectStore.endpoint.String(), "bucket", objectStore.bucket)
+	}
+
+	// Optional leader election among replicas on a Kubernetes Lease
+	electionCtx, stopElection := context.WithCancel(context.Background())
+	defer stopElection()
+	if getEnvBool("ENABLE_LEADER_ELECTION", false) {
+		kube, err := inClusterKube()
+		if err != nil {
+			fatal("leader election needs the Kubernetes API", "error", err)
+		}
+		elector, err = newLeaderElector(kube, getEnv("LEADER_ELECTION_LEASE", "go-app-leader"))
+		if err != nil {
+			fatal("leader election needs the Kubernetes API", "error", err)
+		}
+		go elector.Run(electionCtx)
+		slog.Info("leader election enabled", "lease", kube.namespace+"/"+elector.name, "identity", elector.identity)
+	}
+	routes.HandleFunc("/api/leader", "Current leader of the Lease election", leaderHandler, http.MethodGet)
+
+	// Optional work partitioning: shards split by ordinal or per-shard Leases
+	shardWork, err = newShardWorkerFromEnv()
+	if err != nil {
+		failedSetting("shards", err)
+	}
+	if shardWork != nil {
+		go shardWork.Run(electionCtx)
+		slog.Info("shard worker enabled", "shards", shardWork.count, "assignment", shardWork.mode)
+	}
+	routes.HandleFunc("/api/shards", "Shard ownership map: which replica works on each SHARDS shard", shardsHandler, http.MethodGet)
+
+	// Experimental key-value store replicated by Raft among StatefulSet pods
+	kvRaft, err = newRaftNodeFromEnv(port, kvStore)
+	if err != nil {
+		failedSetting("raft", err)
+	}
+	if kvRaft != nil {
+		go func() {
+			<-electionCtx.Done()
+			kvRaft.Shutdown()
+		}()
+		slog.Info("raft kv store enabled", "id", kvRaft.id, "addr", kvRaft.addr, "members", len(kvRaft.members.Servers), "state_dir", kvRaft.stateDir)
+	}
+	routes.HandleFunc("/api/kv/", "Replicated key-value store: GET, PUT or DELETE /api/kv/{key}, GET /api/kv/ lists keys (KV_RAFT)", kvHandler, http.MethodGet, http.MethodPut, http.MethodDelete)
+	routes.HandleFunc("/api/raft/status", "Raft member state: leader, term, commit index and each peer's replication", raftStatusHandler, http.MethodGet)
 
 	// Start server
-	addr := ":" + port
-	log.Printf("Starting %s v%s on %s", appName, appVersion, addr)
-	log.Printf("Endpoints: /, /health, /ready, /api/info")
+	listenAddrs, err := parseListenAddrs(getEnv("LISTEN_ADDR", ""), port)
+	if err != nil {
+		failedSetting("LISTEN_ADDR", err)
+		listenAddrs, _ = parseListenAddrs("", port)
+	}
+	addr := listenAddrs[0].addr
+	srv := &http.Server{Addr: addr, Handler: trackInFlight(mux)}
+	drainer.srv.Store(srv)
+	serverCfg.apply(srv)
+	srv.Protocols = protocolsFromEnv()
+	slog.Info("starting server", "app", appName, "version", appVersion, "commit", version.Short(buildInfo().GitCommit), "addr", listenAddrStrings(listenAddrs),
+		"protocols", protocolNames(srv.Protocols))
+	slog.Info("registered endpoints", "paths", routes.Paths())
+	slog.Info("server limits", "read_header_timeout", serverCfg.ReadHeaderTimeout.String(), "read_timeout", serverCfg.ReadTimeout.String(),
+		"write_timeout", serverCfg.WriteTimeout.String(), "idle_timeout", serverCfg.IdleTimeout.String(),
+		"max_header_bytes", serverCfg.MaxHeaderBytes, "max_conns", serverCfg.MaxConns)
+	var adminSrv *http.Server
+	if admin != routes {
+		adminSrv = serveAdmin(":"+adminPort, adminMux)
+		slog.Info("admin server listening", "addr", ":"+adminPort, "paths", admin.Paths())
+	}
+
+	// gRPC services and health on a second port; GRPC_PORT=0 disables it
+	var grpcSrv *http.Server
+	if grpcPort := getEnv("GRPC_PORT", "50051"); grpcPort != "0" {
+		grpcSrv = serveGRPC(":" + grpcPort)
+		slog.Info("gRPC server listening", "addr", ":"+grpcPort)
+	}
+
+	// Raw TCP echo for Service lessons without HTTP; off unless TCP_PORT is set
+	var tcpEcho *tcpEchoServer
+	if tcpPort := getEnv("TCP_PORT", "0"); tcpPort != "0" {
+		tcpEcho = serveTCPEcho(":" + tcpPort)
+		slog.Info("TCP echo server listening", "addr", ":"+tcpPort, "idle_timeout", tcpEchoIdleTimeout.String())
+	}
+
+	// UDP echo likewise, off unless UDP_PORT is set
+	var udpEcho *udpEchoServer
+	if udpPort := getEnv("UDP_PORT", "0"); udpPort != "0" {
+		udpEcho = serveUDPEcho(":" + udpPort)
+		slog.Info("UDP echo server listening", "addr", ":"+udpPort)
+	}
+
+	// The same API on a Unix socket for sidecars sharing a volume; off unless UDS_PATH is set
+	var udsSrv *http.Server
+	if udsPath := getEnv("UDS_PATH", ""); udsPath != "" {
+		udsSrv = serveUnix(udsPath, srv.Handler, serverCfg)
+		slog.Info("Unix socket server listening", "path", udsPath)
+	}
+
+	// Serve HTTPS when a certificate is configured, optionally requiring
+	// client certificates (mTLS) when a client CA bundle is given too
+	// Listen before serving so warm-up can run while the socket is open
+	ln, err := listenMain(listenAddrs)
+	if err != nil {
+		fatal("server failed to start", "error", err)
+	}
+	watchReload()
+	if getEnvBool("READY_CHECK_DUAL_STACK", false) {
+		readinessChecks.Register(dualStackCheck{addrs: listenAddrs})
+		slog.Info("readiness check enabled", "check", "dual-stack")
+	}
+	ln = serverCfg.listener(ln)
+	serve := func() error { return srv.Serve(ln) }
+	var redirectSrv *http.Server
+	var h3Srv *http3Server
+	certFile, keyFile := getEnv("TLS_CERT_FILE", ""), getEnv("TLS_KEY_FILE", "")
+	if certFile != "" && keyFile != "" {
+		certs, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			fatal("TLS configuration failed", "error", err)
+		}
+		go certs.Watch(getEnvDuration("TLS_RELOAD_INTERVAL", 10*time.Second))
+		// MTLS_CA_FILE is the newer name for TLS_CLIENT_CA_FILE
+		clientCAFile := getEnv("MTLS_CA_FILE", getEnv("TLS_CLIENT_CA_FILE", ""))
+		mtlsMode, minVersion := getEnv("MTLS_MODE", "require"), getEnv("TLS_MIN_VERSION", "1.2")
+		tlsConfig, err := buildTLSConfig(certs, clientCAFile, mtlsMode, minVersion)
+		if err != nil {
+			fatal("TLS configuration failed", "error", err)
+		}
+		srv.TLSConfig = tlsConfig
+		if clientCAFile != "" {
+			slog.Info("TLS enabled with client certificate verification", "mtls_mode", mtlsMode, "client_ca", clientCAFile, "min_version", minVersion)
+		} else {
+			slog.Info("TLS enabled", "min_version", minVersion)
+		}
+		serve = func() error { return srv.ServeTLS(ln, "", "") }
+
+		// Optional plain-HTTP port that redirects to HTTPS
+		if redirectPort := getEnv("HTTP_REDIRECT_PORT", ""); redirectPort != "" {
+			redirectSrv = serveHTTPSRedirect(":"+redirectPort, getEnv("HTTPS_PUBLIC_PORT", port), adminMux)
+			slog.Info("redirecting HTTP to HTTPS", "addr", ":"+redirectPort)
+		}
+
+		// Experimental HTTP/3 on a UDP port, announced by Alt-Svc over TCP
+		if h3Port := getEnv("HTTP3_PORT", ""); h3Port != "" {
+			if publicPort, err := http3PublicPort(h3Port); err != nil {
+				failedSetting("HTTP3_PORT", err)
+			} else {
+				h3Srv = serveHTTP3(":"+h3Port, publicPort, srv.Handler, tlsConfig)
+				srv.Handler = advertiseHTTP3(h3Srv, srv.Handler)
+				slog.Info("HTTP/3 server listening", "addr", ":"+h3Port, "alt_svc_port", publicPort)
+			}
+		}
+	} else if getEnv("HTTP3_PORT", "") != "" {
+		failedSetting("HTTP3_PORT", errors.New("needs TLS: set TLS_CERT_FILE and TLS_KEY_FILE"))
+	}
+
+	// Dependencies, a simulated slow start and optional warm-up before the
+	// startup and readiness probes pass
+	if dependencyWait, err = newStartupWaitFromEnv(); err != nil {
+		failedSetting("WAIT_FOR", err)
+	}
+	var warmup func() error
+	if getEnvBool("WARMUP", false) {
+		warmup = func() error { return warmUp(mux, warmupPaths) }
+	}
+	go startUp(dependencyWait, getEnvDuration("STARTUP_DELAY", 0), warmup, getEnvBool("WARMUP_REQUIRED", false))
+
+	// Shutdown behavior: our drain timeout vs. the pod's terminationGracePeriodSeconds
+	shutdownCfg := shutdownConfig{
+		Strategy:    getEnv("SHUTDOWN_STRATEGY", shutdownGraceful),
+		Delay:       getEnvDuration("SHUTDOWN_DELAY", 0),
+		Timeout:     getEnvDuration("SHUTDOWN_GRACE_PERIOD", 15*time.Second),
+		GracePeriod: getEnvDuration("TERMINATION_GRACE_PERIOD", defaultGracePeriod),
+	}
+	if shutdownCfg.Strategy != shutdownGraceful && shutdownCfg.Strategy != shutdownImmediate {
+		settingError("SHUTDOWN_STRATEGY", errors.New("want "+shutdownGraceful+" or "+shutdownImmediate))
+	}
+
+	// Every startup setting has been read by now; report the bad ones together
+	if err := settingsErrors(); err != nil {
+		fatal("invalid settings", "errors", strings.Split(err.Error(), "\n"))
+	}
+
+	logStartupBanner(newStartupBanner(appName, appVersion, port, map[string]bool{
+		"metrics":         true,
+		"tls":             srv.TLSConfig != nil,
+		"mtls":            srv.TLSConfig != nil && srv.TLSConfig.ClientCAs != nil,
+		"h2c":             srv.Protocols.UnencryptedHTTP2(),
+		"http2":           srv.TLSConfig != nil && srv.Protocols.HTTP2(),
+		"http3":           h3Srv != nil,
+		"redis_counter":   getEnv("REDIS_ADDR", "") != "",
+		"guestbook":       dbEnabled,
+		"leader_elect":    elector != nil,
+		"shards":          shardWork != nil,
+		"raft_kv":         kvRaft != nil,
+		"tracing":         tracer != nil,
+		"warmup":          getEnvBool("WARMUP", false),
+		"startup_delay":   getEnvDuration("STARTUP_DELAY", 0) > 0,
+		"wait_for":        dependencyWait != nil,
+		"degraded_auto":   degraded.auto,
+		"config_file":     appConfig().Checksum != "",
+		"flags_file":      featureFlags().Checksum != "",
+		"grpc":            grpcSrv != nil,
+		"admin_port":      adminSrv != nil,
+		"pprof":           adminSrv != nil && getEnvBool("ENABLE_PPROF", false),
+		"max_conns":       serverCfg.MaxConns > 0,
+		"rate_limit":      limiter != nil,
+		"tenants":         tenants != nil,
+		"mirror":          mirror != nil,
+		"registry":        registration != nil,
+		"vault":           vault != nil,
+		"access_log_file": getEnv("ACCESS_LOG_FILE", "") != "",
+		"broker":          msgBroker != nil,
+		"object_storage":  s3Enabled,
+		"tcp_echo":        tcpEcho != nil,
+		"udp_echo":        udpEcho != nil,
+		"unix_socket":     udsSrv != nil,
+		"upstreams":       len(upstreams.upstreams) > 0,
+		"self_load":       selfLoadPlanFor(appConfig()).schedule != nil,
+		"request_log":     reqLog != nil,
+		"restart_history": restartHistory != nil,
+		"cluster_view":    cluster != nil,
+		"groupcache":      groupcache != nil,
+	}))
+
+	sig := runServer(srv, serve, shutdownCfg)
+	lingerAfterShutdown(shutdownCfg.GracePeriod)
+
+	// Sidecars keep their socket through the drain; finish what they sent
+	if udsSrv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		udsSrv.Shutdown(ctx)
+		cancel()
+	}
+
+	// Jobs outlive the requests that queued them
+	jobs.Drain(getEnvDuration("JOB_DRAIN_TIMEOUT", 10*time.Second))
+
+	// After the last query, so the database drops this pod's users now
+	if vault != nil {
+		vault.Close()
+	}
+
+	// After the servers, so the log has their last requests
+	if reqLog != nil {
+		reqLog.Close()
+	}
+
+	// gRPC calls are short; Health/Watch streams end when the server closes
+	if grpcSrv != nil {
+		grpcSrv.Close()
+	}
+	if groupcache != nil {
+		groupcache.Close()
+	}
+	if tcpEcho != nil {
+		tcpEcho.Close()
+	}
+	if udpEcho != nil {
+		udpEcho.Close()
+	}
+	if redirectSrv != nil {
+		redirectSrv.Close()
+	}
+	if h3Srv != nil {
+		h3Srv.Close()
+	}
+	// Last, so probes and scrapes were answered throughout the drain
+	if adminSrv != nil {
+		adminSrv.Close()
+	}
+
+	// Hand over leadership now rather than after the lease expires
+	if elector != nil {
+		stopElection()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		elector.Release(ctx)
+		cancel()
+	}
+	if shardWork != nil {
+		stopElection()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		shardWork.Release(ctx)
+		cancel()
+	}
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	if msgBroker != nil {
+		msgBroker.Close()
 	}
+
+	// Send the last spans before exiting
+	if tracer != nil {
+		tracer.Flush()
+	}
+
+	// PID 1 outlives its generation, or the container would stop with it
+	if successor != nil && os.Getpid() == 1 {
+		return superviseGenerations(successorSockets, successor)
+	}
+
+	code := configuredExitCode(0)
+	signalName := "none"
+	if sig != nil {
+		signalName = sig.String()
+	}
+	writeTerminationMessage(code, "Shutdown", "stopped on "+signalName+" after a "+shutdownCfg.Strategy+" shutdown",
+		map[string]any{"signal": signalName, "strategy": shutdownCfg.Strategy, "signals": len(receivedSignals())})
+	if code != 0 {
+		slog.Warn("exiting with EXIT_CODE", "exit_code", code)
+	}
+	return code
+}
+
+// HomePage is the data for templates/home.html
+type HomePage struct {
+	AppName     string
+	BodyClass   string
+	ThemeStyle  template.CSS
+	Banner      string
+	Badge       string
+	StartingUp  string // time left of STARTUP_DELAY, "" once started
+	FlagMessage string
+	Rows        []HomeRow
+}
+
+// HomeRow is one label/value line of the info box
+type HomeRow struct {
+	Label, Value string
 }
 
 // homeHandler serves the main HTML page
-func homeHandler(appName, appVersion string) http.HandlerFunc {
+func homeHandler(pages *template.Template, appName string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		hostname, _ := os.Hostname()
-
-		html := fmt.Sprintf(`
-<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>%s - Kubernetes Demo</title>
-    <style>
-        * { margin: 0; padding: 0; box-sizing: border-box; }
-        body {
-            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
-            background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);
-            min-height: 100vh;
-            display: flex;
-            align-items: center;
-            justify-content: center;
-            padding: 20px;
-        }
-        .container {
-            background: white;
-            border-radius: 20px;
-            box-shadow: 0 20px 60px rgba(0,0,0,0.3);
-            padding: 60px;
-            max-width: 600px;
-            width: 100%%;
-        }
-        h1 {
-            color: #333;
-            font-size: 2.5em;
-            margin-bottom: 10px;
-            text-align: center;
-        }
-        .emoji { font-size: 4em; text-align: center; margin: 20px 0; }
-        .info {
-            background: #f7f7f7;
-            border-left: 4px solid #667eea;
-            padding: 20px;
-            margin: 20px 0;
-            border-radius: 5px;
-        }
-        .info-item {
-            display: flex;
-            justify-content: space-between;
-            padding: 10px 0;
-            border-bottom: 1px solid #e0e0e0;
-        }
-        .info-item:last-child { border-bottom: none; }
-        .label { font-weight: bold; color: #666; }
-        .value { color: #333; font-family: 'Courier New', monospace; }
-        .badge {
-            display: inline-block;
-            background: #667eea;
-            color: white;
-            padding: 5px 15px;
-            border-radius: 20px;
-            font-size: 0.9em;
-            margin-top: 10px;
-        }
-        .links {
-            display: grid;
-            grid-template-columns: 1fr 1fr;
-            gap: 15px;
-            margin-top: 30px;
-        }
-        .link-btn {
-            background: #667eea;
-            color: white;
-            padding: 15px;
-            text-align: center;
-            border-radius: 10px;
-            text-decoration: none;
-            transition: all 0.3s;
-        }
-        .link-btn:hover {
-            background: #764ba2;
-            transform: translateY(-2px);
-            box-shadow: 0 5px 15px rgba(0,0,0,0.2);
-        }
-        footer {
-            margin-top: 30px;
-            text-align: center;
-            color: #999;
-            font-size: 0.9em;
-        }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <div class="emoji">🚀</div>
-        <h1>Kubernetes Demo</h1>
-        <p style="text-align: center; color: #666; margin-bottom: 30px;">
-            Running on KIND (Kubernetes IN Docker)
-        </p>
-
-        <div class="info">
-            <div class="info-item">
-                <span class="label">Application:</span>
-                <span class="value">%s</span>
-            </div>
-            <div class="info-item">
-                <span class="label">Version:</span>
-                <span class="value">%s</span>
-            </div>
-            <div class="info-item">
-                <span class="label">Pod/Hostname:</span>
-                <span class="value">%s</span>
-            </div>
-            <div class="info-item">
-                <span class="label">Request Time:</span>
-                <span class="value">%s</span>
-            </div>
-        </div>
-
-        <div class="links">
-            <a href="/api/info" class="link-btn">📊 API Info</a>
-            <a href="/health" class="link-btn">💚 Health Check</a>
-        </div>
-
-        <footer>
-            <p>Learning Kubernetes with KIND</p>
-            <p style="margin-top: 5px;">Refresh the page to see which pod handles the request!</p>
-        </footer>
-    </div>
-</body>
-</html>
-`, appName, appName, appVersion, hostname, time.Now().Format(time.RFC3339))
-
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, html)
-
-		log.Printf("Served request from %s to pod %s", r.RemoteAddr, hostname)
+		page := HomePage{
+			AppName:     appName,
+			BodyClass:   homepageClass(),
+			ThemeStyle:  themeStyle(),
+			Banner:      cmp.Or(currentTheme().Banner, trackBanner()),
+			Badge:       themeBadge(),
+			StartingUp:  startupNotice(),
+			FlagMessage: flagString("v2_message"),
+			Rows: []HomeRow{
+				{"Application", appName},
+				{"Version", versionLabel()},
+				{"Track", deploymentTrack()},
+				{"Pod/Hostname", hostname},
+				{"Node/Zone", servedBy()},
+				{"Visits", visitsLabel(recordVisit(r.Context()))},
+			},
+		}
+		if leader := leaderLabel(); leader != "" {
+			page.Rows = append(page.Rows, HomeRow{"Leader", leader})
+		}
+		page.Rows = append(page.Rows, HomeRow{"Request Time", time.Now().Format(time.RFC3339)})
+		renderPage(w, r, pages, "home.html", page)
 	}
 }
 
@@ -198,47 +888,169 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		Uptime:  uptime.String(),
 		Checked: time.Now(),
 	}
+	code := http.StatusOK
+
+	// Failure injected through /admin/health/fail
+	if failing, _ := liveness.Failing(); failing {
+		status.Status = "unhealthy"
+		code = http.StatusInternalServerError
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(status)
+	writeJSON(w, code, status)
 }
 
-// readyHandler provides readiness probe endpoint
+// readyHandler provides readiness probe endpoint. The pod is ready once
+// startup has finished and every configured dependency check passes.
 func readyHandler(w http.ResponseWriter, r *http.Request) {
-	// In a real app, check dependencies (DB, cache, etc.)
-	status := map[string]string{
-		"status": "ready",
+	status := ReadyStatus{Status: "ready", Toggle: readyOverride.status()}
+	code := http.StatusOK
+
+	if !status.Toggle.Enabled {
+		status.Status = "not ready"
+		status.Reason = "disabled via /admin/ready/disable"
+		code = http.StatusServiceUnavailable
+	} else if drainer.Draining() {
+		status.Status = "not ready"
+		status.Reason = "draining via /admin/drain"
+		code = http.StatusServiceUnavailable
+	} else if !ready.Load() {
+		status.Status = "not ready"
+		status.Reason = "shutting down"
+		if !started.Load() {
+			status.Reason = "starting up"
+		}
+		code = http.StatusServiceUnavailable
+	} else if checks, ok := readinessChecks.Run(r.Context()); !ok {
+		status.Status = "not ready"
+		status.Reason = "dependency check failed"
+		status.Checks = checks
+		code = http.StatusServiceUnavailable
+	} else {
+		status.Checks = checks
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(status)
+	writeJSON(w, code, status)
 }
 
 // apiInfoHandler provides JSON API endpoint
 func apiInfoHandler(appName, appVersion string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		hostname, _ := os.Hostname()
+		info := newAppInfo(r, appName, appVersion)
 
-		info := AppInfo{
-			Name:      appName,
-			Version:   appVersion,
-			Hostname:  hostname,
-			Timestamp: time.Now(),
-			Message:   "Hello from Kubernetes!",
-		}
+		// Weak: the same answer but for the time it was given
+		untimed := info
+		untimed.Timestamp = time.Time{}
+		writeJSONConditional(w, r, "W/"+etagOf(untimed), info)
+	}
+}
+
+// newAppInfo describes this pod as seen by request r
+func newAppInfo(r *http.Request, appName, appVersion string) AppInfo {
+	hostname, _ := os.Hostname()
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(info)
+	info := AppInfo{
+		Name:      appName,
+		Version:   appVersion,
+		Hostname:  hostname,
+		Timestamp: time.Now(),
+		Message:   appMessage(),
+		ClientCN:  clientCommonName(r),
+		Protocol:  requestProtocol(r),
+		Zone:      topology().Zone,
+		Region:    topology().Region,
+		Color:     currentTheme().Color,
+		PodColor:  currentPodColor(),
+		Track:     deploymentTrack(),
+	}
+	if hotReload() {
+		info.Generation = reloadGeneration()
 	}
+	pod := readPodInfo()
+	info.Namespace = pod.Namespace
+	info.PodName = pod.Name
+	info.PodIP = pod.IP
+	info.Node = pod.Node
+	if !degraded.skip(nil, "visits") {
+		info.Visits = currentVisits(r.Context())
+	}
+	if o, ok := statefulSetOrdinal(); ok {
+		info.Ordinal, info.Role = &o.ordinal, o.role()
+	}
+	return info
 }
 
-// getEnv gets environment variable with fallback
+// getEnv gets a setting (flag, env or config file) with fallback
 func getEnv(key, fallback string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+	value := lookupSetting(key, "string", fallback)
+	if value == "" || checkSetting(key, value) != nil {
+		return fallback
+	}
+	return value
+}
+
+// getEnvBool gets a boolean setting with fallback
+func getEnvBool(key string, fallback bool) bool {
+	value := lookupSetting(key, "bool", strconv.FormatBool(fallback))
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		invalidSetting(key, value, "not a boolean", fallback)
+		return fallback
+	}
+	return b
+}
+
+// getEnvInt gets an integer setting with fallback
+func getEnvInt(key string, fallback int64) int64 {
+	value := lookupSetting(key, "int", strconv.FormatInt(fallback, 10))
+	if value == "" {
+		return fallback
 	}
-	return fallback
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		invalidSetting(key, value, "not an integer", fallback)
+		return fallback
+	}
+	return n
+}
+
+// getEnvFloat gets a decimal setting with fallback
+func getEnvFloat(key string, fallback float64) float64 {
+	value := lookupSetting(key, "float", strconv.FormatFloat(fallback, 'g', -1, 64))
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		invalidSetting(key, value, "not a number", fallback)
+		return fallback
+	}
+	return f
+}
+
+// getEnvDuration parses a duration setting, accepting plain numbers as
+// seconds so values can be copied straight from a pod spec
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := lookupSetting(key, "duration", fallback.String())
+	if value == "" {
+		return fallback
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		invalidSetting(key, value, "not a positive duration such as 30s or 5m", fallback.String())
+		return fallback
+	}
+	return d
+}
+
+// invalidSetting records a value that didn't parse; serve fails on it at
+// startup, later reads log it and use the default
+func invalidSetting(key, value, problem string, fallback any) {
+	settingError(key, errors.New(problem))
+	slog.Warn("invalid setting, using default", "key", key, "value", value, "default", fallback)
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/middleware"
+)
+
+// This file is a small implementation of the Prometheus text exposition
+// format, in place of client_golang. It supports just what the app needs:
+// labelled counters, gauges and histograms, plus gauges computed at scrape
+// time. Everything /metrics serves is built here, which makes it the place
+// to read how the format works.
+
+// collector is anything that can render itself in exposition format
+type collector interface {
+	write(w io.Writer)
+}
+
+// metricsRegistry holds every metric exposed at /metrics
+type metricsRegistry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// metrics is the process-wide registry
+var metrics = &metricsRegistry{}
+
+func (m *metricsRegistry) register(c collector) {
+	m.mu.Lock()
+	m.collectors = append(m.collectors, c)
+	m.mu.Unlock()
+}
+
+// Render writes all registered metrics. They are formatted into a buffer
+// first: collectors hold their lock while writing, and the response writer
+// counts metrics of its own (compression), which would deadlock on a
+// collector that is mid-write.
+func (m *metricsRegistry) Render(w io.Writer) {
+	m.mu.Lock()
+	collectors := append([]collector(nil), m.collectors...)
+	m.mu.Unlock()
+	var buf bytes.Buffer
+	for _, c := range collectors {
+		c.write(&buf)
+	}
+	w.Write(buf.Bytes())
+}
+
+// metricVec is the shared label bookkeeping for counters and gauges
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(kind, name, help string, labels []string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, values: map[string]float64{}}
+}
+
+func (v *metricVec) add(delta float64, labelValues []string) {
+	key := labelKey(v.labels, labelValues)
+	v.mu.Lock()
+	v.values[key] += delta
+	v.mu.Unlock()
+}
+
+func (v *metricVec) set(value float64, labelValues []string) {
+	key := labelKey(v.labels, labelValues)
+	v.mu.Lock()
+	v.values[key] = value
+	v.mu.Unlock()
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, key, formatFloat(v.values[key]))
+	}
+}
+
+// counterVec is a monotonically increasing counter with labels
+type counterVec struct{ vec *metricVec }
+
+// newCounterVec creates and registers a counter
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{newMetricVec("counter", name, help, labels)}
+	metrics.register(c.vec)
+	return c
+}
+
+// Inc adds one to the series identified by labelValues
+func (c *counterVec) Inc(labelValues ...string) { c.vec.add(1, labelValues) }
+
+// Add adds delta (which must not be negative) to the series
+func (c *counterVec) Add(delta float64, labelValues ...string) { c.vec.add(delta, labelValues) }
+
+// gaugeVec is a value that can go up and down, with labels
+type gaugeVec struct{ vec *metricVec }
+
+// newGaugeVec creates and registers a gauge
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{newMetricVec("gauge", name, help, labels)}
+	metrics.register(g.vec)
+	return g
+}
+
+// Set sets the series identified by labelValues
+func (g *gaugeVec) Set(value float64, labelValues ...string) { g.vec.set(value, labelValues) }
+
+// Add adds delta to the series identified by labelValues
+func (g *gaugeVec) Add(delta float64, labelValues ...string) { g.vec.add(delta, labelValues) }
+
+// gaugeFunc is a gauge (or counter) whose value is computed at scrape time
+type gaugeFunc struct {
+	name, help, kind string
+	fn               func() float64
+}
+
+// newGaugeFunc registers a gauge computed by fn on every scrape
+func newGaugeFunc(name, help string, fn func() float64) {
+	metrics.register(&gaugeFunc{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+// newCounterFunc registers a counter read from fn on every scrape
+func newCounterFunc(name, help string, fn func() float64) {
+	metrics.register(&gaugeFunc{name: name, help: help, kind: "counter", fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", g.name, g.help, g.name, g.kind, g.name, formatFloat(g.fn()))
+}
+
+// histogramVec tracks observations in cumulative buckets, with labels
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // one per bucket, non-cumulative
+	count  uint64
+	sum    float64
+}
+
+// defaultBuckets suit HTTP latencies from a few milliseconds to 10 seconds
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// newHistogramVec creates and registers a histogram
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+	metrics.register(h)
+	return h
+}
+
+// Observe records value in the series identified by labelValues
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := labelKey(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// labelKey renders label pairs as `{a="x",b="y"}`, which doubles as the
+// series key
+func labelKey(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel appends one more label pair to a rendered label key
+func withLabel(key, name, value string) string {
+	pair := name + `="` + value + `"`
+	if key == "" {
+		return "{" + pair + "}"
+	}
+	return key[:len(key)-1] + "," + pair + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string { return labelEscaper.Replace(v) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// HTTP request metrics, labelled by route pattern rather than raw URL so
+// cardinality stays bounded no matter what clients request
+var (
+	httpRequestsTotal = newCounterVec("http_requests_total",
+		"Total HTTP requests handled.", "handler", "method", "code")
+	httpRequestDuration = newHistogramVec("http_request_duration_seconds",
+		"HTTP request latency in seconds.", defaultBuckets, "handler", "method")
+)
+
+func init() {
+	newGaugeFunc("http_requests_in_flight", "HTTP requests currently being served.",
+		func() float64 { return float64(inFlight.Load()) })
+	registerRuntimeMetrics()
+}
+
+// registerRuntimeMetrics exposes the Go runtime stats usually provided by
+// the Prometheus client's Go collector
+func registerRuntimeMetrics() {
+	var (
+		mu       sync.Mutex
+		lastRead time.Time
+		stats    runtime.MemStats
+	)
+	// ReadMemStats stops the world, so read it at most once per scrape burst
+	memStats := func() *runtime.MemStats {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(lastRead) > time.Second {
+			runtime.ReadMemStats(&stats)
+			lastRead = time.Now()
+		}
+		return &stats
+	}
+
+	metrics.register(&infoMetric{name: "go_info", help: "Information about the Go environment.",
+		labels: labelKey([]string{"version"}, []string{runtime.Version()})})
+	newGaugeFunc("go_goroutines", "Number of goroutines that currently exist.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+	newGaugeFunc("go_sched_gomaxprocs_threads", "The current runtime.GOMAXPROCS setting.",
+		func() float64 { return float64(runtime.GOMAXPROCS(0)) })
+	newGaugeFunc("go_memstats_alloc_bytes", "Bytes of allocated heap objects.",
+		func() float64 { return float64(memStats().Alloc) })
+	newGaugeFunc("go_memstats_heap_inuse_bytes", "Bytes in in-use heap spans.",
+		func() float64 { return float64(memStats().HeapInuse) })
+	newGaugeFunc("go_memstats_sys_bytes", "Bytes of memory obtained from the OS.",
+		func() float64 { return float64(memStats().Sys) })
+	newCounterFunc("go_gc_cycles_total", "Completed GC cycles.",
+		func() float64 { return float64(memStats().NumGC) })
+	newGaugeFunc("process_start_time_seconds", "Start time of the process since unix epoch in seconds.",
+		func() float64 { return float64(startTime.Unix()) })
+}
+
+// infoMetric is a constant gauge of 1 carrying information in its labels
+type infoMetric struct {
+	name, help, labels string
+}
+
+func (m *infoMetric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s%s 1\n", m.name, m.help, m.name, m.name, m.labels)
+}
+
+// methodLabel is r's method for the method label, or "other" past the
+// standard ones: the method is the client's to choose, and each new one
+// would start new series, as an unbounded tenant would
+func methodLabel(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return r.Method
+	}
+	return "other"
+}
+
+// instrument records request count and latency for handler under the
+// given route pattern and wraps it in a server span
+func instrument(pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		method := methodLabel(r)
+		ctx, s := startSpan(contextWithRemoteParent(r.Context(), r.Header), method+" "+pattern, spanKindServer)
+		ctx, stages := withStageTimer(ctx)
+		r = r.WithContext(ctx)
+
+		rec := &middleware.Recorder{ResponseWriter: w}
+		handler(rec, r)
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		httpRequestsTotal.Inc(pattern, method, strconv.Itoa(rec.Status))
+		httpRequestDuration.Observe(time.Since(start).Seconds(), pattern, method)
+		countTrackRequest(pattern, rec.Status)
+		if rec.Header().Get(degradedHeader) == "" {
+			slos.record(pattern, rec.Status, time.Since(start))
+		}
+
+		s.SetAttr("http.method", r.Method)
+		s.SetAttr("http.route", pattern)
+		s.SetAttr("url.path", r.URL.Path)
+		s.SetAttr("http.status_code", rec.Status)
+		if id := requestIDFromContext(ctx); id != "" {
+			s.SetAttr("http.request_id", id)
+		}
+		s.isError = rec.Status >= http.StatusInternalServerError
+		s.mu.Lock()
+		s.stages = stages.done()
+		s.mu.Unlock()
+		s.End()
+	}
+}
+
+// metricsHandler serves all metrics in Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	metrics.Render(w)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/middleware"
+)
+
+// standardMiddleware is applied to every route, outermost first:
+//
+//	request ID -> timing headers -> metrics and span -> access log -> CORS -> compression -> debug capture -> tenant -> rate limit -> concurrency limit -> mirror -> timeout -> panic recovery -> JWT auth -> audit -> basic auth -> chaos -> per-request faults -> format negotiation -> handler
+//
+// Recovery sits inside the access log and metrics so a panic is logged and
+// counted as the 500 it turned into; rejected 429s are logged and counted too.
+// X-Response-Time is taken as close to the outside as it can be while still
+// going out with the response's header.
+// CORS answers preflights before the rate limiter, so a browser's OPTIONS
+// doesn't spend a token. The tenant is known before the rate limiter, which
+// keeps a bucket per tenant. A request waits for a concurrency slot only
+// once the rate limiter has let it in. Requests either turns away aren't
+// mirrored, and the mirror sees the status the client got, timeouts
+// included. Compression covers everything written inside it, error bodies
+// included; a debug capture inside it keeps bodies as the handler wrote
+// them. The timeout's deadline covers auth and injected faults, and its
+// 504 is logged, counted and compressed like any other. Auth sits after
+// the rate limiter, so guessing passwords costs tokens like any other
+// request, except on /admin/*, which the limiter lets through for the
+// kubelet: there basic auth throttles wrong guesses itself. The audit trail sits between the two auths: it sees the JWT
+// subject and what basic auth turns away. Format negotiation is innermost,
+// as only the handler's own writeJSON changes format.
+var standardMiddleware = []middleware.Func{withRequestID, timingHeaders, instrument, accessLog, cors, compress, captureTraffic, withTenant, rateLimit, limitConcurrency, mirrorTraffic, withTimeout, recoverPanic, authenticate, auditActions, requireBasicAuth, injectChaos, injectFromRequest, negotiateFormats}
+
+// withRequestID takes the caller's X-Request-ID or makes one up (see
+// middleware.RequestID), so one request can be followed across pods with
+// kubectl logs | grep. X-Served-By (and X-Pod, the name timing.go's
+// lessons use) names the pod and X-Deployment-Track its track, for curl -i
+// and ./app loadgen's tallies.
+func withRequestID(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	hostname, _ := os.Hostname()
+	track := deploymentTrack()
+	return middleware.RequestID(pattern, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", hostname)
+		w.Header().Set("X-Pod", hostname)
+		w.Header().Set("X-Deployment-Track", track)
+		next(w, r)
+	})
+}
+
+// requestIDFromContext returns the request ID, or "" outside a request
+func requestIDFromContext(ctx context.Context) string {
+	return middleware.RequestIDFromContext(ctx)
+}
+
+// accessLog writes one log line per request and publishes it to /events
+func accessLog(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return middleware.AccessLog(logRequest)(pattern, next)
+}
+
+// logRequest is accessLog's line and event for one request
+func logRequest(r *http.Request, status int, start time.Time) {
+	latency := time.Since(start)
+
+	accessLogger.Info("request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", status,
+		"latency_ms", float64(latency.Microseconds())/1000,
+		"remote", r.RemoteAddr,
+		"trace_id", traceIDFromContext(r.Context()),
+		"request_id", requestIDFromContext(r.Context()),
+	)
+	hostname, _ := os.Hostname()
+	requestEvents.Publish(RequestEvent{
+		Time:         start,
+		Pod:          hostname,
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		Status:       status,
+		Client:       r.RemoteAddr,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		LatencyMS:    float64(latency.Microseconds()) / 1000,
+		RequestID:    requestIDFromContext(r.Context()),
+	})
+}
+
+var httpPanics = newCounterVec("http_panics_total",
+	"Handler panics recovered, by route.", "handler")
+
+// recoverPanic turns a handler panic into a logged, structured 500 instead
+// of net/http's default of dropping the connection
+func recoverPanic(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return middleware.Recover(reportPanic, func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusInternalServerError, "the handler panicked; see the logs for this request_id")
+	})(pattern, next)
+}
+
+// reportPanic logs and counts a recovered panic
+func reportPanic(r *http.Request, pattern string, v any, stack []byte) {
+	httpPanics.Inc(pattern)
+	slog.Error("handler panic", "path", r.URL.Path, "panic", fmt.Sprint(v),
+		"request_id", requestIDFromContext(r.Context()), "stack", string(stack))
+}
@@ -0,0 +1,159 @@
+// Package middleware composes the cross-cutting behavior wrapped around
+// every route: a Func takes the route's pattern and the handler it wraps,
+// and Chain stacks them. The pieces most middleware needs live here too:
+// request IDs, a Recorder for the status written, panic recovery and
+// access logging. What they log or count is left to the app, which passes
+// it in; the app's own middleware (metrics, auth, limits) builds on these.
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Func wraps the handler registered for a route pattern. Taking the
+// pattern lets cross-cutting behavior label by route (metrics, spans) or
+// opt routes out (chaos skips /chaos itself).
+type Func func(pattern string, next http.HandlerFunc) http.HandlerFunc
+
+// Chain wraps handler in mws, the first one outermost. around, when not
+// nil, also wraps the handler and each layer, under its Name ("handler"
+// for the handler itself), e.g. to time them.
+func Chain(pattern string, handler http.HandlerFunc, around func(name string, next http.HandlerFunc) http.HandlerFunc, mws ...Func) http.HandlerFunc {
+	if around == nil {
+		around = func(_ string, next http.HandlerFunc) http.HandlerFunc { return next }
+	}
+	handler = around("handler", handler)
+	for i := len(mws) - 1; i >= 0; i-- {
+		handler = around(Name(mws[i]), mws[i](pattern, handler))
+	}
+	return handler
+}
+
+// Name is a middleware's function name, without its package
+func Name(mw Func) string {
+	name := runtime.FuncForPC(reflect.ValueOf(mw).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+type requestIDKey struct{}
+
+// validRequestID bounds what we accept from clients: IDs end up in logs
+// and response headers
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID reuses the caller's X-Request-ID, as set by Ingress
+// controllers and upstream services, or generates one. The ID is echoed in
+// the response and kept in the request's context (RequestIDFromContext),
+// for logs and outbound calls, so one request can be followed across pods
+// with kubectl logs | grep.
+func RequestID(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			var b [16]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set("X-Request-ID", id)
+		next(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// RequestIDFromContext returns the request ID, or "" outside a request
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Recorder captures the status code written by a handler, 0 until one is
+type Recorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (s *Recorder) WriteHeader(code int) {
+	if s.Status == 0 {
+		s.Status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *Recorder) Write(b []byte) (int, error) {
+	if s.Status == 0 {
+		s.Status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses working through the wrapper
+func (s *Recorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack records upgraded connections (WebSockets) as 101 Switching Protocols
+func (s *Recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(s.ResponseWriter).Hijack()
+	if err == nil && s.Status == 0 {
+		s.Status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *Recorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// AccessLog calls log once per request, after it was served, with the
+// status sent (200 when the handler wrote nothing) and when it started
+func AccessLog(log func(r *http.Request, status int, start time.Time)) Func {
+	return func(pattern string, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &Recorder{ResponseWriter: w}
+			next(rec, r)
+			if rec.Status == 0 {
+				rec.Status = http.StatusOK
+			}
+			log(r, rec.Status, start)
+		}
+	}
+}
+
+// Recover turns a handler panic into a structured 500 instead of
+// net/http's default of dropping the connection. report is told about the
+// panic, with the stack; fail writes the response, unless the handler had
+// started one already. http.ErrAbortHandler is left to net/http, which
+// closes the connection quietly.
+func Recover(report func(r *http.Request, pattern string, v any, stack []byte), fail http.HandlerFunc) Func {
+	return func(pattern string, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			rec := &Recorder{ResponseWriter: w}
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				report(r, pattern, v, debug.Stack())
+				if rec.Status == 0 {
+					fail(rec, r)
+				}
+			}()
+			next(rec, r)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tagged(tag string, order *[]string) Func {
+	return func(pattern string, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			*order = append(*order, tag+" "+pattern)
+			next(w, r)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order, stages []string
+	around := func(name string, next http.HandlerFunc) http.HandlerFunc {
+		stages = append(stages, name)
+		return next
+	}
+	h := Chain("/api/x", func(http.ResponseWriter, *http.Request) { order = append(order, "handler") },
+		around, tagged("outer", &order), tagged("inner", &order), RequestID)
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/x", nil))
+
+	if want := []string{"outer /api/x", "inner /api/x", "handler"}; !slices.Equal(order, want) {
+		t.Errorf("ran %q, want %q", order, want)
+	}
+	// Wrapped from the inside out; closures are named after their function
+	if len(stages) != 4 || stages[0] != "handler" || stages[1] != "RequestID" {
+		t.Errorf("stages %q, want handler, RequestID and the two closures", stages)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := RequestID("/", func(w http.ResponseWriter, r *http.Request) { seen = RequestIDFromContext(r.Context()) })
+	tests := []struct {
+		name, header string
+		kept         bool
+	}{
+		{"from the caller", "abc-123.ingress:1", true},
+		{"none", "", false},
+		{"injected newline", "abc\nX-Admin: 1", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("X-Request-ID", tt.header)
+			w := httptest.NewRecorder()
+			h(w, r)
+			got := w.Header().Get("X-Request-ID")
+			if got != seen {
+				t.Errorf("header %q, context %q: want the same ID", got, seen)
+			}
+			if kept := got == tt.header; kept != tt.kept || len(got) == 0 {
+				t.Errorf("ID %q for %q, want it kept: %v", got, tt.header, tt.kept)
+			}
+		})
+	}
+	if RequestIDFromContext(httptest.NewRequest(http.MethodGet, "/", nil).Context()) != "" {
+		t.Error("an ID outside a request")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	var reported any
+	mw := Recover(func(r *http.Request, pattern string, v any, stack []byte) {
+		reported = v
+		if pattern != "/boom" || len(stack) == 0 {
+			t.Errorf("reported %q with %d bytes of stack", pattern, len(stack))
+		}
+	}, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "recovered", http.StatusInternalServerError)
+	})
+
+	w := httptest.NewRecorder()
+	mw("/boom", func(http.ResponseWriter, *http.Request) { panic("boom") })(w, httptest.NewRequest(http.MethodGet, "/boom", nil))
+	if reported != "boom" || w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "recovered") {
+		t.Errorf("reported %v, answered %d %q; want boom and a 500", reported, w.Code, w.Body)
+	}
+
+	// A response already under way is left alone
+	w = httptest.NewRecorder()
+	mw("/boom", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("late")
+	})(w, httptest.NewRequest(http.MethodGet, "/boom", nil))
+	if w.Code != http.StatusAccepted || strings.Contains(w.Body.String(), "recovered") {
+		t.Errorf("answered %d %q after the handler started, want its 202 alone", w.Code, w.Body)
+	}
+
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want ErrAbortHandler passed on", v)
+		}
+	}()
+	mw("/abort", func(http.ResponseWriter, *http.Request) { panic(http.ErrAbortHandler) })(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/abort", nil))
+}
+
+func TestAccessLog(t *testing.T) {
+	var statuses []int
+	mw := AccessLog(func(r *http.Request, status int, start time.Time) {
+		if start.IsZero() {
+			t.Error("no start time")
+		}
+		statuses = append(statuses, status)
+	})
+	for _, h := range []http.HandlerFunc{
+		func(http.ResponseWriter, *http.Request) {},
+		func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) },
+	} {
+		mw("/", h)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	if !slices.Equal(statuses, []int{http.StatusOK, http.StatusNotFound}) {
+		t.Errorf("logged %v, want 200 for a handler that wrote nothing, then 404", statuses)
+	}
+}
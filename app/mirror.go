@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/middleware"
+)
+
+// Traffic mirroring, the app-level version of a shadow deployment: a share
+// of /api/ requests is copied to a second deployment, whose answers are
+// thrown away after comparing their status with the one the client got:
+//
+//	MIRROR_URL=http://go-app-shadow MIRROR_PERCENT=10
+//	curl localhost:30080/api/mirror
+//
+// The copy is sent while the real request is served, never delays it, and
+// is dropped rather than queued when MIRROR_CONCURRENCY copies are already
+// in flight. Bodies up to MIRROR_MAX_BODY (1MiB) are mirrored; larger ones,
+// and the long-lived routes, are not. A copy carries X-Mirrored-From and is
+// never mirrored again, so MIRROR_URL may point back at this Service.
+// mirror_requests_total{result="diverged"} is what to watch before moving
+// the shadow to real traffic; a mesh does the same with Istio's mirror or
+// Linkerd's traffic split, minus the comparison. The shadow does the work
+// for real: a mirrored POST /api/jobs is a second job unless the shadow has
+// backends of its own.
+
+// keptDivergences bounds the recent divergences /api/mirror returns
+const keptDivergences = 50
+
+// mirrorExempt are /api/ routes whose requests are too long-lived or too
+// big to copy
+func mirrorExempt(pattern string) bool {
+	switch pattern {
+	case "/api/wait", "/api/stream-echo", "/api/upload", "/api/download", "/api/upload-sink":
+		return true
+	}
+	return strings.HasPrefix(pattern, "/api/load/")
+}
+
+// trafficMirror copies requests to target
+type trafficMirror struct {
+	target  *url.URL
+	percent float64
+	maxBody int64
+	timeout time.Duration
+	slots   chan struct{} // one per copy in flight
+	client  *http.Client
+
+	mu        sync.Mutex
+	stats     map[string]int64 // by result
+	divergent []MirrorDivergence
+}
+
+// mirror is set in main when MIRROR_URL is
+var mirror *trafficMirror
+
+// MirrorDivergence is one request whose copy answered differently
+type MirrorDivergence struct {
+	Time           time.Time `json:"time"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	RequestID      string    `json:"request_id,omitempty"`
+	PrimaryStatus  int       `json:"primary_status"`
+	ShadowStatus   int       `json:"shadow_status"`
+	PrimaryLatency float64   `json:"primary_latency_ms"`
+	ShadowLatency  float64   `json:"shadow_latency_ms"`
+}
+
+// MirrorResponse is returned by /api/mirror
+type MirrorResponse struct {
+	Enabled  bool               `json:"enabled"`
+	Target   string             `json:"target,omitempty"`
+	Percent  float64            `json:"percent"`
+	Pod      string             `json:"pod"`
+	Results  map[string]int64   `json:"results"`            // match, diverged, error, dropped, skipped
+	Diverged []MirrorDivergence `json:"recent_divergences"` // newest first
+}
+
+var (
+	mirrorRequests = newCounterVec("mirror_requests_total",
+		"Requests copied to MIRROR_URL, by result: match, diverged, error, dropped (too many in flight) or skipped (body too large).", "result")
+	mirrorDivergence = newCounterVec("mirror_status_divergence_total",
+		"Mirrored requests whose shadow answered with a different status class, by both.", "primary", "shadow")
+	mirrorDuration = newHistogramVec("mirror_shadow_duration_seconds",
+		"Time the shadow took to answer a mirrored request.", defaultBuckets)
+)
+
+// newTrafficMirrorFromEnv returns nil when MIRROR_URL is unset
+func newTrafficMirrorFromEnv() (*trafficMirror, error) {
+	raw := getEnv("MIRROR_URL", "")
+	if raw == "" {
+		return nil, nil
+	}
+	target, err := url.Parse(raw)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("MIRROR_URL %q is not an http(s) URL", raw)
+	}
+	m := &trafficMirror{
+		target:  target,
+		percent: min(max(getEnvFloat("MIRROR_PERCENT", 100), 0), 100),
+		maxBody: getEnvInt("MIRROR_MAX_BODY", 1<<20),
+		timeout: getEnvDuration("MIRROR_TIMEOUT", 5*time.Second),
+		slots:   make(chan struct{}, max(getEnvInt("MIRROR_CONCURRENCY", 50), 1)),
+		stats:   map[string]int64{},
+	}
+	m.client = &http.Client{
+		Transport: tracingTransport{base: http.DefaultTransport},
+		Timeout:   m.timeout,
+		// The shadow's redirects are its own business
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return m, nil
+}
+
+// mirrorTraffic copies a share of /api/ requests to the shadow
+func mirrorTraffic(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if !strings.HasPrefix(pattern, "/api/") || mirrorExempt(pattern) {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := mirror
+		if m == nil || r.Header.Get("X-Mirrored-From") != "" || rand.Float64()*100 >= m.percent {
+			next(w, r)
+			return
+		}
+		body, ok := m.captureBody(r)
+		if !ok {
+			m.record("skipped")
+			next(w, r)
+			return
+		}
+		select {
+		case m.slots <- struct{}{}:
+		default:
+			m.record("dropped")
+			next(w, r)
+			return
+		}
+		primary := make(chan primaryResult, 1)
+		start := time.Now()
+		go m.send(r, body, start, primary)
+
+		rec := &middleware.Recorder{ResponseWriter: w}
+		defer func() {
+			// A panic is answered with a 500 further out
+			if v := recover(); v != nil {
+				primary <- primaryResult{http.StatusInternalServerError, time.Since(start)}
+				panic(v)
+			}
+			primary <- primaryResult{cmp.Or(rec.Status, http.StatusOK), time.Since(start)}
+		}()
+		next(rec, r)
+	}
+}
+
+// primaryResult is how the request the client got was answered
+type primaryResult struct {
+	status  int
+	latency time.Duration
+}
+
+// captureBody reads up to maxBody of r's body into memory, putting it back
+// for the handler; ok is false when the body is larger
+func (m *trafficMirror) captureBody(r *http.Request) (body []byte, ok bool) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil, true
+	}
+	if r.ContentLength > m.maxBody {
+		return nil, false
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, m.maxBody+1))
+	rest := r.Body
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), rest), rest}
+	if err != nil || int64(len(buf)) > m.maxBody {
+		return nil, false
+	}
+	return buf, true
+}
+
+// send copies r to the shadow, then compares its status with the primary's
+// once both are known
+func (m *trafficMirror) send(r *http.Request, body []byte, start time.Time, primary <-chan primaryResult) {
+	defer func() { <-m.slots }()
+	// The copy outlives the request it copies
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), m.timeout)
+	defer cancel()
+
+	target := *m.target
+	target.Path = strings.TrimSuffix(m.target.Path, "/") + r.URL.Path
+	target.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequestWithContext(ctx, r.Method, target.String(), bytes.NewReader(body))
+	shadowStatus := 0
+	if err == nil {
+		req.Header = r.Header.Clone()
+		req.Header.Del("Connection")
+		hostname, _ := os.Hostname()
+		req.Header.Set("X-Mirrored-From", hostname)
+		req.Header.Set("X-Forwarded-Host", r.Host)
+		var res *http.Response
+		if res, err = m.client.Do(req); err == nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, 1<<20))
+			res.Body.Close()
+			shadowStatus = res.StatusCode
+		}
+	}
+	shadowLatency := time.Since(start)
+	mirrorDuration.Observe(shadowLatency.Seconds())
+
+	p := <-primary
+	if err != nil {
+		m.record("error")
+		slog.Debug("mirrored request failed", "path", r.URL.Path, "target", m.target.Host, "error", err)
+		return
+	}
+	if statusClass(p.status) == statusClass(shadowStatus) {
+		m.record("match")
+		return
+	}
+	m.record("diverged")
+	mirrorDivergence.Inc(statusClass(p.status), statusClass(shadowStatus))
+	d := MirrorDivergence{
+		Time: start.UTC(), Method: r.Method, Path: r.URL.Path, RequestID: requestIDFromContext(r.Context()),
+		PrimaryStatus: p.status, ShadowStatus: shadowStatus,
+		PrimaryLatency: float64(p.latency.Microseconds()) / 1000, ShadowLatency: float64(shadowLatency.Microseconds()) / 1000,
+	}
+	slog.Info("mirrored request diverged", "method", d.Method, "path", d.Path, "primary_status", d.PrimaryStatus,
+		"shadow_status", d.ShadowStatus, "target", m.target.Host, "request_id", d.RequestID)
+	m.mu.Lock()
+	m.divergent = append(m.divergent, d)
+	if len(m.divergent) > keptDivergences {
+		m.divergent = m.divergent[len(m.divergent)-keptDivergences:]
+	}
+	m.mu.Unlock()
+}
+
+func (m *trafficMirror) record(result string) {
+	mirrorRequests.Inc(result)
+	m.mu.Lock()
+	m.stats[result]++
+	m.mu.Unlock()
+}
+
+// statusClass is 2xx, 4xx and so on: a shadow answering 201 where the
+// primary said 200 hasn't diverged in a way worth counting
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// mirrorHandler serves GET /api/mirror: how the shadow's answers compare
+func mirrorHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	hostname, _ := os.Hostname()
+	resp := MirrorResponse{Pod: hostname, Results: map[string]int64{}, Diverged: []MirrorDivergence{}}
+	if m := mirror; m != nil {
+		resp.Enabled, resp.Target, resp.Percent = true, m.target.String(), m.percent
+		m.mu.Lock()
+		for result, n := range m.stats {
+			resp.Results[result] = n
+		}
+		for i := len(m.divergent) - 1; i >= 0; i-- {
+			resp.Diverged = append(resp.Diverged, m.divergent[i])
+		}
+		m.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
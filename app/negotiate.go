@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /api/info and /api/peers also answer in MessagePack and protobuf, when
+// the Accept header prefers them; formats.go adds YAML and XML everywhere:
+//
+//	curl -s localhost:30080/api/info | wc -c                                          # JSON
+//	curl -s -H 'Accept: application/msgpack' localhost:30080/api/info | wc -c         # MessagePack
+//	curl -s -H 'Accept: application/x-protobuf' localhost:30080/api/info | wc -c      # protobuf
+//	curl -s -H 'Accept: application/x-protobuf' localhost:30080/api/info | protoc --decode=demo.v1.AppInfo app/proto/appinfo.proto
+//
+// MessagePack keeps JSON's shape, field names included, in binary; protobuf
+// drops the names for the numbers in app/proto/appinfo.proto, which is
+// where most of its size win comes from. Each format has its own ETag and
+// the response says Vary: Accept, so a cache in front keeps them apart.
+
+// protoMarshaler is a response with a protobuf schema
+type protoMarshaler interface {
+	MarshalProto() []byte
+}
+
+// responseFormat is one representation negotiateFormat can pick
+type responseFormat struct {
+	name        string // suffixed to ETags
+	contentType string
+	aliases     []string // other media types asking for it
+}
+
+var (
+	formatJSON     = responseFormat{name: "json", contentType: "application/json"}
+	formatMsgpack  = responseFormat{name: "msgpack", contentType: "application/msgpack", aliases: []string{"application/x-msgpack", "application/vnd.msgpack"}}
+	formatProtobuf = responseFormat{name: "protobuf", contentType: "application/x-protobuf", aliases: []string{"application/protobuf", "application/vnd.google.protobuf"}}
+)
+
+// negotiateFormat picks ?format= if it names a format, else the client's
+// most preferred one; ties and */* go to JSON, and protobuf is offered
+// only when the response has a schema
+func negotiateFormat(r *http.Request, hasProto bool) responseFormat {
+	candidates := []responseFormat{}
+	for _, f := range responseFormats {
+		if f.name != formatProtobuf.name || hasProto {
+			candidates = append(candidates, f)
+		}
+	}
+	if name := strings.ToLower(r.URL.Query().Get("format")); name != "" {
+		if name == "yml" {
+			name = formatYAML.name
+		}
+		for _, f := range candidates {
+			if f.name == name {
+				return f
+			}
+		}
+		// anything else is some handler's own ?format=, like an image's png
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" || strings.HasPrefix(accept, "text/html") {
+		return formatJSON // a browser lists application/xml, but wants the JSON
+	}
+	weights := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if _, seen := weights[mediaType]; !seen || q > weights[mediaType] {
+			weights[mediaType] = q
+		}
+	}
+	best, bestQ := formatJSON, -1.0
+	for _, f := range candidates {
+		q, ok := -1.0, false
+		for _, t := range append([]string{f.contentType}, f.aliases...) {
+			if w, found := weights[t]; found && w > q {
+				q, ok = w, true
+			}
+		}
+		if !ok && f.name == formatJSON.name {
+			// JSON is also what a wildcard gets
+			for _, t := range []string{"application/*", "*/*"} {
+				if w, found := weights[t]; found && w > q {
+					q = w
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	if bestQ <= 0 {
+		return formatJSON // nothing acceptable: JSON beats a 406
+	}
+	return best
+}
+
+// writeNegotiated writes v in the format r asks for
+func writeNegotiated(w http.ResponseWriter, r *http.Request, code int, v any) {
+	if fw, ok := w.(*formatWriter); ok {
+		w = fw.ResponseWriter
+	}
+	_, hasProto := v.(protoMarshaler)
+	format := negotiateFormat(r, hasProto)
+	w.Header().Add("Vary", "Accept")
+	var data []byte
+	var err error
+	switch format.name {
+	case formatProtobuf.name:
+		data = v.(protoMarshaler).MarshalProto()
+	case formatMsgpack.name:
+		data, err = marshalMsgpack(v)
+	case formatYAML.name:
+		data, err = marshalYAML(v)
+	case formatXML.name:
+		data, err = marshalXML(v)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "cannot encode "+format.name+": "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", format.contentType)
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// marshalMsgpack encodes v as MessagePack through its JSON form, so the
+// field names, their order and omitempty rules are the JSON ones
+func marshalMsgpack(v any) ([]byte, error) {
+	tree, err := decodeOrdered(v)
+	if err != nil {
+		return nil, err
+	}
+	return appendMsgpack(nil, tree), nil
+}
+
+// appendMsgpack encodes a value from decodeOrdered
+// https://github.com/msgpack/msgpack/blob/master/spec.md
+func appendMsgpack(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, n)
+		}
+		f, _ := v.Float64()
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f))
+	case string:
+		switch n := len(v); {
+		case n < 32:
+			b = append(b, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+		}
+		return append(b, v...)
+	case []any:
+		b = appendMsgpackLen(b, len(v), 0x90, 0xdc)
+		for _, item := range v {
+			b = appendMsgpack(b, item)
+		}
+		return b
+	case *orderedObject:
+		b = appendMsgpackLen(b, len(v.keys), 0x80, 0xde)
+		for i, k := range v.keys {
+			b = appendMsgpack(appendMsgpack(b, k), v.values[i])
+		}
+		return b
+	}
+	return append(b, 0xc0)
+}
+
+// appendMsgpackLen writes an array or map header: fix form up to 15, else
+// the 16 or 32-bit one (big16, plus one for 32)
+func appendMsgpackLen(b []byte, n int, fix, big16 byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, big16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, big16+1), uint32(n))
+}
+
+// appendMsgpackInt uses the smallest encoding that holds n
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n < 128:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(b, 0xcc, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+// MarshalProto encodes info as demo.v1.AppInfo
+func (info AppInfo) MarshalProto() []byte {
+	m := protoMessage(nil).
+		String(1, info.Name).
+		String(2, info.Version).
+		String(3, info.Hostname).
+		String(4, info.Timestamp.Format(time.RFC3339Nano)).
+		String(5, info.Message).
+		String(6, info.Node).
+		String(7, info.Zone).
+		String(8, info.ClientCN).
+		String(9, info.Region).
+		String(10, info.Namespace).
+		String(11, info.PodName).
+		String(12, info.PodIP)
+	if info.Visits != nil {
+		m = m.Bytes(13, protoMessage(nil).Varint(1, uint64(info.Visits.Total)).Varint(2, uint64(info.Visits.Pod)))
+	}
+	m = m.String(14, info.Protocol)
+	if info.Ordinal != nil {
+		m = m.OptionalVarint(15, uint64(*info.Ordinal))
+	}
+	return m.
+		String(16, info.Role).
+		String(17, info.Color).
+		String(18, info.PodColor).
+		String(19, info.Track).
+		Varint(20, uint64(info.Generation))
+}
+
+// MarshalProto encodes resp as demo.v1.PeersResponse
+func (resp PeersResponse) MarshalProto() []byte {
+	m := protoMessage(nil).
+		String(1, resp.Source).
+		String(2, resp.Selector).
+		String(3, resp.Service)
+	for _, p := range resp.Peers {
+		m = m.Bytes(4, protoMessage(nil).
+			String(1, p.Name).
+			String(2, p.IP).
+			String(3, p.Node).
+			String(4, p.Phase).
+			Bool(5, p.Ready).
+			Bool(6, p.Self))
+	}
+	return m.String(5, resp.Error)
+}
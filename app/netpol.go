@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /api/netpol/test dials a list of targets from this pod and says, for
+// each, whether what happened is what the NetworkPolicy exercise expects.
+// The list is a file, usually a ConfigMap key, reread on every run so a
+// re-applied ConfigMap takes effect without a restart:
+//
+//	# /etc/config/netpol-targets: host:port, then allow (default) or deny
+//	go-app-service:80        allow
+//	go-app-admin:9090        deny
+//	kubernetes.default:443   allow
+//
+//	NETPOL_TARGETS_FILE=/etc/config/netpol-targets
+//	NETPOL_INTERVAL=30s      also run on a timer; GET returns the last run
+//	NETPOL_TIMEOUT=2s        per dial; a policy drop shows as a timeout
+//	curl localhost:8080/api/netpol/test            # ?run=true to run now
+//
+// A deny target passes when the dial times out or is refused, and fails
+// when it connects or the name doesn't resolve. netpol_check_passing has
+// the last result of each, so an alert can catch a policy change that
+// opened or closed a path.
+
+// NetpolTarget is one line of NETPOL_TARGETS_FILE
+type NetpolTarget struct {
+	Target string `json:"target"` // host:port
+	Expect string `json:"expect"` // allow or deny
+}
+
+// NetpolResult is one row of the matrix
+type NetpolResult struct {
+	NetpolTarget
+	Connected bool    `json:"connected"`
+	Pass      bool    `json:"pass"`
+	Failure   string  `json:"failure,omitempty"` // dns, refused, timeout, unreachable or error
+	Error     string  `json:"error,omitempty"`
+	MS        float64 `json:"ms"`
+}
+
+// NetpolTestResponse is returned by /api/netpol/test
+type NetpolTestResponse struct {
+	Pod     string         `json:"pod"`
+	File    string         `json:"file"`
+	RanAt   time.Time      `json:"ran_at"`
+	Cached  bool           `json:"cached"` // from the NETPOL_INTERVAL timer
+	Passed  int            `json:"passed"`
+	Failed  int            `json:"failed"`
+	Results []NetpolResult `json:"results"`
+}
+
+var (
+	netpolPassing = newGaugeVec("netpol_check_passing",
+		"1 when the last NetworkPolicy check of a target matched its expectation, else 0.", "target", "expect")
+
+	netpolLast   *NetpolTestResponse // last timed run
+	netpolLastMu sync.Mutex
+)
+
+func netpolTargetsFile() string {
+	return getEnv("NETPOL_TARGETS_FILE", "/etc/config/netpol-targets")
+}
+
+// parseNetpolTargets reads host:port [allow|deny] lines; # starts a comment
+func parseNetpolTargets(path string) ([]NetpolTarget, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var targets []NetpolTarget
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		t := NetpolTarget{Target: fields[0], Expect: "allow"}
+		if len(fields) > 1 {
+			t.Expect = fields[1]
+		}
+		if _, port, err := net.SplitHostPort(t.Target); err != nil || port == "" {
+			return nil, fmt.Errorf("line %d: %q is not host:port", n, t.Target)
+		}
+		if len(fields) > 2 || (t.Expect != "allow" && t.Expect != "deny") {
+			return nil, fmt.Errorf("line %d: want host:port followed by allow or deny", n)
+		}
+		targets = append(targets, t)
+	}
+	return targets, scanner.Err()
+}
+
+// runNetpolTests dials every target at once
+func runNetpolTests(ctx context.Context) (*NetpolTestResponse, error) {
+	hostname, _ := os.Hostname()
+	resp := &NetpolTestResponse{Pod: hostname, File: netpolTargetsFile(), RanAt: time.Now().UTC()}
+	targets, err := parseNetpolTargets(resp.File)
+	if err != nil {
+		return nil, err
+	}
+	timeout := getEnvDuration("NETPOL_TIMEOUT", 2*time.Second)
+	resp.Results = make([]NetpolResult, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp.Results[i] = checkNetpolTarget(ctx, t, timeout)
+		}()
+	}
+	wg.Wait()
+	for _, res := range resp.Results {
+		if res.Pass {
+			resp.Passed++
+			netpolPassing.Set(1, res.Target, res.Expect)
+		} else {
+			resp.Failed++
+			netpolPassing.Set(0, res.Target, res.Expect)
+		}
+	}
+	return resp, nil
+}
+
+func checkNetpolTarget(ctx context.Context, t NetpolTarget, timeout time.Duration) NetpolResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	res := NetpolResult{NetpolTarget: t}
+	var dialer net.Dialer
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", t.Target)
+	res.MS = float64(time.Since(start).Microseconds()) / 1000
+	if err == nil {
+		conn.Close()
+		res.Connected = true
+	} else {
+		res.Failure, res.Error = dialFailure(err), err.Error()
+	}
+	switch t.Expect {
+	case "allow":
+		res.Pass = res.Connected
+	case "deny":
+		// A name that doesn't resolve says nothing about the policy
+		res.Pass = !res.Connected && res.Failure != "dns"
+	}
+	return res
+}
+
+// runNetpolTimer reruns the checks every interval for GET to return
+func runNetpolTimer(interval time.Duration) {
+	for {
+		if resp, err := runNetpolTests(context.Background()); err != nil {
+			slog.Warn("netpol checks not run", "file", netpolTargetsFile(), "error", err)
+		} else {
+			netpolLastMu.Lock()
+			netpolLast = resp
+			netpolLastMu.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// netpolTestHandler serves /api/netpol/test?run=
+func netpolTestHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	run, _ := strconv.ParseBool(r.URL.Query().Get("run"))
+	netpolLastMu.Lock()
+	last := netpolLast
+	netpolLastMu.Unlock()
+	if last != nil && !run {
+		cached := *last
+		cached.Cached = true
+		writeJSON(w, http.StatusOK, cached)
+		return
+	}
+	resp, err := runNetpolTests(r.Context())
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeProblem(w, r, http.StatusNotFound, "no targets file at "+netpolTargetsFile()+"; mount one and set NETPOL_TARGETS_FILE")
+	case err != nil:
+		writeProblem(w, r, http.StatusInternalServerError, "bad targets file: "+err.Error())
+	default:
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
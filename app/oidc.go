@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Optional OpenID Connect login for /dashboard: the authorization code
+// flow with PKCE against any OIDC provider (Dex, Keycloak, Google, ...).
+// Off unless an issuer is configured; every value is read with
+// readSecret, so it can come from a mounted Secret or env vars:
+//
+//	OIDC_ISSUER_URL=http://dex.go-demo.svc:5556/dex
+//	OIDC_CLIENT_ID=go-app
+//	OIDC_CLIENT_SECRET=...             empty for a public client (PKCE only)
+//	OIDC_REDIRECT_URL=http://localhost/auth/callback   default: this host
+//	OIDC_SESSION_SECRET=...            at least 32 bytes; signs the cookies
+//	OIDC_SCOPES=openid,email,profile
+//	OIDC_SESSION_TTL=8h
+//
+// /dashboard sends a browser without a session to /auth/login, which
+// redirects to the provider. The provider sends it back to /auth/callback
+// with a code; the app trades the code for an ID token, verifies it
+// against the provider's JWKS (the same verifier as JWT_JWKS_URL) and sets
+// a signed session cookie. /auth/logout clears it, and signs out at the
+// provider too when it has an end_session_endpoint.
+//
+// The session lives entirely in the cookie, so any replica can check it -
+// as long as they share OIDC_SESSION_SECRET. Without one each pod makes up
+// its own, and a browser logged in on one pod is sent back to login by the
+// next. The issuer URL must also be the same for the browser and the pod:
+// it is in every ID token, and discovery hands out endpoints under it.
+
+// oidcProvider is one configured client of one issuer
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string // "" derives it from the request
+	scopes       []string
+	sessionKey   []byte
+	sessionTTL   time.Duration
+	randomKey    bool // no OIDC_SESSION_SECRET; sessions are per pod
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery // nil until the first successful fetch
+	verifier  *jwtVerifier
+}
+
+// oidcAuth is set in main when OIDC login is configured
+var oidcAuth *oidcProvider
+
+var oidcLogins = newCounterVec("oidc_logins_total",
+	"OIDC login callbacks by result.", "result")
+
+const (
+	sessionCookie = "go_app_session"
+	loginCookie   = "go_app_oidc_login"
+)
+
+// newOIDCFromEnv returns nil when no issuer is configured
+func newOIDCFromEnv() (*oidcProvider, error) {
+	issuer, _ := readSecret("OIDC_ISSUER_URL")
+	if issuer = strings.TrimRight(issuer, "/"); issuer == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(issuer); err != nil || u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("OIDC_ISSUER_URL %q is not an http(s) URL", issuer)
+	}
+	p := &oidcProvider{
+		issuer:     issuer,
+		scopes:     splitList(getEnv("OIDC_SCOPES", "openid,email,profile")),
+		sessionTTL: getEnvDuration("OIDC_SESSION_TTL", 8*time.Hour),
+	}
+	p.clientID, _ = readSecret("OIDC_CLIENT_ID")
+	p.clientSecret, _ = readSecret("OIDC_CLIENT_SECRET")
+	p.redirectURL, _ = readSecret("OIDC_REDIRECT_URL")
+	if p.clientID == "" {
+		return nil, errors.New("OIDC_CLIENT_ID is required with OIDC_ISSUER_URL")
+	}
+	secret, _ := readSecret("OIDC_SESSION_SECRET")
+	switch {
+	case secret == "":
+		p.sessionKey, p.randomKey = make([]byte, 32), true
+		rand.Read(p.sessionKey)
+	case len(secret) < 32:
+		return nil, errors.New("OIDC_SESSION_SECRET must be at least 32 bytes")
+	default:
+		p.sessionKey = []byte(secret)
+	}
+	return p, nil
+}
+
+// oidcDiscovery is the part of /.well-known/openid-configuration used here
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// discover fetches the provider's metadata once; failures are retried on
+// the next login, so the app can start before the provider does
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, *jwtVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, p.verifier, nil
+	}
+	var d oidcDiscovery
+	if err := oidcGetJSON(ctx, p.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, nil, err
+	}
+	if d.Issuer != p.issuer {
+		return nil, nil, fmt.Errorf("discovery issuer %q is not OIDC_ISSUER_URL %q", d.Issuer, p.issuer)
+	}
+	jwksURL, err := url.Parse(d.JWKSURI)
+	if err != nil || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, nil, errors.New("discovery document lacks authorization_endpoint, token_endpoint or jwks_uri")
+	}
+	p.discovery = &d
+	p.verifier = &jwtVerifier{
+		jwks:     &jwksCache{url: jwksURL, refresh: 10 * time.Minute},
+		issuer:   p.issuer,
+		audience: p.clientID,
+		leeway:   30 * time.Second,
+	}
+	slog.Info("OIDC provider discovered", "issuer", d.Issuer, "token_endpoint", d.TokenEndpoint)
+	return p.discovery, p.verifier, nil
+}
+
+func oidcGetJSON(ctx context.Context, rawURL string, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Session is what the session cookie holds, from the ID token's claims
+type Session struct {
+	Subject   string    `json:"sub"`
+	Email     string    `json:"email,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Issuer    string    `json:"iss"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// User is the name to show for the session
+func (s *Session) User() string {
+	switch {
+	case s.Name != "":
+		return s.Name
+	case s.Email != "":
+		return s.Email
+	}
+	return s.Subject
+}
+
+// loginState carries the flow from /auth/login to /auth/callback
+type loginState struct {
+	State       string    `json:"state"`
+	Nonce       string    `json:"nonce"`
+	Verifier    string    `json:"verifier"` // PKCE code_verifier
+	RedirectURI string    `json:"redirect_uri"`
+	Next        string    `json:"next"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// sealCookie signs v as base64url(JSON).base64url(HMAC-SHA256); the value
+// is readable by the browser, but can't be changed or forged
+func (p *oidcProvider) sealCookie(v any) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, p.sessionKey)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (p *oidcProvider) openCookie(value string, out any) error {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return errors.New("malformed cookie")
+	}
+	mac := hmac.New(sha256.New, p.sessionKey)
+	mac.Write([]byte(payload))
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.New("bad cookie signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return errors.New("malformed cookie")
+	}
+	return json.Unmarshal(data, out)
+}
+
+// session returns the request's valid session, or nil
+func (p *oidcProvider) session(r *http.Request) *Session {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	var s Session
+	if p.openCookie(c.Value, &s) != nil || time.Now().After(s.ExpiresAt) {
+		return nil
+	}
+	return &s
+}
+
+// setCookie sets or, with maxAge < 0, clears a cookie; Secure when the
+// browser reached us over HTTPS, directly or through the Ingress
+func setCookie(w http.ResponseWriter, r *http.Request, name, value, path string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode, // sent on the provider's top-level redirect back
+	})
+}
+
+// randomToken is 32 random bytes, base64url
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// localPath keeps ?next= on this site, so login can't be used as an open redirect
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/dashboard"
+	}
+	return next
+}
+
+// requestBaseURL is scheme://host as the browser sees it
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	host := r.Host
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+		host = fwd
+	}
+	return scheme + "://" + host
+}
+
+// registerOIDCRoutes adds the /auth endpoints of the login flow
+func registerOIDCRoutes(routes *routeRegistry, p *oidcProvider) {
+	routes.HandleFunc("/auth/login", "Start OIDC login (?next=/dashboard)", oidcLoginHandler(p), http.MethodGet)
+	routes.HandleFunc("/auth/callback", "OIDC redirect target: exchanges the code and sets the session cookie", oidcCallbackHandler(p), http.MethodGet)
+	routes.HandleFunc("/auth/logout", "Clear the session and sign out at the provider", oidcLogoutHandler(p), http.MethodGet)
+	routes.HandleFunc("/auth/session", "The current login session", oidcSessionHandler(p), http.MethodGet)
+}
+
+// oidcLoginHandler starts the flow: state against CSRF, nonce against
+// replayed ID tokens, and a PKCE verifier against stolen codes
+func oidcLoginHandler(p *oidcProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, _, err := p.discover(r.Context())
+		if err != nil {
+			writeProblem(w, r, http.StatusBadGateway, "identity provider unavailable: "+err.Error())
+			return
+		}
+		st := loginState{
+			State:       randomToken(),
+			Nonce:       randomToken(),
+			Verifier:    randomToken(),
+			RedirectURI: p.redirectURL,
+			Next:        localPath(r.URL.Query().Get("next")),
+			ExpiresAt:   time.Now().Add(10 * time.Minute),
+		}
+		if st.RedirectURI == "" {
+			st.RedirectURI = requestBaseURL(r) + "/auth/callback"
+		}
+		setCookie(w, r, loginCookie, p.sealCookie(st), "/auth/", 600)
+
+		challenge := sha256.Sum256([]byte(st.Verifier))
+		q := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {p.clientID},
+			"redirect_uri":          {st.RedirectURI},
+			"scope":                 {strings.Join(p.scopes, " ")},
+			"state":                 {st.State},
+			"nonce":                 {st.Nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+		sep := "?"
+		if strings.Contains(d.AuthorizationEndpoint, "?") {
+			sep = "&"
+		}
+		http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+	}
+}
+
+// oidcCallbackHandler finishes the flow and sets the session cookie
+func oidcCallbackHandler(p *oidcProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fail := func(status int, result, msg string) {
+			oidcLogins.Inc(result)
+			slog.Warn("OIDC login failed", "result", result, "error", msg)
+			writeProblem(w, r, status, msg)
+		}
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			fail(http.StatusUnauthorized, "provider_error", "identity provider returned "+e+": "+q.Get("error_description"))
+			return
+		}
+		var st loginState
+		c, err := r.Cookie(loginCookie)
+		if err == nil {
+			err = p.openCookie(c.Value, &st)
+		}
+		switch {
+		case err != nil:
+			fail(http.StatusBadRequest, "bad_state", "no login in progress; start at /auth/login")
+			return
+		case time.Now().After(st.ExpiresAt):
+			fail(http.StatusBadRequest, "bad_state", "login expired; start again at /auth/login")
+			return
+		case subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(st.State)) != 1:
+			fail(http.StatusBadRequest, "bad_state", "state does not match this browser's login")
+			return
+		}
+		setCookie(w, r, loginCookie, "", "/auth/", -1)
+
+		d, verifier, err := p.discover(r.Context())
+		if err != nil {
+			fail(http.StatusBadGateway, "provider_unavailable", "identity provider unavailable: "+err.Error())
+			return
+		}
+		idToken, err := p.exchange(r.Context(), d.TokenEndpoint, q.Get("code"), st)
+		if err != nil {
+			fail(http.StatusBadGateway, "exchange_failed", "code exchange failed: "+err.Error())
+			return
+		}
+		t, err := verifier.Verify(r.Context(), idToken)
+		if err != nil {
+			fail(http.StatusUnauthorized, "invalid_id_token", "ID token rejected: "+err.Error())
+			return
+		}
+		if nonce, _ := t.Raw["nonce"].(string); subtle.ConstantTimeCompare([]byte(nonce), []byte(st.Nonce)) != 1 {
+			fail(http.StatusUnauthorized, "invalid_id_token", "ID token nonce does not match")
+			return
+		}
+
+		s := Session{Subject: t.Claims.Subject, Issuer: t.Claims.Issuer, ExpiresAt: time.Now().Add(p.sessionTTL).UTC()}
+		s.Email, _ = t.Raw["email"].(string)
+		if s.Name, _ = t.Raw["name"].(string); s.Name == "" {
+			s.Name, _ = t.Raw["preferred_username"].(string)
+		}
+		setCookie(w, r, sessionCookie, p.sealCookie(s), "/", int(p.sessionTTL.Seconds()))
+		oidcLogins.Inc("ok")
+		slog.Info("OIDC login", "sub", s.Subject, "email", s.Email)
+		http.Redirect(w, r, st.Next, http.StatusFound)
+	}
+}
+
+// exchange trades the code for tokens at the token endpoint and returns
+// the ID token
+func (p *oidcProvider) exchange(ctx context.Context, tokenEndpoint, code string, st loginState) (string, error) {
+	if code == "" {
+		return "", errors.New("callback has no code")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {st.RedirectURI},
+		"code_verifier": {st.Verifier},
+		"client_id":     {p.clientID},
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		// client_secret_basic: RFC 6749 form-encodes both halves first
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	switch {
+	case body.Error != "":
+		return "", fmt.Errorf("%s: %s", body.Error, body.ErrorDescription)
+	case body.IDToken == "":
+		return "", errors.New("token response has no id_token (is openid in OIDC_SCOPES?)")
+	}
+	return body.IDToken, nil
+}
+
+// oidcLogoutHandler clears the session, then signs out at the provider
+// when it supports RP-initiated logout
+func oidcLogoutHandler(p *oidcProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setCookie(w, r, sessionCookie, "", "/", -1)
+		target := "/"
+		if d, _, err := p.discover(r.Context()); err == nil && d.EndSessionEndpoint != "" {
+			q := url.Values{"client_id": {p.clientID}, "post_logout_redirect_uri": {requestBaseURL(r) + "/"}}
+			target = d.EndSessionEndpoint + "?" + q.Encode()
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	}
+}
+
+// oidcSessionHandler shows the current session, or 401
+func oidcSessionHandler(p *oidcProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := p.session(r)
+		if s == nil {
+			writeProblem(w, r, http.StatusUnauthorized, "not logged in; visit /auth/login")
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	}
+}
+
+type sessionKey struct{}
+
+// sessionFromContext returns the request's login session, or nil
+func sessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// requireLogin protects a page when OIDC is configured: browsers without
+// a session are sent to log in, API calls get a 401
+func requireLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if oidcAuth == nil {
+			next(w, r)
+			return
+		}
+		s := oidcAuth.session(r)
+		if s == nil {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeProblem(w, r, http.StatusUnauthorized, "not logged in; visit /auth/login")
+				return
+			}
+			http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), sessionKey{}, s)))
+	}
+}
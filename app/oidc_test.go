@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeOIDCProvider serves discovery, a JWKS and a token endpoint that
+// answers every code with idToken(nonce)
+type fakeOIDCProvider struct {
+	url     string
+	key     *rsa.PrivateKey
+	idToken func(nonce string) string
+	nonce   string // the nonce of the last authorization request
+}
+
+func startFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeOIDCProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                f.url,
+			AuthorizationEndpoint: f.url + "/authorize",
+			TokenEndpoint:         f.url + "/token",
+			JWKSURI:               f.url + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+		json.NewEncoder(w).Encode(map[string]any{"keys": []jwk{{
+			Kty: "RSA", Kid: "test", Use: "sig", N: b64(key.N), E: b64(big.NewInt(int64(key.E))),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") == "" || r.FormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": f.idToken(f.nonce)})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	f.url = srv.URL
+	f.idToken = func(nonce string) string {
+		return signJWT(t, "RS256", testClaims(map[string]any{"iss": f.url, "nonce": nonce}), key)
+	}
+	return f
+}
+
+// startLogin runs /auth/login and returns the login cookie and the state
+// sent to the provider
+func startLogin(t *testing.T, p *oidcProvider, f *fakeOIDCProvider) (*http.Cookie, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	oidcLoginHandler(p)(rec, httptest.NewRequest(http.MethodGet, "/auth/login?next=/dashboard/jobs", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login status = %d, want 302: %s", rec.Code, rec.Body)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.nonce = location.Query().Get("nonce")
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != loginCookie {
+		t.Fatalf("login set cookies %v, want %s", cookies, loginCookie)
+	}
+	return cookies[0], location.Query().Get("state")
+}
+
+func TestOIDCCallback(t *testing.T) {
+	f := startFakeOIDCProvider(t)
+	p := &oidcProvider{
+		issuer:     f.url,
+		clientID:   "go-app",
+		scopes:     []string{"openid"},
+		sessionKey: []byte(testHMACSecret),
+		sessionTTL: time.Hour,
+	}
+	validToken := f.idToken
+
+	tests := []struct {
+		name       string
+		state      func(state string) string
+		cookie     func(c *http.Cookie) *http.Cookie
+		idToken    func(nonce string) string
+		query      string
+		wantStatus int
+	}{
+		{name: "valid", wantStatus: http.StatusFound},
+		{name: "state mismatch", state: func(string) string { return "forged" }, wantStatus: http.StatusBadRequest},
+		{name: "no state", state: func(string) string { return "" }, wantStatus: http.StatusBadRequest},
+		{name: "no login cookie", cookie: func(*http.Cookie) *http.Cookie { return nil }, wantStatus: http.StatusBadRequest},
+		{name: "login cookie tampered", cookie: func(c *http.Cookie) *http.Cookie {
+			payload, sig, _ := strings.Cut(c.Value, ".")
+			return &http.Cookie{Name: c.Name, Value: payload + "x." + sig}
+		}, wantStatus: http.StatusBadRequest},
+		{name: "login expired", cookie: func(c *http.Cookie) *http.Cookie {
+			var st loginState
+			if err := p.openCookie(c.Value, &st); err != nil {
+				t.Fatal(err)
+			}
+			st.ExpiresAt = time.Now().Add(-time.Minute)
+			return &http.Cookie{Name: c.Name, Value: p.sealCookie(st)}
+		}, wantStatus: http.StatusBadRequest},
+		{name: "nonce mismatch", idToken: func(string) string { return validToken("replayed") }, wantStatus: http.StatusUnauthorized},
+		{name: "no nonce", idToken: func(string) string {
+			return signJWT(t, "RS256", testClaims(map[string]any{"iss": f.url}), f.key)
+		}, wantStatus: http.StatusUnauthorized},
+		{name: "wrong audience", idToken: func(nonce string) string {
+			return signJWT(t, "RS256", testClaims(map[string]any{"iss": f.url, "nonce": nonce, "aud": "other-app"}), f.key)
+		}, wantStatus: http.StatusUnauthorized},
+		{name: "provider error", query: "&error=access_denied", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.idToken = validToken
+			if tt.idToken != nil {
+				f.idToken = tt.idToken
+			}
+			cookie, state := startLogin(t, p, f)
+			if tt.state != nil {
+				state = tt.state(state)
+			}
+			if tt.cookie != nil {
+				cookie = tt.cookie(cookie)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/auth/callback?code=abc&state="+url.QueryEscape(state)+tt.query, nil)
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			rec := httptest.NewRecorder()
+			oidcCallbackHandler(p)(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("callback status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+
+			var session *Session
+			for _, c := range rec.Result().Cookies() {
+				if c.Name == sessionCookie {
+					r := httptest.NewRequest(http.MethodGet, "/", nil)
+					r.AddCookie(c)
+					session = p.session(r)
+				}
+			}
+			if tt.wantStatus != http.StatusFound {
+				if session != nil {
+					t.Errorf("a failed login set a session for %q", session.Subject)
+				}
+				return
+			}
+			if session == nil || session.Subject != "alice" {
+				t.Fatalf("session = %+v, want one for alice", session)
+			}
+			if got := rec.Header().Get("Location"); got != "/dashboard/jobs" {
+				t.Errorf("redirect = %q, want /dashboard/jobs", got)
+			}
+		})
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	tests := map[string]string{
+		"/dashboard/jobs":    "/dashboard/jobs",
+		"":                   "/dashboard",
+		"https://evil.test/": "/dashboard",
+		"//evil.test/":       "/dashboard",
+		"/\\evil.test/":      "/dashboard",
+	}
+	for next, want := range tests {
+		if got := localPath(next); got != want {
+			t.Errorf("localPath(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/chaos"
+	"github.com/michael-jaquier/kubernetes-learning/app/config"
+	"github.com/michael-jaquier/kubernetes-learning/app/flags"
+	"github.com/michael-jaquier/kubernetes-learning/app/store"
+	"github.com/michael-jaquier/kubernetes-learning/app/version"
+)
+
+// /openapi.json describes the JSON API as OpenAPI 3, built at request time
+// from the route registry, so it never drifts from what is served. Methods
+// and query parameters are read from each route's description (the
+// "(POST ?name=&value=)" convention), and response schemas come from the Go
+// types in apiResponseTypes by reflection over their json tags. /docs is
+// Swagger UI over the spec:
+//
+//	curl localhost:8080/openapi.json | jq '.paths | keys'
+//	open http://localhost:8080/docs
+//
+// The page is embedded, but the Swagger UI bundle loads from a CDN;
+// SWAGGER_UI_URL points it at a mirror for clusters without internet.
+// Admin routes are only included when they share the app port.
+
+// apiResponseTypes are the typed 200 responses; other JSON routes are
+// documented as a free-form object
+var apiResponseTypes = map[string]any{
+	"/api/info":                AppInfo{},
+	"/api/v1/info":             AppInfo{},
+	"/api/v2/info":             InfoV2{},
+	"/api/config":              config.Config{},
+	"/api/config/source":       ConfigSource{},
+	"/api/config/version":      ConfigVersion{},
+	"/api/config/effective":    EffectiveConfigResponse{},
+	"/api/flags":               flags.Set{},
+	"/api/requests":            RequestsResponse{},
+	"/api/session":             SessionAffinity{},
+	"/api/requests/log":        RequestLogResponse{},
+	"/api/secrets":             SecretsResponse{},
+	"/api/secrets/lease":       LeasesResponse{},
+	"/api/files":               FilesResponse{},
+	"/api/fs-audit":            FSAuditResponse{},
+	"/api/security":            SecurityResponse{},
+	"/api/peers":               PeersResponse{},
+	"/api/cluster":             ClusterResponse{},
+	"/api/cluster/config-skew": ConfigSkewResponse{},
+	"/api/fanout":              FanoutResponse{},
+	"/api/call":                CallResponse{},
+	"/api/breakers":            BreakersResponse{},
+	"/api/chain":               ChainResponse{},
+	"/api/upload":              UploadResponse{},
+	"/api/wait":                WaitResponse{},
+	"/api/compute/fib/":        ComputeResponse{},
+	"/api/compute/primes":      ComputeResponse{},
+	"/api/whoami":              WhoamiResponse{},
+	"/api/version":             version.Info{},
+	"/api/provenance":          ProvenanceResponse{},
+	"/api/time":                TimeResponse{},
+	"/api/echo":                EchoResponse{},
+	"/api/echo/":               EchoResponse{},
+	"/api/dashboard":           DashboardResponse{},
+	"/status/upstreams":        UpstreamsResponse{},
+	"/api/shards":              ShardsResponse{},
+	"/api/kv/":                 KVResponse{},
+	"/api/raft/status":         RaftStatus{},
+	"/api/stats":               PodSnapshot{},
+	"/api/tenants":             TenantsResponse{},
+	"/api/registration":        RegistrationResponse{},
+	"/api/jobs":                JobsResponse{},
+	"/api/jobs/":               Job{},
+	"/api/drain/status":        DrainTasksStatus{},
+	"/api/messages":            MessagesResponse{},
+	"/api/dns":                 DNSResponse{},
+	"/api/connect":             ConnectResponse{},
+	"/api/netpol/test":         NetpolTestResponse{},
+	"/api/upload-sink":         UploadSinkResponse{},
+	"/api/resources":           ResourcesResponse{},
+	"/api/signals":             SignalsResponse{},
+	"/api/rbac/can-i":          CanIResponse{},
+	"/api/serviceaccount":      ServiceAccountResponse{},
+	"/api/pod":                 PodInfo{},
+	"/api/startup":             StartupWaitResponse{},
+	"/api/degraded":            DegradedStatus{},
+	"/api/restarts":            RestartsResponse{},
+	"/api/routes":              []Route{},
+	"/api/load/memory":         MemoryLoadResponse{},
+	"/api/counter":             CounterResponse{},
+	"/api/guestbook":           []store.GuestbookEntry{},
+	"/api/objects":             ObjectsResponse{},
+	"/api/leader":              LeaderStatus{},
+	"/chaos":                   chaos.Status{},
+	"/health":                  HealthStatus{},
+	"/ready":                   ReadyStatus{},
+	"/startup":                 StartupStatus{},
+	"/admin/audit":             AuditResponse{},
+	"/admin/cache/flush":       CacheFlushResponse{},
+	"/admin/debug-capture":     DebugCaptureStatus{},
+	"/admin/drain":             DrainStatus{},
+	"/admin/loadgen":           LoadgenStatus{},
+	"/admin/routes":            []Route{},
+	"/debug/connections":       ConnectionsResponse{},
+}
+
+// nonJSONRoutes serve HTML, streams, raw files or Prometheus text
+var nonJSONRoutes = map[string]bool{
+	"/": true, "/static/": true, "/dashboard": true, "/docs": true, "/events": true, "/ws/stats": true, "/ws/chat": true,
+	"/metrics": true, "/api/files/": true, "/api/objects/": true,
+}
+
+// pathParams names the wildcard of subtree routes like /api/jobs/
+var pathParams = map[string]string{
+	"/api/jobs/": "id", "/api/echo/": "path", "/api/kv/": "key",
+}
+
+var descriptionParam = regexp.MustCompile(`[?&]([a-z_]+)=`)
+
+// openAPIDocument is the generated spec; maps keep it short to build
+type openAPIDocument struct {
+	OpenAPI    string                               `json:"openapi"`
+	Info       map[string]string                    `json:"info"`
+	Paths      map[string]map[string]map[string]any `json:"paths"`
+	Components map[string]map[string]any            `json:"components"`
+}
+
+// schemaBuilder turns Go types into JSON Schema, named structs into
+// components/schemas entries referenced by $ref
+type schemaBuilder struct {
+	schemas map[string]any
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, ok := b.schemas[t.Name()]; !ok {
+			b.schemas[t.Name()] = map[string]any{} // placeholder, for recursive types
+			b.schemas[t.Name()] = b.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{} // interfaces: anything
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			if embedded, ok := b.structProps(f.Type); ok {
+				for k, v := range embedded {
+					props[k] = v
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") {
+			required = append(required, name)
+		}
+	}
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// structProps returns the properties of an embedded struct
+func (b *schemaBuilder) structProps(t reflect.Type) (map[string]any, bool) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, false
+	}
+	props, _ := b.structSchema(t)["properties"].(map[string]any)
+	return props, true
+}
+
+// routeOperations builds the operations for one route
+func routeOperations(b *schemaBuilder, route Route) (string, map[string]map[string]any) {
+	path := route.Path
+	var params []any
+	if strings.HasSuffix(path, "/") && path != "/" {
+		name := pathParams[path]
+		if name == "" {
+			name = "name"
+		}
+		path += "{" + name + "}"
+		params = append(params, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+	}
+	seen := map[string]bool{}
+	for _, m := range descriptionParam.FindAllStringSubmatch(route.Description, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			params = append(params, map[string]any{"name": m[1], "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+	}
+
+	response := map[string]any{"type": "object"}
+	if t, ok := apiResponseTypes[route.Path]; ok {
+		response = b.schema(reflect.TypeOf(t))
+	}
+	ops := map[string]map[string]any{}
+	for _, method := range route.Methods {
+		op := map[string]any{
+			"summary": route.Description,
+			"tags":    []string{strings.SplitN(strings.TrimPrefix(route.Path, "/"), "/", 2)[0]},
+			"responses": map[string]any{
+				"200":     map[string]any{"description": "OK", "content": map[string]any{"application/json": map[string]any{"schema": response}}},
+				"default": map[string]any{"$ref": "#/components/responses/Error"},
+			},
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		ops[strings.ToLower(method)] = op
+	}
+	return path, ops
+}
+
+// buildOpenAPI documents every JSON route in routes
+func buildOpenAPI(title, version string, routes []Route) openAPIDocument {
+	b := &schemaBuilder{schemas: map[string]any{}}
+	doc := openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    map[string]string{"title": title, "version": version},
+		Paths:   map[string]map[string]map[string]any{},
+	}
+	for _, route := range routes {
+		if nonJSONRoutes[route.Path] || strings.HasPrefix(route.Path, "/debug/pprof") || route.Path == "/openapi.json" {
+			continue
+		}
+		path, ops := routeOperations(b, route)
+		doc.Paths[path] = ops
+	}
+	problem := b.schema(reflect.TypeOf(Problem{}))
+	doc.Components = map[string]map[string]any{
+		"schemas": b.schemas,
+		"responses": {"Error": map[string]any{"description": "Error (RFC 7807 problem details)",
+			"content": map[string]any{problemContentType: map[string]any{"schema": problem}}}},
+	}
+	return doc
+}
+
+// openAPIHandler serves /openapi.json for the routes in rr
+func openAPIHandler(rr *routeRegistry, title string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+		if w.Header().Get("Access-Control-Allow-Origin") == "" { // unless a CORS policy already answered
+			w.Header().Set("Access-Control-Allow-Origin", "*") // for editor.swagger.io and other hosted viewers
+		}
+		writeJSON(w, http.StatusOK, buildOpenAPI(title, buildInfo().Version, rr.Routes()))
+	}
+}
+
+// DocsPage is the data for templates/docs.html
+type DocsPage struct {
+	AppName    string
+	SwaggerURL string
+	SpecURL    string
+}
+
+func docsHandler(pages *template.Template, appName string) http.HandlerFunc {
+	swagger := strings.TrimRight(getEnv("SWAGGER_UI_URL", "https://unpkg.com/swagger-ui-dist@5"), "/")
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderPage(w, r, pages, "docs.html", DocsPage{AppName: appName, SwaggerURL: swagger, SpecURL: "/openapi.json"})
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// operator mode is a controller for the Greeting custom resource, written
+// without controller-runtime so every step is visible:
+//
+//	app operator -addr=:8080
+//
+//	kubectl apply -f k8s/advanced/operator.yaml
+//	kubectl get greetings -n go-demo          # MESSAGE and READY come from status
+//	kubectl patch greeting world -n go-demo --type=merge -p '{"spec":{"shout":true}}'
+//	curl localhost:8080/api/greetings           # what the operator has reconciled
+//
+// The loop is the one every operator runs: list the resources, watch from
+// the list's resourceVersion, and for each change reconcile desired state
+// (spec) into observed state (status). Reconciling is level-based: it looks
+// at the whole object, not at what changed, so a missed event is repaired
+// by the next one or by the periodic resync. Writing status doesn't bump
+// metadata.generation, and status.observedGeneration records what was
+// reconciled, so status updates don't loop back into work.
+
+const (
+	greetingGroup   = "demo.go-app.io"
+	greetingVersion = "v1alpha1"
+)
+
+// greeting is a Greeting custom resource
+type greeting struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   kubeObjectMeta `json:"metadata"`
+	Spec       greetingSpec   `json:"spec"`
+	Status     greetingStatus `json:"status"`
+}
+
+// greetingSpec is the desired greeting
+type greetingSpec struct {
+	Greeting string `json:"greeting"` // Hello by default
+	Name     string `json:"name"`     // required
+	Shout    bool   `json:"shout"`
+}
+
+// greetingStatus is what the operator observed and did
+type greetingStatus struct {
+	Message            string              `json:"message,omitempty"`
+	ObservedGeneration int64               `json:"observedGeneration,omitempty"`
+	Conditions         []greetingCondition `json:"conditions,omitempty"`
+}
+
+// greetingCondition follows the metav1.Condition shape
+type greetingCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"` // True or False
+	Reason             string `json:"reason"`
+	Message            string `json:"message"`
+	ObservedGeneration int64  `json:"observedGeneration"`
+	LastTransitionTime string `json:"lastTransitionTime"`
+}
+
+// greetingList is a list response
+type greetingList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []greeting `json:"items"`
+}
+
+// GreetingView is one reconciled Greeting, for /api/greetings
+type GreetingView struct {
+	Name         string    `json:"name"`
+	Message      string    `json:"message,omitempty"`
+	Ready        bool      `json:"ready"`
+	Reason       string    `json:"reason,omitempty"`
+	Generation   int64     `json:"generation"`
+	ReconciledAt time.Time `json:"reconciled_at"`
+}
+
+// OperatorStatus is returned by /api/greetings
+type OperatorStatus struct {
+	Namespace       string         `json:"namespace"`
+	ResourceVersion string         `json:"resource_version"`
+	Reconciles      int            `json:"reconciles"`
+	Errors          int            `json:"errors"`
+	Greetings       []GreetingView `json:"greetings"`
+}
+
+// greetingOperator reconciles Greetings in one namespace
+type greetingOperator struct {
+	kube      *kubeClient
+	namespace string
+	resync    time.Duration
+
+	mu     sync.Mutex
+	status OperatorStatus
+	views  map[string]GreetingView
+}
+
+func (op *greetingOperator) path(suffix string) string {
+	return "/apis/" + greetingGroup + "/" + greetingVersion + "/namespaces/" + op.namespace + "/greetings" + suffix
+}
+
+// desiredStatus computes the status a Greeting's spec asks for
+func desiredStatus(g greeting) greetingStatus {
+	cond := greetingCondition{Type: "Ready", Status: "True", Reason: "Reconciled", ObservedGeneration: g.Metadata.Generation}
+	status := greetingStatus{ObservedGeneration: g.Metadata.Generation}
+	if strings.TrimSpace(g.Spec.Name) == "" {
+		cond.Status, cond.Reason, cond.Message = "False", "InvalidSpec", "spec.name is required"
+	} else {
+		word := g.Spec.Greeting
+		if word == "" {
+			word = "Hello"
+		}
+		status.Message = word + ", " + g.Spec.Name + "!"
+		if g.Spec.Shout {
+			status.Message = strings.ToUpper(status.Message)
+		}
+		cond.Message = "serving " + status.Message
+	}
+	// lastTransitionTime only moves when the condition's status flips
+	cond.LastTransitionTime = time.Now().UTC().Format(time.RFC3339)
+	for _, old := range g.Status.Conditions {
+		if old.Type == cond.Type && old.Status == cond.Status {
+			cond.LastTransitionTime = old.LastTransitionTime
+		}
+	}
+	status.Conditions = []greetingCondition{cond}
+	return status
+}
+
+// reconcile brings one Greeting's status in line with its spec
+func (op *greetingOperator) reconcile(ctx context.Context, g greeting) error {
+	want := desiredStatus(g)
+	ready := want.Conditions[0]
+	op.mu.Lock()
+	op.views[g.Metadata.Name] = GreetingView{Name: g.Metadata.Name, Message: want.Message, Ready: ready.Status == "True",
+		Reason: ready.Reason, Generation: g.Metadata.Generation, ReconciledAt: time.Now()}
+	op.status.Reconciles++
+	op.mu.Unlock()
+
+	if g.Status.ObservedGeneration == g.Metadata.Generation && g.Status.Message == want.Message &&
+		len(g.Status.Conditions) == 1 && g.Status.Conditions[0] == ready {
+		return nil // already up to date, typically the echo of our own status write
+	}
+	g.Status = want
+	// PUT to the status subresource carries resourceVersion, so a write
+	// racing another change fails with 409 and the next event retries
+	err := op.kube.Do(ctx, http.MethodPut, op.path("/"+g.Metadata.Name+"/status"), g, nil)
+	if err != nil {
+		return err
+	}
+	slog.Info("greeting reconciled", "name", g.Metadata.Name, "generation", g.Metadata.Generation,
+		"message", want.Message, "ready", ready.Status, "reason", ready.Reason)
+	return nil
+}
+
+// handle reconciles g, or forgets it once deleted
+func (op *greetingOperator) handle(ctx context.Context, event string, g greeting) {
+	if event == "DELETED" {
+		op.mu.Lock()
+		delete(op.views, g.Metadata.Name)
+		op.mu.Unlock()
+		slog.Info("greeting deleted", "name", g.Metadata.Name)
+		return
+	}
+	if err := op.reconcile(ctx, g); err != nil {
+		op.mu.Lock()
+		op.status.Errors++
+		op.mu.Unlock()
+		if isKubeStatus(err, http.StatusConflict) {
+			slog.Info("greeting changed while reconciling, will retry", "name", g.Metadata.Name)
+			return
+		}
+		slog.Warn("reconcile failed", "name", g.Metadata.Name, "error", err)
+	}
+}
+
+// list reconciles every Greeting and returns the resourceVersion to watch
+// from; Greetings gone since the last list are dropped
+func (op *greetingOperator) list(ctx context.Context) (string, error) {
+	var list greetingList
+	if err := op.kube.Do(ctx, http.MethodGet, op.path(""), nil, &list); err != nil {
+		return "", err
+	}
+	seen := map[string]bool{}
+	for _, g := range list.Items {
+		seen[g.Metadata.Name] = true
+		op.handle(ctx, "ADDED", g)
+	}
+	op.mu.Lock()
+	for name := range op.views {
+		if !seen[name] {
+			delete(op.views, name)
+		}
+	}
+	op.mu.Unlock()
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch handles events after resourceVersion until the server or resync
+// ends the watch
+func (op *greetingOperator) watch(ctx context.Context, resourceVersion string) (string, error) {
+	q := url.Values{"watch": {"true"}, "resourceVersion": {resourceVersion}, "allowWatchBookmarks": {"true"},
+		"timeoutSeconds": {fmt.Sprint(int(op.resync.Seconds()))}}
+	err := op.kube.Watch(ctx, op.path("?"+q.Encode()), func(e kubeWatchEvent) error {
+		if e.Type == "ERROR" {
+			var status kubeAPIError
+			json.Unmarshal(e.Object, &status)
+			if status.Code == http.StatusGone {
+				return errWatchExpired
+			}
+			return &status
+		}
+		var g greeting
+		if err := json.Unmarshal(e.Object, &g); err != nil {
+			return err
+		}
+		resourceVersion = g.Metadata.ResourceVersion
+		op.mu.Lock()
+		op.status.ResourceVersion = resourceVersion
+		op.mu.Unlock()
+		if e.Type != "BOOKMARK" {
+			op.handle(ctx, e.Type, g)
+		}
+		return nil
+	})
+	return resourceVersion, err
+}
+
+// Run lists, then watches, relisting (a resync) whenever a watch ends
+// after the resync period or expires, until ctx is done
+func (op *greetingOperator) Run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		resourceVersion, err := op.list(ctx)
+		for err == nil && ctx.Err() == nil {
+			op.mu.Lock()
+			op.status.ResourceVersion = resourceVersion
+			op.mu.Unlock()
+			started := time.Now()
+			resourceVersion, err = op.watch(ctx, resourceVersion)
+			if err == nil && time.Since(started) >= op.resync {
+				break // resync: list everything again
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil || errors.Is(err, errWatchExpired) {
+			backoff = time.Second
+			continue
+		}
+		if isKubeStatus(err, http.StatusNotFound) {
+			slog.Warn("Greeting CRD not installed (kubectl apply -f k8s/advanced/operator.yaml)", "error", err)
+		} else {
+			slog.Warn("list/watch failed, retrying", "error", err, "backoff", backoff.String())
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// Status is the operator's view, for /api/greetings
+func (op *greetingOperator) Status() OperatorStatus {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	s := op.status
+	s.Greetings = make([]GreetingView, 0, len(op.views))
+	for _, v := range op.views {
+		s.Greetings = append(s.Greetings, v)
+	}
+	sort.Slice(s.Greetings, func(i, j int) bool { return s.Greetings[i].Name < s.Greetings[j].Name })
+	return s
+}
+
+func runOperator(args []string) int {
+	fs := newFlagSet("operator", "")
+	addr := fs.String("addr", ":"+getEnv("PORT", "8080"), "listen address for /api/greetings and /healthz")
+	resync := fs.Duration("resync", getEnvDuration("OPERATOR_RESYNC", 5*time.Minute), "relist and reconcile everything this often")
+	fs.Parse(args)
+	if *resync < time.Second {
+		fs.Usage()
+		return 2
+	}
+
+	setupLogging(getEnv("LOG_LEVEL", "info"))
+	kube, err := inClusterKube()
+	if err != nil {
+		slog.Error("the operator needs the Kubernetes API", "error", err)
+		return 1
+	}
+	op := &greetingOperator{kube: kube, namespace: getEnv("OPERATOR_NAMESPACE", kube.namespace), resync: *resync, views: map[string]GreetingView{}}
+	op.status.Namespace = op.namespace
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go op.Run(ctx)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/greetings", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, op.Status())
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	srv := &http.Server{Addr: *addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe() }()
+	slog.Info("operator started", "namespace", op.namespace, "resource", "greetings."+greetingGroup, "addr", *addr, "resync", resync.String())
+
+	select {
+	case err := <-errs:
+		slog.Error("operator server failed", "error", err)
+		return 1
+	case <-ctx.Done():
+		slog.Info("shutting down operator")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// StatefulSet identity. A StatefulSet names its pods <set>-0, <set>-1, ...
+// and keeps the name (and the number) across restarts and reschedules, so
+// the number can decide what a pod does:
+// the guestbook takes writes only on ordinal 0 and answers reads anywhere,
+// the usual shape of a primary with read replicas:
+//
+//	kubectl exec -n go-demo go-app-cluster-1 -- wget -qO- localhost:8080/api/info   # "ordinal": 1, "role": "reader"
+//
+// The ordinal comes from POD_ORDINAL when set, else the
+// apps.kubernetes.io/pod-index label (Kubernetes 1.28+, via the Downward
+// API labels file), else the hostname. A Deployment's pods have no
+// ordinal, and every one of them is a writer.
+
+// podOrdinal is this pod's StatefulSet identity
+type podOrdinal struct {
+	set     string // the StatefulSet's name, the hostname before -N
+	ordinal int
+}
+
+// replicaSetSuffixChars are what a ReplicaSet draws its pods' random
+// suffix from (k8s.io/apimachinery rand.String): no vowels, 0, 1 or 3
+const replicaSetSuffixChars = "bcdfghjklmnpqrstvwxz2456789"
+
+// statefulSetOrdinal returns this pod's ordinal, if it has one
+func statefulSetOrdinal() (podOrdinal, bool) {
+	hostname, _ := os.Hostname()
+	set, suffix, ok := cutLast(hostname, "-")
+	if v := getEnv("POD_ORDINAL", ""); v != "" {
+		n, err := strconv.Atoi(v)
+		return podOrdinal{set: set, ordinal: n}, err == nil && n >= 0
+	}
+	if v, found := readPodInfo().Labels["apps.kubernetes.io/pod-index"]; found {
+		n, err := strconv.Atoi(v)
+		return podOrdinal{set: set, ordinal: n}, err == nil && n >= 0
+	}
+	if !ok || suffix == "" || strings.Trim(suffix, "0123456789") != "" || len(suffix) > 1 && suffix[0] == '0' {
+		return podOrdinal{}, false
+	}
+	n, err := strconv.Atoi(suffix)
+	if err != nil {
+		return podOrdinal{}, false
+	}
+	// go-app-7d9f8c6b5-24567 is a Deployment's pod whose random suffix
+	// happens to be all digits
+	if len(suffix) == 5 && strings.Trim(suffix, replicaSetSuffixChars) == "" {
+		return podOrdinal{}, false
+	}
+	return podOrdinal{set: set, ordinal: n}, true
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// role is "writer" for ordinal 0 and "reader" for the rest
+func (o podOrdinal) role() string {
+	if o.ordinal == 0 {
+		return "writer"
+	}
+	return "reader"
+}
+
+// writer is the stable DNS name of ordinal 0: <set>-0.<service> when
+// PEER_SERVICE names the StatefulSet's headless Service, else the pod name
+func (o podOrdinal) writer() string {
+	name := o.set + "-0"
+	if service := getEnv("PEER_SERVICE", ""); service != "" {
+		name += "." + service
+	}
+	return name
+}
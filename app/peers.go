@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Peer discovery: which other replicas are out there? In-cluster with RBAC
+// (list pods) the answer comes from the API server, including readiness.
+// Without API access, a headless Service (clusterIP: None) still answers a
+// DNS query with one A record per ready pod, which is how StatefulSets and
+// many databases find each other.
+
+// kubePod is the subset of a v1 Pod the app reads
+type kubePod struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		Phase      string `json:"phase"`
+		PodIP      string `json:"podIP"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+		ContainerStatuses []struct {
+			Name         string `json:"name"`
+			RestartCount int    `json:"restartCount"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// Ready reports the pod's Ready condition, what Services use to route
+func (p kubePod) Ready() bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+// Peer is one replica of this app
+type Peer struct {
+	Name  string `json:"name,omitempty"`
+	IP    string `json:"ip"`
+	Node  string `json:"node,omitempty"`
+	Phase string `json:"phase,omitempty"`
+	Ready bool   `json:"ready"`
+	Self  bool   `json:"self"`
+}
+
+// PeersResponse is returned by /api/peers
+type PeersResponse struct {
+	Source   string `json:"source"` // kubernetes-api or dns
+	Selector string `json:"selector,omitempty"`
+	Service  string `json:"service,omitempty"`
+	Peers    []Peer `json:"peers"`
+	Error    string `json:"error,omitempty"` // why the API wasn't used, if it wasn't
+}
+
+// peerSelector is the label selector matching our replicas: PEER_SELECTOR,
+// or the pod's own app label from the Downward API
+func peerSelector() string {
+	if s := getEnv("PEER_SELECTOR", ""); s != "" {
+		return s
+	}
+	if app := readPodInfo().Labels["app"]; app != "" {
+		return "app=" + app
+	}
+	return "app=go-app"
+}
+
+// listPeerPods asks the API server for pods matching selector
+func listPeerPods(ctx context.Context, kube *kubeClient, selector string) ([]Peer, error) {
+	var list struct {
+		Items []kubePod `json:"items"`
+	}
+	path := "/api/v1/namespaces/" + kube.namespace + "/pods?labelSelector=" + url.QueryEscape(selector)
+	if err := kube.Do(ctx, http.MethodGet, path, nil, &list); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	peers := []Peer{}
+	for _, pod := range list.Items {
+		peers = append(peers, Peer{
+			Name:  pod.Metadata.Name,
+			IP:    pod.Status.PodIP,
+			Node:  pod.Spec.NodeName,
+			Phase: pod.Status.Phase,
+			Ready: pod.Ready(),
+			Self:  pod.Metadata.Name == hostname,
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	return peers, nil
+}
+
+// lookupPeerDNS resolves a headless Service. Only ready pods are
+// published, unless the Service sets publishNotReadyAddresses.
+func lookupPeerDNS(ctx context.Context, service string) ([]Peer, error) {
+	ips, err := net.DefaultResolver.LookupHost(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	ownIP := getEnv("POD_IP", "")
+	peers := []Peer{}
+	for _, ip := range ips {
+		peer := Peer{IP: ip, Ready: true, Self: ip == ownIP}
+		// Pods behind a headless Service get PTR records like
+		// 10-244-0-5.go-app-headless.go-demo.svc.cluster.local.
+		if names, err := net.DefaultResolver.LookupAddr(ctx, ip); err == nil && len(names) > 0 {
+			peer.Name = strings.TrimSuffix(names[0], ".")
+		}
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].IP < peers[j].IP })
+	return peers, nil
+}
+
+// discoverPeers lists sibling pods, via the API when possible, else DNS.
+// The response explains a fallback in Error even when DNS succeeded.
+func discoverPeers(ctx context.Context) (PeersResponse, error) {
+	selector := peerSelector()
+	resp := PeersResponse{Selector: selector}
+
+	kube, err := inClusterKube()
+	if err == nil {
+		peers, listErr := listPeerPods(ctx, kube, selector)
+		if listErr == nil {
+			resp.Source, resp.Peers = "kubernetes-api", peers
+			return resp, nil
+		}
+		err = listErr
+		if isKubeStatus(err, http.StatusForbidden) {
+			resp.Error = "no RBAC permission to list pods (see k8s/advanced/rbac.yaml): " + err.Error()
+		}
+	}
+	if resp.Error == "" {
+		resp.Error = err.Error()
+	}
+
+	resp.Source, resp.Selector = "dns", ""
+	resp.Service = getEnv("PEER_SERVICE", "go-app-headless")
+	peers, err := lookupPeerDNS(ctx, resp.Service)
+	if err != nil {
+		return resp, errors.New(resp.Error + "; DNS lookup of " + resp.Service + " failed: " + err.Error())
+	}
+	resp.Peers = peers
+	return resp, nil
+}
+
+func peersHandler(w http.ResponseWriter, r *http.Request) {
+	resp, err := discoverPeers(r.Context())
+	if err != nil {
+		writeProblem(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeNegotiated(w, r, http.StatusOK, resp)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"sync"
+)
+
+// Pod metadata from the Downward API. Kubernetes can expose pod fields as
+// env vars (fieldRef / resourceFieldRef) or as files in a downwardAPI
+// volume; labels and annotations are only available as files because they
+// can change while the pod runs. Everything falls back to empty values when
+// running outside a cluster.
+
+// serviceAccountDir is where Kubernetes mounts the service account token
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// PodResources holds the container's requests and limits as exposed by
+// resourceFieldRef (CPU in millicores, memory in bytes by default divisor)
+type PodResources struct {
+	CPURequest    string `json:"cpu_request,omitempty"`
+	CPULimit      string `json:"cpu_limit,omitempty"`
+	MemoryRequest string `json:"memory_request,omitempty"`
+	MemoryLimit   string `json:"memory_limit,omitempty"`
+}
+
+// PodInfo describes the pod this process runs in
+type PodInfo struct {
+	Name           string            `json:"name,omitempty"`
+	Namespace      string            `json:"namespace,omitempty"`
+	IP             string            `json:"ip,omitempty"`
+	Node           string            `json:"node,omitempty"`
+	ServiceAccount string            `json:"service_account,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+	Resources      PodResources      `json:"resources"`
+	InCluster      bool              `json:"in_cluster"`
+}
+
+// podEnv is the env part of PodInfo. The Downward API env vars are fixed
+// for the life of the container, so they are read once rather than on
+// every request; labels and annotations are files and re-read each time.
+var podEnv = sync.OnceValue(func() PodInfo {
+	info := PodInfo{
+		Name:           getEnv("POD_NAME", ""),
+		Namespace:      getEnv("POD_NAMESPACE", ""),
+		IP:             getEnv("POD_IP", ""),
+		Node:           getEnv("NODE_NAME", ""),
+		ServiceAccount: getEnv("POD_SERVICE_ACCOUNT", ""),
+		Resources: PodResources{
+			CPURequest:    getEnv("CPU_REQUEST", ""),
+			CPULimit:      getEnv("CPU_LIMIT", ""),
+			MemoryRequest: getEnv("MEMORY_REQUEST", ""),
+			MemoryLimit:   getEnv("MEMORY_LIMIT", ""),
+		},
+		InCluster: getEnv("KUBERNETES_SERVICE_HOST", "") != "",
+	}
+
+	// The service account mount always carries the namespace, even when
+	// the Downward API env var wasn't configured
+	if info.Namespace == "" {
+		if data, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+			info.Namespace = strings.TrimSpace(string(data))
+		}
+	}
+	if info.Name == "" && info.InCluster {
+		// A pod's hostname is its name unless spec.hostname overrides it
+		info.Name, _ = os.Hostname()
+	}
+	return info
+})
+
+// topology is the node's zone and region (TOPOLOGY_ZONE, TOPOLOGY_REGION),
+// read once like podEnv
+var topology = sync.OnceValue(func() struct{ Zone, Region string } {
+	return struct{ Zone, Region string }{getEnv("TOPOLOGY_ZONE", ""), getEnv("TOPOLOGY_REGION", "")}
+})
+
+// podInfoDir is PODINFO_DIR, where the downwardAPI volume is mounted
+var podInfoDir = sync.OnceValue(func() string { return getEnv("PODINFO_DIR", "/etc/podinfo") })
+
+// readPodInfo gathers pod metadata from env vars and PODINFO_DIR files
+func readPodInfo() PodInfo {
+	info := podEnv()
+	info.Labels = readDownwardAPIMap(filepath.Join(podInfoDir(), "labels"))
+	info.Annotations = readDownwardAPIMap(filepath.Join(podInfoDir(), "annotations"))
+	return info
+}
+
+// readDownwardAPIMap parses a downwardAPI labels/annotations file, which
+// holds one key="quoted value" pair per line. A missing file yields nil.
+func readDownwardAPIMap(path string) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, quoted, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			value = quoted
+		}
+		values[key] = value
+	}
+	return values
+}
+
+// podHandler reports the pod's Downward API metadata
+func podHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, readPodInfo())
+}
+
+// servedBy describes where this pod is scheduled, for the home page
+func servedBy() string {
+	node := podEnv().Node
+	if node == "" {
+		node = "unknown node"
+	}
+	if zone := topology().Zone; zone != "" {
+		return node + " / " + zone
+	}
+	return node
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HTTP versions on the app port. HTTP/1.1 is always on; on top of it:
+//
+//	ENABLE_H2C=true     cleartext HTTP/2 with prior knowledge   (true)
+//	ENABLE_HTTP2=true   HTTP/2 over TLS, negotiated by ALPN     (true)
+//	HTTP3_PORT=8080     HTTP/3 over QUIC on that UDP port       (off, see http3.go)
+//
+//	curl --http2-prior-knowledge localhost:30080/api/echo | jq .protocol   # "h2c"
+//	curl -k --http2 https://localhost:8443/api/echo | jq .protocol         # "h2"
+//	curl --http1.1 localhost:30080/api/echo | jq .protocol                 # "http/1.1"
+//
+// h2c is what gRPC and most meshes speak to a pod (appProtocol:
+// kubernetes.io/h2c in service.yaml): an Ingress or Gateway forwarding
+// gRPC to a backend needs the backend to accept HTTP/2 without TLS. Only
+// prior knowledge is supported, not the "Upgrade: h2c" dance (deprecated
+// by RFC 9113, and not in net/http): a request asking to upgrade is
+// answered over HTTP/1.1, which curl --http2 on a plain URL shows.
+//
+// Behind a Service the protocol is whatever the last hop chose: kube-proxy
+// passes TCP through untouched, while an Ingress controller usually talks
+// HTTP/1.1 to pods whatever the client used.
+
+// protocolsFromEnv is the HTTP versions the app port serves
+func protocolsFromEnv() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetUnencryptedHTTP2(getEnvBool("ENABLE_H2C", true))
+	p.SetHTTP2(getEnvBool("ENABLE_HTTP2", true))
+	return p
+}
+
+// protocolNames lists what p enables, for the startup log
+func protocolNames(p *http.Protocols) string {
+	var names []string
+	if p.HTTP1() {
+		names = append(names, "http/1.1")
+	}
+	if p.UnencryptedHTTP2() {
+		names = append(names, "h2c")
+	}
+	if p.HTTP2() {
+		names = append(names, "h2")
+	}
+	return strings.Join(names, ",")
+}
+
+// requestProtocol is the protocol r arrived over: h3 (HTTP/3 over QUIC),
+// h2 (HTTP/2 over TLS), h2c (cleartext HTTP/2) or http/1.x
+func requestProtocol(r *http.Request) string {
+	if r.ProtoMajor == 3 {
+		return "h3"
+	}
+	if r.ProtoMajor == 2 {
+		if r.TLS != nil {
+			return "h2"
+		}
+		return "h2c"
+	}
+	return strings.ToLower(r.Proto)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Just enough of the protobuf wire format for the gRPC server: messages
+// here only use strings, varints (ints, bools, enums) and nested messages,
+// which are all "varint" or "length-delimited" on the wire.
+//
+// https://protobuf.dev/programming-guides/encoding/
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// protoMessage builds an encoded message field by field
+type protoMessage []byte
+
+func (m protoMessage) tag(field, wireType int) protoMessage {
+	return binary.AppendUvarint(m, uint64(field)<<3|uint64(wireType))
+}
+
+// String appends a string field, skipping the empty default like protoc does
+func (m protoMessage) String(field int, s string) protoMessage {
+	if s == "" {
+		return m
+	}
+	return m.Bytes(field, []byte(s))
+}
+
+// Bytes appends a length-delimited field (bytes or an embedded message)
+func (m protoMessage) Bytes(field int, b []byte) protoMessage {
+	m = m.tag(field, wireBytes)
+	m = binary.AppendUvarint(m, uint64(len(b)))
+	return append(m, b...)
+}
+
+// Varint appends an integer, bool or enum field, skipping zero
+func (m protoMessage) Varint(field int, v uint64) protoMessage {
+	if v == 0 {
+		return m
+	}
+	return binary.AppendUvarint(m.tag(field, wireVarint), v)
+}
+
+// OptionalVarint appends v even when it is zero: a proto3 optional field
+// that is set
+func (m protoMessage) OptionalVarint(field int, v uint64) protoMessage {
+	return binary.AppendUvarint(m.tag(field, wireVarint), v)
+}
+
+// Bool appends a bool field
+func (m protoMessage) Bool(field int, b bool) protoMessage {
+	if !b {
+		return m
+	}
+	return m.Varint(field, 1)
+}
+
+// protoFields is a decoded message: the last value seen for each field.
+// Repeated fields aren't needed by any message the server reads.
+type protoFields struct {
+	bytes   map[int][]byte
+	varints map[int]uint64
+}
+
+func (f protoFields) String(field int) string { return string(f.bytes[field]) }
+
+func (f protoFields) Has(field int) bool {
+	_, ok := f.bytes[field]
+	if !ok {
+		_, ok = f.varints[field]
+	}
+	return ok
+}
+
+var errBadProto = errors.New("malformed protobuf message")
+
+// decodeProto parses a message, skipping fixed32/fixed64 fields
+func decodeProto(data []byte) (protoFields, error) {
+	f := protoFields{bytes: map[int][]byte{}, varints: map[int]uint64{}}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return f, errBadProto
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return f, errBadProto
+			}
+			f.varints[field] = v
+			data = data[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return f, errBadProto
+			}
+			f.bytes[field] = data[n : n+int(size)]
+			data = data[n+int(size):]
+		case 1: // fixed64
+			if len(data) < 8 {
+				return f, errBadProto
+			}
+			data = data[8:]
+		case 5: // fixed32
+			if len(data) < 4 {
+				return f, errBadProto
+			}
+			data = data[4:]
+		default:
+			return f, errBadProto
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /api/provenance is the running binary's own evidence for a supply-chain
+// lesson: its SHA-256, what the Go toolchain recorded about the build, and
+// where its signature and SBOM live. Compare the checksum with the one in
+// the image to see that the pod runs what was signed:
+//
+//	curl -s localhost:8080/api/provenance | jq '{sha256: .binary.sha256, vcs, signature, sbom}'
+//	kubectl exec -n go-demo deploy/go-app -- sha256sum /home/appuser/app
+//	cosign verify --key cosign.pub localhost:5001/go-app:latest
+//
+// The signature and SBOM references are stamped in like the version, as
+// they are known before the build (where the pipeline will push them):
+//
+//	docker build --build-arg SIGNATURE_REF=localhost:5001/go-app:sha256-<digest>.sig \
+//	  --build-arg SBOM_REF=localhost:5001/go-app:sha256-<digest>.sbom .
+//
+// debug.ReadBuildInfo only has VCS fields for a binary built inside a git
+// checkout; the Dockerfile copies the sources without .git, so in the image
+// the commit comes from GIT_COMMIT instead. The checksum is taken once, on
+// the first request, from /proc/self/exe's target.
+var (
+	signatureRef string
+	sbomRef      string
+)
+
+// ProvenanceBinary is the executable this process runs
+type ProvenanceBinary struct {
+	Path    string     `json:"path"`
+	SHA256  string     `json:"sha256,omitempty"`
+	Size    int64      `json:"size,omitempty"`
+	ModTime *time.Time `json:"mod_time,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// ProvenanceDependency is one module compiled in
+type ProvenanceDependency struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Sum     string `json:"sum,omitempty"`
+	Replace string `json:"replace,omitempty"`
+}
+
+// ProvenanceResponse is returned by /api/provenance
+type ProvenanceResponse struct {
+	Binary        ProvenanceBinary       `json:"binary"`
+	Version       string                 `json:"version"`
+	GitCommit     string                 `json:"git_commit,omitempty"`
+	BuildDate     string                 `json:"build_date,omitempty"`
+	Module        string                 `json:"module,omitempty"`
+	GoVersion     string                 `json:"go_version,omitempty"`
+	VCS           map[string]string      `json:"vcs"`            // vcs.* settings, empty outside a git checkout
+	BuildSettings map[string]string      `json:"build_settings"` // -ldflags, CGO_ENABLED, GOOS, GOARCH...
+	Dependencies  []ProvenanceDependency `json:"dependencies"`
+	Image         string                 `json:"image,omitempty"` // from the IMAGE env var
+	Signature     string                 `json:"signature,omitempty"`
+	SBOM          string                 `json:"sbom,omitempty"`
+}
+
+// binaryChecksum hashes the executable once
+var binaryChecksum = sync.OnceValue(func() ProvenanceBinary {
+	path, err := os.Executable()
+	if err != nil {
+		return ProvenanceBinary{Error: err.Error()}
+	}
+	b := ProvenanceBinary{Path: path}
+	f, err := os.Open(path)
+	if err != nil {
+		b.Error = err.Error()
+		return b
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err == nil {
+		mod := st.ModTime().UTC()
+		b.Size, b.ModTime = st.Size(), &mod
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		b.Error = err.Error()
+		return b
+	}
+	b.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return b
+})
+
+// provenance assembles the response from the binary and its build info
+func provenance() ProvenanceResponse {
+	v := buildInfo()
+	p := ProvenanceResponse{
+		Binary:        binaryChecksum(),
+		Version:       v.Version,
+		GitCommit:     v.GitCommit,
+		BuildDate:     v.BuildDate,
+		GoVersion:     v.GoVersion,
+		VCS:           map[string]string{},
+		BuildSettings: map[string]string{},
+		Dependencies:  []ProvenanceDependency{},
+		Image:         getEnv("IMAGE", ""),
+		Signature:     signatureRef,
+		SBOM:          sbomRef,
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return p
+	}
+	p.Module = info.Main.Path
+	for _, s := range info.Settings {
+		if s.Key == "vcs" || strings.HasPrefix(s.Key, "vcs.") {
+			p.VCS[s.Key] = s.Value
+		} else {
+			p.BuildSettings[s.Key] = s.Value
+		}
+	}
+	for _, dep := range info.Deps {
+		d := ProvenanceDependency{Path: dep.Path, Version: dep.Version, Sum: dep.Sum}
+		if dep.Replace != nil {
+			d.Replace = dep.Replace.Path + "@" + dep.Replace.Version
+		}
+		p.Dependencies = append(p.Dependencies, d)
+	}
+	sort.Slice(p.Dependencies, func(i, j int) bool { return p.Dependencies[i].Path < p.Dependencies[j].Path })
+	return p
+}
+
+func provenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, provenance())
+}
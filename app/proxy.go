@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/cache"
+)
+
+// app proxy puts a caching reverse proxy in front of an upstream, so the
+// same image can run as the app, as a caching sidecar next to it, or as a
+// small edge layer in front of a Service:
+//
+//	app proxy -upstream http://go-app-service -addr :8080 -ttl 30s
+//	curl -si localhost:8080/api/info | grep -i '^x-cache\|^age'   # MISS, then REVALIDATED
+//	curl localhost:8080/_proxy/cache                              # entries, hit rate
+//	curl -X POST localhost:8080/_proxy/cache/flush
+//
+// GET and HEAD responses with a 200, 203, 301, 404 or 410 are cached for
+// the upstream's Cache-Control max-age (s-maxage first), capped at -ttl.
+// A no-cache response with an ETag, which is what the app's own /api/info
+// and /api/config send, is kept but revalidated: the next request goes up
+// with If-None-Match, and a 304 is answered from the cache. Responses
+// marked no-store or private, ones that set a cookie, and requests that
+// send Authorization or a Cookie go straight through; so do /events and
+// /ws/, which stream. The cache key is the method and path, the query
+// unless -key-query=false, and the -key-headers values. X-Cache says HIT,
+// REVALIDATED, MISS or BYPASS, and Age how old a cached answer is. The
+// proxy's own endpoints live under /_proxy/, out of the upstream's way,
+// with proxy_requests_total{cache} and the cache_* metrics at
+// /_proxy/metrics.
+
+var (
+	proxyRequests = newCounterVec("proxy_requests_total",
+		"Requests through the caching proxy, by cache result (hit, revalidated, miss, bypass).", "cache")
+	proxyUpstreamDuration = newHistogramVec("proxy_upstream_duration_seconds",
+		"Time the upstream took to answer the proxy.", defaultBuckets)
+)
+
+// cachedResponse is one stored upstream answer
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+	// revalidate is set for no-cache answers: each use asks the
+	// upstream whether etag is still current
+	revalidate bool
+	etag       string
+}
+
+// cachingProxy forwards to upstream, answering repeat GETs from its cache
+type cachingProxy struct {
+	upstream   *url.URL
+	proxy      *httputil.ReverseProxy
+	cache      *cache.LRU[*cachedResponse]
+	ttl        time.Duration
+	maxBody    int64
+	keyQuery   bool
+	keyHeaders []string // canonical names
+
+	results sync.Map // cache result -> *atomic.Int64, for /_proxy/cache
+}
+
+// ProxyCacheResponse is returned by /_proxy/cache
+type ProxyCacheResponse struct {
+	Upstream   string           `json:"upstream"`
+	TTL        string           `json:"ttl"`
+	KeyQuery   bool             `json:"key_query"`
+	KeyHeaders []string         `json:"key_headers"`
+	Cache      cache.Stats      `json:"cache"`
+	Requests   map[string]int64 `json:"requests"`  // by X-Cache result
+	HitRatio   float64          `json:"hit_ratio"` // hits and revalidations among cacheable requests
+}
+
+var cacheableStatus = map[int]bool{200: true, 203: true, 301: true, 404: true, 410: true}
+
+func runProxy(args []string) int {
+	fs := newFlagSet("proxy", "")
+	addr := fs.String("addr", getEnv("PROXY_ADDR", ":8080"), "listen address")
+	upstream := fs.String("upstream", getEnv("PROXY_UPSTREAM", ""), "URL to forward to, e.g. http://go-app-service")
+	ttl := fs.Duration("ttl", getEnvDuration("PROXY_CACHE_TTL", 30*time.Second), "longest a response is cached")
+	size := fs.Int("size", int(getEnvInt("PROXY_CACHE_SIZE", 1024)), "cached responses, 0 disables the cache")
+	maxBody := fs.Int64("max-body", getEnvInt("PROXY_CACHE_MAX_BODY", 1<<20), "larger responses are passed through uncached")
+	keyQuery := fs.Bool("key-query", getEnvBool("PROXY_CACHE_KEY_QUERY", true), "include the query string in the cache key")
+	keyHeaders := fs.String("key-headers", getEnv("PROXY_CACHE_KEY_HEADERS", "Accept,Accept-Encoding"), "comma-separated request headers in the cache key")
+	fs.Parse(args)
+
+	setupLogging(getEnv("LOG_LEVEL", "info"))
+	target, err := url.Parse(*upstream)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		slog.Error("proxy needs -upstream (PROXY_UPSTREAM) as an absolute URL", "upstream", *upstream)
+		return 2
+	}
+	p := &cachingProxy{
+		upstream: target,
+		cache:    cache.New[*cachedResponse]("proxy", *size, *ttl),
+		ttl:      *ttl,
+		maxBody:  *maxBody,
+		keyQuery: *keyQuery,
+	}
+	p.keyHeaders = []string{}
+	for _, h := range strings.Split(*keyHeaders, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			p.keyHeaders = append(p.keyHeaders, http.CanonicalHeaderKey(h))
+		}
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+		},
+		ModifyResponse: p.store,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			writeProblem(w, r, http.StatusBadGateway, "upstream "+target.Host+": "+err.Error())
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_proxy/metrics", metricsHandler)
+	mux.HandleFunc("/_proxy/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/_proxy/cache", p.statsHandler)
+	mux.HandleFunc("/_proxy/cache/flush", cacheFlushHandler)
+	mux.HandleFunc("/", p.ServeHTTP)
+	srv := &http.Server{Addr: *addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe() }()
+	slog.Info("caching proxy listening", "addr", *addr, "upstream", target.String(), "ttl", ttl.String(), "size", *size)
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("proxy server failed", "error", err)
+			return 1
+		}
+	case <-ctx.Done():
+		slog.Info("shutting down proxy")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}
+	return 0
+}
+
+// cacheKey is the method, path, query and key headers of r
+func (p *cachingProxy) cacheKey(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method + " " + r.URL.Path)
+	if p.keyQuery && r.URL.RawQuery != "" {
+		b.WriteString("?" + r.URL.Query().Encode()) // sorted, so ?a=1&b=2 and ?b=2&a=1 share an entry
+	}
+	for _, h := range p.keyHeaders {
+		b.WriteString("\n" + h + ": " + r.Header.Get(h))
+	}
+	return b.String()
+}
+
+// bypass reports whether r must go to the upstream uncached
+func (p *cachingProxy) bypass(r *http.Request) bool {
+	if !p.cache.Enabled() || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return true
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		return true
+	}
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return true
+	}
+	return r.URL.Path == "/events" || strings.HasPrefix(r.URL.Path, "/ws/")
+}
+
+type proxyContextKey struct{}
+
+// proxyState rides on a forwarded request to tell store its key
+type proxyState struct {
+	key    string          // "" when bypassing the cache
+	cached *cachedResponse // the copy being revalidated
+	start  time.Time
+}
+
+func (p *cachingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.bypass(r) {
+		p.count("bypass")
+		w.Header().Set("X-Cache", "BYPASS")
+		p.forward(w, r, &proxyState{})
+		return
+	}
+	state := &proxyState{key: p.cacheKey(r)}
+	if c, ok := p.cache.Get(state.key); ok {
+		if !c.revalidate && time.Now().Before(c.expires) {
+			p.count("hit")
+			p.writeCached(w, r, c, "HIT")
+			return
+		}
+		// A stale or no-cache copy is still worth a conditional request,
+		// unless the client is revalidating its own
+		if c.etag != "" && r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "" {
+			state.cached = c
+			r = r.Clone(r.Context())
+			r.Header.Set("If-None-Match", c.etag)
+		}
+	}
+	p.forward(w, r, state)
+}
+
+// writeCached answers from c
+func (p *cachingProxy) writeCached(w http.ResponseWriter, r *http.Request, c *cachedResponse, result string) {
+	h := w.Header()
+	for k, v := range c.header {
+		h[k] = v
+	}
+	h.Set("X-Cache", result)
+	h.Set("Age", strconv.Itoa(int(time.Since(c.stored).Seconds())))
+	w.WriteHeader(c.status)
+	if r.Method != http.MethodHead {
+		w.Write(c.body)
+	}
+}
+
+func (p *cachingProxy) count(result string) {
+	proxyRequests.Inc(result)
+	n, _ := p.results.LoadOrStore(result, new(atomic.Int64))
+	n.(*atomic.Int64).Add(1)
+}
+
+func (p *cachingProxy) forward(w http.ResponseWriter, r *http.Request, state *proxyState) {
+	state.start = time.Now()
+	p.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyContextKey{}, state)))
+}
+
+// store is the ReverseProxy's ModifyResponse: it times the upstream,
+// answers a 304 to a revalidation from the cache, and keeps a copy of
+// cacheable answers
+func (p *cachingProxy) store(res *http.Response) error {
+	state, _ := res.Request.Context().Value(proxyContextKey{}).(*proxyState)
+	if state == nil || state.key == "" {
+		return nil
+	}
+	proxyUpstreamDuration.Observe(time.Since(state.start).Seconds())
+	now := time.Now()
+	if c := state.cached; c != nil && res.StatusCode == http.StatusNotModified {
+		p.count("revalidated")
+		fresh := *c
+		fresh.stored, fresh.expires = now, now.Add(p.ttl)
+		p.cache.Add(state.key, &fresh)
+		res.Body.Close()
+		res.StatusCode, res.Status = c.status, ""
+		res.Header = c.header.Clone()
+		res.Header.Set("X-Cache", "REVALIDATED")
+		res.Header.Set("Age", "0")
+		res.Body, res.ContentLength = io.NopCloser(bytes.NewReader(c.body)), int64(len(c.body))
+		return nil
+	}
+	p.count("miss")
+	res.Header.Set("X-Cache", "MISS")
+	ttl, revalidate := p.responseTTL(res)
+	if ttl <= 0 || res.ContentLength > p.maxBody {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, p.maxBody+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > p.maxBody {
+		// Too big after all: send what was read, then the rest, uncached
+		res.Body = readCloser{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return nil
+	}
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	header := res.Header.Clone()
+	header.Del("X-Cache")
+	p.cache.Add(state.key, &cachedResponse{status: res.StatusCode, header: header, body: body, stored: now, expires: now.Add(ttl),
+		revalidate: revalidate, etag: res.Header.Get("Etag")})
+	return nil
+}
+
+// readCloser reads from one reader and closes another
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// responseTTL is how long res may be cached, 0 when it mustn't be, and
+// whether each use must be revalidated first
+func (p *cachingProxy) responseTTL(res *http.Response) (time.Duration, bool) {
+	if !cacheableStatus[res.StatusCode] || res.Header.Get("Set-Cookie") != "" || res.Header.Get("Vary") == "*" {
+		return 0, false
+	}
+	ttl := p.ttl
+	directives := map[string]string{}
+	for _, d := range strings.Split(res.Header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(d)), "=")
+		directives[name] = value
+	}
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := directives[d]; ok {
+			return 0, false
+		}
+	}
+	if _, ok := directives["no-cache"]; ok {
+		if res.Header.Get("Etag") == "" {
+			return 0, false // nothing to revalidate with
+		}
+		return ttl, true
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[d]; ok {
+			if secs, err := strconv.Atoi(v); err == nil {
+				return min(ttl, time.Duration(secs)*time.Second), false
+			}
+		}
+	}
+	return ttl, false
+}
+
+// statsHandler serves /_proxy/cache
+func (p *cachingProxy) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	resp := ProxyCacheResponse{Upstream: p.upstream.String(), TTL: p.ttl.String(), KeyQuery: p.keyQuery,
+		KeyHeaders: p.keyHeaders, Cache: p.cache.Stats(), Requests: map[string]int64{}}
+	p.results.Range(func(k, v any) bool {
+		resp.Requests[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	served := resp.Requests["hit"] + resp.Requests["revalidated"]
+	if total := served + resp.Requests["miss"]; total > 0 {
+		resp.HitRatio = float64(served) / float64(total)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An in-memory work queue for demos of scaling on queue length and of
+// draining in-flight work on shutdown:
+//
+//	curl -X POST 'localhost:8080/api/jobs?type=cpu&duration=10s&count=20'
+//	curl localhost:8080/api/jobs            # queue depth, workers, recent jobs
+//	curl localhost:8080/api/jobs/<id>       # one job's status
+//
+// JOB_WORKERS jobs run at once (2 by default), up to JOB_QUEUE_SIZE wait
+// (100), and more are rejected with 503. job_queue_depth is the metric to
+// scale on. The queue is per pod and lost on restart: on SIGTERM the pod
+// stops accepting jobs and finishes the running ones within
+// JOB_DRAIN_TIMEOUT; queued jobs are dropped and logged. A real system puts
+// the queue in a broker so another pod picks them up.
+
+// Job is one unit of simulated work
+type Job struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"` // cpu or sleep
+	Duration   string     `json:"duration"`
+	Status     string     `json:"status"` // queued, running, done, canceled
+	Pod        string     `json:"pod"`
+	Worker     int        `json:"worker,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	duration time.Duration
+}
+
+// JobsResponse is returned by GET /api/jobs
+type JobsResponse struct {
+	Pod      string `json:"pod"`
+	Workers  int    `json:"workers"`
+	Capacity int    `json:"queue_capacity"`
+	Queued   int    `json:"queued"`
+	Running  int64  `json:"running"`
+	Draining bool   `json:"draining"`
+	Recent   []Job  `json:"recent"` // newest first
+}
+
+// keptJobs bounds the finished jobs remembered for GET /api/jobs/{id}
+const keptJobs = 1000
+
+type jobQueue struct {
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []string // IDs oldest first, for eviction
+
+	pending  chan *Job
+	workers  int
+	running  atomic.Int64
+	draining atomic.Bool
+	done     sync.WaitGroup
+	ctx      context.Context // canceled when a drain runs out of time
+	cancel   context.CancelFunc
+}
+
+var (
+	jobs *jobQueue
+
+	jobsProcessed = newCounterVec("jobs_processed_total",
+		"Jobs finished, by type and status.", "type", "status")
+	jobsRejected = newCounterVec("jobs_rejected_total",
+		"Jobs turned away, by reason (queue_full or draining).", "reason")
+)
+
+func init() {
+	newGaugeFunc("job_queue_depth", "Jobs waiting for a worker.", func() float64 {
+		if jobs == nil {
+			return 0
+		}
+		return float64(len(jobs.pending))
+	})
+	newGaugeFunc("jobs_running", "Jobs being worked on.", func() float64 {
+		if jobs == nil {
+			return 0
+		}
+		return float64(jobs.running.Load())
+	})
+}
+
+// newJobQueue starts workers goroutines reading a queue of size capacity
+func newJobQueue(workers, capacity int) *jobQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &jobQueue{jobs: map[string]*Job{}, pending: make(chan *Job, capacity), workers: workers, ctx: ctx, cancel: cancel}
+	hostname, _ := os.Hostname()
+	for i := 1; i <= workers; i++ {
+		q.done.Add(1)
+		go q.work(i, hostname)
+	}
+	return q
+}
+
+func (q *jobQueue) work(worker int, pod string) {
+	defer q.done.Done()
+	for job := range q.pending {
+		if q.draining.Load() {
+			continue // shutting down: finish what's running, skip the rest
+		}
+		q.update(job, func(j *Job) {
+			now := time.Now()
+			j.Status, j.Worker, j.StartedAt = "running", worker, &now
+		})
+		q.running.Add(1)
+		err := runJob(q.ctx, job)
+		q.running.Add(-1)
+		q.update(job, func(j *Job) {
+			now := time.Now()
+			j.Status, j.FinishedAt = "done", &now
+			if err != nil {
+				j.Status, j.Error = "canceled", err.Error()
+			}
+		})
+		jobsProcessed.Inc(job.Type, job.Status)
+		slog.Debug("job finished", "job", job.ID, "type", job.Type, "status", job.Status, "worker", worker)
+	}
+}
+
+// runJob does the job's work: spinning a CPU or sleeping
+func runJob(ctx context.Context, job *Job) error {
+	ctx, cancel := context.WithTimeout(ctx, job.duration)
+	defer cancel()
+	if job.Type == "cpu" {
+		var iterations atomic.Int64
+		cpuLoadWorkers.Add(1)
+		burnCPU(ctx, &iterations)
+		cpuLoadWorkers.Add(-1)
+	} else {
+		<-ctx.Done()
+	}
+	if ctx.Err() == context.Canceled {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// update changes a job under the lock, so readers see consistent copies
+func (q *jobQueue) update(job *Job, change func(*Job)) {
+	q.mu.Lock()
+	change(job)
+	q.mu.Unlock()
+}
+
+// Enqueue adds a job, or reports why it can't
+func (q *jobQueue) Enqueue(jobType string, d time.Duration, pod string) (Job, string) {
+	var b [8]byte
+	rand.Read(b[:])
+	job := &Job{ID: hex.EncodeToString(b[:]), Type: jobType, Duration: d.String(), Status: "queued",
+		Pod: pod, CreatedAt: time.Now(), duration: d}
+
+	// Under the lock: Drain closes pending while holding it
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.draining.Load() {
+		jobsRejected.Inc("draining")
+		return Job{}, "draining"
+	}
+	select {
+	case q.pending <- job:
+	default:
+		jobsRejected.Inc("queue_full")
+		return Job{}, "queue_full"
+	}
+	q.jobs[job.ID] = job
+	q.order = append(q.order, job.ID)
+	for len(q.order) > keptJobs {
+		if old := q.jobs[q.order[0]]; old != nil && old.FinishedAt == nil {
+			break // never forget a job that's still pending
+		}
+		delete(q.jobs, q.order[0])
+		q.order = q.order[1:]
+	}
+	return *job, ""
+}
+
+// Get returns a copy of a job
+func (q *jobQueue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Recent returns copies of the newest n jobs
+func (q *jobQueue) Recent(n int) []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	recent := []Job{}
+	for i := len(q.order) - 1; i >= 0 && len(recent) < n; i-- {
+		recent = append(recent, *q.jobs[q.order[i]])
+	}
+	return recent
+}
+
+// LongRunning returns copies of the running jobs of at least min duration,
+// the work a drain waits for
+func (q *jobQueue) LongRunning(min time.Duration) []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	long := []Job{}
+	for _, id := range q.order {
+		if job := q.jobs[id]; job.Status == "running" && job.duration >= min {
+			long = append(long, *job)
+		}
+	}
+	return long
+}
+
+// Drain stops accepting jobs and waits up to timeout for the workers to
+// finish what's running; anything still queued is dropped
+func (q *jobQueue) Drain(timeout time.Duration) {
+	q.mu.Lock()
+	if !q.draining.CompareAndSwap(false, true) {
+		q.mu.Unlock()
+		return
+	}
+	close(q.pending) // workers skip what's left and exit
+	q.mu.Unlock()
+	slog.Info("draining job queue", "running", q.running.Load(), "queued", len(q.pending), "timeout", timeout.String())
+
+	finished := make(chan struct{})
+	go func() {
+		q.done.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		slog.Info("job queue drained")
+	case <-time.After(timeout):
+		q.cancel()
+		<-finished
+		slog.Warn("job drain timed out, canceled running jobs", "timeout", timeout.String())
+	}
+	q.mu.Lock()
+	var dropped []string
+	for _, id := range q.order {
+		if job := q.jobs[id]; job.Status == "queued" {
+			job.Status = "canceled"
+			dropped = append(dropped, id)
+		}
+	}
+	q.mu.Unlock()
+	if len(dropped) > 0 {
+		slog.Warn("queued jobs dropped at shutdown", "count", len(dropped), "jobs", dropped)
+	}
+}
+
+// jobsHandler serves GET and POST /api/jobs and GET /api/jobs/{id}
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	hostname, _ := os.Hostname()
+	if id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/"); id != "" {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+		job, ok := jobs.Get(id)
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, "no such job on this pod ("+hostname+"); jobs live in the pod that accepted them")
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, JobsResponse{
+			Pod:      hostname,
+			Workers:  jobs.workers,
+			Capacity: cap(jobs.pending),
+			Queued:   len(jobs.pending),
+			Running:  jobs.running.Load(),
+			Draining: jobs.draining.Load(),
+			Recent:   jobs.Recent(50),
+		})
+	case http.MethodPost:
+		var req struct {
+			Type     string `json:"type" validate:"oneof=sleep cpu"`
+			Duration string `json:"duration" validate:"duration=10m"`
+			Count    int    `json:"count" validate:"min=1,max=100"`
+		}
+		if err := decodeBody(w, r, 4<<10, &req); err != nil { // optional; query params win
+			writeBodyProblem(w, r, err)
+			return
+		}
+		q := r.URL.Query()
+		if v := q.Get("type"); v != "" {
+			req.Type = v
+		}
+		if v := q.Get("duration"); v != "" {
+			req.Duration = v
+		}
+		if v := q.Get("count"); v != "" {
+			var err error
+			if req.Count, err = strconv.Atoi(v); err != nil {
+				writeProblem(w, r, http.StatusBadRequest, "count must be an integer")
+				return
+			}
+		}
+		req.Type = cmp.Or(req.Type, "sleep")
+		req.Duration = cmp.Or(req.Duration, "5s")
+		req.Count = cmp.Or(req.Count, 1)
+		if err := validate(&req); err != nil {
+			writeBodyProblem(w, r, err)
+			return
+		}
+		d, _ := time.ParseDuration(req.Duration)
+
+		accepted := make([]Job, 0, req.Count)
+		for range req.Count {
+			job, reason := jobs.Enqueue(req.Type, d, hostname)
+			if reason != "" {
+				if len(accepted) > 0 {
+					break // partial: report what got in
+				}
+				w.Header().Set("Retry-After", "5")
+				writeProblem(w, r, http.StatusServiceUnavailable, "job not accepted: "+reason)
+				return
+			}
+			accepted = append(accepted, job)
+		}
+		if req.Count == 1 {
+			w.Header().Set("Location", "/api/jobs/"+accepted[0].ID)
+			writeJSON(w, http.StatusAccepted, accepted[0])
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]any{"accepted": len(accepted), "requested": req.Count, "jobs": accepted})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeProblem(w, r, http.StatusMethodNotAllowed, "use GET or POST")
+	}
+}
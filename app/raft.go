@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// Experimental: Raft consensus among a StatefulSet's pods, carrying the
+// key-value store in kv.go. hashicorp/raft does the elections, the log
+// replication and the snapshots; this file picks the members, wires the
+// transport and the stores, and reports what the library sees:
+//
+//	KV_RAFT=true RAFT_REPLICAS=3 PEER_SERVICE=go-app-cluster RAFT_SECRET=...
+//	curl -X PUT --data blue localhost:8080/api/kv/color
+//	curl -s localhost:8080/api/raft/status | jq '{state, term, leader, commit_index}'
+//
+// The members are the ordinals 0 to RAFT_REPLICAS-1, reached at their
+// stable names in the headless Service, <set>-<n>.<PEER_SERVICE>, so a
+// rescheduled pod rejoins under the same identity with a new IP. Every
+// member bootstraps the same configuration on its first start, which the
+// library allows; after that the log carries it. A follower that hears
+// nothing from the leader for RAFT_ELECTION_TIMEOUT (1.5s) stands for
+// election in the next term. A write is acknowledged once a majority has
+// it in their logs, so 3 replicas survive losing one and stop taking
+// writes at two down: delete two pods and PUTs answer 503 while the
+// survivor keeps calling elections it can't win.
+//
+// RAFT_STATE_DIR keeps the log, term, vote (raft.db) and snapshots on a
+// volume. Without it they are in memory, and a restarted member rejoins
+// empty and is caught up by the leader - but it also forgets whom it
+// voted for, which Raft's safety relies on: volumeClaimTemplates are what
+// make a StatefulSet a fit for consensus.
+//
+// Peers talk the library's own protocol on RAFT_PORT (7000), not the app
+// port: nothing there is for clients, and raftpeer.go admits only the
+// members, holding RAFT_SECRET. RAFT_LOG_LEVEL (warn) sets how much of the
+// library's logging reaches stdout.
+
+// raftNode is this pod's member of the group
+type raftNode struct {
+	id, addr string // addr is the Raft address peers dial
+	appPort  string // peers' HTTP port, for forwarding writes
+	stateDir string
+	members  raft.Configuration
+	r        *raft.Raft
+
+	mu               sync.Mutex
+	lastLeaderChange time.Time
+}
+
+// RaftPeer is one member as this pod sees it
+type RaftPeer struct {
+	ID       string `json:"id"`
+	Addr     string `json:"addr"`
+	Self     bool   `json:"self"`
+	Leader   bool   `json:"leader"`
+	Suffrage string `json:"suffrage"` // Voter, Nonvoter or Staging
+}
+
+// RaftStatus is returned by /api/raft/status
+type RaftStatus struct {
+	Enabled           bool       `json:"enabled"`
+	ID                string     `json:"id,omitempty"`
+	Addr              string     `json:"addr,omitempty"`
+	State             string     `json:"state,omitempty"` // follower, candidate, leader or shutdown
+	Term              uint64     `json:"term"`
+	Leader            string     `json:"leader,omitempty"`
+	CommitIndex       uint64     `json:"commit_index"`
+	LastApplied       uint64     `json:"last_applied"`
+	LastLogIndex      uint64     `json:"last_log_index"`
+	LastLogTerm       uint64     `json:"last_log_term"`
+	LastSnapshotIndex uint64     `json:"last_snapshot_index"`
+	Quorum            int        `json:"quorum,omitempty"`       // members needed for an election or a commit
+	LastContact       string     `json:"last_contact,omitempty"` // follower: since it last heard from the leader
+	LastLeaderChange  *time.Time `json:"last_leader_change,omitempty"`
+	StateDir          string     `json:"state_dir,omitempty"`
+	Peers             []RaftPeer `json:"peers"`
+}
+
+// errNotLeader is returned by Propose on a follower; the handler forwards
+var errNotLeader = errors.New("not the leader")
+
+// kvRaft is set in main when KV_RAFT is true
+var kvRaft *raftNode
+
+var raftLeaderChanges = newCounterVec("raft_leader_changes_total",
+	"Leaders this pod has seen taken over, by whether it is this pod (self, other, none).", "leader")
+
+func init() {
+	newGaugeFunc("raft_term", "Current Raft term on this pod.", func() float64 {
+		if kvRaft == nil {
+			return 0
+		}
+		return float64(kvRaft.r.CurrentTerm())
+	})
+	newGaugeFunc("raft_leader", "1 while this pod is the Raft leader.", func() float64 {
+		if kvRaft == nil || kvRaft.r.State() != raft.Leader {
+			return 0
+		}
+		return 1
+	})
+	newGaugeFunc("raft_commit_index", "Highest log index known to be committed on this pod.", func() float64 {
+		if kvRaft == nil {
+			return 0
+		}
+		return float64(kvRaft.r.CommitIndex())
+	})
+}
+
+// newRaftNodeFromEnv reads the RAFT_* settings and starts this member;
+// nil unless KV_RAFT=true
+func newRaftNodeFromEnv(appPort string, fsm raft.FSM) (*raftNode, error) {
+	if !getEnvBool("KV_RAFT", false) {
+		return nil, nil
+	}
+	ordinal, ok := statefulSetOrdinal()
+	if !ok {
+		return nil, errors.New("KV_RAFT needs a StatefulSet pod or POD_ORDINAL")
+	}
+	service := getEnv("PEER_SERVICE", "")
+	if service == "" {
+		return nil, errors.New("KV_RAFT needs PEER_SERVICE, the StatefulSet's headless Service")
+	}
+	replicas := int(getEnvInt("RAFT_REPLICAS", 3))
+	if replicas < 1 || ordinal.ordinal >= replicas {
+		return nil, fmt.Errorf("ordinal %d is not a member of RAFT_REPLICAS=%d", ordinal.ordinal, replicas)
+	}
+	raftPort := getEnv("RAFT_PORT", "7000")
+	secret, _ := readSecret("RAFT_SECRET")
+	if secret == "" {
+		return nil, errors.New("KV_RAFT needs RAFT_SECRET, shared by the members to admit each other")
+	}
+	n := &raftNode{
+		id:       ordinal.set + "-" + strconv.Itoa(ordinal.ordinal),
+		appPort:  appPort,
+		stateDir: getEnv("RAFT_STATE_DIR", ""),
+	}
+	n.addr = n.id + "." + service + ":" + raftPort
+	for i := range replicas {
+		id := ordinal.set + "-" + strconv.Itoa(i)
+		n.members.Servers = append(n.members.Servers, raft.Server{
+			Suffrage: raft.Voter, ID: raft.ServerID(id), Address: raft.ServerAddress(id + "." + service + ":" + raftPort)})
+	}
+
+	timeout := getEnvDuration("RAFT_ELECTION_TIMEOUT", 1500*time.Millisecond)
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(n.id)
+	conf.HeartbeatTimeout, conf.ElectionTimeout, conf.LeaderLeaseTimeout = timeout, timeout, timeout/2
+	conf.Logger = hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.LevelFromString(getEnv("RAFT_LOG_LEVEL", "warn")),
+		JSONFormat: true, Output: os.Stdout})
+	if err := raft.ValidateConfig(conf); err != nil {
+		return nil, fmt.Errorf("RAFT_ELECTION_TIMEOUT: %w", err)
+	}
+
+	logs, stable, snaps, err := n.openStores(conf.Logger)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := newRaftStream(":"+raftPort, n.addr, []byte(secret), n.members)
+	if err != nil {
+		return nil, fmt.Errorf("RAFT_PORT: %w", err)
+	}
+	transport := raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+		Stream: stream, MaxPool: 3, Timeout: 10 * time.Second, Logger: conf.Logger})
+
+	if n.r, err = raft.NewRaft(conf, fsm, logs, stable, snaps, transport); err != nil {
+		transport.Close()
+		return nil, err
+	}
+	// Every member bootstraps the same members on its first start; with
+	// state on disk, the log already has them
+	if err := n.r.BootstrapCluster(n.members).Error(); err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+		return nil, fmt.Errorf("raft bootstrap: %w", err)
+	}
+	go n.watchLeader()
+	return n, nil
+}
+
+// openStores returns bolt stores in RAFT_STATE_DIR, or in-memory ones
+func (n *raftNode) openStores(logger hclog.Logger) (raft.LogStore, raft.StableStore, raft.SnapshotStore, error) {
+	if n.stateDir == "" {
+		store := raft.NewInmemStore()
+		return store, store, raft.NewInmemSnapshotStore(), nil
+	}
+	if err := os.MkdirAll(n.stateDir, 0o755); err != nil {
+		return nil, nil, nil, fmt.Errorf("RAFT_STATE_DIR: %w", err)
+	}
+	store, err := openRaftBoltStore(filepath.Join(n.stateDir, "raft.db"))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("RAFT_STATE_DIR: %w", err)
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(n.stateDir, 2, logger)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("RAFT_STATE_DIR: %w", err)
+	}
+	return store, store, snaps, nil
+}
+
+// watchLeader logs and counts leadership changes, with an Event when this
+// pod takes over
+func (n *raftNode) watchLeader() {
+	ch := make(chan raft.Observation, 8)
+	n.r.RegisterObserver(raft.NewObserver(ch, false, func(o *raft.Observation) bool {
+		_, ok := o.Data.(raft.LeaderObservation)
+		return ok
+	}))
+	for o := range ch {
+		leader := o.Data.(raft.LeaderObservation).LeaderID
+		n.mu.Lock()
+		n.lastLeaderChange = time.Now()
+		n.mu.Unlock()
+		term := strconv.FormatUint(n.r.CurrentTerm(), 10)
+		switch leader {
+		case "":
+			raftLeaderChanges.Inc("none")
+			slog.Info("raft leader lost", "term", term)
+		case raft.ServerID(n.id):
+			raftLeaderChanges.Inc("self")
+			slog.Info("raft leader elected", "term", term, "id", n.id)
+			podEvents.Record("Normal", "RaftLeader", "elected leader for term "+term)
+		default:
+			raftLeaderChanges.Inc("other")
+			slog.Info("raft following leader", "term", term, "leader", leader)
+		}
+	}
+}
+
+// Propose replicates one command and waits until it is applied here,
+// returning its log index; errNotLeader on a follower
+func (n *raftNode) Propose(ctx context.Context, cmd []byte) (uint64, error) {
+	timeout := 5 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	f := n.r.Apply(cmd, timeout)
+	if err := f.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) {
+			return 0, errNotLeader
+		}
+		return 0, err
+	}
+	if err, ok := f.Response().(error); ok {
+		return 0, err
+	}
+	return f.Index(), nil
+}
+
+// Leader returns the leader's ID and HTTP address; no address when this
+// pod leads, nothing when there is no leader
+func (n *raftNode) Leader() (id, httpAddr string) {
+	addr, leader := n.r.LeaderWithID()
+	if leader == "" || string(leader) == n.id {
+		return string(leader), ""
+	}
+	host, _, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		return string(leader), ""
+	}
+	return string(leader), net.JoinHostPort(host, n.appPort)
+}
+
+// Status returns this member's view
+func (n *raftNode) Status() RaftStatus {
+	stats := n.r.Stats()
+	stat := func(key string) uint64 {
+		v, _ := strconv.ParseUint(stats[key], 10, 64)
+		return v
+	}
+	_, leader := n.r.LeaderWithID()
+	s := RaftStatus{Enabled: true, ID: n.id, Addr: n.addr, State: strings.ToLower(n.r.State().String()), Term: n.r.CurrentTerm(),
+		Leader: string(leader), CommitIndex: n.r.CommitIndex(), LastApplied: n.r.AppliedIndex(), LastLogIndex: stat("last_log_index"),
+		LastLogTerm: stat("last_log_term"), LastSnapshotIndex: stat("last_snapshot_index"), StateDir: n.stateDir, Peers: []RaftPeer{}}
+	if s.State != "leader" {
+		s.LastContact = stats["last_contact"]
+	}
+	n.mu.Lock()
+	if !n.lastLeaderChange.IsZero() {
+		at := n.lastLeaderChange.UTC()
+		s.LastLeaderChange = &at
+	}
+	n.mu.Unlock()
+
+	members := n.members
+	if f := n.r.GetConfiguration(); f.Error() == nil {
+		members = f.Configuration()
+	}
+	voters := 0
+	for _, m := range members.Servers {
+		if m.Suffrage == raft.Voter {
+			voters++
+		}
+		s.Peers = append(s.Peers, RaftPeer{ID: string(m.ID), Addr: string(m.Address), Self: string(m.ID) == n.id,
+			Leader: m.ID == leader, Suffrage: m.Suffrage.String()})
+	}
+	s.Quorum = voters/2 + 1
+	return s
+}
+
+// Shutdown leaves the group, for the end of serve
+func (n *raftNode) Shutdown() {
+	if err := n.r.Shutdown().Error(); err != nil {
+		slog.Warn("raft shutdown", "error", err)
+	}
+}
+
+// raftStatusHandler serves GET /api/raft/status
+func raftStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if kvRaft == nil {
+		writeJSON(w, http.StatusOK, RaftStatus{Peers: []RaftPeer{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, kvRaft.Status())
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// The connection layer under hashicorp/raft's NetworkTransport. RAFT_PORT
+// admits a connection only from a configured member that proves it holds
+// RAFT_SECRET: the remote IP must be one a member's DNS name resolves to,
+// and the dialer must answer a fresh random challenge with
+// HMAC-SHA256(RAFT_SECRET, challenge). The secret never crosses the wire,
+// and a recorded answer is useless for the next challenge. Anything else
+// is closed before the library reads a byte, and counted in
+// raft_peer_rejected_total.
+//
+// The handshake authenticates, it doesn't encrypt: the kv traffic that
+// follows is plain, like the app port's. A NetworkPolicy on 7000 is the
+// other half of keeping it among the members.
+
+// raftChallengeSize is the challenge's length in bytes
+const raftChallengeSize = 32
+
+// raftHandshakeTimeout bounds the challenge and answer
+const raftHandshakeTimeout = 5 * time.Second
+
+var raftPeerRejected = newCounterVec("raft_peer_rejected_total",
+	"Connections to RAFT_PORT closed before Raft saw them, by reason (not_member, bad_secret, handshake).", "reason")
+
+// raftAddr is a member's address as its peers know it: a stable DNS name,
+// where a TCP listener only knows its IP
+type raftAddr string
+
+func (a raftAddr) Network() string { return "tcp" }
+func (a raftAddr) String() string  { return string(a) }
+
+// raftStream is the transport's StreamLayer: TCP on RAFT_PORT, advertised
+// under the member's DNS name, with each connection authenticated. The
+// handshakes run off the accept loop, so one slow peer delays no other.
+type raftStream struct {
+	ln        net.Listener
+	advertise raftAddr
+	secret    []byte
+	hosts     []string // the members' DNS names
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newRaftStream listens on addr for the members of conf
+func newRaftStream(addr, advertise string, secret []byte, conf raft.Configuration) (*raftStream, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &raftStream{ln: ln, advertise: raftAddr(advertise), secret: secret,
+		conns: make(chan net.Conn), done: make(chan struct{})}
+	for _, m := range conf.Servers {
+		if host, _, err := net.SplitHostPort(string(m.Address)); err == nil {
+			s.hosts = append(s.hosts, host)
+		}
+	}
+	go s.acceptLoop()
+	return s, nil
+}
+
+func (s *raftStream) acceptLoop() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			s.Close()
+			return
+		}
+		go s.admit(conn)
+	}
+}
+
+// admit hands conn to the transport once it passes both checks
+func (s *raftStream) admit(conn net.Conn) {
+	remote, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !s.isMember(remote) {
+		raftPeerRejected.Inc("not_member")
+		slog.Warn("raft connection refused: not a member", "remote", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	if reason, err := s.challenge(conn); err != nil {
+		raftPeerRejected.Inc(reason)
+		slog.Warn("raft connection refused", "remote", conn.RemoteAddr().String(), "reason", reason, "error", err)
+		conn.Close()
+		return
+	}
+	select {
+	case s.conns <- conn:
+	case <-s.done:
+		conn.Close()
+	}
+}
+
+// isMember reports whether ip is one a member's name resolves to now: a
+// rescheduled pod has a new IP under the same name
+func (s *raftStream) isMember(ip string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), raftHandshakeTimeout)
+	defer cancel()
+	for _, host := range s.hosts {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err == nil && slices.Contains(addrs, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge sends a random challenge and checks the answer, returning the
+// reason to count when it fails
+func (s *raftStream) challenge(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(raftHandshakeTimeout))
+	nonce := make([]byte, raftChallengeSize)
+	rand.Read(nonce)
+	if _, err := conn.Write(nonce); err != nil {
+		return "handshake", err
+	}
+	answer := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return "handshake", err
+	}
+	if !hmac.Equal(answer, raftAnswer(s.secret, nonce)) {
+		return "bad_secret", errors.New("wrong answer to the challenge")
+	}
+	return "", conn.SetDeadline(time.Time{})
+}
+
+// raftAnswer is what a member holding secret answers to nonce
+func raftAnswer(secret, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// Dial connects to a member and answers its challenge
+func (s *raftStream) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", string(address), timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(raftHandshakeTimeout))
+	nonce := make([]byte, raftChallengeSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(raftAnswer(s.secret, nonce)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Accept returns the next authenticated connection
+func (s *raftStream) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *raftStream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.ln.Close()
+	})
+	return err
+}
+
+func (s *raftStream) Addr() net.Addr { return s.advertise }
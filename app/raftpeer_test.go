@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// counterValue reads one series of c
+func counterValue(c *counterVec, labelValues ...string) float64 {
+	c.vec.mu.Lock()
+	defer c.vec.mu.Unlock()
+	return c.vec.values[labelKey(c.vec.labels, labelValues)]
+}
+
+// startRaftStream listens on a free loopback port for the given member hosts
+func startRaftStream(t *testing.T, secret string, hosts ...string) *raftStream {
+	t.Helper()
+	var conf raft.Configuration
+	for _, h := range hosts {
+		conf.Servers = append(conf.Servers, raft.Server{Address: raft.ServerAddress(net.JoinHostPort(h, "7000"))})
+	}
+	s, err := newRaftStream("127.0.0.1:0", "kv-0.kv:7000", []byte(secret), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// acceptOne returns the next connection s admits, or nil after a second
+func acceptOne(s *raftStream) net.Conn {
+	select {
+	case conn := <-s.conns:
+		return conn
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+// closedByPeer reports whether the server closes conn without sending more
+func closedByPeer(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(make([]byte, 1))
+	return n == 0 && err == io.EOF
+}
+
+func TestRaftStreamAdmitsMembersWithTheSecret(t *testing.T) {
+	server := startRaftStream(t, "shared secret", "127.0.0.1")
+	client := startRaftStream(t, "shared secret", "127.0.0.1")
+
+	conn, err := client.Dial(raft.ServerAddress(server.ln.Addr().String()), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted := acceptOne(server)
+	if accepted == nil {
+		t.Fatal("the member's connection was not admitted")
+	}
+	defer accepted.Close()
+
+	// After the handshake the stream is Raft's, byte for byte
+	conn.Write([]byte("append entries"))
+	got := make([]byte, len("append entries"))
+	if _, err := io.ReadFull(accepted, got); err != nil || string(got) != "append entries" {
+		t.Errorf("read %q, %v; want the client's bytes", got, err)
+	}
+}
+
+func TestRaftStreamRejectsAWrongSecret(t *testing.T) {
+	server := startRaftStream(t, "shared secret", "127.0.0.1")
+	client := startRaftStream(t, "guessed secret", "127.0.0.1")
+	before := counterValue(raftPeerRejected, "bad_secret")
+
+	conn, err := client.Dial(raft.ServerAddress(server.ln.Addr().String()), time.Second)
+	if err != nil {
+		t.Fatal(err) // the dialer can't tell until the server hangs up
+	}
+	defer conn.Close()
+	if !closedByPeer(t, conn) {
+		t.Error("the server kept a connection with the wrong secret open")
+	}
+	if acceptOne(server) != nil {
+		t.Error("a connection with the wrong secret reached Raft")
+	}
+	if got := counterValue(raftPeerRejected, "bad_secret"); got != before+1 {
+		t.Errorf("raft_peer_rejected_total{reason=bad_secret} = %v, want %v", got, before+1)
+	}
+}
+
+func TestRaftStreamRejectsAReplayedAnswer(t *testing.T) {
+	server := startRaftStream(t, "shared secret", "127.0.0.1")
+	answerTo := func(conn net.Conn) []byte {
+		nonce := make([]byte, raftChallengeSize)
+		if _, err := io.ReadFull(conn, nonce); err != nil {
+			t.Fatal(err)
+		}
+		return nonce
+	}
+
+	first, err := net.Dial("tcp", server.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	nonce := answerTo(first)
+	recorded := raftAnswer([]byte("shared secret"), nonce)
+	first.Write(recorded)
+	if acceptOne(server) == nil {
+		t.Fatal("the genuine answer was not admitted")
+	}
+
+	second, err := net.Dial("tcp", server.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if bytes.Equal(answerTo(second), nonce) {
+		t.Fatal("the server sent the same challenge twice")
+	}
+	second.Write(recorded)
+	if !closedByPeer(t, second) || acceptOne(server) != nil {
+		t.Error("a recorded answer was admitted for a fresh challenge")
+	}
+}
+
+func TestRaftStreamRejectsAShortAnswer(t *testing.T) {
+	server := startRaftStream(t, "shared secret", "127.0.0.1")
+	before := counterValue(raftPeerRejected, "handshake")
+
+	conn, err := net.Dial("tcp", server.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadFull(conn, make([]byte, raftChallengeSize))
+	conn.Write(make([]byte, sha256.Size/2))
+	conn.Close()
+	if acceptOne(server) != nil {
+		t.Error("a half answer was admitted")
+	}
+	if got := counterValue(raftPeerRejected, "handshake"); got != before+1 {
+		t.Errorf("raft_peer_rejected_total{reason=handshake} = %v, want %v", got, before+1)
+	}
+}
+
+func TestRaftStreamRejectsNonMembers(t *testing.T) {
+	// 192.0.2.1 is TEST-NET-1: the only member is somewhere the test isn't
+	server := startRaftStream(t, "shared secret", "192.0.2.1")
+	client := startRaftStream(t, "shared secret", "127.0.0.1")
+	before := counterValue(raftPeerRejected, "not_member")
+
+	conn, err := net.Dial("tcp", server.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Closed before the challenge: not even the secret's holders get one
+	if !closedByPeer(t, conn) {
+		t.Error("a non-member was sent a challenge")
+	}
+	if _, err := client.Dial(raft.ServerAddress(server.ln.Addr().String()), time.Second); err == nil {
+		t.Error("a non-member holding the secret completed the handshake")
+	}
+	if acceptOne(server) != nil {
+		t.Error("a non-member's connection reached Raft")
+	}
+	if got := counterValue(raftPeerRejected, "not_member"); got != before+2 {
+		t.Errorf("raft_peer_rejected_total{reason=not_member} = %v, want %v", got, before+2)
+	}
+}
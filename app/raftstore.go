@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/raft"
+	bolt "go.etcd.io/bbolt"
+)
+
+// raftBoltStore keeps the Raft log and the term and vote in one bbolt
+// file under RAFT_STATE_DIR: hashicorp/raft's LogStore and StableStore,
+// the same shape as raft-boltdb. Entries are keyed by their index,
+// big-endian so the keys sort in log order, and stored as JSON.
+
+var (
+	raftLogsBucket = []byte("logs")
+	raftConfBucket = []byte("conf")
+
+	// errRaftKeyNotFound is what hashicorp/raft expects, by its text, for a
+	// key never set
+	errRaftKeyNotFound = errors.New("not found")
+)
+
+type raftBoltStore struct {
+	db *bolt.DB
+}
+
+// openRaftBoltStore opens or creates the file at path
+func openRaftBoltStore(path string) (*raftBoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{raftLogsBucket, raftConfBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &raftBoltStore{db: db}, nil
+}
+
+func raftIndexKey(index uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, index)
+}
+
+// FirstIndex is the oldest index kept, 0 for an empty log
+func (s *raftBoltStore) FirstIndex() (uint64, error) {
+	return s.edgeIndex(false)
+}
+
+// LastIndex is the newest index, 0 for an empty log
+func (s *raftBoltStore) LastIndex() (uint64, error) {
+	return s.edgeIndex(true)
+}
+
+func (s *raftBoltStore) edgeIndex(last bool) (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(raftLogsBucket).Cursor()
+		k, _ := c.First()
+		if last {
+			k, _ = c.Last()
+		}
+		if k != nil {
+			index = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// GetLog reads the entry at index into log
+func (s *raftBoltStore) GetLog(index uint64, log *raft.Log) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(raftLogsBucket).Get(raftIndexKey(index))
+		if v == nil {
+			return raft.ErrLogNotFound
+		}
+		return json.Unmarshal(v, log)
+	})
+}
+
+// StoreLog appends one entry
+func (s *raftBoltStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs appends entries in one transaction
+func (s *raftBoltStore) StoreLogs(logs []*raft.Log) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(raftLogsBucket)
+		for _, log := range logs {
+			v, err := json.Marshal(log)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(raftIndexKey(log.Index), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteRange removes the entries from min to max, both included: the
+// library compacts after a snapshot and truncates a conflicting tail
+func (s *raftBoltStore) DeleteRange(min, max uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(raftLogsBucket).Cursor()
+		for k, _ := c.Seek(raftIndexKey(min)); k != nil && binary.BigEndian.Uint64(k) <= max; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Set stores a value of the library's own, the term or the vote
+func (s *raftBoltStore) Set(key, val []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(raftConfBucket).Put(key, val)
+	})
+}
+
+// Get returns what Set stored, or errRaftKeyNotFound
+func (s *raftBoltStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(raftConfBucket).Get(key)
+		if v == nil {
+			return errRaftKeyNotFound
+		}
+		val = append([]byte(nil), v...)
+		return nil
+	})
+	return val, err
+}
+
+func (s *raftBoltStore) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, binary.BigEndian.AppendUint64(nil, val))
+}
+
+func (s *raftBoltStore) GetUint64(key []byte) (uint64, error) {
+	v, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token-bucket rate limiting, off unless a rate is set:
+//
+//	RATE_LIMIT_RPS=100 RATE_LIMIT_BURST=200                 all clients together
+//	RATE_LIMIT_CLIENT_RPS=5 RATE_LIMIT_CLIENT_BURST=10      each client IP
+//	RATE_LIMIT_TRUST_FORWARDED=true                         key clients by X-Forwarded-For
+//	RATE_LIMIT_TENANT_RPS=20 RATE_LIMIT_TENANT_BURST=40     each tenant (TENANT_MODE)
+//
+// Behind an Ingress or a Service every request comes from the proxy's IP,
+// so per-client limits only make sense with RATE_LIMIT_TRUST_FORWARDED -
+// and only when the proxy sets the header, since clients can send their
+// own. Limits are per pod: three replicas at 100 rps let 300 rps through,
+// which is the main difference from nginx-ingress's limit-rps annotation.
+// Rejected requests get a 429 with Retry-After. With TENANT_MODE a client's
+// bucket is per tenant too, so the same IP calling as two tenants has two.
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// take spends a token, or reports how long until one is available
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	ok, wait := b.ready(now)
+	if ok {
+		b.tokens--
+	}
+	return ok, wait
+}
+
+// ready reports whether a token is available without spending it, or how
+// long until one is
+func (b *tokenBucket) ready(now time.Time) (bool, time.Duration) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled, i.e. forgetting it changes nothing
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// rateLimiter holds the global bucket and one bucket per client and per tenant
+type rateLimiter struct {
+	mu             sync.Mutex
+	global         *tokenBucket // nil when there is no global limit
+	clients        map[string]*tokenBucket
+	clientRate     float64 // 0 when there is no per-client limit
+	clientBurst    float64
+	tenants        map[string]*tokenBucket
+	tenantRate     float64 // 0 when there is no per-tenant limit
+	tenantBurst    float64
+	trustForwarded bool
+}
+
+// limiter is set in main when rate limiting is configured
+var limiter *rateLimiter
+
+var (
+	rateLimited = newCounterVec("http_rate_limited_total",
+		"Requests rejected with 429, by the limit that was hit.", "scope")
+	rateLimitAllowed = newCounterVec("http_rate_limit_allowed_total",
+		"Requests that passed the rate limiter.")
+)
+
+func init() {
+	newGaugeFunc("http_rate_limit_clients", "Clients with a per-client token bucket.",
+		func() float64 {
+			if limiter == nil {
+				return 0
+			}
+			limiter.mu.Lock()
+			defer limiter.mu.Unlock()
+			return float64(len(limiter.clients))
+		})
+}
+
+// newRateLimiterFromEnv returns nil when no limit is configured
+func newRateLimiterFromEnv() *rateLimiter {
+	rps, clientRPS := getEnvFloat("RATE_LIMIT_RPS", 0), getEnvFloat("RATE_LIMIT_CLIENT_RPS", 0)
+	tenantRPS := getEnvFloat("RATE_LIMIT_TENANT_RPS", 0)
+	if rps <= 0 && clientRPS <= 0 && tenantRPS <= 0 {
+		return nil
+	}
+	l := &rateLimiter{
+		clients:        map[string]*tokenBucket{},
+		clientRate:     max(clientRPS, 0),
+		clientBurst:    max(getEnvFloat("RATE_LIMIT_CLIENT_BURST", math.Ceil(clientRPS)), 1),
+		tenants:        map[string]*tokenBucket{},
+		tenantRate:     max(tenantRPS, 0),
+		tenantBurst:    max(getEnvFloat("RATE_LIMIT_TENANT_BURST", math.Ceil(tenantRPS)), 1),
+		trustForwarded: getEnvBool("RATE_LIMIT_TRUST_FORWARDED", false),
+	}
+	if rps > 0 {
+		l.global = newTokenBucket(rps, max(getEnvFloat("RATE_LIMIT_BURST", math.Ceil(rps)), 1), time.Now())
+	}
+	return l
+}
+
+// allow checks the client's bucket, then the tenant's, then the global one.
+// A client over its own limit doesn't spend the others' tokens, so it can't
+// starve everyone else, and neither can a tenant. tenant is "" without
+// TENANT_MODE.
+func (l *rateLimiter) allow(client, tenant string) (ok bool, scope string, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.clientRate > 0 {
+		b, found := l.clients[client]
+		if !found {
+			b = newTokenBucket(l.clientRate, l.clientBurst, now)
+			l.clients[client] = b
+		}
+		if ok, wait := b.take(now); !ok {
+			return false, "client", wait
+		}
+	}
+	if l.tenantRate > 0 && tenant != "" {
+		b, found := l.tenants[tenant]
+		if !found {
+			b = newTokenBucket(l.tenantRate, l.tenantBurst, now)
+			l.tenants[tenant] = b
+		}
+		if ok, wait := b.take(now); !ok {
+			return false, "tenant", wait
+		}
+	}
+	if l.global != nil {
+		if ok, wait := l.global.take(now); !ok {
+			return false, "global", wait
+		}
+	}
+	return true, "", 0
+}
+
+// sweep forgets clients and tenants whose buckets have refilled, so the maps
+// don't grow with every IP that ever called
+func (l *rateLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, buckets := range []map[string]*tokenBucket{l.clients, l.tenants} {
+		for key, b := range buckets {
+			if b.full(now) {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+func (l *rateLimiter) sweepEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.sweep()
+	}
+}
+
+// clientKey is the client IP: the first X-Forwarded-For hop when trusted,
+// else the connection's remote address. With TENANT_MODE it is prefixed
+// with the tenant.
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	host := r.RemoteAddr
+	if xff := r.Header.Get("X-Forwarded-For"); l.trustForwarded && xff != "" {
+		first, _, _ := strings.Cut(xff, ",")
+		host = strings.TrimSpace(first)
+	} else if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		host = h
+	}
+	if tenant := tenantFromContext(r.Context()); tenant != "" {
+		return tenant + "/" + host
+	}
+	return host
+}
+
+// rateLimitExempt are routes never limited: kubelet probes, preStop hooks
+// on /admin/ and Prometheus scrapes must get through however busy the pod
+// is. Wrong admin passwords are throttled by basic auth instead.
+func rateLimitExempt(pattern string) bool {
+	switch pattern {
+	case "/health", "/ready", "/metrics":
+		return true
+	}
+	return strings.HasPrefix(pattern, "/admin/") || strings.HasPrefix(pattern, "/debug/")
+}
+
+// rateLimit answers 429 once the client's or the global bucket is empty
+func rateLimit(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if rateLimitExempt(pattern) {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limiter == nil {
+			next(w, r)
+			return
+		}
+		ok, scope, retryAfter := limiter.allow(limiter.clientKey(r), tenantFromContext(r.Context()))
+		if !ok {
+			rateLimited.Inc(scope)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeProblem(w, r, http.StatusTooManyRequests, "rate limit exceeded ("+scope+")")
+			return
+		}
+		rateLimitAllowed.Inc()
+		next(w, r)
+	}
+}
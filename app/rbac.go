@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// /api/rbac/can-i is kubectl auth can-i from inside the pod: it asks the
+// API server, with the pod's own service account token, whether that
+// account may do something:
+//
+//	curl 'localhost:8080/api/rbac/can-i?verb=list&resource=pods'
+//	curl 'localhost:8080/api/rbac/can-i?verb=update&resource=leases.coordination.k8s.io'
+//	curl 'localhost:8080/api/rbac/can-i?verb=get&resource=pods/log&namespace=kube-system'
+//
+// Edit the Role in k8s/advanced/rbac.yaml, kubectl apply it, and the next
+// answer changes: RBAC is evaluated on every request, with no restart. The
+// check is a SelfSubjectAccessReview, which every authenticated account may
+// create (the built-in system:basic-user ClusterRole), so it needs no
+// permission of its own.
+
+// selfSubjectAccessReview is the subset of an authorization.k8s.io/v1
+// SelfSubjectAccessReview the app sends and reads
+type selfSubjectAccessReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		ResourceAttributes *resourceAttributes `json:"resourceAttributes"`
+	} `json:"spec"`
+	Status struct {
+		Allowed         bool   `json:"allowed"`
+		Reason          string `json:"reason"`
+		EvaluationError string `json:"evaluationError"`
+	} `json:"status"`
+}
+
+// resourceAttributes is what the review asks about
+type resourceAttributes struct {
+	Namespace   string `json:"namespace,omitempty"`
+	Verb        string `json:"verb"`
+	Group       string `json:"group"`
+	Resource    string `json:"resource"`
+	Subresource string `json:"subresource,omitempty"`
+	Name        string `json:"name,omitempty"`
+}
+
+// CanIResponse is returned by /api/rbac/can-i
+type CanIResponse struct {
+	Allowed         bool   `json:"allowed"`
+	Verb            string `json:"verb"`
+	Group           string `json:"group,omitempty"`
+	Resource        string `json:"resource"`
+	Subresource     string `json:"subresource,omitempty"`
+	Name            string `json:"name,omitempty"`
+	Namespace       string `json:"namespace,omitempty"`
+	ServiceAccount  string `json:"service_account,omitempty"`
+	Reason          string `json:"reason,omitempty"` // usually which RoleBinding allowed it
+	EvaluationError string `json:"evaluation_error,omitempty"`
+	Kubectl         string `json:"kubectl"` // the same check from a workstation
+}
+
+// parseResource splits kubectl's resource syntax: "deployments.apps" has
+// group apps, "pods/log" is the log subresource of pods
+func parseResource(s string) (resource, group, subresource string) {
+	resource, subresource, _ = strings.Cut(s, "/")
+	resource, group, _ = strings.Cut(resource, ".")
+	return resource, group, subresource
+}
+
+// canIHandler serves GET /api/rbac/can-i?verb=&resource=&namespace=&name=
+func canIHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	q := r.URL.Query()
+	verb, resourceArg := q.Get("verb"), q.Get("resource")
+	if verb == "" || resourceArg == "" {
+		writeProblem(w, r, http.StatusBadRequest, "verb and resource are required, e.g. ?verb=list&resource=pods")
+		return
+	}
+	kube, err := inClusterKube()
+	if err != nil {
+		writeProblem(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	attrs := &resourceAttributes{Verb: verb, Name: q.Get("name"), Namespace: q.Get("namespace")}
+	attrs.Resource, attrs.Group, attrs.Subresource = parseResource(resourceArg)
+	if attrs.Namespace == "" {
+		attrs.Namespace = kube.namespace
+	}
+	if attrs.Namespace == "*" {
+		attrs.Namespace = "" // all namespaces, like kubectl auth can-i -A
+	}
+	review := selfSubjectAccessReview{APIVersion: "authorization.k8s.io/v1", Kind: "SelfSubjectAccessReview"}
+	review.Spec.ResourceAttributes = attrs
+	if err := kube.Do(r.Context(), http.MethodPost, "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews", review, &review); err != nil {
+		writeProblem(w, r, http.StatusBadGateway, "SelfSubjectAccessReview: "+err.Error())
+		return
+	}
+
+	resp := CanIResponse{
+		Allowed:         review.Status.Allowed,
+		Verb:            verb,
+		Group:           attrs.Group,
+		Resource:        attrs.Resource,
+		Subresource:     attrs.Subresource,
+		Name:            attrs.Name,
+		Namespace:       attrs.Namespace,
+		Reason:          review.Status.Reason,
+		EvaluationError: review.Status.EvaluationError,
+	}
+	kubectl := "kubectl auth can-i " + verb + " " + resourceArg
+	if attrs.Name != "" {
+		kubectl += " " + attrs.Name
+	}
+	if attrs.Namespace == "" {
+		kubectl += " -A"
+	} else {
+		kubectl += " -n " + attrs.Namespace
+	}
+	if sa := getEnv("POD_SERVICE_ACCOUNT", ""); sa != "" {
+		resp.ServiceAccount = sa
+		kubectl += " --as=system:serviceaccount:" + kube.namespace + ":" + sa
+	}
+	resp.Kubectl = kubectl
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadinessChecker is a dependency that must be reachable before this pod
+// should receive traffic. Liveness never runs these: a database outage
+// should take pods out of the Service, not restart them all.
+type ReadinessChecker interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+// checkResult is the outcome of one readiness check
+type checkResult struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// readinessRegistry holds the checks run by /ready
+type readinessRegistry struct {
+	mu       sync.RWMutex
+	checkers []ReadinessChecker
+}
+
+// readinessChecks is the process-wide registry
+var readinessChecks = &readinessRegistry{}
+
+// checkTimeout bounds each check so one slow dependency can't stall the probe
+const checkTimeout = 2 * time.Second
+
+// Register adds a check
+func (rr *readinessRegistry) Register(c ReadinessChecker) {
+	rr.mu.Lock()
+	rr.checkers = append(rr.checkers, c)
+	rr.mu.Unlock()
+}
+
+// Run executes all checks concurrently and reports whether all passed
+func (rr *readinessRegistry) Run(ctx context.Context) ([]checkResult, bool) {
+	rr.mu.RLock()
+	checkers := append([]ReadinessChecker(nil), rr.checkers...)
+	rr.mu.RUnlock()
+
+	results := make([]checkResult, len(checkers))
+	var wg sync.WaitGroup
+	for i, c := range checkers {
+		wg.Add(1)
+		go func(i int, c ReadinessChecker) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := c.Check(ctx)
+			results[i] = checkResult{
+				Name:      c.Name(),
+				Status:    "ok",
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				results[i].Status = "failed"
+				results[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	healthy := true
+	for _, res := range results {
+		if res.Status != "ok" {
+			healthy = false
+		}
+	}
+	return results, healthy
+}
+
+// tcpCheck passes when a TCP connection can be opened
+type tcpCheck struct{ addr string }
+
+func (c tcpCheck) Name() string { return "tcp:" + c.addr }
+
+func (c tcpCheck) Check(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// httpCheck passes when a GET returns a 2xx/3xx status
+type httpCheck struct{ url string }
+
+func (c httpCheck) Name() string { return "http:" + c.url }
+
+func (c httpCheck) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// redisCheck sends PING
+type redisCheck struct{ client *redisClient }
+
+func (c redisCheck) Name() string { return "redis:" + c.client.addr }
+
+func (c redisCheck) Check(ctx context.Context) error { return c.client.Ping(ctx) }
+
+// postgresCheck verifies a PostgreSQL server is answering the wire
+// protocol, without needing credentials: it sends an SSLRequest, which every
+// server answers with a single 'S' or 'N' byte before authentication.
+type postgresCheck struct{ addr string }
+
+func (c postgresCheck) Name() string { return "postgres:" + c.addr }
+
+func (c postgresCheck) Check(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Length 8, then the SSLRequest code 80877103
+	if _, err := conn.Write([]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}); err != nil {
+		return err
+	}
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 'S' && reply[0] != 'N' {
+		return errors.New("unexpected reply, not a PostgreSQL server?")
+	}
+	return nil
+}
+
+// fileCheck passes once a file exists, such as the marker an init
+// container or sidecar writes into a shared volume
+type fileCheck struct{ path string }
+
+func (c fileCheck) Name() string { return "file:" + c.path }
+
+func (c fileCheck) Check(ctx context.Context) error {
+	if _, err := os.Stat(c.path); err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("not created yet")
+		}
+		return err
+	}
+	return nil
+}
+
+// registerReadinessChecksFromEnv enables checks from comma-separated env vars:
+// READY_CHECK_TCP (host:port), READY_CHECK_HTTP (URLs),
+// READY_CHECK_REDIS (host:port), READY_CHECK_POSTGRES (host:port) and
+// READY_CHECK_FILE (paths)
+func registerReadinessChecksFromEnv() {
+	for _, addr := range splitList(getEnv("READY_CHECK_TCP", "")) {
+		readinessChecks.Register(tcpCheck{addr: addr})
+	}
+	for _, url := range splitList(getEnv("READY_CHECK_HTTP", "")) {
+		readinessChecks.Register(httpCheck{url: url})
+	}
+	for _, addr := range splitList(getEnv("READY_CHECK_REDIS", "")) {
+		readinessChecks.Register(redisCheck{client: newRedisClient(addr)})
+	}
+	for _, addr := range splitList(getEnv("READY_CHECK_POSTGRES", "")) {
+		readinessChecks.Register(postgresCheck{addr: addr})
+	}
+	for _, path := range splitList(getEnv("READY_CHECK_FILE", "")) {
+		readinessChecks.Register(fileCheck{path: path})
+	}
+
+	readinessChecks.mu.RLock()
+	for _, c := range readinessChecks.checkers {
+		slog.Info("readiness check enabled", "check", c.Name())
+	}
+	readinessChecks.mu.RUnlock()
+}
+
+// splitList splits a comma-separated env value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisClient is a deliberately tiny Redis client speaking RESP over TCP.
+// It dials a fresh connection per command, which keeps it simple and makes
+// Redis outages show up immediately instead of being hidden by a pool.
+type redisClient struct {
+	addr    string
+	timeout time.Duration
+}
+
+// newRedisClient creates a client for the Redis server at addr
+func newRedisClient(addr string) *redisClient {
+	return &redisClient{addr: addr, timeout: 2 * time.Second}
+}
+
+// Do sends a single command and returns the parsed reply
+func (c *redisClient) Do(ctx context.Context, args ...string) (reply interface{}, err error) {
+	ctx, s := startSpan(ctx, "redis "+args[0], spanKindClient)
+	s.SetAttr("db.system", "redis")
+	s.SetAttr("server.address", c.addr)
+	defer func() {
+		if err != nil {
+			s.SetError(err)
+		}
+		s.End()
+	}()
+
+	conn, r, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(encodeRESP(args)); err != nil {
+		return nil, fmt.Errorf("redis write: %w", err)
+	}
+	return readRESP(r)
+}
+
+// dial connects and, when redisCredentials has a password, authenticates
+func (c *redisClient) dial(ctx context.Context) (net.Conn, *bufio.Reader, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("redis dial %s: %w", c.addr, err)
+	}
+	r := bufio.NewReader(conn)
+	user, password := redisCredentials.credentials()
+	if password == "" {
+		return conn, r, nil
+	}
+	auth := []string{"AUTH", password}
+	if user != "" {
+		auth = []string{"AUTH", user, password} // an ACL user, as Vault creates
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err = conn.Write(encodeRESP(auth)); err == nil {
+		_, err = readRESP(r)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("redis AUTH: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+// Incr increments key and returns the new value
+func (c *redisClient) Incr(ctx context.Context, key string) (int64, error) {
+	reply, err := c.Do(ctx, "INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis INCR: unexpected reply %v", reply)
+	}
+	return n, nil
+}
+
+// GetInt returns the integer stored at key, or 0 when it does not exist
+func (c *redisClient) GetInt(ctx context.Context, key string) (int64, error) {
+	reply, err := c.Do(ctx, "GET", key)
+	if err != nil || reply == nil {
+		return 0, err
+	}
+	s, ok := reply.(string)
+	if !ok {
+		return 0, fmt.Errorf("redis GET: unexpected reply %v", reply)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// Ping checks that the server is reachable and answering
+func (c *redisClient) Ping(ctx context.Context) error {
+	reply, err := c.Do(ctx, "PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("redis PING: unexpected reply %v", reply)
+	}
+	return nil
+}
+
+// Subscribe holds a connection subscribed to channel and calls handle with
+// every message published there, until ctx ends. A subscribed connection
+// can't run other commands, so this is the one long-lived connection the
+// client makes; it redials with backoff and reports each change in
+// connectivity through connected.
+func (c *redisClient) Subscribe(ctx context.Context, channel string, handle func(data []byte), connected func(bool)) {
+	for attempt := 0; ctx.Err() == nil; attempt++ {
+		err := c.subscribeOnce(ctx, channel, handle, func() {
+			attempt = 0
+			connected(true)
+		})
+		connected(false)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("redis subscription lost, reconnecting", "channel", channel, "error", err)
+		select {
+		case <-time.After(backoff(attempt, 500*time.Millisecond, 30*time.Second)):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (c *redisClient) subscribeOnce(ctx context.Context, channel string, handle func([]byte), subscribed func()) error {
+	conn, r, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if _, err := conn.Write(encodeRESP([]string{"SUBSCRIBE", channel})); err != nil {
+		return fmt.Errorf("redis write: %w", err)
+	}
+	for {
+		reply, err := readRESP(r)
+		if err != nil {
+			return err
+		}
+		// ["subscribe", channel, count] once, then ["message", channel, data]
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 {
+			return fmt.Errorf("redis SUBSCRIBE: unexpected reply %v", reply)
+		}
+		switch items[0] {
+		case "subscribe":
+			subscribed()
+		case "message":
+			if data, ok := items[2].(string); ok {
+				handle([]byte(data))
+			}
+		}
+	}
+}
+
+// encodeRESP encodes a command as a RESP array of bulk strings
+func encodeRESP(args []string) []byte {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
+
+// readRESP parses one RESP reply: simple strings, errors, integers,
+// bulk strings (nil-able) and arrays
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis read: %w", err)
+	}
+	if len(line) < 3 {
+		return nil, errors.New("redis read: short reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis error: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("redis read: %w", err)
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis read: unknown reply type %q", line[0])
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Self-registration with a Consul-style service registry, for the callers
+// that don't live in the cluster and can't read Endpoints: the pod
+// registers itself on startup, keeps a TTL check passing while it is ready,
+// and deregisters when it is told to stop:
+//
+//	REGISTRY_URL=http://consul:8500 REGISTRY_SERVICE=go-app REGISTRY_TTL=15s
+//	curl localhost:30080/api/registration
+//	curl consul:8500/v1/health/service/go-app?passing
+//
+// The heartbeat goes every REGISTRY_TTL/3 and reports what /ready would: a
+// pod failing readiness, drained or shutting down fails its check, so the
+// registry stops handing it out just as the Service's endpoints do.
+// Deregistration happens first on SIGTERM, before the shutdown delay, so
+// the registry is not behind kube-proxy. A pod that is SIGKILLed or whose
+// node vanishes never deregisters: its check goes critical after one TTL
+// and the registry removes it REGISTRY_DEREGISTER_AFTER (1m) later, which
+// is the gap Kubernetes closes by owning the Endpoints itself.
+
+// RegistrationResponse is returned by /api/registration
+type RegistrationResponse struct {
+	Enabled       bool       `json:"enabled"`
+	Registry      string     `json:"registry,omitempty"`
+	Service       string     `json:"service,omitempty"`
+	ServiceID     string     `json:"service_id,omitempty"`
+	Address       string     `json:"address,omitempty"`
+	Port          int        `json:"port,omitempty"`
+	TTL           string     `json:"ttl,omitempty"`
+	State         string     `json:"state"`           // disabled, registering, registered or deregistered
+	Check         string     `json:"check,omitempty"` // passing or critical, as last reported
+	RegisteredAt  *time.Time `json:"registered_at,omitempty"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	Heartbeats    int64      `json:"heartbeats"`
+	Failures      int64      `json:"failures"` // registry calls that failed
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// serviceRegistration keeps this pod registered with REGISTRY_URL
+type serviceRegistration struct {
+	base            *url.URL
+	token           string
+	service         string
+	id              string
+	address         string
+	port            int
+	ttl             time.Duration
+	deregisterAfter time.Duration
+	client          *http.Client
+
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu     sync.Mutex
+	status RegistrationResponse
+}
+
+// registration is set in main when REGISTRY_URL is
+var registration *serviceRegistration
+
+var registryCalls = newCounterVec("registry_calls_total",
+	"Calls to the service registry, by operation (register, pass, fail, deregister) and result (ok, error).", "op", "result")
+
+// newServiceRegistrationFromEnv returns nil when REGISTRY_URL is unset
+func newServiceRegistrationFromEnv(appName, port string) (*serviceRegistration, error) {
+	raw := getEnv("REGISTRY_URL", "")
+	if raw == "" {
+		return nil, nil
+	}
+	base, err := url.Parse(raw)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("REGISTRY_URL %q is not an http(s) URL", raw)
+	}
+	p, err := strconv.Atoi(getEnv("REGISTRY_PORT", port))
+	if err != nil || p <= 0 || p > 65535 {
+		return nil, fmt.Errorf("REGISTRY_PORT must be a port number")
+	}
+	hostname, _ := os.Hostname()
+	s := &serviceRegistration{
+		base:            base,
+		token:           getEnv("REGISTRY_TOKEN", ""),
+		service:         getEnv("REGISTRY_SERVICE", appName),
+		address:         getEnv("POD_IP", hostname),
+		port:            p,
+		ttl:             getEnvDuration("REGISTRY_TTL", 15*time.Second),
+		deregisterAfter: getEnvDuration("REGISTRY_DEREGISTER_AFTER", time.Minute),
+		stop:            make(chan struct{}),
+	}
+	if !validTenant.MatchString(s.service) {
+		return nil, fmt.Errorf("REGISTRY_SERVICE %q must be a DNS label", s.service)
+	}
+	if s.ttl < 3*time.Second {
+		return nil, fmt.Errorf("REGISTRY_TTL must be at least 3s, got %s", s.ttl)
+	}
+	s.id = s.service + "-" + hostname
+	s.client = &http.Client{Transport: tracingTransport{base: http.DefaultTransport}, Timeout: 5 * time.Second}
+	s.status = RegistrationResponse{Enabled: true, Registry: base.Redacted(), Service: s.service, ServiceID: s.id,
+		Address: s.address, Port: s.port, TTL: s.ttl.String(), State: "registering"}
+	newGaugeFunc("registry_registered", "1 while this pod is registered with REGISTRY_URL.", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.status.State == "registered" {
+			return 1
+		}
+		return 0
+	})
+	return s, nil
+}
+
+// run registers, retrying with backoff, then heartbeats every TTL/3 until
+// deregister is called
+func (s *serviceRegistration) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.stop
+		cancel()
+	}()
+
+	for backoff := time.Second; !s.register(ctx); backoff = min(backoff*2, 30*time.Second) {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+	}
+	ticker := time.NewTicker(s.ttl / 3)
+	defer ticker.Stop()
+	for {
+		s.heartbeat(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// register puts the service and its TTL check in the registry
+func (s *serviceRegistration) register(ctx context.Context) bool {
+	meta := map[string]string{"pod": s.id, "version": buildInfo().Version, "track": deploymentTrack()}
+	if node := getEnv("NODE_NAME", ""); node != "" {
+		meta["node"] = node
+	}
+	body, _ := json.Marshal(map[string]any{
+		"ID":      s.id,
+		"Name":    s.service,
+		"Address": s.address,
+		"Port":    s.port,
+		"Tags":    []string{deploymentTrack(), "version-" + buildInfo().Version},
+		"Meta":    meta,
+		"Check": map[string]string{
+			"CheckID":                        s.checkID(),
+			"Name":                           "go-app readiness",
+			"TTL":                            s.ttl.String(),
+			"DeregisterCriticalServiceAfter": s.deregisterAfter.String(),
+		},
+	})
+	if _, err := s.call(ctx, "register", "/v1/agent/service/register", body); err != nil {
+		slog.Warn("service registration failed, retrying", "registry", s.base.Host, "service", s.service, "error", err)
+		return false
+	}
+	now := time.Now().UTC()
+	s.mu.Lock()
+	if s.status.State == "deregistered" {
+		// deregister ran while this was in flight
+		s.mu.Unlock()
+		return true
+	}
+	s.status.State, s.status.RegisteredAt = "registered", &now
+	s.mu.Unlock()
+	slog.Info("registered with service registry", "registry", s.base.Host, "service", s.service, "id", s.id,
+		"address", s.address, "port", s.port)
+	return true
+}
+
+// heartbeat reports the pod's readiness as the TTL check's state; a
+// registry that has forgotten the check (an agent restart) gets the
+// service registered again
+func (s *serviceRegistration) heartbeat(ctx context.Context) {
+	op, note := "pass", "ready"
+	if reason := s.notReady(ctx); reason != "" {
+		op, note = "fail", reason
+	}
+	code, err := s.call(ctx, op, "/v1/agent/check/"+op+"/"+url.PathEscape(s.checkID())+"?note="+url.QueryEscape(note), nil)
+	if code == http.StatusNotFound {
+		slog.Warn("registry lost the service, registering again", "registry", s.base.Host, "id", s.id)
+		s.register(ctx)
+		return
+	}
+	if err != nil {
+		slog.Warn("registry heartbeat failed", "registry", s.base.Host, "id", s.id, "error", err)
+		return
+	}
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Heartbeats++
+	s.status.LastHeartbeat = &now
+	if s.status.Check = "passing"; op == "fail" {
+		s.status.Check = "critical"
+	}
+}
+
+// notReady is why /ready would fail, or "" when it wouldn't
+func (s *serviceRegistration) notReady(ctx context.Context) string {
+	switch {
+	case !readyOverride.status().Enabled:
+		return "disabled via /admin/ready/disable"
+	case drainer.Draining():
+		return "draining via /admin/drain"
+	case !started.Load():
+		return "starting up"
+	case !ready.Load():
+		return "shutting down"
+	}
+	if _, ok := readinessChecks.Run(ctx); !ok {
+		return "dependency check failed"
+	}
+	return ""
+}
+
+// deregister stops the heartbeat and removes the service; safe to call
+// more than once and on nil
+func (s *serviceRegistration) deregister() {
+	if s == nil {
+		return
+	}
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.mu.Lock()
+		registered := s.status.State == "registered"
+		s.status.State = "deregistered"
+		s.mu.Unlock()
+		if !registered {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if _, err := s.call(ctx, "deregister", "/v1/agent/service/deregister/"+url.PathEscape(s.id), nil); err != nil {
+			slog.Warn("service deregistration failed; the registry drops the service once its check is critical",
+				"registry", s.base.Host, "id", s.id, "after", (s.ttl + s.deregisterAfter).String(), "error", err)
+			return
+		}
+		slog.Info("deregistered from service registry", "registry", s.base.Host, "id", s.id)
+	})
+}
+
+func (s *serviceRegistration) checkID() string {
+	return "service:" + s.id
+}
+
+// call PUTs body to the registry's path, returning the status it answered
+func (s *serviceRegistration) call(ctx context.Context, op, path string, body []byte) (int, error) {
+	target := strings.TrimSuffix(s.base.String(), "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(body))
+	code := 0
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		if s.token != "" {
+			req.Header.Set("X-Consul-Token", s.token)
+		}
+		var res *http.Response
+		if res, err = s.client.Do(req); err == nil {
+			msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+			res.Body.Close()
+			if code = res.StatusCode; code/100 != 2 {
+				err = fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+			}
+		}
+	}
+	if err != nil {
+		registryCalls.Inc(op, "error")
+		s.mu.Lock()
+		s.status.Failures++
+		s.status.LastError = op + ": " + err.Error()
+		s.mu.Unlock()
+		return code, err
+	}
+	registryCalls.Inc(op, "ok")
+	return code, nil
+}
+
+// registrationHandler serves GET /api/registration
+func registrationHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	resp := RegistrationResponse{State: "disabled"}
+	if s := registration; s != nil {
+		s.mu.Lock()
+		resp = s.status
+		s.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// In-place reload without dropping a connection, to compare with what a
+// rolling update does across pods:
+//
+//	HOT_RELOAD=true                 SIGUSR2 starts the next generation
+//	RELOAD_TIMEOUT=30s              how long it may take to become ready
+//	kubectl exec <pod> -- kill -USR2 1
+//	while sleep 0.2; do curl -s go-app-service/api/info | jq -c '{hostname, generation}'; done
+//
+// On SIGUSR2 the process starts its own binary again and passes it the
+// listening sockets (one per LISTEN_ADDR) from file descriptor 3 on, so the
+// new process accepts from the same sockets and their queues: not one
+// connection is refused. Once the
+// successor is ready (startup and any warm-up done) the old generation
+// stops accepting and drains like on SIGTERM, without SHUTDOWN_DELAY, as no
+// endpoint has to be removed first. The admin, gRPC, echo and HTTP/3 ports
+// aren't handed over; with HOT_RELOAD they are opened with SO_REUSEPORT, so
+// the successor binds them too and the kernel spreads connections between
+// the two generations until the old one closes its copies.
+//
+// The container lives as long as PID 1, so a PID 1 that has handed off
+// stays on as a supervisor: it keeps the sockets for later generations,
+// forwards signals to the current one, starts the next on SIGUSR2 (the
+// current one passes its own SIGUSR2 up), and exits with the last
+// generation's exit code. Outside a container the old process just exits.
+// Unlike a rolling update nothing reschedules, pulls an image or drops out
+// of the Endpoints - and nothing protects the pod if the new binary is bad,
+// beyond the successor having to get ready before it takes over.
+
+var (
+	hotReload = sync.OnceValue(func() bool { return getEnvBool("HOT_RELOAD", false) })
+
+	// reloadGeneration is 1 for the process the container started, and one
+	// more for each successor
+	reloadGeneration = sync.OnceValue(func() int {
+		n, _ := strconv.Atoi(os.Getenv("RELOAD_GENERATION"))
+		return max(n, 1)
+	})
+
+	// mainListeners are the sockets handed to a successor
+	mainListeners []*net.TCPListener
+
+	// listenerHandedOff is closed once a successor has taken the sockets;
+	// successor is that process
+	listenerHandedOff = make(chan struct{})
+	successor         *os.Process
+	successorSockets  []*os.File
+
+	reloadHandoffs = newCounterVec("reload_handoffs_total",
+		"SIGUSR2 reloads by result (ok, failed).", "result")
+)
+
+// listenMain opens the main port's addresses, or takes the sockets a
+// previous generation passed down
+func listenMain(addrs []listenAddr) (net.Listener, error) {
+	var listeners []net.Listener
+	if fds := os.Getenv("RELOAD_LISTEN_FDS"); fds != "" {
+		for _, fd := range strings.Split(fds, ",") {
+			n, _ := strconv.Atoi(fd)
+			f := os.NewFile(uintptr(n), "inherited-listener")
+			ln, err := net.FileListener(f)
+			f.Close() // FileListener has its own copy
+			if err != nil {
+				return nil, fmt.Errorf("inherited listener (fd %s): %w", fd, err)
+			}
+			listeners = append(listeners, ln)
+			slog.Info("took over the listener", "generation", reloadGeneration(), "addr", ln.Addr().String())
+		}
+	} else {
+		for _, a := range addrs {
+			ln, err := net.Listen(a.network, a.addr)
+			if err != nil {
+				return nil, err
+			}
+			listeners = append(listeners, ln)
+		}
+	}
+	for _, ln := range listeners {
+		if tcp, ok := ln.(*net.TCPListener); ok {
+			mainListeners = append(mainListeners, tcp)
+		}
+	}
+	return newMultiListener(listeners), nil
+}
+
+// listen opens a side port, with SO_REUSEPORT under HOT_RELOAD so the next
+// generation can bind it while this one still does
+func listen(network, addr string) (net.Listener, error) {
+	return reuseConfig().Listen(context.Background(), network, addr)
+}
+
+// listenPacket is listen for UDP
+func listenPacket(network, addr string) (net.PacketConn, error) {
+	return reuseConfig().ListenPacket(context.Background(), network, addr)
+}
+
+// soReusePort is Linux's SO_REUSEPORT, which package syscall leaves out
+const soReusePort = 0xf
+
+func reuseConfig() *net.ListenConfig {
+	if !hotReload() {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		return errors.Join(err, sockErr)
+	}}
+}
+
+// listenAndServe is srv.ListenAndServe on a listen socket
+func listenAndServe(srv *http.Server) error {
+	ln, err := listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// watchReload starts the next generation on SIGUSR2, under HOT_RELOAD
+func watchReload() {
+	if !hotReload() {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	go func() {
+		for range ch {
+			if os.Getenv("RELOAD_SUPERVISED") != "" {
+				// PID 1 holds the socket and starts generations
+				syscall.Kill(os.Getppid(), syscall.SIGUSR2)
+				continue
+			}
+			if len(mainListeners) == 0 {
+				slog.Warn("SIGUSR2 ignored: the main listener is not a TCP socket")
+				continue
+			}
+			var sockets []*os.File
+			for _, ln := range mainListeners {
+				f, err := ln.File()
+				if err != nil {
+					slog.Error("reload failed", "error", err)
+					break
+				}
+				sockets = append(sockets, f)
+			}
+			var next *os.Process
+			err := errors.New("cannot pass the listener")
+			if len(sockets) == len(mainListeners) {
+				next, err = startSuccessor(sockets, reloadGeneration()+1, os.Getpid() == 1)
+			}
+			if err != nil {
+				for _, f := range sockets {
+					f.Close()
+				}
+				continue // still serving
+			}
+			successor, successorSockets = next, sockets
+			close(listenerHandedOff)
+			return
+		}
+	}()
+}
+
+// startSuccessor runs this binary again with sockets from fd 3 on and
+// waits for it to become ready, which it says by writing to the next fd. A
+// successor that exits or isn't ready within RELOAD_TIMEOUT is killed.
+func startSuccessor(sockets []*os.File, generation int, supervised bool) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	fds := make([]string, len(sockets))
+	for i := range sockets {
+		fds[i] = strconv.Itoa(3 + i)
+	}
+	cmd.Env = append(os.Environ(), "RELOAD_LISTEN_FDS="+strings.Join(fds, ","),
+		"RELOAD_READY_FD="+strconv.Itoa(3+len(sockets)), "RELOAD_GENERATION="+strconv.Itoa(generation))
+	if supervised {
+		cmd.Env = append(cmd.Env, "RELOAD_SUPERVISED=true")
+	}
+	cmd.ExtraFiles = append(append([]*os.File{}, sockets...), readyW)
+	slog.Info("starting the next generation", "generation", generation, "binary", exe)
+	err = cmd.Start()
+	readyW.Close() // only the successor writes it; its exit is our EOF
+	if err != nil {
+		reloadHandoffs.Inc("failed")
+		slog.Error("reload failed", "generation", generation, "error", err)
+		return nil, err
+	}
+
+	timeout := getEnvDuration("RELOAD_TIMEOUT", 30*time.Second)
+	readyR.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := readyR.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		reloadHandoffs.Inc("failed")
+		err = fmt.Errorf("generation %d exited or was not ready within %s: %w", generation, timeout, err)
+		slog.Error("reload failed, this generation keeps serving", "error", err)
+		return nil, err
+	}
+	reloadHandoffs.Inc("ok")
+	slog.Info("next generation is ready, handing off", "generation", generation, "pid", cmd.Process.Pid)
+	podEvents.Record("Normal", "Reloaded", fmt.Sprintf("generation %d (pid %d) took over the listener", generation, cmd.Process.Pid))
+	return cmd.Process, nil
+}
+
+// notifyReloadReady tells the previous generation this one is ready
+func notifyReloadReady() {
+	fd := os.Getenv("RELOAD_READY_FD")
+	if fd == "" {
+		return
+	}
+	os.Unsetenv("RELOAD_READY_FD")
+	n, _ := strconv.Atoi(fd)
+	f := os.NewFile(uintptr(n), "reload-ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// superviseGenerations is what PID 1 does after handing off: start each
+// next generation on SIGUSR2, forward other signals to the current one,
+// and exit with its exit code
+func superviseGenerations(sockets []*os.File, current *os.Process) int {
+	generation := reloadGeneration() + 1
+	slog.Info("supervising the serving generation as PID 1", "generation", generation, "pid", current.Pid)
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2)
+
+	type exit struct{ pid, code int }
+	exits := make(chan exit)
+	go func() {
+		for {
+			var ws syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &ws, 0, nil)
+			if err != nil {
+				time.Sleep(100 * time.Millisecond) // EINTR, or ECHILD while a child starts
+				continue
+			}
+			code := ws.ExitStatus()
+			if ws.Signaled() {
+				code = 128 + int(ws.Signal())
+			}
+			exits <- exit{pid, code}
+		}
+	}()
+
+	for {
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGUSR2 {
+				current.Signal(sig)
+				continue
+			}
+			next, err := startSuccessor(sockets, generation+1, true)
+			if err != nil {
+				continue
+			}
+			current.Signal(syscall.SIGTERM) // drains as on pod deletion
+			current, generation = next, generation+1
+		case e := <-exits:
+			if e.pid == current.Pid {
+				slog.Info("serving generation exited", "generation", generation, "exit_code", e.code)
+				return e.code
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// /api/requests answers "who has been hitting this pod?" from the last
+// REQUEST_HISTORY_SIZE requests (1000 by default) it served, the same
+// events /events streams live:
+//
+//	curl 'localhost:30080/api/requests?limit=20'
+//	curl 'localhost:30080/api/requests?code=5xx&path=/api/'
+//	curl 'localhost:30080/api/requests?exclude=/health,/ready,/metrics'   # without the probes
+//
+// Newest first. code takes statuses and classes (404,5xx); path and exclude
+// take path prefixes. A full page comes with next_before: pass it as
+// ?before= for the page after. clients counts every match by client, the
+// first X-Forwarded-For hop when a proxy set one - so through a Service,
+// compare it across pods to see how connections were spread.
+//
+// The history is per pod and in memory: a restart starts it over, and
+// each replica only knows its own traffic (the dashboard asks the one
+// that answered it). The filter is ?code=, not ?status=, which asks any
+// /api/ route for an injected failure.
+
+// RequestsResponse is returned by /api/requests
+type RequestsResponse struct {
+	Pod        string         `json:"pod"`
+	Capacity   int            `json:"capacity"` // REQUEST_HISTORY_SIZE
+	Buffered   int            `json:"buffered"`
+	Matched    int            `json:"matched"` // across every page
+	Requests   []RequestEvent `json:"requests"`
+	NextBefore uint64         `json:"next_before,omitempty"`
+	Clients    []ClientCount  `json:"clients"`
+}
+
+// ClientCount is how many matching requests came from one client
+type ClientCount struct {
+	Client   string `json:"client"`
+	Requests int    `json:"requests"`
+}
+
+// requestFilter is parsed from the /api/requests query
+type requestFilter struct {
+	statuses []string // "404" or "5xx"
+	paths    []string
+	exclude  []string
+	before   uint64 // 0 for the newest
+}
+
+func (f requestFilter) matches(ev RequestEvent) bool {
+	if f.before != 0 && ev.ID >= f.before {
+		return false
+	}
+	for _, p := range f.exclude {
+		if strings.HasPrefix(ev.Path, p) {
+			return false
+		}
+	}
+	if len(f.paths) > 0 && !hasPrefixAny(ev.Path, f.paths) {
+		return false
+	}
+	if len(f.statuses) == 0 {
+		return true
+	}
+	code := strconv.Itoa(ev.Status)
+	for _, s := range f.statuses {
+		if s == code || len(s) == 3 && strings.HasSuffix(s, "xx") && s[0] == code[0] {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrefixAny(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventClient is the request's original client: the first forwarded hop,
+// else the peer address without its port
+func eventClient(ev RequestEvent) string {
+	if ev.ForwardedFor != "" {
+		first, _, _ := strings.Cut(ev.ForwardedFor, ",")
+		return strings.TrimSpace(first)
+	}
+	if host, _, err := net.SplitHostPort(ev.Client); err == nil {
+		return host
+	}
+	return ev.Client
+}
+
+func requestsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	q := r.URL.Query()
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeProblem(w, r, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, requestEvents.historySize)
+	}
+	f := requestFilter{
+		statuses: splitList(strings.ToLower(q.Get("code"))),
+		paths:    splitList(q.Get("path")),
+		exclude:  splitList(q.Get("exclude")),
+	}
+	for _, s := range f.statuses {
+		if _, err := strconv.Atoi(strings.TrimSuffix(s, "xx")); err != nil || len(s) != 3 {
+			writeProblem(w, r, http.StatusBadRequest, "code takes statuses and classes, like 404,5xx")
+			return
+		}
+	}
+	if v := q.Get("before"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "before must be a request id")
+			return
+		}
+		f.before = n
+	}
+
+	hostname, _ := os.Hostname()
+	resp := RequestsResponse{Pod: hostname, Capacity: requestEvents.historySize, Requests: []RequestEvent{}}
+	clients := map[string]int{}
+	requestEvents.each(func(ev RequestEvent) bool {
+		if !f.matches(ev) {
+			return true
+		}
+		resp.Matched++
+		clients[eventClient(ev)]++
+		if len(resp.Requests) < limit {
+			resp.Requests = append(resp.Requests, ev)
+		}
+		return true
+	})
+	resp.Buffered = requestEvents.Buffered()
+	if resp.Matched > len(resp.Requests) {
+		resp.NextBefore = resp.Requests[len(resp.Requests)-1].ID
+	}
+	resp.Clients = make([]ClientCount, 0, len(clients))
+	for c, n := range clients {
+		resp.Clients = append(resp.Clients, ClientCount{Client: c, Requests: n})
+	}
+	sort.Slice(resp.Clients, func(i, j int) bool {
+		a, b := resp.Clients[i], resp.Clients[j]
+		return a.Requests > b.Requests || a.Requests == b.Requests && a.Client < b.Client
+	})
+	writeJSON(w, http.StatusOK, resp)
+}
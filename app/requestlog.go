@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// A persistent request log under DATA_DIR, for showing state that
+// outlives the pod: with a PVC mounted there, /api/requests/log still has
+// yesterday's traffic after a restart, a rollout or a reschedule; with an
+// emptyDir it is gone with the pod.
+//
+//	REQUEST_LOG=true                 off by default
+//	REQUEST_LOG_RETENTION=24h        older entries are pruned
+//	REQUEST_LOG_MAX_BYTES=67108864   and the oldest go once the log is bigger
+//
+//	curl 'localhost:30080/api/requests/log?since=1h&code=5xx'
+//	kubectl delete pod -n go-demo -l app=go-app     # then ask again
+//
+// The log is a SQLite database, $DATA_DIR/requests.db, through
+// modernc.org/sqlite: pure Go, so the image stays a static binary with no
+// database server beside it. Queries filter in SQL on an index over the
+// time. An entry's id is its row's seq, which keeps counting across
+// restarts, and pages follow it (?before=<next_before>). Entries are
+// written in one transaction every second: a crash loses at most that
+// much, and the write-ahead log keeps the file consistent whatever happens
+// mid-write. Pruned rows leave free pages
+// that later inserts reuse, so the file stops growing at about
+// REQUEST_LOG_MAX_BYTES rather than shrinking.
+//
+// One writer per file: with a ReadWriteOnce PVC that means one replica,
+// or a StatefulSet with a volume per pod, and SQLite's locking isn't
+// meant for network filesystems. The pod column shows which incarnation
+// served each request, so a Deployment's log spans several pod names
+// while a StatefulSet's keeps one.
+
+// requestLog appends request events to a SQLite table
+type requestLog struct {
+	dir       string
+	path      string
+	retention time.Duration
+	maxBytes  int64
+	db        *sql.DB
+
+	mu      sync.Mutex // guards pending
+	pending []RequestEvent
+
+	stop, done chan struct{}
+}
+
+// reqLog is set in main when REQUEST_LOG=true
+var reqLog *requestLog
+
+var (
+	requestLogWritten = newCounterVec("request_log_entries_written_total",
+		"Requests appended to the persistent request log.")
+	requestLogPruned = newCounterVec("request_log_entries_pruned_total",
+		"Request log entries deleted, by reason (age, size).", "reason")
+)
+
+const requestLogSchema = `
+CREATE TABLE IF NOT EXISTS requests (
+	seq           INTEGER PRIMARY KEY AUTOINCREMENT,
+	time          INTEGER NOT NULL, -- Unix nanoseconds
+	id            INTEGER NOT NULL, -- the pod's event ID, restarting with the process; seq is the entry's
+	pod           TEXT NOT NULL,
+	method        TEXT NOT NULL,
+	path          TEXT NOT NULL,
+	status        INTEGER NOT NULL,
+	client        TEXT NOT NULL,
+	forwarded_for TEXT NOT NULL DEFAULT '',
+	latency_ms    REAL NOT NULL,
+	request_id    TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS requests_time ON requests (time);
+`
+
+// newRequestLogFromEnv returns nil unless REQUEST_LOG=true
+func newRequestLogFromEnv() (*requestLog, error) {
+	if !getEnvBool("REQUEST_LOG", false) {
+		return nil, nil
+	}
+	l := &requestLog{
+		dir:       dataDir(),
+		retention: getEnvDuration("REQUEST_LOG_RETENTION", 24*time.Hour),
+		maxBytes:  getEnvInt("REQUEST_LOG_MAX_BYTES", 64<<20),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	l.path = filepath.Join(l.dir, "requests.db")
+	if err := os.MkdirAll(l.dir, 0o755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", l.path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // one writer; reads wait their turn for a moment
+	if _, err := db.Exec(requestLogSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	l.db = db
+	newGaugeFunc("request_log_bytes", "Size of the persistent request log on disk.",
+		func() float64 { _, size := l.stats(); return float64(size) })
+	return l, nil
+}
+
+// stats returns how many entries the log has and its size on disk
+func (l *requestLog) stats() (entries, size int64) {
+	l.db.QueryRow(`SELECT count(*) FROM requests`).Scan(&entries)
+	for _, suffix := range []string{"", "-wal"} {
+		if info, err := os.Stat(l.path + suffix); err == nil {
+			size += info.Size()
+		}
+	}
+	return entries, size
+}
+
+// run appends every request event until Close
+func (l *requestLog) run() {
+	defer close(l.done)
+	events, unsubscribe := requestEvents.subscribe(4096) // room for load tests between flushes
+	defer unsubscribe()
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	prune := time.NewTicker(10 * time.Minute)
+	defer prune.Stop()
+	l.prune()
+	for {
+		select {
+		case ev := <-events:
+			l.mu.Lock()
+			l.pending = append(l.pending, ev)
+			l.mu.Unlock()
+		case <-flush.C:
+			l.flush()
+		case <-prune.C:
+			l.prune()
+		case <-l.stop:
+			l.mu.Lock()
+			for len(events) > 0 { // the last requests before shutdown
+				l.pending = append(l.pending, <-events)
+			}
+			l.mu.Unlock()
+			l.flush()
+			return
+		}
+	}
+}
+
+// Close writes out what is pending and closes the database
+func (l *requestLog) Close() {
+	close(l.stop)
+	<-l.done
+	l.db.Close()
+}
+
+// flush inserts the pending events in one transaction
+func (l *requestLog) flush() {
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	if err := l.insert(pending); err != nil {
+		slog.Warn("request log write failed", "file", l.path, "entries", len(pending), "error", err)
+		return
+	}
+	requestLogWritten.Add(float64(len(pending)))
+}
+
+func (l *requestLog) insert(events []RequestEvent) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO requests (time, id, pod, method, path, status, client, forwarded_for, latency_ms, request_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, ev := range events {
+		if _, err := stmt.Exec(ev.Time.UnixNano(), int64(ev.ID), ev.Pod, ev.Method, ev.Path, ev.Status, ev.Client,
+			ev.ForwardedFor, ev.LatencyMS, ev.RequestID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// prune deletes entries past the retention, then the oldest tenth at a
+// time while the pages in use are over the size
+func (l *requestLog) prune() {
+	cutoff := time.Now().Add(-l.retention).UnixNano()
+	if res, err := l.db.Exec(`DELETE FROM requests WHERE time < ?`, cutoff); err == nil {
+		n, _ := res.RowsAffected()
+		l.pruned(n, "age")
+	}
+	var bySize int64
+	for l.maxBytes > 0 && l.usedBytes() > l.maxBytes {
+		res, err := l.db.Exec(`DELETE FROM requests WHERE seq IN
+			(SELECT seq FROM requests ORDER BY seq LIMIT max((SELECT count(*) FROM requests) / 10, 1))`)
+		if err != nil {
+			break
+		}
+		n, _ := res.RowsAffected()
+		if n == 0 {
+			break
+		}
+		bySize += n
+	}
+	l.pruned(bySize, "size")
+}
+
+// usedBytes is the database's size less its free pages
+func (l *requestLog) usedBytes() int64 {
+	var pages, free, size int64
+	l.db.QueryRow(`SELECT page_count, freelist_count, page_size FROM pragma_page_count, pragma_freelist_count, pragma_page_size`).
+		Scan(&pages, &free, &size)
+	return (pages - free) * size
+}
+
+func (l *requestLog) pruned(n int64, reason string) {
+	if n > 0 {
+		requestLogPruned.Add(float64(n), reason)
+		slog.Info("request log pruned", "entries", n, "reason", reason)
+	}
+}
+
+// query returns up to limit matching entries newest first, below seq
+// before when that is set, and whether there are more. An entry's ID is
+// its seq, unique in the file across restarts, where the event IDs start
+// over with every process.
+func (l *requestLog) query(f requestFilter, since time.Time, before uint64, limit int) (entries []RequestEvent, more bool, err error) {
+	l.flush() // include what is still pending
+	var where []string
+	var args []any
+	if !since.IsZero() {
+		where, args = append(where, "time >= ?"), append(args, since.UnixNano())
+	}
+	if before > 0 {
+		where, args = append(where, "seq < ?"), append(args, int64(before))
+	}
+	if len(f.paths) > 0 {
+		var or []string
+		for _, p := range f.paths {
+			or, args = append(or, "instr(path, ?) = 1"), append(args, p)
+		}
+		where = append(where, "("+strings.Join(or, " OR ")+")")
+	}
+	for _, p := range f.exclude {
+		where, args = append(where, "instr(path, ?) != 1"), append(args, p)
+	}
+	if len(f.statuses) > 0 {
+		var or []string
+		for _, s := range f.statuses {
+			if len(s) == 3 && strings.HasSuffix(s, "xx") {
+				or, args = append(or, "status / 100 = ?"), append(args, int(s[0]-'0'))
+			} else {
+				or, args = append(or, "status = ?"), append(args, s)
+			}
+		}
+		where = append(where, "("+strings.Join(or, " OR ")+")")
+	}
+	q := `SELECT seq, time, pod, method, path, status, client, forwarded_for, latency_ms, request_id FROM requests`
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := l.db.Query(q+" ORDER BY seq DESC LIMIT ?", append(args, limit+1)...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	entries = []RequestEvent{}
+	for rows.Next() {
+		var ev RequestEvent
+		var seq, at int64
+		if err := rows.Scan(&seq, &at, &ev.Pod, &ev.Method, &ev.Path, &ev.Status, &ev.Client, &ev.ForwardedFor,
+			&ev.LatencyMS, &ev.RequestID); err != nil {
+			return nil, false, err
+		}
+		ev.ID, ev.Time = uint64(seq), time.Unix(0, at).UTC()
+		entries = append(entries, ev)
+	}
+	if len(entries) > limit {
+		return entries[:limit], true, rows.Err()
+	}
+	return entries, false, rows.Err()
+}
+
+// RequestLogResponse is returned by /api/requests/log
+type RequestLogResponse struct {
+	File       string         `json:"file"`
+	Mounted    bool           `json:"mounted"` // a volume is mounted at DATA_DIR
+	Entries    int64          `json:"entries"`
+	Bytes      int64          `json:"bytes"`
+	Retention  string         `json:"retention"`
+	Requests   []RequestEvent `json:"requests"`
+	NextBefore uint64         `json:"next_before,omitempty"` // pass as ?before= for the next page
+	Pods       []PodCount     `json:"pods"`                  // pod incarnations in this page
+}
+
+// PodCount is how many logged requests one pod served
+type PodCount struct {
+	Pod      string `json:"pod"`
+	Requests int    `json:"requests"`
+}
+
+// parseSince takes a duration back from now (1h) or an RFC 3339 time
+func parseSince(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+func requestLogHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	if reqLog == nil {
+		writeProblem(w, r, http.StatusNotFound, "the persistent request log is off; set REQUEST_LOG=true")
+		return
+	}
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 5000 {
+			writeProblem(w, r, http.StatusBadRequest, "limit must be from 1 to 5000")
+			return
+		}
+		limit = n
+	}
+	f := requestFilter{
+		statuses: splitList(strings.ToLower(q.Get("code"))),
+		paths:    splitList(q.Get("path")),
+		exclude:  splitList(q.Get("exclude")),
+	}
+	var since time.Time
+	var before uint64
+	var err error
+	if v := q.Get("since"); v != "" {
+		if since, err = parseSince(v); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "since takes a duration (1h) or an RFC 3339 time")
+			return
+		}
+	}
+	if v := q.Get("before"); v != "" {
+		if before, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "before takes an entry id, as in next_before")
+			return
+		}
+	}
+
+	entries, more, err := reqLog.query(f, since, before, limit)
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "reading the request log: "+err.Error())
+		return
+	}
+	count, size := reqLog.stats()
+	resp := RequestLogResponse{
+		File:      reqLog.path,
+		Mounted:   isMountPoint(reqLog.dir),
+		Entries:   count,
+		Bytes:     size,
+		Retention: reqLog.retention.String(),
+		Requests:  entries,
+		Pods:      []PodCount{},
+	}
+	if more {
+		resp.NextBefore = entries[len(entries)-1].ID
+	}
+	pods := map[string]int{}
+	for _, ev := range entries {
+		pods[ev.Pod]++
+	}
+	for _, pod := range sortedKeys(pods) {
+		resp.Pods = append(resp.Pods, PodCount{Pod: pod, Requests: pods[pod]})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
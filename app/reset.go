@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/cache"
+)
+
+// /admin/reset puts the demo data back to a clean start between workshop
+// sessions, without a redeploy. GET shows what there is to clear, as a
+// page with checkboxes for a browser; POST clears it, and only with
+// ?confirm=yes, as a slip would take every attendee's data with it:
+//
+//	open http://localhost:9090/admin/reset
+//	curl -s localhost:9090/admin/reset | jq '.targets[] | {name, entries}'
+//	curl -X POST 'localhost:9090/admin/reset?confirm=yes'                         # everything
+//	curl -X POST 'localhost:9090/admin/reset?confirm=yes&targets=guestbook,chaos'
+//
+// Like every /admin change it is in the audit trail (/admin/audit), and
+// each reset is also logged and posted as a pod Event. Redis counters and
+// the guestbook are shared, so one call clears them for every replica;
+// the rest is in each pod's memory, and every pod needs its own call:
+//
+//	for p in $(kubectl get pods -n go-demo -l app=go-app -o name); do
+//	  kubectl exec -n go-demo $p -- wget -qO- --post-data= 'localhost:9090/admin/reset?confirm=yes'
+//	done
+
+// ResetTarget is one kind of data /admin/reset clears
+type ResetTarget struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Entries     int    `json:"entries"` // what there is now, or was cleared
+	Error       string `json:"error,omitempty"`
+}
+
+// ResetResponse is returned by /admin/reset
+type ResetResponse struct {
+	Pod     string        `json:"pod"`
+	Reset   bool          `json:"reset"` // false for GET's preview
+	At      time.Time     `json:"at"`
+	Targets []ResetTarget `json:"targets"`
+}
+
+// ResetPage is the data for templates/reset.html
+type ResetPage struct {
+	AppName string
+	ResetResponse
+}
+
+// resettable is one target's count and clear
+type resettable struct {
+	name, description string
+	count, reset      func(context.Context) (int, error)
+}
+
+// resetRegistry holds the targets in registration order
+type resetRegistry struct {
+	mu      sync.Mutex
+	targets []resettable
+}
+
+var resetTargets = &resetRegistry{}
+
+// Register adds a target that count measures and reset clears
+func (rr *resetRegistry) Register(name, description string, count, reset func(context.Context) (int, error)) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.targets = append(rr.targets, resettable{name: name, description: description, count: count, reset: reset})
+}
+
+// names lists the registered targets
+func (rr *resetRegistry) names() []string {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	names := make([]string, len(rr.targets))
+	for i, t := range rr.targets {
+		names[i] = t.name
+	}
+	return names
+}
+
+// run counts (reset=false) or clears the named targets, all for none
+func (rr *resetRegistry) run(ctx context.Context, only []string, reset bool) []ResetTarget {
+	rr.mu.Lock()
+	targets := append([]resettable(nil), rr.targets...)
+	rr.mu.Unlock()
+	out := []ResetTarget{}
+	for _, t := range targets {
+		if len(only) > 0 && !slices.Contains(only, t.name) {
+			continue
+		}
+		op := t.count
+		if reset {
+			op = t.reset
+		}
+		n, err := op(ctx)
+		rt := ResetTarget{Name: t.name, Description: t.description, Entries: n}
+		if err != nil {
+			rt.Error = err.Error()
+		}
+		out = append(out, rt)
+	}
+	return out
+}
+
+func init() {
+	resetTargets.Register("counters", "/api/counter and visit counts: this pod's, and the shared ones in Redis",
+		func(ctx context.Context) (int, error) { return int(podCounter.total() + podVisits.total()), nil },
+		resetCounters)
+	resetTargets.Register("requests", "Request history behind /api/requests, /events and /graphql (not the REQUEST_LOG database)",
+		func(context.Context) (int, error) { return requestEvents.Buffered(), nil },
+		func(context.Context) (int, error) { return requestEvents.Clear(), nil })
+	resetTargets.Register("traces", "Spans kept for /trace/",
+		func(context.Context) (int, error) { return recentTraces.Len(), nil },
+		func(context.Context) (int, error) { return recentTraces.Clear(), nil })
+	resetTargets.Register("caches", "In-memory caches: compute results, guestbook pages",
+		func(context.Context) (int, error) { return cache.Entries(), nil },
+		func(context.Context) (int, error) { return cache.FlushAll(), nil })
+	resetTargets.Register("chaos", "Injected latency, error rate, leaked memory and goroutines (CPU burners run out on their own)",
+		func(context.Context) (int, error) { return chaosState.Status().Active(), nil },
+		func(context.Context) (int, error) { return chaosState.Reset(), nil })
+}
+
+// resetCounters zeroes this pod's counters and deletes the Redis ones,
+// for every tenant this pod has seen
+func resetCounters(ctx context.Context) (int, error) {
+	n := int(podCounter.total() + podVisits.total())
+	podCounter.reset()
+	podVisits.reset()
+	if visitsRedis == nil {
+		return n, nil
+	}
+	args := []string{"DEL", counterKey, visitsKey}
+	tenantsMu.Lock()
+	for tenant := range tenantsSeen {
+		args = append(args, counterKey+":tenant:"+tenant, visitsKey+":tenant:"+tenant)
+	}
+	tenantsMu.Unlock()
+	if _, err := visitsRedis.Do(ctx, args...); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// resetHandler serves /admin/reset: GET previews, POST ?confirm=yes clears
+func resetHandler(pages *template.Template, appName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hostname, _ := os.Hostname()
+		resp := ResetResponse{Pod: hostname, At: time.Now()}
+		var only []string
+		if v := r.URL.Query().Get("targets"); v != "" {
+			only = splitList(v)
+			for _, name := range only {
+				if !slices.Contains(resetTargets.names(), name) {
+					writeProblem(w, r, http.StatusBadRequest, "no target "+name+"; targets are "+strings.Join(resetTargets.names(), ", "))
+					return
+				}
+			}
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			resp.Targets = resetTargets.run(r.Context(), only, false)
+			if strings.HasPrefix(r.Header.Get("Accept"), "text/html") && r.URL.Query().Get("format") == "" {
+				renderPage(w, r, pages, "reset.html", ResetPage{AppName: appName, ResetResponse: resp})
+				return
+			}
+			writeJSON(w, http.StatusOK, resp)
+		case http.MethodPost:
+			if r.URL.Query().Get("confirm") != "yes" {
+				names := only
+				if len(names) == 0 {
+					names = resetTargets.names()
+				}
+				writeProblem(w, r, http.StatusBadRequest, "this clears "+strings.Join(names, ", ")+" on "+hostname+"; repeat with ?confirm=yes")
+				return
+			}
+			resp.Reset, resp.Targets = true, resetTargets.run(r.Context(), only, true)
+			code := http.StatusOK
+			var cleared []string
+			for _, t := range resp.Targets {
+				cleared = append(cleared, t.Name)
+				if t.Error != "" {
+					code = http.StatusInternalServerError // "failed" in the audit trail
+					slog.Error("reset failed", "target", t.Name, "error", t.Error)
+				}
+			}
+			who, _ := auditActor(r)
+			slog.Warn("demo data reset", "targets", cleared, "by", who)
+			podEvents.Record("Normal", "DemoDataReset", "/admin/reset by "+who+": "+strings.Join(cleared, ", "))
+			writeJSON(w, code, resp)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeProblem(w, r, http.StatusMethodNotAllowed, "use GET to preview or POST ?confirm=yes to reset")
+		}
+	}
+}
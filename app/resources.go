@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// /api/resources is the container's own view of its CPU and memory, read
+// from the same cgroup files the kubelet reads for kubectl top:
+//
+//	curl localhost:8080/api/resources
+//	curl -X POST 'localhost:8080/api/load/cpu?duration=30s' & curl 'localhost:8080/api/resources?window=5s'
+//
+// CPU usage is measured over ?window (1s by default). Throttling counts
+// the CFS periods where the container hit its quota: a high percentage
+// with modest average usage means bursts are being squeezed, long before
+// kubectl top shows anything alarming. Memory headroom is measured from
+// the working set (usage minus inactive page cache), which is what
+// kubectl top shows and what the kubelet evicts on; the kernel OOM-kills
+// when usage can't be reclaimed under the limit.
+
+// ResourcesResponse is returned by /api/resources
+type ResourcesResponse struct {
+	Pod           string         `json:"pod"`
+	CgroupVersion string         `json:"cgroup_version"` // v1, v2 or none
+	Window        string         `json:"window"`
+	CPU           ResourceCPU    `json:"cpu"`
+	Memory        ResourceMemory `json:"memory"`
+	Error         string         `json:"error,omitempty"`
+}
+
+// ResourceCPU is CPU usage and throttling
+type ResourceCPU struct {
+	UsageCores        float64 `json:"usage_cores"` // average over the window
+	LimitCores        float64 `json:"limit_cores,omitempty"`
+	RequestCores      float64 `json:"request_cores,omitempty"` // CPU_REQUEST from the Downward API
+	PercentOfLimit    float64 `json:"percent_of_limit,omitempty"`
+	UsageSecondsTotal float64 `json:"usage_seconds_total"`
+	Periods           int64   `json:"periods_total"`
+	ThrottledPeriods  int64   `json:"throttled_periods_total"`
+	ThrottledPercent  float64 `json:"throttled_percent"` // of all periods since start
+	ThrottledSeconds  float64 `json:"throttled_seconds_total"`
+}
+
+// ResourceMemory is memory usage against the limit
+type ResourceMemory struct {
+	UsageBytes      int64   `json:"usage_bytes"`
+	WorkingSetBytes int64   `json:"working_set_bytes"` // what kubectl top shows
+	AnonBytes       int64   `json:"anon_bytes"`        // heap and stacks: can't be reclaimed
+	FileBytes       int64   `json:"file_bytes"`        // page cache: mostly reclaimable
+	LimitBytes      int64   `json:"limit_bytes,omitempty"`
+	RequestBytes    int64   `json:"request_bytes,omitempty"` // MEMORY_REQUEST from the Downward API
+	HeadroomBytes   int64   `json:"headroom_bytes,omitempty"`
+	HeadroomPercent float64 `json:"headroom_percent,omitempty"`
+	OOMKills        int64   `json:"oom_kills"` // in this cgroup, e.g. of child processes
+}
+
+// cgroupUsage is one reading of the cgroup's counters
+type cgroupUsage struct {
+	cpuUsage     time.Duration
+	periods      int64
+	throttled    int64
+	throttledFor time.Duration
+	memory       int64
+	inactiveFile int64
+	anon, file   int64
+	oomKills     int64
+}
+
+// readCgroupUsage reads the v1 or v2 usage counters under root
+func readCgroupUsage(root string) (cgroupUsage, string, error) {
+	var u cgroupUsage
+	if cgroupV1(root) {
+		ns, err := readCgroupInt(filepath.Join(root, "cpuacct", "cpuacct.usage"))
+		if err != nil {
+			return u, "v1", err
+		}
+		u.cpuUsage = time.Duration(ns)
+		if stat, err := readCgroupStat(filepath.Join(root, "cpu", "cpu.stat")); err == nil {
+			u.periods, u.throttled = stat["nr_periods"], stat["nr_throttled"]
+			u.throttledFor = time.Duration(stat["throttled_time"])
+		}
+		if u.memory, err = readCgroupInt(filepath.Join(root, "memory", "memory.usage_in_bytes")); err != nil {
+			return u, "v1", err
+		}
+		if stat, err := readCgroupStat(filepath.Join(root, "memory", "memory.stat")); err == nil {
+			u.inactiveFile, u.anon, u.file = stat["total_inactive_file"], stat["total_rss"], stat["total_cache"]
+		}
+		if oom, err := readCgroupStat(filepath.Join(root, "memory", "memory.oom_control")); err == nil {
+			u.oomKills = oom["oom_kill"]
+		}
+		return u, "v1", nil
+	}
+
+	stat, err := readCgroupStat(filepath.Join(root, "cpu.stat"))
+	if err != nil {
+		return u, "none", err
+	}
+	u.cpuUsage = time.Duration(stat["usage_usec"]) * time.Microsecond
+	u.periods, u.throttled = stat["nr_periods"], stat["nr_throttled"]
+	u.throttledFor = time.Duration(stat["throttled_usec"]) * time.Microsecond
+	if u.memory, err = readCgroupInt(filepath.Join(root, "memory.current")); err != nil {
+		return u, "v2", err
+	}
+	if mem, err := readCgroupStat(filepath.Join(root, "memory.stat")); err == nil {
+		u.inactiveFile, u.anon, u.file = mem["inactive_file"], mem["anon"], mem["file"]
+	}
+	if events, err := readCgroupStat(filepath.Join(root, "memory.events")); err == nil {
+		u.oomKills = events["oom_kill"]
+	}
+	return u, "v2", nil
+}
+
+// resourcesHandler serves /api/resources?window=1s
+func resourcesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	window := time.Second
+	if v := r.URL.Query().Get("window"); v != "" {
+		var err error
+		if window, err = time.ParseDuration(v); err != nil || window < 100*time.Millisecond || window > 30*time.Second {
+			writeProblem(w, r, http.StatusBadRequest, "window must be a Go duration between 100ms and 30s")
+			return
+		}
+	}
+	resp, err := sampleResources(r.Context(), window)
+	if err != nil {
+		if r.Context().Err() == nil {
+			writeProblem(w, r, http.StatusInternalServerError, "cgroup usage: "+err.Error())
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// sampleResources reads the cgroup counters twice, window apart. Outside a
+// container the response says so in Error rather than failing.
+func sampleResources(ctx context.Context, window time.Duration) (ResourcesResponse, error) {
+	hostname, _ := os.Hostname()
+	resp := ResourcesResponse{Pod: hostname, Window: window.String()}
+
+	before, version, err := readCgroupUsage(cgroupRoot)
+	resp.CgroupVersion = version
+	if err != nil {
+		resp.CgroupVersion = "none"
+		resp.Error = "cannot read cgroup usage (not in a container?): " + err.Error()
+		return resp, nil
+	}
+	start := time.Now()
+	select {
+	case <-time.After(window):
+	case <-ctx.Done():
+		return resp, ctx.Err()
+	}
+	u, _, err := readCgroupUsage(cgroupRoot)
+	if err != nil {
+		return resp, err
+	}
+	limits, _ := readCgroupLimits(cgroupRoot)
+
+	cpu := ResourceCPU{
+		UsageCores:        round2((u.cpuUsage - before.cpuUsage).Seconds() / time.Since(start).Seconds()),
+		LimitCores:        limits.CPUCores,
+		UsageSecondsTotal: round2(u.cpuUsage.Seconds()),
+		Periods:           u.periods,
+		ThrottledPeriods:  u.throttled,
+		ThrottledSeconds:  round2(u.throttledFor.Seconds()),
+	}
+	if milli, err := strconv.ParseInt(getEnv("CPU_REQUEST", ""), 10, 64); err == nil {
+		cpu.RequestCores = float64(milli) / 1000
+	}
+	if cpu.LimitCores > 0 {
+		cpu.PercentOfLimit = round2(100 * cpu.UsageCores / cpu.LimitCores)
+	}
+	if u.periods > 0 {
+		cpu.ThrottledPercent = round2(100 * float64(u.throttled) / float64(u.periods))
+	}
+
+	mem := ResourceMemory{
+		UsageBytes:      u.memory,
+		WorkingSetBytes: max(u.memory-u.inactiveFile, 0),
+		AnonBytes:       u.anon,
+		FileBytes:       u.file,
+		LimitBytes:      limits.MemoryBytes,
+		OOMKills:        u.oomKills,
+	}
+	mem.RequestBytes, _ = strconv.ParseInt(getEnv("MEMORY_REQUEST", ""), 10, 64)
+	if mem.LimitBytes > 0 {
+		mem.HeadroomBytes = mem.LimitBytes - mem.WorkingSetBytes
+		mem.HeadroomPercent = round2(100 * float64(mem.HeadroomBytes) / float64(mem.LimitBytes))
+	}
+	resp.CPU, resp.Memory = cpu, mem
+	return resp, nil
+}
+
+// round2 keeps two decimals, enough for cores and percentages
+func round2(v float64) float64 { return math.Round(v*100) / 100 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeJSON writes v as a JSON response with the given status code, or as
+// YAML or XML, when negotiateFormats found the request asking for those
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	if fw, ok := w.(*formatWriter); ok {
+		writeNegotiated(fw.ResponseWriter, fw.r, code, v)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Problem is an RFC 7807 problem details object, the body of every error
+// response:
+//
+//	{"type": "about:blank", "title": "Too Many Requests", "status": 429,
+//	 "detail": "rate limit exceeded (client)", "instance": "/api/info",
+//	 "request_id": "...", "retryable": true}
+//
+// Clients branch on status (and type, when a handler sets one), people
+// read detail, and request_id finds the request in this pod's logs and
+// traces. retryable says whether trying again can help: true for 408, 429
+// and the 502/503/504 family a retry loop is meant for, false for a 4xx
+// that will fail the same way every time.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Retryable bool   `json:"retryable"`
+
+	// Extensions are extra members next to the standard ones (RFC 7807
+	// section 3.2), such as the code and required_scope of an auth error
+	Extensions map[string]any `json:"-"`
+}
+
+const problemContentType = "application/problem+json"
+
+// MarshalJSON appends Extensions after the standard members
+func (p Problem) MarshalJSON() ([]byte, error) {
+	type plain Problem
+	data, err := json.Marshal(plain(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return data, err
+	}
+	var standard map[string]json.RawMessage
+	json.Unmarshal(data, &standard)
+	data = data[:len(data)-1] // reopen the object
+	for _, k := range sortedKeys(p.Extensions) {
+		if _, taken := standard[k]; taken {
+			continue
+		}
+		key, _ := json.Marshal(k)
+		value, err := json.Marshal(p.Extensions[k])
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(append(append(data, ','), key...), ':'), value...)
+	}
+	return append(data, '}'), nil
+}
+
+// retryableStatus reports whether the same request may succeed later
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// writeProblem writes an application/problem+json error response
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	sendProblem(w, r, Problem{Status: status, Detail: detail})
+}
+
+// sendProblem fills in what p leaves out (type, title, instance, request
+// ID, retryable) from the status and the request, and writes it
+func sendProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Type == "" {
+		p.Type = "about:blank" // RFC 7807: the status code says it all
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Instance == "" {
+		p.Instance = r.URL.Path
+	}
+	if p.RequestID == "" {
+		p.RequestID = requestIDFromContext(r.Context())
+	}
+	p.Retryable = p.Retryable || retryableStatus(p.Status)
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Restart history under DATA_DIR, for CrashLoopBackOff and liveness
+// lessons: every start appends a run to $DATA_DIR/restarts.json, a
+// heartbeat keeps its last_seen current, and an exit on purpose records
+// the same reason and code as the termination message:
+//
+//	RESTART_HISTORY=true
+//	CRASH_AFTER=20s EXIT_CODE=3
+//	curl -s localhost:30080/api/restarts | jq '{restarts, pod_restarts, reasons, previous: [.previous[] | {reason, uptime, down_before}]}'
+//
+// A run without an exit was killed: SIGKILL from a failed liveness probe,
+// the OOM killer, or the node going away. Its uptime ends at the last
+// heartbeat, RESTART_HEARTBEAT (10s) at most before the kill. down_before
+// is the gap before a run started, where CrashLoopBackOff's back-off shows.
+// With an emptyDir the history is the pod's, lasting through container
+// restarts like kubectl's RESTARTS column; with a PVC it spans pods too,
+// and pod_restarts counts only this pod's.
+
+// maxRestartRuns bounds the history kept in the file
+const maxRestartRuns = 50
+
+// RestartRun is one start of the container
+type RestartRun struct {
+	Run       int        `json:"run"` // 1 for the first start on record
+	Pod       string     `json:"pod"`
+	Version   string     `json:"version"`
+	StartedAt time.Time  `json:"started_at"`
+	LastSeen  time.Time  `json:"last_seen"` // the last heartbeat
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	Uptime    string     `json:"uptime"`
+	Down      string     `json:"down_before,omitempty"` // since the run before ended
+	ExitCode  *int       `json:"exit_code,omitempty"`
+	Reason    string     `json:"reason,omitempty"` // the termination reason, or Killed
+	Message   string     `json:"message,omitempty"`
+}
+
+// RestartsResponse is returned by /api/restarts
+type RestartsResponse struct {
+	File        string         `json:"file"`
+	Mounted     bool           `json:"mounted"`  // a volume is mounted at DATA_DIR
+	Restarts    int            `json:"restarts"` // runs on record before this one
+	PodRestarts int            `json:"pod_restarts"`
+	Reasons     map[string]int `json:"reasons"` // how the earlier runs ended
+	TotalUptime string         `json:"total_uptime"`
+	Current     RestartRun     `json:"current"`
+	Previous    []RestartRun   `json:"previous"` // newest first
+}
+
+// restartLog is the history file and the run this process is
+type restartLog struct {
+	path      string
+	heartbeat time.Duration
+
+	mu   sync.Mutex
+	runs []RestartRun // oldest first, the last is this process
+}
+
+// restartHistory is nil unless RESTART_HISTORY=true
+var restartHistory *restartLog
+
+// newRestartLogFromEnv reads the history and appends this run to it; nil
+// unless RESTART_HISTORY=true
+func newRestartLogFromEnv(version string) (*restartLog, error) {
+	if !getEnvBool("RESTART_HISTORY", false) {
+		return nil, nil
+	}
+	l := &restartLog{
+		path:      filepath.Join(dataDir(), "restarts.json"),
+		heartbeat: getEnvDuration("RESTART_HEARTBEAT", 10*time.Second),
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(l.path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &l.runs); err != nil {
+			slog.Warn("restart history unreadable, starting a new one", "file", l.path, "error", err)
+			l.runs = nil
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	run := RestartRun{Run: 1, Pod: hostname, Version: version, StartedAt: startTime, LastSeen: time.Now()}
+	if n := len(l.runs); n > 0 {
+		prev := &l.runs[n-1]
+		if prev.EndedAt == nil {
+			prev.Reason = "Killed"
+			prev.Message = "no exit recorded: SIGKILL after a failed liveness probe, OOMKilled, or the node went away"
+		}
+		run.Run = prev.Run + 1
+		run.Down = startTime.Sub(prev.end()).Round(time.Second).String()
+	}
+	l.runs = append(l.runs, run)
+	if len(l.runs) > maxRestartRuns {
+		l.runs = l.runs[len(l.runs)-maxRestartRuns:]
+	}
+	if err := l.save(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// end is when the run ended, or was last seen
+func (r RestartRun) end() time.Time {
+	if r.EndedAt != nil {
+		return *r.EndedAt
+	}
+	return r.LastSeen
+}
+
+// save writes the history; l.mu must be held or the log not yet shared
+func (l *restartLog) save() error {
+	data, err := json.MarshalIndent(l.runs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.path, data)
+}
+
+// run refreshes this run's last_seen until the process exits
+func (l *restartLog) run() {
+	for range time.Tick(l.heartbeat) {
+		l.mu.Lock()
+		l.runs[len(l.runs)-1].LastSeen = time.Now()
+		err := l.save()
+		l.mu.Unlock()
+		if err != nil {
+			slog.Warn("cannot update the restart history", "file", l.path, "error", err)
+		}
+	}
+}
+
+// recordExit notes how this run ended; called with the termination message
+func (l *restartLog) recordExit(code int, reason, message string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	cur := &l.runs[len(l.runs)-1]
+	cur.LastSeen, cur.EndedAt, cur.ExitCode, cur.Reason, cur.Message = now, &now, &code, reason, message
+	cur.Uptime = now.Sub(cur.StartedAt).Round(time.Second).String()
+	if err := l.save(); err != nil {
+		slog.Warn("cannot record the exit in the restart history", "file", l.path, "error", err)
+	}
+}
+
+// Snapshot returns the history, with uptimes worked out
+func (l *restartLog) Snapshot() RestartsResponse {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	resp := RestartsResponse{File: l.path, Mounted: isMountPoint(dataDir()), Reasons: map[string]int{}, Previous: []RestartRun{}}
+	var total time.Duration
+	for i := len(l.runs) - 1; i >= 0; i-- {
+		run := l.runs[i]
+		end := run.end()
+		if i == len(l.runs)-1 {
+			end = time.Now()
+		}
+		total += end.Sub(run.StartedAt)
+		run.Uptime = end.Sub(run.StartedAt).Round(time.Second).String()
+		if i == len(l.runs)-1 {
+			resp.Current = run
+			continue
+		}
+		resp.Previous = append(resp.Previous, run)
+		resp.Reasons[run.Reason]++
+		if run.Pod == resp.Current.Pod {
+			resp.PodRestarts++
+		}
+	}
+	resp.Restarts = len(resp.Previous)
+	resp.TotalUptime = total.Round(time.Second).String()
+	return resp
+}
+
+// restartsHandler serves /api/restarts
+func restartsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	if restartHistory == nil {
+		writeProblem(w, r, http.StatusNotFound, "the restart history is off; set RESTART_HISTORY=true")
+		return
+	}
+	writeJSON(w, http.StatusOK, restartHistory.Snapshot())
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Retries for /api/call and /api/chain, and how they go wrong. A retry is
+// one more request to a downstream that is already failing; when every
+// layer retries, the load multiplies (4 attempts per hop over 3 hops is
+// 64 requests at the bottom) and an overload becomes an outage:
+//
+//	RETRY_MODE=backoff            backoff, or naive: retry at once, no budget
+//	CALL_RETRIES=3                retries after the first attempt
+//	RETRY_BACKOFF_BASE=100ms      exponential backoff from here
+//	RETRY_BACKOFF_MAX=2s          up to here
+//	RETRY_JITTER=true             random in [0, backoff): no synchronized waves
+//	RETRY_BUDGET_RATIO=0.2        retries allowed per first attempt, 0 for no budget
+//	RETRY_BUDGET_MIN_PER_SECOND=5 retries allowed however little traffic there is
+//
+//	curl -X POST 'localhost:30080/chaos/error-rate?percent=100'
+//	curl 'localhost:30080/api/chain?hops=3&mode=naive'   # then watch the metrics
+//
+// The budget is what fixes a storm: with one retry allowed per five first
+// attempts, a dead downstream sees about 1.2x its normal load instead of
+// 4x, as outbound_requests_total{attempt="retry"} shows. It is shared by
+// every outbound call this pod makes, the way Envoy and gRPC budget
+// retries per client rather than per request. ?mode= and ?retries= on
+// either endpoint override the policy, and /api/chain passes them on.
+
+// retryPolicy decides whether, when and how often a call is tried again
+type retryPolicy struct {
+	Mode      string // backoff or naive
+	Retries   int
+	Base, Max time.Duration
+	Jitter    bool
+}
+
+const (
+	retryBackoff = "backoff"
+	retryNaive   = "naive"
+)
+
+// retryPolicyFromQuery applies ?mode= and ?retries= to p
+func retryPolicyFromQuery(w http.ResponseWriter, r *http.Request, p retryPolicy) (retryPolicy, bool) {
+	q := r.URL.Query()
+	if mode := q.Get("mode"); mode != "" {
+		if mode != retryBackoff && mode != retryNaive {
+			writeProblem(w, r, http.StatusBadRequest, "mode must be backoff or naive")
+			return p, false
+		}
+		p.Mode = mode
+	}
+	if q.Get("retries") != "" {
+		n, ok := queryInt(w, r, "retries", 0, maxCallRetries)
+		if !ok {
+			return p, false
+		}
+		p.Retries = int(n)
+	}
+	return p, true
+}
+
+// Why a call stopped early, in CallResponse.StoppedBy
+var (
+	errRetryBudget = errors.New("retry budget exhausted")
+	errRetryCancel = errors.New("request cancelled")
+)
+
+var (
+	outboundRequests = newCounterVec("outbound_requests_total",
+		"Outbound attempts by /api/call and /api/chain, by client and attempt (first, retry).", "client", "attempt")
+	outboundRetriesDenied = newCounterVec("outbound_retries_denied_total",
+		"Retries not made, by client and reason (budget, breaker).", "client", "reason")
+)
+
+func retryPolicyFromEnv() retryPolicy {
+	return retryPolicy{
+		Mode:    getEnv("RETRY_MODE", retryBackoff),
+		Retries: int(getEnvInt("CALL_RETRIES", 3)),
+		Base:    getEnvDuration("RETRY_BACKOFF_BASE", 100*time.Millisecond),
+		Max:     getEnvDuration("RETRY_BACKOFF_MAX", 2*time.Second),
+		Jitter:  getEnvBool("RETRY_JITTER", true),
+	}
+}
+
+// backoff is how long to wait before retry number attempt+1: exponential,
+// and with jitter random in [0, base*2^attempt)
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	if p.Mode == retryNaive || p.Base <= 0 {
+		return 0
+	}
+	if !p.Jitter {
+		return min(p.Base<<attempt, p.Max)
+	}
+	return backoff(attempt, p.Base, p.Max)
+}
+
+// attemptFunc makes one try, returning the status (0 when nothing came
+// back) and a transport error
+type attemptFunc func(ctx context.Context) (int, error)
+
+// do runs try until it succeeds, the retries are used up, or something
+// stops it: the breaker (when not nil), the budget or ctx. It returns the
+// attempts made and what stopped it early.
+func (p retryPolicy) do(ctx context.Context, client string, breaker *circuitBreaker, try attemptFunc) ([]CallAttempt, error) {
+	attempts := []CallAttempt{}
+	for attempt := 0; attempt <= p.Retries; attempt++ {
+		if breaker != nil {
+			if err := breaker.Allow(); err != nil {
+				if attempt > 0 {
+					outboundRetriesDenied.Inc(client, "breaker")
+				}
+				return attempts, err
+			}
+		}
+		kind := "first"
+		if attempt > 0 {
+			kind = "retry"
+		} else if p.Mode != retryNaive {
+			retryBudget.deposit()
+		}
+		outboundRequests.Inc(client, kind)
+
+		a := CallAttempt{Attempt: attempt + 1}
+		start := time.Now()
+		status, err := try(ctx)
+		a.Status, a.LatencyMS = status, float64(time.Since(start).Microseconds())/1000
+		ok := err == nil && !retryable(status)
+		if breaker != nil {
+			breaker.Record(ok)
+		}
+		if err != nil {
+			a.Error = err.Error()
+		}
+		if ok || attempt == p.Retries {
+			return append(attempts, a), nil
+		}
+		if ctx.Err() != nil {
+			return append(attempts, a), errRetryCancel
+		}
+		if p.Mode != retryNaive && !retryBudget.withdraw() {
+			outboundRetriesDenied.Inc(client, "budget")
+			return append(attempts, a), errRetryBudget
+		}
+		sleep := p.backoff(attempt)
+		a.BackoffMS = float64(sleep.Microseconds()) / 1000
+		attempts = append(attempts, a)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return attempts, errRetryCancel
+		}
+	}
+	return attempts, nil
+}
+
+// retryBudgetState is a token bucket: every first attempt adds ratio
+// tokens, every retry takes one, and minPerSecond trickle in regardless
+type retryBudgetState struct {
+	ratio        float64 // 0 is no budget
+	minPerSecond float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// retryBudget is set in serve, from RETRY_BUDGET_RATIO and RETRY_BUDGET_MIN_PER_SECOND
+var retryBudget *retryBudgetState
+
+func newRetryBudgetFromEnv() *retryBudgetState {
+	b := &retryBudgetState{
+		ratio:        getEnvFloat("RETRY_BUDGET_RATIO", 0.2),
+		minPerSecond: getEnvFloat("RETRY_BUDGET_MIN_PER_SECOND", 5),
+		last:         time.Now(),
+	}
+	b.tokens = b.capacity()
+	newGaugeFunc("retry_budget_tokens", "Retries the shared retry budget allows right now.", func() float64 {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.refill()
+		return b.tokens
+	})
+	return b
+}
+
+// capacity is ten seconds' worth of the minimum, so a quiet pod can
+// still retry a short burst of failures
+func (b *retryBudgetState) capacity() float64 { return max(10*b.minPerSecond, 1) }
+
+func (b *retryBudgetState) refill() {
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.minPerSecond, b.capacity())
+	b.last = now
+}
+
+func (b *retryBudgetState) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, b.capacity())
+}
+
+// withdraw reports whether a retry may go ahead, taking its token
+func (b *retryBudgetState) withdraw() bool {
+	if b.ratio <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
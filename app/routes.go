@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/middleware"
+)
+
+// Route describes a registered endpoint. Methods are the ones it answers,
+// declared at registration and enforced; Auth names what guards it once
+// its setting is on: admin (ADMIN_PASSWORD), bearer (JWT) or login (OIDC).
+type Route struct {
+	Path        string   `json:"path"`
+	Methods     []string `json:"methods"`
+	Description string   `json:"description"`
+	Auth        []string `json:"auth,omitempty"`
+}
+
+// What a route's Auth can require
+const (
+	authAdmin  = "admin"  // basic auth, requireBasicAuth
+	authBearer = "bearer" // a JWT, authenticate
+	authLogin  = "login"  // an OIDC session, requireLogin
+)
+
+// routeRegistry wraps a ServeMux and records every route registered through
+// it, so the route list can never drift from what is actually served
+type routeRegistry struct {
+	mux         *http.ServeMux
+	middlewares []middleware.Func
+
+	mu     sync.RWMutex
+	routes []Route
+}
+
+// newRouteRegistry creates a registry around mux whose routes are wrapped
+// in mws, the first one outermost
+func newRouteRegistry(mux *http.ServeMux, mws ...middleware.Func) *routeRegistry {
+	return &routeRegistry{mux: mux, middlewares: mws}
+}
+
+// HandleFunc registers handler for path, answering methods; see Handle
+func (rr *routeRegistry) HandleFunc(path, description string, handler http.HandlerFunc, methods ...string) {
+	rr.Handle(Route{Path: path, Methods: methods, Description: description}, handler)
+}
+
+// Handle registers handler on the mux wrapped in the registry's middleware,
+// and records the route. Its methods are enforced, with a 405 for the rest
+// (GET lets HEAD through too), and Auth login puts the handler behind
+// requireLogin; admin and bearer come from the middleware, by path, and are
+// filled in here. A route without methods is a mistake routes_test catches.
+func (rr *routeRegistry) Handle(route Route, handler http.HandlerFunc) {
+	handler = allowMethods(route.Methods, handler)
+	if slices.Contains(route.Auth, authLogin) {
+		handler = requireLogin(handler)
+	}
+	route.Auth = append(pathAuth(route.Path), route.Auth...)
+	rr.mux.HandleFunc(route.Path, middleware.Chain(route.Path, handler, timeStage, rr.middlewares...))
+
+	rr.mu.Lock()
+	rr.routes = append(rr.routes, route)
+	rr.mu.Unlock()
+}
+
+// pathAuth is what the auth middleware requires of pattern
+func pathAuth(pattern string) []string {
+	var auth []string
+	if protectedPattern(pattern) {
+		auth = append(auth, authAdmin)
+	}
+	if strings.HasPrefix(pattern, "/api/") {
+		auth = append(auth, authBearer)
+	}
+	return auth
+}
+
+// allowMethods answers methods other than the allowed ones with a 405
+func allowMethods(methods []string, next http.HandlerFunc) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(methods, r.Method) || r.Method == http.MethodHead && slices.Contains(methods, http.MethodGet) {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Allow", allow)
+		writeProblem(w, r, http.StatusMethodNotAllowed, "use "+allow)
+	}
+}
+
+// Routes returns a copy of the registered routes in registration order
+func (rr *routeRegistry) Routes() []Route {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	return append([]Route(nil), rr.routes...)
+}
+
+// Paths returns just the registered paths, for logging
+func (rr *routeRegistry) Paths() []string {
+	routes := rr.Routes()
+	paths := make([]string, len(routes))
+	for i, route := range routes {
+		paths[i] = route.Path
+	}
+	return paths
+}
+
+// routesHandler lists the registered routes as JSON: all of them, or
+// those answering ?method= or behind ?auth= (none for the open ones)
+func routesHandler(rr *routeRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		method, auth := strings.ToUpper(r.URL.Query().Get("method")), r.URL.Query().Get("auth")
+		routes := []Route{}
+		for _, route := range rr.Routes() {
+			if method != "" && !slices.Contains(route.Methods, method) {
+				continue
+			}
+			if auth == "none" && len(route.Auth) > 0 || auth != "" && auth != "none" && !slices.Contains(route.Auth, auth) {
+				continue
+			}
+			routes = append(routes, route)
+		}
+		writeJSON(w, http.StatusOK, routes)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"crypto/hmac"
+)
+
+// Object storage on any S3-compatible endpoint, usually MinIO in the
+// cluster (k8s/advanced/minio.yaml):
+//
+//	S3_ENDPOINT=http://minio:9000   S3_BUCKET=go-demo   S3_REGION=us-east-1
+//	S3_ACCESS_KEY_ID / S3_SECRET_ACCESS_KEY from a Secret, as env or files
+//
+// Requests are signed with AWS Signature Version 4 by hand, rather than
+// through the AWS SDK, so the signing steps are there to read, and use
+// path-style URLs (endpoint/bucket/key), which MinIO and AWS both accept.
+// The bucket is a readiness check: no bucket, no traffic.
+
+// s3Client is a minimal S3 client for one bucket
+type s3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+// maxObjectBytes bounds uploads, which are buffered to compute the
+// payload hash the signature needs
+const maxObjectBytes = 16 << 20
+
+// S3Object is one entry of a bucket listing
+type S3Object struct {
+	Key          string    `json:"key" xml:"Key"`
+	Size         int64     `json:"size" xml:"Size"`
+	LastModified time.Time `json:"last_modified" xml:"LastModified"`
+	ETag         string    `json:"etag" xml:"ETag"`
+}
+
+// ObjectsResponse is returned by GET /api/objects
+type ObjectsResponse struct {
+	Endpoint  string     `json:"endpoint"`
+	Bucket    string     `json:"bucket"`
+	Prefix    string     `json:"prefix,omitempty"`
+	Objects   []S3Object `json:"objects"`
+	Truncated bool       `json:"truncated"`
+}
+
+// s3Error is S3's XML error body
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return "S3 returned " + strconv.Itoa(e.Status)
+	}
+	return e.Code + ": " + e.Message
+}
+
+// newS3ClientFromEnv configures a client from S3_ENDPOINT and S3_BUCKET,
+// with credentials from readSecret (AWS_* names work too). ok is false
+// when no endpoint is configured.
+func newS3ClientFromEnv() (client *s3Client, ok bool, err error) {
+	raw := getEnv("S3_ENDPOINT", "")
+	if raw == "" {
+		return nil, false, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, false, errors.New("S3_ENDPOINT must look like http://minio:9000")
+	}
+	c := &s3Client{endpoint: u, bucket: getEnv("S3_BUCKET", ""), region: getEnv("S3_REGION", "us-east-1")}
+	if c.bucket == "" {
+		return nil, false, errors.New("S3_BUCKET is required with S3_ENDPOINT")
+	}
+	for _, names := range [][2]string{{"S3_ACCESS_KEY_ID", "S3_SECRET_ACCESS_KEY"}, {"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"}} {
+		c.accessKey, _ = readSecret(names[0])
+		c.secretKey, _ = readSecret(names[1])
+		if c.accessKey != "" {
+			break
+		}
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, false, errors.New("S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required with S3_ENDPOINT")
+	}
+	return c, true, nil
+}
+
+func (c *s3Client) Name() string { return "s3:" + c.endpoint.Host + "/" + c.bucket }
+
+// Check is the readiness check: HEAD the bucket
+func (c *s3Client) Check(ctx context.Context) error {
+	res, err := c.do(ctx, http.MethodHead, "", nil, nil, "")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// ensureBucketWithRetry creates the bucket when S3_CREATE_BUCKET is set,
+// retrying until the endpoint is up like the guestbook migrations
+func (c *s3Client) ensureBucketWithRetry() {
+	backoff := time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := c.Check(ctx)
+		var s3err *s3Error
+		if errors.As(err, &s3err) && s3err.Status == http.StatusNotFound {
+			var res *http.Response
+			if res, err = c.do(ctx, http.MethodPut, "", nil, nil, ""); err == nil {
+				res.Body.Close()
+				slog.Info("S3 bucket created", "bucket", c.bucket)
+			}
+		}
+		cancel()
+		if err == nil {
+			return
+		}
+		slog.Warn("S3 bucket not available, retrying", "bucket", c.bucket, "error", err, "retry_in", backoff.String())
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// Put uploads an object
+func (c *s3Client) Put(ctx context.Context, key string, body []byte, contentType string) (string, error) {
+	res, err := c.do(ctx, http.MethodPut, key, nil, body, contentType)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	return res.Header.Get("ETag"), nil
+}
+
+// Get opens an object; the caller closes the body
+func (c *s3Client) Get(ctx context.Context, key string) (*http.Response, error) {
+	return c.do(ctx, http.MethodGet, key, nil, nil, "")
+}
+
+// Delete removes an object; S3 reports success for missing keys too
+func (c *s3Client) Delete(ctx context.Context, key string) error {
+	res, err := c.do(ctx, http.MethodDelete, key, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// List returns up to 1000 objects under prefix (ListObjectsV2)
+func (c *s3Client) List(ctx context.Context, prefix string) ([]S3Object, bool, error) {
+	query := url.Values{"list-type": {"2"}, "max-keys": {"1000"}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	res, err := c.do(ctx, http.MethodGet, "", query, nil, "")
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+	var listing struct {
+		Contents    []S3Object `xml:"Contents"`
+		IsTruncated bool       `xml:"IsTruncated"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&listing); err != nil {
+		return nil, false, fmt.Errorf("decoding bucket listing: %w", err)
+	}
+	for i := range listing.Contents {
+		listing.Contents[i].ETag = strings.Trim(listing.Contents[i].ETag, `"`)
+	}
+	return listing.Contents, listing.IsTruncated, nil
+}
+
+// do sends a signed request for key in the bucket ("" for the bucket
+// itself) and turns non-2xx replies into *s3Error
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.sign(req, body, time.Now().UTC())
+
+	res, err := outboundClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	s3err := &s3Error{Status: res.StatusCode}
+	xml.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(s3err) // HEAD replies have no body
+	if s3err.Code == "" && res.StatusCode == http.StatusNotFound {
+		s3err.Code, s3err.Message = "NotFound", "no such bucket or key"
+	}
+	return nil, s3err
+}
+
+// sign adds AWS Signature Version 4 headers to req
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{"host": req.URL.Host, "x-amz-content-sha256": payloadHash, "x-amz-date": amzDate}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		signed = append(signed, "content-type")
+		values["content-type"] = ct
+	}
+	sort.Strings(signed)
+	var headers strings.Builder
+	for _, name := range signed {
+		headers.WriteString(name + ":" + strings.TrimSpace(values[name]) + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		headers.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	for _, part := range []string{c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Escape percent-encodes everything but RFC 3986 unreserved characters,
+// as SigV4 requires; url.PathEscape leaves some sub-delims alone
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' ||
+			ch == '-' || ch == '.' || ch == '_' || ch == '~' || (keepSlash && ch == '/') {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(path string) string { return s3Escape(path, true) }
+
+// s3CanonicalQuery encodes query sorted by key, the form SigV4 signs
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// validObjectKey allows nested keys but nothing that reads as traversal
+func validObjectKey(key string) bool {
+	if key == "" || len(key) > 1024 || strings.HasPrefix(key, "/") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// objectsHandler serves GET /api/objects and GET/PUT/DELETE /api/objects/{key}
+func objectsHandler(c *s3Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/objects"), "/")
+		if key == "" {
+			if !requireMethod(w, r, http.MethodGet) {
+				return
+			}
+			prefix := r.URL.Query().Get("prefix")
+			objects, truncated, err := c.List(r.Context(), prefix)
+			if err != nil {
+				writeS3Error(w, r, err)
+				return
+			}
+			if objects == nil {
+				objects = []S3Object{}
+			}
+			writeJSON(w, http.StatusOK, ObjectsResponse{Endpoint: c.endpoint.String(), Bucket: c.bucket,
+				Prefix: prefix, Objects: objects, Truncated: truncated})
+			return
+		}
+		if !validObjectKey(key) {
+			writeProblem(w, r, http.StatusBadRequest, "key must be slash-separated segments, without empty, '.' or '..' parts")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			res, err := c.Get(r.Context(), key)
+			if err != nil {
+				writeS3Error(w, r, err)
+				return
+			}
+			defer res.Body.Close()
+			for _, h := range []string{"Content-Type", "Content-Length", "ETag", "Last-Modified"} {
+				if v := res.Header.Get(h); v != "" {
+					w.Header().Set(h, v)
+				}
+			}
+			io.Copy(w, res.Body)
+		case http.MethodPut:
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxObjectBytes+1))
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, "cannot read body: "+err.Error())
+				return
+			}
+			if len(body) > maxObjectBytes {
+				writeProblem(w, r, http.StatusRequestEntityTooLarge, "objects are limited to "+strconv.Itoa(maxObjectBytes>>20)+" MiB")
+				return
+			}
+			etag, err := c.Put(r.Context(), key, body, r.Header.Get("Content-Type"))
+			if err != nil {
+				writeS3Error(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, S3Object{Key: key, Size: int64(len(body)), LastModified: time.Now().UTC(), ETag: strings.Trim(etag, `"`)})
+		case http.MethodDelete:
+			if err := c.Delete(r.Context(), key); err != nil {
+				writeS3Error(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"deleted": key})
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			writeProblem(w, r, http.StatusMethodNotAllowed, "use GET, PUT or DELETE")
+		}
+	}
+}
+
+// writeS3Error passes S3's 404s and 403s through; anything else is the
+// dependency failing, a 502
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	var s3err *s3Error
+	if errors.As(err, &s3err) && (s3err.Status == http.StatusNotFound || s3err.Status == http.StatusForbidden) {
+		writeProblem(w, r, s3err.Status, s3err.Error())
+		return
+	}
+	writeProblem(w, r, http.StatusBadGateway, "object storage: "+err.Error())
+}
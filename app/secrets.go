@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Credentials from Kubernetes Secrets. A Secret can reach the container
+// as env vars (secretKeyRef) or as files in a secret volume. Files are
+// updated in place when the Secret is rotated; env vars keep their old
+// value until the pod restarts. /api/secrets shows both side by side
+// without ever revealing a value.
+
+// defaultSecretEnvVars are the env vars listed by /api/secrets unless
+// SECRET_ENV_VARS names others (matches k8s/advanced/secret.yaml)
+var defaultSecretEnvVars = []string{"DB_PASSWORD", "API_KEY", "JWT_SECRET"}
+
+// unlistedSecrets are never listed, from the env or the volume: they are
+// the basic auth credentials of /admin, and a short password's length and
+// unsalted hash prefix would give it away to a wordlist
+var unlistedSecrets = map[string]bool{"ADMIN_USER": true, "ADMIN_PASSWORD": true}
+
+// SecretInfo describes one secret value, redacted
+type SecretInfo struct {
+	Key      string     `json:"key"`
+	Source   string     `json:"source"` // file or env
+	Length   int        `json:"length"`
+	SHA256   string     `json:"sha256"` // first 12 hex chars, enough to spot a rotation
+	Modified *time.Time `json:"modified,omitempty"`
+}
+
+// SecretsResponse is returned by /api/secrets
+type SecretsResponse struct {
+	Dir     string       `json:"dir"`
+	Secrets []SecretInfo `json:"secrets"`
+	Error   string       `json:"error,omitempty"`
+}
+
+func secretsDir() string {
+	return getEnv("SECRETS_DIR", "/etc/secrets")
+}
+
+// readSecret returns a credential by key, preferring the mounted file
+// (which follows rotations) over the setting of the same name
+func readSecret(key string) (string, bool) {
+	value := lookupSetting(key, "string", "")
+	if data, err := os.ReadFile(filepath.Join(secretsDir(), key)); err == nil {
+		settingFromSecretFile(key)
+		return strings.TrimRight(string(data), "\r\n"), true
+	}
+	return value, value != ""
+}
+
+// listSecretFiles describes every key in a secret volume. Kubernetes
+// writes the files through a hidden ..data symlink swapped atomically on
+// rotation; the dot entries are implementation details and skipped.
+func listSecretFiles(dir string) ([]SecretInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var secrets []SecretInfo
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || unlistedSecrets[e.Name()] {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		info, err := os.Stat(path) // follows the symlink
+		if err != nil || info.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		modified := info.ModTime().UTC()
+		secret := redactSecret(e.Name(), "file", string(data))
+		secret.Modified = &modified
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+func redactSecret(key, source, value string) SecretInfo {
+	sum := sha256.Sum256([]byte(value))
+	return SecretInfo{
+		Key:    key,
+		Source: source,
+		Length: len(value),
+		SHA256: hex.EncodeToString(sum[:])[:12],
+	}
+}
+
+// secretsHandler lists which secrets are present, never their values
+func secretsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := SecretsResponse{Dir: secretsDir()}
+	files, err := listSecretFiles(resp.Dir)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Secrets = append(resp.Secrets, files...)
+
+	names := defaultSecretEnvVars
+	if v := getEnv("SECRET_ENV_VARS", ""); v != "" {
+		names = splitList(v)
+	}
+	for _, name := range names {
+		if unlistedSecrets[name] {
+			continue
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			resp.Secrets = append(resp.Secrets, redactSecret(name, "env", v))
+		}
+	}
+	sort.SliceStable(resp.Secrets, func(i, j int) bool { return resp.Secrets[i].Key < resp.Secrets[j].Key })
+	if resp.Secrets == nil {
+		resp.Secrets = []SecretInfo{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// /api/security reports what the container's securityContext left the
+// process with, read from /proc/self/status rather than trusted from the
+// manifest:
+//
+//	securityContext:                      /api/security
+//	  runAsNonRoot: true, runAsUser: 1000   uid: 1000, root: false
+//	  runAsGroup: 3000, fsGroup: 2000       gid: 3000, groups: [2000]
+//	  readOnlyRootFilesystem: true          root_read_only: true
+//	  allowPrivilegeEscalation: false       no_new_privs: true
+//	  seccompProfile: RuntimeDefault        seccomp: filter
+//	  capabilities: {drop: [ALL]}           capabilities.effective: []
+//
+// Without a securityContext a container runs with the runtime's default
+// capabilities (CHOWN, NET_RAW, SETUID, ...), and as root if the image
+// doesn't say otherwise; warnings lists what a hardened pod wouldn't have.
+
+// SecurityResponse is returned by /api/security
+type SecurityResponse struct {
+	UID          int                 `json:"uid"`
+	GID          int                 `json:"gid"`
+	Groups       []int               `json:"groups"` // supplementary, fsGroup among them
+	Root         bool                `json:"root"`
+	RootReadOnly bool                `json:"root_read_only"`
+	NoNewPrivs   bool                `json:"no_new_privs"` // allowPrivilegeEscalation: false
+	Seccomp      string              `json:"seccomp"`      // disabled, strict or filter
+	Capabilities map[string][]string `json:"capabilities"` // effective, permitted, bounding, ambient, inheritable
+	Warnings     []string            `json:"warnings"`
+}
+
+// capabilityNames are the Linux capabilities by bit, as securityContext
+// names them (without CAP_)
+var capabilityNames = []string{
+	"CHOWN", "DAC_OVERRIDE", "DAC_READ_SEARCH", "FOWNER", "FSETID", "KILL", "SETGID", "SETUID",
+	"SETPCAP", "LINUX_IMMUTABLE", "NET_BIND_SERVICE", "NET_BROADCAST", "NET_ADMIN", "NET_RAW",
+	"IPC_LOCK", "IPC_OWNER", "SYS_MODULE", "SYS_RAWIO", "SYS_CHROOT", "SYS_PTRACE", "SYS_PACCT",
+	"SYS_ADMIN", "SYS_BOOT", "SYS_NICE", "SYS_RESOURCE", "SYS_TIME", "SYS_TTY_CONFIG", "MKNOD",
+	"LEASE", "AUDIT_WRITE", "AUDIT_CONTROL", "SETFCAP", "MAC_OVERRIDE", "MAC_ADMIN", "SYSLOG",
+	"WAKE_ALARM", "BLOCK_SUSPEND", "AUDIT_READ", "PERFMON", "BPF", "CHECKPOINT_RESTORE",
+}
+
+// capabilitySets maps /proc/self/status fields to the response's keys
+var capabilitySets = map[string]string{
+	"CapEff:": "effective",
+	"CapPrm:": "permitted",
+	"CapBnd:": "bounding",
+	"CapAmb:": "ambient",
+	"CapInh:": "inheritable",
+}
+
+// dangerousCapabilities are worth a warning when effective
+var dangerousCapabilities = map[string]bool{
+	"SYS_ADMIN": true, "NET_ADMIN": true, "NET_RAW": true, "SYS_PTRACE": true,
+	"SYS_MODULE": true, "DAC_OVERRIDE": true, "SETUID": true, "SETGID": true,
+}
+
+// decodeCapabilities turns a hex capability mask into names
+func decodeCapabilities(hex string) []string {
+	mask, err := strconv.ParseUint(hex, 16, 64)
+	if err != nil {
+		return nil
+	}
+	names := []string{}
+	for bit := 0; bit < 64; bit++ {
+		if mask&(1<<bit) == 0 {
+			continue
+		}
+		if bit < len(capabilityNames) {
+			names = append(names, capabilityNames[bit])
+		} else {
+			names = append(names, "CAP_"+strconv.Itoa(bit))
+		}
+	}
+	return names
+}
+
+// readSecurityStatus fills in what /proc/self/status knows
+func readSecurityStatus(resp *SecurityResponse) error {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch key := fields[0]; key {
+		case "Groups:":
+			for _, g := range fields[1:] {
+				if n, err := strconv.Atoi(g); err == nil {
+					resp.Groups = append(resp.Groups, n)
+				}
+			}
+		case "NoNewPrivs:":
+			resp.NoNewPrivs = fields[1] == "1"
+		case "Seccomp:":
+			resp.Seccomp = map[string]string{"0": "disabled", "1": "strict", "2": "filter"}[fields[1]]
+		default:
+			if set, ok := capabilitySets[key]; ok {
+				resp.Capabilities[set] = decodeCapabilities(fields[1])
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// securityWarnings lists what a restricted Pod Security Standard would refuse
+func securityWarnings(resp SecurityResponse) []string {
+	warnings := []string{}
+	if resp.Root {
+		warnings = append(warnings, "running as root: set runAsNonRoot: true and runAsUser")
+	}
+	if !resp.NoNewPrivs {
+		warnings = append(warnings, "privilege escalation allowed: set allowPrivilegeEscalation: false")
+	}
+	if resp.Seccomp == "disabled" {
+		warnings = append(warnings, "no seccomp filter: set seccompProfile.type: RuntimeDefault")
+	}
+	if !resp.RootReadOnly {
+		warnings = append(warnings, "root filesystem is writable: set readOnlyRootFilesystem: true")
+	}
+	for _, c := range resp.Capabilities["effective"] {
+		if dangerousCapabilities[c] {
+			warnings = append(warnings, "capability "+c+" is effective: drop ALL and add back only what is needed")
+		}
+	}
+	return warnings
+}
+
+// securityHandler serves /api/security
+func securityHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	resp := SecurityResponse{
+		UID:          os.Geteuid(),
+		GID:          os.Getegid(),
+		Groups:       []int{},
+		RootReadOnly: rootReadOnly(),
+		Capabilities: map[string][]string{},
+	}
+	resp.Root = resp.UID == 0
+	if err := readSecurityStatus(&resp); err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "cannot read /proc/self/status: "+err.Error())
+		return
+	}
+	resp.Warnings = securityWarnings(resp)
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/config"
+)
+
+// Load on a timetable, so HPA and dashboard demos run unattended through a
+// workshop: on a cron schedule the app sends load to its own Service,
+// through the same runs as /admin/loadgen:
+//
+//	SELF_LOAD_SCHEDULE="*/20 * * * *"     minute hour day-of-month month day-of-week
+//	SELF_LOAD_RPS=50                      per pod that runs it
+//	SELF_LOAD_DURATION=5m
+//	SELF_LOAD_URL=http://go-app-service/api/compute/primes?n=50000
+//	curl localhost:9090/admin/self-load             # schedule, next run, the run
+//	curl -X POST localhost:9090/admin/self-load     # a run now, schedule or not
+//	curl -X DELETE localhost:9090/admin/self-load   # stop the run
+//
+// Like every config key these reload from the ConfigMap (self_load.rps,
+// self_load.schedule, ...), so editing it reschedules without a restart,
+// and /api/config shows the schedule in force. The schedule is in the
+// pod's time zone, UTC in the image, and takes numbers, *, a-b, */n and
+// lists, or @hourly and @daily. A run still going when the next one is
+// due keeps going; the due one is skipped.
+//
+// Every replica keeps the schedule, so the total is RPS times the replica
+// count, and grows as the HPA scales out. With ENABLE_LEADER_ELECTION only
+// the leader sends load, which keeps the total fixed.
+
+var selfLoadConfigKeys = []config.Key{
+	{Name: "self_load.schedule", Env: "SELF_LOAD_SCHEDULE", Default: ""},
+	{Name: "self_load.rps", Env: "SELF_LOAD_RPS", Default: "20"},
+	{Name: "self_load.duration", Env: "SELF_LOAD_DURATION", Default: "5m"},
+	{Name: "self_load.url", Env: "SELF_LOAD_URL", Default: "http://go-app-service/api/info"},
+}
+
+func init() {
+	appConfigs.Register(selfLoadConfigKeys...)
+}
+
+var selfLoadRuns = newCounterVec("self_load_runs_total",
+	"Scheduled self-load runs by result (started, skipped_running, not_leader).", "result")
+
+// selfLoadPlan is parsed from one config snapshot
+type selfLoadPlan struct {
+	config   *config.Config // the snapshot it was parsed from
+	spec     string
+	schedule *cronSchedule // nil when there is no schedule
+	load     loadgenConfig
+	loadErr  error // bad rps, duration or url: no runs at all
+	err      error // why the schedule is off, loadErr included
+}
+
+var currentSelfLoad atomic.Pointer[selfLoadPlan]
+
+// selfLoadPlanFor returns the plan for the current config, parsing it
+// again only after a reload
+func selfLoadPlanFor(c *config.Config) *selfLoadPlan {
+	if p := currentSelfLoad.Load(); p != nil && p.config == c {
+		return p
+	}
+	p := &selfLoadPlan{config: c, spec: c.Get("self_load.schedule")}
+	q := url.Values{"url": {c.Get("self_load.url")}, "rps": {c.Get("self_load.rps")}, "duration": {c.Get("self_load.duration")}}
+	p.load, p.loadErr = loadgenConfigFromQuery(q)
+	p.err = p.loadErr
+	if p.err == nil && p.spec != "" {
+		p.schedule, p.err = parseCron(p.spec)
+	}
+	if p.err != nil && p.spec != "" {
+		slog.Error("self-load schedule disabled", "schedule", p.spec, "error", p.err)
+		p.schedule = nil
+	}
+	currentSelfLoad.Store(p)
+	return p
+}
+
+// runSelfLoadSchedule starts a run at each minute the schedule matches,
+// until ctx ends
+func runSelfLoadSchedule(ctx context.Context) {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			return
+		}
+		p := selfLoadPlanFor(appConfig())
+		if p.schedule == nil || !p.schedule.Matches(next) {
+			continue
+		}
+		switch {
+		case elector != nil && !elector.Status().IsLeader:
+			selfLoadRuns.Inc("not_leader")
+		case startLoadgenRun(p.load, "schedule") != nil:
+			selfLoadRuns.Inc("skipped_running")
+			slog.Info("self-load run skipped: the last one is still going", "schedule", p.spec)
+		default:
+			selfLoadRuns.Inc("started")
+		}
+	}
+}
+
+// SelfLoadStatus is returned by /admin/self-load
+type SelfLoadStatus struct {
+	Schedule   string        `json:"schedule"`
+	RPS        float64       `json:"rps"`
+	Duration   string        `json:"duration"`
+	URL        string        `json:"url"`
+	Error      string        `json:"error,omitempty"` // why the schedule is off
+	NextRun    *time.Time    `json:"next_run,omitempty"`
+	LeaderOnly bool          `json:"leader_only"` // runs only while this pod leads
+	Run        LoadgenStatus `json:"run"`         // as in /admin/loadgen
+}
+
+func selfLoadStatus() SelfLoadStatus {
+	p := selfLoadPlanFor(appConfig())
+	s := SelfLoadStatus{Schedule: p.spec, RPS: p.load.RPS, Duration: p.load.Duration.String(), URL: p.load.URL,
+		LeaderOnly: elector != nil, Run: loadgenStatus()}
+	if p.err != nil {
+		s.Error = p.err.Error()
+	}
+	if p.schedule != nil {
+		if next := p.schedule.Next(time.Now()); !next.IsZero() {
+			s.NextRun = &next
+		}
+	}
+	return s
+}
+
+// selfLoadHandler reports (GET), starts a run now (POST) or stops the
+// run (DELETE)
+func selfLoadHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, selfLoadStatus())
+	case http.MethodPost:
+		p := selfLoadPlanFor(appConfig())
+		if p.loadErr != nil {
+			writeProblem(w, r, http.StatusBadRequest, "invalid self-load settings: "+p.loadErr.Error())
+			return
+		}
+		if err := startLoadgenRun(p.load, "admin"); err != nil {
+			writeProblem(w, r, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, selfLoadStatus())
+	case http.MethodDelete:
+		stopLoadgenRun()
+		writeJSON(w, http.StatusOK, selfLoadStatus())
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeProblem(w, r, http.StatusMethodNotAllowed, "use GET, POST or DELETE")
+	}
+}
+
+// cronSchedule is a five-field cron expression, each field a bitset of
+// the values it allows
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool // "*": cron matches either day field when both are set
+}
+
+// cronMacros are the shorthands parseCron accepts
+var cronMacros = map[string]string{
+	"@hourly": "0 * * * *",
+	"@daily":  "0 0 * * *",
+}
+
+// parseCron reads "minute hour day-of-month month day-of-week"
+func parseCron(spec string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[strings.TrimSpace(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q: want 5 fields, minute hour day-of-month month day-of-week", spec)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("%q: field %d: %w", spec, i+1, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1 // 7 is Sunday too
+	}
+	return &cronSchedule{minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*"}, nil
+}
+
+// parseCronField reads a comma-separated list of *, n, a-b, each with an
+// optional /step
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step %q", stepStr)
+			}
+			step = n
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value %q", rng)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad range %q", rng)
+				}
+			} else if hasStep {
+				to = hi // 5/15 is 5-59/15
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// Matches reports whether the schedule fires in t's minute
+func (c *cronSchedule) Matches(t time.Time) bool {
+	if c.minute&(1<<t.Minute()) == 0 || c.hour&(1<<t.Hour()) == 0 || c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	domOK, dowOK := c.dom&(1<<t.Day()) != 0, c.dow&(1<<int(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+// Next is the first minute after t the schedule fires in, zero if none
+// within a year (like February 30th)
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	for end := next.AddDate(1, 0, 0); next.Before(end); next = next.Add(time.Minute) {
+		if c.Matches(next) {
+			return next
+		}
+	}
+	return time.Time{}
+}
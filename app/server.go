@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Server limits. A zero-value http.Server waits forever for slow clients,
+// which is how a handful of slowloris connections can tie up a pod:
+//
+//	HTTP_READ_HEADER_TIMEOUT  time to send the request headers   (5s)
+//	HTTP_READ_TIMEOUT         time to send the whole request     (30s)
+//	HTTP_WRITE_TIMEOUT        time to write the response         (0, off)
+//	HTTP_IDLE_TIMEOUT         keep-alive time between requests   (120s)
+//	HTTP_MAX_HEADER_BYTES     request header size limit          (1 MiB)
+//	HTTP_MAX_CONNS            concurrent connections, 0 for none (0)
+//
+// The write timeout is off by default because the load endpoints run for
+// minutes; /events and the /ws/ streams opt out of it either way. At HTTP_MAX_CONNS
+// new connections wait in the kernel's accept queue rather than being
+// refused, so clients see latency before they see errors. Watch it all on
+// the admin port:
+//
+//	curl localhost:9090/debug/connections
+
+// serverConfig is the http.Server limits, from the environment
+type serverConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	MaxConns          int // 0 is unlimited
+}
+
+func serverConfigFromEnv() serverConfig {
+	return serverConfig{
+		ReadHeaderTimeout: getEnvDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       getEnvDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      getEnvDuration("HTTP_WRITE_TIMEOUT", 0),
+		IdleTimeout:       getEnvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    int(getEnvInt("HTTP_MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)),
+		MaxConns:          int(getEnvInt("HTTP_MAX_CONNS", 0)),
+	}
+}
+
+// apply sets the limits on srv and tracks its connections
+func (c serverConfig) apply(srv *http.Server) {
+	srv.ReadHeaderTimeout = c.ReadHeaderTimeout
+	srv.ReadTimeout = c.ReadTimeout
+	srv.WriteTimeout = c.WriteTimeout
+	srv.IdleTimeout = c.IdleTimeout
+	srv.MaxHeaderBytes = c.MaxHeaderBytes
+	srv.ConnState = connections.track
+}
+
+// listener wraps ln with the connection limit, when there is one
+func (c serverConfig) listener(ln net.Listener) net.Listener {
+	if c.MaxConns <= 0 {
+		return ln
+	}
+	return newLimitListener(ln, c.MaxConns)
+}
+
+var (
+	httpConnections = newGaugeVec("http_connections",
+		"Open connections on the app port, by state.", "state")
+	connLimitWaits = newCounterVec("http_connection_limit_waits_total",
+		"Connections that had to wait for a free slot under HTTP_MAX_CONNS.")
+)
+
+// limitListener caps concurrent connections: Accept blocks while the limit
+// is reached, and a slot frees up when a connection is closed
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(ln net.Listener, n int) *limitListener {
+	return &limitListener{Listener: ln, slots: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		connLimitWaits.Inc()
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.done:
+			return nil, net.ErrClosed
+		}
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, release: sync.OnceFunc(func() { <-l.slots })}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+// connTracker follows connections through http.ConnState transitions
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]*trackedConn
+}
+
+type trackedConn struct {
+	remote   string
+	state    http.ConnState
+	opened   time.Time
+	changed  time.Time
+	requests int
+}
+
+var connections = &connTracker{conns: map[net.Conn]*trackedConn{}}
+
+// track is an http.Server ConnState hook
+func (t *connTracker) track(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	tc, ok := t.conns[conn]
+	if ok {
+		httpConnections.Add(-1, tc.state.String())
+	} else {
+		tc = &trackedConn{remote: conn.RemoteAddr().String(), opened: now}
+	}
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		// Terminal; hijacked connections (WebSockets) are no longer the server's
+		delete(t.conns, conn)
+		return
+	case http.StateActive:
+		tc.requests++
+	}
+	tc.state, tc.changed = state, now
+	t.conns[conn] = tc
+	httpConnections.Add(1, state.String())
+}
+
+// ConnectionInfo is one open connection in /debug/connections
+type ConnectionInfo struct {
+	Remote         string  `json:"remote"`
+	State          string  `json:"state"`
+	AgeSeconds     float64 `json:"age_seconds"`
+	InStateSeconds float64 `json:"in_state_seconds"`
+	Requests       int     `json:"requests"` // more than one means keep-alive reuse
+}
+
+// ServerLimits is serverConfig for display; "0s" means no timeout
+type ServerLimits struct {
+	ReadHeaderTimeout string `json:"read_header_timeout"`
+	ReadTimeout       string `json:"read_timeout"`
+	WriteTimeout      string `json:"write_timeout"`
+	IdleTimeout       string `json:"idle_timeout"`
+	MaxHeaderBytes    int    `json:"max_header_bytes"`
+	MaxConns          int    `json:"max_conns,omitempty"`
+}
+
+// ConnectionsResponse is returned by /debug/connections
+type ConnectionsResponse struct {
+	Limits  ServerLimits     `json:"limits"`
+	Open    int              `json:"open"`
+	ByState map[string]int   `json:"by_state"`
+	Conns   []ConnectionInfo `json:"connections"`
+}
+
+// connectionsHandler lists the app port's open connections, oldest first
+func connectionsHandler(cfg serverConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		limits := ServerLimits{
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout.String(),
+			ReadTimeout:       cfg.ReadTimeout.String(),
+			WriteTimeout:      cfg.WriteTimeout.String(),
+			IdleTimeout:       cfg.IdleTimeout.String(),
+			MaxHeaderBytes:    cfg.MaxHeaderBytes,
+			MaxConns:          cfg.MaxConns,
+		}
+		resp := ConnectionsResponse{Limits: limits, ByState: map[string]int{}, Conns: []ConnectionInfo{}}
+		connections.mu.Lock()
+		for _, tc := range connections.conns {
+			resp.ByState[tc.state.String()]++
+			resp.Conns = append(resp.Conns, ConnectionInfo{
+				Remote:         tc.remote,
+				State:          tc.state.String(),
+				AgeSeconds:     now.Sub(tc.opened).Round(time.Millisecond).Seconds(),
+				InStateSeconds: now.Sub(tc.changed).Round(time.Millisecond).Seconds(),
+				Requests:       tc.requests,
+			})
+		}
+		connections.mu.Unlock()
+		resp.Open = len(resp.Conns)
+		sort.Slice(resp.Conns, func(i, j int) bool { return resp.Conns[i].AgeSeconds > resp.Conns[j].AgeSeconds })
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// /api/serviceaccount shows what is inside the pod's service account token.
+// Since Kubernetes 1.22 the mount is a projected volume and the token is a
+// bound token: it names the audience it is for, expires (an hour by
+// default, projected with expirationSeconds), and dies with the pod it is
+// bound to. The kubelet rewrites the file once 80% of its lifetime has
+// passed, so watching file_age and fingerprint shows the rotation:
+//
+//	curl localhost:8080/api/serviceaccount
+//	kubectl exec <pod> -- ls -la /var/run/secrets/kubernetes.io/serviceaccount   # ..data symlink swap
+//
+// The claims are decoded, not verified: only the API server can say the
+// token is valid (a TokenReview). Old Secret-based tokens have no expiry
+// and no pod binding, which is why they were replaced. SERVICE_ACCOUNT_TOKEN
+// points at a token projected elsewhere, e.g. one with a custom audience.
+
+// ServiceAccountResponse is returned by /api/serviceaccount
+type ServiceAccountResponse struct {
+	TokenPath   string         `json:"token_path"`
+	Fingerprint string         `json:"fingerprint"` // sha256 prefix, changes on rotation
+	FileAge     string         `json:"file_age"`
+	FileWritten time.Time      `json:"file_written"`
+	Bound       bool           `json:"bound"` // false for a legacy Secret token
+	Issuer      string         `json:"issuer,omitempty"`
+	Subject     string         `json:"subject,omitempty"`
+	Audience    []string       `json:"audience,omitempty"`
+	IssuedAt    *time.Time     `json:"issued_at,omitempty"`
+	ExpiresAt   *time.Time     `json:"expires_at,omitempty"`
+	ExpiresIn   string         `json:"expires_in,omitempty"`
+	Lifetime    string         `json:"lifetime,omitempty"`
+	RefreshDue  *time.Time     `json:"refresh_due,omitempty"` // when the kubelet rewrites the file
+	Namespace   string         `json:"namespace,omitempty"`
+	Account     string         `json:"service_account,omitempty"`
+	Pod         *boundObject   `json:"pod,omitempty"`
+	Node        *boundObject   `json:"node,omitempty"`
+	Claims      map[string]any `json:"claims"`
+}
+
+// boundObject is an object the token is bound to
+type boundObject struct {
+	Name string `json:"name"`
+	UID  string `json:"uid"`
+}
+
+// serviceAccountClaims are the JWT claims a kube-apiserver issues
+type serviceAccountClaims struct {
+	Issuer    string  `json:"iss"`
+	Subject   string  `json:"sub"`
+	Audience  jwtAud  `json:"aud"`
+	IssuedAt  float64 `json:"iat"`
+	ExpiresAt float64 `json:"exp"`
+	Kube      struct {
+		Namespace      string       `json:"namespace"`
+		Pod            *boundObject `json:"pod"`
+		Node           *boundObject `json:"node"`
+		ServiceAccount boundObject  `json:"serviceaccount"`
+	} `json:"kubernetes.io"`
+	// Legacy Secret-based tokens use flat claims instead
+	LegacyNamespace string `json:"kubernetes.io/serviceaccount/namespace"`
+	LegacyAccount   string `json:"kubernetes.io/serviceaccount/service-account.name"`
+}
+
+// jwtAud is the aud claim, which may be a string or a list
+type jwtAud []string
+
+func (a *jwtAud) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*a = jwtAud{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// decodeJWTPayload returns the raw claims of a JWT without checking the
+// signature
+func decodeJWTPayload(token string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT (want header.payload.signature)")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, errors.New("JWT payload is not base64url: " + err.Error())
+	}
+	return payload, nil
+}
+
+// unixTime converts a NumericDate claim, nil when absent
+func unixTime(v float64) *time.Time {
+	if v == 0 {
+		return nil
+	}
+	t := time.Unix(int64(v), 0).UTC()
+	return &t
+}
+
+// inspectServiceAccountToken reads and decodes the token at path
+func inspectServiceAccountToken(path string) (ServiceAccountResponse, error) {
+	resp := ServiceAccountResponse{TokenPath: path}
+	info, err := os.Stat(path) // follows ..data to the current token
+	if err != nil {
+		return resp, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return resp, err
+	}
+	token := strings.TrimSpace(string(data))
+	sum := sha256.Sum256([]byte(token))
+	resp.Fingerprint = hex.EncodeToString(sum[:6])
+	resp.FileWritten = info.ModTime().UTC()
+	resp.FileAge = time.Since(info.ModTime()).Round(time.Second).String()
+
+	payload, err := decodeJWTPayload(token)
+	if err != nil {
+		return resp, err
+	}
+	var claims serviceAccountClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return resp, errors.New("JWT claims: " + err.Error())
+	}
+	json.Unmarshal(payload, &resp.Claims)
+
+	resp.Issuer, resp.Subject, resp.Audience = claims.Issuer, claims.Subject, claims.Audience
+	resp.IssuedAt, resp.ExpiresAt = unixTime(claims.IssuedAt), unixTime(claims.ExpiresAt)
+	resp.Namespace, resp.Account = claims.Kube.Namespace, claims.Kube.ServiceAccount.Name
+	resp.Pod, resp.Node = claims.Kube.Pod, claims.Kube.Node
+	if resp.Namespace == "" {
+		resp.Namespace, resp.Account = claims.LegacyNamespace, claims.LegacyAccount
+	}
+	resp.Bound = resp.ExpiresAt != nil && resp.Pod != nil
+	if resp.ExpiresAt != nil {
+		resp.ExpiresIn = time.Until(*resp.ExpiresAt).Round(time.Second).String()
+		if resp.IssuedAt != nil {
+			lifetime := resp.ExpiresAt.Sub(*resp.IssuedAt)
+			resp.Lifetime = lifetime.String()
+			refresh := resp.IssuedAt.Add(lifetime * 8 / 10)
+			resp.RefreshDue = &refresh
+		}
+	}
+	return resp, nil
+}
+
+// serviceAccountHandler serves GET /api/serviceaccount
+func serviceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	path := getEnv("SERVICE_ACCOUNT_TOKEN", filepath.Join(serviceAccountDir, "token"))
+	resp, err := inspectServiceAccountToken(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeProblem(w, r, http.StatusNotFound, "no service account token at "+path+" (not in a cluster, or automountServiceAccountToken: false)")
+			return
+		}
+		writeProblem(w, r, http.StatusInternalServerError, path+": "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/config"
+)
+
+// Startup settings and where each one came from. Every getEnv* call looks
+// its key up in four layers, the first one that has it wins:
+//
+//	app serve -port 9000 -set JOB_WORKERS=8      flag
+//	JOB_WORKERS=8                                env
+//	job_workers: 8                               CONFIG_FILE, read once at start
+//	getEnvInt("JOB_WORKERS", 2)                  default
+//
+// File keys are the env var in lower case, dots allowed for nesting
+// (server: {port: 9000} is SERVER_PORT); message and log_level stay live
+// settings of /api/config. Every setting is read through getEnv*, or
+// readSecret for credentials, where a file in SECRETS_DIR comes before the
+// four layers. The few os.Getenv calls left read what isn't one: the Go
+// runtime's own GOMAXPROCS, GOMEMLIMIT, TZ and TMPDIR, reload's handoff
+// between generations, and the live layers of /api/config and the feature
+// flags, re-read on change.
+//
+// A value that doesn't parse or validate used to be logged and swapped
+// for the default; now every such value, and every setting like UPSTREAMS
+// or JWT_* that fails as a whole, is collected while the servers start and
+// the pod fails with all of them at once, rather than one per
+// CrashLoopBackOff round. /api/config/effective lists what was read.
+
+// EffectiveSetting is one setting the app read
+type EffectiveSetting struct {
+	Key      string `json:"key"`
+	Type     string `json:"type"` // string, bool, int, float or duration
+	Value    string `json:"value,omitempty"`
+	Default  string `json:"default"`
+	Source   string `json:"source"` // secret, flag, env, file or default
+	Redacted bool   `json:"redacted,omitempty"`
+	Error    string `json:"error,omitempty"` // the default was used instead
+}
+
+// EffectiveConfigResponse is returned by /api/config/effective
+type EffectiveConfigResponse struct {
+	Precedence []string           `json:"precedence"`
+	File       string             `json:"file"`
+	FileError  string             `json:"file_error,omitempty"`
+	Settings   []EffectiveSetting `json:"settings"`
+	Errors     []string           `json:"errors"`
+}
+
+var settings = struct {
+	mu        sync.Mutex
+	flags     map[string]bool   // keys given on the command line
+	file      map[string]string // CONFIG_FILE values, by env var name
+	fileName  string
+	fileError string
+	read      map[string]*EffectiveSetting
+	invalid   []error // settings that failed as a whole, see failedSetting
+}{flags: map[string]bool{}, file: map[string]string{}, read: map[string]*EffectiveSetting{}}
+
+// settingChecks validate values beyond their type
+var settingChecks = map[string]func(string) error{
+	"PORT":              validPort,
+	"ADMIN_PORT":        validPort,
+	"GRPC_PORT":         validPort,
+	"TCP_PORT":          validPort,
+	"UDP_PORT":          validPort,
+	"HTTPS_PUBLIC_PORT": validPort,
+	"LOG_LEVEL": func(value string) error {
+		var level slog.Level
+		return level.UnmarshalText([]byte(value))
+	},
+}
+
+var secretSettingName = regexp.MustCompile(`PASSWORD|SECRET|TOKEN|CREDENTIAL|_KEY$`)
+
+func validPort(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n < 0 || n > 65535 {
+		return errors.New("not a port number (0-65535)")
+	}
+	return nil
+}
+
+// settingFlags is -set KEY=value, repeatable
+type settingFlags map[string]string
+
+func (s settingFlags) String() string { return "" }
+
+func (s settingFlags) Set(kv string) error {
+	key, value, ok := strings.Cut(kv, "=")
+	if !ok || key == "" {
+		return errors.New("want KEY=value")
+	}
+	s[key] = value
+	return nil
+}
+
+// addSettingFlags defines serve's flags: shortcuts for the common settings
+// and -set for the rest. applySettingFlags takes the parsed result.
+func addSettingFlags(fs *flag.FlagSet) func() {
+	shortcuts := map[string]*string{
+		"PORT":        fs.String("port", "", "app port (PORT)"),
+		"ADMIN_PORT":  fs.String("admin-port", "", "probe and admin port, 0 to share the app port (ADMIN_PORT)"),
+		"GRPC_PORT":   fs.String("grpc-port", "", "gRPC port, 0 to disable (GRPC_PORT)"),
+		"LOG_LEVEL":   fs.String("log-level", "", "debug, info, warn or error (LOG_LEVEL)"),
+		"CONFIG_FILE": fs.String("config", "", "YAML config file (CONFIG_FILE)"),
+	}
+	set := settingFlags{}
+	fs.Var(set, "set", "any setting as `KEY=value`, repeatable; wins over env and file")
+	return func() {
+		for key, value := range shortcuts {
+			if *value != "" {
+				set[key] = *value
+			}
+		}
+		applySettingFlags(set)
+	}
+}
+
+func applySettingFlags(set settingFlags) {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	for key, value := range set {
+		os.Setenv(key, value)
+		settings.flags[key] = true
+	}
+}
+
+// loadSettingsFile reads the file layer; a broken file is left to
+// appConfigs.Load to report
+func loadSettingsFile(path string) {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	settings.fileName = path
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			settings.fileError = err.Error()
+		}
+		return
+	}
+	values, err := config.Parse(data)
+	if err != nil {
+		settings.fileError = err.Error()
+		return
+	}
+	live := map[string]bool{}
+	for _, k := range appConfigs.Keys() {
+		live[k.Name] = true
+	}
+	for k, v := range values {
+		if !live[k] {
+			settings.file[strings.ToUpper(strings.ReplaceAll(k, ".", "_"))] = v
+		}
+	}
+}
+
+// lookupSetting returns the raw value of key, "" when no layer has it, and
+// records the read for /api/config/effective
+func lookupSetting(key, kind, fallback string) string {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	s := &EffectiveSetting{Key: key, Type: kind, Default: fallback, Source: "default", Value: fallback}
+	value := os.Getenv(key)
+	switch {
+	case value != "" && settings.flags[key]:
+		s.Source = "flag"
+	case value != "":
+		s.Source = "env"
+	case settings.file[key] != "":
+		value, s.Source = settings.file[key], "file"
+	}
+	if value != "" {
+		s.Value = value
+	}
+	settings.read[key] = s
+	return value
+}
+
+// settingFromSecretFile marks key, just read by lookupSetting, as coming
+// from a SECRETS_DIR file; its value is never recorded
+func settingFromSecretFile(key string) {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	if s := settings.read[key]; s != nil {
+		s.Source, s.Value = "secret", ""
+	}
+}
+
+// settingSource is where key's value came from, for layers that read the
+// env themselves
+func settingSource(key string) string {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	if settings.flags[key] {
+		return "flag"
+	}
+	return "env"
+}
+
+// checkSetting runs key's validation, if any, and records a failure
+func checkSetting(key, value string) error {
+	if check := settingChecks[key]; check != nil {
+		if err := check(value); err != nil {
+			settingError(key, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// settingError records why key's value was not used
+func settingError(key string, err error) {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	if s := settings.read[key]; s != nil {
+		s.Error = err.Error()
+	}
+}
+
+// failedSetting records a setting, or a group of them such as the JWT
+// ones, that failed as a whole; the feature stays off and serve fails with
+// it among the rest
+func failedSetting(name string, err error) {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	settings.invalid = append(settings.invalid, fmt.Errorf("%s: %w", name, err))
+}
+
+// settingsErrors joins every invalid value read so far, nil when all were fine
+func settingsErrors() error {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	errs := append([]error(nil), settings.invalid...)
+	for _, s := range sortedSettings() {
+		if s.Error == "" {
+			continue
+		}
+		if secretSettingName.MatchString(s.Key) {
+			errs = append(errs, fmt.Errorf("%s (%s): %s", s.Key, s.Source, s.Error))
+		} else {
+			errs = append(errs, fmt.Errorf("%s=%q (%s): %s", s.Key, redactURLPassword(s.Value), s.Source, s.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// redactURLPassword masks the password of a URL setting, DATABASE_URL or
+// BROKER_URL, whose name doesn't say it holds one
+func redactURLPassword(v string) string {
+	u, err := url.Parse(v)
+	if err != nil || u.User == nil {
+		return v
+	}
+	if _, ok := u.User.Password(); !ok {
+		return v
+	}
+	return u.Redacted()
+}
+
+// sortedSettings is called with settings.mu held
+func sortedSettings() []EffectiveSetting {
+	list := make([]EffectiveSetting, 0, len(settings.read))
+	for _, s := range settings.read {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// effectiveConfigHandler lists every setting read, its value and layer
+func effectiveConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	settings.mu.Lock()
+	resp := EffectiveConfigResponse{
+		Precedence: []string{"secret", "flag", "env", "file", "default"},
+		File:       settings.fileName,
+		FileError:  settings.fileError,
+		Settings:   sortedSettings(),
+		Errors:     []string{},
+	}
+	settings.mu.Unlock()
+	for i := range resp.Settings {
+		s := &resp.Settings[i]
+		if s.Source == "secret" || secretSettingName.MatchString(s.Key) && s.Source != "default" {
+			s.Value, s.Redacted = "", true
+		} else if v := redactURLPassword(s.Value); v != s.Value {
+			s.Value, s.Redacted = v, true
+		}
+		if s.Error != "" {
+			resp.Errors = append(resp.Errors, s.Key+": "+s.Error)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
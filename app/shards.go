@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Work partitioning: a background worker splits SHARDS shards of work
+// (queue partitions, tenant ranges, cron buckets) between the replicas, so
+// each shard is worked on by one pod and scaling out spreads the load:
+//
+//	SHARDS=10 SHARD_ASSIGNMENT=ordinal SHARD_REPLICAS=3   shard % 3 == the pod's ordinal
+//	SHARDS=10 SHARD_ASSIGNMENT=lease                      one Lease per shard, claimed at runtime
+//	curl -s localhost:8080/api/shards | jq '{owned, assignments: [.assignments[] | {shard, owner}]}'
+//	kubectl get leases -n go-demo -l shard-set=go-app-shard -w
+//
+// Ordinal assignment needs no coordination: go-app-cluster-1 of three
+// always owns 1, 4 and 7. It also has no failover. While a pod is down
+// its shards wait for it to come back, and scaling the StatefulSet means
+// changing SHARD_REPLICAS on every pod, which rolls them all.
+//
+// Lease assignment keeps a coordination.k8s.io/v1 Lease per shard
+// (go-app-shard-0, ...). Every leaseRetry each pod renews what it holds and
+// claims free or expired shards up to its fair share, the shard count over
+// the ready replicas, rounded up; a pod over its share releases the extras
+// for the newcomer. Delete a pod and its shards move once their leases
+// expire (leaseDuration), or at once when it shuts down cleanly and
+// releases them. Scale from 2 to 3 and watch shards change hands. A pod
+// that can't renew for renewDeadline stops working its shards, like the
+// leader does, since someone else may have them by then.
+//
+// The default is ordinal for a StatefulSet pod and lease otherwise. Lease
+// assignment needs get/list/create/update on leases (k8s/advanced/rbac.yaml).
+
+// shardWorkInterval is how often the worker does one item per shard it owns
+const shardWorkInterval = time.Second
+
+// shardOwner is who works on one shard
+type shardOwner struct {
+	owner   string // "" while unclaimed
+	renewed time.Time
+	self    bool
+}
+
+// shardWorker claims shards and works the ones it owns
+type shardWorker struct {
+	mode     string // ordinal or lease
+	count    int
+	identity string
+
+	ordinal  podOrdinal // ordinal mode
+	replicas int        // SHARD_REPLICAS in ordinal mode, ready replicas seen in lease mode
+
+	kube   *kubeClient // lease mode
+	prefix string
+
+	mu        sync.Mutex
+	owners    []shardOwner
+	leases    map[int]kubeLease // the last version seen of each shard's Lease
+	fairShare int
+	processed []int64
+	syncedAt  time.Time // last complete lease sync
+	lastError string
+}
+
+// shardWork is nil unless SHARDS is set
+var shardWork *shardWorker
+
+var (
+	shardItems = newCounterVec("shard_items_processed_total",
+		"Work items this pod processed, by shard.", "shard")
+	shardChanges = newCounterVec("shard_assignment_changes_total",
+		"Shards this pod gained or gave up, by change (claimed, released, lost).", "change")
+)
+
+func init() {
+	newGaugeFunc("shards_owned", "Shards this pod currently works on.", func() float64 {
+		if shardWork == nil {
+			return 0
+		}
+		return float64(len(shardWork.Status().Owned))
+	})
+}
+
+// newShardWorkerFromEnv reads the SHARD* settings; nil when SHARDS is unset
+func newShardWorkerFromEnv() (*shardWorker, error) {
+	count := int(getEnvInt("SHARDS", 0))
+	if count <= 0 {
+		return nil, nil
+	}
+	identity, _ := os.Hostname()
+	ordinal, hasOrdinal := statefulSetOrdinal()
+	w := &shardWorker{count: count, identity: identity, mode: getEnv("SHARD_ASSIGNMENT", "lease"),
+		owners: make([]shardOwner, count), leases: map[int]kubeLease{}, processed: make([]int64, count)}
+	if getEnv("SHARD_ASSIGNMENT", "") == "" && hasOrdinal {
+		w.mode = "ordinal"
+	}
+	switch w.mode {
+	case "ordinal":
+		if !hasOrdinal {
+			return nil, fmt.Errorf("SHARD_ASSIGNMENT=ordinal needs a StatefulSet pod or POD_ORDINAL")
+		}
+		w.ordinal, w.replicas = ordinal, int(getEnvInt("SHARD_REPLICAS", 0))
+		if w.replicas <= 0 {
+			return nil, fmt.Errorf("SHARD_ASSIGNMENT=ordinal needs SHARD_REPLICAS, the StatefulSet's replica count")
+		}
+		w.assignByOrdinal()
+	case "lease":
+		kube, err := inClusterKube()
+		if err != nil {
+			return nil, fmt.Errorf("SHARD_ASSIGNMENT=lease needs the Kubernetes API: %w", err)
+		}
+		w.kube, w.prefix = kube, getEnv("SHARD_LEASE_PREFIX", "go-app-shard")
+	default:
+		return nil, fmt.Errorf("SHARD_ASSIGNMENT=%q: want ordinal or lease", w.mode)
+	}
+	return w, nil
+}
+
+// assignByOrdinal gives shard s to ordinal s % replicas
+func (w *shardWorker) assignByOrdinal() {
+	for s := range w.owners {
+		n := s % w.replicas
+		w.owners[s] = shardOwner{owner: w.ordinal.set + "-" + strconv.Itoa(n), self: n == w.ordinal.ordinal}
+	}
+	w.fairShare = (w.count + w.replicas - 1) / w.replicas
+	if w.ordinal.ordinal >= w.replicas {
+		slog.Warn("ordinal is beyond SHARD_REPLICAS, no shards for this pod",
+			"ordinal", w.ordinal.ordinal, "replicas", w.replicas)
+	}
+	slog.Info("shards assigned by ordinal", "owned", w.ownedLocked())
+}
+
+// Run works the owned shards and, in lease mode, keeps the claims up to
+// date, until ctx ends
+func (w *shardWorker) Run(ctx context.Context) {
+	work := time.NewTicker(shardWorkInterval)
+	defer work.Stop()
+	claims := time.NewTicker(leaseRetry)
+	defer claims.Stop()
+	if w.mode == "lease" {
+		w.syncLeases(ctx)
+	}
+	for {
+		select {
+		case <-work.C:
+			w.work()
+		case <-claims.C:
+			if w.mode == "lease" {
+				w.syncLeases(ctx)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// work does one item for each owned shard
+func (w *shardWorker) work() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for s, o := range w.owners {
+		if o.self {
+			w.processed[s]++
+			shardItems.Inc(strconv.Itoa(s))
+		}
+	}
+}
+
+func (w *shardWorker) leasesPath() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + w.kube.namespace + "/leases"
+}
+
+func (w *shardWorker) leaseName(shard int) string {
+	return w.prefix + "-" + strconv.Itoa(shard)
+}
+
+// syncLeases renews, releases and claims shard Leases for one round
+func (w *shardWorker) syncLeases(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, leaseRetry)
+	defer cancel()
+	err := w.trySyncLeases(ctx)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err == nil {
+		w.lastError = ""
+		return
+	}
+	w.lastError = err.Error()
+	if time.Since(w.syncedAt) <= renewDeadline {
+		return
+	}
+	var lost []int
+	for s := range w.owners {
+		if w.owners[s].self {
+			w.owners[s].self = false
+			lost = append(lost, s)
+		}
+	}
+	if len(lost) > 0 {
+		shardChanges.Add(float64(len(lost)), "lost")
+		slog.Warn("stopped working shards, could not renew their leases", "shards", lost, "error", err)
+		podEvents.Record("Warning", "ShardsLost", fmt.Sprintf("stopped working shards %v: leases not renewed for %s: %v", lost, renewDeadline, err))
+	}
+}
+
+func (w *shardWorker) trySyncLeases(ctx context.Context) error {
+	var list struct {
+		Items []kubeLease `json:"items"`
+	}
+	selector := url.QueryEscape("shard-set=" + w.prefix)
+	if err := w.kube.Do(ctx, http.MethodGet, w.leasesPath()+"?labelSelector="+selector, nil, &list); err != nil {
+		return err
+	}
+	leases := map[int]kubeLease{}
+	for _, l := range list.Items {
+		l.APIVersion, l.Kind = "coordination.k8s.io/v1", "Lease" // list items leave them out
+		if s, err := strconv.Atoi(l.Metadata.Labels["shard"]); err == nil && s >= 0 && s < w.count && l.Metadata.Name == w.leaseName(s) {
+			leases[s] = l
+		}
+	}
+
+	// The fair share counts the ready replicas, and the pods holding
+	// shards in case some of them aren't ready
+	now := time.Now()
+	members := map[string]bool{w.identity: true}
+	for _, l := range leases {
+		if h := l.Spec.HolderIdentity; h != "" && !leaseExpired(l, now) {
+			members[h] = true
+		}
+	}
+	replicas := len(members)
+	if peers, err := discoverPeers(ctx); err == nil {
+		ready := 0
+		for _, p := range peers.Peers {
+			if p.Ready || p.Self {
+				ready++
+			}
+		}
+		replicas = max(replicas, ready)
+	}
+	fair := (w.count + replicas - 1) / replicas
+
+	var mine []int
+	for s := 0; s < w.count; s++ {
+		if leases[s].Spec.HolderIdentity == w.identity {
+			mine = append(mine, s)
+		}
+	}
+	var claimed, released []int
+	var firstErr error
+	keep := func(err error) {
+		if firstErr == nil && !isKubeStatus(err, http.StatusConflict) {
+			firstErr = err // a 409 is another pod winning a race
+		}
+	}
+	// Over the share (someone joined): give the highest shards back
+	for len(mine) > fair {
+		s := mine[len(mine)-1]
+		mine = mine[:len(mine)-1]
+		l := leases[s]
+		l.Spec.HolderIdentity = ""
+		l.Spec.LeaseDurationSeconds = 1
+		l.Spec.RenewTime = now.UTC().Format(kubeMicroTime)
+		if err := w.kube.Do(ctx, http.MethodPut, w.leasesPath()+"/"+w.leaseName(s), l, &l); err != nil {
+			keep(err)
+			continue
+		}
+		leases[s] = l
+		released = append(released, s)
+	}
+	for _, s := range mine {
+		l := leases[s]
+		l.Spec.LeaseDurationSeconds = int(leaseDuration / time.Second)
+		l.Spec.RenewTime = now.UTC().Format(kubeMicroTime)
+		if err := w.kube.Do(ctx, http.MethodPut, w.leasesPath()+"/"+w.leaseName(s), l, &l); err != nil {
+			keep(err)
+			continue
+		}
+		leases[s] = l
+	}
+	// Under the share: take free and expired shards, lowest first
+	held := len(mine)
+	for s := 0; s < w.count && held < fair; s++ {
+		l, exists := leases[s]
+		if exists && (l.Spec.HolderIdentity == w.identity || l.Spec.HolderIdentity != "" && !leaseExpired(l, now)) {
+			continue
+		}
+		if !exists {
+			l = kubeLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+			l.Metadata = kubeObjectMeta{Name: w.leaseName(s), Namespace: w.kube.namespace,
+				Labels: map[string]string{"shard-set": w.prefix, "shard": strconv.Itoa(s)}}
+		} else {
+			l.Spec.LeaseTransitions++
+		}
+		l.Spec.HolderIdentity = w.identity
+		l.Spec.LeaseDurationSeconds = int(leaseDuration / time.Second)
+		l.Spec.AcquireTime = now.UTC().Format(kubeMicroTime)
+		l.Spec.RenewTime = l.Spec.AcquireTime
+		var err error
+		if exists {
+			err = w.kube.Do(ctx, http.MethodPut, w.leasesPath()+"/"+w.leaseName(s), l, &l)
+		} else {
+			err = w.kube.Do(ctx, http.MethodPost, w.leasesPath(), l, &l)
+		}
+		if err != nil {
+			keep(err)
+			continue
+		}
+		leases[s] = l
+		claimed = append(claimed, s)
+		held++
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.leases, w.replicas, w.fairShare = leases, replicas, fair
+	for s := range w.owners {
+		o := shardOwner{}
+		if l, ok := leases[s]; ok && l.Spec.HolderIdentity != "" && !leaseExpired(l, time.Now()) {
+			o.owner = l.Spec.HolderIdentity
+			o.renewed, _ = time.Parse(kubeMicroTime, l.Spec.RenewTime)
+			o.self = o.owner == w.identity
+		}
+		w.owners[s] = o
+	}
+	if firstErr == nil {
+		w.syncedAt = now
+	}
+	if len(claimed) > 0 || len(released) > 0 {
+		shardChanges.Add(float64(len(claimed)), "claimed")
+		shardChanges.Add(float64(len(released)), "released")
+		owned := w.ownedLocked()
+		slog.Info("shard assignment changed", "owned", owned, "claimed", claimed, "released", released, "fair_share", fair)
+		podEvents.Record("Normal", "ShardsAssigned", fmt.Sprintf("now works shards %v (claimed %v, released %v, fair share %d of %d over %d replicas)",
+			owned, claimed, released, fair, w.count, replicas))
+	}
+	return firstErr
+}
+
+// Release gives up this pod's shard Leases on shutdown, so the others
+// take them over right away instead of after they expire
+func (w *shardWorker) Release(ctx context.Context) {
+	if w.mode != "lease" {
+		return
+	}
+	w.mu.Lock()
+	var mine []kubeLease
+	for s, o := range w.owners {
+		if o.self {
+			mine = append(mine, w.leases[s])
+			w.owners[s] = shardOwner{}
+		}
+	}
+	w.mu.Unlock()
+	released := 0
+	for _, l := range mine {
+		l.Spec.HolderIdentity = ""
+		l.Spec.LeaseDurationSeconds = 1
+		l.Spec.RenewTime = time.Now().UTC().Format(kubeMicroTime)
+		if err := w.kube.Do(ctx, http.MethodPut, w.leasesPath()+"/"+l.Metadata.Name, l, nil); err != nil {
+			slog.Warn("shard lease release failed", "lease", l.Metadata.Name, "error", err)
+			continue
+		}
+		released++
+	}
+	if released > 0 {
+		shardChanges.Add(float64(released), "released")
+		slog.Info("released shard leases", "count", released)
+	}
+}
+
+// ownedLocked lists the shards this pod works on; w.mu must be held
+func (w *shardWorker) ownedLocked() []int {
+	owned := []int{}
+	for s, o := range w.owners {
+		if o.self {
+			owned = append(owned, s)
+		}
+	}
+	return owned
+}
+
+// ShardAssignment is one shard in /api/shards
+type ShardAssignment struct {
+	Shard     int        `json:"shard"`
+	Owner     string     `json:"owner,omitempty"` // "" while unclaimed
+	Self      bool       `json:"self"`
+	RenewedAt *time.Time `json:"renewed_at,omitempty"` // lease mode
+	Processed int64      `json:"processed"`            // items this pod did for the shard, ever
+}
+
+// ShardsResponse is returned by /api/shards
+type ShardsResponse struct {
+	Enabled     bool              `json:"enabled"`
+	Mode        string            `json:"mode,omitempty"` // ordinal or lease
+	Identity    string            `json:"identity,omitempty"`
+	Shards      int               `json:"shards,omitempty"`
+	Replicas    int               `json:"replicas,omitempty"`   // SHARD_REPLICAS, or the ready replicas last seen
+	FairShare   int               `json:"fair_share,omitempty"` // most shards one pod takes
+	Owned       []int             `json:"owned"`
+	Unowned     int               `json:"unowned"` // shards nobody works on right now
+	Assignments []ShardAssignment `json:"assignments"`
+	SyncedAt    *time.Time        `json:"synced_at,omitempty"` // last complete lease sync
+	Error       string            `json:"error,omitempty"`
+}
+
+// Status is the ownership map as this pod sees it
+func (w *shardWorker) Status() ShardsResponse {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	resp := ShardsResponse{Enabled: true, Mode: w.mode, Identity: w.identity, Shards: w.count,
+		Replicas: w.replicas, FairShare: w.fairShare, Owned: w.ownedLocked(), Assignments: []ShardAssignment{}, Error: w.lastError}
+	for s, o := range w.owners {
+		a := ShardAssignment{Shard: s, Owner: o.owner, Self: o.self, Processed: w.processed[s]}
+		if !o.renewed.IsZero() {
+			renewed := o.renewed
+			a.RenewedAt = &renewed
+		}
+		if o.owner == "" {
+			resp.Unowned++
+		}
+		resp.Assignments = append(resp.Assignments, a)
+	}
+	if !w.syncedAt.IsZero() {
+		synced := w.syncedAt
+		resp.SyncedAt = &synced
+	}
+	return resp
+}
+
+// shardsHandler shows who works on each shard
+func shardsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	if shardWork == nil {
+		writeJSON(w, http.StatusOK, ShardsResponse{Enabled: false, Owned: []int{}, Assignments: []ShardAssignment{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, shardWork.Status())
+}
+
+// kubeMicroTime is the layout of metav1.MicroTime
+const kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// kubeLease is a coordination.k8s.io/v1 Lease
+type kubeLease struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   kubeObjectMeta `json:"metadata"`
+	Spec       struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+func leaseExpired(lease kubeLease, now time.Time) bool {
+	renewed, err := time.Parse(kubeMicroTime, lease.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	duration := time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second
+	return now.After(renewed.Add(duration))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// defaultGracePeriod matches the pod spec default terminationGracePeriodSeconds
+const defaultGracePeriod = 30 * time.Second
+
+// Shutdown strategies selectable via SHUTDOWN_STRATEGY
+const (
+	shutdownGraceful  = "graceful"  // srv.Shutdown: stop accepting, wait for in-flight requests
+	shutdownImmediate = "immediate" // srv.Close: drop every open connection right away
+)
+
+// shutdownConfig controls how the server stops on SIGTERM/SIGINT
+type shutdownConfig struct {
+	Strategy    string
+	Delay       time.Duration // keep serving this long after SIGTERM before draining
+	Timeout     time.Duration // how long a graceful drain may take
+	GracePeriod time.Duration // the pod's terminationGracePeriodSeconds
+}
+
+// inFlight counts requests currently being handled, requestsServed every
+// request since startup
+var inFlight, requestsServed atomic.Int64
+
+// trackInFlight keeps inFlight and requestsServed up to date for every request
+func trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsServed.Add(1)
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streamsClosing is closed when shutdown starts. srv.Shutdown doesn't wait
+// for hijacked connections like WebSockets, so long-lived streams watch
+// this to say goodbye and let clients reconnect to another pod, and count
+// themselves in activeStreams so the drain waits for that goodbye.
+var (
+	streamsClosing = make(chan struct{})
+	closeStreams   = sync.OnceFunc(func() { close(streamsClosing) })
+	activeStreams  sync.WaitGroup
+)
+
+// exceedsGracePeriod reports whether an app-level shutdown timeout leaves no
+// headroom inside the pod's termination grace period. Kubelet sends SIGKILL
+// when the grace period ends, so a drain that is allowed to run that long
+// (or longer) can be cut off mid-way.
+func exceedsGracePeriod(shutdownTimeout, gracePeriod time.Duration) bool {
+	return gracePeriod > 0 && shutdownTimeout >= gracePeriod
+}
+
+// runServer runs serve until it fails or a termination signal arrives, then
+// stops srv according to cfg and returns the signal. A second signal forces
+// an immediate exit, like pressing Ctrl+C twice.
+func runServer(srv *http.Server, serve func() error, cfg shutdownConfig) os.Signal {
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- serve() }()
+
+	srv.RegisterOnShutdown(closeStreams)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	var sig os.Signal
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("server failed", "error", err)
+		}
+		return nil
+	case <-listenerHandedOff:
+		slog.Info("listener handed off, draining", "successor_pid", successor.Pid, "timeout", cfg.Timeout.String())
+		registration.deregister()
+		cfg.Delay = 0 // nothing has to stop routing here first: the successor shares the socket
+		shutdown(srv, cfg)
+		return syscall.SIGUSR2
+	case sig = <-signals:
+		slog.Info("shutting down", "signal", sig.String(), "strategy", cfg.Strategy,
+			"delay", cfg.Delay.String(), "timeout", cfg.Timeout.String(), "grace_period", cfg.GracePeriod.String())
+	}
+
+	go func() {
+		sig := <-signals
+		slog.Warn("received second signal, exiting immediately", "signal", sig.String())
+		terminate(1, "ForcedExit", "second signal during shutdown: "+sig.String(), nil)
+	}()
+
+	// Out of the registry first: unlike the endpoints, nothing else removes it
+	registration.deregister()
+	shutdown(srv, cfg)
+	return sig
+}
+
+// shutdown stops srv using the configured strategy. A graceful shutdown
+// first fails readiness and keeps serving for cfg.Delay: endpoint removal
+// reaches kube-proxy and Ingress controllers asynchronously, so requests keep
+// arriving for a few seconds after SIGTERM. Only then does it drain, and a
+// drain that runs out of time falls back to Close, force-closing whatever is left.
+func shutdown(srv *http.Server, cfg shutdownConfig) {
+	if cfg.Strategy == shutdownImmediate {
+		active := inFlight.Load()
+		srv.Close()
+		slog.Info("server closed immediately", "dropped_requests", active)
+		return
+	}
+
+	if exceedsGracePeriod(cfg.Delay+cfg.Timeout, cfg.GracePeriod) {
+		slog.Warn("shutdown delay + timeout is not shorter than the termination grace period; kubelet may SIGKILL the pod mid-drain",
+			"delay", cfg.Delay.String(), "timeout", cfg.Timeout.String(), "grace_period", cfg.GracePeriod.String())
+	}
+
+	ready.Store(false)
+	if cfg.Delay > 0 {
+		slog.Info("readiness now failing, still serving before drain", "delay", cfg.Delay.String())
+		time.Sleep(cfg.Delay)
+	}
+
+	// Ask clients to reconnect elsewhere instead of reusing this connection
+	srv.SetKeepAlivesEnabled(false)
+	slog.Info("draining", "in_flight", inFlight.Load())
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		active := inFlight.Load()
+		srv.Close()
+		slog.Warn("drain timed out, force-closed remaining requests", "timeout", cfg.Timeout.String(), "force_closed", active)
+		return
+	}
+	streamsDone := make(chan struct{})
+	go func() {
+		activeStreams.Wait()
+		close(streamsDone)
+	}()
+	select {
+	case <-streamsDone:
+	case <-ctx.Done():
+		slog.Warn("drain timed out waiting for streams to close", "timeout", cfg.Timeout.String())
+		return
+	}
+	slog.Info("server stopped, all in-flight requests completed")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logTo sends slog output to a buffer for the rest of the test
+func logTo(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestShutdownForceClosesAfterTimeout(t *testing.T) {
+	logs := logTo(t)
+	t.Cleanup(func() { ready.Store(true) })
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	ts := httptest.NewServer(trackInFlight(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})))
+	defer ts.Close()
+
+	clientErr := make(chan error, 1)
+	go func() {
+		resp, err := ts.Client().Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		clientErr <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never reached the handler")
+	}
+	if n := inFlight.Load(); n != 1 {
+		t.Fatalf("in flight = %d, want 1", n)
+	}
+
+	begin := time.Now()
+	shutdown(ts.Config, shutdownConfig{Strategy: shutdownGraceful, Timeout: 100 * time.Millisecond})
+	if took := time.Since(begin); took > 2*time.Second {
+		t.Errorf("shutdown took %s with a 100ms timeout", took)
+	}
+
+	select {
+	case err := <-clientErr:
+		if err == nil {
+			t.Error("blocked request completed; want its connection force-closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked request still open after shutdown")
+	}
+	out := logs.String()
+	if !strings.Contains(out, "drain timed out, force-closed remaining requests") {
+		t.Errorf("no force-close in the logs:\n%s", out)
+	}
+	if !strings.Contains(out, "force_closed=1") {
+		t.Errorf("logs don't report the one in-flight request:\n%s", out)
+	}
+	if ready.Load() {
+		t.Error("still ready after shutdown")
+	}
+}
+
+func TestShutdownDrainsFinishedRequests(t *testing.T) {
+	logs := logTo(t)
+	t.Cleanup(func() { ready.Store(true) })
+
+	ts := httptest.NewServer(trackInFlight(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	shutdown(ts.Config, shutdownConfig{Strategy: shutdownGraceful, Timeout: time.Second})
+	if out := logs.String(); !strings.Contains(out, "all in-flight requests completed") || strings.Contains(out, "force-closed") {
+		t.Errorf("want a clean drain, got:\n%s", out)
+	}
+}
+
+func TestExceedsGracePeriod(t *testing.T) {
+	tests := []struct {
+		name           string
+		timeout, grace time.Duration
+		want           bool
+	}{
+		{"shorter than the grace period", 25 * time.Second, 30 * time.Second, false},
+		{"equal to the grace period", 30 * time.Second, 30 * time.Second, true},
+		{"longer than the grace period", 45 * time.Second, 30 * time.Second, true},
+		{"no grace period", 30 * time.Second, 0, false},
+		{"no grace period and no timeout", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exceedsGracePeriod(tt.timeout, tt.grace); got != tt.want {
+				t.Errorf("exceedsGracePeriod(%s, %s) = %v, want %v", tt.timeout, tt.grace, got, tt.want)
+			}
+		})
+	}
+}
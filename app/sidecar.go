@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// sidecar-logs is the other half of ACCESS_LOG_FILE: a second container in
+// the pod tails the file from a shared emptyDir and re-emits each line as
+// JSON on its own stdout, tagged with pod metadata, where kubectl logs
+// and node-level collectors find it - a small Fluent Bit:
+//
+//	app sidecar-logs -file=/var/log/app/access.log
+//
+// It follows the file across rotation (a new file at the path) and
+// truncation, and on SIGTERM ships what's left before exiting. Lines that
+// aren't JSON are wrapped as {"message": ...}. See
+// k8s/advanced/sidecar-logging.yaml.
+
+// shippedMeta is attached to every forwarded line under "kubernetes", the
+// key Fluent Bit's kubernetes filter uses
+type shippedMeta struct {
+	Pod       string `json:"pod_name,omitempty"`
+	Namespace string `json:"namespace_name,omitempty"`
+	Node      string `json:"host,omitempty"`
+	Container string `json:"container_name,omitempty"` // the container that wrote the file
+}
+
+func runSidecarLogs(args []string) int {
+	fs := newFlagSet("sidecar-logs", "")
+	path := fs.String("file", getEnv("SIDECAR_LOG_FILE", "/var/log/app/access.log"), "file to follow")
+	container := fs.String("container", getEnv("SIDECAR_SOURCE_CONTAINER", "go-app"), "container name reported for the lines")
+	poll := fs.Duration("poll", 250*time.Millisecond, "how often to check for new lines")
+	fromStart := fs.Bool("from-start", true, "ship lines already in the file; false starts at the end")
+	fs.Parse(args)
+
+	setupLogging(getEnv("LOG_LEVEL", "info"))
+	hostname, _ := os.Hostname()
+	meta := shippedMeta{
+		Pod:       getEnv("POD_NAME", hostname),
+		Namespace: getEnv("POD_NAMESPACE", ""),
+		Node:      getEnv("NODE_NAME", ""),
+		Container: *container,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	slog.Info("sidecar following log file", "file", *path, "container", *container)
+	out := json.NewEncoder(os.Stdout)
+	shipped, err := followFile(ctx, *path, *poll, *fromStart, func(line string) {
+		out.Encode(shipLine(line, *path, meta))
+	})
+	if err != nil {
+		slog.Error("sidecar stopped", "file", *path, "error", err, "lines", shipped)
+		return 1
+	}
+	slog.Info("sidecar stopped", "file", *path, "lines", shipped)
+	return 0
+}
+
+// shipLine decodes a JSON line, or wraps a plain one, and adds metadata
+func shipLine(line, path string, meta shippedMeta) map[string]any {
+	record := map[string]any{}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		record = map[string]any{"message": line}
+	}
+	record["kubernetes"] = meta
+	record["source"] = path
+	return record
+}
+
+// followFile calls emit for every complete line written to path until ctx
+// ends, then drains to EOF. It waits for the file to appear, and reopens
+// from the start when the path is replaced or the file shrinks.
+func followFile(ctx context.Context, path string, poll time.Duration, fromStart bool, emit func(string)) (int, error) {
+	var (
+		f       *os.File
+		reader  *bufio.Reader
+		offset  int64
+		partial string
+		lines   int
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		if f == nil {
+			opened, err := os.Open(path)
+			if err != nil && !os.IsNotExist(err) {
+				return lines, err
+			}
+			if opened != nil {
+				f, offset, partial = opened, 0, ""
+				if !fromStart {
+					offset, _ = f.Seek(0, io.SeekEnd)
+				}
+				fromStart = true // files that appear later are read whole
+				reader = bufio.NewReader(f)
+			}
+		}
+
+		// Read everything available
+		for f != nil {
+			chunk, err := reader.ReadString('\n')
+			offset += int64(len(chunk))
+			if err == nil {
+				emit(strings.TrimRight(partial+chunk, "\r\n"))
+				partial = ""
+				lines++
+				continue
+			}
+			partial += chunk // no newline yet: the rest is still being written
+			if !errors.Is(err, io.EOF) {
+				return lines, err
+			}
+			break
+		}
+
+		if ctx.Err() != nil {
+			if partial != "" {
+				emit(partial)
+				lines++
+			}
+			return lines, nil
+		}
+		select {
+		case <-ctx.Done():
+			continue // one last read
+		case <-ticker.C:
+		}
+
+		// Rotated or truncated: start over on whatever is at path now
+		if f != nil {
+			current, err := os.Stat(path)
+			opened, statErr := f.Stat()
+			switch {
+			case err != nil || statErr != nil || !os.SameFile(current, opened):
+				// Finish the old file first; its last lines may still be unread
+				rest, _ := io.ReadAll(reader)
+				if tail := strings.TrimRight(partial+string(rest), "\r\n"); tail != "" {
+					for _, line := range strings.Split(tail, "\n") {
+						emit(line)
+						lines++
+					}
+				}
+				slog.Info("log file rotated, reopening", "file", path)
+				f.Close()
+				f = nil
+			case current.Size() < offset:
+				slog.Info("log file truncated, reading from the start", "file", path)
+				f.Seek(0, io.SeekStart)
+				reader.Reset(f)
+				offset, partial = 0, ""
+			}
+		}
+	}
+}
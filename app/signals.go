@@ -0,0 +1,163 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// /api/signals lists every signal the process received, to make the pod
+// termination sequence concrete:
+//
+//	kubectl delete pod <pod> &
+//	kubectl exec <pod> -- wget -qO- localhost:8080/api/signals   # during SHUTDOWN_DELAY
+//	kubectl logs <pod> --previous | grep signal
+//
+// kubectl delete runs the preStop hook first (it can call
+// /api/signals/prestop to show up here), then sends SIGTERM, then SIGKILL
+// once terminationGracePeriodSeconds is up. SIGKILL can't be caught, but
+// TERMINATION_DELAY keeps the process alive that long after draining, and
+// the pod's exit code 137 shows the kill. SIGHUP and SIGUSR1/2 are recorded
+// and otherwise ignored instead of killing the process, except SIGUSR2
+// under HOT_RELOAD, which starts the next generation (reload.go).
+
+// observedSignals are the signals recorded; SIGQUIT is left alone so it
+// still dumps goroutines
+var observedSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// ReceivedSignal is one signal, or a preStop hook call
+type ReceivedSignal struct {
+	Signal      string    `json:"signal"`
+	Number      int       `json:"number,omitempty"`
+	Time        time.Time `json:"time"`
+	SinceStart  string    `json:"since_start"`
+	SinceFirst  string    `json:"since_first,omitempty"` // since the first SIGTERM or preStop
+	Description string    `json:"description"`
+}
+
+// SignalsResponse is returned by /api/signals
+type SignalsResponse struct {
+	Pod              string           `json:"pod"`
+	PID              int              `json:"pid"`
+	Signals          []ReceivedSignal `json:"signals"`
+	TerminationDelay string           `json:"termination_delay,omitempty"`
+	GracePeriod      string           `json:"grace_period"`
+}
+
+var signalLog struct {
+	mu      sync.Mutex
+	signals []ReceivedSignal
+	first   time.Time
+}
+
+// describeSignal says what each signal usually means in a pod
+func describeSignal(name string) string {
+	switch name {
+	case "terminated":
+		return "SIGTERM: the kubelet asks the container to stop (pod deleted, evicted, rolled)"
+	case "interrupt":
+		return "SIGINT: Ctrl+C on a terminal, not sent by Kubernetes"
+	case "hangup":
+		return "SIGHUP: conventionally reload config; recorded and ignored"
+	case "preStop":
+		return "preStop hook called; SIGTERM follows when it returns"
+	}
+	return "user-defined signal; recorded and ignored"
+}
+
+// recordSignal appends an event to the log
+func recordSignal(name string, number int) ReceivedSignal {
+	now := time.Now()
+	signalLog.mu.Lock()
+	defer signalLog.mu.Unlock()
+	s := ReceivedSignal{Signal: name, Number: number, Time: now,
+		SinceStart: now.Sub(startTime).Round(time.Millisecond).String(), Description: describeSignal(name)}
+	if name == "terminated" || name == "preStop" {
+		if signalLog.first.IsZero() {
+			signalLog.first = now
+		}
+	}
+	if !signalLog.first.IsZero() {
+		s.SinceFirst = now.Sub(signalLog.first).Round(time.Millisecond).String()
+	}
+	if len(signalLog.signals) < 100 {
+		signalLog.signals = append(signalLog.signals, s)
+	}
+	return s
+}
+
+// watchSignals records observedSignals as they arrive. runServer has its
+// own subscription for SIGTERM and SIGINT, so both see them.
+func watchSignals() {
+	ch := make(chan os.Signal, 8)
+	signal.Notify(ch, observedSignals...)
+	go func() {
+		for sig := range ch {
+			number := 0
+			if s, ok := sig.(syscall.Signal); ok {
+				number = int(s)
+			}
+			s := recordSignal(sig.String(), number)
+			slog.Info("signal received", "signal", sig.String(), "number", number, "since_start", s.SinceStart)
+		}
+	}()
+}
+
+// receivedSignals returns a copy of the log
+func receivedSignals() []ReceivedSignal {
+	signalLog.mu.Lock()
+	defer signalLog.mu.Unlock()
+	return append([]ReceivedSignal{}, signalLog.signals...)
+}
+
+// lingerAfterShutdown keeps the process alive for TERMINATION_DELAY after
+// the drain, logging each second, so a delay past the grace period ends in
+// SIGKILL (exit code 137) just as a slow shutdown would
+func lingerAfterShutdown(gracePeriod time.Duration) {
+	delay := getEnvDuration("TERMINATION_DELAY", 0)
+	if delay <= 0 {
+		return
+	}
+	slog.Info("delaying exit", "termination_delay", delay.String(), "grace_period", gracePeriod.String(),
+		"sigkill_expected", gracePeriod > 0 && delay >= gracePeriod)
+	deadline := time.Now().Add(delay)
+	for time.Now().Before(deadline) {
+		time.Sleep(min(time.Second, time.Until(deadline)))
+		slog.Info("still running after shutdown", "remaining", time.Until(deadline).Round(time.Second).String())
+	}
+}
+
+// signalsHandler serves GET /api/signals
+func signalsHandler(gracePeriod time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+		hostname, _ := os.Hostname()
+		resp := SignalsResponse{Pod: hostname, PID: os.Getpid(), Signals: receivedSignals(), GracePeriod: gracePeriod.String()}
+		if d := getEnvDuration("TERMINATION_DELAY", 0); d > 0 {
+			resp.TerminationDelay = d.String()
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// preStopHandler records a preStop hook's httpGet, optionally holding it
+// for ?sleep= the way "sleep 5" preStop hooks buy time for endpoint removal
+func preStopHandler(w http.ResponseWriter, r *http.Request) {
+	s := recordSignal("preStop", 0)
+	slog.Info("preStop hook called", "since_start", s.SinceStart, "remote", r.RemoteAddr)
+	if v := r.URL.Query().Get("sleep"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > 5*time.Minute {
+			writeProblem(w, r, http.StatusBadRequest, "sleep must be a Go duration up to 5m")
+			return
+		}
+		time.Sleep(d)
+	}
+	writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-route SLOs with error budgets and multiwindow burn rates, worked out
+// in the app so the numbers can be read before anyone writes the recording
+// rules for them:
+//
+//	SLO_AVAILABILITY_TARGET=99.9    share of requests that aren't 5xx
+//	SLO_LATENCY_TARGET=99           share of requests faster than SLO_LATENCY_THRESHOLD (300ms)
+//	SLO_ROUTES=/api/compute/fib/=99.5:2s,/api/info=99.99:50ms   per-route overrides
+//	curl localhost:30080/api/slo
+//
+// The burn rate is how fast a window spends the budget: 1 uses exactly the
+// budget over the SLO period, 14.4 spends 2% of a 30-day budget in an hour.
+// The alerts follow the SRE workbook's multiwindow rule, a long window to
+// be sure and a short one to stop paging once it's over: page when both 1h
+// and 5m burn faster than 14.4, ticket when 6h and 30m burn faster than 6.
+// The budget itself is counted since the pod started, so it resets on a
+// restart; slo_requests_total{sli,result} has the same counts for
+// Prometheus to keep over the real 30 days:
+//
+//	sum(rate(slo_requests_total{sli="availability",result="bad"}[1h])) / sum(rate(slo_requests_total{sli="availability"}[1h])) / 0.001
+//
+// /chaos/error-rate and ?delay= make a budget burn on demand. Probes and
+// scrapes aren't counted.
+
+// sloWindows are the burn-rate windows, shortest first
+var sloWindows = []struct {
+	name    string
+	minutes int
+}{{"5m", 5}, {"30m", 30}, {"1h", 60}, {"6h", 360}}
+
+// sloMinutes is how much per-minute history a route keeps: the longest window
+const sloMinutes = 360
+
+// Burn-rate thresholds of the two alerts
+const (
+	sloPageBurnRate   = 14.4
+	sloTicketBurnRate = 6
+)
+
+// sloObjective is what a route promises
+type sloObjective struct {
+	availability float64 // percent
+	latency      float64 // percent
+	threshold    time.Duration
+}
+
+// sloMinute is one minute of a route's requests
+type sloMinute struct {
+	unix                int64 // the minute, as unix seconds / 60
+	total, errors, slow int64
+}
+
+// sloRoute is one route's objective and history
+type sloRoute struct {
+	objective           sloObjective
+	total, errors, slow int64 // since start
+	minutes             [sloMinutes]sloMinute
+}
+
+// sloTracker holds every route that has been requested
+type sloTracker struct {
+	defaults  sloObjective
+	overrides map[string]sloObjective
+
+	mu     sync.Mutex
+	routes map[string]*sloRoute
+}
+
+// SLIReport is one SLI of one route
+type SLIReport struct {
+	Target          float64            `json:"target_percent"`
+	Threshold       string             `json:"threshold,omitempty"` // latency only
+	SLI             float64            `json:"sli_percent"`         // since start
+	Good            int64              `json:"good"`
+	Bad             int64              `json:"bad"`
+	BudgetRemaining float64            `json:"error_budget_remaining"` // 1 untouched, 0 spent, below 0 overspent
+	BurnRates       map[string]float64 `json:"burn_rates"`             // by window
+	Alert           string             `json:"alert"`                  // none, ticket or page
+}
+
+// RouteSLO is one route in /api/slo
+type RouteSLO struct {
+	Route        string    `json:"route"`
+	Requests     int64     `json:"requests"`
+	Availability SLIReport `json:"availability"`
+	Latency      SLIReport `json:"latency"`
+}
+
+// SLOResponse is returned by /api/slo
+type SLOResponse struct {
+	Pod    string     `json:"pod"`
+	Since  time.Time  `json:"since"`
+	Routes []RouteSLO `json:"routes"` // worst budget first
+}
+
+var (
+	// slos is set in main
+	slos *sloTracker
+
+	sloRequests = newCounterVec("slo_requests_total",
+		"Requests counted against the route's SLOs, by SLI (availability, latency) and result (good, bad).", "handler", "sli", "result")
+)
+
+// newSLOTrackerFromEnv reads the targets
+func newSLOTrackerFromEnv() (*sloTracker, error) {
+	t := &sloTracker{
+		defaults: sloObjective{
+			availability: getEnvFloat("SLO_AVAILABILITY_TARGET", 99.9),
+			latency:      getEnvFloat("SLO_LATENCY_TARGET", 99),
+			threshold:    getEnvDuration("SLO_LATENCY_THRESHOLD", 300*time.Millisecond),
+		},
+		overrides: map[string]sloObjective{},
+		routes:    map[string]*sloRoute{},
+	}
+	for _, target := range []float64{t.defaults.availability, t.defaults.latency} {
+		if target <= 0 || target >= 100 {
+			return nil, fmt.Errorf("SLO targets must be percentages between 0 and 100, got %g", target)
+		}
+	}
+	for _, spec := range splitList(getEnv("SLO_ROUTES", "")) {
+		route, objective, err := t.parseOverride(spec)
+		if err != nil {
+			return nil, fmt.Errorf("SLO_ROUTES entry %q: %w", spec, err)
+		}
+		t.overrides[route] = objective
+	}
+	return t, nil
+}
+
+// parseOverride reads "route=availability[:threshold]", the latency target
+// staying the default
+func (t *sloTracker) parseOverride(spec string) (string, sloObjective, error) {
+	route, rest, ok := strings.Cut(spec, "=")
+	if !ok || !strings.HasPrefix(route, "/") {
+		return "", sloObjective{}, fmt.Errorf("want /route=availability[:latency-threshold]")
+	}
+	o := t.defaults
+	target, threshold, hasThreshold := strings.Cut(rest, ":")
+	a, err := strconv.ParseFloat(target, 64)
+	if err != nil || a <= 0 || a >= 100 {
+		return "", sloObjective{}, fmt.Errorf("availability target must be a percentage below 100")
+	}
+	o.availability = a
+	if hasThreshold {
+		d, err := time.ParseDuration(threshold)
+		if err != nil || d <= 0 {
+			return "", sloObjective{}, fmt.Errorf("latency threshold must be a duration like 250ms")
+		}
+		o.threshold = d
+	}
+	return route, o, nil
+}
+
+// record counts one answered request; called by instrument
+func (t *sloTracker) record(pattern string, status int, elapsed time.Duration) {
+	if t == nil || rateLimitExempt(pattern) || pattern == "/startup" {
+		return
+	}
+	now := time.Now().Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.routes[pattern]
+	if !ok {
+		r = &sloRoute{objective: t.defaults}
+		if o, found := t.overrides[pattern]; found {
+			r.objective = o
+		}
+		t.routes[pattern] = r
+	}
+	failed, slow := status >= 500, elapsed > r.objective.threshold
+	m := &r.minutes[now%sloMinutes]
+	if m.unix != now {
+		*m = sloMinute{unix: now}
+	}
+	m.total++
+	r.total++
+	if failed {
+		m.errors++
+		r.errors++
+	}
+	if slow {
+		m.slow++
+		r.slow++
+	}
+	sloRequests.Inc(pattern, "availability", goodOrBad(!failed))
+	sloRequests.Inc(pattern, "latency", goodOrBad(!slow))
+}
+
+func goodOrBad(good bool) string {
+	if good {
+		return "good"
+	}
+	return "bad"
+}
+
+// report works out every route's SLIs, budgets and burn rates
+func (t *sloTracker) report() []RouteSLO {
+	now := time.Now().Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	routes := make([]RouteSLO, 0, len(t.routes))
+	for pattern, r := range t.routes {
+		// requests, and bad ones by bad(), in the last n minutes
+		windowed := func(bad func(sloMinute) int64, minutes int) (int64, int64) {
+			var total, n int64
+			for _, m := range r.minutes {
+				if m.unix > now-int64(minutes) && m.unix <= now {
+					total += m.total
+					n += bad(m)
+				}
+			}
+			return total, n
+		}
+		o := r.objective
+		routes = append(routes, RouteSLO{
+			Route:    pattern,
+			Requests: r.total,
+			Availability: sliReport(o.availability, "", r.total, r.errors, func(minutes int) (int64, int64) {
+				return windowed(func(m sloMinute) int64 { return m.errors }, minutes)
+			}),
+			Latency: sliReport(o.latency, o.threshold.String(), r.total, r.slow, func(minutes int) (int64, int64) { return windowed(func(m sloMinute) int64 { return m.slow }, minutes) }),
+		})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		bi := min(routes[i].Availability.BudgetRemaining, routes[i].Latency.BudgetRemaining)
+		bj := min(routes[j].Availability.BudgetRemaining, routes[j].Latency.BudgetRemaining)
+		if bi != bj {
+			return bi < bj
+		}
+		return routes[i].Route < routes[j].Route
+	})
+	return routes
+}
+
+// sliReport is one SLI: target in percent, counts since start, and window
+// returning the requests and bad ones in the last n minutes
+func sliReport(target float64, threshold string, total, bad int64, window func(minutes int) (int64, int64)) SLIReport {
+	budget := 1 - target/100 // the share of requests allowed to be bad
+	rep := SLIReport{Target: target, Threshold: threshold, Good: total - bad, Bad: bad, SLI: 100, BudgetRemaining: 1,
+		BurnRates: map[string]float64{}, Alert: "none"}
+	if total > 0 {
+		rep.SLI = roundTo(float64(total-bad)/float64(total)*100, 4)
+		rep.BudgetRemaining = roundTo(1-float64(bad)/float64(total)/budget, 4)
+	}
+	for _, w := range sloWindows {
+		n, b := window(w.minutes)
+		rate := 0.0
+		if n > 0 {
+			rate = float64(b) / float64(n) / budget
+		}
+		rep.BurnRates[w.name] = roundTo(rate, 3)
+	}
+	switch {
+	case rep.BurnRates["1h"] > sloPageBurnRate && rep.BurnRates["5m"] > sloPageBurnRate:
+		rep.Alert = "page"
+	case rep.BurnRates["6h"] > sloTicketBurnRate && rep.BurnRates["30m"] > sloTicketBurnRate:
+		rep.Alert = "ticket"
+	}
+	return rep
+}
+
+func roundTo(v float64, places int) float64 {
+	p := math.Pow10(places)
+	return math.Round(v*p) / p
+}
+
+// write exposes the report as gauges, worked out at scrape time
+func (t *sloTracker) write(w io.Writer) {
+	routes := t.report()
+	gauge := func(name, help string, value func(SLIReport) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, r := range routes {
+			for _, sli := range []string{"availability", "latency"} {
+				fmt.Fprintf(w, "%s%s %s\n", name, labelKey([]string{"handler", "sli"}, []string{r.Route, sli}), formatFloat(value(r.sli(sli))))
+			}
+		}
+	}
+	gauge("slo_target_ratio", "The route's SLO target, by SLI.", func(s SLIReport) float64 { return roundTo(s.Target/100, 6) })
+	gauge("slo_error_budget_remaining_ratio", "Share of the error budget left since the pod started, by SLI.",
+		func(s SLIReport) float64 { return s.BudgetRemaining })
+
+	fmt.Fprint(w, "# HELP slo_burn_rate How fast each window spends the error budget, 1 being exactly on budget.\n# TYPE slo_burn_rate gauge\n")
+	for _, r := range routes {
+		for _, sli := range []string{"availability", "latency"} {
+			for _, win := range sloWindows {
+				fmt.Fprintf(w, "slo_burn_rate%s %s\n", labelKey([]string{"handler", "sli", "window"}, []string{r.Route, sli, win.name}),
+					formatFloat(r.sli(sli).BurnRates[win.name]))
+			}
+		}
+	}
+}
+
+func (r RouteSLO) sli(name string) SLIReport {
+	if name == "latency" {
+		return r.Latency
+	}
+	return r.Availability
+}
+
+// sloHandler serves GET /api/slo?route=
+func sloHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	hostname, _ := os.Hostname()
+	resp := SLOResponse{Pod: hostname, Since: startTime.UTC(), Routes: []RouteSLO{}}
+	route := r.URL.Query().Get("route")
+	for _, rs := range slos.report() {
+		if route == "" || rs.Route == route {
+			resp.Routes = append(resp.Routes, rs)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
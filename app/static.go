@@ -0,0 +1,41 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// staticFiles holds the CSS/JS assets compiled into the binary, so the image
+// still needs nothing but the executable
+//
+//go:embed static
+var staticFiles embed.FS
+
+// staticHandler serves the embedded assets under /static/. FileServerFS sets
+// Content-Type from the file extension and rejects ".." path traversal;
+// directory listings are refused so only real files are exposed. Each
+// asset's content hash is its ETag, which FileServerFS checks against
+// If-None-Match.
+func staticHandler() http.HandlerFunc {
+	assets, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		fatal("static assets unavailable", "error", err)
+	}
+	fileServer := http.StripPrefix("/static/", http.FileServerFS(assets))
+	etags := staticETags(assets)
+	cacheControl := getEnv("STATIC_CACHE_CONTROL", "public, max-age=3600")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			writeProblem(w, r, http.StatusNotFound, "no asset listing; request a file under /static/")
+			return
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		if etag, ok := etags[strings.TrimPrefix(r.URL.Path, "/static/")]; ok {
+			w.Header().Set("ETag", etag)
+		}
+		fileServer.ServeHTTP(w, r)
+	}
+}
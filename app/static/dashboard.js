@@ -0,0 +1,100 @@
+// Polls /api/dashboard and renders one row per replica, plus the recent
+// requests of whichever pod answered /api/requests. Request rates are
+// computed here from the change in each pod's counter between polls.
+(function () {
+    var root = document.getElementById('dashboard');
+    if (!root) return;
+    var field = function (name) { return root.querySelector('[data-dash="' + name + '"]'); };
+    var previous = {}; // pod name -> {requests, time}
+
+    function cell(row, text) {
+        var td = document.createElement('td');
+        td.textContent = text;
+        row.appendChild(td);
+        return td;
+    }
+
+    function render(data) {
+        var now = Date.now(), next = {}, versions = {}, ready = 0;
+        var body = field('pods');
+        body.textContent = '';
+        data.pods.forEach(function (pod) {
+            var s = pod.stats, name = pod.name || pod.ip;
+            var row = document.createElement('tr');
+            if (pod.self) row.className = 'self';
+            cell(row, name);
+            cell(row, pod.node || '-');
+            if (!s) {
+                cell(row, '-');
+                cell(row, pod.ready ? 'yes' : 'no');
+                cell(row, pod.error || 'unreachable').colSpan = 4;
+                body.appendChild(row);
+                return;
+            }
+            var version = cell(row, s.version);
+            var swatch = document.createElement('span');
+            swatch.className = 'swatch';
+            swatch.style.background = s.color;
+            version.prepend(swatch);
+            cell(row, s.ready ? 'yes' : 'no').className = s.ready ? 'ok' : 'bad';
+            cell(row, s.requests_total);
+            var rate = '-', last = previous[name];
+            if (last && s.requests_total >= last.requests) {
+                rate = ((s.requests_total - last.requests) / ((now - last.time) / 1000)).toFixed(1);
+            }
+            cell(row, rate);
+            cell(row, s.in_flight);
+            cell(row, s.uptime_seconds + 's');
+            next[name] = {requests: s.requests_total, time: now};
+            versions[s.version] = (versions[s.version] || 0) + 1;
+            if (s.ready) ready++;
+            body.appendChild(row);
+        });
+        previous = next;
+
+        var split = Object.keys(versions).map(function (v) { return versions[v] + '× ' + v; }).join(', ');
+        field('summary').textContent = data.pods.length + ' pods, ' + ready + ' ready' + (split ? ' - ' + split : '') + ' (via ' + data.source + ')';
+        field('served-by').textContent = data.served_by;
+        field('error').textContent = data.error || '';
+    }
+
+    // The pod that answered, not the cluster: each keeps its own history.
+    // The dashboard's own polling is left out.
+    function renderRequests(data) {
+        var body = field('requests');
+        body.textContent = '';
+        field('history-pod').textContent = data.pod;
+        data.requests.forEach(function (req) {
+            var row = document.createElement('tr');
+            cell(row, new Date(req.time).toLocaleTimeString());
+            cell(row, req.method);
+            cell(row, req.path);
+            cell(row, req.status).className = req.status >= 500 ? 'bad' : 'ok';
+            cell(row, req.latency_ms.toFixed(1) + 'ms');
+            cell(row, (req.forwarded_for || req.client).split(',')[0]);
+            body.appendChild(row);
+        });
+    }
+
+    function pollRequests() {
+        fetch('/api/requests?limit=10&exclude=/api/dashboard,/api/requests,/static/', {cache: 'no-store'})
+            .then(function (res) { return res.ok ? res.json() : null; })
+            .then(function (data) { if (data) renderRequests(data); })
+            .catch(function () {});
+    }
+
+    function poll() {
+        pollRequests();
+        fetch('/api/dashboard', {cache: 'no-store'})
+            .then(function (res) {
+                return res.json().then(function (data) {
+                    if (!res.ok) throw new Error(data.detail || data.title || res.statusText); // problem+json
+                    return data;
+                });
+            })
+            .then(render)
+            .catch(function (err) { field('error').textContent = 'poll failed: ' + err; })
+            .finally(function () { setTimeout(poll, 2000); });
+    }
+    poll();
+})();
@@ -0,0 +1,31 @@
+// Live pod stats over /ws/stats. The WebSocket stays on the pod that
+// accepted it; when that pod shuts down the socket closes and we reconnect
+// through the Service, usually landing on another pod.
+(function () {
+    var panel = document.getElementById('live-stats');
+    if (!panel || !window.WebSocket) return;
+    var field = function (name) { return panel.querySelector('[data-stat="' + name + '"]'); };
+    var mib = function (bytes) { return (bytes / 1048576).toFixed(1) + ' MiB'; };
+    var retry = 1000;
+
+    function connect() {
+        var scheme = location.protocol === 'https:' ? 'wss://' : 'ws://';
+        var ws = new WebSocket(scheme + location.host + '/ws/stats');
+        ws.onopen = function () { retry = 1000; field('state').textContent = 'connected'; };
+        ws.onmessage = function (event) {
+            var s = JSON.parse(event.data);
+            field('pod').textContent = s.pod;
+            field('uptime').textContent = s.uptime_seconds + 's';
+            field('requests').textContent = s.requests_total + ' (' + s.requests_per_second.toFixed(1) + '/s, ' + s.in_flight + ' in flight)';
+            field('goroutines').textContent = s.goroutines;
+            field('memory').textContent = mib(s.heap_alloc_bytes) + ' heap / ' + mib(s.sys_bytes) + ' sys';
+            field('connected').textContent = s.connected_seconds + 's';
+        };
+        ws.onclose = function () {
+            field('state').textContent = 'reconnecting...';
+            setTimeout(connect, retry);
+            retry = Math.min(retry * 2, 10000);
+        };
+    }
+    connect();
+})();
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStaticHandlerServesEmbeddedAsset(t *testing.T) {
+	handler := staticHandler()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/static/style.css", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Errorf("Content-Type = %q, want text/css", ct)
+	}
+	if rec.Body.Len() == 0 {
+		t.Error("empty body")
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/static/style.css", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match with the ETag: status = %d, want 304", rec.Code)
+	}
+}
+
+func TestStaticHandlerRefusesTraversalAndListing(t *testing.T) {
+	handler := staticHandler()
+	for _, path := range []string{
+		"/static/",
+		"/static/../main.go",
+		"/static/../../etc/passwd",
+		"/static/%2e%2e/main.go",
+		"/static/..%2fmain.go",
+		"/static/missing.css",
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code == http.StatusOK || rec.Code == http.StatusMovedPermanently {
+			t.Errorf("%s: status %d, want it refused", path, rec.Code)
+		}
+		if body := rec.Body.String(); strings.Contains(body, "package main") || strings.Contains(body, "style.css") {
+			t.Errorf("%s: response gives away files:\n%s", path, body)
+		}
+	}
+}
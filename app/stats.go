@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+)
+
+// /ws/stats streams live pod stats over a WebSocket, one JSON frame per
+// second. A WebSocket is a single long-lived TCP connection, so it shows
+// what load balancing means for connections rather than requests: every
+// frame comes from the pod that accepted the upgrade, no matter how many
+// replicas the Service has, until that pod goes away. Ingress controllers
+// also need to allow the upgrade and a long read timeout.
+//
+//	websocat ws://localhost:30080/ws/stats
+
+// StatsFrame is one message on /ws/stats
+type StatsFrame struct {
+	Pod               string  `json:"pod"`
+	Timestamp         string  `json:"timestamp"`
+	UptimeSeconds     float64 `json:"uptime_seconds"`
+	RequestsTotal     int64   `json:"requests_total"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	InFlight          int64   `json:"in_flight"`
+	Goroutines        int     `json:"goroutines"`
+	HeapAllocBytes    uint64  `json:"heap_alloc_bytes"`
+	SysBytes          uint64  `json:"sys_bytes"`
+	GCCycles          uint32  `json:"gc_cycles"`
+	ConnectedSeconds  float64 `json:"connected_seconds"` // age of this WebSocket
+}
+
+var wsConnections = newGaugeVec("websocket_connections",
+	"Open WebSocket connections, by path.", "path")
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	activeStreams.Add(1)
+	defer activeStreams.Done()
+	closeCode := uint16(wsNormalClosure)
+	defer func() { ws.Close(closeCode) }()
+	wsConnections.Add(1, "/ws/stats")
+	defer wsConnections.Add(-1, "/ws/stats")
+	slog.Info("websocket connected", "path", "/ws/stats", "remote", r.RemoteAddr)
+
+	clientGone := make(chan error, 1)
+	go func() { clientGone <- ws.readLoop() }()
+
+	hostname, _ := os.Hostname()
+	connected := time.Now()
+	lastCount, lastTime := requestsServed.Load(), time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		now, count := time.Now(), requestsServed.Load()
+		frame, _ := json.Marshal(StatsFrame{
+			Pod:               hostname,
+			Timestamp:         now.Format(time.RFC3339),
+			UptimeSeconds:     now.Sub(startTime).Round(time.Second).Seconds(),
+			RequestsTotal:     count,
+			RequestsPerSecond: float64(count-lastCount) / max(now.Sub(lastTime).Seconds(), 1e-3),
+			InFlight:          inFlight.Load(),
+			Goroutines:        runtime.NumGoroutine(),
+			HeapAllocBytes:    mem.HeapAlloc,
+			SysBytes:          mem.Sys,
+			GCCycles:          mem.NumGC,
+			ConnectedSeconds:  now.Sub(connected).Round(time.Second).Seconds(),
+		})
+		lastCount, lastTime = count, now
+		if err := ws.WriteText(frame); err != nil {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case err := <-clientGone:
+			slog.Info("websocket disconnected", "path", "/ws/stats", "remote", r.RemoteAddr,
+				"duration", time.Since(connected).Round(time.Second).String(), "reason", err.Error())
+			return
+		case <-streamsClosing:
+			// The page reconnects, through the Service, to a pod that's staying
+			closeCode = wsGoingAway
+			return
+		}
+	}
+}
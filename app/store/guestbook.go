@@ -0,0 +1,211 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/cache"
+)
+
+// A PostgreSQL-backed guestbook: a small stateful dependency for the
+// StatefulSet and Secret lessons. The schema is created by numbered
+// migrations at startup; the readiness probe fails until they have run
+// and whenever the database stops answering.
+
+// migrations are applied in order and recorded in schema_migrations.
+// Never edit one that has shipped; add a new one instead.
+var migrations = []string{
+	1: `CREATE TABLE guestbook (
+		id         BIGSERIAL PRIMARY KEY,
+		name       TEXT NOT NULL,
+		message    TEXT NOT NULL,
+		pod        TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	2: `CREATE INDEX guestbook_created_at ON guestbook (created_at DESC)`,
+	3: `ALTER TABLE guestbook ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default'`,
+	4: `CREATE INDEX guestbook_tenant_created_at ON guestbook (tenant, created_at DESC)`,
+}
+
+// migrationLockID is the pg_advisory_lock key that stops replicas starting
+// at the same time from applying the same migration twice
+const migrationLockID = 720_514
+
+// GuestbookEntry is one guestbook message
+type GuestbookEntry struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Message   string `json:"message"`
+	Pod       string `json:"pod"`
+	Tenant    string `json:"tenant"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Guestbook wraps the database with the guestbook's queries. Lists are
+// cached per pod for the cache TTL; an entry added here clears this pod's
+// cache, the other replicas show it once theirs expire.
+type Guestbook struct {
+	db       *Postgres
+	migrated atomic.Bool
+	cache    *cache.LRU[[]GuestbookEntry]
+}
+
+// NewGuestbook returns the guestbook in db, caching up to cacheSize lists
+// for cacheTTL each
+func NewGuestbook(db *Postgres, cacheSize int, cacheTTL time.Duration) *Guestbook {
+	return &Guestbook{db: db, cache: cache.New[[]GuestbookEntry]("guestbook", cacheSize, cacheTTL)}
+}
+
+// Migrate applies pending migrations under an advisory lock. Each one runs
+// in its own transaction together with its schema_migrations row.
+func (gs *Guestbook) Migrate(ctx context.Context) error {
+	conn, err := gs.db.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Exec(fmt.Sprintf("SELECT pg_advisory_lock(%d)", migrationLockID)); err != nil {
+		return err
+	}
+	defer conn.Exec(fmt.Sprintf("SELECT pg_advisory_unlock(%d)", migrationLockID))
+
+	err = conn.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+	res, err := conn.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	applied := map[int]bool{}
+	for _, row := range res.Rows {
+		v, _ := strconv.Atoi(row[0])
+		applied[v] = true
+	}
+
+	for version, sql := range migrations {
+		if sql == "" || applied[version] {
+			continue
+		}
+		err := conn.Exec(fmt.Sprintf("BEGIN; %s; INSERT INTO schema_migrations (version) VALUES (%d); COMMIT", sql, version))
+		if err != nil {
+			conn.Exec("ROLLBACK")
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		slog.Info("database migration applied", "version", version)
+	}
+	gs.migrated.Store(true)
+	return nil
+}
+
+// MigrateWithRetry keeps trying until the database is up, so a pod that
+// starts before its database waits (not ready) instead of crash-looping
+func (gs *Guestbook) MigrateWithRetry() {
+	backoff := time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := gs.Migrate(ctx)
+		cancel()
+		if err == nil {
+			slog.Info("database schema up to date", "versions", len(migrations)-1)
+			return
+		}
+		slog.Warn("database migrations failed, retrying", "error", err, "retry_in", backoff.String())
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// Add stores an entry for tenant and returns it with its id and timestamp
+func (gs *Guestbook) Add(ctx context.Context, tenant, name, message, pod string) (GuestbookEntry, error) {
+	res, err := gs.db.Query(ctx,
+		`INSERT INTO guestbook (name, message, pod, tenant) VALUES ($1, $2, $3, $4)
+		RETURNING id, name, message, pod, tenant, `+guestbookTimestamp, name, message, pod, tenant)
+	if err != nil {
+		return GuestbookEntry{}, err
+	}
+	entries := guestbookEntries(res)
+	if len(entries) != 1 {
+		return GuestbookEntry{}, fmt.Errorf("insert returned %d rows", len(entries))
+	}
+	gs.cache.Flush()
+	return entries[0], nil
+}
+
+// List returns tenant's newest entries first; every tenant's for "".
+// cached reports whether they came from this pod's cache.
+func (gs *Guestbook) List(ctx context.Context, tenant string, limit int) (entries []GuestbookEntry, cached bool, err error) {
+	key := tenant + "|" + strconv.Itoa(limit)
+	if entries, ok := gs.cache.Get(key); ok {
+		return entries, true, nil
+	}
+	res, err := gs.db.Query(ctx,
+		`SELECT id, name, message, pod, tenant, `+guestbookTimestamp+`
+		FROM guestbook WHERE $2 = '' OR tenant = $2
+		ORDER BY created_at DESC, id DESC LIMIT $1`, strconv.Itoa(limit), tenant)
+	if err != nil {
+		return nil, false, err
+	}
+	entries = guestbookEntries(res)
+	gs.cache.Add(key, entries)
+	return entries, false, nil
+}
+
+// Count returns how many entries there are, across tenants
+func (gs *Guestbook) Count(ctx context.Context) (int, error) {
+	res, err := gs.db.Query(ctx, `SELECT count(*) FROM guestbook`)
+	return pgCount(res, err)
+}
+
+// Reset deletes every entry, returning how many there were
+func (gs *Guestbook) Reset(ctx context.Context) (int, error) {
+	res, err := gs.db.Query(ctx, `WITH deleted AS (DELETE FROM guestbook RETURNING 1) SELECT count(*) FROM deleted`)
+	gs.cache.Flush()
+	return pgCount(res, err)
+}
+
+// pgCount reads a single count(*) row
+func pgCount(res Result, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Rows) != 1 || len(res.Rows[0]) != 1 {
+		return 0, fmt.Errorf("count returned %d rows", len(res.Rows))
+	}
+	return strconv.Atoi(res.Rows[0][0])
+}
+
+// guestbookTimestamp renders created_at as RFC 3339 in UTC
+const guestbookTimestamp = `to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')`
+
+func guestbookEntries(res Result) []GuestbookEntry {
+	entries := []GuestbookEntry{}
+	for _, row := range res.Rows {
+		if len(row) < 6 {
+			continue
+		}
+		id, _ := strconv.ParseInt(row[0], 10, 64)
+		entries = append(entries, GuestbookEntry{ID: id, Name: row[1], Message: row[2], Pod: row[3], Tenant: row[4], CreatedAt: row[5]})
+	}
+	return entries
+}
+
+// Name and Check make the store a readiness check: the pod is ready once
+// migrations have run and the database answers queries
+func (gs *Guestbook) Name() string { return "postgres-guestbook:" + gs.db.Addr }
+
+func (gs *Guestbook) Check(ctx context.Context) error {
+	if !gs.migrated.Load() {
+		return errors.New("migrations not applied yet")
+	}
+	return gs.db.Ping(ctx)
+}
@@ -0,0 +1,421 @@
+// Package store is the app's PostgreSQL storage: a small client for the
+// wire protocol, and the guestbook kept with it. Configuration, metrics and
+// the HTTP API stay with the app, which hands them in through the
+// Postgres fields and the Guestbook's constructor.
+package store
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Postgres is a small PostgreSQL client speaking the v3 wire protocol,
+// in the same spirit as the app's Redis client: no driver dependency, a
+// fresh connection per operation, and just enough protocol for the demo:
+// password/MD5/SCRAM-SHA-256 authentication, simple queries (several
+// statements at once, used by migrations) and parameterized queries.
+// There is no TLS, which suits an in-cluster database reached over the
+// pod network but not a managed database on the internet.
+type Postgres struct {
+	Addr     string // host:port
+	User     string
+	Password string
+	Database string
+	Timeout  time.Duration
+
+	// Credentials, when set, overrides User and Password for each new
+	// connection, e.g. from a Vault lease
+	Credentials func() (user, password string)
+	// Trace, when set, wraps every query, for spans; done gets its error
+	Trace func(ctx context.Context, op string) (_ context.Context, done func(error))
+}
+
+// Result holds the rows of a query; NULLs are returned as ""
+type Result struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// pgConn is one authenticated connection
+type pgConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Query runs one parameterized statement ($1, $2, ...) on a new connection
+func (c *Postgres) Query(ctx context.Context, sql string, args ...string) (res Result, err error) {
+	if c.Trace != nil {
+		var done func(error)
+		ctx, done = c.Trace(ctx, "postgres "+sqlVerb(sql))
+		defer func() { done(err) }()
+	}
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	return conn.Query(sql, args...)
+}
+
+// Ping checks that the database accepts our credentials and queries
+func (c *Postgres) Ping(ctx context.Context) error {
+	_, err := c.Query(ctx, "SELECT 1")
+	return err
+}
+
+// connect dials and authenticates a connection
+func (c *Postgres) connect(ctx context.Context) (*pgConn, error) {
+	timeout := cmp.Or(c.Timeout, 5*time.Second)
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("postgres dial %s: %w", c.Addr, err)
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	user, password := c.User, c.Password
+	if c.Credentials != nil {
+		user, password = c.Credentials()
+	}
+	pc := &pgConn{conn: conn, r: bufio.NewReader(conn)}
+	if err := pc.startup(user, password, cmp.Or(c.Database, user)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+func (pc *pgConn) Close() error {
+	pc.send('X', nil)
+	return pc.conn.Close()
+}
+
+// startup sends the StartupMessage and completes authentication
+func (pc *pgConn) startup(user, password, database string) error {
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, 196608) // protocol 3.0
+	for _, kv := range [][2]string{{"user", user}, {"database", database}, {"application_name", "go-demo-app"}} {
+		body = append(body, kv[0]...)
+		body = append(body, 0)
+		body = append(body, kv[1]...)
+		body = append(body, 0)
+	}
+	body = append(body, 0)
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(body)+4))
+	if _, err := pc.conn.Write(append(msg, body...)); err != nil {
+		return fmt.Errorf("postgres write: %w", err)
+	}
+
+	var scram *scramClient
+	for {
+		typ, data, err := pc.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'R':
+			if len(data) < 4 {
+				return errors.New("postgres: short authentication message")
+			}
+			switch code := binary.BigEndian.Uint32(data); code {
+			case 0: // AuthenticationOk
+			case 3: // cleartext password
+				err = pc.send('p', cstring(password))
+			case 5: // MD5, salted with 4 bytes
+				inner := md5.Sum([]byte(password + user))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), data[4:8]...))
+				err = pc.send('p', cstring("md5"+hex.EncodeToString(outer[:])))
+			case 10: // SASL, offering mechanisms
+				if !strings.Contains(string(data[4:]), "SCRAM-SHA-256\x00") {
+					return errors.New("postgres: server offers no supported SASL mechanism")
+				}
+				scram = newSCRAMClient(password)
+				first := scram.clientFirst()
+				msg := cstring("SCRAM-SHA-256")
+				msg = binary.BigEndian.AppendUint32(msg, uint32(len(first)))
+				err = pc.send('p', append(msg, first...))
+			case 11: // SASL continue
+				if scram == nil {
+					return errors.New("postgres: unexpected SASL message")
+				}
+				var final string
+				if final, err = scram.clientFinal(string(data[4:])); err == nil {
+					err = pc.send('p', []byte(final))
+				}
+			case 12: // SASL final
+				if scram == nil || !scram.verifyServer(string(data[4:])) {
+					return errors.New("postgres: server SCRAM signature mismatch")
+				}
+			default:
+				return fmt.Errorf("postgres: unsupported authentication method %d", code)
+			}
+			if err != nil {
+				return err
+			}
+		case 'E':
+			return pgError(data)
+		case 'Z':
+			return nil
+		}
+		// ParameterStatus (S), BackendKeyData (K) and notices are ignored
+	}
+}
+
+// Exec runs one or more ;-separated statements with the simple query
+// protocol. Multiple statements run in a single implicit transaction.
+func (pc *pgConn) Exec(sql string) error {
+	if err := pc.send('Q', cstring(sql)); err != nil {
+		return err
+	}
+	_, err := pc.readResult()
+	return err
+}
+
+// Query runs one statement with the extended protocol, which sends the
+// arguments separately from the SQL so they never need escaping
+func (pc *pgConn) Query(sql string, args ...string) (Result, error) {
+	parse := cstring("") // unnamed statement
+	parse = append(parse, cstring(sql)...)
+	parse = binary.BigEndian.AppendUint16(parse, 0) // let the server infer param types
+
+	bind := cstring("")                           // unnamed portal
+	bind = append(bind, cstring("")...)           // unnamed statement
+	bind = binary.BigEndian.AppendUint16(bind, 0) // all params in text format
+	bind = binary.BigEndian.AppendUint16(bind, uint16(len(args)))
+	for _, arg := range args {
+		bind = binary.BigEndian.AppendUint32(bind, uint32(len(arg)))
+		bind = append(bind, arg...)
+	}
+	bind = binary.BigEndian.AppendUint16(bind, 0) // all results in text format
+
+	execute := binary.BigEndian.AppendUint32(cstring(""), 0) // no row limit
+
+	for _, m := range []struct {
+		typ  byte
+		data []byte
+	}{{'P', parse}, {'B', bind}, {'D', []byte("P\x00")}, {'E', execute}, {'S', nil}} {
+		if err := pc.send(m.typ, m.data); err != nil {
+			return Result{}, err
+		}
+	}
+	return pc.readResult()
+}
+
+// readResult collects rows until ReadyForQuery, returning the first error
+func (pc *pgConn) readResult() (Result, error) {
+	var res Result
+	var firstErr error
+	for {
+		typ, data, err := pc.receive()
+		if err != nil {
+			return res, err
+		}
+		switch typ {
+		case 'T':
+			res.Columns = parseRowDescription(data)
+		case 'D':
+			res.Rows = append(res.Rows, parseDataRow(data))
+		case 'E':
+			if firstErr == nil {
+				firstErr = pgError(data)
+			}
+		case 'Z':
+			return res, firstErr
+		}
+	}
+}
+
+// send writes one frontend message: type byte, int32 length, body
+func (pc *pgConn) send(typ byte, data []byte) error {
+	msg := []byte{typ}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(data)+4))
+	if _, err := pc.conn.Write(append(msg, data...)); err != nil {
+		return fmt.Errorf("postgres write: %w", err)
+	}
+	return nil
+}
+
+// receive reads one backend message
+func (pc *pgConn) receive() (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(pc.r, header); err != nil {
+		return 0, nil, fmt.Errorf("postgres read: %w", err)
+	}
+	n := int(binary.BigEndian.Uint32(header[1:])) - 4
+	if n < 0 || n > 64<<20 {
+		return 0, nil, errors.New("postgres read: bad message length")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(pc.r, data); err != nil {
+		return 0, nil, fmt.Errorf("postgres read: %w", err)
+	}
+	return header[0], data, nil
+}
+
+func parseRowDescription(data []byte) []string {
+	if len(data) < 2 {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	columns := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		end := strings.IndexByte(string(data), 0)
+		if end < 0 || len(data) < end+19 {
+			break
+		}
+		columns = append(columns, string(data[:end]))
+		data = data[end+19:] // name, NUL, then 18 bytes of type info
+	}
+	return columns
+}
+
+func parseDataRow(data []byte) []string {
+	if len(data) < 2 {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	row := make([]string, n)
+	for i := range row {
+		if len(data) < 4 {
+			break
+		}
+		size := int32(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size < 0 || int(size) > len(data) {
+			continue // NULL
+		}
+		row[i] = string(data[:size])
+		data = data[size:]
+	}
+	return row
+}
+
+// pgError turns an ErrorResponse into an error with severity, code and message
+func pgError(data []byte) error {
+	fields := map[byte]string{}
+	for len(data) > 1 {
+		end := strings.IndexByte(string(data[1:]), 0)
+		if end < 0 {
+			break
+		}
+		fields[data[0]] = string(data[1 : end+1])
+		data = data[end+2:]
+	}
+	return fmt.Errorf("postgres %s %s: %s", fields['S'], fields['C'], fields['M'])
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// sqlVerb returns the first word of a statement, for span names
+func sqlVerb(sql string) string {
+	if fields := strings.Fields(sql); len(fields) > 0 {
+		return strings.ToUpper(fields[0])
+	}
+	return "query"
+}
+
+// scramClient implements the client side of SCRAM-SHA-256 (RFC 5802 /
+// RFC 7677), the default password authentication since PostgreSQL 14
+type scramClient struct {
+	password    string
+	nonce       string
+	authMessage string
+	salted      []byte
+}
+
+func newSCRAMClient(password string) *scramClient {
+	raw := make([]byte, 18)
+	rand.Read(raw)
+	return &scramClient{password: password, nonce: base64.StdEncoding.EncodeToString(raw)}
+}
+
+// clientFirst is sent with an empty user name; the server uses the one
+// from the startup message
+func (sc *scramClient) clientFirst() string {
+	return "n,,n=,r=" + sc.nonce
+}
+
+func (sc *scramClient) clientFinal(serverFirst string) (string, error) {
+	attrs := scramAttributes(serverFirst)
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	iterations, _ := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 || !strings.HasPrefix(attrs["r"], sc.nonce) {
+		return "", errors.New("postgres: invalid SCRAM server-first message")
+	}
+
+	sc.salted = pbkdf2SHA256([]byte(sc.password), salt, iterations)
+	clientKey := hmacSHA256(sc.salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + attrs["r"]
+	sc.authMessage = "n=,r=" + sc.nonce + "," + serverFirst + "," + withoutProof
+	signature := hmacSHA256(storedKey[:], sc.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (sc *scramClient) verifyServer(serverFinal string) bool {
+	expected := hmacSHA256(hmacSHA256(sc.salted, "Server Key"), sc.authMessage)
+	got, err := base64.StdEncoding.DecodeString(scramAttributes(serverFinal)["v"])
+	return err == nil && hmac.Equal(got, expected)
+}
+
+func scramAttributes(msg string) map[string]string {
+	attrs := map[string]string{}
+	for _, part := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a single 32-byte block, all SCRAM-SHA-256 needs
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(nil)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// The published PBKDF2-HMAC-SHA256 vectors for "password" and "salt"
+	tests := []struct {
+		iterations int
+		want       string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(pbkdf2SHA256([]byte("password"), []byte("salt"), tt.iterations)); got != tt.want {
+			t.Errorf("%d iterations: %s, want %s", tt.iterations, got, tt.want)
+		}
+	}
+}
+
+// fakeBackend accepts one connection, asks for a cleartext password and
+// answers every query with rows; it reports what the client sent
+type fakeBackend struct {
+	ln       net.Listener
+	password chan string
+	queries  chan []string // SQL and arguments
+}
+
+func startFakeBackend(t *testing.T, rows ...[]string) *fakeBackend {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	b := &fakeBackend{ln: ln, password: make(chan string, 1), queries: make(chan []string, 1)}
+	go b.serve(rows)
+	return b
+}
+
+func (b *fakeBackend) serve(rows [][]string) {
+	conn, err := b.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	send := func(typ byte, data []byte) {
+		conn.Write(append(binary.BigEndian.AppendUint32([]byte{typ}, uint32(len(data)+4)), data...))
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return
+	}
+	io.CopyN(io.Discard, r, int64(binary.BigEndian.Uint32(size[:])-4)) // the startup message
+	send('R', binary.BigEndian.AppendUint32(nil, 3))
+
+	var query []string
+	for {
+		typ, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(size[:])-4)
+		io.ReadFull(r, data)
+		switch typ {
+		case 'p':
+			b.password <- strings.TrimSuffix(string(data), "\x00")
+			send('R', binary.BigEndian.AppendUint32(nil, 0))
+			send('Z', []byte("I"))
+		case 'P': // statement name, SQL
+			query = append(query, strings.Split(string(data), "\x00")[1])
+		case 'B': // portal, statement, no formats, then the arguments
+			n := binary.BigEndian.Uint16(data[4:])
+			data = data[6:]
+			for range n {
+				size := binary.BigEndian.Uint32(data)
+				query = append(query, string(data[4:4+size]))
+				data = data[4+size:]
+			}
+		case 'S':
+			b.queries <- query
+			send('T', append(binary.BigEndian.AppendUint16(nil, 1), append([]byte("name\x00"), make([]byte, 18)...)...))
+			for _, row := range rows {
+				d := binary.BigEndian.AppendUint16(nil, uint16(len(row)))
+				for _, v := range row {
+					d = binary.BigEndian.AppendUint32(d, uint32(len(v)))
+					d = append(d, v...)
+				}
+				send('D', d)
+			}
+			send('Z', []byte("I"))
+		case 'X':
+			return
+		}
+	}
+}
+
+func TestPostgresQuery(t *testing.T) {
+	b := startFakeBackend(t, []string{"alice"}, []string{"bob"})
+	db := &Postgres{Addr: b.ln.Addr().String(), User: "app", Password: "static"}
+	db.Credentials = func() (string, string) { return "leased", "from vault" }
+	var traced string
+	db.Trace = func(ctx context.Context, op string) (context.Context, func(error)) {
+		return ctx, func(err error) { traced = op }
+	}
+
+	res, err := db.Query(context.Background(), "select name from guestbook where tenant = $1", "it's")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-b.password; got != "from vault" {
+		t.Errorf("password %q, want the one from Credentials", got)
+	}
+	if got := <-b.queries; len(got) != 2 || got[1] != "it's" {
+		t.Errorf("sent %q, want the SQL and its argument unescaped", got)
+	}
+	if len(res.Columns) != 1 || res.Columns[0] != "name" || len(res.Rows) != 2 || res.Rows[1][0] != "bob" {
+		t.Errorf("result = %+v, want name: alice, bob", res)
+	}
+	if traced != "postgres SELECT" {
+		t.Errorf("traced %q, want postgres SELECT", traced)
+	}
+}
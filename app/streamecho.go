@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// POST /api/stream-echo sends the request body back as it reads it, one
+// chunk at a time with a flush after each, so the first bytes come back
+// before the upload is over. Whatever sits in between shows whether it
+// buffers:
+//
+//	curl -N --data-binary @big.log -H 'Expect:' 'localhost:30080/api/stream-echo?chunk=1024&chunk_delay=200ms'
+//	seq 1 20 | curl -N --data-binary @- 'localhost:30080/api/stream-echo?chunk=3&chunk_delay=500ms'
+//
+// Direct to the pod the output trickles in a chunk per chunk_delay; through
+// ingress-nginx it arrives all at once at the end unless request and
+// response buffering are off (proxy-request-buffering and proxy-buffering
+// annotations, or X-Accel-Buffering: no for the response, which this
+// sends). The response is chunked (HTTP/1.1) or a stream of DATA frames
+// (HTTP/2), and the byte and chunk counts come last, as trailers.
+
+// Limits on one stream
+const (
+	maxStreamEchoBody  = 64 << 20
+	maxStreamEchoChunk = 1 << 20
+	maxStreamEchoDelay = 10 * time.Second
+)
+
+var streamEchoBytes = newCounterVec("stream_echo_bytes_total", "Bytes /api/stream-echo has read and sent back.")
+
+func streamEchoHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	chunk := int64(1024)
+	var ok bool
+	if r.URL.Query().Get("chunk") != "" {
+		if chunk, ok = queryInt(w, r, "chunk", 1, maxStreamEchoChunk); !ok {
+			return
+		}
+	}
+	// chunk_delay, not delay: ?delay= on /api/ is the latency injection
+	var delay time.Duration
+	if v := r.URL.Query().Get("chunk_delay"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxStreamEchoDelay {
+			writeProblem(w, r, http.StatusBadRequest, "chunk_delay must be a duration up to "+maxStreamEchoDelay.String())
+			return
+		}
+		delay = d
+	}
+
+	rc := http.NewResponseController(w)
+	// HTTP/1.1 handlers may not read the body once they've written,
+	// unless asked; HTTP/2 always allows it
+	rc.EnableFullDuplex()
+	rc.SetWriteDeadline(time.Time{})
+	body := http.MaxBytesReader(w, r.Body, maxStreamEchoBody)
+
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("X-Accel-Buffering", "no")
+	h.Set("Trailer", "X-Echo-Bytes, X-Echo-Chunks, X-Echo-Error")
+
+	// The headers wait for the first chunk: reading is what sends a 100
+	// Continue to a client that asked for one (curl does over 1MB), and a
+	// response before it tells the server the body won't be read
+	buf := make([]byte, chunk)
+	var total, chunks int64
+	var readErr error
+	for {
+		n, err := io.ReadFull(body, buf)
+		if chunks == 0 {
+			w.WriteHeader(http.StatusOK)
+		}
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return // the client is gone
+			}
+			rc.Flush()
+			total += int64(n)
+			chunks++
+			streamEchoBytes.Add(float64(n))
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				readErr = err
+			}
+			break
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+	trailer := w.Header() // asked again: a wrapper may have swapped maps on WriteHeader
+	trailer.Set("X-Echo-Bytes", strconv.FormatInt(total, 10))
+	trailer.Set("X-Echo-Chunks", strconv.FormatInt(chunks, 10))
+	if readErr != nil {
+		trailer.Set("X-Echo-Error", readErr.Error())
+	}
+}
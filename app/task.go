@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// task is a simulated batch job: it works in steps, logs progress, and
+// exits, so the same image teaches Jobs and CronJobs. Failures are the
+// lesson - a non-zero exit is a failed pod, retried up to backoffLimit,
+// and activeDeadlineSeconds kills a task that runs too long:
+//
+//	app task -work=30s                        succeed after 30s
+//	app task -work=10s -failure-rate=0.5      fail half the time, partway
+//	app task -exit-code=3                     always fail with exit 3
+//
+// In a manifest, APP_MODE=task runs it without overriding the command, and
+// TASK_WORK, TASK_STEPS, TASK_EXIT_CODE and TASK_FAILURE_RATE set the
+// flags' defaults. See k8s/advanced/job.yaml.
+
+func runTask(args []string) int {
+	fs := newFlagSet("task", "")
+	work := fs.Duration("work", getEnvDuration("TASK_WORK", 30*time.Second), "total simulated work")
+	steps := fs.Int("steps", int(getEnvInt("TASK_STEPS", 10)), "progress log lines over the work")
+	exitCode := fs.Int("exit-code", int(getEnvInt("TASK_EXIT_CODE", 0)), "exit code when the work completes; non-zero always fails")
+	failureRate := fs.Float64("failure-rate", getEnvFloat("TASK_FAILURE_RATE", 0), "chance (0-1) the task fails at a random step")
+	fs.Parse(args)
+	if *work < 0 || *steps < 1 || *failureRate < 0 || *failureRate > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	setupLogging(getEnv("LOG_LEVEL", "info"))
+	// Set by the Job controller: which pod of an Indexed Job this is
+	index := getEnv("JOB_COMPLETION_INDEX", "")
+	failAt := 0 // step to fail at, 0 for none
+	if rand.Float64() < *failureRate {
+		failAt = 1 + rand.Intn(*steps)
+	}
+	slog.Info("task started", "work", work.String(), "steps", *steps, "failure_rate", *failureRate, "completion_index", index)
+
+	// activeDeadlineSeconds and kubectl delete send SIGTERM first
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	start := time.Now()
+	step := time.Duration(int64(*work) / int64(*steps))
+	for i := 1; i <= *steps; i++ {
+		select {
+		case <-time.After(step):
+		case <-ctx.Done():
+			slog.Warn("task interrupted", "step", i, "steps", *steps, "elapsed", time.Since(start).Round(time.Millisecond).String())
+			return 143 // 128 + SIGTERM, what the shell would report
+		}
+		if i == failAt {
+			slog.Error("task failed", "step", i, "steps", *steps, "elapsed", time.Since(start).Round(time.Millisecond).String(), "exit_code", 1)
+			return 1
+		}
+		slog.Info("task progress", "step", i, "steps", *steps, "percent", i*100 / *steps)
+	}
+
+	elapsed := time.Since(start).Round(time.Millisecond).String()
+	if *exitCode != 0 {
+		slog.Error("task finished with failure", "elapsed", elapsed, "exit_code", *exitCode)
+		return *exitCode
+	}
+	slog.Info("task completed", "elapsed", elapsed)
+	return 0
+}
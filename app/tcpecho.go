@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A raw TCP echo server, for Service lessons without HTTP in the way.
+// TCP_PORT turns it on (off by default); every line sent comes back
+// prefixed with the pod's name:
+//
+//	kubectl set env deploy/go-app -n go-demo TCP_PORT=7000
+//	kubectl apply -f k8s/advanced/tcp-echo.yaml
+//	kubectl port-forward -n go-demo svc/go-app-tcp 7000 &
+//	nc localhost 7000
+//
+// kube-proxy balances connections, not requests: every line on one nc
+// session goes to the same pod, and only a new connection may land on
+// another. HTTP looks request-balanced only because clients open new
+// connections; a keep-alive client sticks to one pod just the same.
+
+// tcpEchoIdleTimeout closes connections that send nothing for this long;
+// TCP_IDLE_TIMEOUT, set in serve
+var tcpEchoIdleTimeout = 5 * time.Minute
+
+// maxEchoLine bounds one line, so a client can't grow the buffer forever
+const maxEchoLine = 64 << 10
+
+var (
+	tcpConnections = newCounterVec("tcp_echo_connections_total",
+		"Connections accepted by the TCP echo server.")
+	tcpLines = newCounterVec("tcp_echo_lines_total",
+		"Lines echoed by the TCP echo server.")
+	tcpActive atomic.Int64
+)
+
+func init() {
+	newGaugeFunc("tcp_echo_connections_active", "Open TCP echo connections.", func() float64 {
+		return float64(tcpActive.Load())
+	})
+}
+
+// tcpEchoServer tracks its connections so Close can say goodbye to each
+type tcpEchoServer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	done  sync.WaitGroup
+	seq   atomic.Int64
+}
+
+// serveTCPEcho listens on addr and echoes lines until Close
+func serveTCPEcho(addr string) *tcpEchoServer {
+	ln, err := listen("tcp", addr)
+	if err != nil {
+		fatal("TCP echo server failed to start", "addr", addr, "error", err)
+	}
+	s := &tcpEchoServer{ln: ln, conns: map[net.Conn]struct{}{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				slog.Warn("TCP echo accept failed", "error", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			s.mu.Lock()
+			s.conns[conn] = struct{}{}
+			s.done.Add(1)
+			s.mu.Unlock()
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *tcpEchoServer) handle(conn net.Conn) {
+	defer s.done.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	tcpConnections.Inc()
+	tcpActive.Add(1)
+	defer tcpActive.Add(-1)
+
+	hostname, _ := os.Hostname()
+	id := s.seq.Add(1)
+	start := time.Now()
+	slog.Debug("TCP echo connection opened", "remote", conn.RemoteAddr().String(), "conn", id)
+	fmt.Fprintf(conn, "%s: hello %s, this is connection %d; every line you send comes back from this pod\n",
+		hostname, conn.RemoteAddr(), id)
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxEchoLine)
+	lines := 0
+	for conn.SetReadDeadline(time.Now().Add(tcpEchoIdleTimeout)) == nil && scanner.Scan() {
+		lines++
+		tcpLines.Inc()
+		if _, err := fmt.Fprintf(conn, "%s: %s\n", hostname, scanner.Text()); err != nil {
+			break
+		}
+	}
+	if errors.Is(scanner.Err(), os.ErrDeadlineExceeded) {
+		fmt.Fprintf(conn, "%s: idle for %s, closing\n", hostname, tcpEchoIdleTimeout)
+	} else if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		fmt.Fprintf(conn, "%s: line longer than %d bytes, closing\n", hostname, maxEchoLine)
+	}
+	slog.Debug("TCP echo connection closed", "remote", conn.RemoteAddr().String(), "conn", id,
+		"lines", lines, "duration", time.Since(start).String())
+}
+
+// Close stops accepting, tells open connections the pod is going away and
+// closes them; clients reconnect through the Service to another pod
+func (s *tcpEchoServer) Close() {
+	s.ln.Close()
+	hostname, _ := os.Hostname()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		fmt.Fprintf(conn, "%s: shutting down, reconnect to reach another pod\n", hostname)
+		conn.Close()
+	}
+	open := len(s.conns)
+	s.mu.Unlock()
+	s.done.Wait()
+	if open > 0 {
+		slog.Info("TCP echo connections closed", "count", open)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+// Page templates, embedded like the static assets. html/template escapes
+// every value for its context (text, attribute, URL), so config, flags and
+// env vars can't inject markup into the page.
+//
+//go:embed templates
+var templateFiles embed.FS
+
+// parseTemplates parses every page and partial under templates/
+func parseTemplates() (*template.Template, error) {
+	return template.ParseFS(templateFiles, "templates/*.html")
+}
+
+// renderPage executes the named template into a buffer first, so a failure
+// becomes a clean 500 rather than half a page
+func renderPage(w http.ResponseWriter, r *http.Request, pages *template.Template, name string, data any) {
+	var buf bytes.Buffer
+	if err := pages.ExecuteTemplate(&buf, name, data); err != nil {
+		slog.Error("rendering page failed", "template", name, "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "rendering "+name+" failed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	buf.WriteTo(w)
+}
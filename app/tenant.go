@@ -0,0 +1,253 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Soft multi-tenancy at the app layer: one Deployment serves every tenant,
+// telling them apart by a header or by the Host's subdomain, and keeps
+// their counters, guestbook entries and rate limits apart itself:
+//
+//	TENANT_MODE=header                   X-Tenant: acme (TENANT_HEADER to rename it)
+//	TENANT_MODE=subdomain                acme.demo.local (TENANT_DOMAIN=demo.local)
+//	curl -H 'X-Tenant: acme' localhost:30080/api/counter
+//	curl localhost:30080/api/tenants
+//
+// Requests without one belong to tenant "default". The contrast with a
+// namespace per tenant is the lesson: here the separation is only as good
+// as this code - a bug or a forged header crosses it, and tenants share one
+// pod's CPU, memory and failure - while namespaces get it from the cluster
+// (quotas, NetworkPolicies, RBAC) whatever the app does. With
+// RATE_LIMIT_TENANT_RPS each tenant also gets its own bucket, so one noisy
+// tenant gets 429s before the others notice.
+
+// defaultTenant owns requests that don't name one
+const defaultTenant = "default"
+
+// maxObservedTenants bounds /api/tenants and the tenant label: past it new
+// tenants are still served, but counted as "_other"
+const maxObservedTenants = 200
+
+// validTenant is a DNS label, so a tenant can also be a subdomain and a namespace name
+var validTenant = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// tenantResolver finds the tenant of a request
+type tenantResolver struct {
+	mode   string // header or subdomain
+	header string
+	domain string // subdomain mode: the suffix after the tenant label, or "" for any
+}
+
+// tenants is set in main when TENANT_MODE is on
+var tenants *tenantResolver
+
+// TenantInfo is one tenant this pod has served
+type TenantInfo struct {
+	Name      string    `json:"name"`
+	Requests  int64     `json:"requests"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// TenantsResponse is returned by /api/tenants
+type TenantsResponse struct {
+	Mode    string       `json:"mode"` // off, header or subdomain
+	Source  string       `json:"source,omitempty"`
+	Pod     string       `json:"pod"`
+	Tenants []TenantInfo `json:"tenants"` // seen by this pod, busiest first
+}
+
+var (
+	tenantsMu   sync.Mutex
+	tenantsSeen = map[string]*TenantInfo{}
+
+	tenantRequests = newCounterVec("tenant_requests_total", "Requests by tenant (TENANT_MODE).", "tenant")
+)
+
+// newTenantResolverFromEnv returns nil when TENANT_MODE is off
+func newTenantResolverFromEnv() (*tenantResolver, error) {
+	t := &tenantResolver{
+		mode:   getEnv("TENANT_MODE", "off"),
+		header: getEnv("TENANT_HEADER", "X-Tenant"),
+		domain: strings.Trim(strings.ToLower(getEnv("TENANT_DOMAIN", "")), "."),
+	}
+	switch t.mode {
+	case "off":
+		return nil, nil
+	case "header", "subdomain":
+		return t, nil
+	}
+	return nil, fmt.Errorf("TENANT_MODE %q must be off, header or subdomain", t.mode)
+}
+
+// source describes where tenants come from, for /api/tenants and the banner
+func (t *tenantResolver) source() string {
+	if t.mode == "header" {
+		return t.header
+	}
+	if t.domain == "" {
+		return "<tenant>.<any host>"
+	}
+	return "<tenant>." + t.domain
+}
+
+// resolve returns r's tenant, "" when it names an invalid one
+func (t *tenantResolver) resolve(r *http.Request) string {
+	var name string
+	if t.mode == "header" {
+		name = strings.ToLower(strings.TrimSpace(r.Header.Get(t.header)))
+	} else {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if net.ParseIP(host) == nil {
+			if t.domain != "" {
+				name, _ = strings.CutSuffix(host, "."+t.domain)
+				if name == host || strings.Contains(name, ".") {
+					name = ""
+				}
+			} else if label, rest, found := strings.Cut(host, "."); found && rest != "" {
+				name = label
+			}
+		}
+	}
+	if name == "" {
+		return defaultTenant
+	}
+	if !validTenant.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+type tenantKey struct{}
+
+// withTenant puts the request's tenant in its context, for the rate limiter
+// and handlers inside it; probes, scrapes and the admin surface belong to
+// no tenant
+func withTenant(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if rateLimitExempt(pattern) {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tenants == nil {
+			next(w, r)
+			return
+		}
+		tenant := tenants.resolve(r)
+		if tenant == "" {
+			writeProblem(w, r, http.StatusBadRequest, "tenant must be a DNS label: lowercase letters, digits and '-', up to 63 characters")
+			return
+		}
+		observeTenant(tenant)
+		w.Header().Set("X-Tenant", tenant)
+		next(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+	}
+}
+
+// tenantFromContext returns the request's tenant, or "" when TENANT_MODE is off
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenantScoped gives each tenant its own copy of a Redis key; with
+// TENANT_MODE off the key is unchanged
+func tenantScoped(ctx context.Context, key string) string {
+	if tenant := tenantFromContext(ctx); tenant != "" {
+		return key + ":tenant:" + tenant
+	}
+	return key
+}
+
+func observeTenant(name string) {
+	now := time.Now().UTC()
+	tenantsMu.Lock()
+	info, ok := tenantsSeen[name]
+	if !ok && len(tenantsSeen) < maxObservedTenants {
+		info = &TenantInfo{Name: name, FirstSeen: now}
+		tenantsSeen[name] = info
+	}
+	if info != nil {
+		info.Requests++
+		info.LastSeen = now
+	}
+	tenantsMu.Unlock()
+	if info == nil {
+		name = "_other"
+	}
+	tenantRequests.Inc(name)
+}
+
+// tenantCounter is a per-pod counter kept separately for each tenant
+type tenantCounter struct {
+	mu     sync.Mutex
+	counts map[string]*atomic.Int64
+}
+
+func (c *tenantCounter) get(ctx context.Context) *atomic.Int64 {
+	tenant := tenantFromContext(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = map[string]*atomic.Int64{}
+	}
+	n, ok := c.counts[tenant]
+	if !ok {
+		n = new(atomic.Int64)
+		c.counts[tenant] = n
+	}
+	return n
+}
+
+// total adds up every tenant's count
+func (c *tenantCounter) total() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int64
+	for _, v := range c.counts {
+		n += v.Load()
+	}
+	return n
+}
+
+// reset zeroes every tenant's count
+func (c *tenantCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts = nil
+}
+
+// tenantsHandler lists the tenants this pod has served
+func tenantsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	hostname, _ := os.Hostname()
+	resp := TenantsResponse{Mode: "off", Pod: hostname, Tenants: []TenantInfo{}}
+	if tenants != nil {
+		resp.Mode, resp.Source = tenants.mode, tenants.source()
+	}
+	tenantsMu.Lock()
+	for _, info := range tenantsSeen {
+		resp.Tenants = append(resp.Tenants, *info)
+	}
+	tenantsMu.Unlock()
+	slices.SortFunc(resp.Tenants, func(a, b TenantInfo) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), strings.Compare(a.Name, b.Name))
+	})
+	writeJSON(w, http.StatusOK, resp)
+}
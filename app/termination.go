@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Kubernetes reads a container's last words from /dev/termination-log and
+// shows them in kubectl describe pod, under Last State:
+//
+//	Last State:  Terminated
+//	  Reason:    Error
+//	  Message:   {"reason":"CrashAfter","message":"CRASH_AFTER=30s elapsed","exit_code":3,...}
+//	  Exit Code: 3
+//
+// We write one whenever the process ends on purpose: a clean shutdown, a
+// fatal error, /chaos/crash, a forced exit. TERMINATION_LOG moves the file
+// (terminationMessagePath in the pod spec must match); the default path is
+// only written when the kubelet has mounted it.
+//
+// For troubleshooting exercises the container can also fail on cue:
+//
+//	CRASH_AFTER=30s EXIT_CODE=3   exit 3 thirty seconds after starting
+//	EXIT_CODE=1                   exit 1 after every clean shutdown
+//
+// The first gives CrashLoopBackOff with a growing back-off; the second
+// shows how restartPolicy and Jobs treat non-zero exits.
+
+// defaultTerminationLog is the kubelet's default terminationMessagePath
+const defaultTerminationLog = "/dev/termination-log"
+
+// maxTerminationMessage is what the kubelet keeps of the file
+const maxTerminationMessage = 4096
+
+// TerminationMessage is written to the termination log as JSON
+type TerminationMessage struct {
+	Reason   string         `json:"reason"`
+	Message  string         `json:"message"`
+	ExitCode int            `json:"exit_code"`
+	Pod      string         `json:"pod"`
+	Uptime   string         `json:"uptime"`
+	Time     time.Time      `json:"time"`
+	Details  map[string]any `json:"details,omitempty"`
+}
+
+// terminationLogPath is TERMINATION_LOG, and whether it was set rather
+// than left to the kubelet's default file
+func terminationLogPath() (string, bool) {
+	if path := getEnv("TERMINATION_LOG", ""); path != "" {
+		return path, true
+	}
+	return defaultTerminationLog, false
+}
+
+// writeTerminationMessage records why the process is about to exit, and
+// notes it in the restart history.
+// Failures only log: the exit matters more than the message.
+func writeTerminationMessage(exitCode int, reason, message string, details map[string]any) {
+	restartHistory.recordExit(exitCode, reason, message)
+	path, custom := terminationLogPath()
+	flags := os.O_WRONLY | os.O_TRUNC
+	if custom {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		if custom {
+			slog.Warn("cannot write termination log", "path", path, "error", err)
+		}
+		return
+	}
+	defer f.Close()
+
+	hostname, _ := os.Hostname()
+	data, _ := json.Marshal(TerminationMessage{Reason: reason, Message: message, ExitCode: exitCode, Pod: hostname,
+		Uptime: time.Since(startTime).Round(time.Second).String(), Time: time.Now().UTC(), Details: details})
+	if len(data) > maxTerminationMessage {
+		data, _ = json.Marshal(TerminationMessage{Reason: reason, Message: message[:min(len(message), 1024)],
+			ExitCode: exitCode, Pod: hostname, Time: time.Now().UTC()})
+	}
+	f.Write(data)
+}
+
+// terminate writes the termination message and exits with code
+func terminate(code int, reason, message string, details map[string]any) {
+	writeTerminationMessage(code, reason, message, details)
+	podEvents.Record("Warning", reason, message)
+	podEvents.Flush(2 * time.Second)
+	os.Exit(code)
+}
+
+// slogDetails turns slog-style key-value pairs into a details map
+func slogDetails(args []any) map[string]any {
+	if len(args) == 0 {
+		return nil
+	}
+	details := map[string]any{}
+	for i := 0; i+1 < len(args); i += 2 {
+		v := args[i+1]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		details[fmt.Sprint(args[i])] = v
+	}
+	return details
+}
+
+// configuredExitCode is EXIT_CODE, or fallback when it's unset
+func configuredExitCode(fallback int) int {
+	code, err := strconv.Atoi(getEnv("EXIT_CODE", ""))
+	if err != nil || code < 0 || code > 255 {
+		return fallback
+	}
+	return code
+}
+
+// scheduleCrash exits with EXIT_CODE (1 by default) once CRASH_AFTER has
+// passed since startup
+func scheduleCrash() {
+	after := getEnvDuration("CRASH_AFTER", 0)
+	if after <= 0 {
+		return
+	}
+	code := configuredExitCode(1)
+	slog.Warn("crash scheduled", "crash_after", after.String(), "exit_code", code)
+	time.AfterFunc(after, func() {
+		slog.Error("crashing as scheduled by CRASH_AFTER", "crash_after", after.String(), "exit_code", code)
+		terminate(code, "CrashAfter", "CRASH_AFTER="+after.String()+" elapsed", map[string]any{"crash_after": after.String()})
+	})
+}
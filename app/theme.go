@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"log/slog"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Homepage theme for blue/green and canary demos, so you can tell which
+// version answered from across the room:
+//
+//	APP_COLOR=blue         a palette name, or a hex color like #2f80ed
+//	APP_COLOR=pod          a color of the pod's own, see podColor
+//	APP_BANNER="GREEN - release 2.0"
+//
+// Without APP_COLOR the color follows the APP_VERSION major: purple for
+// 1.x, green for 2.x, orange for 3.x. Every page also carries the pod's
+// color as a stripe, and /api/info and /api/fanout report it, so pods of
+// one version still tell apart in screenshots.
+
+// theme is the resolved homepage look
+type theme struct {
+	Color      string // palette name or hex, reported in /api/info
+	Accent     string
+	AccentDark string
+	Banner     string
+}
+
+// palettes are the named APP_COLOR values
+var palettes = map[string][2]string{
+	"purple": {"#667eea", "#764ba2"},
+	"blue":   {"#2f80ed", "#1c4fa0"},
+	"green":  {"#11998e", "#0b6e4f"},
+	"orange": {"#f2994a", "#c0392b"},
+	"red":    {"#eb5757", "#a82828"},
+}
+
+// versionColors is the default color per APP_VERSION major
+var versionColors = map[int]string{1: "purple", 2: "green", 3: "orange"}
+
+var hexColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// currentTheme resolves APP_COLOR and APP_BANNER once
+var currentTheme = sync.OnceValue(func() theme {
+	color := getEnv("APP_COLOR", "")
+	if strings.EqualFold(strings.TrimSpace(color), "pod") {
+		color = currentPodColor()
+	}
+	t, err := resolveTheme(color, buildInfo().Version)
+	if err != nil {
+		slog.Warn("invalid APP_COLOR, using the version color", "error", err)
+	}
+	t.Banner = getEnv("APP_BANNER", "")
+	return t
+})
+
+// resolveTheme maps color, or the version's default when color is empty.
+// On error the version's default is returned too.
+func resolveTheme(color, appVersion string) (theme, error) {
+	fallback, ok := versionColors[majorVersion(appVersion)]
+	if !ok {
+		fallback = "purple"
+	}
+	color = strings.ToLower(strings.TrimSpace(color))
+	switch {
+	case color == "":
+		color = fallback
+	case hexColor.MatchString(color):
+		return theme{Color: color, Accent: color, AccentDark: darken(color)}, nil
+	}
+	p, ok := palettes[color]
+	if !ok {
+		p = palettes[fallback]
+		t := theme{Color: fallback, Accent: p[0], AccentDark: p[1]}
+		return t, fmt.Errorf("unknown color %q: want #rrggbb, pod or one of purple, blue, green, orange, red", color)
+	}
+	return theme{Color: color, Accent: p[0], AccentDark: p[1]}, nil
+}
+
+// podColor derives a stable #rrggbb from hostname: the hue comes from an
+// FNV hash of the name, saturation and lightness are fixed so white text
+// stays readable on every pod. A Deployment's pods get new names, and so
+// new colors, on every rollout; a StatefulSet's keep theirs.
+func podColor(hostname string) string {
+	h := fnv.New32a()
+	h.Write([]byte(hostname))
+	hue := float64(h.Sum32()%360) / 60
+	const saturation, lightness = 0.65, 0.45
+	chroma := (1 - math.Abs(2*lightness-1)) * saturation
+	x := chroma * (1 - math.Abs(math.Mod(hue, 2)-1))
+	var r, g, b float64
+	switch int(hue) {
+	case 0:
+		r, g = chroma, x
+	case 1:
+		r, g = x, chroma
+	case 2:
+		g, b = chroma, x
+	case 3:
+		g, b = x, chroma
+	case 4:
+		r, b = x, chroma
+	default:
+		r, b = chroma, x
+	}
+	m := lightness - chroma/2
+	return fmt.Sprintf("#%02x%02x%02x", uint8(math.Round((r+m)*255)), uint8(math.Round((g+m)*255)), uint8(math.Round((b+m)*255)))
+}
+
+// currentPodColor is podColor of this pod's hostname
+var currentPodColor = sync.OnceValue(func() string {
+	hostname, _ := os.Hostname()
+	return podColor(hostname)
+})
+
+// darken scales a #rrggbb color to 70% for the gradient's second stop
+func darken(hex string) string {
+	n, _ := strconv.ParseUint(hex[1:], 16, 32)
+	r, g, b := (n>>16&0xff)*7/10, (n>>8&0xff)*7/10, (n&0xff)*7/10
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
+
+// themeStyle is the homepage body's inline style; style.css reads the
+// accent from these variables. Safe as CSS: the colors come from the
+// palette, passed the hex check or were formatted by podColor.
+func themeStyle() template.CSS {
+	t := currentTheme()
+	return template.CSS("--accent: " + t.Accent + "; --accent-dark: " + t.AccentDark + "; --pod-color: " + currentPodColor())
+}
+
+// themeBadge is the homepage's version and color badge
+func themeBadge() string {
+	return "v" + strings.TrimPrefix(buildInfo().Version, "v") + " · " + currentTheme().Color
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Network throughput with nothing but curl, between any two pods:
+//
+//	curl -o /dev/null -w '%{speed_download}\n' 'go-app-service/api/download?mb=100'
+//	head -c 100M /dev/zero | curl -T - go-app-service/api/upload-sink
+//
+// The download is random bytes, so gzip on the way can't flatter it, sent
+// with a Content-Length; the upload sink reads and drops the body and
+// says how fast it came in. Pod to pod on one node stays on the node's
+// bridge or veth pairs; across nodes it goes through the CNI's overlay or
+// routes, and the difference is the lesson. Both skip the request timeout
+// and the traffic mirror. DOWNLOAD_MAX_MB (1024) and UPLOAD_SINK_MAX_MB
+// (10240) cap one request.
+
+// UploadSinkResponse is returned by /api/upload-sink
+type UploadSinkResponse struct {
+	Bytes          int64   `json:"bytes"`
+	DurationMS     float64 `json:"duration_ms"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	Mbps           float64 `json:"mbps"` // megabits, as links are rated
+	Pod            string  `json:"pod"`
+	Error          string  `json:"error,omitempty"` // the upload stopped early
+}
+
+var (
+	throughputBytes = newCounterVec("throughput_bytes_total",
+		"Bytes sent by /api/download and received by /api/upload-sink.", "direction")
+
+	// downloadBlock is repeated to make up a download; 1MiB is far past
+	// gzip's 32KiB window, so the repeats don't compress either
+	downloadBlock = sync.OnceValue(func() []byte {
+		b := make([]byte, 1<<20)
+		rand.Read(b)
+		return b
+	})
+)
+
+// downloadHandler serves GET /api/download?mb=
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	mb, ok := queryInt(w, r, "mb", 1, getEnvInt("DOWNLOAD_MAX_MB", 1024))
+	if !ok {
+		return
+	}
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	block := downloadBlock()
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.FormatInt(mb*int64(len(block)), 10))
+	h.Set("Content-Disposition", `attachment; filename="download-`+strconv.FormatInt(mb, 10)+`mb.bin"`)
+	h.Set("Cache-Control", "no-store")
+	for range mb {
+		n, err := w.Write(block)
+		throughputBytes.Add(float64(n), "download")
+		if err != nil {
+			return // the client is gone
+		}
+	}
+}
+
+// uploadSinkHandler serves POST or PUT /api/upload-sink
+func uploadSinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+	hostname, _ := os.Hostname()
+	body := http.MaxBytesReader(w, r.Body, getEnvInt("UPLOAD_SINK_MAX_MB", 10240)<<20)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, body)
+	elapsed := time.Since(start)
+	throughputBytes.Add(float64(n), "upload")
+
+	resp := UploadSinkResponse{Bytes: n, DurationMS: float64(elapsed.Microseconds()) / 1000, Pod: hostname}
+	if s := elapsed.Seconds(); s > 0 {
+		resp.BytesPerSecond = float64(n) / s
+		resp.Mbps = resp.BytesPerSecond * 8 / 1e6
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, resp)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
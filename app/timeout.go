@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A server-side deadline for every request. The handler's context is
+// cancelled when it passes, which ends what it is waiting on (outbound
+// calls, Redis and PostgreSQL queries, injected delays all take
+// r.Context()), and the client gets a 504 problem+json right away even if
+// the handler ignores the cancellation:
+//
+//	REQUEST_TIMEOUT=5s                      0 (the default) for none
+//	curl -i 'localhost:30080/api/info?delay=10s'      # 504 after 5s
+//	curl -i -H 'X-Request-Timeout: 200ms' 'localhost:30080/api/chain?hops=3&delay=1s'
+//	curl -i -H 'X-Latency-Budget: 50ms' 'localhost:30080/api/info?delay=100ms'
+//
+// X-Request-Timeout asks for a shorter deadline (never a longer one), the
+// way gRPC clients send grpc-timeout; X-Latency-Budget does the same under
+// the name of the SLI lessons (timing.go), and the 504 says which of the
+// three set the deadline. Outbound calls send what is left
+// of theirs on in it (tracingTransport), so every hop of /api/chain gives
+// up together. Set REQUEST_TIMEOUT below the Ingress's proxy-read-timeout
+// and the client's own timeout, or they give up first and the work
+// carries on for nobody.
+//
+// Routes that stream or run for as long as asked (/events, /ws/*,
+// /api/wait, /api/load/*, /chaos/*, /admin/*) are exempt. A handler that
+// has already started its response when the deadline passes can't be
+// turned into a 504: its connection is closed instead.
+
+// requestTimeout is the default deadline, REQUEST_TIMEOUT, set in serve
+var requestTimeout time.Duration
+
+// maxRequestTimeoutHeader bounds X-Request-Timeout when there is no default
+const maxRequestTimeoutHeader = 5 * time.Minute
+
+var requestTimeouts = newCounterVec("http_request_timeouts_total",
+	"Requests that ran past their deadline (REQUEST_TIMEOUT, X-Request-Timeout or X-Latency-Budget), by route.", "handler")
+
+func requestTimeoutExempt(pattern string) bool {
+	switch pattern {
+	case "/events", "/ws/stats", "/ws/chat", "/api/wait", "/api/download", "/api/upload-sink", "/health", "/ready", "/startup", "/metrics":
+		return true
+	}
+	return strings.HasPrefix(pattern, "/api/load/") || pattern == "/chaos" || strings.HasPrefix(pattern, "/chaos/") ||
+		strings.HasPrefix(pattern, "/admin/") || strings.HasPrefix(pattern, "/debug/")
+}
+
+// requestDeadline is the timeout for r: the default, or a shorter one the
+// client asked for, and what set it. Zero means none.
+func requestDeadline(r *http.Request) (time.Duration, string) {
+	timeout, source := requestTimeout, "REQUEST_TIMEOUT"
+	for _, header := range []string{"X-Request-Timeout", "X-Latency-Budget"} {
+		v := r.Header.Get(header)
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err == nil && d > 0 && (timeout == 0 || d < timeout) {
+			timeout, source = min(d, maxRequestTimeoutHeader), header
+		}
+	}
+	return timeout, source
+}
+
+// withTimeout runs the handler under its deadline, answering 504 when it
+// passes first
+func withTimeout(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if requestTimeoutExempt(pattern) {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout, source := requestDeadline(r)
+		if timeout <= 0 {
+			next(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{w: w, header: w.Header().Clone()}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					panicked <- v
+				}
+			}()
+			next(tw, r)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case v := <-panicked:
+			panic(v) // on the serving goroutine, where net/http expects it
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			requestTimeouts.Inc(pattern)
+			slog.Warn("request timed out", "path", r.URL.Path, "timeout", timeout.String(), "set_by", source,
+				"request_id", requestIDFromContext(r.Context()), "response_started", tw.wroteHeader)
+			if tw.wroteHeader {
+				panic(http.ErrAbortHandler) // too late for a 504; drop the connection
+			}
+			writeProblem(w, r, http.StatusGatewayTimeout, "the request took longer than its "+timeout.String()+" deadline ("+source+")")
+		}
+	}
+}
+
+// timeoutWriter keeps the handler's writes away from the real
+// ResponseWriter once the deadline has answered for it. Headers go to a
+// copy of its own until the handler writes them out, so a late handler
+// can't race the 504's.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+// Header is the real one once the response has started, so trailers set
+// after the body still go out
+func (tw *timeoutWriter) Header() http.Header {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wroteHeader && !tw.timedOut {
+		return tw.w.Header()
+	}
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	dst := tw.w.Header()
+	clear(dst)
+	for k, v := range tw.header {
+		dst[k] = v
+	}
+	tw.w.WriteHeader(code)
+	if code >= 200 { // 1xx informational responses come before the real one
+		tw.wroteHeader = true
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	return tw.w.Write(b)
+}
+
+// Flush keeps streaming responses working through the wrapper
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	http.NewResponseController(tw.w).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection's deadlines
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter { return tw.w }
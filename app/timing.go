@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Every response says how long it took and where the time went, so
+// latency lessons need nothing but curl -i:
+//
+//	curl -si 'localhost:30080/api/chain?hops=3' | grep -i '^x-'
+//	X-Request-Id: 4bf0...
+//	X-Pod: go-app-7d9f8-x2x4q
+//	X-Response-Time: 14.210ms          in this pod, middleware included
+//	X-Upstream-Latency: 12.873ms (1)   of that, waiting on outbound HTTP calls (how many)
+//
+// X-Response-Time minus X-Upstream-Latency is the pod's own share, the
+// number to compare with the client's total to see the network and the
+// Ingress. A request with X-Latency-Budget: 100ms gets a 504 when it isn't
+// answered within the budget (see timeout.go); outbound calls pass the
+// rest of it on, so the whole chain keeps to it.
+
+type upstreamLatencyKey struct{}
+
+// upstreamLatency adds up the outbound calls made for one request
+type upstreamLatency struct {
+	total atomic.Int64 // nanoseconds
+	calls atomic.Int64
+}
+
+// recordUpstreamLatency adds one outbound call to ctx's request, if any
+func recordUpstreamLatency(ctx context.Context, d time.Duration) {
+	if u, ok := ctx.Value(upstreamLatencyKey{}).(*upstreamLatency); ok {
+		u.total.Add(int64(d))
+		u.calls.Add(1)
+	}
+}
+
+// timingHeaders stamps X-Response-Time and X-Upstream-Latency on the
+// response as its header is written; withRequestID sets X-Request-ID and
+// X-Pod
+func timingHeaders(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := &upstreamLatency{}
+		tw := &timingWriter{ResponseWriter: w, start: time.Now(), upstream: u}
+		next(tw, r.WithContext(context.WithValue(r.Context(), upstreamLatencyKey{}, u)))
+	}
+}
+
+// timingWriter sets the timing headers just before the status line
+type timingWriter struct {
+	http.ResponseWriter
+	start    time.Time
+	upstream *upstreamLatency
+	stamped  bool
+}
+
+func (t *timingWriter) stamp() {
+	if t.stamped {
+		return
+	}
+	t.stamped = true
+	h := t.ResponseWriter.Header()
+	h.Set("X-Response-Time", headerMS(time.Since(t.start)))
+	if calls := t.upstream.calls.Load(); calls > 0 {
+		h.Set("X-Upstream-Latency", headerMS(time.Duration(t.upstream.total.Load()))+" ("+strconv.FormatInt(calls, 10)+")")
+	}
+}
+
+// headerMS is d in milliseconds, ASCII for a header: 0.382ms, not 382µs
+func headerMS(d time.Duration) string {
+	return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 3, 64) + "ms"
+}
+
+func (t *timingWriter) WriteHeader(code int) {
+	if code >= 200 { // 1xx informational responses come before the real one
+		t.stamp()
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *timingWriter) Write(b []byte) (int, error) {
+	t.stamp()
+	return t.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses working through the wrapper
+func (t *timingWriter) Flush() {
+	t.stamp()
+	http.NewResponseController(t.ResponseWriter).Flush()
+}
+
+// Hijack lets WebSockets upgrade through the wrapper
+func (t *timingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(t.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the connection's deadlines
+func (t *timingWriter) Unwrap() http.ResponseWriter { return t.ResponseWriter }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLS versions accepted by TLS_MIN_VERSION
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Client certificate policies accepted by MTLS_MODE
+var mtlsModes = map[string]tls.ClientAuthType{
+	"require":  tls.RequireAndVerifyClientCert, // no valid cert, no connection
+	"optional": tls.VerifyClientCertIfGiven,    // anonymous clients allowed, presented certs must verify
+}
+
+// buildTLSConfig creates the server TLS config. Certificates come from
+// certs on every handshake, so a rotated certificate is picked up without a
+// restart. When clientCAFile is set the server verifies client certificates
+// against that CA (mutual TLS). In "require" mode clients without one are
+// rejected during the handshake, before any handler runs.
+func buildTLSConfig(certs *certReloader, clientCAFile, mtlsMode, minVersion string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS_MIN_VERSION %q (want 1.2 or 1.3)", minVersion)
+	}
+	clientAuth, ok := mtlsModes[mtlsMode]
+	if !ok {
+		return nil, fmt.Errorf("unsupported MTLS_MODE %q (want require or optional)", mtlsMode)
+	}
+	cfg := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     version,
+	}
+
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = clientAuth
+	}
+
+	return cfg, nil
+}
+
+var (
+	tlsReloads = newCounterVec("tls_cert_reloads_total",
+		"Server certificate reloads, by result (success, error).", "result")
+	tlsCertExpiry = newGaugeVec("tls_cert_expiry_timestamp_seconds",
+		"NotAfter of the serving certificate, in seconds since epoch.")
+)
+
+// certReloader serves the key pair from certFile/keyFile and reloads it
+// when the files change. cert-manager and kubelet update a mounted Secret
+// by swapping a symlink, so the files are compared by content rather than
+// watched for events.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certPEM []byte // for spotting changes
+	keyPEM  []byte
+}
+
+// newCertReloader loads the initial key pair; an invalid one is fatal for
+// the caller, unlike a bad rotation later, which keeps the old certificate
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the files and swaps in the key pair if it changed
+func (c *certReloader) reload() (bool, error) {
+	certPEM, err := os.ReadFile(c.certFile)
+	if err != nil {
+		return false, fmt.Errorf("read certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("read key: %w", err)
+	}
+	c.mu.RLock()
+	unchanged := bytes.Equal(certPEM, c.certPEM) && bytes.Equal(keyPEM, c.keyPEM)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		// Often a half-finished rotation: the cert is new but the key isn't yet
+		return false, fmt.Errorf("load server certificate: %w", err)
+	}
+	c.mu.Lock()
+	c.cert, c.certPEM, c.keyPEM = &cert, certPEM, keyPEM
+	c.mu.Unlock()
+	tlsCertExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+	slog.Info("serving certificate loaded", "subject", cert.Leaf.Subject.String(),
+		"dns_names", cert.Leaf.DNSNames, "not_after", cert.Leaf.NotAfter)
+	return true, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Watch checks the files every interval, forever
+func (c *certReloader) Watch(interval time.Duration) {
+	var lastErr string
+	for range time.Tick(interval) {
+		changed, err := c.reload()
+		switch {
+		case err != nil:
+			// Log a broken pair once, not on every tick until it's fixed
+			if err.Error() != lastErr {
+				tlsReloads.Inc("error")
+				slog.Error("certificate reload failed, keeping previous certificate", "error", err)
+			}
+			lastErr = err.Error()
+		case changed:
+			tlsReloads.Inc("success")
+			lastErr = ""
+		}
+	}
+}
+
+// serveHTTPSRedirect listens on addr with plain HTTP and redirects every
+// request to the same URL on HTTPS. httpsPort is the port clients use to
+// reach HTTPS, which behind a Service may differ from the container port;
+// 443 is left out of the URL. /health and /ready are answered directly so
+// httpGet probes on the plain port keep working. Fatal if addr can't be opened.
+func serveHTTPSRedirect(addr, httpsPort string, probes http.Handler) *http.Server {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host // no port in the Host header
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/", redirect)
+	mux.Handle("/health", probes)
+	mux.Handle("/ready", probes)
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := listenAndServe(srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("HTTPS redirect server failed", "addr", addr, "error", err)
+		}
+	}()
+	return srv
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// clientCommonName returns the CN of the verified client certificate, if any
+func clientCommonName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
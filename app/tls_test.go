@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs the server and client certificates of a test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a leaf certificate for cn, returning it and its key as PEM
+func (ca *testCA) issue(t *testing.T, serial int64, cn string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// serverTLSConfig is buildTLSConfig's config for mode, with a server
+// certificate for 127.0.0.1 and client certificates checked against ca
+func serverTLSConfig(t *testing.T, ca *testCA, mode string) *tls.Config {
+	t.Helper()
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, 2, "127.0.0.1", x509.ExtKeyUsageServerAuth)
+	files := map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM, "ca.crt": ca.pem}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certs, err := newCertReloader(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := buildTLSConfig(certs, filepath.Join(dir, "ca.crt"), mode, "1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// startMTLSServer serves /api/info with buildTLSConfig's config for mode
+func startMTLSServer(t *testing.T, ca *testCA, mode string) string {
+	t.Helper()
+	// StartTLS would serve httptest's own certificate; wrap the listener
+	// so the handshake is exactly the one buildTLSConfig sets up
+	ts := httptest.NewUnstartedServer(apiInfoHandler("go-app", "test"))
+	ts.Listener = tls.NewListener(ts.Listener, serverTLSConfig(t, ca, mode))
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return "https://" + ts.Listener.Addr().String()
+}
+
+// mtlsClient trusts ca and presents certPEM/keyPEM if given
+func mtlsClient(t *testing.T, ca *testCA, certPEM, keyPEM []byte) *http.Client {
+	t.Helper()
+	cfg := &tls.Config{RootCAs: ca.pool}
+	if certPEM != nil {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}, Timeout: 5 * time.Second}
+}
+
+func getClientCN(t *testing.T, client *http.Client, url string) (string, error) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	var info AppInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	return info.ClientCN, nil
+}
+
+func TestMTLSRequireReportsClientCN(t *testing.T) {
+	ca := newTestCA(t)
+	url := startMTLSServer(t, ca, "require")
+
+	certPEM, keyPEM := ca.issue(t, 3, "workshop-client", x509.ExtKeyUsageClientAuth)
+	cn, err := getClientCN(t, mtlsClient(t, ca, certPEM, keyPEM), url)
+	if err != nil {
+		t.Fatalf("with a client certificate: %v", err)
+	}
+	if cn != "workshop-client" {
+		t.Errorf("client_cn = %q, want workshop-client", cn)
+	}
+
+	if _, err := getClientCN(t, mtlsClient(t, ca, nil, nil), url); err == nil {
+		t.Error("handshake without a client certificate succeeded; MTLS_MODE=require should refuse it")
+	}
+
+	other := newTestCA(t)
+	certPEM, keyPEM = other.issue(t, 4, "stranger", x509.ExtKeyUsageClientAuth)
+	if _, err := getClientCN(t, mtlsClient(t, ca, certPEM, keyPEM), url); err == nil {
+		t.Error("handshake with a certificate from another CA succeeded")
+	}
+}
+
+func TestMTLSOptionalAllowsAnonymous(t *testing.T) {
+	ca := newTestCA(t)
+	url := startMTLSServer(t, ca, "optional")
+
+	cn, err := getClientCN(t, mtlsClient(t, ca, nil, nil), url)
+	if err != nil {
+		t.Fatalf("without a client certificate: %v", err)
+	}
+	if cn != "" {
+		t.Errorf("client_cn = %q for an anonymous client", cn)
+	}
+	certPEM, keyPEM := ca.issue(t, 3, "workshop-client", x509.ExtKeyUsageClientAuth)
+	if cn, err := getClientCN(t, mtlsClient(t, ca, certPEM, keyPEM), url); err != nil || cn != "workshop-client" {
+		t.Errorf("client_cn = %q, %v; want workshop-client", cn, err)
+	}
+}
+
+func TestBuildTLSConfigRejectsUnknownSettings(t *testing.T) {
+	if _, err := buildTLSConfig(nil, "", "require", "1.1"); err == nil {
+		t.Error("TLS_MIN_VERSION=1.1 accepted")
+	}
+	if _, err := buildTLSConfig(nil, "", "sometimes", "1.2"); err == nil {
+		t.Error("MTLS_MODE=sometimes accepted")
+	}
+}
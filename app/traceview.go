@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /trace/{request-id} draws one recent request as a waterfall from the
+// spans this pod keeps in memory, a step before running Jaeger:
+//
+//	curl -si 'localhost:30080/api/chain?hops=3' | grep X-Request-Id
+//	open http://localhost:30080/trace/<request-id>
+//	curl -s localhost:30080/trace/<request-id>?format=json | jq '.spans[] | {name, kind, duration_ms}'
+//
+// Every finished span is kept, whether or not OTEL_EXPORTER_OTLP_ENDPOINT
+// exports it: the handler's server span, its outbound HTTP, Redis and
+// Postgres calls, and the server spans of requests it made back to this
+// same pod. Each server span also times the middleware stages it went
+// through (middleware.go), as rows that aren't exported. A stage's bar
+// covers everything inside it, so its own cost is the self column.
+// TRACE_BUFFER (500) traces are kept, oldest dropped first; /trace/ lists
+// the recent ones. A trace that went through other pods only has this
+// pod's spans: the rest are on theirs, which is the gap a collector fills.
+
+// Bounds on what the store keeps
+const (
+	defaultTraceBuffer = 500
+	maxSpansPerTrace   = 256
+)
+
+// traceStage is one middleware layer's part of a request
+type traceStage struct {
+	name       string
+	start, end time.Time
+}
+
+// stageTimer collects a request's stages; the timeout middleware can run
+// the inner ones on another goroutine
+type stageTimer struct {
+	mu     sync.Mutex
+	stages []traceStage
+}
+
+type stageTimerKey struct{}
+
+// withStageTimer starts collecting stages for the request in ctx
+func withStageTimer(ctx context.Context) (context.Context, *stageTimer) {
+	t := &stageTimer{}
+	return context.WithValue(ctx, stageTimerKey{}, t), t
+}
+
+// done returns the stages seen so far
+func (t *stageTimer) done() []traceStage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]traceStage(nil), t.stages...)
+}
+
+// timeStage records how long next takes, for requests with a stage timer
+func timeStage(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, ok := r.Context().Value(stageTimerKey{}).(*stageTimer)
+		if !ok {
+			next(w, r)
+			return
+		}
+		t.mu.Lock()
+		i := len(t.stages)
+		t.stages = append(t.stages, traceStage{name: name, start: time.Now()})
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			t.stages[i].end = time.Now()
+			t.mu.Unlock()
+		}()
+		next(w, r)
+	}
+}
+
+// storedTrace is the spans of one trace this pod has finished
+type storedTrace struct {
+	spans      []*span
+	requestIDs []string
+}
+
+// traceStore keeps the most recent traces, by trace ID and request ID
+type traceStore struct {
+	size int
+
+	mu        sync.Mutex
+	traces    map[[16]byte]*storedTrace
+	order     [][16]byte // oldest first
+	byRequest map[string][16]byte
+}
+
+// recentTraces holds defaultTraceBuffer traces until serve applies TRACE_BUFFER
+var recentTraces = &traceStore{size: defaultTraceBuffer, traces: map[[16]byte]*storedTrace{}, byRequest: map[string][16]byte{}}
+
+// add keeps a finished span
+func (ts *traceStore) add(s *span) {
+	if ts.size <= 0 {
+		return
+	}
+	s.mu.Lock()
+	requestID, _ := s.attrs["http.request_id"].(string)
+	s.mu.Unlock()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	id := s.ctx.TraceID
+	t, ok := ts.traces[id]
+	if !ok {
+		t = &storedTrace{}
+		ts.traces[id] = t
+		ts.order = append(ts.order, id)
+		for len(ts.order) > ts.size {
+			for _, rid := range ts.traces[ts.order[0]].requestIDs {
+				if ts.byRequest[rid] == ts.order[0] {
+					delete(ts.byRequest, rid)
+				}
+			}
+			delete(ts.traces, ts.order[0])
+			ts.order = ts.order[1:]
+		}
+	}
+	if len(t.spans) < maxSpansPerTrace {
+		t.spans = append(t.spans, s)
+	}
+	if requestID != "" && s.kind == spanKindServer {
+		if _, seen := ts.byRequest[requestID]; !seen {
+			t.requestIDs = append(t.requestIDs, requestID)
+		}
+		ts.byRequest[requestID] = id
+	}
+}
+
+// Len returns how many spans are kept
+func (ts *traceStore) Len() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	n := 0
+	for _, t := range ts.traces {
+		n += len(t.spans)
+	}
+	return n
+}
+
+// Clear drops every trace, returning how many spans there were
+func (ts *traceStore) Clear() int {
+	n := ts.Len()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.traces, ts.order, ts.byRequest = map[[16]byte]*storedTrace{}, nil, map[string][16]byte{}
+	return n
+}
+
+// lookup finds a trace by request ID, or by its hex trace ID
+func (ts *traceStore) lookup(id string) ([]*span, string, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	traceID, ok := ts.byRequest[id]
+	requestID := id
+	if !ok {
+		b, err := hex.DecodeString(id)
+		if err != nil || len(b) != len(traceID) {
+			return nil, "", false
+		}
+		copy(traceID[:], b)
+		requestID = ""
+	}
+	t, ok := ts.traces[traceID]
+	if !ok {
+		return nil, "", false
+	}
+	if requestID == "" && len(t.requestIDs) > 0 {
+		requestID = t.requestIDs[0]
+	}
+	return append([]*span(nil), t.spans...), requestID, true
+}
+
+// TraceSpanView is one row of the waterfall
+type TraceSpanView struct {
+	Name       string         `json:"name"`
+	Kind       string         `json:"kind"` // server, client, internal or middleware
+	SpanID     string         `json:"span_id,omitempty"`
+	ParentID   string         `json:"parent_id,omitempty"`
+	Depth      int            `json:"depth"`
+	StartMS    float64        `json:"start_ms"` // from the start of the trace
+	DurationMS float64        `json:"duration_ms"`
+	SelfMS     *float64       `json:"self_ms,omitempty"` // middleware only: without the stages inside it
+	Error      bool           `json:"error,omitempty"`
+	Attrs      map[string]any `json:"attributes,omitempty"`
+
+	OffsetPct, WidthPct float64 `json:"-"` // the bar, for the page
+}
+
+// TraceView is returned by /trace/{request-id}
+type TraceView struct {
+	TraceID    string          `json:"trace_id"`
+	RequestID  string          `json:"request_id,omitempty"`
+	Pod        string          `json:"pod"`
+	Start      time.Time       `json:"start"`
+	DurationMS float64         `json:"duration_ms"`
+	Spans      []TraceSpanView `json:"spans"`
+}
+
+// TraceSummary is one trace in /trace/
+type TraceSummary struct {
+	TraceID    string    `json:"trace_id"`
+	RequestID  string    `json:"request_id"`
+	Name       string    `json:"name"`
+	Status     any       `json:"status,omitempty"`
+	Start      time.Time `json:"start"`
+	DurationMS float64   `json:"duration_ms"`
+	Spans      int       `json:"spans"`
+}
+
+// TracePage is the data for templates/trace.html
+type TracePage struct {
+	AppName    string
+	ThemeStyle template.CSS
+	Trace      *TraceView
+	Recent     []TraceSummary
+}
+
+var spanKindNames = map[int]string{spanKindInternal: "internal", spanKindServer: "server", spanKindClient: "client"}
+
+// traceView lays the spans out as a tree, children under their parents
+// in start order, with each server span's stages first
+func traceView(spans []*span, requestID string) TraceView {
+	hostname, _ := os.Hostname()
+	view := TraceView{RequestID: requestID, Pod: hostname, Spans: []TraceSpanView{}}
+	if len(spans) == 0 {
+		return view
+	}
+	view.TraceID = hex.EncodeToString(spans[0].ctx.TraceID[:])
+	t0, t1 := spans[0].start, spans[0].end
+	byID := map[[8]byte]bool{}
+	for _, s := range spans {
+		byID[s.ctx.SpanID] = true
+		if s.start.Before(t0) {
+			t0 = s.start
+		}
+		if s.end.After(t1) {
+			t1 = s.end
+		}
+	}
+	view.Start, view.DurationMS = t0, ms(t1.Sub(t0))
+	total := max(t1.Sub(t0), time.Microsecond)
+	bar := func(v *TraceSpanView, start, end time.Time) {
+		v.StartMS, v.DurationMS = ms(start.Sub(t0)), ms(end.Sub(start))
+		v.OffsetPct = float64(start.Sub(t0)) / float64(total) * 100
+		v.WidthPct = max(float64(end.Sub(start))/float64(total)*100, 0.2)
+	}
+
+	children := map[[8]byte][]*span{}
+	var roots []*span
+	for _, s := range spans {
+		if byID[s.parentID] {
+			children[s.parentID] = append(children[s.parentID], s)
+		} else {
+			roots = append(roots, s)
+		}
+	}
+	byStart := func(list []*span) {
+		sort.Slice(list, func(i, j int) bool { return list[i].start.Before(list[j].start) })
+	}
+	var walk func(s *span, depth int)
+	walk = func(s *span, depth int) {
+		s.mu.Lock()
+		v := TraceSpanView{Name: s.name, Kind: spanKindNames[s.kind], SpanID: hex.EncodeToString(s.ctx.SpanID[:]),
+			Depth: depth, Error: s.isError, Attrs: map[string]any{}}
+		for k, val := range s.attrs {
+			v.Attrs[k] = val
+		}
+		stages := s.stages
+		s.mu.Unlock()
+		if s.parentID != ([8]byte{}) {
+			v.ParentID = hex.EncodeToString(s.parentID[:])
+		}
+		bar(&v, s.start, s.end)
+		view.Spans = append(view.Spans, v)
+
+		for i, st := range stages {
+			end := st.end
+			if end.IsZero() {
+				end = s.end // still running inside a timed-out request
+			}
+			sv := TraceSpanView{Name: st.name, Kind: "middleware", Depth: depth + 1}
+			bar(&sv, st.start, end)
+			self := sv.DurationMS
+			if i+1 < len(stages) && !stages[i+1].end.IsZero() {
+				self = roundTo(max(self-ms(stages[i+1].end.Sub(stages[i+1].start)), 0), 3)
+			}
+			sv.SelfMS = &self
+			view.Spans = append(view.Spans, sv)
+		}
+		kids := children[s.ctx.SpanID]
+		byStart(kids)
+		for _, c := range kids {
+			walk(c, depth+1)
+		}
+	}
+	byStart(roots)
+	for _, s := range roots {
+		walk(s, 0)
+	}
+	return view
+}
+
+// summaries lists the recent traces with a request ID, newest first,
+// leaving out the probes and this page's own requests
+func (ts *traceStore) summaries(limit int) []TraceSummary {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	out := []TraceSummary{}
+	for i := len(ts.order) - 1; i >= 0 && len(out) < limit; i-- {
+		id := ts.order[i]
+		t := ts.traces[id]
+		if len(t.requestIDs) == 0 {
+			continue
+		}
+		sum := TraceSummary{TraceID: hex.EncodeToString(id[:]), RequestID: t.requestIDs[0], Spans: len(t.spans)}
+		var route string
+		var end time.Time
+		for _, s := range t.spans {
+			if sum.Start.IsZero() || s.start.Before(sum.Start) {
+				sum.Start = s.start
+			}
+			if s.end.After(end) {
+				end = s.end
+			}
+			if s.kind == spanKindServer && sum.Name == "" {
+				s.mu.Lock()
+				sum.Name, sum.Status = s.name, s.attrs["http.status_code"]
+				route, _ = s.attrs["http.route"].(string)
+				s.mu.Unlock()
+			}
+		}
+		if rateLimitExempt(route) || route == "/trace/" {
+			continue
+		}
+		sum.DurationMS = ms(end.Sub(sum.Start))
+		out = append(out, sum)
+	}
+	return out
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// traceHandler serves /trace/ and /trace/{request-id}: a page for
+// browsers, JSON for everything else or with ?format=json
+func traceHandler(pages *template.Template, appName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+		html := strings.HasPrefix(r.Header.Get("Accept"), "text/html") && r.URL.Query().Get("format") == ""
+		page := TracePage{AppName: appName, ThemeStyle: themeStyle()}
+		id := strings.TrimPrefix(r.URL.Path, "/trace/")
+		if id == "" {
+			page.Recent = recentTraces.summaries(50)
+			if html {
+				renderPage(w, r, pages, "trace.html", page)
+				return
+			}
+			writeJSON(w, http.StatusOK, page.Recent)
+			return
+		}
+		spans, requestID, ok := recentTraces.lookup(id)
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, "no recent trace for "+id+" on this pod; see /trace/ for the ones kept")
+			return
+		}
+		view := traceView(spans, requestID)
+		if html {
+			page.Trace = &view
+			renderPage(w, r, pages, "trace.html", page)
+			return
+		}
+		writeJSON(w, http.StatusOK, view)
+	}
+}
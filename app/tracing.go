@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Distributed tracing, written against the OpenTelemetry wire formats
+// rather than with the OpenTelemetry SDK: W3C Trace Context propagation
+// (the traceparent header), spans for every handler and outbound call, and
+// export to a collector using OTLP/HTTP with JSON encoding. Any OTLP
+// collector, Jaeger or Tempo can receive it. Spans are the app's own type
+// so they can carry what the SDK's don't, like the middleware stages
+// /trace/ draws; the cost is no sampling or batching options beyond the
+// ones here, and no OTel instrumentation libraries.
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// spanContext identifies a span across process boundaries
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// span is a single timed operation within a trace
+type span struct {
+	name     string
+	kind     int
+	ctx      spanContext
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	isError  bool
+
+	mu     sync.Mutex
+	attrs  map[string]any
+	stages []traceStage // a server span's middleware, for /trace/
+}
+
+type spanContextKey struct{}
+
+// tracer is the active exporter, or nil when tracing export is disabled.
+// Spans are still created and propagated without it, so trace IDs flow
+// through the system even if this pod doesn't report them.
+var tracer *otlpExporter
+
+// startSpan starts a child of the span in ctx (or a new trace)
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]any{}}
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		s.ctx.TraceID = parent.TraceID
+		s.ctx.Sampled = parent.Sampled
+		s.parentID = parent.SpanID
+	} else {
+		rand.Read(s.ctx.TraceID[:])
+		s.ctx.Sampled = true
+	}
+	rand.Read(s.ctx.SpanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s.ctx), s
+}
+
+// contextWithRemoteParent continues a trace started by an upstream caller
+func contextWithRemoteParent(ctx context.Context, h http.Header) context.Context {
+	if sc, ok := parseTraceparent(h.Get("traceparent")); ok {
+		return context.WithValue(ctx, spanContextKey{}, sc)
+	}
+	return ctx
+}
+
+// SetAttr records an attribute on the span
+func (s *span) SetAttr(key string, value any) {
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *span) SetError(err error) {
+	s.mu.Lock()
+	s.isError = true
+	s.attrs["error.message"] = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and hands it to the exporter, and to the store
+// behind /trace/
+func (s *span) End() {
+	s.end = time.Now()
+	recentTraces.add(s)
+	if tracer != nil && s.ctx.Sampled {
+		tracer.enqueue(s)
+	}
+}
+
+// traceIDFromContext returns the hex trace ID in ctx, for log correlation
+func traceIDFromContext(ctx context.Context) string {
+	if sc, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		return hex.EncodeToString(sc.TraceID[:])
+	}
+	return ""
+}
+
+// traceparent renders the W3C header: version-traceid-spanid-flags
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// parseTraceparent parses a W3C traceparent header
+func parseTraceparent(value string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != 16 {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != 8 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	if sc.TraceID == ([16]byte{}) || sc.SpanID == ([8]byte{}) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// tracingTransport creates a client span for each outbound request and
+// injects traceparent (and X-Request-ID) so the next service joins the same
+// trace, and X-Request-Timeout when the request has a deadline
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, s := startSpan(req.Context(), "HTTP "+req.Method, spanKindClient)
+	defer s.End()
+	s.SetAttr("http.method", req.Method)
+	s.SetAttr("http.url", req.URL.String())
+
+	req = req.Clone(ctx)
+	req.Header.Set("traceparent", s.ctx.traceparent())
+	if id := requestIDFromContext(ctx); id != "" && req.Header.Get("X-Request-ID") == "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	if deadline, ok := ctx.Deadline(); ok && req.Header.Get("X-Request-Timeout") == "" {
+		// What is left of our deadline, so the next service stops when we do
+		req.Header.Set("X-Request-Timeout", max(time.Until(deadline), time.Millisecond).Round(time.Millisecond).String())
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	recordUpstreamLatency(ctx, time.Since(start)) // for X-Upstream-Latency
+	if err != nil {
+		s.SetError(err)
+		return nil, err
+	}
+	s.SetAttr("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		s.isError = true
+	}
+	return resp, nil
+}
+
+// outboundClient is the HTTP client every outbound call should use, so
+// trace context is always propagated
+var outboundClient = &http.Client{
+	Transport: tracingTransport{base: http.DefaultTransport},
+	Timeout:   10 * time.Second,
+}
+
+// otlpExporter batches finished spans and POSTs them to an OTLP/HTTP endpoint
+type otlpExporter struct {
+	url     string
+	service string
+	client  *http.Client
+
+	mu    sync.Mutex
+	queue []*span
+}
+
+// maxQueuedSpans bounds memory if the collector is down
+const maxQueuedSpans = 2048
+
+// newOTLPExporter starts an exporter sending to endpoint (e.g.
+// http://otel-collector:4318) and flushing every few seconds
+func newOTLPExporter(endpoint, service string) *otlpExporter {
+	e := &otlpExporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+	go func() {
+		for range time.Tick(5 * time.Second) {
+			e.Flush()
+		}
+	}()
+	return e
+}
+
+func (e *otlpExporter) enqueue(s *span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) >= maxQueuedSpans {
+		return
+	}
+	e.queue = append(e.queue, s)
+}
+
+// Flush exports all queued spans
+func (e *otlpExporter) Flush() {
+	e.mu.Lock()
+	batch := e.queue
+	e.queue = nil
+	e.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e.payload(batch))
+	if err != nil {
+		slog.Error("trace export encode failed", "error", err)
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("trace export failed", "error", err, "spans", len(batch))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("trace export rejected", "status", resp.StatusCode, "spans", len(batch))
+	}
+}
+
+// payload builds an OTLP ExportTraceServiceRequest in its JSON mapping
+func (e *otlpExporter) payload(batch []*span) map[string]any {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		out := map[string]any{
+			"traceId":           hex.EncodeToString(s.ctx.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.ctx.SpanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != ([8]byte{}) {
+			out["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.isError {
+			out["status"] = map[string]any{"code": 2} // STATUS_CODE_ERROR
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": e.service}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "go-demo-app"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes converts attributes to OTLP KeyValue JSON
+func otlpAttributes(attrs map[string]any) []map[string]any {
+	out := make([]map[string]any, 0, len(attrs))
+	for _, key := range sortedKeys(attrs) {
+		var value map[string]any
+		switch v := attrs[key].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]any{"key": key, "value": value})
+	}
+	return out
+}
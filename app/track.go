@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Canary tracks. The stable and canary Deployments run the same image with
+// DEPLOYMENT_TRACK set apart, and every answer says which one gave it:
+//
+//	DEPLOYMENT_TRACK=canary DEPLOYMENT_WEIGHT=10
+//	curl -sI localhost:30080/api/info | grep X-Deployment-Track
+//	./app loadgen -rps 50 -duration 1m http://go-app-service/api/info     # Tracks: stable: 2700 (90.0%), canary: 300 (10.0%)
+//	curl localhost:30080/api/track
+//
+// The track is in the X-Deployment-Track header, /api/info, every log line
+// and the track label of track_requests_total, and the homepage shows a
+// banner on the canary. DEPLOYMENT_WEIGHT is the share the Ingress or mesh
+// is meant to send this track (the canary-weight annotation, a VirtualService
+// weight); comparing it with what arrives shows how exact the split is:
+//
+//	sum by (track) (rate(track_requests_total[5m])) / scalar(sum(rate(track_requests_total[5m])))
+//
+// A replica-count split (9 stable pods, 1 canary behind one Service) is only
+// as exact as kube-proxy's random choice, and keep-alive skews it further.
+// Probes and scrapes aren't counted: every pod gets the same number of
+// those whatever the weights.
+
+// deploymentTracks are the accepted DEPLOYMENT_TRACK values
+var deploymentTracks = []string{"stable", "canary"}
+
+// deploymentTrack is DEPLOYMENT_TRACK, "stable" when unset or unknown
+var deploymentTrack = sync.OnceValue(func() string {
+	track := getEnv("DEPLOYMENT_TRACK", "stable")
+	for _, t := range deploymentTracks {
+		if track == t {
+			return track
+		}
+	}
+	slog.Warn("unknown DEPLOYMENT_TRACK, using stable", "value", track, "want", deploymentTracks)
+	return "stable"
+})
+
+// trackWindow is how far back /api/track's recent rate looks
+const trackWindow = 60
+
+// TrackResponse is returned by /api/track
+type TrackResponse struct {
+	Track          string           `json:"track"`
+	Pod            string           `json:"pod"`
+	Version        string           `json:"version"`
+	ExpectedWeight *float64         `json:"expected_weight_percent,omitempty"` // DEPLOYMENT_WEIGHT
+	Requests       int64            `json:"requests"`                          // served by this pod since it started
+	ByStatus       map[string]int64 `json:"by_status"`                         // 2xx, 4xx, 5xx...
+	RPS            float64          `json:"rps"`                               // over the last minute
+	Since          time.Time        `json:"since"`
+}
+
+var (
+	trackRequests = newCounterVec("track_requests_total",
+		"Requests served, by DEPLOYMENT_TRACK and status class; probes and scrapes aren't counted.", "track", "code")
+
+	trackMu       sync.Mutex
+	trackTotal    int64
+	trackByStatus = map[string]int64{}
+	trackSeconds  [trackWindow]struct {
+		unix  int64
+		count int64
+	}
+)
+
+func init() {
+	metrics.register(&infoMetric{name: "app_deployment_track_info", help: "The DEPLOYMENT_TRACK this pod serves.",
+		labels: labelKey([]string{"track"}, []string{deploymentTrack()})})
+}
+
+// countTrackRequest is called by instrument for every answered request
+func countTrackRequest(pattern string, status int) {
+	if rateLimitExempt(pattern) || pattern == "/startup" {
+		return
+	}
+	class := statusClass(status)
+	trackRequests.Inc(deploymentTrack(), class)
+	now := time.Now().Unix()
+	trackMu.Lock()
+	defer trackMu.Unlock()
+	trackTotal++
+	trackByStatus[class]++
+	slot := &trackSeconds[now%trackWindow]
+	if slot.unix != now {
+		slot.unix, slot.count = now, 0
+	}
+	slot.count++
+}
+
+// trackHandler serves GET /api/track: what this pod's track has served
+func trackHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	hostname, _ := os.Hostname()
+	resp := TrackResponse{Track: deploymentTrack(), Pod: hostname, Version: buildInfo().Version,
+		ByStatus: map[string]int64{}, Since: startTime.UTC()}
+	if v := getEnv("DEPLOYMENT_WEIGHT", ""); v != "" {
+		if weight, err := strconv.ParseFloat(v, 64); err == nil {
+			resp.ExpectedWeight = &weight
+		}
+	}
+	now := time.Now().Unix()
+	var recent int64
+	trackMu.Lock()
+	resp.Requests = trackTotal
+	for class, n := range trackByStatus {
+		resp.ByStatus[class] = n
+	}
+	for _, slot := range trackSeconds {
+		if now-slot.unix < trackWindow {
+			recent += slot.count
+		}
+	}
+	trackMu.Unlock()
+	resp.RPS = float64(recent) / min(float64(trackWindow), max(time.Since(startTime).Seconds(), 1))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// trackBanner is the homepage banner on the canary, "" on stable
+func trackBanner() string {
+	if deploymentTrack() != "canary" {
+		return ""
+	}
+	return "🐤 Canary - this answer came from the canary track"
+}
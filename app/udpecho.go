@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// A UDP echo server, the datagram twin of the TCP one. UDP_PORT turns it
+// on; every packet is answered with the pod's name and packet counts:
+//
+//	kubectl set env deploy/go-app -n go-demo UDP_PORT=7001
+//	kubectl run -n go-demo udp-client --rm -it --image=busybox -- nc -u go-app-udp 7001
+//
+// UDP has no connections, but conntrack pretends it does: packets from
+// one client port keep going to the pod the first one reached until the
+// entry idles out, even if that pod is gone or unready. That stale entry
+// is the classic "my UDP Service still sends to a dead pod" (DNS clients
+// hit it too); a new source port gets a fresh pick.
+
+// maxUDPPacket is the largest datagram read; bigger ones are truncated
+const maxUDPPacket = 64 << 10
+
+// maxUDPSources bounds the per-client counters
+const maxUDPSources = 1000
+
+var (
+	udpPackets = newCounterVec("udp_echo_packets_total",
+		"Packets answered by the UDP echo server.")
+)
+
+// udpEchoServer answers datagrams until Close
+type udpEchoServer struct {
+	conn  net.PacketConn
+	total atomic.Int64
+	done  sync.WaitGroup
+
+	mu      sync.Mutex
+	sources map[string]int64 // packets per client address
+}
+
+// serveUDPEcho listens on addr and echoes packets until Close
+func serveUDPEcho(addr string) *udpEchoServer {
+	conn, err := listenPacket("udp", addr)
+	if err != nil {
+		fatal("UDP echo server failed to start", "addr", addr, "error", err)
+	}
+	s := &udpEchoServer{conn: conn, sources: map[string]int64{}}
+	hostname, _ := os.Hostname()
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		buf := make([]byte, maxUDPPacket)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				slog.Warn("UDP echo read failed", "error", err)
+				continue
+			}
+			total := s.total.Add(1)
+			fromYou := s.count(from.String())
+			udpPackets.Inc()
+			reply := fmt.Appendf(nil, "%s: packet %d (%d from %s): %s", hostname, total, fromYou, from, buf[:n])
+			if _, err := conn.WriteTo(reply, from); err != nil {
+				slog.Debug("UDP echo reply failed", "to", from.String(), "error", err)
+			}
+		}
+	}()
+	return s
+}
+
+// count bumps and returns the packets seen from one client address
+func (s *udpEchoServer) count(from string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sources[from]; !ok && len(s.sources) >= maxUDPSources {
+		clear(s.sources) // crude, but keeps a port scan from growing the map
+	}
+	s.sources[from]++
+	return s.sources[from]
+}
+
+// Close stops the server; there are no connections to say goodbye to
+func (s *udpEchoServer) Close() {
+	s.conn.Close()
+	s.done.Wait()
+	slog.Info("UDP echo server stopped", "packets", s.total.Load())
+}
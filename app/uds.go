@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// The API on a Unix domain socket too, for a sidecar that shares a volume
+// with the app instead of calling it over the pod network:
+//
+//	UDS_PATH=/var/run/app/app.sock
+//	kubectl exec deploy/go-app-sidecar -c log-shipper -- \
+//	  ./app healthcheck -unix /var/run/app/app.sock http://localhost/api/echo
+//	curl -s --unix-socket /var/run/app/app.sock localhost/api/echo | jq .client
+//
+// The socket serves the main port's routes and middleware, without TLS
+// or MAX_CONNS: only containers mounting the volume can reach it, and the
+// file is mode 0660, so fsGroup decides which of them may connect. There
+// is no client IP (remote_addr is "@"), but the kernel knows the peer:
+// /api/echo reports the connecting process's pid, uid and gid.
+//
+// A socket file left by a crashed container is replaced; one a running
+// process still answers on is an error. Under HOT_RELOAD the successor
+// binds a fresh socket at the path while the old generation drains on the
+// one it has; the socket isn't handed over like the main port's.
+
+// udsMode lets the app's user and fsGroup connect
+const udsMode = 0o660
+
+// udsPeerKey holds a connection's UnixPeer in its context
+type udsPeerKey struct{}
+
+// UnixPeer is the process at the other end of a Unix socket connection,
+// from SO_PEERCRED
+type UnixPeer struct {
+	PID int32  `json:"pid"`
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+// listenUnix opens a socket at path, replacing a stale one
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o775); err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil && !hotReload() {
+			conn.Close()
+			return nil, fmt.Errorf("%s: another process is listening", path)
+		}
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// a successor has bound its own socket at the path by the time this
+	// generation closes, so leave the file to it
+	ln.(*net.UnixListener).SetUnlinkOnClose(!hotReload())
+	if err := os.Chmod(path, udsMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// serveUnix serves handler on a socket at path, with cfg's timeouts
+func serveUnix(path string, handler http.Handler, cfg serverConfig) *http.Server {
+	ln, err := listenUnix(path)
+	if err != nil {
+		fatal("Unix socket server failed to start", "path", path, "error", err)
+	}
+	srv := &http.Server{Handler: handler, ConnContext: unixPeerContext}
+	cfg.apply(srv)
+	srv.ConnState = nil // the connection table is the app port's
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Unix socket server failed", "path", path, "error", err)
+		}
+	}()
+	return srv
+}
+
+// unixPeerContext records who connected, for /api/echo
+func unixPeerContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, udsPeerKey{}, &UnixPeer{PID: cred.Pid, UID: cred.Uid, GID: cred.Gid})
+}
+
+// unixPeer is r's UnixPeer, nil for a TCP connection
+func unixPeer(r *http.Request) *UnixPeer {
+	peer, _ := r.Context().Value(udsPeerKey{}).(*UnixPeer)
+	return peer
+}
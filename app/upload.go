@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// POST /api/upload streams multipart file uploads into DATA_DIR. Each part
+// goes straight from the connection to disk, hashed on the way, so a 1GiB
+// upload costs a 32KiB buffer rather than 1GiB of memory or of /tmp the way
+// ParseMultipartForm would:
+//
+//	curl -F file=@big.iso localhost:30080/api/upload
+//	curl -F a=@one.txt -F b=@two.txt localhost:30080/api/upload
+//	curl --data-binary @big.iso 'localhost:30080/api/upload?name=big.iso'   # no multipart
+//
+// A request body over UPLOAD_MAX_BYTES (100MiB) is cut off with a 413.
+// ingress-nginx has its own limit in front (1m unless the
+// nginx.ingress.kubernetes.io/proxy-body-size annotation raises it) and
+// buffers the whole body before the pod sees a byte unless
+// proxy-request-buffering is "off"; with it off, upload_bytes_received_total
+// climbs while the upload is still in flight. The files land wherever
+// DATA_DIR is, so with an emptyDir they go with the pod and with a PVC
+// they stay (files.go).
+
+// uploadMaxBytes bounds a whole upload request; UPLOAD_MAX_BYTES, set in serve
+var uploadMaxBytes int64 = 100 << 20
+
+var (
+	uploadRequests = newCounterVec("upload_requests_total", "Upload requests, by result (ok, too_large, invalid, error).", "result")
+	uploadBytes    = newCounterVec("upload_bytes_received_total", "File bytes written by /api/upload, counted as they arrive.")
+	uploadsActive  = newGaugeVec("uploads_in_progress", "Uploads being received now.")
+)
+
+func init() { uploadsActive.Set(0) }
+
+// UploadedFile is one stored file with its checksum
+type UploadedFile struct {
+	Name   string `json:"name"`
+	Field  string `json:"field,omitempty"` // the multipart form field
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// UploadResponse is returned by POST /api/upload
+type UploadResponse struct {
+	Dir            string         `json:"dir"`
+	Mounted        bool           `json:"mounted"`
+	Files          []UploadedFile `json:"files"`
+	DurationMS     float64        `json:"duration_ms"`
+	BytesPerSecond float64        `json:"bytes_per_second"`
+	Disk           *DiskUsage     `json:"disk,omitempty"`
+}
+
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	uploadsActive.Add(1)
+	defer uploadsActive.Add(-1)
+	start := time.Now()
+	dir := dataDir()
+	r.Body = http.MaxBytesReader(w, r.Body, uploadMaxBytes)
+
+	var files []UploadedFile
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		files, err = storeMultipartUpload(dir, r)
+	} else {
+		var file UploadedFile
+		file, err = storeUpload(dir, r.URL.Query().Get("name"), "", r.Body)
+		files = []UploadedFile{file}
+	}
+
+	var tooLarge *http.MaxBytesError
+	var invalid uploadError
+	switch {
+	case errors.As(err, &tooLarge):
+		uploadRequests.Inc("too_large")
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, "upload larger than UPLOAD_MAX_BYTES ("+strconv.FormatInt(uploadMaxBytes, 10)+" bytes)")
+		return
+	case errors.As(err, &invalid):
+		uploadRequests.Inc("invalid")
+		writeProblem(w, r, http.StatusBadRequest, invalid.Error())
+		return
+	case err != nil:
+		uploadRequests.Inc("error")
+		slog.Error("upload failed", "dir", dir, "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "upload failed: "+err.Error())
+		return
+	}
+	uploadRequests.Inc("ok")
+
+	elapsed := time.Since(start)
+	var total int64
+	for _, f := range files {
+		total += f.Size
+		slog.Info("file uploaded", "file", f.Name, "size", f.Size, "sha256", f.SHA256, "dir", dir)
+	}
+	stored, _ := listStoredFiles(dir)
+	listing := filesResponse(dir, stored)
+	writeJSON(w, http.StatusCreated, UploadResponse{
+		Dir:            dir,
+		Mounted:        listing.Mounted,
+		Files:          files,
+		DurationMS:     float64(elapsed.Microseconds()) / 1000,
+		BytesPerSecond: float64(total) / max(elapsed.Seconds(), 1e-6),
+		Disk:           listing.Disk,
+	})
+}
+
+// uploadError is the client's fault, a 400
+type uploadError string
+
+func (e uploadError) Error() string { return string(e) }
+
+// storeMultipartUpload stores every file part in the order they arrive,
+// reading the body once; form fields without a file name are skipped
+func storeMultipartUpload(dir string, r *http.Request) ([]UploadedFile, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, uploadError("bad multipart body: " + err.Error())
+	}
+	files := []UploadedFile{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, err
+			}
+			return nil, uploadError("bad multipart body: " + err.Error())
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		file, err := storeUpload(dir, filepath.Base(part.FileName()), part.FormName(), part)
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return nil, uploadError("no file parts in the upload; send one with curl -F file=@name")
+	}
+	return files, nil
+}
+
+// storeUpload writes body to name in dir, counting and hashing it as it
+// streams through
+func storeUpload(dir, name, field string, body io.Reader) (UploadedFile, error) {
+	if name == "" {
+		return UploadedFile{}, uploadError("a body that isn't multipart needs ?name= for the file")
+	}
+	if !validFileName.MatchString(name) {
+		return UploadedFile{}, uploadError("file name " + strconv.Quote(name) + " must be one path segment of letters, digits, '.', '_' or '-'")
+	}
+	sum := sha256.New()
+	stored, err := writeStoredFile(dir, name, io.TeeReader(&uploadProgress{r: body}, sum))
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	return UploadedFile{Name: stored.Name, Field: field, Size: stored.Size, SHA256: hex.EncodeToString(sum.Sum(nil))}, nil
+}
+
+// uploadProgress counts bytes into upload_bytes_received_total as they are
+// read, not when the file is done
+type uploadProgress struct{ r io.Reader }
+
+func (p *uploadProgress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		uploadBytes.Add(float64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A self-hosted status page: the app probes a list of upstreams in the
+// background and keeps a rolling success rate for each, the way a load
+// balancer's active health checks do:
+//
+//	UPSTREAMS=api=http://go-app-service/health,redis=redis:6379,postgres:5432
+//	UPSTREAM_INTERVAL=10s            between probes of each upstream
+//	UPSTREAM_WINDOW=30               probes the success rate covers
+//	UPSTREAM_FAILURE_THRESHOLD=3     consecutive failures before it's down
+//	UPSTREAM_READY=true              not ready while one is down
+//	open http://localhost:30080/status/upstreams
+//	curl -s localhost:30080/status/upstreams | jq '.upstreams[] | {name, state, success_rate}'
+//
+// Entries are [name=]target: an http(s) URL gets a GET that must answer
+// below 400, anything else is a host:port (tcp:// optional) that must
+// accept a connection. The first probe decides the initial state; after
+// that one failure doesn't take an upstream down, a run of
+// UPSTREAM_FAILURE_THRESHOLD does, and one success brings it back. Unlike
+// READY_CHECK_HTTP and READY_CHECK_TCP, which dial on every readiness
+// probe, the readiness check here reads the prober's state, so a flapping
+// dependency doesn't flap the pod.
+
+// upstream is one UPSTREAMS entry and its recent probes
+type upstream struct {
+	name, target, kind string
+	check              ReadinessChecker
+
+	recent              []bool // oldest first, at most window long
+	consecutiveFailures int
+	state               string // unknown, up or down
+	lastLatency         time.Duration
+	lastError           string
+	lastProbe           time.Time
+	lastChange          time.Time
+}
+
+// upstreamProber probes every upstream on its own ticker
+type upstreamProber struct {
+	interval, timeout time.Duration
+	window, threshold int
+
+	mu        sync.Mutex
+	upstreams []*upstream
+}
+
+var (
+	upstreamUp = newGaugeVec("upstream_up",
+		"1 while an UPSTREAMS target is up, 0 while down.", "upstream")
+	upstreamSuccessRatio = newGaugeVec("upstream_success_ratio",
+		"Share of an upstream's last UPSTREAM_WINDOW probes that passed.", "upstream")
+	upstreamProbes = newCounterVec("upstream_probes_total",
+		"Active health check probes by upstream and result (ok, failed).", "upstream", "result")
+)
+
+// parseUpstreams reads UPSTREAMS entries
+func parseUpstreams(spec string) ([]*upstream, error) {
+	var ups []*upstream
+	seen := map[string]bool{}
+	for _, item := range splitList(spec) {
+		name, target, named := strings.Cut(item, "=")
+		if !named {
+			name, target = item, item
+		}
+		u := &upstream{name: name, target: target, state: "unknown"}
+		switch {
+		case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+			u.kind, u.check = "http", httpCheck{url: target}
+		default:
+			addr := strings.TrimPrefix(target, "tcp://")
+			if host, port, err := net.SplitHostPort(addr); err != nil || host == "" || port == "" {
+				return nil, fmt.Errorf("%q: want an http(s) URL or host:port", item)
+			}
+			u.kind, u.check = "tcp", tcpCheck{addr: addr}
+		}
+		if name == "" || seen[name] {
+			return nil, fmt.Errorf("%q: names must be set and unique", item)
+		}
+		seen[name] = true
+		ups = append(ups, u)
+	}
+	return ups, nil
+}
+
+// newUpstreamProberFromEnv reads the UPSTREAM_* settings
+func newUpstreamProberFromEnv() (*upstreamProber, error) {
+	ups, err := parseUpstreams(getEnv("UPSTREAMS", ""))
+	if err != nil {
+		return nil, err
+	}
+	return &upstreamProber{
+		interval:  getEnvDuration("UPSTREAM_INTERVAL", 10*time.Second),
+		timeout:   getEnvDuration("UPSTREAM_TIMEOUT", checkTimeout),
+		window:    int(max(getEnvInt("UPSTREAM_WINDOW", 30), 1)),
+		threshold: int(max(getEnvInt("UPSTREAM_FAILURE_THRESHOLD", 3), 1)),
+		upstreams: ups,
+	}, nil
+}
+
+// Run probes each upstream now and then every interval, until ctx ends
+func (p *upstreamProber) Run(ctx context.Context) {
+	for _, u := range p.upstreams {
+		go func() {
+			ticker := time.NewTicker(p.interval)
+			defer ticker.Stop()
+			for {
+				p.probe(ctx, u)
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// probe checks u once and records the result
+func (p *upstreamProber) probe(ctx context.Context, u *upstream) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	start := time.Now()
+	err := u.check.Check(ctx)
+	latency := time.Since(start)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u.recent = append(u.recent, err == nil)
+	if len(u.recent) > p.window {
+		u.recent = u.recent[len(u.recent)-p.window:]
+	}
+	u.lastProbe, u.lastLatency, u.lastError = start, latency, ""
+	previous := u.state
+	if err != nil {
+		u.lastError = err.Error()
+		u.consecutiveFailures++
+		upstreamProbes.Inc(u.name, "failed")
+		if u.consecutiveFailures >= p.threshold || previous == "unknown" {
+			u.state = "down"
+		}
+	} else {
+		u.consecutiveFailures = 0
+		u.state = "up"
+		upstreamProbes.Inc(u.name, "ok")
+	}
+	upstreamSuccessRatio.Set(successRate(u.recent), u.name)
+	if u.state == previous {
+		return
+	}
+	u.lastChange = start
+	switch u.state {
+	case "up":
+		upstreamUp.Set(1, u.name)
+		if previous == "down" {
+			slog.Info("upstream is up again", "upstream", u.name, "target", u.target)
+			podEvents.Record("Normal", "UpstreamUp", u.name+" ("+u.target+") is answering again")
+		}
+	case "down":
+		upstreamUp.Set(0, u.name)
+		slog.Warn("upstream is down", "upstream", u.name, "target", u.target,
+			"consecutive_failures", u.consecutiveFailures, "error", u.lastError)
+		podEvents.Record("Warning", "UpstreamDown", fmt.Sprintf("%s (%s) failed %d probes in a row: %s",
+			u.name, u.target, u.consecutiveFailures, u.lastError))
+	}
+}
+
+// successRate is the share of true in results, 0 when there are none
+func successRate(results []bool) float64 {
+	if len(results) == 0 {
+		return 0
+	}
+	ok := 0
+	for _, r := range results {
+		if r {
+			ok++
+		}
+	}
+	return float64(ok) / float64(len(results))
+}
+
+// UpstreamStatus is one upstream in /status/upstreams
+type UpstreamStatus struct {
+	Name                string     `json:"name"`
+	Target              string     `json:"target"`
+	Kind                string     `json:"kind"`  // http or tcp
+	State               string     `json:"state"` // unknown until the first probe, then up or down
+	SuccessRate         float64    `json:"success_rate"`
+	Probes              int        `json:"probes"` // in the window
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Recent              []bool     `json:"recent"` // oldest first
+	LastLatencyMS       float64    `json:"last_latency_ms"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastProbe           *time.Time `json:"last_probe,omitempty"`
+	LastChange          *time.Time `json:"last_change,omitempty"`
+}
+
+// Percent is SuccessRate for the page
+func (s UpstreamStatus) Percent() string {
+	if s.Probes == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", s.SuccessRate*100)
+}
+
+// UpstreamsResponse is returned by /status/upstreams
+type UpstreamsResponse struct {
+	Pod         string           `json:"pod"`
+	Interval    string           `json:"interval"`
+	Window      int              `json:"window"`
+	Threshold   int              `json:"failure_threshold"`
+	Upstreams   []UpstreamStatus `json:"upstreams"`
+	GeneratedAt time.Time        `json:"generated_at"`
+}
+
+// Status snapshots every upstream
+func (p *upstreamProber) Status() UpstreamsResponse {
+	hostname, _ := os.Hostname()
+	resp := UpstreamsResponse{Pod: hostname, Interval: p.interval.String(), Window: p.window, Threshold: p.threshold,
+		Upstreams: []UpstreamStatus{}, GeneratedAt: time.Now().UTC()}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, u := range p.upstreams {
+		s := UpstreamStatus{
+			Name: u.name, Target: u.target, Kind: u.kind, State: u.state,
+			SuccessRate:         successRate(u.recent),
+			Probes:              len(u.recent),
+			ConsecutiveFailures: u.consecutiveFailures,
+			Recent:              append([]bool{}, u.recent...),
+			LastLatencyMS:       float64(u.lastLatency.Microseconds()) / 1000,
+			LastError:           u.lastError,
+		}
+		if !u.lastProbe.IsZero() {
+			s.LastProbe = &u.lastProbe
+		}
+		if !u.lastChange.IsZero() {
+			s.LastChange = &u.lastChange
+		}
+		resp.Upstreams = append(resp.Upstreams, s)
+	}
+	return resp
+}
+
+// UpstreamsPage is the data for templates/upstreams.html
+type UpstreamsPage struct {
+	AppName    string
+	ThemeStyle template.CSS
+	UpstreamsResponse
+}
+
+// upstreamsHandler serves /status/upstreams: a page for browsers, JSON
+// (or ?format=) for everything else
+func upstreamsHandler(p *upstreamProber, pages *template.Template, appName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+		status := p.Status()
+		if strings.HasPrefix(r.Header.Get("Accept"), "text/html") && r.URL.Query().Get("format") == "" {
+			renderPage(w, r, pages, "upstreams.html", UpstreamsPage{AppName: appName, ThemeStyle: themeStyle(), UpstreamsResponse: status})
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// upstreamsCheck fails readiness while an upstream is down or not probed yet
+type upstreamsCheck struct{ prober *upstreamProber }
+
+func (c upstreamsCheck) Name() string { return "upstreams" }
+
+func (c upstreamsCheck) Check(ctx context.Context) error {
+	var problems []string
+	for _, u := range c.prober.Status().Upstreams {
+		switch u.State {
+		case "down":
+			problems = append(problems, u.Name+" is down: "+u.LastError)
+		case "unknown":
+			problems = append(problems, u.Name+" not probed yet")
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
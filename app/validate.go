@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Request bodies are checked against rules in their struct tags, and every
+// broken rule comes back at once, by field, in a 422:
+//
+//	type body struct {
+//		Name string `json:"name" validate:"required,max=100"`
+//	}
+//
+//	curl -s -X POST localhost:30080/api/guestbook -d '{"name":" ","message":""}'
+//	{"type":"about:blank","title":"Unprocessable Entity","status":422,
+//	 "detail":"the body has 2 invalid fields", ...,
+//	 "errors":[{"field":"name","message":"is required"},
+//	           {"field":"message","message":"is required"}]}
+//
+// A field of the wrong JSON type, or one the endpoint doesn't know, is a
+// 422 for that field, and a body that isn't JSON at all a 400, rather than
+// a silently empty struct. The rules:
+//
+//	required         not empty; strings are trimmed first
+//	min=N, max=N     a string's length in characters, or a number's value
+//	oneof=a b c      one of the listed values
+//	duration=MAX     a Go duration, above zero and at most MAX
+//	subject          a broker subject, dot-separated tokens
+//
+// Strings are trimmed in place, so the handler stores what was checked.
+
+// FieldError is one broken rule, named by the field's JSON name
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError lists every FieldError in a body
+type validationError []FieldError
+
+func (e validationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Field + " " + f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// validationRules check one value against a rule's argument, returning
+// what's wrong or ""
+var validationRules = map[string]func(v reflect.Value, arg string) string{
+	"required": func(v reflect.Value, _ string) string {
+		if v.IsZero() {
+			return "is required"
+		}
+		return ""
+	},
+	"min": func(v reflect.Value, arg string) string {
+		n, _ := strconv.ParseFloat(arg, 64)
+		if v.Kind() == reflect.String {
+			if utf8.RuneCountInString(v.String()) < int(n) {
+				return "must be at least " + arg + " characters"
+			}
+		} else if numeric(v) < n {
+			return "must be at least " + arg
+		}
+		return ""
+	},
+	"max": func(v reflect.Value, arg string) string {
+		n, _ := strconv.ParseFloat(arg, 64)
+		if v.Kind() == reflect.String {
+			if utf8.RuneCountInString(v.String()) > int(n) {
+				return "must be at most " + arg + " characters"
+			}
+		} else if numeric(v) > n {
+			return "must be at most " + arg
+		}
+		return ""
+	},
+	"oneof": func(v reflect.Value, arg string) string {
+		if !slices.Contains(strings.Fields(arg), fmt.Sprint(v.Interface())) {
+			return "must be one of " + strings.Join(strings.Fields(arg), ", ")
+		}
+		return ""
+	},
+	"duration": func(v reflect.Value, arg string) string {
+		limit, _ := time.ParseDuration(arg)
+		d, err := time.ParseDuration(v.String())
+		if err != nil || d <= 0 || (limit > 0 && d > limit) {
+			return "must be a Go duration up to " + arg + ", like 5s"
+		}
+		return ""
+	},
+	"subject": func(v reflect.Value, _ string) string {
+		if !validSubject(v.String()) {
+			return "must be dot-separated tokens without spaces or wildcards"
+		}
+		return ""
+	},
+}
+
+// numeric is an int, uint or float field's value
+func numeric(v reflect.Value) float64 {
+	switch {
+	case v.CanInt():
+		return float64(v.Int())
+	case v.CanUint():
+		return float64(v.Uint())
+	case v.CanFloat():
+		return v.Float()
+	}
+	return 0
+}
+
+// validate trims dst's string fields and checks their validate tags. dst
+// is a pointer to a struct.
+func validate(dst any) error {
+	var errs validationError
+	v := reflect.ValueOf(dst).Elem()
+	for i := range v.NumField() {
+		field, value := v.Type().Field(i), v.Field(i)
+		tag := field.Tag.Get("validate")
+		if tag == "" || !field.IsExported() {
+			continue
+		}
+		if value.Kind() == reflect.String {
+			value.SetString(strings.TrimSpace(value.String()))
+		}
+		name := jsonFieldName(field)
+		for _, rule := range strings.Split(tag, ",") {
+			rule, arg, _ := strings.Cut(rule, "=")
+			if rule != "required" && value.IsZero() {
+				continue // an omitted optional field has nothing to check
+			}
+			check, ok := validationRules[rule]
+			if !ok {
+				panic("validate: unknown rule " + rule + " on " + v.Type().Name() + "." + field.Name)
+			}
+			if msg := check(value, arg); msg != "" {
+				errs = append(errs, FieldError{Field: name, Message: msg})
+				break // one message per field
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// jsonFieldName is the name a field has in the body
+func jsonFieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return f.Name
+	}
+	return name
+}
+
+// decodeJSON reads dst from the body, as decodeBody does, and validates it
+func decodeJSON(w http.ResponseWriter, r *http.Request, limit int64, dst any) error {
+	if err := decodeBody(w, r, limit, dst); err != nil {
+		return err
+	}
+	return validate(dst)
+}
+
+// decodeBody reads one JSON object of at most limit bytes into dst; an
+// empty body leaves dst as it was. Errors name the field when there is one.
+func decodeBody(w http.ResponseWriter, r *http.Request, limit int64, dst any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case errors.As(err, &typeErr) && typeErr.Field != "":
+			return validationError{{Field: typeErr.Field, Message: "must be " + jsonTypeName(typeErr.Type)}}
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+			return validationError{{Field: field, Message: "is not a known field"}}
+		}
+		return err
+	}
+	if dec.More() {
+		return errors.New("more than one JSON value")
+	}
+	return nil
+}
+
+// jsonTypeName says what JSON a Go type wants
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+// writeBodyProblem answers a decodeJSON or validate error: 422 with
+// per-field errors, else 400 with what went wrong
+func writeBodyProblem(w http.ResponseWriter, r *http.Request, err error) {
+	var fields validationError
+	var tooBig *http.MaxBytesError
+	switch {
+	case errors.As(err, &fields):
+		detail := "the body has " + strconv.Itoa(len(fields)) + " invalid fields"
+		if len(fields) == 1 {
+			detail = "the body has an invalid field: " + fields.Error()
+		}
+		sendProblem(w, r, Problem{
+			Status:     http.StatusUnprocessableEntity,
+			Detail:     detail,
+			Extensions: map[string]any{"errors": []FieldError(fields)},
+		})
+	case errors.As(err, &tooBig):
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, "body is over "+strconv.FormatInt(tooBig.Limit, 10)+" bytes")
+	default:
+		writeProblem(w, r, http.StatusBadRequest, "body is not valid JSON: "+err.Error())
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dynamic database credentials from HashiCorp Vault. Instead of one
+// password in a Kubernetes Secret, shared by every pod and only changed
+// when someone remembers to, each pod asks Vault's database engine for a
+// username and password of its own, which expire unless renewed:
+//
+//	VAULT_ADDR=http://vault:8200 VAULT_AUTH=kubernetes VAULT_ROLE=go-app
+//	VAULT_DB_CREDS_PATH=database/creds/go-app             # Postgres
+//	VAULT_REDIS_CREDS_PATH=database/creds/go-app-redis    # Redis ACL user
+//	curl localhost:30080/api/secrets/lease
+//
+// With VAULT_AUTH=kubernetes the pod logs in with its service account
+// token (VAULT_ROLE names the Vault role bound to it, VAULT_K8S_MOUNT the
+// auth mount); VAULT_AUTH=token takes VAULT_TOKEN, from a mounted Secret
+// file or the env. Every lease is renewed when two thirds of it have
+// passed; once Vault stops extending it (max_ttl) or a renewal fails, the
+// pod fetches new credentials and the next connection uses them - the
+// clients dial per operation, so nothing holds on to the old ones. The
+// leases are revoked on shutdown, so a stopped pod's users are dropped
+// from the database at once rather than at their expiry.
+//
+// Without VAULT_ADDR credentials come from static Secrets as before
+// (PGPASSWORD, REDIS_PASSWORD): the same for every pod until rotated by
+// hand. The External Secrets Operator or the Vault Agent injector sit in
+// between, syncing Vault into a Secret or a file in SECRETS_DIR; the app
+// then sees a static Secret whose file happens to change.
+
+// credentialSource hands out the username and password for the next
+// connection
+type credentialSource interface {
+	credentials() (username, password string)
+}
+
+// secretCredentials reads static credentials from Secrets on every
+// connection, so a rotated Secret file is picked up
+type secretCredentials struct {
+	userKey, passwordKey string
+}
+
+func (s secretCredentials) credentials() (string, string) {
+	user, _ := readSecret(s.userKey)
+	password, _ := readSecret(s.passwordKey)
+	return user, password
+}
+
+// vaultClient holds the Vault token and the leases taken with it
+type vaultClient struct {
+	addr      *url.URL
+	auth      string // token or kubernetes
+	role      string
+	mount     string
+	jwtPath   string
+	namespace string
+	client    *http.Client
+
+	mu             sync.Mutex
+	token          string
+	tokenRenewable bool
+	tokenIssued    time.Time // or last renewed
+	tokenExpires   time.Time // zero for a token that doesn't expire
+	tokenRenewals  int64
+	leases         []*vaultLease
+}
+
+// vaultLease is one set of dynamic credentials
+type vaultLease struct {
+	name string // postgres or redis
+	path string
+
+	mu          sync.Mutex
+	id          string
+	username    string
+	password    string
+	duration    time.Duration // as first issued
+	renewable   bool
+	issued      time.Time
+	expires     time.Time
+	lastRenewed time.Time
+	retryAt     time.Time // after a failed fetch
+	renewals    int64
+	rotations   int64
+	lastErr     string
+}
+
+// LeaseStatus is one lease in /api/secrets/lease; never the password
+type LeaseStatus struct {
+	Name        string     `json:"name"`
+	Path        string     `json:"path"`
+	LeaseID     string     `json:"lease_id"`
+	Username    string     `json:"username"`
+	Renewable   bool       `json:"renewable"`
+	Duration    string     `json:"lease_duration"`
+	IssuedAt    time.Time  `json:"issued_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	TTLSeconds  float64    `json:"ttl_seconds"`
+	Renewals    int64      `json:"renewals"`  // of the current lease
+	Rotations   int64      `json:"rotations"` // new credentials since start
+	LastRenewed *time.Time `json:"last_renewed,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// VaultTokenStatus is the app's own Vault token
+type VaultTokenStatus struct {
+	Renewable  bool       `json:"renewable"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds float64    `json:"ttl_seconds,omitempty"`
+	Renewals   int64      `json:"renewals"`
+}
+
+// LeasesResponse is returned by /api/secrets/lease
+type LeasesResponse struct {
+	Enabled bool              `json:"enabled"`
+	Addr    string            `json:"addr,omitempty"`
+	Auth    string            `json:"auth,omitempty"`
+	Role    string            `json:"role,omitempty"`
+	Token   *VaultTokenStatus `json:"token,omitempty"`
+	Leases  []LeaseStatus     `json:"leases"`
+	Static  []string          `json:"static"` // credentials still coming from Secrets
+}
+
+var (
+	// vault is set in main when VAULT_ADDR is
+	vault *vaultClient
+
+	// redisCredentials authenticates every Redis connection; set in main
+	redisCredentials credentialSource = secretCredentials{"REDIS_USERNAME", "REDIS_PASSWORD"}
+
+	vaultRequests = newCounterVec("vault_requests_total",
+		"Requests to Vault, by operation (login, renew_token, read, renew, revoke) and result (ok, error).", "op", "result")
+	vaultLeaseExpiry = newGaugeVec("vault_lease_expiry_timestamp_seconds",
+		"When each dynamic credential's lease expires, as a Unix time.", "secret")
+	vaultRotations = newCounterVec("vault_credential_rotations_total",
+		"New dynamic credentials fetched after the first, by secret.", "secret")
+)
+
+// newVaultClientFromEnv returns nil when VAULT_ADDR is unset
+func newVaultClientFromEnv() (*vaultClient, error) {
+	raw := getEnv("VAULT_ADDR", "")
+	if raw == "" {
+		return nil, nil
+	}
+	addr, err := url.Parse(raw)
+	if err != nil || (addr.Scheme != "http" && addr.Scheme != "https") || addr.Host == "" {
+		return nil, fmt.Errorf("VAULT_ADDR %q is not an http(s) URL", raw)
+	}
+	v := &vaultClient{
+		addr:      addr,
+		role:      getEnv("VAULT_ROLE", ""),
+		mount:     strings.Trim(getEnv("VAULT_K8S_MOUNT", "kubernetes"), "/"),
+		jwtPath:   getEnv("SERVICE_ACCOUNT_TOKEN", filepath.Join(serviceAccountDir, "token")),
+		namespace: getEnv("VAULT_NAMESPACE", ""),
+		client:    &http.Client{Transport: tracingTransport{base: http.DefaultTransport}, Timeout: 10 * time.Second},
+	}
+	token, haveToken := readSecret("VAULT_TOKEN")
+	v.auth = getEnv("VAULT_AUTH", "kubernetes")
+	if haveToken && getEnv("VAULT_AUTH", "") == "" {
+		v.auth = "token"
+	}
+	switch v.auth {
+	case "token":
+		if token == "" {
+			return nil, errors.New("VAULT_AUTH=token needs VAULT_TOKEN, as a Secret file or env var")
+		}
+		v.token = token
+	case "kubernetes":
+		if v.role == "" {
+			return nil, errors.New("VAULT_AUTH=kubernetes needs the Vault role in VAULT_ROLE")
+		}
+	default:
+		return nil, fmt.Errorf("VAULT_AUTH %q must be token or kubernetes", v.auth)
+	}
+	return v, nil
+}
+
+// login gets a token with the service account's JWT, or checks the one
+// given in VAULT_TOKEN
+func (v *vaultClient) login(ctx context.Context) error {
+	if v.auth == "token" {
+		var res struct {
+			Data struct {
+				TTL       int64 `json:"ttl"`
+				Renewable bool  `json:"renewable"`
+			} `json:"data"`
+		}
+		if err := v.do(ctx, "login", http.MethodGet, "/v1/auth/token/lookup-self", nil, &res); err != nil {
+			return err
+		}
+		v.mu.Lock()
+		v.tokenRenewable, v.tokenIssued, v.tokenExpires = res.Data.Renewable, time.Now(), expiresIn(res.Data.TTL)
+		v.mu.Unlock()
+		return nil
+	}
+	jwt, err := os.ReadFile(v.jwtPath)
+	if err != nil {
+		return fmt.Errorf("service account token: %w", err)
+	}
+	var res vaultAuthResponse
+	body := map[string]string{"role": v.role, "jwt": strings.TrimSpace(string(jwt))}
+	if err := v.do(ctx, "login", http.MethodPost, "/v1/auth/"+v.mount+"/login", body, &res); err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.token, v.tokenRenewable = res.Auth.ClientToken, res.Auth.Renewable
+	v.tokenIssued, v.tokenExpires, v.tokenRenewals = time.Now(), expiresIn(res.Auth.LeaseDuration), 0
+	v.mu.Unlock()
+	slog.Info("logged in to vault", "addr", v.addr.Host, "auth", v.auth, "role", v.role,
+		"ttl", (time.Duration(res.Auth.LeaseDuration) * time.Second).String())
+	return nil
+}
+
+type vaultAuthResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+// expiresIn is when a TTL of seconds runs out, zero for none
+func expiresIn(seconds int64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second)
+}
+
+// lease fetches the first credentials at path, to be kept fresh by run
+func (v *vaultClient) lease(ctx context.Context, name, path string) (*vaultLease, error) {
+	l := &vaultLease{name: name, path: strings.Trim(path, "/")}
+	if err := v.fetch(ctx, l); err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	v.leases = append(v.leases, l)
+	v.mu.Unlock()
+	return l, nil
+}
+
+// find returns the lease called name, nil when there is none (or no Vault)
+func (v *vaultClient) find(name string) *vaultLease {
+	if v == nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, l := range v.leases {
+		if l.name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// fetch reads new credentials into l
+func (v *vaultClient) fetch(ctx context.Context, l *vaultLease) error {
+	var res struct {
+		LeaseID       string `json:"lease_id"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+		Data          struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"data"`
+	}
+	if err := v.do(ctx, "read", http.MethodGet, "/v1/"+l.path, nil, &res); err != nil {
+		l.setError(err)
+		return fmt.Errorf("vault %s: %w", l.path, err)
+	}
+	if res.Data.Password == "" {
+		err := errors.New("no password in the response; is this a database/creds path?")
+		l.setError(err)
+		return fmt.Errorf("vault %s: %w", l.path, err)
+	}
+	now := time.Now()
+	l.mu.Lock()
+	first := l.id == ""
+	l.id, l.username, l.password = res.LeaseID, res.Data.Username, res.Data.Password
+	l.duration, l.renewable = time.Duration(res.LeaseDuration)*time.Second, res.Renewable
+	l.issued, l.expires, l.lastRenewed = now, now.Add(l.duration), time.Time{}
+	l.renewals, l.lastErr, l.retryAt = 0, "", time.Time{}
+	if !first {
+		l.rotations++
+	}
+	l.mu.Unlock()
+	if !first {
+		vaultRotations.Inc(l.name)
+	}
+	vaultLeaseExpiry.Set(float64(l.expires.Unix()), l.name)
+	slog.Info("vault credentials issued", "secret", l.name, "path", l.path, "username", res.Data.Username,
+		"lease_duration", l.duration.String(), "renewable", res.Renewable)
+	return nil
+}
+
+// run keeps the token and every lease alive until ctx is done
+func (v *vaultClient) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		v.refreshToken(ctx)
+		v.mu.Lock()
+		leases := v.leases
+		v.mu.Unlock()
+		for _, l := range leases {
+			if l.due() {
+				v.refreshLease(ctx, l)
+			}
+		}
+	}
+}
+
+// refreshToken renews the token two thirds of the way through its TTL,
+// logging in again when it can't be renewed
+func (v *vaultClient) refreshToken(ctx context.Context) {
+	v.mu.Lock()
+	issued, expires, renewable := v.tokenIssued, v.tokenExpires, v.tokenRenewable
+	v.mu.Unlock()
+	if expires.IsZero() || time.Now().Before(issued.Add(expires.Sub(issued)*2/3)) {
+		return
+	}
+	if renewable {
+		var res vaultAuthResponse
+		if err := v.do(ctx, "renew_token", http.MethodPost, "/v1/auth/token/renew-self", map[string]string{}, &res); err == nil {
+			v.mu.Lock()
+			v.tokenIssued, v.tokenExpires = time.Now(), expiresIn(res.Auth.LeaseDuration)
+			v.tokenRenewals++
+			v.mu.Unlock()
+			return
+		} else if v.auth == "token" {
+			slog.Warn("vault token renewal failed", "error", err)
+			return
+		}
+	}
+	if v.auth == "kubernetes" {
+		if err := v.login(ctx); err != nil {
+			slog.Warn("vault login failed", "error", err)
+		}
+	}
+}
+
+// due is true once two thirds of the lease have passed
+func (l *vaultLease) due() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.retryAt.IsZero() {
+		return time.Now().After(l.retryAt)
+	}
+	from := cmp.Or(l.lastRenewed, l.issued)
+	return time.Now().After(from.Add(l.expires.Sub(from) * 2 / 3))
+}
+
+// refreshLease renews l, or fetches new credentials once Vault won't
+// extend it any more
+func (v *vaultClient) refreshLease(ctx context.Context, l *vaultLease) {
+	l.mu.Lock()
+	id, renewable, duration := l.id, l.renewable, l.duration
+	l.mu.Unlock()
+	if renewable {
+		var res struct {
+			LeaseDuration int64 `json:"lease_duration"`
+		}
+		body := map[string]any{"lease_id": id, "increment": int64(duration.Seconds())}
+		err := v.do(ctx, "renew", http.MethodPut, "/v1/sys/leases/renew", body, &res)
+		extended := time.Duration(res.LeaseDuration) * time.Second
+		// Near max_ttl Vault renews for what is left; rotate before that runs out
+		if err == nil && extended >= duration/3 {
+			now := time.Now()
+			l.mu.Lock()
+			l.expires, l.lastRenewed, l.lastErr, l.retryAt = now.Add(extended), now, "", time.Time{}
+			l.renewals++
+			l.mu.Unlock()
+			vaultLeaseExpiry.Set(float64(now.Add(extended).Unix()), l.name)
+			return
+		}
+		if err != nil {
+			l.setError(err)
+			slog.Warn("vault lease renewal failed, fetching new credentials", "secret", l.name, "error", err)
+		} else {
+			slog.Info("vault lease near its max TTL, fetching new credentials", "secret", l.name, "left", extended.String())
+		}
+	}
+	if err := v.fetch(ctx, l); err != nil {
+		slog.Warn("vault credentials unavailable, keeping the current ones", "secret", l.name, "error", err)
+		// Try again in a few seconds rather than on every tick
+		l.mu.Lock()
+		l.retryAt = time.Now().Add(5 * time.Second)
+		l.mu.Unlock()
+	}
+}
+
+// Close revokes every lease, so the database drops a stopped pod's users now
+func (v *vaultClient) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	v.mu.Lock()
+	leases := v.leases
+	v.mu.Unlock()
+	for _, l := range leases {
+		l.mu.Lock()
+		id := l.id
+		l.mu.Unlock()
+		if err := v.do(ctx, "revoke", http.MethodPut, "/v1/sys/leases/revoke", map[string]string{"lease_id": id}, nil); err != nil {
+			slog.Warn("vault lease revocation failed; it expires on its own", "secret", l.name, "error", err)
+			continue
+		}
+		slog.Info("vault lease revoked", "secret", l.name)
+	}
+}
+
+func (l *vaultLease) credentials() (string, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.username, l.password
+}
+
+func (l *vaultLease) setError(err error) {
+	l.mu.Lock()
+	l.lastErr = err.Error()
+	l.mu.Unlock()
+}
+
+// do sends one request to Vault, decoding the answer into out
+func (v *vaultClient) do(ctx context.Context, op, method, path string, in, out any) (err error) {
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		vaultRequests.Inc(op, result)
+	}()
+	var body io.Reader
+	if in != nil {
+		data, _ := json.Marshal(in)
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(v.addr.String(), "/")+path, body)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	v.mu.Unlock()
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if res.StatusCode/100 != 2 {
+		var verr struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(data, &verr)
+		return fmt.Errorf("%s %s: %s", op, res.Status, cmp.Or(strings.Join(verr.Errors, "; "), "no details"))
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// secretsLeaseHandler serves GET /api/secrets/lease
+func secretsLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	resp := LeasesResponse{Leases: []LeaseStatus{}, Static: []string{}}
+	if v := vault; v != nil {
+		resp.Enabled, resp.Addr, resp.Auth, resp.Role = true, v.addr.Redacted(), v.auth, v.role
+		v.mu.Lock()
+		token := &VaultTokenStatus{Renewable: v.tokenRenewable, Renewals: v.tokenRenewals}
+		if !v.tokenExpires.IsZero() {
+			expires := v.tokenExpires.UTC()
+			token.ExpiresAt, token.TTLSeconds = &expires, max(time.Until(expires).Round(time.Second).Seconds(), 0)
+		}
+		leases := v.leases
+		v.mu.Unlock()
+		resp.Token = token
+		for _, l := range leases {
+			resp.Leases = append(resp.Leases, l.status())
+		}
+	}
+	for _, name := range []string{"postgres", "redis"} {
+		if vault.find(name) == nil {
+			resp.Static = append(resp.Static, name)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (l *vaultLease) status() LeaseStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := LeaseStatus{Name: l.name, Path: l.path, LeaseID: l.id, Username: l.username, Renewable: l.renewable,
+		Duration: l.duration.String(), IssuedAt: l.issued.UTC(), ExpiresAt: l.expires.UTC(),
+		TTLSeconds: max(time.Until(l.expires).Round(time.Second).Seconds(), 0), Renewals: l.renewals,
+		Rotations: l.rotations, LastError: l.lastErr}
+	if !l.lastRenewed.IsZero() {
+		renewed := l.lastRenewed.UTC()
+		s.LastRenewed = &renewed
+	}
+	return s
+}
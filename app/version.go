@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/michael-jaquier/kubernetes-learning/app/version"
+)
+
+// Build metadata from the version package, which the Dockerfile stamps with
+// -ldflags; the version falls back to APP_VERSION when it wasn't stamped.
+
+// buildInfo resolves the build metadata once
+var buildInfo = sync.OnceValue(func() version.Info {
+	v := version.Get()
+	if v.Version == "" {
+		v.Version = getEnv("APP_VERSION", "1.0.0")
+	}
+	return v
+})
+
+func init() {
+	v := buildInfo()
+	metrics.register(&infoMetric{name: "app_build_info", help: "Build metadata of the running binary.",
+		labels: labelKey([]string{"version", "commit", "build_date"}, []string{v.Version, version.Short(v.GitCommit), v.BuildDate})})
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	v := buildInfo()
+	v.Image = getEnv("IMAGE", "")
+	writeJSON(w, http.StatusOK, v)
+}
+
+// versionLabel is the homepage row for the build
+func versionLabel() string {
+	v := buildInfo()
+	label := v.Version
+	if v.GitCommit != "" {
+		label += " @ " + version.Short(v.GitCommit)
+	}
+	if t, err := time.Parse(time.RFC3339, v.BuildDate); err == nil {
+		label += ", built " + t.UTC().Format("2006-01-02 15:04")
+	}
+	return label
+}
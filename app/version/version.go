@@ -0,0 +1,72 @@
+// Package version holds the build metadata, stamped at build time so a
+// running pod can prove which code it runs - handy when checking that a
+// rollout (or rollback) landed:
+//
+//	go build -ldflags "-X github.com/michael-jaquier/kubernetes-learning/app/version.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/michael-jaquier/kubernetes-learning/app/version.Date=$(date -u +%FT%TZ)"
+//
+// The Dockerfile passes these in as build args. Anything not injected is
+// filled from debug.ReadBuildInfo, which knows the VCS revision when the
+// binary was built inside a git checkout.
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Set with -ldflags -X; empty when not
+var (
+	Version string
+	Commit  string
+	Date    string
+)
+
+// Info describes the running binary
+type Info struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit,omitempty"`
+	GitDirty  bool   `json:"git_dirty,omitempty"` // built with uncommitted changes
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+	Image     string `json:"image,omitempty"` // from the IMAGE env var (Downward API can't expose it)
+}
+
+// Get resolves the build metadata once. Version stays empty unless it was
+// stamped, for the app to fill from its settings.
+var Get = sync.OnceValue(func() Info {
+	v := Info{
+		Version:   Version,
+		GitCommit: Commit,
+		BuildDate: Date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if v.GitCommit == "" {
+					v.GitCommit = s.Value
+				}
+			case "vcs.time":
+				if v.BuildDate == "" {
+					v.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				v.GitDirty = s.Value == "true"
+			}
+		}
+	}
+	return v
+})
+
+// Short is the abbreviated commit for display
+func Short(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// /api/wait holds a request open for as long as asked, to find out who
+// gives up first on a long or idle request. Each hop has its own limit:
+// ingress-nginx's proxy-read-timeout (60s), a cloud load balancer's idle
+// timeout (AWS ELB 60s, GCP 30s backend timeout), the client's own:
+//
+//	curl -i 'localhost:30080/api/wait?seconds=120'                  # cut off at 60s through nginx
+//	curl -i 'localhost:30080/api/wait?seconds=120&keepalive=10s'    # whitespace every 10s keeps it alive
+//
+// A proxy's read timeout counts the time since it last got a byte, so
+// keepalive whitespace (valid before a JSON body) gets past it, at the cost
+// of committing to a 200 before the work is done. Whichever gives up, the
+// request's context is cancelled here: the log line and
+// wait_requests_total{result="cancelled"} show a handler noticing in time.
+// A shutdown ends waits early with result "shutdown", rather than holding
+// the drain for their full length.
+
+// maxWaitSeconds bounds ?seconds=
+const maxWaitSeconds = 3600
+
+// WaitResponse is returned by /api/wait when the client is still there
+type WaitResponse struct {
+	Pod        string  `json:"pod"`
+	Requested  float64 `json:"requested_seconds"`
+	Waited     float64 `json:"waited_seconds"`
+	Result     string  `json:"result"` // completed or shutdown
+	Keepalives int     `json:"keepalives,omitempty"`
+}
+
+var (
+	waitRequests = newCounterVec("wait_requests_total",
+		"Finished /api/wait requests, by result (completed, cancelled by the client or a proxy, shutdown).", "result")
+	waitsActive = newGaugeVec("wait_requests_in_progress", "Requests /api/wait is holding open.")
+)
+
+func init() { waitsActive.Set(0) }
+
+func waitHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	seconds := int64(30)
+	var ok bool
+	if r.URL.Query().Get("seconds") != "" {
+		if seconds, ok = queryInt(w, r, "seconds", 0, maxWaitSeconds); !ok {
+			return
+		}
+	}
+	var keepalive time.Duration
+	if v := r.URL.Query().Get("keepalive"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 100*time.Millisecond {
+			writeProblem(w, r, http.StatusBadRequest, "keepalive must be a duration of at least 100ms, like 10s")
+			return
+		}
+		keepalive = d
+	}
+	waitsActive.Add(1)
+	defer waitsActive.Add(-1)
+	rc := http.NewResponseController(w)
+	// HTTP_WRITE_TIMEOUT would end it before the proxies get a chance to
+	rc.SetWriteDeadline(time.Time{})
+
+	hostname, _ := os.Hostname()
+	requested := time.Duration(seconds) * time.Second
+	start := time.Now()
+	done := time.NewTimer(requested)
+	defer done.Stop()
+	var tick <-chan time.Time
+	if keepalive > 0 {
+		ticker := time.NewTicker(keepalive)
+		defer ticker.Stop()
+		tick = ticker.C
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Accel-Buffering", "no") // nginx: pass each space on
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+	}
+
+	resp := WaitResponse{Pod: hostname, Requested: requested.Seconds()}
+	for resp.Result == "" {
+		select {
+		case <-done.C:
+			resp.Result = "completed"
+		case <-streamsClosing:
+			resp.Result = "shutdown"
+		case <-tick:
+			w.Write([]byte(" "))
+			rc.Flush()
+			resp.Keepalives++
+		case <-r.Context().Done():
+			waitRequests.Inc("cancelled")
+			slog.Info("wait cancelled", "waited", time.Since(start).Round(time.Millisecond).String(),
+				"requested", requested.String(), "keepalives", resp.Keepalives, "reason", context.Cause(r.Context()).Error())
+			return
+		}
+	}
+	waitRequests.Inc(resp.Result)
+	resp.Waited = time.Since(start).Round(time.Millisecond).Seconds()
+	if keepalive > 0 {
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WAIT_FOR holds startup until the app's dependencies answer, instead of
+// an initContainer running `until nc -z postgres 5432; do sleep 2; done`:
+//
+//	WAIT_FOR=postgres:5432,http://go-app-redis-exporter:9121/health
+//	WAIT_FOR_BACKOFF=500ms        first retry delay, doubled after each failure
+//	WAIT_FOR_MAX_BACKOFF=30s      cap on the delay
+//	WAIT_FOR_TIMEOUT=5m           exit 1 if they still don't answer (0: wait forever)
+//	curl -s localhost:8080/api/startup | jq '.targets[] | {target, status, attempts, last_error}'
+//
+// An http(s) URL must answer a GET below 400; anything else is a host:port
+// (tcp:// optional) that must accept a connection. Targets are checked in
+// parallel, each with its own backoff, and every attempt is logged. Until
+// all of them pass, /startup and /ready fail as they do during
+// STARTUP_DELAY, which only starts counting afterwards. Unlike an init
+// container, the server is already up: /api/startup shows what it is
+// waiting for, and a timeout is a container exit the kubelet restarts with
+// a termination message naming the targets.
+
+// waitHistoryLen bounds the attempts remembered per target
+const waitHistoryLen = 20
+
+// WaitAttempt is one check of a WAIT_FOR target
+type WaitAttempt struct {
+	Attempt    int       `json:"attempt"`
+	At         time.Time `json:"at"`
+	DurationMS int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+	Backoff    string    `json:"backoff,omitempty"` // wait before the next attempt
+}
+
+// WaitTarget is one WAIT_FOR entry and its attempts
+type WaitTarget struct {
+	Target     string        `json:"target"`
+	Kind       string        `json:"kind"`   // tcp or http
+	Status     string        `json:"status"` // waiting, ok or gave_up
+	Attempts   int           `json:"attempts"`
+	ReadyAfter string        `json:"ready_after,omitempty"`
+	LastError  string        `json:"last_error,omitempty"`
+	History    []WaitAttempt `json:"history"` // the last 20, oldest first
+
+	check ReadinessChecker
+}
+
+// StartupWaitResponse is returned by /api/startup
+type StartupWaitResponse struct {
+	Status     string       `json:"status"` // waiting, done or gave_up
+	Started    bool         `json:"started"`
+	StartedAt  time.Time    `json:"started_at"`
+	Elapsed    string       `json:"elapsed"`
+	Timeout    string       `json:"timeout,omitempty"`
+	Backoff    string       `json:"backoff,omitempty"`
+	MaxBackoff string       `json:"max_backoff,omitempty"`
+	Targets    []WaitTarget `json:"targets"`
+}
+
+// startupWait checks the WAIT_FOR targets until they all pass
+type startupWait struct {
+	backoff, maxBackoff, timeout time.Duration
+
+	mu         sync.Mutex
+	start, end time.Time
+	status     string
+	targets    []*WaitTarget
+}
+
+var (
+	dependencyWait *startupWait // nil without WAIT_FOR
+
+	waitForAttempts = newCounterVec("startup_wait_attempts_total",
+		"WAIT_FOR checks at startup, by target and result (ok, failed).", "target", "result")
+)
+
+// parseWaitFor reads WAIT_FOR entries
+func parseWaitFor(spec string) ([]*WaitTarget, error) {
+	var targets []*WaitTarget
+	for _, item := range splitList(spec) {
+		t := &WaitTarget{Target: item, Status: "waiting", History: []WaitAttempt{}}
+		switch {
+		case strings.HasPrefix(item, "http://"), strings.HasPrefix(item, "https://"):
+			t.Kind, t.check = "http", httpCheck{url: item}
+		default:
+			addr := strings.TrimPrefix(item, "tcp://")
+			if host, port, err := net.SplitHostPort(addr); err != nil || host == "" || port == "" {
+				return nil, fmt.Errorf("%q: want an http(s) URL or host:port", item)
+			}
+			t.Kind, t.check = "tcp", tcpCheck{addr: addr}
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// newStartupWaitFromEnv reads the WAIT_FOR settings; nil without targets
+func newStartupWaitFromEnv() (*startupWait, error) {
+	targets, err := parseWaitFor(getEnv("WAIT_FOR", ""))
+	if err != nil || len(targets) == 0 {
+		return nil, err
+	}
+	w := &startupWait{
+		backoff:    getEnvDuration("WAIT_FOR_BACKOFF", 500*time.Millisecond),
+		maxBackoff: getEnvDuration("WAIT_FOR_MAX_BACKOFF", 30*time.Second),
+		timeout:    getEnvDuration("WAIT_FOR_TIMEOUT", 0),
+		status:     "waiting",
+		targets:    targets,
+	}
+	if w.backoff <= 0 || w.maxBackoff < w.backoff {
+		return nil, fmt.Errorf("WAIT_FOR_BACKOFF must be positive and at most WAIT_FOR_MAX_BACKOFF")
+	}
+	return w, nil
+}
+
+// Run checks every target until all pass, and reports whether they did
+// before the timeout
+func (w *startupWait) Run() bool {
+	ctx := context.Background()
+	w.mu.Lock()
+	w.start = time.Now()
+	w.mu.Unlock()
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+	slog.Info("waiting for dependencies", "targets", w.names(), "timeout", w.timeout.String())
+
+	var wg sync.WaitGroup
+	for _, t := range w.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.waitFor(ctx, t)
+		}()
+	}
+	wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.end = time.Now()
+	elapsed := w.end.Sub(w.start).Round(time.Millisecond).String()
+	if ctx.Err() != nil {
+		w.status = "gave_up"
+		for _, t := range w.targets {
+			if t.Status == "waiting" {
+				t.Status = "gave_up"
+			}
+		}
+		return false
+	}
+	w.status = "done"
+	slog.Info("dependencies ready", "targets", len(w.targets), "after", elapsed)
+	return true
+}
+
+// waitFor checks t with exponential backoff until it passes or ctx ends
+func (w *startupWait) waitFor(ctx context.Context, t *WaitTarget) {
+	delay := w.backoff
+	for attempt := 1; ; attempt++ {
+		checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+		start := time.Now()
+		err := t.check.Check(checkCtx)
+		cancel()
+		a := WaitAttempt{Attempt: attempt, At: start, DurationMS: time.Since(start).Milliseconds()}
+		if err != nil {
+			a.Error, a.Backoff = err.Error(), delay.String()
+			waitForAttempts.Inc(t.Target, "failed")
+			slog.Warn("dependency not ready", "target", t.Target, "attempt", attempt, "error", err, "retry_in", delay.String())
+		} else {
+			waitForAttempts.Inc(t.Target, "ok")
+			slog.Info("dependency ready", "target", t.Target, "attempt", attempt)
+		}
+
+		w.mu.Lock()
+		t.Attempts = attempt
+		t.History = append(t.History, a)
+		if len(t.History) > waitHistoryLen {
+			t.History = t.History[len(t.History)-waitHistoryLen:]
+		}
+		t.LastError = a.Error
+		if err == nil {
+			t.Status, t.ReadyAfter = "ok", time.Since(w.start).Round(time.Millisecond).String()
+		}
+		w.mu.Unlock()
+		if err == nil {
+			return
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(delay*2, w.maxBackoff)
+	}
+}
+
+// names are the targets' entries, for logs
+func (w *startupWait) names() []string {
+	names := make([]string, len(w.targets))
+	for i, t := range w.targets {
+		names[i] = t.Target
+	}
+	return names
+}
+
+// Pending returns the targets that haven't passed yet
+func (w *startupWait) Pending() []string {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var pending []string
+	for _, t := range w.targets {
+		if t.Status != "ok" {
+			pending = append(pending, t.Target)
+		}
+	}
+	return pending
+}
+
+// Snapshot returns a copy of the wait's state
+func (w *startupWait) Snapshot() StartupWaitResponse {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	resp := StartupWaitResponse{Status: w.status, Started: started.Load(), StartedAt: w.start,
+		Backoff: w.backoff.String(), MaxBackoff: w.maxBackoff.String(), Targets: make([]WaitTarget, len(w.targets))}
+	if w.timeout > 0 {
+		resp.Timeout = w.timeout.String()
+	}
+	if !w.end.IsZero() {
+		resp.Elapsed = w.end.Sub(w.start).Round(time.Millisecond).String()
+	} else if !w.start.IsZero() {
+		resp.Elapsed = time.Since(w.start).Round(time.Millisecond).String()
+	}
+	for i, t := range w.targets {
+		resp.Targets[i] = *t
+		resp.Targets[i].History = append([]WaitAttempt(nil), t.History...)
+	}
+	return resp
+}
+
+// startupWaitHandler serves /api/startup
+func startupWaitHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	if dependencyWait == nil {
+		writeJSON(w, http.StatusOK, StartupWaitResponse{Status: "done", Started: started.Load(), StartedAt: startTime, Targets: []WaitTarget{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, dependencyWait.Snapshot())
+}
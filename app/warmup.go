@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+)
+
+// ready gates the readiness probe. It starts false so a pod is only added
+// to Service endpoints once startup work (such as warm-up) has finished.
+var ready atomic.Bool
+
+// started gates the startup probe. Unlike ready it never goes back to
+// false: a startupProbe only runs until it first succeeds, after which
+// liveness and readiness take over. STARTUP_DELAY simulates a slow start
+// (loading a model, priming caches) so you can watch a startupProbe hold
+// off the liveness probe that would otherwise restart the container:
+//
+//	STARTUP_DELAY=45s -> /startup and /ready return 503 for 45s
+var started atomic.Bool
+
+// startupDone is when STARTUP_DELAY ends, for the homepage countdown
+var startupDone atomic.Int64
+
+// StartupStatus is returned by /startup
+type StartupStatus struct {
+	Status           string   `json:"status"`
+	RemainingSeconds float64  `json:"remaining_seconds,omitempty"`
+	WaitingFor       []string `json:"waiting_for,omitempty"` // WAIT_FOR targets not answering yet
+}
+
+// startUp waits for the WAIT_FOR dependencies, waits out delay, runs the
+// optional warm-up, then marks the pod started and ready. A failed warm-up
+// with required set leaves it neither; dependencies that don't answer
+// before WAIT_FOR_TIMEOUT end the process.
+func startUp(deps *startupWait, delay time.Duration, warmup func() error, required bool) {
+	if deps != nil && !deps.Run() {
+		fatal("dependencies not ready before WAIT_FOR_TIMEOUT", "waiting_for", deps.Pending(), "timeout", deps.timeout.String())
+		return
+	}
+	startupDone.Store(time.Now().Add(delay).UnixNano())
+	if delay > 0 {
+		slog.Info("simulating slow startup", "startup_delay", delay.String())
+		time.Sleep(delay)
+	}
+	if warmup != nil {
+		start := time.Now()
+		err := warmup()
+		slog.Info("warm-up finished", "duration", time.Since(start).String())
+		if err != nil {
+			slog.Warn("warm-up failed", "error", err)
+			if required {
+				slog.Error("WARMUP_REQUIRED is set, staying not ready")
+				return
+			}
+		}
+	}
+	started.Store(true)
+	ready.Store(true)
+	notifyReloadReady()
+	slog.Info("startup complete", "after", time.Since(startTime).Round(time.Millisecond).String())
+	podEvents.Record("Normal", "StartupComplete", "ready to serve after "+time.Since(startTime).Round(time.Millisecond).String())
+}
+
+// startupHandler is the startupProbe endpoint
+func startupHandler(w http.ResponseWriter, r *http.Request) {
+	if started.Load() {
+		writeJSON(w, http.StatusOK, StartupStatus{Status: "started"})
+		return
+	}
+	writeJSON(w, http.StatusServiceUnavailable, StartupStatus{Status: "starting", RemainingSeconds: startupRemaining().Seconds(),
+		WaitingFor: dependencyWait.Pending()})
+}
+
+// startupRemaining is what's left of STARTUP_DELAY, rounded to seconds
+func startupRemaining() time.Duration {
+	return max(time.Until(time.Unix(0, startupDone.Load())).Round(time.Second), 0)
+}
+
+// startupNotice is the time left for the homepage's "warming up" notice,
+// "" once started
+func startupNotice() string {
+	if started.Load() {
+		return ""
+	}
+	return startupRemaining().String()
+}
+
+// warmupPaths are exercised once at startup to pay cold-start costs
+// (first-use allocations, lazy init) before real traffic arrives
+var warmupPaths = []string{"/", "/api/info", "/static/style.css"}
+
+// warmUp sends in-process requests through handler and returns the first
+// failure. Requests never leave the process, so warm-up works the same with
+// TLS or mTLS enabled.
+func warmUp(handler http.Handler, paths []string) error {
+	for _, path := range paths {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "127.0.0.1:0"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code >= http.StatusInternalServerError {
+			return fmt.Errorf("warm-up %s returned %d", path, rec.Code)
+		}
+	}
+	return nil
+}
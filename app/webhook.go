@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// webhook mode is an admission webhook: the API server sends it every
+// matching create or update as an AdmissionReview before storing it, and
+// the answer allows, denies or patches the object.
+//
+//	app webhook -addr=:8443 -tls-cert=/etc/webhook/tls/tls.crt -tls-key=/etc/webhook/tls/tls.key
+//
+//	POST /validate   deny workloads whose containers have no CPU and memory limits
+//	POST /mutate     add a label (-label, demo.go-app/admitted=true) to the object
+//
+// The API server only talks HTTPS, and checks the certificate against the
+// caBundle in the webhook configuration; cert-manager can fill that in
+// (see k8s/advanced/admission-webhook.yaml). Webhooks sit in the path of
+// every matching write, so a broken one blocks deploys cluster-wide unless
+// failurePolicy is Ignore and the namespaceSelector keeps it scoped.
+
+// admissionReview is the admission.k8s.io/v1 AdmissionReview envelope
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+// admissionRequest is the subset of the request the webhook reads
+type admissionRequest struct {
+	UID  string `json:"uid"`
+	Kind struct {
+		Group   string `json:"group"`
+		Version string `json:"version"`
+		Kind    string `json:"kind"`
+	} `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Operation string `json:"operation"` // CREATE, UPDATE, DELETE or CONNECT
+	UserInfo  struct {
+		Username string `json:"username"`
+	} `json:"userInfo"`
+	Object json.RawMessage `json:"object"`
+	DryRun *bool           `json:"dryRun,omitempty"`
+}
+
+// admissionResponse is the webhook's verdict
+type admissionResponse struct {
+	UID       string           `json:"uid"`
+	Allowed   bool             `json:"allowed"`
+	Result    *admissionStatus `json:"status,omitempty"`
+	Patch     []byte           `json:"patch,omitempty"` // base64 in JSON, as the API expects
+	PatchType string           `json:"patchType,omitempty"`
+	Warnings  []string         `json:"warnings,omitempty"`
+}
+
+// admissionStatus is the metav1.Status shown to kubectl on a denial
+type admissionStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// jsonPatchOp is one RFC 6902 operation
+type jsonPatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+// admissionObject is what the webhook needs from any workload: its labels
+// and wherever its pod spec lives
+type admissionObject struct {
+	Metadata struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		podSpec
+		Template    *podTemplate `json:"template"` // Deployments, StatefulSets, DaemonSets, Jobs...
+		JobTemplate *struct {
+			Spec struct {
+				Template *podTemplate `json:"template"`
+			} `json:"spec"`
+		} `json:"jobTemplate"` // CronJobs
+	} `json:"spec"`
+}
+
+type podTemplate struct {
+	Spec podSpec `json:"spec"`
+}
+
+// podSpec is the part of a pod spec the limits check reads
+type podSpec struct {
+	Containers     []admissionContainer `json:"containers"`
+	InitContainers []admissionContainer `json:"initContainers"`
+}
+
+type admissionContainer struct {
+	Name      string `json:"name"`
+	Resources struct {
+		Limits map[string]string `json:"limits"`
+	} `json:"resources"`
+}
+
+// podSpec returns the object's pod spec, wherever the kind keeps it
+func (o *admissionObject) podSpec() podSpec {
+	switch {
+	case o.Spec.Template != nil:
+		return o.Spec.Template.Spec
+	case o.Spec.JobTemplate != nil && o.Spec.JobTemplate.Spec.Template != nil:
+		return o.Spec.JobTemplate.Spec.Template.Spec
+	}
+	return o.Spec.podSpec
+}
+
+// missingLimits lists "container: cpu, memory" for every container without
+// both limits. Init containers count too: they run in the same quota.
+func missingLimits(spec podSpec) []string {
+	var problems []string
+	for _, c := range append(append([]admissionContainer{}, spec.InitContainers...), spec.Containers...) {
+		var missing []string
+		for _, resource := range []string{"cpu", "memory"} {
+			if c.Resources.Limits[resource] == "" {
+				missing = append(missing, resource)
+			}
+		}
+		if len(missing) > 0 {
+			problems = append(problems, c.Name+": "+strings.Join(missing, ", "))
+		}
+	}
+	return problems
+}
+
+// validateLimits denies objects with containers lacking limits
+func validateLimits(req *admissionRequest) *admissionResponse {
+	resp := &admissionResponse{UID: req.UID, Allowed: true}
+	if req.Operation == "DELETE" || len(req.Object) == 0 {
+		return resp
+	}
+	var obj admissionObject
+	if err := json.Unmarshal(req.Object, &obj); err != nil {
+		resp.Allowed = false
+		resp.Result = &admissionStatus{Code: http.StatusBadRequest, Message: "cannot decode object: " + err.Error()}
+		return resp
+	}
+	spec := obj.podSpec()
+	if len(spec.Containers) == 0 {
+		resp.Warnings = []string{"go-app webhook: no pod spec found in " + req.Kind.Kind + ", not checked"}
+		return resp
+	}
+	if problems := missingLimits(spec); len(problems) > 0 {
+		resp.Allowed = false
+		resp.Result = &admissionStatus{Code: http.StatusForbidden,
+			Message: fmt.Sprintf("%s %s: every container needs CPU and memory limits; missing %s", req.Kind.Kind, req.Name, strings.Join(problems, "; "))}
+	}
+	return resp
+}
+
+// labelPatch adds key=value to the object's labels as a JSON patch
+func labelPatch(req *admissionRequest, key, value string) *admissionResponse {
+	resp := &admissionResponse{UID: req.UID, Allowed: true}
+	if req.Operation == "DELETE" || len(req.Object) == 0 {
+		return resp
+	}
+	var obj admissionObject
+	if err := json.Unmarshal(req.Object, &obj); err != nil {
+		resp.Result = &admissionStatus{Code: http.StatusBadRequest, Message: "cannot decode object: " + err.Error()}
+		resp.Allowed = false
+		return resp
+	}
+	if obj.Metadata.Labels[key] == value {
+		return resp
+	}
+	var ops []jsonPatchOp
+	if obj.Metadata.Labels == nil {
+		ops = []jsonPatchOp{{Op: "add", Path: "/metadata/labels", Value: map[string]string{key: value}}}
+	} else {
+		// JSON Pointer escapes ~ and /, which label keys with a prefix contain
+		escaped := strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+		ops = []jsonPatchOp{{Op: "add", Path: "/metadata/labels/" + escaped, Value: value}}
+	}
+	resp.Patch, _ = json.Marshal(ops)
+	resp.PatchType = "JSONPatch"
+	return resp
+}
+
+// admissionHandler decodes an AdmissionReview, runs review and answers
+// with the same envelope
+func admissionHandler(name string, review func(*admissionRequest) *admissionResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodPost) {
+			return
+		}
+		var ar admissionReview
+		if err := json.NewDecoder(io.LimitReader(r.Body, 8<<20)).Decode(&ar); err != nil || ar.Request == nil {
+			writeProblem(w, r, http.StatusBadRequest, "expected an AdmissionReview with a request")
+			return
+		}
+		req := ar.Request
+		resp := review(req)
+		attrs := []any{"webhook", name, "uid", req.UID, "operation", req.Operation, "kind", req.Kind.Kind,
+			"namespace", req.Namespace, "name", req.Name, "user", req.UserInfo.Username, "allowed", resp.Allowed}
+		if resp.Patch != nil {
+			attrs = append(attrs, "patch", string(resp.Patch))
+		}
+		if resp.Result != nil {
+			attrs = append(attrs, "reason", resp.Result.Message)
+		}
+		slog.Info("admission review", attrs...)
+		writeJSON(w, http.StatusOK, admissionReview{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview", Response: resp})
+	}
+}
+
+func runWebhook(args []string) int {
+	fs := newFlagSet("webhook", "")
+	addr := fs.String("addr", getEnv("WEBHOOK_ADDR", ":8443"), "listen address")
+	certFile := fs.String("tls-cert", getEnv("TLS_CERT_FILE", "/etc/webhook/tls/tls.crt"), "serving certificate")
+	keyFile := fs.String("tls-key", getEnv("TLS_KEY_FILE", "/etc/webhook/tls/tls.key"), "serving key")
+	label := fs.String("label", getEnv("WEBHOOK_LABEL", "demo.go-app/admitted=true"), "key=value label /mutate adds")
+	fs.Parse(args)
+	labelKey, labelValue, ok := strings.Cut(*label, "=")
+	if !ok || labelKey == "" {
+		fmt.Fprintln(os.Stderr, "-label must be key=value")
+		return 2
+	}
+
+	setupLogging(getEnv("LOG_LEVEL", "info"))
+	certs, err := newCertReloader(*certFile, *keyFile)
+	if err != nil {
+		slog.Error("webhooks must serve HTTPS", "error", err)
+		return 1
+	}
+	go certs.Watch(getEnvDuration("TLS_RELOAD_INTERVAL", 30*time.Second))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", admissionHandler("validate", validateLimits))
+	mux.HandleFunc("/mutate", admissionHandler("mutate", func(req *admissionRequest) *admissionResponse {
+		return labelPatch(req, labelKey, labelValue)
+	}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           mux,
+		TLSConfig:         &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12},
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServeTLS("", "") }()
+	slog.Info("admission webhook listening", "addr", *addr, "paths", []string{"/validate", "/mutate", "/healthz"}, "label", *label)
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("webhook server failed", "error", err)
+			return 1
+		}
+	case <-ctx.Done():
+		slog.Info("shutting down webhook")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}
+	return 0
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal server side of the WebSocket protocol (RFC 6455): the upgrade
+// handshake, unfragmented text frames out, and enough of the read side to
+// answer pings, notice when the client closes and take the short,
+// unfragmented text messages /ws/chat gets. That is all a stream like
+// /ws/stats needs.
+
+// websocketGUID is the fixed value from RFC 6455 mixed into the accept key
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// Close status codes
+const (
+	wsNormalClosure = 1000
+	wsGoingAway     = 1001 // server shutting down
+)
+
+// maxWSControlFrame is the RFC 6455 limit for control frame payloads; data
+// frames from clients are read at most this big too, unless the endpoint
+// expects client messages and reads them with readMessage
+const maxWSControlFrame = 125
+
+// wsConn is an upgraded WebSocket connection
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu sync.Mutex // serializes writes
+}
+
+// upgradeWebSocket completes the handshake and takes over the connection.
+// On failure it has already written an HTTP error response.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		w.Header().Set("Upgrade", "websocket")
+		writeProblem(w, r, http.StatusUpgradeRequired, "this endpoint needs a WebSocket client")
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeProblem(w, r, http.StatusBadRequest, "unsupported WebSocket version")
+		return nil, errors.New("unsupported websocket version")
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "connection can't be upgraded")
+		return nil, err
+	}
+	// The server's read/write deadlines don't apply once hijacked
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// headerContains reports whether a comma-separated header has token,
+// ignoring case (browsers send "Connection: keep-alive, Upgrade")
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeFrame sends one unmasked, unfragmented frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = binary.BigEndian.AppendUint16(append(header, 126), uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 127), uint64(n))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(append(header, payload...))
+	return err
+}
+
+// WriteText sends a text message
+func (c *wsConn) WriteText(msg []byte) error { return c.writeFrame(wsText, msg) }
+
+// Close sends a close frame with code and closes the connection
+func (c *wsConn) Close(code uint16) error {
+	c.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, code))
+	return c.conn.Close()
+}
+
+// readLoop discards client data, answers pings, and returns when the client
+// closes the connection or it breaks
+func (c *wsConn) readLoop() error {
+	for {
+		if _, err := c.readMessage(maxWSControlFrame); err != nil {
+			return err
+		}
+	}
+}
+
+// readMessage returns the next text or binary message of at most limit
+// bytes, answering pings on the way; io.EOF means the client closed
+func (c *wsConn) readMessage(limit uint64) ([]byte, error) {
+	for {
+		opcode, payload, err := c.readFrame(max(limit, maxWSControlFrame))
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsClose:
+			return nil, io.EOF
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		default:
+			return payload, nil
+		}
+	}
+}
+
+// readFrame reads one client frame of at most limit bytes, which RFC 6455
+// requires to be masked
+func (c *wsConn) readFrame(limit uint64) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode, masked := head[0]&0x0F, head[1]&0x80 != 0
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if !masked {
+		return 0, nil, errors.New("websocket: unmasked client frame")
+	}
+	if size > limit {
+		return 0, nil, errors.New("websocket: client frame too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// /api/whoami tells the caller who the server thinks they are. With JWT
+// authentication on (see jwtauth.go) that's the validated token. With raw
+// mTLS (MTLS_CA_FILE) that's the client certificate verified during the
+// handshake. Behind a service mesh the sidecar terminates mTLS instead, so
+// the connection here is plain HTTP and the identity arrives in a header
+// (Envoy/Istio's X-Forwarded-Client-Cert) - compare the two:
+//
+//	curl --cacert ca.crt --cert client.crt --key client.key https://localhost:8443/api/whoami
+
+// ClientCert describes a certificate presented by the client
+type ClientCert struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	URIs      []string  `json:"uris,omitempty"` // SPIFFE IDs live here: spiffe://cluster.local/ns/go-demo/sa/go-app
+}
+
+// WhoamiResponse is returned by /api/whoami
+type WhoamiResponse struct {
+	Authenticated bool        `json:"authenticated"`
+	Method        string      `json:"method"` // jwt, mtls, mesh or none
+	CommonName    string      `json:"common_name,omitempty"`
+	Certificate   *ClientCert `json:"certificate,omitempty"`
+	Chain         []string    `json:"chain,omitempty"` // subjects from the client cert up to our CA
+	TLSVersion    string      `json:"tls_version,omitempty"`
+	CipherSuite   string      `json:"cipher_suite,omitempty"`
+	ForwardedCert string      `json:"forwarded_client_cert,omitempty"` // X-Forwarded-Client-Cert from a mesh sidecar
+	Token         *TokenInfo  `json:"token,omitempty"`
+	RemoteAddr    string      `json:"remote_addr"`
+}
+
+// TokenInfo is a bearer token that passed validation
+type TokenInfo struct {
+	Algorithm string         `json:"algorithm"`
+	KeyID     string         `json:"key_id,omitempty"`
+	Subject   string         `json:"subject,omitempty"`
+	Issuer    string         `json:"issuer,omitempty"`
+	Audience  []string       `json:"audience,omitempty"`
+	ExpiresAt *time.Time     `json:"expires_at,omitempty"`
+	Scopes    []string       `json:"scopes,omitempty"`
+	Claims    map[string]any `json:"claims"`
+}
+
+func whoamiHandler(w http.ResponseWriter, r *http.Request) {
+	resp := WhoamiResponse{
+		Method:        "none",
+		RemoteAddr:    r.RemoteAddr,
+		ForwardedCert: r.Header.Get("X-Forwarded-Client-Cert"),
+	}
+	if r.TLS != nil {
+		resp.TLSVersion = tls.VersionName(r.TLS.Version)
+		resp.CipherSuite = tls.CipherSuiteName(r.TLS.CipherSuite)
+	}
+	switch t := jwtFromContext(r.Context()); {
+	case t != nil:
+		resp.Authenticated, resp.Method = true, "jwt"
+		resp.Token = &TokenInfo{
+			Algorithm: t.Alg,
+			KeyID:     t.Kid,
+			Subject:   t.Claims.Subject,
+			Issuer:    t.Claims.Issuer,
+			Audience:  t.Claims.Audience,
+			ExpiresAt: unixTime(t.Claims.ExpiresAt),
+			Scopes:    append(strings.Fields(t.Claims.Scope), t.Claims.Scp...),
+			Claims:    t.Raw,
+		}
+	case r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0:
+		chain := r.TLS.VerifiedChains[0]
+		resp.Authenticated, resp.Method = true, "mtls"
+		resp.CommonName = clientCommonName(r)
+		resp.Certificate = describeCert(chain[0])
+		for _, cert := range chain {
+			resp.Chain = append(resp.Chain, cert.Subject.String())
+		}
+	case resp.ForwardedCert != "":
+		// Trusted only because the sidecar is the sole way into the pod
+		resp.Authenticated, resp.Method = true, "mesh"
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func describeCert(cert *x509.Certificate) *ClientCert {
+	c := &ClientCert{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		Serial:    cert.SerialNumber.Text(16),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		DNSNames:  cert.DNSNames,
+	}
+	for _, uri := range cert.URIs {
+		c.URIs = append(c.URIs, uri.String())
+	}
+	return c
+}